@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+
+	goFlags "github.com/jessevdk/go-flags"
+	"gopkg.in/yaml.v2"
+)
+
+// loadOptions applies the DNSPROXY_* environment variables and the config file to the options parsed by the parser.
+// The flags override the environment variables, and they override the config file.
+func loadOptions(parser *goFlags.Parser, options *Options) error {
+	skip := flagsSet(parser)
+	envSet, err := loadEnv(skip, options)
+	if err != nil {
+		return err
+	}
+	for name := range envSet {
+		skip[name] = true
+	}
+
+	if options.ConfigPath != "" {
+		err = loadConfigFile(options.ConfigPath, skip, options)
+		if err != nil {
+			return fmt.Errorf("cannot load the config file %s: %s", options.ConfigPath, err)
+		}
+	}
+	return nil
+}
+
+// loadConfigFile reads the YAML config file into the options.
+// The keys of the file are the long flag names, the fields in skip (set with the flags or the environment) aren't changed.
+// Returns an error naming the key if the file has unknown keys.
+func loadConfigFile(path string, skip map[string]bool, options *Options) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	fileOptions := Options{}
+	err = yaml.UnmarshalStrict(data, &fileOptions)
+	if err != nil {
+		return err
+	}
+	// the keys of the file, so the values equal to the zero values are applied too
+	keys := map[string]interface{}{}
+	err = yaml.Unmarshal(data, &keys)
+	if err != nil {
+		return err
+	}
+
+	v := reflect.ValueOf(options).Elem()
+	fileValue := reflect.ValueOf(fileOptions)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if _, ok := keys[key]; !ok || skip[f.Name] {
+			continue
+		}
+		v.Field(i).Set(fileValue.Field(i))
+	}
+	return nil
+}
+
+// flagsSet returns the names of the fields of the options set with the command-line flags
+func flagsSet(parser *goFlags.Parser) map[string]bool {
+	set := map[string]bool{}
+	addFlagsSet(parser.Command.Group, set)
+	return set
+}
+
+// addFlagsSet adds the names of the fields of the options set with the command-line flags in the group and its subgroups
+func addFlagsSet(g *goFlags.Group, flagsSet map[string]bool) {
+	for _, o := range g.Options() {
+		if o.IsSet() && !o.IsSetDefault() {
+			flagsSet[o.Field().Name] = true
+		}
+	}
+	for _, sub := range g.Groups() {
+		addFlagsSet(sub, flagsSet)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	goFlags "github.com/jessevdk/go-flags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// parseTestOptions parses the command-line arguments and the config file
+func parseTestOptions(t *testing.T, config string, args ...string) (Options, error) {
+	dir, err := ioutil.TempDir("", "dnsproxy-config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(config), 0o644))
+
+	options := Options{}
+	parser := goFlags.NewParser(&options, goFlags.Default)
+	_, err = parser.ParseArgs(append(args, "--config-path="+path))
+	require.NoError(t, err)
+	err = loadConfigFile(options.ConfigPath, flagsSet(parser), &options)
+	return options, err
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	config := `
+listen: 127.0.0.1
+port: 5353
+upstream:
+  - 8.8.8.8
+  - "[/lan/]192.168.1.1"
+cache: true
+cache-size: 1024
+ratelimit: 0
+`
+	options, err := parseTestOptions(t, config, "-p", "53", "--ratelimit=10")
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", options.ListenAddr)
+	assert.Equal(t, []string{"8.8.8.8", "[/lan/]192.168.1.1"}, options.Upstreams)
+	assert.True(t, options.Cache)
+	assert.Equal(t, 1024, options.CacheSizeBytes)
+
+	// the flags override the file values, even if they are equal to the defaults
+	assert.Equal(t, 53, options.ListenPort)
+	assert.Equal(t, 10, options.Ratelimit)
+
+	// the lists aren't merged
+	options, err = parseTestOptions(t, config, "-u", "1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.1.1.1"}, options.Upstreams)
+	assert.Equal(t, 5353, options.ListenPort)
+
+	// the defaults are kept for the keys that aren't in the file
+	assert.Equal(t, uint32(10800), options.CacheMaxNegativeTTL)
+}
+
+func TestLoadConfigFileInvalid(t *testing.T) {
+	_, err := parseTestOptions(t, "upstream: [8.8.8.8]\nunknown-key: 1\n")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown-key")
+
+	_, err = parseTestOptions(t, "port: abc\n")
+	assert.Error(t, err)
+
+	// the command-line only options can't be set in the file
+	_, err = parseTestOptions(t, "config-path: other.yaml\n")
+	assert.Error(t, err)
+}
+
+func TestLoadOptionsPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy-config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte("upstream: [8.8.8.8]\nport: 5353\nratelimit: 5\ncache: true\n"), 0o644))
+
+	// the config file path can be set in the environment too
+	defer setTestEnv(t, map[string]string{
+		"DNSPROXY_CONFIG_PATH": path,
+		"DNSPROXY_PORT":        "5454",
+		"DNSPROXY_RATELIMIT":   "20",
+	})()
+
+	options := Options{}
+	parser := goFlags.NewParser(&options, goFlags.Default)
+	_, err = parser.ParseArgs([]string{"--ratelimit=10"})
+	require.NoError(t, err)
+	require.NoError(t, loadOptions(parser, &options))
+
+	assert.Equal(t, []string{"8.8.8.8"}, options.Upstreams)
+	assert.True(t, options.Cache)
+	assert.Equal(t, 5454, options.ListenPort)
+	assert.Equal(t, 10, options.Ratelimit)
+}
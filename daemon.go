@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+)
+
+// shutdownTimeout is how long the queries in progress are waited for on SIGINT and SIGTERM
+const shutdownTimeout = 5 * time.Second
+
+// writePIDFile writes the PID of the process to the file.
+// Returns an error if the file contains the PID of another running process.
+func writePIDFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		pid, perr := strconv.Atoi(strings.TrimSpace(string(data)))
+		if perr == nil && pid != os.Getpid() && processExists(pid) {
+			return fmt.Errorf("dnsproxy is already running with PID %d (see the PID file %s)", pid, path)
+		}
+	} else if !os.IsNotExist(err) {
+		return errorx.Decorate(err, "couldn't read the PID file")
+	}
+
+	err = ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+	if err != nil {
+		return errorx.Decorate(err, "couldn't write the PID file")
+	}
+	return nil
+}
+
+// removePIDFile removes the PID file, the errors are logged
+func removePIDFile(path string) {
+	err := os.Remove(path)
+	if err != nil {
+		log.Printf("cannot remove the PID file: %s", err)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWritePIDFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy-pidfile")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dnsproxy.pid")
+
+	require.NoError(t, writePIDFile(path))
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(os.Getpid())+"\n", string(data))
+
+	// the PID of a running process
+	require.NoError(t, ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getppid())), 0644))
+	err = writePIDFile(path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "already running with PID "+strconv.Itoa(os.Getppid()))
+
+	// a stale or an invalid PID file is overwritten
+	require.NoError(t, ioutil.WriteFile(path, []byte("invalid"), 0644))
+	require.NoError(t, writePIDFile(path))
+
+	removePIDFile(path)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix is the prefix of the environment variables of the options
+const envPrefix = "DNSPROXY_"
+
+// redacted replaces the values of the secret options in the effective configuration
+const redacted = "********"
+
+// envName returns the name of the environment variable of the long flag name, e.g. DNSPROXY_CACHE_SIZE for cache-size
+func envName(long string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(long, "-", "_", -1))
+}
+
+// loadEnv sets the options from the DNSPROXY_* environment variables, the fields in skip
+// (set with the command-line flags) aren't changed. The lists are comma- or newline-separated.
+// Returns the names of the fields that are set. Returns an error naming the variable if its value is invalid.
+func loadEnv(skip map[string]bool, options *Options) (map[string]bool, error) {
+	set := map[string]bool{}
+	v := reflect.ValueOf(options).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		long := f.Tag.Get("long")
+		if long == "" || long == "version" || skip[f.Name] {
+			continue
+		}
+		name := envName(long)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		err := setOptionValue(v.Field(i), value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of %s: %s", name, err)
+		}
+		set[f.Name] = true
+	}
+	return set, nil
+}
+
+// setOptionValue parses the string into the option field
+func setOptionValue(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 0)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Uint32:
+		n, err := strconv.ParseUint(strings.TrimSpace(value), 10, 32)
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+	case reflect.Slice:
+		list := []string{}
+		for _, s := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' }) {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+// effectiveConfig returns the options in the config file format, the values of the secret options are redacted
+func effectiveConfig(options Options) string {
+	v := reflect.ValueOf(&options).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("secret") != "true" {
+			continue
+		}
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.String:
+			if field.Len() > 0 {
+				field.SetString(redacted)
+			}
+		case reflect.Slice:
+			list := make([]string, field.Len())
+			for j := range list {
+				list[j] = redacted
+			}
+			field.Set(reflect.ValueOf(list))
+		}
+	}
+
+	data, err := yaml.Marshal(options)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
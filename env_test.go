@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	goFlags "github.com/jessevdk/go-flags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setTestEnv sets the environment variables and returns the function that unsets them
+func setTestEnv(t *testing.T, env map[string]string) func() {
+	for k, v := range env {
+		require.NoError(t, os.Setenv(k, v))
+	}
+	return func() {
+		for k := range env {
+			_ = os.Unsetenv(k)
+		}
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	assert.Equal(t, "DNSPROXY_CACHE_SIZE", envName("cache-size"))
+	assert.Equal(t, "DNSPROXY_UPSTREAM", envName("upstream"))
+}
+
+func TestLoadEnv(t *testing.T) {
+	defer setTestEnv(t, map[string]string{
+		"DNSPROXY_UPSTREAM":      "8.8.8.8, tls://dns.adguard.com\n[/lan/]192.168.1.1",
+		"DNSPROXY_PORT":          "5353",
+		"DNSPROXY_CACHE":         "true",
+		"DNSPROXY_CACHE_MIN_TTL": "60",
+		"DNSPROXY_LISTEN":        "127.0.0.1",
+	})()
+
+	options := Options{}
+	parser := goFlags.NewParser(&options, goFlags.Default)
+	_, err := parser.ParseArgs([]string{"-l", "0.0.0.0"})
+	require.NoError(t, err)
+
+	set, err := loadEnv(flagsSet(parser), &options)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"8.8.8.8", "tls://dns.adguard.com", "[/lan/]192.168.1.1"}, options.Upstreams)
+	assert.Equal(t, 5353, options.ListenPort)
+	assert.True(t, options.Cache)
+	assert.Equal(t, uint32(60), options.CacheMinTTL)
+	assert.True(t, set["ListenPort"])
+
+	// the flags override the environment
+	assert.Equal(t, "0.0.0.0", options.ListenAddr)
+	assert.False(t, set["ListenAddr"])
+}
+
+func TestLoadEnvInvalid(t *testing.T) {
+	defer setTestEnv(t, map[string]string{"DNSPROXY_RATELIMIT": "fast"})()
+
+	_, err := loadEnv(map[string]bool{}, &Options{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "DNSPROXY_RATELIMIT")
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	options := Options{
+		Upstreams:     []string{"8.8.8.8"},
+		DoHAuthTokens: []string{"secret1", "secret2"},
+	}
+	config := effectiveConfig(options)
+	assert.Contains(t, config, "8.8.8.8")
+	assert.NotContains(t, config, "secret1")
+	assert.Contains(t, config, redacted)
+
+	// the options aren't changed
+	assert.Equal(t, []string{"secret1", "secret2"}, options.DoHAuthTokens)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// startHealthServer starts the plain HTTP server of the healthcheck endpoints (see proxy.Proxy.HealthHandler)
+func startHealthServer(addr string, handler http.Handler) (*http.Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: defaultTimeout}
+	log.Printf("Listening for the healthchecks on http://%s/health", l.Addr())
+	go func() {
+		err := srv.Serve(l)
+		if err != http.ErrServerClosed {
+			log.Error("the healthcheck listener has stopped: %s", err)
+		}
+	}()
+	return srv, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartHealthServer(t *testing.T) {
+	// find a free port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	srv, err := startHealthServer(addr, handler)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	resp, err := http.Get("http://" + addr + "/health")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	// the address is in use
+	_, err = startHealthServer(addr, handler)
+	assert.Error(t, err)
+}
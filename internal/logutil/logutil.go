@@ -0,0 +1,139 @@
+// Package logutil contains the helpers to write the structured messages (a text and the fields)
+// with proxyutil.Logger, so they go to the same outputs as the other messages.
+package logutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+)
+
+// jsonFormat is 1 if the messages are written as JSON objects (see SetJSON), accessed atomically
+var jsonFormat int32 // nolint:gochecknoglobals
+
+// Field is a structured field of the log message
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F returns the field with the key and the value.
+// The durations are written in milliseconds, so the key should end with _ms.
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// SetJSON sets the format of the messages: {"msg":"text","key":"value"} if enabled is true,
+// "text key=value" otherwise
+func SetJSON(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&jsonFormat, v)
+}
+
+// Debug writes the debug message with l.
+// Check l.DebugEnabled() before building the fields on the hot paths.
+func Debug(l proxyutil.Logger, msg string, fields ...Field) {
+	if l.DebugEnabled() {
+		l.Debugf("%s", format(msg, fields))
+	}
+}
+
+// Info writes the info message with l
+func Info(l proxyutil.Logger, msg string, fields ...Field) {
+	l.Infof("%s", format(msg, fields))
+}
+
+// Warn writes the warning message with l
+func Warn(l proxyutil.Logger, msg string, fields ...Field) {
+	l.Warnf("%s", format(msg, fields))
+}
+
+// Error writes the error message with l
+func Error(l proxyutil.Logger, msg string, fields ...Field) {
+	l.Errorf("%s", format(msg, fields))
+}
+
+// format formats the message with the fields
+func format(msg string, fields []Field) string {
+	if atomic.LoadInt32(&jsonFormat) == 1 {
+		return formatJSON(msg, fields)
+	}
+	if len(fields) == 0 {
+		return msg
+	}
+
+	var b strings.Builder
+	b.WriteString(msg)
+	for _, f := range fields {
+		b.WriteByte(' ')
+		b.WriteString(f.Key)
+		b.WriteByte('=')
+		v := textValue(f.Value)
+		if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+			v = strconv.Quote(v)
+		}
+		b.WriteString(v)
+	}
+	return b.String()
+}
+
+// formatJSON formats the message and the fields as a JSON object, the fields are written in order
+func formatJSON(msg string, fields []Field) string {
+	var b strings.Builder
+	b.WriteString(`{"msg":`)
+	writeJSON(&b, msg)
+	for _, f := range fields {
+		b.WriteByte(',')
+		writeJSON(&b, f.Key)
+		b.WriteByte(':')
+		writeJSON(&b, jsonValue(f.Value))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// writeJSON writes the JSON encoding of v
+func writeJSON(b *strings.Builder, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(data)
+}
+
+// textValue returns the text representation of the field value
+func textValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case time.Duration:
+		return strconv.FormatInt(int64(v/time.Millisecond), 10)
+	case error:
+		return v.Error()
+	}
+	return fmt.Sprint(v)
+}
+
+// jsonValue returns the value to be encoded to JSON: the durations are in milliseconds,
+// the errors and the fmt.Stringer values are strings
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string, bool, int, int64, uint16, uint32, uint64, float64:
+		return v
+	case time.Duration:
+		return int64(v / time.Millisecond)
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
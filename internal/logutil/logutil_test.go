@@ -0,0 +1,46 @@
+package logutil
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormat(t *testing.T) {
+	fields := []Field{
+		F("qname", "example.org."),
+		F("client", "127.0.0.1:5353"),
+		F("duration_ms", 1500*time.Microsecond*10),
+		F("err", errors.New("i/o timeout")),
+		F("answers", 2),
+	}
+
+	assert.Equal(t, `Processed qname=example.org. client=127.0.0.1:5353 duration_ms=15 err="i/o timeout" answers=2`, format("Processed", fields))
+	assert.Equal(t, "Processed", format("Processed", nil))
+
+	SetJSON(true)
+	defer SetJSON(false)
+	assert.Equal(t, `{"msg":"Processed","qname":"example.org.","client":"127.0.0.1:5353","duration_ms":15,"err":"i/o timeout","answers":2}`, format("Processed", fields))
+	assert.Equal(t, `{"msg":"multi\nline \"text\""}`, format("multi\nline \"text\"", nil))
+}
+
+func TestDebug(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+
+	l := proxyutil.DefaultLogger()
+	Debug(l, "hidden", F("qname", "example.org."))
+	assert.Empty(t, buf.String())
+
+	log.SetLevel(log.DEBUG)
+	defer log.SetLevel(log.INFO)
+	Debug(l, "shown", F("qname", "example.org."))
+	assert.Contains(t, buf.String(), "[debug] shown qname=example.org.")
+}
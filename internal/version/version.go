@@ -0,0 +1,43 @@
+// Package version contains the build information of dnsproxy.
+// The values are set with -ldflags, e.g.:
+//
+//	go build -ldflags "-X github.com/AdguardTeam/dnsproxy/internal/version.version=v0.23.0"
+package version
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// These are set through ldflags.
+// nolint:gochecknoglobals
+var (
+	version   = "dev"     // semantic version
+	commit    = "dev"     // git commit
+	buildDate = "unknown" // build date
+)
+
+// Version returns the semantic version of the build ("dev" if it's not set)
+func Version() string {
+	return version
+}
+
+// Commit returns the git commit of the build ("dev" if it's not set)
+func Commit() string {
+	return commit
+}
+
+// BuildDate returns the date of the build ("unknown" if it's not set)
+func BuildDate() string {
+	return buildDate
+}
+
+// GoVersion returns the version of Go the program is built with
+func GoVersion() string {
+	return runtime.Version()
+}
+
+// Full returns the full build information: the version, the commit, the build date and the Go version
+func Full() string {
+	return fmt.Sprintf("dnsproxy version: %s (commit: %s, built: %s, %s)", version, commit, buildDate, GoVersion())
+}
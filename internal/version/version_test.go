@@ -0,0 +1,19 @@
+package version
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFull(t *testing.T) {
+	assert.Equal(t, "dev", Version())
+	assert.Equal(t, "dev", Commit())
+	assert.Equal(t, "unknown", BuildDate())
+
+	full := Full()
+	assert.True(t, strings.HasPrefix(full, "dnsproxy version: dev (commit: dev, built: unknown, "))
+	assert.Contains(t, full, runtime.Version())
+}
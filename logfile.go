@@ -0,0 +1,250 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is the time format of the rotated log files names, e.g. dnsproxy-2019-10-14T05-12-25.000.log
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// logRotation contains the settings of the log file rotation
+type logRotation struct {
+	maxSize    int64         // the file is rotated when it gets larger (in bytes), 0 to disable
+	maxBackups int           // max number of the rotated files, 0 to keep all
+	maxAge     time.Duration // the rotated files older than that are removed, 0 to keep all
+	compress   bool          // if true, the rotated files are compressed with gzip
+}
+
+// enabled returns true if any of the rotation settings is set
+func (r logRotation) enabled() bool {
+	return r.maxSize > 0 || r.maxBackups > 0 || r.maxAge > 0 || r.compress
+}
+
+// logFile is the log output that is rotated by size or can be reopened after the file is moved by logrotate
+type logFile struct {
+	path     string
+	rotation logRotation
+	file     *os.File
+	size     int64      // size of the file
+	mu       sync.Mutex // protects file and size
+
+	cleanupMu sync.Mutex     // serializes the compression and the removal of the rotated files
+	cleanups  sync.WaitGroup // the cleanups in progress, Close waits for them
+}
+
+// openLogFile opens the log file for appending
+func openLogFile(path string, rotation logRotation) (*logFile, error) {
+	l := &logFile{path: path, rotation: rotation}
+	err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the file at the path, the callers must hold mu (or own the logFile)
+func (l *logFile) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	l.file = f
+	l.size = fi.Size()
+	return nil
+}
+
+// Write implements the io.Writer interface for logFile.
+// The file is rotated first if the message doesn't fit into rotation.maxSize.
+func (l *logFile) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rotation.maxSize > 0 && l.size > 0 && l.size+int64(len(b)) > l.rotation.maxSize {
+		err := l.rotateLocked()
+		if err != nil {
+			// can't log it to the log file
+			fmt.Fprintf(os.Stderr, "cannot rotate the log file: %s\n", err)
+		}
+	}
+
+	n, err := l.file.Write(b)
+	l.size += int64(n)
+	return n, err
+}
+
+// reopen opens the file at the path again, the file that was open is closed.
+// If the file can't be opened, the logs are still written to the old one.
+func (l *logFile) reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	old := l.file
+	err := l.open()
+	if err != nil {
+		return err
+	}
+	return old.Close()
+}
+
+// rotate moves the file to a backup and starts a new one
+func (l *logFile) rotate() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rotateLocked()
+}
+
+// rotateLocked moves the file to a backup, starts a new one and removes (or compresses) the old backups
+// in the background. l.mu must be held.
+func (l *logFile) rotateLocked() error {
+	err := l.file.Close()
+	if err != nil {
+		return err
+	}
+
+	renameErr := os.Rename(l.path, l.backupPath())
+
+	// the new file is opened even if the old one couldn't be moved, so the logs aren't lost
+	err = l.open()
+	if err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+
+	l.cleanups.Add(1)
+	go func() {
+		defer l.cleanups.Done()
+		l.cleanup()
+	}()
+	return nil
+}
+
+// backupPath returns the path of the new rotated file, e.g. dnsproxy-2019-10-14T05-12-25.000.log.
+// If the file with the current time exists, the next millisecond is used.
+func (l *logFile) backupPath() string {
+	ext := filepath.Ext(l.path)
+	base := strings.TrimSuffix(l.path, ext)
+	for t := time.Now(); ; t = t.Add(time.Millisecond) {
+		path := fmt.Sprintf("%s-%s%s", base, t.Format(backupTimeFormat), ext)
+		if !fileExists(path) && !fileExists(path+".gz") {
+			return path
+		}
+	}
+}
+
+// fileExists returns true if the file exists
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// backupFile is a rotated log file
+type backupFile struct {
+	path string
+	time time.Time
+}
+
+// backups returns the rotated log files, the newest first
+func (l *logFile) backups() ([]backupFile, error) {
+	dir := filepath.Dir(l.path)
+	ext := filepath.Ext(l.path)
+	prefix := strings.TrimSuffix(filepath.Base(l.path), ext) + "-"
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var res []backupFile
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		ts := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".gz"), ext)
+		t, err := time.ParseInLocation(backupTimeFormat, ts, time.Local)
+		if err != nil {
+			continue
+		}
+		res = append(res, backupFile{path: filepath.Join(dir, name), time: t})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].time.After(res[j].time) })
+	return res, nil
+}
+
+// cleanup removes the rotated files exceeding rotation.maxBackups or older than rotation.maxAge
+// and compresses the other ones if rotation.compress is set
+func (l *logFile) cleanup() {
+	l.cleanupMu.Lock()
+	defer l.cleanupMu.Unlock()
+
+	backups, err := l.backups()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot list the rotated log files: %s\n", err)
+		return
+	}
+
+	for i, b := range backups {
+		err = nil
+		if (l.rotation.maxBackups > 0 && i >= l.rotation.maxBackups) ||
+			(l.rotation.maxAge > 0 && time.Since(b.time) > l.rotation.maxAge) {
+			err = os.Remove(b.path)
+		} else if l.rotation.compress && !strings.HasSuffix(b.path, ".gz") {
+			err = compressFile(b.path)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot clean up the rotated log file: %s\n", err)
+		}
+	}
+}
+
+// compressFile compresses the file with gzip to path.gz and removes the original file
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+
+	_ = src.Close()
+	return os.Remove(path)
+}
+
+// Close closes the log file after the cleanups in progress are finished
+func (l *logFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cleanups.Wait()
+	return l.file.Close()
+}
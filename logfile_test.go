@@ -0,0 +1,146 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rotatedFiles returns the names of the rotated files in the directory
+func rotatedFiles(t *testing.T, dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, fi := range files {
+		if fi.Name() != "dnsproxy.log" {
+			names = append(names, fi.Name())
+		}
+	}
+	return names
+}
+
+func TestLogFileReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy-log")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dnsproxy.log")
+
+	file, err := openLogFile(path, logRotation{})
+	require.NoError(t, err)
+	defer file.Close()
+	_, err = file.Write([]byte("first\n"))
+	require.NoError(t, err)
+
+	// the file is moved by logrotate
+	require.NoError(t, os.Rename(path, path+".1"))
+	_, err = file.Write([]byte("second\n"))
+	require.NoError(t, err)
+	require.NoError(t, file.reopen())
+	_, err = file.Write([]byte("third\n"))
+	require.NoError(t, err)
+
+	data, err := ioutil.ReadFile(path + ".1")
+	require.NoError(t, err)
+	assert.Equal(t, "first\nsecond\n", string(data))
+	data, err = ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "third\n", string(data))
+}
+
+func TestLogFileRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy-log")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dnsproxy.log")
+
+	file, err := openLogFile(path, logRotation{maxSize: 10, maxBackups: 2})
+	require.NoError(t, err)
+	for _, msg := range []string{"line 1\n", "line 2\n", "line 3\n", "line 4\n"} {
+		_, err = file.Write([]byte(msg))
+		require.NoError(t, err)
+	}
+	require.NoError(t, file.Close())
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "line 4\n", string(data))
+
+	// the oldest backup is removed
+	names := rotatedFiles(t, dir)
+	require.Len(t, names, 2)
+	data, err = ioutil.ReadFile(filepath.Join(dir, names[0]))
+	require.NoError(t, err)
+	assert.Equal(t, "line 2\n", string(data))
+	assert.True(t, strings.HasPrefix(names[0], "dnsproxy-"))
+	assert.True(t, strings.HasSuffix(names[0], ".log"))
+}
+
+func TestLogFileRotateCompress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy-log")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dnsproxy.log")
+
+	file, err := openLogFile(path, logRotation{compress: true})
+	require.NoError(t, err)
+	_, err = file.Write([]byte("rotated\n"))
+	require.NoError(t, err)
+
+	// the forced rotation (SIGUSR1)
+	require.NoError(t, file.rotate())
+	_, err = file.Write([]byte("current\n"))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	names := rotatedFiles(t, dir)
+	require.Len(t, names, 1)
+	require.True(t, strings.HasSuffix(names[0], ".log.gz"))
+
+	f, err := os.Open(filepath.Join(dir, names[0]))
+	require.NoError(t, err)
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, "rotated\n", string(data))
+}
+
+func TestLogFileConcurrentWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy-log")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dnsproxy.log")
+
+	file, err := openLogFile(path, logRotation{maxSize: 1024})
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, _ = file.Write([]byte("a log message\n"))
+			}
+		}()
+	}
+	wg.Wait()
+	require.NoError(t, file.Close())
+
+	// no messages are lost or torn
+	total := 0
+	for _, name := range append(rotatedFiles(t, dir), "dnsproxy.log") {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		assert.True(t, len(data) <= 1024)
+		total += strings.Count(string(data), "a log message\n")
+	}
+	assert.Equal(t, 1000, total)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+)
+
+// stdLogTimeFormat is the time format of the standard log lines prefix
+const stdLogTimeFormat = "2006/01/02 15:04:05 "
+
+// The levels of the log messages (see github.com/AdguardTeam/golibs/log)
+const (
+	levelDebug = "debug"
+	levelInfo  = "info"
+	levelError = "error"
+	levelFatal = "fatal"
+)
+
+// logBackend receives the log messages with their levels (e.g. syslog)
+type logBackend interface {
+	writeMessage(level, msg string) error
+}
+
+// backendWriter is the log output that passes the messages to the backend
+type backendWriter struct {
+	backend logBackend
+}
+
+// Write implements the io.Writer interface for backendWriter
+func (w *backendWriter) Write(b []byte) (int, error) {
+	level, msg := parseLogLine(string(b))
+	err := w.backend.writeMessage(level, msg)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// parseLogLine splits the log line (e.g. "2019/10/14 05:12:25 [info] text") into the level and the text.
+// The lines without the level are info messages.
+func parseLogLine(line string) (level, msg string) {
+	line = strings.TrimRight(line, "\n")
+	start := strings.Index(line, "[")
+	end := strings.Index(line, "] ")
+	if start >= 0 && end > start {
+		switch level = line[start+1 : end]; level {
+		case levelDebug, levelInfo, levelError, levelFatal:
+			return level, line[end+2:]
+		}
+	}
+
+	// e.g. the errors of the HTTP server written with the standard log
+	if len(line) >= len(stdLogTimeFormat) {
+		if _, err := time.Parse(stdLogTimeFormat, line[:len(stdLogTimeFormat)]); err == nil {
+			line = line[len(stdLogTimeFormat):]
+		}
+	}
+	return levelInfo, line
+}
+
+// jsonWriter is the log output that writes the messages as JSON objects, one per line, e.g.
+// {"ts":"2019-10-14T05:12:25.123+03:00","level":"info","msg":"text"}.
+// The fields of the structured messages (see logutil) follow msg.
+type jsonWriter struct {
+	w io.Writer
+}
+
+// Write implements the io.Writer interface for jsonWriter
+func (j *jsonWriter) Write(b []byte) (int, error) {
+	level, msg := parseLogLine(string(b))
+
+	var buf strings.Builder
+	buf.WriteString(`{"ts":`)
+	writeJSONValue(&buf, time.Now().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSONValue(&buf, level)
+	if strings.HasPrefix(msg, `{"msg":`) && json.Valid([]byte(msg)) {
+		// the message with the fields is a JSON object already
+		buf.WriteByte(',')
+		buf.WriteString(msg[1:])
+	} else {
+		buf.WriteString(`,"msg":`)
+		writeJSONValue(&buf, msg)
+		buf.WriteByte('}')
+	}
+	buf.WriteByte('\n')
+
+	_, err := io.WriteString(j.w, buf.String())
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeJSONValue writes the JSON encoding of the string
+func writeJSONValue(buf *strings.Builder, s string) {
+	data, _ := json.Marshal(s)
+	buf.Write(data)
+}
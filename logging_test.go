@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLogLine(t *testing.T) {
+	testCases := []struct {
+		line  string
+		level string
+		msg   string
+	}{
+		{"2019/10/14 05:12:25 [info] Starting the DNS proxy\n", levelInfo, "Starting the DNS proxy"},
+		{"2019/10/14 05:12:25 123#45 [debug] proxy.handle(): [udp] query\n", levelDebug, "proxy.handle(): [udp] query"},
+		{"2019/10/14 05:12:25 [error] cannot resolve\n", levelError, "cannot resolve"},
+		{"2019/10/14 05:12:25 [fatal] cannot start\n", levelFatal, "cannot start"},
+		{"2019/10/14 05:12:25 http: TLS handshake error\n", levelInfo, "http: TLS handshake error"},
+		{"2019/10/14 05:12:25 [unknown] text\n", levelInfo, "[unknown] text"},
+		{"text\n", levelInfo, "text"},
+	}
+	for _, tc := range testCases {
+		level, msg := parseLogLine(tc.line)
+		assert.Equal(t, tc.level, level, tc.line)
+		assert.Equal(t, tc.msg, msg, tc.line)
+	}
+}
+
+func TestJSONWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := &jsonWriter{w: buf}
+
+	line := "2019/10/14 05:12:25 [info] Starting the DNS proxy\n"
+	n, err := w.Write([]byte(line))
+	assert.Nil(t, err)
+	assert.Equal(t, len(line), n)
+	_, err = w.Write([]byte(`2019/10/14 05:12:25 [error] {"msg":"Upstream exchange failed","qname":"example.org.","duration_ms":12}` + "\n"))
+	assert.Nil(t, err)
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	assert.Len(t, lines, 2)
+
+	var m map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &m))
+	assert.Equal(t, "info", m["level"])
+	assert.Equal(t, "Starting the DNS proxy", m["msg"])
+	assert.NotEmpty(t, m["ts"])
+
+	// the fields of the structured messages are the fields of the object
+	m = nil
+	assert.Nil(t, json.Unmarshal([]byte(lines[1]), &m))
+	assert.Equal(t, "error", m["level"])
+	assert.Equal(t, "Upstream exchange failed", m["msg"])
+	assert.Equal(t, "example.org.", m["qname"])
+	assert.Equal(t, float64(12), m["duration_ms"])
+}
@@ -2,14 +2,22 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	stdlog "log"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/internal/logutil"
+	"github.com/AdguardTeam/dnsproxy/internal/version"
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/log"
@@ -18,79 +26,227 @@ import (
 
 // Options represents console arguments
 type Options struct {
+	// Path to the YAML config file
+	ConfigPath string `long:"config-path" description:"Path to the YAML config file with the same keys as the long flag names. The flags and the DNSPROXY_* environment variables override the file values" yaml:"-"`
+
+	// If true, the configuration is validated without starting the proxy
+	CheckConfig bool `long:"check-config" description:"If specified, validate the configuration and exit" optional:"yes" optional-value:"true" yaml:"-"`
+
+	// Windows service action
+	Service string `long:"service" description:"Manage the Windows service: install (with the other arguments), uninstall, start, stop or run (used by the service control manager)" yaml:"-"`
+
+	// If true, the upstreams are tested without starting the proxy
+	Test bool `long:"test" description:"If specified, resolve --test-domain through every upstream, print the results and exit. The exit status is 0 if at least one upstream of every group (default, per-domain, fallback) works" optional:"yes" optional-value:"true" yaml:"-"`
+
+	// Domain resolved in the test mode
+	TestDomain string `long:"test-domain" description:"Domain resolved through the upstreams with --test" default:"example.org" yaml:"-"`
+
+	// If true, all the upstreams must work in the test mode
+	Strict bool `long:"strict" description:"If specified, --test requires all the upstreams to work" optional:"yes" optional-value:"true" yaml:"-"`
+
 	// Should we write
-	Verbose bool `short:"v" long:"verbose" description:"Verbose output (optional)" optional:"yes" optional-value:"true"`
+	Verbose bool `short:"v" long:"verbose" description:"Verbose output (optional)" optional:"yes" optional-value:"true" yaml:"verbose"`
 
 	// Path to a log file
-	LogOutput string `short:"o" long:"output" description:"Path to the log file. If not set, write to stdout." default:""`
+	LogOutput string `short:"o" long:"output" description:"Path to the log file. If not set, write to stdout. The file is reopened on SIGUSR1 (rotated if the rotation is configured)" default:"" yaml:"output"`
+
+	// Log file rotation
+	OutputMaxSize    int  `long:"output-max-size" description:"Rotate the log file when it gets larger than this number of megabytes (0 to disable)" yaml:"output-max-size"`
+	OutputMaxBackups int  `long:"output-max-backups" description:"Max number of the rotated log files to keep (0 to keep all)" yaml:"output-max-backups"`
+	OutputMaxAge     int  `long:"output-max-age" description:"Remove the rotated log files older than this number of days (0 to keep all)" yaml:"output-max-age"`
+	OutputCompress   bool `long:"output-compress" description:"If specified, compress the rotated log files with gzip" optional:"yes" optional-value:"true" yaml:"output-compress"`
+
+	// Log format
+	LogFormat string `long:"log-format" description:"Format of the log messages: text or json (one JSON object per line)" default:"text" yaml:"log-format"`
+
+	// Syslog output
+	LogSyslog      bool   `long:"log-syslog" description:"If specified, write the logs to the local syslog (in addition to --output if set)" optional:"yes" optional-value:"true" yaml:"log-syslog"`
+	SyslogFacility string `long:"syslog-facility" description:"Syslog facility (e.g. daemon, user, local0)" default:"daemon" yaml:"syslog-facility"`
+	SyslogTag      string `long:"syslog-tag" description:"Syslog tag" default:"dnsproxy" yaml:"syslog-tag"`
+
+	// Path to the PID file
+	PIDFile string `long:"pidfile" description:"Path to the file the PID is written to. The proxy doesn't start if the file contains the PID of a running process" yaml:"pidfile"`
+
+	// The account the proxy runs as after the listeners are started
+	User  string `long:"user" description:"Switch to this user after the listeners are started (not supported on Windows)" yaml:"user"`
+	Group string `long:"group" description:"Switch to this group after the listeners are started (default: the primary group of --user)" yaml:"group"`
 
 	// Server listen address
-	ListenAddr string `short:"l" long:"listen" description:"Listen address" default:"0.0.0.0"`
+	ListenAddr string `short:"l" long:"listen" description:"Listen address" default:"0.0.0.0" yaml:"listen"`
 
 	// Server listen port
-	ListenPort int `short:"p" long:"port" description:"Listen port. Zero value disables TCP and UDP listeners" default:"53"`
+	ListenPort int `short:"p" long:"port" description:"Listen port. Zero value disables TCP and UDP listeners" default:"53" yaml:"port"`
 
 	// HTTPS listen port (0 to disable DOH server)
-	HTTPSListenPort int `short:"h" long:"https-port" description:"Listen port for DNS-over-HTTPS" default:"0"`
+	HTTPSListenPort int `short:"h" long:"https-port" description:"Listen port for DNS-over-HTTPS" default:"0" yaml:"https-port"`
 
 	// TLS listen port (0 to disable DOH server)
-	TLSListenPort int `short:"t" long:"tls-port" description:"Listen port for DNS-over-TLS" default:"0"`
+	TLSListenPort int `short:"t" long:"tls-port" description:"Listen port for DNS-over-TLS" default:"0" yaml:"tls-port"`
 
 	// Path to the .crt with the certificate chain
-	TLSCertPath string `short:"c" long:"tls-crt" description:"Path to a file with the certificate chain"`
+	TLSCertPath string `short:"c" long:"tls-crt" description:"Path to a file with the certificate chain" yaml:"tls-crt"`
 
 	// Path to the file with the private key
-	TLSKeyPath string `short:"k" long:"tls-key" description:"Path to a file with the private key"`
+	TLSKeyPath string `short:"k" long:"tls-key" description:"Path to a file with the private key" yaml:"tls-key"`
+
+	// Path to the file with the CA certificates used to verify the client certificates
+	TLSClientCAPath string `long:"tls-client-ca" description:"Path to a file with CA certificates. If set, DoT and DoH clients must present a certificate signed by one of them" yaml:"tls-client-ca"`
 
 	// Bootstrap DNS
-	BootstrapDNS []string `short:"b" long:"bootstrap" description:"Bootstrap DNS for DoH and DoT, can be specified multiple times (default: 8.8.8.8:53)"`
+	BootstrapDNS []string `short:"b" long:"bootstrap" description:"Bootstrap DNS for DoH and DoT in the --upstream syntax, can be specified multiple times. The DoH and DoT bootstraps with hostnames are resolved by the other ones (default: 8.8.8.8:53)" yaml:"bootstrap"`
 
 	// Ratelimit value
-	Ratelimit int `short:"r" long:"ratelimit" description:"Ratelimit (requests per second)" default:"0"`
+	Ratelimit int `short:"r" long:"ratelimit" description:"Ratelimit (requests per second)" default:"0" yaml:"ratelimit"`
 
 	// If true, DNS cache is enabled
-	Cache bool `short:"z" long:"cache" description:"If specified, DNS cache is enabled" optional:"yes" optional-value:"true"`
+	Cache bool `short:"z" long:"cache" description:"If specified, DNS cache is enabled" optional:"yes" optional-value:"true" yaml:"cache"`
 
 	// Cache size value
-	CacheSizeBytes int `short:"e" long:"cache-size" description:"Cache size (in bytes). Default: 64k"`
+	CacheSizeBytes int `short:"e" long:"cache-size" description:"Cache size (in bytes). Default: 64k" yaml:"cache-size"`
+
+	// If true, the expired cache entries are served while they are refreshed
+	CacheOptimistic bool `long:"cache-optimistic" description:"If specified, optimistic DNS caching is enabled: expired entries are served with a short TTL and refreshed in the background" optional:"yes" optional-value:"true" yaml:"cache-optimistic"`
+
+	// Number of hits after which the cache entries are prefetched
+	CachePrefetch int `long:"cache-prefetch" description:"Prefetch the cache entries that have got this number of hits when less than 10% of their TTL is left (0 to disable)" default:"0" yaml:"cache-prefetch"`
+
+	// If true, the addresses in the cached responses are rotated
+	CacheRoundRobin bool `long:"cache-round-robin" description:"If specified, the A and AAAA records of the cached responses are rotated on every cache hit" optional:"yes" optional-value:"true" yaml:"cache-round-robin"`
+
+	// If true, the RRsets of the CNAME chains are cached separately
+	CacheCNAMEChains bool `long:"cache-cname-chains" description:"If specified, every RRset of the CNAME chains is cached under its own name, so the queries for the intermediate names are answered from the cache" optional:"yes" optional-value:"true" yaml:"cache-cname-chains"`
+
+	// Cache file
+	CachePersist string `long:"cache-persist" description:"Path to the file where the cache is saved on exit and loaded from on start" yaml:"cache-persist"`
+
+	// Cache warm-up list
+	CacheWarmup string `long:"cache-warmup" description:"Path to the list of names (one per line, optionally followed by the record type) that are resolved on start to fill the cache" yaml:"cache-warmup"`
+
+	// TTL limits of the responses
+	CacheMinTTL         uint32 `long:"cache-min-ttl" description:"Minimum TTL value for DNS entries, in seconds (0 means no limit)" default:"0" yaml:"cache-min-ttl"`
+	CacheMaxTTL         uint32 `long:"cache-max-ttl" description:"Maximum TTL value for DNS entries, in seconds (0 means no limit)" default:"0" yaml:"cache-max-ttl"`
+	CacheMinNegativeTTL uint32 `long:"cache-min-negative-ttl" description:"Minimum TTL value for NXDOMAIN and NODATA responses, in seconds (0 means no limit)" default:"0" yaml:"cache-min-negative-ttl"`
+	CacheMaxNegativeTTL uint32 `long:"cache-max-negative-ttl" description:"Maximum TTL value for cached NXDOMAIN and NODATA responses, in seconds" default:"10800" yaml:"cache-max-negative-ttl"`
+
+	// Per-type TTL caps of the cached responses
+	CacheTTLCaps []string `long:"cache-ttl-cap" description:"Maximum TTL of the cached responses of a query type in the TYPE=seconds format (e.g. TXT=300), can be specified multiple times" yaml:"cache-ttl-cap"`
+
+	// Per-domain TTL limits of the responses
+	CacheTTLOverrides []string `long:"cache-ttl-override" description:"Minimum and maximum TTL of the responses for a domain and its subdomains (or only the subdomains for *.DOMAIN) in the DOMAIN=MIN:MAX format (e.g. example.org=60:300), overrides --cache-min-ttl and --cache-max-ttl, can be specified multiple times" yaml:"cache-ttl-override"`
+
+	// TTL of the failure cache entries
+	CacheFailureTTL uint32 `long:"cache-failure-ttl" description:"Cache upstream failures and SERVFAIL, REFUSED and NOTIMP responses for this number of seconds (at most 30, 0 to disable)" default:"0" yaml:"cache-failure-ttl"`
 
 	// If true, refuse ANY requests
-	RefuseAny bool `short:"a" long:"refuse-any" description:"If specified, refuse ANY requests" optional:"yes" optional-value:"true"`
+	RefuseAny bool `short:"a" long:"refuse-any" description:"If specified, refuse ANY requests" optional:"yes" optional-value:"true" yaml:"refuse-any"`
 
 	// DNS upstreams
-	Upstreams []string `short:"u" long:"upstream" description:"An upstream to be used (can be specified multiple times)" required:"true"`
+	Upstreams []string `short:"u" long:"upstream" description:"An upstream to be used (can be specified multiple times), optionally named for the logs and the stats: name=address" yaml:"upstream"`
+
+	// Path to the file with the upstreams
+	UpstreamFile string `long:"upstream-file" description:"Path to the file with an upstream per line in the --upstream syntax (# starts a comment). The file is re-read on changes and on SIGHUP" yaml:"upstream-file"`
 
 	// Fallback DNS resolver
-	Fallbacks []string `short:"f" long:"fallback" description:"Fallback resolvers to use when regular ones are unavailable, can be specified multiple times"`
+	Fallbacks []string `short:"f" long:"fallback" description:"Fallback resolvers to use when regular ones are unavailable, can be specified multiple times" yaml:"fallback"`
+
+	// The address family of the outbound connections
+	OutboundFamily string `long:"outbound-family" description:"Address family of the connections to the upstreams: auto, ipv4 or ipv6. The upstreams with the IP addresses of the other family are rejected, and its bootstrapped addresses are never dialed" default:"auto" yaml:"outbound-family"`
 
 	// If true, parallel queries to all configured upstream servers
-	AllServers bool `short:"s" long:"all-servers" description:"If specified, parallel queries to all configured upstream servers are enabled" optional:"yes" optional-value:"true"`
+	AllServers bool `short:"s" long:"all-servers" description:"If specified, parallel queries to all configured upstream servers are enabled" optional:"yes" optional-value:"true" yaml:"all-servers"`
 
 	// If true, all AAAA requests will be replied with NoError RCode and empty answer
-	IPv6Disabled bool `short:"d" long:"ipv6-disabled" description:"If specified, all AAAA requests will be replied with NoError RCode and empty answer" optional:"yes" optional-value:"true"`
+	IPv6Disabled bool `short:"d" long:"ipv6-disabled" description:"If specified, all AAAA requests will be replied with NoError RCode and empty answer" optional:"yes" optional-value:"true" yaml:"ipv6-disabled"`
 
 	// Use EDNS Client Subnet extension
-	EnableEDNSSubnet bool `long:"edns" description:"Use EDNS Client Subnet extension" optional:"yes" optional-value:"true"`
+	EnableEDNSSubnet bool `long:"edns" description:"Use EDNS Client Subnet extension" optional:"yes" optional-value:"true" yaml:"edns"`
+
+	// ECS override
+	ECSOverrideSubnet []string `long:"edns-override-subnet" description:"Send this subnet (CIDR) in EDNS Client Subnet instead of the clients' addresses, at most one IPv4 and one IPv6 subnet. Can't be used with --edns" yaml:"edns-override-subnet"`
+
+	// If true, names under the mDNS zones are resolved via multicast DNS
+	MDNS bool `long:"mdns" description:"If specified, names under .local (or --mdns-zone) are resolved via mDNS" optional:"yes" optional-value:"true" yaml:"mdns"`
+
+	// Zones resolved via mDNS
+	MDNSZones []string `long:"mdns-zone" description:"A zone to resolve via mDNS, can be specified multiple times (default: local.)" yaml:"mdns-zone"`
+
+	// Answer to version.bind and version.server CHAOS queries
+	ServerVersion string `long:"chaos-version" description:"Answer to TXT CH version.bind queries. If not set, they are refused." yaml:"chaos-version"`
+
+	// Answer to hostname.bind and id.server CHAOS queries
+	ServerHostname string `long:"chaos-hostname" description:"Answer to TXT CH hostname.bind and id.server queries. If not set, they are refused." yaml:"chaos-hostname"`
+
+	// Server identifier sent in the NSID option
+	NSID string `long:"nsid" description:"Server identifier sent in the NSID EDNS option to the clients that request it. If not set, the option is forwarded to the upstreams." yaml:"nsid"`
+
+	// Extended DNS Errors of the failure responses
+	ExtendedErrors     bool `long:"extended-errors" description:"If specified, the failure responses carry Extended DNS Errors (RFC 8914) for the clients that send EDNS" optional:"yes" optional-value:"true" yaml:"extended-errors"`
+	ExtendedErrorsText bool `long:"extended-errors-text" description:"If specified, the Extended DNS Errors also carry the error text with the names of the failed upstreams" optional:"yes" optional-value:"true" yaml:"extended-errors-text"`
+
+	// Failover on the server errors of the upstreams
+	RetryServerErrors       bool `long:"retry-server-errors" description:"If specified, the SERVFAIL and REFUSED responses of an upstream are retried on the next upstream" optional:"yes" optional-value:"true" yaml:"retry-server-errors"`
+	RespectUpstreamBlocking bool `long:"respect-upstream-blocking" description:"If specified, the responses with the Blocked, Censored or Filtered Extended DNS Errors aren't retried on the next upstream" optional:"yes" optional-value:"true" yaml:"respect-upstream-blocking"`
+
+	// DoH authentication tokens
+	DoHAuthTokens []string `long:"https-auth-token" description:"A token that DNS-over-HTTPS clients must present (Bearer header or /dns-query/<token>), can be specified multiple times" yaml:"https-auth-token" secret:"true"`
+
+	// If true, the Server header of the DoH responses includes the version
+	HTTPSServerVersion bool `long:"https-server-version" description:"If specified, the Server header of the DNS-over-HTTPS responses includes the dnsproxy version" optional:"yes" optional-value:"true" yaml:"https-server-version"`
+
+	// Reverse proxies in front of the DoH server
+	TrustedProxies []string `long:"https-trusted-proxy" description:"IP address or CIDR of a reverse proxy whose Forwarded and X-Forwarded-For headers are trusted by the DNS-over-HTTPS server, can be specified multiple times" yaml:"https-trusted-proxy"`
+
+	// Healthcheck listener
+	HealthAddr              string `long:"health-addr" description:"Address of the HTTP healthcheck listener (e.g. 127.0.0.1:8080) with the /health and /health/detail endpoints" yaml:"health-addr"`
+	HealthWindow            int    `long:"health-window" description:"The upstreams are healthy if they have answered within this number of seconds (default: 60)" yaml:"health-window"`
+	HealthDegradedUnhealthy bool   `long:"health-degraded-unhealthy" description:"If specified, the healthcheck fails if any of the upstreams has failed within --health-window, not only all of them" optional:"yes" optional-value:"true" yaml:"health-degraded-unhealthy"`
+
+	// Static DNS entries
+	DNSEntries []string `long:"dns-entry" description:"A static DNS entry in the name=IP format (e.g. myprinter.lan=192.168.1.50), can be specified multiple times" yaml:"dns-entry"`
+
+	// CNAME overrides
+	CNAMEOverrides []string `long:"cname-override" description:"Answer the queries for the name with the CNAME to the target in the name=target format (e.g. www.bing.com=strict.bing.com), can be specified multiple times" yaml:"cname-override"`
+
+	// Safe search CNAME overrides
+	SafeSearch bool `long:"safe-search" description:"If specified, the safe search of Google, Bing, DuckDuckGo and YouTube is enforced with the CNAME overrides" optional:"yes" optional-value:"true" yaml:"safe-search"`
+
+	// Idle timeout of TCP and DoT connections
+	TCPIdleTimeout int `long:"tcp-idle-timeout" description:"Idle timeout of TCP and DNS-over-TLS connections in seconds, advertised with edns-tcp-keepalive (default: 10)" yaml:"tcp-idle-timeout"`
+
+	// Slow query log
+	SlowQueryThreshold int `long:"slow-query-threshold" description:"Log the queries processed longer than this number of milliseconds as warnings (default: 0, disabled)" yaml:"slow-query-threshold"`
+
+	// Upstream failure tracking
+	UpstreamFailureThreshold int  `long:"upstream-failure-threshold" description:"Mark an upstream down after this number of consecutive failures, so it isn't used until --upstream-cooldown passes (default: 0, disabled)" yaml:"upstream-failure-threshold"`
+	UpstreamCooldown         int  `long:"upstream-cooldown" description:"Number of seconds before a down upstream is probed again (default: 30)" yaml:"upstream-cooldown"`
+	UpstreamGradualRecovery  bool `long:"upstream-gradual-recovery" description:"If specified, a probed upstream is restored only after --upstream-failure-threshold successes in a row" optional:"yes" optional-value:"true" yaml:"upstream-gradual-recovery"`
+
+	// Options of the resolve command
+	ResolveAll    bool   `long:"all" description:"With the resolve command, query every upstream and print the comparison table" optional:"yes" optional-value:"true" yaml:"-"`
+	ResolveClient string `long:"client" description:"With the resolve command, the client IP address used for ECS and the client settings" yaml:"-"`
 
 	// Print DNSProxy version (just for the help)
-	Version bool `long:"version" description:"Prints the program version"`
+	Version bool `long:"version" description:"Prints the program version" yaml:"-"`
 }
 
-// VersionString will be set through ldflags, contains current version
-var VersionString = "undefined" // nolint:gochecknoglobals
-
 const defaultTimeout = 10 * time.Second
 
+// The --log-format values
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
 func main() {
 	var options Options
 	var parser = goFlags.NewParser(&options, goFlags.Default)
 
 	if len(os.Args) > 1 && os.Args[1] == "--version" {
-		fmt.Printf("dnsproxy version: %s\n", VersionString)
+		fmt.Println(version.Full())
 		os.Exit(0)
 	}
 
-	_, err := parser.Parse()
+	args, err := parser.Parse()
 	if err != nil {
 		if flagsErr, ok := err.(*goFlags.Error); ok && flagsErr.Type == goFlags.ErrHelp {
 			os.Exit(0)
@@ -99,83 +255,420 @@ func main() {
 		}
 	}
 
-	log.Println("Starting the DNS proxy")
-	run(options)
+	err = loadOptions(parser, &options)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if options.Service != "" {
+		err = handleServiceCommand(options, os.Args[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	err = checkUpstreams(options)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if options.CheckConfig {
+		_, err = createProxyConfig(options)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid configuration: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("The configuration is valid")
+		os.Exit(0)
+	}
+
+	if len(args) > 0 {
+		if args[0] != resolveCommand {
+			fmt.Fprintf(os.Stderr, "unknown command %s\n", args[0])
+			os.Exit(1)
+		}
+		if !runResolveCommand(options, args[1:]) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if options.Test {
+		config, err := createProxyConfig(options)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid configuration: %s\n", err)
+			os.Exit(1)
+		}
+		if !testUpstreams(config, options.TestDomain, options.Strict, os.Stdout) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	log.Printf("Starting the DNS proxy, %s", version.Full())
+	run(options, nil)
+}
+
+// runResolveCommand resolves the name from the arguments of the resolve command and prints the result.
+// Returns false if the arguments or the configuration are invalid or the name couldn't be resolved.
+func runResolveCommand(options Options, args []string) bool {
+	name, qtype, err := parseResolveArgs(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	var client net.IP
+	if options.ResolveClient != "" {
+		client = net.ParseIP(options.ResolveClient)
+		if client == nil {
+			fmt.Fprintf(os.Stderr, "invalid client IP address %s\n", options.ResolveClient)
+			return false
+		}
+	}
+	config, err := createProxyConfig(options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %s\n", err)
+		return false
+	}
+
+	if options.ResolveAll {
+		return resolveAll(config, name, qtype, os.Stdout)
+	}
+	return resolve(config, name, qtype, client, os.Stdout)
 }
 
-func run(options Options) {
+// checkUpstreams returns an error if no upstreams are configured
+func checkUpstreams(options Options) error {
+	if len(options.Upstreams) == 0 && options.UpstreamFile == "" {
+		return errors.New("no upstreams specified: use --upstream, --upstream-file or the upstream key of the config file")
+	}
+	return nil
+}
+
+// run starts the proxy and serves the queries until it's stopped by a signal or stop is closed
+func run(options Options, stop <-chan struct{}) {
 	if options.Verbose {
 		log.SetLevel(log.DEBUG)
 	}
-	if options.LogOutput != "" {
-		file, err := os.OpenFile(options.LogOutput, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	file := setupLogOutput(options)
+	if file != nil {
+		defer file.Close() //nolint
+	}
+	if options.PIDFile != "" {
+		err := writePIDFile(options.PIDFile)
 		if err != nil {
-			log.Fatalf("cannot create a log file: %s", err)
+			log.Fatalf("%s", err)
 		}
-		defer file.Close() //nolint
-		log.SetOutput(file)
+		defer removePIDFile(options.PIDFile)
+	}
+	if options.Verbose {
+		log.Printf("Effective configuration:\n%s", effectiveConfig(options))
 	}
 
 	// Prepare the proxy server
-	config := createProxyConfig(options)
-	dnsProxy := proxy.Proxy{Config: config}
-
-	// Add extra handler if needed
-	if options.IPv6Disabled {
-		ipv6Configuration := ipv6Configuration{ipv6Disabled: options.IPv6Disabled}
-		dnsProxy.RequestHandler = ipv6Configuration.handleDNSRequest
+	config, err := createProxyConfig(options)
+	if err != nil {
+		log.Fatalf("%s", err)
 	}
+	dnsProxy := proxy.Proxy{Config: config}
 
 	// Start the proxy
-	err := dnsProxy.Start()
+	err = dnsProxy.Start()
 	if err != nil {
 		log.Fatalf("cannot start the DNS proxy due to %s", err)
 	}
 
+	if options.HealthAddr != "" {
+		healthServer, err := startHealthServer(options.HealthAddr, dnsProxy.HealthHandler())
+		if err != nil {
+			log.Fatalf("cannot start the healthcheck listener: %s", err)
+		}
+		defer healthServer.Close() //nolint
+	}
+
+	// All the listeners are started, the privileges aren't needed any more
+	if options.User != "" {
+		var ownFiles []string
+		if options.PIDFile != "" {
+			ownFiles = append(ownFiles, options.PIDFile)
+		}
+		err = dropPrivileges(options.User, options.Group, ownFiles...)
+		if err != nil {
+			log.Fatalf("cannot drop the privileges: %s", err)
+		}
+		err = checkFilesAccess(options)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		log.Printf("Running as the user %s", options.User)
+	}
+
+	// Re-read the upstreams file on changes
+	upstreamFileChanged := make(chan struct{}, 1)
+	stopWatch := make(chan struct{})
+	defer close(stopWatch)
+	if options.UpstreamFile != "" {
+		go watchUpstreamFile(options.UpstreamFile, upstreamFileCheckInterval, upstreamFileChanged, stopWatch)
+	}
+
+	// SIGINT and SIGTERM stop the proxy, SIGHUP reloads the configuration, SIGUSR1 reopens the log file
 	signalChannel := make(chan os.Signal, 1)
-	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
-	<-signalChannel
+	signal.Notify(signalChannel, append([]os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}, reopenSignals...)...)
+loop:
+	for {
+		select {
+		case sig := <-signalChannel:
+			switch {
+			case sig == syscall.SIGHUP:
+				reload(&dnsProxy, options)
+			case isReopenSignal(sig):
+				reopenLogFile(file)
+			default:
+				log.Printf("Received %s, shutting down", sig)
+				break loop
+			}
+		case <-upstreamFileChanged:
+			log.Printf("The upstreams file %s is changed", options.UpstreamFile)
+			reload(&dnsProxy, options)
+		case <-stop:
+			log.Println("Stop requested, shutting down")
+			break loop
+		}
+	}
 
-	// Stopping the proxy
-	err = dnsProxy.Stop()
+	// Stopping the proxy after the queries in progress are processed
+	err = dnsProxy.Shutdown(shutdownTimeout)
 	if err != nil {
 		log.Fatalf("cannot stop the DNS proxy due to %s", err)
 	}
+
+	stats := dnsProxy.Stats()
+	log.Printf("Zone transfers refused: %d, not implemented opcodes: %d", stats.ZoneTransfersRefused, stats.NotImplementedOpcodes)
+}
+
+// setupLogOutput sets the log outputs: the --output file (or the current output) in the --log-format format
+// and syslog. If syslog isn't available, the logs are written to the other output.
+// Returns the log file (nil if it isn't used).
+func setupLogOutput(options Options) *logFile {
+	logutil.SetJSON(options.LogFormat == logFormatJSON)
+
+	var file *logFile
+	var out io.Writer
+	if options.LogOutput != "" {
+		var err error
+		file, err = openLogFile(options.LogOutput, logRotation{
+			maxSize:    int64(options.OutputMaxSize) * 1024 * 1024,
+			maxBackups: options.OutputMaxBackups,
+			maxAge:     time.Duration(options.OutputMaxAge) * 24 * time.Hour,
+			compress:   options.OutputCompress,
+		})
+		if err != nil {
+			log.Fatalf("cannot create a log file: %s", err)
+		}
+		out = file
+	}
+
+	var syslogOut io.Writer
+	if options.LogSyslog {
+		var err error
+		syslogOut, err = newSyslogOutput(options.SyslogFacility, options.SyslogTag)
+		if err != nil {
+			log.Printf("cannot write the logs to syslog: %s", err)
+		}
+	}
+
+	if out == nil && syslogOut == nil {
+		out = stdlog.Writer()
+	}
+	if out != nil && options.LogFormat == logFormatJSON {
+		out = &jsonWriter{w: out}
+	}
+	switch {
+	case out != nil && syslogOut != nil:
+		log.SetOutput(io.MultiWriter(out, syslogOut))
+	case out != nil:
+		log.SetOutput(out)
+	default:
+		log.SetOutput(syslogOut)
+	}
+	return file
+}
+
+// isReopenSignal returns true if the signal makes the proxy reopen the log file
+func isReopenSignal(sig os.Signal) bool {
+	for _, s := range reopenSignals {
+		if s == sig {
+			return true
+		}
+	}
+	return false
+}
+
+// reopenLogFile rotates the log file if the rotation is configured, otherwise it reopens the file
+// after it's moved by logrotate (on SIGUSR1). Does nothing if the logs are written to stdout.
+func reopenLogFile(file *logFile) {
+	if file == nil {
+		return
+	}
+	if file.rotation.enabled() {
+		err := file.rotate()
+		if err != nil {
+			log.Printf("cannot rotate the log file: %s", err)
+			return
+		}
+		log.Println("Rotated the log file")
+		return
+	}
+
+	err := file.reopen()
+	if err != nil {
+		log.Printf("cannot reopen the log file: %s", err)
+		return
+	}
+	log.Println("Reopened the log file")
+}
+
+// reload re-creates the proxy configuration and applies it to the running proxy (on SIGHUP and on the upstreams file changes).
+// If the configuration is invalid, the proxy keeps the current one.
+func reload(dnsProxy *proxy.Proxy, options Options) {
+	log.Println("Reloading the DNS proxy configuration")
+	config, err := createProxyConfig(options)
+	if err != nil {
+		log.Printf("cannot reload the configuration: %s", err)
+		return
+	}
+
+	restartRequired, err := dnsProxy.Reload(config)
+	if err != nil {
+		log.Printf("cannot reload the configuration: %s", err)
+		return
+	}
+	if len(restartRequired) > 0 {
+		log.Printf("Restart the DNS proxy to apply: %v", restartRequired)
+	}
 }
 
 // createProxyConfig creates proxy.Config from the command line arguments
-func createProxyConfig(options Options) proxy.Config {
+func createProxyConfig(options Options) (proxy.Config, error) {
+	if options.LogFormat != logFormatText && options.LogFormat != logFormatJSON {
+		return proxy.Config{}, fmt.Errorf("unknown log format %q: use text or json", options.LogFormat)
+	}
+
+	if options.Group != "" && options.User == "" {
+		return proxy.Config{}, errors.New("--group requires --user")
+	}
+
 	listenIP := net.ParseIP(options.ListenAddr)
 	if listenIP == nil {
-		log.Fatalf("cannot parse %s", options.ListenAddr)
+		return proxy.Config{}, fmt.Errorf("cannot parse %s", options.ListenAddr)
+	}
+
+	family, err := upstream.ParseAddressFamily(options.OutboundFamily)
+	if err != nil {
+		return proxy.Config{}, err
 	}
 
 	// Init upstreams
-	upstreamConfig, err := proxy.ParseUpstreamsConfig(options.Upstreams, options.BootstrapDNS, defaultTimeout)
+	upstreams := options.Upstreams
+	if options.UpstreamFile != "" {
+		entries, err := proxy.ReadUpstreamsFile(options.UpstreamFile, options.BootstrapDNS, defaultTimeout)
+		if err != nil {
+			return proxy.Config{}, err
+		}
+		upstreams = append(append([]string{}, upstreams...), entries...)
+	}
+	upstreamOpts := upstream.Options{Bootstrap: options.BootstrapDNS, Timeout: defaultTimeout, AddressFamily: family}
+	if err := upstream.ValidateBootstrap(options.BootstrapDNS, upstreamOpts); err != nil {
+		return proxy.Config{}, err
+	}
+	upstreamConfig, err := proxy.ParseUpstreamsConfigWithOptions(upstreams, upstreamOpts)
 	if err != nil {
-		log.Fatalf("error while parsing upstreams configuration: %s", err)
+		return proxy.Config{}, fmt.Errorf("error while parsing upstreams configuration: %s", err)
 	}
 
 	// Create the config
 	config := proxy.Config{
 		Upstreams:                upstreamConfig.Upstreams,
 		DomainsReservedUpstreams: upstreamConfig.DomainReservedUpstreams,
+		OutboundAddressFamily:    family,
 		Ratelimit:                options.Ratelimit,
 		CacheEnabled:             options.Cache,
 		CacheSizeBytes:           options.CacheSizeBytes,
+		CacheOptimistic:          options.CacheOptimistic,
+		CachePrefetchThreshold:   options.CachePrefetch,
+		CacheRoundRobin:          options.CacheRoundRobin,
+		CacheCNAMEChains:         options.CacheCNAMEChains,
+		CachePersistPath:         options.CachePersist,
+		CacheWarmupFile:          options.CacheWarmup,
+		CacheMinTTL:              options.CacheMinTTL,
+		CacheMaxTTL:              options.CacheMaxTTL,
+		CacheMinNegativeTTL:      options.CacheMinNegativeTTL,
+		CacheMaxNegativeTTL:      options.CacheMaxNegativeTTL,
+		CacheFailureTTL:          options.CacheFailureTTL,
 		RefuseAny:                options.RefuseAny,
 		AllServers:               options.AllServers,
 		EnableEDNSClientSubnet:   options.EnableEDNSSubnet,
+		ECSOverrideSubnet:        options.ECSOverrideSubnet,
+		MDNSEnabled:              options.MDNS,
+		MDNSZones:                options.MDNSZones,
+		ServerVersion:            options.ServerVersion,
+		ServerHostname:           options.ServerHostname,
+		SafeSearch:               options.SafeSearch,
+		NSID:                     options.NSID,
+		EnableExtendedErrors:     options.ExtendedErrors,
+		ExtendedErrorsText:       options.ExtendedErrorsText,
+		RetryServerErrors:        options.RetryServerErrors,
+		RespectUpstreamBlocking:  options.RespectUpstreamBlocking,
+		DoHAuthTokens:            options.DoHAuthTokens,
+		HTTPSServerVersion:       options.HTTPSServerVersion,
+		TrustedProxies:           options.TrustedProxies,
+		TCPIdleTimeout:           time.Duration(options.TCPIdleTimeout) * time.Second,
+		SlowQueryThreshold:       time.Duration(options.SlowQueryThreshold) * time.Millisecond,
+		UpstreamFailureThreshold: options.UpstreamFailureThreshold,
+		UpstreamCooldown:         time.Duration(options.UpstreamCooldown) * time.Second,
+		UpstreamGradualRecovery:  options.UpstreamGradualRecovery,
+		HealthWindow:             time.Duration(options.HealthWindow) * time.Second,
+		HealthDegradedUnhealthy:  options.HealthDegradedUnhealthy,
+	}
+
+	if len(options.CacheTTLCaps) > 0 {
+		config.CacheTTLCaps, err = parseCacheTTLCaps(options.CacheTTLCaps)
+		if err != nil {
+			return proxy.Config{}, err
+		}
+	}
+
+	if len(options.CacheTTLOverrides) > 0 {
+		config.CacheTTLOverrides, err = parseCacheTTLOverrides(options.CacheTTLOverrides)
+		if err != nil {
+			return proxy.Config{}, err
+		}
+	}
+
+	if len(options.DNSEntries) > 0 {
+		config.StaticEntries, err = parseDNSEntries(options.DNSEntries)
+		if err != nil {
+			return proxy.Config{}, err
+		}
+	}
+
+	if len(options.CNAMEOverrides) > 0 {
+		config.CNAMEOverrides, err = parseCNAMEOverrides(options.CNAMEOverrides)
+		if err != nil {
+			return proxy.Config{}, err
+		}
 	}
 
 	if options.Fallbacks != nil {
 		fallbacks := []upstream.Upstream{}
 		for i, f := range options.Fallbacks {
-			fallback, err := upstream.AddressToUpstream(f, upstream.Options{Timeout: defaultTimeout})
+			fallback, err := upstream.AddressToNamedUpstream(f, upstream.Options{Timeout: defaultTimeout, AddressFamily: family})
 			if err != nil {
-				log.Fatalf("cannot parse the fallback %s (%s): %s", f, options.BootstrapDNS, err)
+				return proxy.Config{}, fmt.Errorf("cannot parse the fallback %s (%s): %s", f, options.BootstrapDNS, err)
 			}
-			log.Printf("Fallback %d is %s", i, fallback.Address())
+			log.Printf("Fallback %d is %s", i, upstream.Name(fallback))
 			fallbacks = append(fallbacks, fallback)
 		}
 		config.Fallbacks = fallbacks
@@ -185,26 +678,120 @@ func createProxyConfig(options Options) proxy.Config {
 	if options.TLSCertPath != "" && options.TLSKeyPath != "" {
 		tlsConfig, err := newTLSConfig(options.TLSCertPath, options.TLSKeyPath)
 		if err != nil {
-			log.Fatalf("failed to load TLS config: %s", err)
+			return proxy.Config{}, fmt.Errorf("failed to load TLS config: %s", err)
 		}
 		config.TLSConfig = tlsConfig
 	}
 
+	if options.TLSClientCAPath != "" {
+		clientCAs, err := loadCertPool(options.TLSClientCAPath)
+		if err != nil {
+			return proxy.Config{}, fmt.Errorf("failed to load client CA certificates: %s", err)
+		}
+		config.TLSClientAuth = &proxy.TLSClientAuth{ClientCAs: clientCAs}
+	}
+
 	if options.TLSListenPort > 0 && config.TLSConfig != nil {
-		config.TLSListenAddr = &net.TCPAddr{Port: options.TLSListenPort, IP: listenIP}
+		config.TLSListenAddr = []*net.TCPAddr{{Port: options.TLSListenPort, IP: listenIP}}
 	}
 
 	if options.HTTPSListenPort > 0 && config.TLSConfig != nil {
-		config.HTTPSListenAddr = &net.TCPAddr{Port: options.HTTPSListenPort, IP: listenIP}
+		config.HTTPSListenAddr = []*net.TCPAddr{{Port: options.HTTPSListenPort, IP: listenIP}}
 	}
 
 	// Init TCP and UDP listen addresses if listen port is not equal to zero
 	if options.ListenPort > 0 {
-		config.UDPListenAddr = &net.UDPAddr{Port: options.ListenPort, IP: listenIP}
-		config.TCPListenAddr = &net.TCPAddr{Port: options.ListenPort, IP: listenIP}
+		config.UDPListenAddr = []*net.UDPAddr{{Port: options.ListenPort, IP: listenIP}}
+		config.TCPListenAddr = []*net.TCPAddr{{Port: options.ListenPort, IP: listenIP}}
+	}
+
+	// Add extra handler if needed
+	if options.IPv6Disabled {
+		ipv6Configuration := ipv6Configuration{ipv6Disabled: options.IPv6Disabled}
+		config.RequestHandler = ipv6Configuration.handleDNSRequest
+	}
+
+	return config, nil
+}
+
+// parseDNSEntries parses the static DNS entries in the name=IP format
+func parseDNSEntries(entries []string) (map[string][]net.IP, error) {
+	res := map[string][]net.IP{}
+	for _, e := range entries {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid DNS entry: %s", e)
+		}
+		ip := net.ParseIP(strings.TrimSpace(parts[1]))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address in the DNS entry: %s", e)
+		}
+		name := strings.TrimSpace(parts[0])
+		res[name] = append(res[name], ip)
+	}
+	return res, nil
+}
+
+// parseCNAMEOverrides parses the CNAME overrides in the name=target format.
+// The names are validated by the proxy.
+func parseCNAMEOverrides(overrides []string) (map[string]string, error) {
+	res := map[string]string{}
+	for _, o := range overrides {
+		parts := strings.SplitN(o, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid CNAME override: %s", o)
+		}
+		res[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return res, nil
+}
+
+// parseCacheTTLCaps parses the cache TTL caps in the TYPE=seconds format.
+// The types are validated by the proxy.
+func parseCacheTTLCaps(caps []string) (map[string]uint32, error) {
+	res := map[string]uint32{}
+	for _, c := range caps {
+		parts := strings.SplitN(c, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid cache TTL cap: %s", c)
+		}
+		ttl, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TTL in the cache TTL cap: %s", c)
+		}
+		res[strings.TrimSpace(parts[0])] = uint32(ttl)
 	}
+	return res, nil
+}
 
-	return config
+// parseCacheTTLOverrides parses the cache TTL overrides in the DOMAIN=MIN:MAX format.
+// The domains are validated by the proxy.
+func parseCacheTTLOverrides(overrides []string) ([]proxy.CacheTTLOverride, error) {
+	var res []proxy.CacheTTLOverride
+	for _, o := range overrides {
+		parts := strings.SplitN(o, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid cache TTL override: %s", o)
+		}
+		ttls := strings.SplitN(parts[1], ":", 2)
+		if len(ttls) != 2 {
+			return nil, fmt.Errorf("invalid cache TTL override: %s", o)
+		}
+		minTTL, err := strconv.ParseUint(strings.TrimSpace(ttls[0]), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid min TTL in the cache TTL override: %s", o)
+		}
+		maxTTL, err := strconv.ParseUint(strings.TrimSpace(ttls[1]), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max TTL in the cache TTL override: %s", o)
+		}
+		res = append(res, proxy.CacheTTLOverride{
+			Domain: strings.TrimSpace(parts[0]),
+			MinTTL: uint32(minTTL),
+			MaxTTL: uint32(maxTTL),
+		})
+	}
+	return res, nil
 }
 
 // IPv6 configuration
@@ -233,6 +820,20 @@ func newTLSConfig(certPath, keyPath string) (*tls.Config, error) {
 	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
 }
 
+// loadCertPool reads the PEM encoded certificates from the file
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
 // loadX509KeyPair reads and parses a public/private key pair from a pair
 // of files. The files must contain PEM encoded data. The certificate file
 // may contain intermediate certificates following the leaf certificate to
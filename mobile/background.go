@@ -0,0 +1,69 @@
+package mobile
+
+import (
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// defaultIdleConnectionTimeout is the default Config.IdleConnectionTimeout.
+// It is shorter than the servers' timeouts, so the radio isn't woken up by the servers closing the connections.
+const defaultIdleConnectionTimeout = 30 * time.Second
+
+// upstreamOptions returns the options of the upstreams with the timeout and the idle connections settings of the config
+func upstreamOptions(config *Config, bootstraps []string) upstream.Options {
+	opts := upstream.Options{
+		Bootstrap:   bootstraps,
+		Timeout:     time.Duration(config.Timeout) * time.Millisecond,
+		IdleTimeout: defaultIdleConnectionTimeout,
+		// no keep-alive probes on the idle connections by default
+		KeepAlive: -1,
+	}
+	if config.IdleConnectionTimeout > 0 {
+		opts.IdleTimeout = time.Duration(config.IdleConnectionTimeout) * time.Millisecond
+	}
+	if config.KeepAliveInterval > 0 {
+		opts.KeepAlive = time.Duration(config.KeepAliveInterval) * time.Millisecond
+	}
+	return opts
+}
+
+// EnterBackground should be called when the app goes to the background.
+// If Config.CloseConnectionsInBackground is true, the idle upstream connections are closed,
+// so they don't wake up the radio. The queries are still resolved, they open new connections.
+func (d *DNSProxy) EnterBackground() {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.dnsProxy == nil || !d.Config.CloseConnectionsInBackground {
+		return
+	}
+	log.Printf("Closing the upstream connections in the background")
+	d.dnsProxy.CloseIdleConnections()
+}
+
+// EnterForeground should be called when the app returns to the foreground.
+// It connects to the upstreams in the background, so the first queries don't wait for the handshakes.
+func (d *DNSProxy) EnterForeground() {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.dnsProxy == nil {
+		return
+	}
+	for _, u := range d.dnsProxy.Upstreams {
+		go warmUpstream(u)
+	}
+}
+
+// warmUpstream sends a query to the upstream to establish the connection
+func warmUpstream(u upstream.Upstream) {
+	req := &dns.Msg{}
+	req.SetQuestion("ipv4only.arpa.", dns.TypeA)
+	_, err := u.Exchange(req)
+	if err != nil {
+		log.Tracef("Couldn't connect to %s: %s", u.Address(), err)
+	}
+}
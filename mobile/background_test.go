@@ -0,0 +1,59 @@
+package mobile
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// warmupUpstream counts the ipv4only.arpa queries
+type warmupUpstream struct {
+	switchUpstream
+	warmups int32
+}
+
+func (u *warmupUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	if m.Question[0].Name == "ipv4only.arpa." {
+		atomic.AddInt32(&u.warmups, 1)
+	}
+	return u.switchUpstream.Exchange(m)
+}
+
+func TestUpstreamOptions(t *testing.T) {
+	config := createDefaultConfig()
+	opts := upstreamOptions(config, []string{"8.8.8.8:53"})
+	assert.Equal(t, []string{"8.8.8.8:53"}, opts.Bootstrap)
+	assert.Equal(t, 5*time.Second, opts.Timeout)
+	assert.Equal(t, defaultIdleConnectionTimeout, opts.IdleTimeout)
+	assert.True(t, opts.KeepAlive < 0)
+
+	config.IdleConnectionTimeout = 5000
+	config.KeepAliveInterval = 60000
+	opts = upstreamOptions(config, nil)
+	assert.Equal(t, 5*time.Second, opts.IdleTimeout)
+	assert.Equal(t, time.Minute, opts.KeepAlive)
+}
+
+func TestEnterForeground(t *testing.T) {
+	d := createTestFilteringProxy(BlockTypeNXDomain)
+	d.Config.CloseConnectionsInBackground = true
+
+	// does nothing if the proxy isn't started
+	d.EnterBackground()
+	d.EnterForeground()
+
+	u := &warmupUpstream{switchUpstream: switchUpstream{available: 1}}
+	assert.Nil(t, d.startWithMock(u))
+	defer d.Stop()
+
+	d.EnterBackground()
+	assert.Equal(t, int32(0), atomic.LoadInt32(&u.warmups))
+
+	d.EnterForeground()
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&u.warmups) == 1
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,272 @@
+package mobile
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// The stages of the upstream test, see UpstreamTestResult.ErrorStage
+const (
+	UpstreamTestStageConfig    = "config"    // the upstream address or the bootstrap DNS is invalid
+	UpstreamTestStageBootstrap = "bootstrap" // the upstream host name can't be resolved
+	UpstreamTestStageDial      = "dial"      // the connection can't be established
+	UpstreamTestStageHandshake = "handshake" // the TLS handshake failed (e.g. the certificate isn't trusted)
+	UpstreamTestStageQuery     = "query"     // the test query failed
+	UpstreamTestStageTimeout   = "timeout"   // the test hasn't finished in time
+)
+
+// UpstreamTestResult contains the details of the upstream test (see TestUpstreamDetailed).
+// The fields of the stages that haven't been reached are empty.
+type UpstreamTestResult struct {
+	bootstrapAddresses []string
+	dialedAddress      string
+	tlsVersion         string
+	certSubject        string
+	certExpiry         time.Time
+	roundTrip          time.Duration
+	rcode              string
+	errorStage         string
+	err                error
+}
+
+// BootstrapAddresses returns the resolved addresses of the upstream host (each on a new line)
+func (r *UpstreamTestResult) BootstrapAddresses() string {
+	return strings.Join(r.bootstrapAddresses, "\n")
+}
+
+// DialedAddress returns the address the test connection has been established to
+func (r *UpstreamTestResult) DialedAddress() string {
+	return r.dialedAddress
+}
+
+// TLSVersion returns the negotiated TLS version (e.g. "TLS 1.3"), empty for plain DNS and DNSCrypt
+func (r *UpstreamTestResult) TLSVersion() string {
+	return r.tlsVersion
+}
+
+// CertificateSubject returns the subject of the upstream certificate
+func (r *UpstreamTestResult) CertificateSubject() string {
+	return r.certSubject
+}
+
+// CertificateExpiry returns the expiry time of the upstream certificate (epoch in milliseconds, 0 if there is none)
+func (r *UpstreamTestResult) CertificateExpiry() int64 {
+	if r.certExpiry.IsZero() {
+		return 0
+	}
+	return r.certExpiry.UnixNano() / int64(time.Millisecond)
+}
+
+// RoundTripMs returns the round-trip time of the test query (in milliseconds)
+func (r *UpstreamTestResult) RoundTripMs() int {
+	return int(r.roundTrip / time.Millisecond)
+}
+
+// Rcode returns the rcode of the response to the test query (e.g. "NOERROR")
+func (r *UpstreamTestResult) Rcode() string {
+	return r.rcode
+}
+
+// ErrorStage returns the stage the test failed at (one of UpstreamTestStage*), empty if the test succeeded
+func (r *UpstreamTestResult) ErrorStage() string {
+	return r.errorStage
+}
+
+// ErrorMessage returns the error of the failed test, empty if the test succeeded
+func (r *UpstreamTestResult) ErrorMessage() string {
+	if r.err == nil {
+		return ""
+	}
+	return r.err.Error()
+}
+
+// fail sets the failed stage and the error of the test
+func (r *UpstreamTestResult) fail(stage string, err error) *UpstreamTestResult {
+	r.errorStage = stage
+	r.err = err
+	return r
+}
+
+// TestUpstreamDetailed checks if upstream is valid and available and returns the details of every stage of the test.
+// * address - see upstream.AddressToUpstream for examples
+// * bootstrap - an optional bootstrap DNS. You can pass multiple addresses by separating them with a newline
+// * timeout - time limit of the whole test in milliseconds
+func TestUpstreamDetailed(address string, bootstrap string, timeout int) *UpstreamTestResult {
+	t := time.Duration(timeout) * time.Millisecond
+	ch := make(chan *UpstreamTestResult, 1)
+	go func() {
+		ch <- runUpstreamTest(address, bootstrap, t)
+	}()
+
+	select {
+	case r := <-ch:
+		return r
+	case <-time.After(t + upstreamTestGracePeriod):
+		r := &UpstreamTestResult{}
+		return r.fail(UpstreamTestStageTimeout, fmt.Errorf("the upstream test hasn't finished in %d ms", timeout))
+	}
+}
+
+// upstreamTestGracePeriod is how long the result of the upstream test is waited for after its time limit
+const upstreamTestGracePeriod = 100 * time.Millisecond
+
+// runUpstreamTest runs the stages of the upstream test within the timeout
+func runUpstreamTest(address string, bootstrap string, timeout time.Duration) *UpstreamTestResult {
+	r := &UpstreamTestResult{}
+	deadline := time.Now().Add(timeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	bootstraps := []string{}
+	for _, line := range strings.Split(bootstrap, "\n") {
+		if line != "" {
+			bootstraps = append(bootstraps, line)
+		}
+	}
+	opts := upstream.Options{Bootstrap: bootstraps, Timeout: timeout}
+	u, err := upstream.AddressToUpstream(address, opts)
+	if err != nil {
+		return r.fail(UpstreamTestStageConfig, err)
+	}
+
+	host, port := tlsHostPort(address)
+	if host != "" {
+		var ip net.IP
+		ip, err = r.testTLS(ctx, host, port, bootstraps, deadline)
+		if err != nil {
+			return r
+		}
+		// query the same address that has been tested
+		opts.ServerIP = ip
+		opts.Timeout = time.Until(deadline)
+		u, err = upstream.AddressToUpstream(address, opts)
+		if err != nil {
+			return r.fail(UpstreamTestStageConfig, err)
+		}
+	} else {
+		r.dialedAddress = u.Address()
+	}
+
+	req := &dns.Msg{}
+	req.Id = dns.Id()
+	req.RecursionDesired = true
+	req.Question = []dns.Question{
+		{Name: "ipv4only.arpa.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+	}
+	start := time.Now()
+	reply, err := u.Exchange(req)
+	r.roundTrip = time.Since(start)
+	if err != nil {
+		return r.fail(UpstreamTestStageQuery, err)
+	}
+	r.rcode = dns.RcodeToString[reply.Rcode]
+	if len(reply.Answer) == 0 {
+		return r.fail(UpstreamTestStageQuery, errors.New("DNS upstream returned reply with wrong number of answers"))
+	}
+	return r
+}
+
+// testTLS resolves the host, connects to it and performs the TLS handshake.
+// Returns the IP address the connection has been established to.
+func (r *UpstreamTestResult) testTLS(ctx context.Context, host, port string, bootstraps []string, deadline time.Time) (net.IP, error) {
+	ips := []net.IP{}
+	if ip := net.ParseIP(host); ip != nil {
+		ips = append(ips, ip)
+	} else {
+		resolvers := []*upstream.Resolver{}
+		for _, b := range bootstraps {
+			resolvers = append(resolvers, upstream.NewResolver(b, time.Until(deadline)))
+		}
+		if len(resolvers) == 0 {
+			resolvers = append(resolvers, upstream.NewResolver("", time.Until(deadline)))
+		}
+		addrs, err := upstream.LookupParallel(ctx, resolvers, host)
+		if err != nil {
+			r.fail(UpstreamTestStageBootstrap, err)
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	for _, ip := range ips {
+		r.bootstrapAddresses = append(r.bootstrapAddresses, ip.String())
+	}
+
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{}
+	for _, ip := range ips {
+		r.dialedAddress = net.JoinHostPort(ip.String(), port)
+		conn, err = dialer.DialContext(ctx, "tcp", r.dialedAddress)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		r.fail(UpstreamTestStageDial, err)
+		return nil, err
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(deadline)
+	tlsConn := tls.Client(conn, upstream.NewTLSConfig(host))
+	err = tlsConn.Handshake()
+	if err != nil {
+		r.fail(UpstreamTestStageHandshake, err)
+		return nil, err
+	}
+	state := tlsConn.ConnectionState()
+	r.tlsVersion = tlsVersionString(state.Version)
+	if len(state.PeerCertificates) > 0 {
+		r.certSubject = state.PeerCertificates[0].Subject.String()
+		r.certExpiry = state.PeerCertificates[0].NotAfter
+	}
+	return conn.RemoteAddr().(*net.TCPAddr).IP, nil
+}
+
+// tlsHostPort returns the host and the port of DNS-over-TLS and DNS-over-HTTPS addresses.
+// The host is empty for the other kinds of upstreams.
+func tlsHostPort(address string) (string, string) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", ""
+	}
+	switch u.Scheme {
+	case "tls":
+		if u.Port() == "" {
+			return u.Hostname(), "853"
+		}
+	case "https":
+		if u.Port() == "" {
+			return u.Hostname(), "443"
+		}
+	default:
+		return "", ""
+	}
+	return u.Hostname(), u.Port()
+}
+
+// tlsVersionString returns the name of the TLS version
+func tlsVersionString(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
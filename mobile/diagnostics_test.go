@@ -0,0 +1,118 @@
+package mobile
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startTestDoTServer starts a DNS-over-TLS server on 127.0.0.1 with a certificate signed by the returned CA
+func startTestDoTServer(t *testing.T) (*dns.Server, *x509.CertPool) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	require.NoError(t, err)
+	srv := &dns.Server{Listener: l, Net: "tcp-tls", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := &dns.Msg{}
+		resp.SetReply(r)
+		answer, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 192.0.0.170")
+		resp.Answer = append(resp.Answer, answer)
+		_ = w.WriteMsg(resp)
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	return srv, roots
+}
+
+func TestTestUpstreamDetailed(t *testing.T) {
+	srv, roots := startTestDoTServer(t)
+	defer srv.Shutdown()
+	addr := srv.Listener.Addr().String()
+
+	oldRoots := upstream.RootCAs
+	upstream.RootCAs = roots
+	defer func() { upstream.RootCAs = oldRoots }()
+
+	r := TestUpstreamDetailed("tls://"+addr, "", 1000)
+	assert.Equal(t, "", r.ErrorStage(), r.ErrorMessage())
+	assert.Equal(t, "127.0.0.1", r.BootstrapAddresses())
+	assert.Equal(t, addr, r.DialedAddress())
+	assert.Equal(t, "TLS 1.3", r.TLSVersion())
+	assert.Equal(t, "CN=127.0.0.1", r.CertificateSubject())
+	assert.True(t, r.CertificateExpiry() > time.Now().UnixNano()/int64(time.Millisecond))
+	assert.Equal(t, "NOERROR", r.Rcode())
+	assert.Nil(t, TestUpstream("tls://"+addr, "", 1000))
+
+	// the certificate isn't trusted
+	upstream.RootCAs = x509.NewCertPool()
+	r = TestUpstreamDetailed("tls://"+addr, "", 1000)
+	assert.Equal(t, UpstreamTestStageHandshake, r.ErrorStage())
+	assert.Equal(t, addr, r.DialedAddress())
+	assert.NotNil(t, TestUpstream("tls://"+addr, "", 1000))
+
+	r = TestUpstreamDetailed("sdns://invalid", "", 1000)
+	assert.Equal(t, UpstreamTestStageConfig, r.ErrorStage())
+
+	// nothing listens on the port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedAddr := l.Addr().String()
+	_ = l.Close()
+	r = TestUpstreamDetailed("tls://"+closedAddr, "", 1000)
+	assert.Equal(t, UpstreamTestStageDial, r.ErrorStage())
+	assert.Equal(t, "", r.TLSVersion())
+
+	// the plain DNS server never responds
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	start := time.Now()
+	r = TestUpstreamDetailed(conn.LocalAddr().String(), "", 200)
+	assert.Equal(t, UpstreamTestStageQuery, r.ErrorStage())
+	assert.Equal(t, conn.LocalAddr().String(), r.DialedAddress())
+	assert.True(t, time.Since(start) < time.Second)
+}
@@ -0,0 +1,128 @@
+package mobile
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// dns64Discovery caches the result of DiscoverDNS64Prefixes until InvalidateNetworkState is called
+type dns64Discovery struct {
+	prefixes []*net.IPNet // the discovered prefixes (empty on IPv4-only networks)
+	done     bool         // true if prefixes contains the result for the current network
+
+	sync.Mutex
+}
+
+// DiscoverDNS64Prefixes discovers the Pref64::/n of the network (see https://tools.ietf.org/html/rfc7050)
+// by resolving ipv4only.arpa AAAA with the upstreams of the running proxy.
+// Returns the prefixes in CIDR notation (e.g. "64:ff9b::/96", each on a new line) or an empty string
+// if the network doesn't have NAT64. The result is cached until InvalidateNetworkState is called.
+// If enable is true, the proxy synthesizes the AAAA records with the discovered /96 prefix.
+func (d *DNSProxy) DiscoverDNS64Prefixes(enable bool) (string, error) {
+	d.dns64.Lock()
+	defer d.dns64.Unlock()
+
+	// the upstreams are read under the lock, UpdateUpstreams replaces them
+	d.RLock()
+	p := d.dnsProxy
+	var upstreams []upstream.Upstream
+	if p != nil {
+		upstreams = p.Upstreams
+	}
+	d.RUnlock()
+	if p == nil {
+		return "", errors.New("DNS proxy is not started")
+	}
+
+	if !d.dns64.done {
+		reply, _, err := upstream.ExchangeParallel(upstreams, createIpv4ArpaMessage())
+		if err != nil {
+			return "", fmt.Errorf("cannot discover the DNS64 prefixes: %s", err)
+		}
+		d.dns64.prefixes = extractNAT64Prefixes(reply)
+		d.dns64.done = true
+		log.Printf("Discovered DNS64 prefixes: %v", d.dns64.prefixes)
+	}
+
+	lines := []string{}
+	for _, prefix := range d.dns64.prefixes {
+		lines = append(lines, prefix.String())
+		ones, _ := prefix.Mask.Size()
+		// only the /96 prefixes are supported by the proxy
+		if enable && ones == 96 {
+			p.SetNAT64Prefix(prefix.IP[:12])
+			enable = false
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// InvalidateNetworkState must be called when the network changes.
+// It drops the cached result of DiscoverDNS64Prefixes and the NAT64 prefix of the proxy
+// and probes the routable address families again.
+func (d *DNSProxy) InvalidateNetworkState() {
+	d.dns64.Lock()
+	d.dns64.prefixes = nil
+	d.dns64.done = false
+	d.dns64.Unlock()
+
+	d.RLock()
+	if d.dnsProxy != nil {
+		d.dnsProxy.ClearNAT64Prefix()
+		d.dnsProxy.NetworkChanged()
+	}
+	d.RUnlock()
+}
+
+// nat64IPv4Offsets are the positions of the IPv4 address bytes in the IPv6 address for each prefix length
+// (byte 8 is always skipped), see https://tools.ietf.org/html/rfc6052#section-2.2
+var nat64IPv4Offsets = map[int][]int{
+	32: {4, 5, 6, 7},
+	40: {5, 6, 7, 9},
+	48: {6, 7, 9, 10},
+	56: {7, 9, 10, 11},
+	64: {9, 10, 11, 12},
+	96: {12, 13, 14, 15},
+}
+
+// extractNAT64Prefixes returns all the distinct prefixes of the AAAA records that embed
+// one of the well-known IPv4 addresses, checking all the possible prefix lengths
+func extractNAT64Prefixes(r *dns.Msg) []*net.IPNet {
+	prefixes := []*net.IPNet{}
+	seen := map[string]bool{}
+	for _, rr := range r.Answer {
+		a, ok := rr.(*dns.AAAA)
+		if !ok || len(a.AAAA) != net.IPv6len {
+			continue
+		}
+
+		for _, length := range []int{32, 40, 48, 56, 64, 96} {
+			ipv4 := net.IP{}
+			for _, i := range nat64IPv4Offsets[length] {
+				ipv4 = append(ipv4, a.AAAA[i])
+			}
+			if !ipv4.Equal(wellKnownIPv4First) && !ipv4.Equal(wellKnownIPv4Second) {
+				continue
+			}
+			// the bits 64 to 71 must be zero
+			if length < 96 && a.AAAA[8] != 0 {
+				continue
+			}
+
+			mask := net.CIDRMask(length, 128)
+			prefix := &net.IPNet{IP: a.AAAA.Mask(mask), Mask: mask}
+			if !seen[prefix.String()] {
+				seen[prefix.String()] = true
+				prefixes = append(prefixes, prefix)
+			}
+		}
+	}
+	return prefixes
+}
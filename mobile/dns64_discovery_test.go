@@ -0,0 +1,104 @@
+package mobile
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dns64Upstream answers ipv4only.arpa AAAA with prefix + well-known IPv4 (no answer if prefix is nil)
+// and all the A queries with 1.2.3.4
+type dns64Upstream struct {
+	prefix net.IP
+	count  int32 // number of ipv4only.arpa queries
+}
+
+func (u *dns64Upstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	q := m.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60}
+	switch {
+	case q.Name == "ipv4only.arpa." && q.Qtype == dns.TypeAAAA:
+		atomic.AddInt32(&u.count, 1)
+		if u.prefix != nil {
+			ip := append(net.IP{}, u.prefix...)
+			copy(ip[12:], wellKnownIPv4Second)
+			resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	case q.Qtype == dns.TypeA:
+		resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: net.IP{1, 2, 3, 4}})
+	}
+	return resp, nil
+}
+
+func (u *dns64Upstream) Address() string {
+	return "dns64"
+}
+
+func TestExtractNAT64Prefixes(t *testing.T) {
+	testCases := map[string][]string{
+		"64:ff9b::c000:aa":             {"64:ff9b::/96"},
+		"64:ff9b::c000:ab":             {"64:ff9b::/96"},
+		"2001:db8:c000:aa::":           {"2001:db8::/32"},
+		"2001:db8:122:c000:0:aa00::":   {"2001:db8:122::/48"},
+		"2001:db8:122:344:c0:0:aa00:0": {"2001:db8:122:344::/64"},
+		"64:ff9b::102:304":             {},
+	}
+	for ip, expected := range testCases {
+		r := &dns.Msg{}
+		r.Answer = []dns.RR{
+			&dns.A{Hdr: dns.RR_Header{Rrtype: dns.TypeA}, A: net.IP{192, 0, 0, 170}},
+			&dns.AAAA{Hdr: dns.RR_Header{Rrtype: dns.TypeAAAA}, AAAA: net.ParseIP(ip)},
+		}
+		prefixes := []string{}
+		for _, prefix := range extractNAT64Prefixes(r) {
+			prefixes = append(prefixes, prefix.String())
+		}
+		assert.Equal(t, expected, prefixes, ip)
+	}
+}
+
+func TestDiscoverDNS64Prefixes(t *testing.T) {
+	u := &dns64Upstream{prefix: net.ParseIP("64:ff9b::")}
+	d := &DNSProxy{Config: createDefaultConfig()}
+	_, err := d.DiscoverDNS64Prefixes(false)
+	assert.NotNil(t, err)
+
+	require.Nil(t, d.startWithMock(u))
+	defer d.Stop()
+
+	resolveAAAA := func() []dns.RR {
+		reply, err := dns.Exchange(createHostTestMessageWithType("example.net", dns.TypeAAAA), d.Addr())
+		require.Nil(t, err)
+		return reply.Answer
+	}
+
+	prefixes, err := d.DiscoverDNS64Prefixes(false)
+	assert.Nil(t, err)
+	assert.Equal(t, "64:ff9b::/96", prefixes)
+	assert.Empty(t, resolveAAAA())
+
+	// the result is cached
+	prefixes, err = d.DiscoverDNS64Prefixes(true)
+	assert.Nil(t, err)
+	assert.Equal(t, "64:ff9b::/96", prefixes)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.count))
+	answer := resolveAAAA()
+	if assert.Len(t, answer, 1) {
+		assert.Equal(t, "64:ff9b::102:304", answer[0].(*dns.AAAA).AAAA.String())
+	}
+
+	// the network has changed to IPv4-only
+	u.prefix = nil
+	d.InvalidateNetworkState()
+	assert.Empty(t, resolveAAAA())
+	prefixes, err = d.DiscoverDNS64Prefixes(true)
+	assert.Nil(t, err)
+	assert.Equal(t, "", prefixes)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&u.count))
+}
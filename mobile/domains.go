@@ -0,0 +1,131 @@
+package mobile
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// domainSet is a set of domain names and *.wildcards
+type domainSet struct {
+	names     map[string]bool // "example.org" matches only example.org
+	wildcards map[string]bool // "*.example.org" matches the subdomains of example.org
+}
+
+// domainRules are the simple domain filtering rules (see Config.BlockedDomains and Config.AllowedDomains)
+type domainRules struct {
+	blocked   domainSet
+	allowed   domainSet
+	blockType int // BlockTypeNXDomain or BlockTypeUnspecifiedIP
+}
+
+// parseDomainSet parses the domains (each on a new line), the empty lines and the lines starting with # are ignored
+func parseDomainSet(list string) (domainSet, error) {
+	s := domainSet{names: map[string]bool{}, wildcards: map[string]bool{}}
+	for _, line := range strings.Split(list, "\n") {
+		line = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(line), "."))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		wildcard := strings.HasPrefix(line, "*.")
+		name := strings.TrimPrefix(line, "*.")
+		if _, ok := dns.IsDomainName(name); !ok || strings.Contains(name, "*") {
+			return s, fmt.Errorf("invalid domain: %s", line)
+		}
+		if wildcard {
+			s.wildcards[name] = true
+		} else {
+			s.names[name] = true
+		}
+	}
+	return s, nil
+}
+
+// match checks if the host (lowercase, without the trailing dot) is in the set
+func (s domainSet) match(host string) bool {
+	if s.names[host] {
+		return true
+	}
+	for i := strings.IndexByte(host, '.'); i >= 0; i = strings.IndexByte(host, '.') {
+		host = host[i+1:]
+		if s.wildcards[host] {
+			return true
+		}
+	}
+	return false
+}
+
+// newDomainRules creates the domain rules of the config, returns nil if there are no blocked domains
+func newDomainRules(blocked, allowed string, blockType int) (*domainRules, error) {
+	if blockType == BlockTypeRule {
+		blockType = BlockTypeNXDomain
+	}
+	if blockType != BlockTypeNXDomain && blockType != BlockTypeUnspecifiedIP {
+		return nil, fmt.Errorf("unknown domains block type %d", blockType)
+	}
+
+	r := &domainRules{blockType: blockType}
+	var err error
+	r.blocked, err = parseDomainSet(blocked)
+	if err != nil {
+		return nil, fmt.Errorf("invalid blocked domains: %s", err)
+	}
+	r.allowed, err = parseDomainSet(allowed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowed domains: %s", err)
+	}
+	if len(r.blocked.names) == 0 && len(r.blocked.wildcards) == 0 {
+		return nil, nil
+	}
+	return r, nil
+}
+
+// filter sets the blocking response if the requested domain is blocked and not allowed.
+// Returns true if the request is blocked.
+func (r *domainRules) filter(ctx *proxy.DNSContext) bool {
+	if r == nil {
+		return false
+	}
+	host := strings.ToLower(strings.TrimSuffix(ctx.Req.Question[0].Name, "."))
+	if !r.blocked.match(host) || r.allowed.match(host) {
+		return false
+	}
+
+	qtype := ctx.Req.Question[0].Qtype
+	switch {
+	case r.blockType == BlockTypeNXDomain:
+		ctx.Res = genNXDomain(ctx.Req)
+	case qtype == dns.TypeA:
+		ctx.Res, _ = genHostRuleAnswer(ctx.Req, net.IPv4zero)
+	case qtype == dns.TypeAAAA:
+		ctx.Res, _ = genHostRuleAnswer(ctx.Req, net.IPv6zero)
+	default:
+		ctx.Res = proxy.GenEmptyMessage(ctx.Req, dns.RcodeSuccess, retryNXDomain)
+	}
+	return true
+}
+
+// UpdateDomainRules replaces BlockedDomains, AllowedDomains and DomainsBlockType without restarting the proxy.
+// If the rules are invalid, an error is returned and the current rules are kept.
+func (d *DNSProxy) UpdateDomainRules(blocked, allowed string, blockType int) error {
+	rules, err := newDomainRules(blocked, allowed, blockType)
+	if err != nil {
+		return fmt.Errorf("cannot update the domain rules: %s", err)
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	d.domainRules = rules
+	if d.Config != nil {
+		newConfig := *d.Config
+		newConfig.BlockedDomains = blocked
+		newConfig.AllowedDomains = allowed
+		newConfig.DomainsBlockType = blockType
+		d.Config = &newConfig
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package mobile
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDomainSet(t *testing.T) {
+	s, err := parseDomainSet("# ads\nAds.Example.org.\n\n*.tracker.net\n")
+	require.NoError(t, err)
+	assert.True(t, s.match("ads.example.org"))
+	assert.False(t, s.match("www.ads.example.org"))
+	assert.False(t, s.match("example.org"))
+	assert.True(t, s.match("www.tracker.net"))
+	assert.True(t, s.match("a.b.tracker.net"))
+	assert.False(t, s.match("tracker.net"))
+	assert.False(t, s.match("nottracker.net"))
+
+	_, err = parseDomainSet("example..org")
+	assert.Error(t, err)
+	_, err = parseDomainSet("www.*.example.org")
+	assert.Error(t, err)
+}
+
+func TestDomainRules(t *testing.T) {
+	config := createDefaultConfig()
+	config.BlockedDomains = "ads.example.org\n*.tracker.net"
+	config.AllowedDomains = "ok.tracker.net"
+	d := &DNSProxy{Config: config}
+	require.Nil(t, d.startWithMock(&switchUpstream{available: 1}))
+	defer d.Stop()
+
+	resolve := func(host string, qtype uint16) *dns.Msg {
+		reply, err := dns.Exchange(createHostTestMessageWithType(host, qtype), d.Addr())
+		require.Nil(t, err)
+		return reply
+	}
+
+	assert.Equal(t, dns.RcodeNameError, resolve("ads.example.org", dns.TypeA).Rcode)
+	assert.Equal(t, dns.RcodeNameError, resolve("www.tracker.net", dns.TypeA).Rcode)
+	assert.Len(t, resolve("tracker.net", dns.TypeA).Answer, 1)
+	assert.Len(t, resolve("ok.tracker.net", dns.TypeA).Answer, 1)
+
+	// the rules are updated at runtime
+	require.Nil(t, d.UpdateDomainRules("*.example.org", "", BlockTypeUnspecifiedIP))
+	reply := resolve("www.example.org", dns.TypeA)
+	if assert.Len(t, reply.Answer, 1) {
+		assert.Equal(t, "0.0.0.0", reply.Answer[0].(*dns.A).A.String())
+	}
+	reply = resolve("www.example.org", dns.TypeAAAA)
+	if assert.Len(t, reply.Answer, 1) {
+		assert.Equal(t, "::", reply.Answer[0].(*dns.AAAA).AAAA.String())
+	}
+	reply = resolve("www.example.org", dns.TypeTXT)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Empty(t, reply.Answer)
+	assert.Len(t, resolve("www.tracker.net", dns.TypeA).Answer, 1)
+
+	// the invalid rules aren't applied
+	assert.NotNil(t, d.UpdateDomainRules("*.*.example.org", "", BlockTypeNXDomain))
+	assert.NotNil(t, d.UpdateDomainRules("example.org", "", 100))
+	assert.Equal(t, "*.example.org", d.Config.BlockedDomains)
+	reply = resolve("www.example.org", dns.TypeA)
+	if assert.Len(t, reply.Answer, 1) {
+		assert.Equal(t, "0.0.0.0", reply.Answer[0].(*dns.A).A.String())
+	}
+
+	stats := d.QueryStats()
+	assert.Equal(t, int64(6), stats.DomainsBlocked)
+	assert.Equal(t, int64(6), stats.Blocked)
+	assert.Equal(t, int64(9), stats.Total)
+}
+
+func TestDomainRulesExtendedErrors(t *testing.T) {
+	config := createDefaultConfig()
+	config.BlockedDomains = "ads.example.org"
+	config.ExtendedErrors = true
+	d := &DNSProxy{Config: config}
+	require.Nil(t, d.startWithMock(&switchUpstream{available: 1}))
+	defer d.Stop()
+
+	req := createHostTestMessageWithType("ads.example.org", dns.TypeA)
+	req.SetEdns0(4096, false)
+	reply, err := dns.Exchange(req, d.Addr())
+	require.Nil(t, err)
+	assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+	require.NotNil(t, reply.IsEdns0())
+	require.Len(t, reply.IsEdns0().Option, 1)
+	// the Blocked info code
+	assert.Equal(t, []byte{0, 15}, reply.IsEdns0().Option[0].(*dns.EDNS0_LOCAL).Data)
+}
@@ -0,0 +1,158 @@
+package mobile
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// systemFallbackProbeInterval is how often the main upstreams are checked in the fallback mode
+var systemFallbackProbeInterval = 30 * time.Second
+
+// systemFallback switches the proxy to the system resolvers when the main upstreams fail (see Config.FallbackToSystem).
+// The nil systemFallback is disabled.
+type systemFallback struct {
+	upstreams []upstream.Upstream // the system resolvers
+	active    bool                // true if the queries are resolved with the system resolvers
+	stop      chan struct{}       // closed when the proxy is stopped
+
+	sync.Mutex
+}
+
+// newSystemFallback creates the systemFallback with the system resolvers of the config.
+// Returns nil if FallbackToSystem is disabled.
+func newSystemFallback(config *Config) (*systemFallback, error) {
+	if !config.FallbackToSystem {
+		return nil, nil
+	}
+
+	upstreams, err := parseSystemResolvers(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no system resolvers specified")
+	}
+	return &systemFallback{upstreams: upstreams, stop: make(chan struct{})}, nil
+}
+
+// parseSystemResolvers creates the upstreams of Config.SystemResolvers (nil if there are none)
+func parseSystemResolvers(config *Config) ([]upstream.Upstream, error) {
+	var upstreams []upstream.Upstream
+	timeout := time.Duration(config.Timeout) * time.Millisecond
+	for _, line := range strings.Split(config.SystemResolvers, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		u, err := upstream.AddressToUpstream(line, upstream.Options{Timeout: timeout})
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse the system resolver %s: %s", line, err)
+		}
+		upstreams = append(upstreams, u)
+	}
+	return upstreams, nil
+}
+
+// isActive checks if the queries are resolved with the system resolvers
+func (f *systemFallback) isActive() bool {
+	if f == nil {
+		return false
+	}
+	f.Lock()
+	defer f.Unlock()
+	return f.active
+}
+
+// prepare makes the query use the system resolvers in the fallback mode
+func (f *systemFallback) prepare(ctx *proxy.DNSContext) {
+	if f.isActive() {
+		ctx.Upstreams = f.upstreams
+	}
+}
+
+// check switches to the fallback mode if the query has been resolved by a system resolver,
+// i.e. all the main upstreams have failed. In the fallback mode, the main upstreams are probed
+// every systemFallbackProbeInterval, when one of them responds, the fallback mode is switched off.
+func (f *systemFallback) check(ctx *proxy.DNSContext, d *DNSProxy) {
+	if f == nil || ctx.Upstream == nil || len(ctx.Upstreams) > 0 {
+		return
+	}
+	found := false
+	for _, u := range f.upstreams {
+		if u == ctx.Upstream {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	if f.active {
+		return
+	}
+	log.Printf("The upstreams are not available, switching to the system resolvers")
+	f.active = true
+	go f.probe(d)
+}
+
+// probe checks the main upstreams until one of them responds or the proxy is stopped
+func (f *systemFallback) probe(d *DNSProxy) {
+	ticker := time.NewTicker(systemFallbackProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+		}
+
+		var upstreams []upstream.Upstream
+		d.RLock()
+		if d.dnsProxy != nil {
+			upstreams = d.dnsProxy.Upstreams
+		}
+		d.RUnlock()
+		if upstreams == nil {
+			return
+		}
+
+		req := &dns.Msg{}
+		req.SetQuestion("ipv4only.arpa.", dns.TypeA)
+		_, u, err := upstream.ExchangeParallel(upstreams, req)
+		if err != nil {
+			log.Tracef("The upstreams are still not available: %s", err)
+			continue
+		}
+
+		log.Printf("Upstream %s is available, switching back from the system resolvers", u.Address())
+		f.Lock()
+		f.active = false
+		f.Unlock()
+		return
+	}
+}
+
+// close stops the probes
+func (f *systemFallback) close() {
+	if f != nil {
+		close(f.stop)
+	}
+}
+
+// IsFallbackMode checks if the queries are resolved with the system resolvers
+// because the upstreams are not available (see Config.FallbackToSystem)
+func (d *DNSProxy) IsFallbackMode() bool {
+	d.RLock()
+	defer d.RUnlock()
+	return d.fallback.isActive()
+}
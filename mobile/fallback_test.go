@@ -0,0 +1,94 @@
+package mobile
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// switchUpstream fails while its available flag is 0, otherwise it answers with 1.1.1.1
+type switchUpstream struct {
+	available int32
+}
+
+func (u *switchUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	if atomic.LoadInt32(&u.available) == 0 {
+		return nil, errors.New("upstream is not available")
+	}
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IP{1, 1, 1, 1},
+	}}
+	return resp, nil
+}
+
+func (u *switchUpstream) Address() string {
+	return "switch"
+}
+
+func TestSystemFallback(t *testing.T) {
+	oldInterval := systemFallbackProbeInterval
+	systemFallbackProbeInterval = 50 * time.Millisecond
+	defer func() { systemFallbackProbeInterval = oldInterval }()
+
+	// the system resolver answers with 2.2.2.2
+	system := proxy.Proxy{}
+	system.UDPListenAddr = []*net.UDPAddr{{Port: 0, IP: net.ParseIP("127.0.0.1")}}
+	system.Upstreams = []upstream.Upstream{&testUpstream{}}
+	system.RequestHandler = func(p *proxy.Proxy, d *proxy.DNSContext) error {
+		resp := dns.Msg{}
+		resp.SetReply(d.Req)
+		answer, err := dns.NewRR(d.Req.Question[0].Name + " 60 IN A 2.2.2.2")
+		assert.Nil(t, err)
+		resp.Answer = append(resp.Answer, answer)
+		d.Res = &resp
+		return nil
+	}
+	assert.Nil(t, system.Start())
+	defer system.Stop()
+
+	config := createDefaultConfig()
+	config.Fallbacks = ""
+	config.FallbackToSystem = true
+	config.SystemResolvers = system.Addr(proxy.ProtoUDP).String()
+	mobileDNSProxy := &DNSProxy{Config: config}
+	u := &switchUpstream{}
+	assert.Nil(t, mobileDNSProxy.startWithMock(u))
+	defer mobileDNSProxy.Stop()
+
+	resolve := func() string {
+		reply, err := dns.Exchange(createHostTestMessage("example.org"), mobileDNSProxy.Addr())
+		assert.Nil(t, err)
+		if len(reply.Answer) != 1 {
+			return ""
+		}
+		return reply.Answer[0].(*dns.A).A.String()
+	}
+
+	assert.False(t, mobileDNSProxy.IsFallbackMode())
+	assert.Equal(t, "2.2.2.2", resolve())
+	assert.True(t, mobileDNSProxy.IsFallbackMode())
+	assert.Equal(t, "2.2.2.2", resolve())
+
+	// the upstream is back
+	atomic.StoreInt32(&u.available, 1)
+	assert.Eventually(t, func() bool {
+		return !mobileDNSProxy.IsFallbackMode()
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "1.1.1.1", resolve())
+
+	// the system resolvers must be specified
+	config = createDefaultConfig()
+	config.FallbackToSystem = true
+	err := (&DNSProxy{Config: config}).Start()
+	assert.NotNil(t, err)
+}
@@ -101,22 +101,52 @@ func addFileRuleLists(listJSON string, ruleList *[]filterlist.RuleList) error {
 	return nil
 }
 
-// handleDNSRequest is a custom handler for proxy with filtering
+// handleDNSRequest is a custom handler for proxy with filtering.
+// Every handled query is reported to the DNSRequestProcessedListener, the stats and the query log here.
 func (d *DNSProxy) handleDNSRequest(p *proxy.Proxy, ctx *proxy.DNSContext) error {
-	var rule rules.Rule
-	var err error
-	var blocked bool
+	r, err := d.processDNSRequest(p, ctx)
+	handleDNSResponse(ctx, r.originalAnswer, r.rule, err, r.bytesReceived)
+	d.queryProcessed(ctx, r.blocked, err)
+	return err
+}
+
+// processedRequest is the outcome of processDNSRequest reported by handleDNSRequest
+type processedRequest struct {
+	originalAnswer *dns.Msg   // the response before the filtering (nil if it wasn't resolved)
+	rule           rules.Rule // the filtering rule that matched the request or the response (may be nil)
+	blocked        bool       // true if the query is blocked by the filtering rules or BlockedDomains
+	bytesReceived  int        // the size of the upstream response (0 if it wasn't resolved)
+}
+
+// processDNSRequest filters and resolves the request
+func (d *DNSProxy) processDNSRequest(p *proxy.Proxy, ctx *proxy.DNSContext) (r processedRequest, err error) {
+	d.RLock()
+	paused, pauseUpstreams := d.paused, d.pauseUpstreams
+	d.RUnlock()
+	if paused {
+		return r, d.handlePausedRequest(p, ctx, pauseUpstreams)
+	}
 
 	// Block AAAA requests if needed
 	if proxy.CheckDisabledAAAARequest(ctx, d.Config.IPv6Disabled) {
-		return nil
+		return r, nil
 	}
 
 	// Block 'use-application-dns.net.' to disable Mozilla DoH
 	if (ctx.Req.Question[0].Qtype == dns.TypeA || ctx.Req.Question[0].Qtype == dns.TypeAAAA) &&
 		ctx.Req.Question[0].Name == "use-application-dns.net." {
 		ctx.Res = genNXDomain(ctx.Req)
-		return nil
+		return r, nil
+	}
+
+	d.RLock()
+	domainsBlocked := d.domainRules.filter(ctx)
+	d.RUnlock()
+	if domainsBlocked {
+		p.SetExtendedError(ctx, proxy.EDEBlocked, "")
+		d.stats.domainBlocked()
+		r.blocked = true
+		return r, nil
 	}
 
 	d.RLock()
@@ -127,42 +157,49 @@ func (d *DNSProxy) handleDNSRequest(p *proxy.Proxy, ctx *proxy.DNSContext) error
 	//  but this would require the Upstream interface to have Close() function
 	//  (to prevent from hanging while waiting for unresponsive DNS server to respond).
 	if d.filteringEngine != nil {
-		rule, blocked, err = d.filteringEngine.filterRequest(ctx)
+		r.rule, r.blocked, err = d.filteringEngine.filterRequest(ctx)
 		d.RUnlock()
 		if err != nil {
-			handleDNSResponse(ctx, nil, rule, err, 0)
-			return err
+			r.blocked = false
+			return r, err
 		}
 
-		if blocked {
-			handleDNSResponse(ctx, nil, rule, nil, 0)
-			return nil
+		if r.blocked {
+			p.SetExtendedError(ctx, proxy.EDEFiltered, "")
+			return r, nil
 		}
 	} else {
 		d.RUnlock()
 	}
 
+	d.RLock()
+	fallback := d.fallback
+	d.RUnlock()
+	fallback.prepare(ctx)
+
 	err = p.Resolve(ctx)
+	fallback.check(ctx, d)
 
-	bytesReceived := 0
-	originalAnswer := &dns.Msg{}
+	r.originalAnswer = &dns.Msg{}
 	if ctx.Res != nil {
-		bytesReceived = ctx.Res.Len()
-		originalAnswer = ctx.Res.Copy()
+		r.bytesReceived = ctx.Res.Len()
+		r.originalAnswer = ctx.Res.Copy()
 	}
 	// Check if we have some rules before performing filtering. If the rule is not nil it means that this request has been whitelisted.
-	if rule == nil {
+	if r.rule == nil {
 		// Synchronize access to d.filteringEngine so it won't be suddenly uninitialized while in use.
 		// This could happen after proxy server has been stopped, but its workers are not yet exited.
 		d.RLock()
 		if d.filteringEngine != nil {
-			rule, _, err = d.filterResponse(ctx)
+			r.rule, r.blocked, err = d.filterResponse(ctx)
 		}
 		d.RUnlock()
+		if r.blocked {
+			p.SetExtendedError(ctx, proxy.EDEFiltered, "")
+		}
 	}
 
-	handleDNSResponse(ctx, originalAnswer, rule, err, bytesReceived)
-	return err
+	return r, err
 }
 
 // filteringEngine is a wrapper for urlfilter structures and filtering options
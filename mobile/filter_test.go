@@ -532,7 +532,7 @@ func TestFilteringProxyFilterResponse(t *testing.T) {
 // startWithMock starts the DNSProxy with given upstream
 // This method call is similar to call d.Start but it replaces the upstreams with given one before start
 // Use it if you want to have your own responses and not rely on a remote server
-func (d *DNSProxy) startWithMock(u *testUpstream) error {
+func (d *DNSProxy) startWithMock(u upstream.Upstream) error {
 	d.Lock()
 	defer d.Unlock()
 
@@ -551,12 +551,32 @@ func (d *DNSProxy) startWithMock(u *testUpstream) error {
 		return fmt.Errorf("cannot start the DNS proxy: %s", err)
 	}
 
+	d.domainRules, err = newDomainRules(d.Config.BlockedDomains, d.Config.AllowedDomains, d.Config.DomainsBlockType)
+	if err != nil {
+		return fmt.Errorf("cannot start the DNS proxy: %s", err)
+	}
+
+	d.fallback, err = newSystemFallback(d.Config)
+	if err != nil {
+		return fmt.Errorf("cannot start the DNS proxy: %s", err)
+	}
+	err = d.initPause(c.Fallbacks)
+	if err != nil {
+		return fmt.Errorf("cannot start the DNS proxy: %s", err)
+	}
+	if d.fallback != nil {
+		c.Fallbacks = append(c.Fallbacks, d.fallback.upstreams...)
+	}
+
 	c.RequestHandler = d.handleDNSRequest
 	d.dnsProxy = &proxy.Proxy{Config: *c}
 	d.dnsProxy.Upstreams = []upstream.Upstream{u}
 
 	// Start the proxy
 	err = d.dnsProxy.Start()
+	if err == nil && d.Config.LowMemoryMode {
+		d.idle = startIdleCloser(d.dnsProxy)
+	}
 	if err == nil && d.Config.DetectDNS64Prefix {
 		go calculateNAT64Prefix(d.dnsProxy, d.Config.SystemResolvers)
 	}
@@ -1,15 +1,17 @@
 package mobile
 
 import (
-	"errors"
-	"strings"
-	"time"
+	"fmt"
 
-	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/dnsproxy/internal/version"
 	"github.com/ameshkov/dnsstamps"
-	"github.com/miekg/dns"
 )
 
+// GetVersion returns the dnsproxy build information: the version, the git commit, the build date and the Go version
+func GetVersion() string {
+	return version.Full()
+}
+
 // DNSStamp is mobile-friendly DNS stamp structure
 type DNSStamp struct {
 	Proto        int    // Protocol (0x00 for plain, 0x01 for DNSCrypt, 0x02 for DOH, 0x03 for DOT
@@ -35,46 +37,14 @@ func ParseDNSStamp(stampStr string) (*DNSStamp, error) {
 
 // TestUpstream checks if upstream is valid and available
 // If it is, no error is returned. Otherwise this method returns an error with an explanation.
+// See TestUpstreamDetailed for the details of the test.
 // * address - see upstream.AddressToUpstream for examples
 // * bootstrap - an optional bootstrap DNS. You can pass multiple addresses by separating them with a newline
-// * timeout - timeout in milliseconds
+// * timeout - time limit of the whole test in milliseconds
 func TestUpstream(address string, bootstrap string, timeout int) error {
-	t := time.Duration(timeout) * time.Millisecond
-
-	bootstraps := []string{}
-
-	// Check bootstrap for empty strings
-	lines := strings.Split(bootstrap, "\n")
-	for _, line := range lines {
-		if line == "" {
-			continue
-		}
-
-		bootstraps = append(bootstraps, line)
-	}
-
-	u, err := upstream.AddressToUpstream(address, upstream.Options{Bootstrap: bootstraps, Timeout: t})
-	if err != nil {
-		return err
+	r := TestUpstreamDetailed(address, bootstrap, timeout)
+	if r.err != nil {
+		return fmt.Errorf("%s failed: %s", r.errorStage, r.err)
 	}
-
-	// Create a test DNS message
-	req := dns.Msg{}
-	req.Id = dns.Id()
-	req.RecursionDesired = true
-	req.Question = []dns.Question{
-		{Name: "ipv4only.arpa.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
-	}
-
-	reply, err := u.Exchange(&req)
-
-	if err != nil {
-		return err
-	}
-	if len(reply.Answer) == 0 {
-		return errors.New("DNS upstream returned reply with wrong number of answers")
-	}
-
-	// Everything else is supposed to be success
 	return nil
 }
@@ -0,0 +1,63 @@
+package mobile
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+)
+
+// listenAddrs returns the IP addresses and ports the proxy listens to on both UDP and TCP:
+// Config.ListenAddrs or, if it's empty, ListenAddr and ListenPort
+func listenAddrs(config *Config) ([]*net.UDPAddr, []*net.TCPAddr, error) {
+	if strings.TrimSpace(config.ListenAddrs) == "" {
+		listenIP := net.ParseIP(config.ListenAddr)
+		if listenIP == nil {
+			return nil, nil, fmt.Errorf("cannot parse %s", config.ListenAddr)
+		}
+		return []*net.UDPAddr{{Port: config.ListenPort, IP: listenIP}}, []*net.TCPAddr{{Port: config.ListenPort, IP: listenIP}}, nil
+	}
+
+	var udpAddrs []*net.UDPAddr
+	var tcpAddrs []*net.TCPAddr
+	for _, line := range strings.Split(config.ListenAddrs, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		host, portStr, err := net.SplitHostPort(line)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot parse the listen address %s: %s", line, err)
+		}
+		ip := net.ParseIP(host)
+		port, err := strconv.Atoi(portStr)
+		if ip == nil || err != nil || port < 0 || port > 0xffff {
+			return nil, nil, fmt.Errorf("cannot parse the listen address %s", line)
+		}
+		udpAddrs = append(udpAddrs, &net.UDPAddr{IP: ip, Port: port})
+		tcpAddrs = append(tcpAddrs, &net.TCPAddr{IP: ip, Port: port})
+	}
+	return udpAddrs, tcpAddrs, nil
+}
+
+// ListenAddrs returns the addresses the proxy is listening to with the actually bound ports (each on a new line),
+// e.g. "udp://127.0.0.1:5353" and "tcp://[::1]:53", in the order of Config.ListenAddrs.
+// When the port 0 is used, the UDP and TCP ports of the same address are different.
+func (d *DNSProxy) ListenAddrs() string {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.dnsProxy == nil {
+		return ""
+	}
+
+	var lines []string
+	for _, proto := range []string{proxy.ProtoUDP, proxy.ProtoTCP} {
+		for _, addr := range d.dnsProxy.Addrs(proto) {
+			lines = append(lines, proto+"://"+addr.String())
+		}
+	}
+	return strings.Join(lines, "\n")
+}
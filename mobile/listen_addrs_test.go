@@ -0,0 +1,56 @@
+package mobile
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenAddrs(t *testing.T) {
+	config := createDefaultConfig()
+	config.ListenAddrs = "127.0.0.1:0\n\n127.0.0.1:0\n"
+	d := &DNSProxy{Config: config}
+	require.Nil(t, d.startWithMock(&switchUpstream{available: 1}))
+
+	lines := strings.Split(d.ListenAddrs(), "\n")
+	require.Len(t, lines, 4)
+	for i, line := range lines {
+		proto := "udp"
+		if i >= 2 {
+			proto = "tcp"
+		}
+		require.True(t, strings.HasPrefix(line, proto+"://127.0.0.1:"), line)
+		assert.False(t, strings.HasSuffix(line, ":0"), line)
+
+		client := &dns.Client{Net: proto}
+		reply, _, err := client.Exchange(createHostTestMessage("example.org"), strings.TrimPrefix(line, proto+"://"))
+		require.NoError(t, err)
+		assert.Len(t, reply.Answer, 1)
+	}
+	assert.NotEqual(t, lines[0], lines[1])
+	require.Nil(t, d.Stop())
+	assert.Empty(t, d.ListenAddrs())
+
+	// the start fails if one of the addresses is busy
+	busy, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+	defer busy.Close()
+	config.ListenAddrs = "127.0.0.1:0\n" + busy.LocalAddr().String()
+	assert.NotNil(t, d.Start())
+	assert.Empty(t, d.ListenAddrs())
+
+	// and the proxy can be started again
+	config.ListenAddrs = "127.0.0.1:0"
+	require.Nil(t, d.startWithMock(&switchUpstream{available: 1}))
+	defer d.Stop()
+	assert.Len(t, strings.Split(d.ListenAddrs(), "\n"), 2)
+
+	for _, addrs := range []string{"127.0.0.1", "localhost:53", "127.0.0.1:65536", "[::1]:port"} {
+		_, _, err := listenAddrs(&Config{ListenAddrs: addrs})
+		assert.Error(t, err, addrs)
+	}
+}
@@ -0,0 +1,57 @@
+package mobile
+
+import (
+	"errors"
+	"net"
+)
+
+// callerListener is the UDP socket created by the app that the proxy serves instead of binding its own ones
+type callerListener struct {
+	conn  *net.UDPConn
+	close func() error // releases the socket when the proxy is stopped (nil if it's kept open)
+}
+
+// StartWithPacketConn starts the DNS proxy on the UDP socket created by the caller instead of ListenAddr and ListenPort.
+// The socket is closed by Stop only if closeOnStop is true. Restart keeps serving the same socket.
+// It's not available in the mobile bindings, see StartWithFD.
+func (d *DNSProxy) StartWithPacketConn(conn net.PacketConn, closeOnStop bool) error {
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		return errors.New("cannot start the DNS proxy: only UDP sockets are supported")
+	}
+
+	l := &callerListener{conn: udpConn}
+	if closeOnStop {
+		l.close = udpConn.Close
+	}
+	return d.startWithListener(l)
+}
+
+// startWithListener starts the DNS proxy on the caller's socket
+func (d *DNSProxy) startWithListener(l *callerListener) error {
+	d.Lock()
+	if d.dnsProxy != nil {
+		d.Unlock()
+		return errors.New("DNS proxy is already started")
+	}
+	d.listener = l
+	d.Unlock()
+
+	err := d.Start()
+	if err != nil {
+		d.Lock()
+		d.listener = nil
+		d.Unlock()
+	}
+	return err
+}
+
+// closeListener releases the caller's socket when the DNS proxy is stopped
+func (d *DNSProxy) closeListener() error {
+	l := d.listener
+	d.listener = nil
+	if l == nil || l.close == nil {
+		return nil
+	}
+	return l.close()
+}
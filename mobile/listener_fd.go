@@ -0,0 +1,48 @@
+// +build !windows
+
+package mobile
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// StartWithFD starts the DNS proxy on the UDP socket with the file descriptor fd instead of ListenAddr and ListenPort
+// (e.g. the socket protected from the VPN on Android).
+// The descriptor is closed by Stop only if closeOnStop is true. Restart keeps serving the same socket.
+func (d *DNSProxy) StartWithFD(fd int, closeOnStop bool) error {
+	// the proxy works with a duplicate, so the caller's descriptor is kept open
+	dup, err := syscall.Dup(fd)
+	if err != nil {
+		return fmt.Errorf("cannot start the DNS proxy: invalid file descriptor %d: %s", fd, err)
+	}
+	f := os.NewFile(uintptr(dup), fmt.Sprintf("fd %d", fd))
+	conn, err := net.FilePacketConn(f)
+	_ = f.Close()
+	if err != nil {
+		return fmt.Errorf("cannot start the DNS proxy: invalid socket %d: %s", fd, err)
+	}
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		_ = conn.Close()
+		return fmt.Errorf("cannot start the DNS proxy: %d is not a UDP socket", fd)
+	}
+
+	l := &callerListener{conn: udpConn}
+	l.close = func() error {
+		err := udpConn.Close()
+		if closeOnStop {
+			if closeErr := syscall.Close(fd); err == nil {
+				err = closeErr
+			}
+		}
+		return err
+	}
+	err = d.startWithListener(l)
+	if err != nil {
+		_ = udpConn.Close()
+	}
+	return err
+}
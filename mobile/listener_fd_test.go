@@ -0,0 +1,47 @@
+// +build !windows
+
+package mobile
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartWithFD(t *testing.T) {
+	srv := startTestUpstreamServer(t)
+	defer srv.Shutdown()
+	config := createDefaultConfig()
+	config.Upstreams = srv.PacketConn.LocalAddr().String()
+	config.Fallbacks = ""
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+	defer conn.Close()
+	f, err := conn.File()
+	require.NoError(t, err)
+	defer f.Close()
+	fd := int(f.Fd())
+
+	d := &DNSProxy{Config: config}
+	require.NoError(t, d.StartWithFD(fd, false))
+	checkServed(t, conn.LocalAddr().String())
+	require.NoError(t, d.Stop())
+
+	// the descriptor is kept open
+	var stat syscall.Stat_t
+	assert.NoError(t, syscall.Fstat(fd, &stat))
+
+	assert.NotNil(t, d.StartWithFD(-1, false))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	lf, err := l.(*net.TCPListener).File()
+	require.NoError(t, err)
+	defer lf.Close()
+	assert.NotNil(t, d.StartWithFD(int(lf.Fd()), false))
+	assert.Equal(t, "", d.Addr())
+}
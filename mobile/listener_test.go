@@ -0,0 +1,75 @@
+package mobile
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startTestUpstreamServer starts a plain DNS server that answers with 1.2.3.4
+func startTestUpstreamServer(t *testing.T) *dns.Server {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := &dns.Msg{}
+		resp.SetReply(r)
+		answer, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 1.2.3.4")
+		resp.Answer = append(resp.Answer, answer)
+		_ = w.WriteMsg(resp)
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+	return srv
+}
+
+// checkServed checks that the proxy answers on the address
+func checkServed(t *testing.T, addr string) {
+	client := &dns.Client{Timeout: time.Second}
+	reply, _, err := client.Exchange(createHostTestMessage("example.net"), addr)
+	require.NoError(t, err)
+	require.Len(t, reply.Answer, 1)
+	assert.Equal(t, "1.2.3.4", reply.Answer[0].(*dns.A).A.String())
+}
+
+func TestStartWithPacketConn(t *testing.T) {
+	srv := startTestUpstreamServer(t)
+	defer srv.Shutdown()
+	config := createDefaultConfig()
+	config.Upstreams = srv.PacketConn.LocalAddr().String()
+	config.Fallbacks = ""
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	d := &DNSProxy{Config: config}
+	require.NoError(t, d.StartWithPacketConn(conn, false))
+	assert.Equal(t, conn.LocalAddr().String(), d.Addr())
+	checkServed(t, d.Addr())
+	assert.NotNil(t, d.StartWithPacketConn(conn, false))
+
+	// Restart serves the same socket
+	require.NoError(t, d.Restart(config))
+	checkServed(t, conn.LocalAddr().String())
+
+	// the socket is kept open
+	require.NoError(t, d.Stop())
+	_, err = conn.WriteTo([]byte{0}, conn.LocalAddr())
+	assert.NoError(t, err)
+
+	// unless closeOnStop is set
+	require.NoError(t, d.StartWithPacketConn(conn, true))
+	checkServed(t, conn.LocalAddr().String())
+	require.NoError(t, d.Stop())
+	_, err = conn.WriteTo([]byte{0}, conn.LocalAddr())
+	assert.Error(t, err)
+
+	icmpConn, err := net.ListenPacket("ip4:icmp", "127.0.0.1")
+	if err == nil {
+		defer icmpConn.Close()
+		assert.NotNil(t, d.StartWithPacketConn(icmpConn, false))
+	}
+}
@@ -0,0 +1,79 @@
+package mobile
+
+import (
+	"runtime/debug"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// The limits of Config.LowMemoryMode
+const (
+	lowMemoryCacheSize     = 16 * 1024 // max cache size (in bytes)
+	lowMemoryUDPBufferSize = 4096      // size of the UDP read buffers (in bytes)
+	lowMemoryMaxGoroutines = 32        // max number of the queries processed in parallel
+)
+
+// lowMemoryIdleInterval is how often the idle upstream connections are closed in the low-memory mode
+var lowMemoryIdleInterval = 10 * time.Second
+
+// applyLowMemoryMode limits the cache, the buffers and the goroutines of the proxy config
+// and disables the optimistic cache and prefetch
+func applyLowMemoryMode(c *proxy.Config) {
+	if c.CacheSizeBytes > lowMemoryCacheSize {
+		c.CacheSizeBytes = lowMemoryCacheSize
+	}
+	c.CacheOptimistic = false
+	c.CachePrefetchThreshold = 0
+	c.UDPBufferSize = lowMemoryUDPBufferSize
+	if c.MaxGoroutines <= 0 || c.MaxGoroutines > lowMemoryMaxGoroutines {
+		c.MaxGoroutines = lowMemoryMaxGoroutines
+	}
+}
+
+// idleCloser closes the idle upstream connections of the proxy every lowMemoryIdleInterval.
+// The nil idleCloser is disabled.
+type idleCloser struct {
+	stop chan struct{} // closed when the proxy is stopped
+}
+
+// startIdleCloser starts closing the idle upstream connections of the proxy
+func startIdleCloser(p *proxy.Proxy) *idleCloser {
+	c := &idleCloser{stop: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(lowMemoryIdleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				p.CloseIdleConnections()
+			}
+		}
+	}()
+	return c
+}
+
+// close stops closing the connections
+func (c *idleCloser) close() {
+	if c != nil {
+		close(c.stop)
+	}
+}
+
+// OnLowMemory frees as much memory as possible: clears the cache, closes the idle upstream connections
+// and returns the freed memory to the OS. Call it from onTrimMemory (Android) or on the memory warnings (iOS).
+func (d *DNSProxy) OnLowMemory() {
+	d.RLock()
+	p := d.dnsProxy
+	d.RUnlock()
+
+	if p != nil {
+		p.ClearCache()
+		p.CloseIdleConnections()
+	}
+	debug.FreeOSMemory()
+	log.Printf("Freed the memory on the low memory warning")
+}
@@ -0,0 +1,58 @@
+package mobile
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLowMemoryMode(t *testing.T) {
+	config := createDefaultConfig()
+	config.CacheSizeBytes = 1024 * 1024
+	config.MaxGoroutines = 1000
+	config.LowMemoryMode = true
+	c, err := createConfig(config)
+	assert.Nil(t, err)
+	assert.Equal(t, lowMemoryCacheSize, c.CacheSizeBytes)
+	assert.True(t, c.CacheEnabled)
+	assert.False(t, c.CacheOptimistic)
+	assert.Equal(t, 0, c.CachePrefetchThreshold)
+	assert.Equal(t, lowMemoryUDPBufferSize, c.UDPBufferSize)
+	assert.Equal(t, lowMemoryMaxGoroutines, c.MaxGoroutines)
+
+	// the smaller limits are kept
+	config.CacheSizeBytes = 0
+	config.MaxGoroutines = 10
+	c, err = createConfig(config)
+	assert.Nil(t, err)
+	assert.False(t, c.CacheEnabled)
+	assert.Equal(t, 10, c.MaxGoroutines)
+}
+
+func TestOnLowMemory(t *testing.T) {
+	d := createTestFilteringProxy(BlockTypeNXDomain)
+	d.Config.CacheSizeBytes = 64 * 1024
+	d.Config.LowMemoryMode = true
+
+	// does nothing if the proxy isn't started
+	d.OnLowMemory()
+
+	// the answers of switchUpstream are cached
+	assert.Nil(t, d.startWithMock(&switchUpstream{available: 1}))
+	defer d.Stop()
+	assert.NotNil(t, d.idle)
+
+	packet, err := createHostTestMessageWithType("www.example.net", dns.TypeA).Pack()
+	assert.Nil(t, err)
+	_, err = d.Resolve(packet)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, d.dnsProxy.CacheStats().Entries)
+
+	d.OnLowMemory()
+	assert.Equal(t, 0, d.dnsProxy.CacheStats().Entries)
+
+	_, err = d.Resolve(packet)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, d.dnsProxy.CacheStats().Entries)
+}
@@ -40,6 +40,19 @@ type DNSProxy struct {
 	sync.RWMutex
 
 	filteringEngine *filteringEngine // Filtering structures and properties
+
+	stats    queryStats      // the processed queries totals and the StatsListener
+	fallback *systemFallback // the system resolvers fallback (nil if disabled)
+	queryLog queryLog        // the QueryLogListener and its queue
+	listener *callerListener // the caller's UDP socket (nil if the proxy binds ListenAddr and ListenPort)
+	dns64    dns64Discovery  // the cached result of DiscoverDNS64Prefixes
+	idle     *idleCloser     // closes the idle upstream connections in LowMemoryMode (nil if disabled)
+
+	domainRules *domainRules // BlockedDomains and AllowedDomains (nil if there are no blocked domains)
+
+	paused          bool                // true if the protection is paused (see Pause)
+	systemResolvers []upstream.Upstream // the parsed SystemResolvers
+	pauseUpstreams  []upstream.Upstream // the resolvers of the queries while paused
 }
 
 // Config is the DNS proxy configuration which uses only the subset of types that is supported by gomobile
@@ -47,6 +60,7 @@ type DNSProxy struct {
 type Config struct {
 	ListenAddr        string // IP address to listen to
 	ListenPort        int    // Port to listen to
+	ListenAddrs       string // A list of addresses with ports to listen to instead of ListenAddr and ListenPort (i.e. 127.0.0.1:53 or [::1]:0 each on a new line)
 	BootstrapDNS      string // A list of bootstrap DNS (i.e. 8.8.8.8:53 each on a new line)
 	Fallbacks         string // A list of fallback resolvers that will be used if the main one is not available (i.e. 1.1.1.1:53 each on a new line)
 	Upstreams         string // A list of upstream resolvers (each on a new line)
@@ -57,6 +71,22 @@ type Config struct {
 	SystemResolvers   string // A list of system resolvers for ipv6-only network (each on new line). We need to specify it to use dns.Client instead of default net.Resolver
 	DetectDNS64Prefix bool   // If true, DNS64 prefix detection is enabled
 	IPv6Disabled      bool   // If true, all AAAA requests will be replied with NoError RCode and empty answer
+	BlockIPv6         bool   // If true, the proxy answers all AAAA requests with NODATA, even the static and cached ones (can't be used with DetectDNS64Prefix)
+	FallbackToSystem  bool   // If true, SystemResolvers are used when the upstreams and fallbacks fail (see DNSProxy.IsFallbackMode)
+	LowMemoryMode     bool   // If true, the cache, buffers and goroutines are limited for the low-end devices (see DNSProxy.OnLowMemory)
+	ExtendedErrors    bool   // If true, the blocked and failed responses carry Extended DNS Errors (RFC 8914) without the text
+	PauseRefused      bool   // If true, the queries are answered with REFUSED while the proxy is paused (see DNSProxy.Pause)
+
+	// CertificateVerifier verifies the upstream certificates that aren't trusted by the embedded root CAs (optional)
+	CertificateVerifier CertificateVerifier
+
+	BlockedDomains   string // A list of blocked domains (each on a new line), "*.example.org" blocks the subdomains of example.org
+	AllowedDomains   string // A list of domains that aren't blocked even if they match BlockedDomains (same syntax)
+	DomainsBlockType int    // Response to the blocked domains: BlockTypeNXDomain (default) or BlockTypeUnspecifiedIP
+
+	IdleConnectionTimeout        int  // How long the idle upstream connections are kept open (milliseconds). Default: 30000
+	KeepAliveInterval            int  // Interval of the keep-alive probes on the upstream connections (milliseconds). Default: 0 (no probes)
+	CloseConnectionsInBackground bool // If true, DNSProxy.EnterBackground closes the idle upstream connections
 }
 
 // FilteringConfig is the filteringEngine configuration
@@ -82,7 +112,12 @@ func (d *DNSProxy) Start() error {
 	}
 
 	// Start proxy
-	return d.startProxy()
+	err = d.startProxy()
+	if err != nil && d.filteringEngine != nil {
+		_ = d.filteringEngine.close()
+		d.filteringEngine = nil
+	}
+	return err
 }
 
 // createFilteringEngine create and set filteringEngine
@@ -131,6 +166,11 @@ func (d *DNSProxy) Stop() error {
 		errs = append(errs, err)
 	}
 
+	err = d.closeListener()
+	if err != nil {
+		errs = append(errs, errorx.Decorate(err, "couldn't close the UDP socket"))
+	}
+
 	// Stop filtering engine
 	if d.filteringEngine != nil {
 		err := d.filteringEngine.close()
@@ -170,9 +210,59 @@ func (d *DNSProxy) Restart(config *Config) error {
 	return d.startProxy()
 }
 
+// UpdateUpstreams replaces the upstreams of the running proxy with Upstreams, Fallbacks, BootstrapDNS, Timeout
+// and CertificateVerifier of the specified config. The listeners and the cache are kept, the other fields of the config are ignored.
+// If the upstreams are invalid, an error is returned and the running proxy isn't changed.
+func (d *DNSProxy) UpdateUpstreams(config *Config) error {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.dnsProxy == nil {
+		return errors.New("DNS proxy is not started")
+	}
+
+	newConfig := *d.Config
+	newConfig.Upstreams = config.Upstreams
+	newConfig.Fallbacks = config.Fallbacks
+	newConfig.BootstrapDNS = config.BootstrapDNS
+	newConfig.Timeout = config.Timeout
+	newConfig.CertificateVerifier = config.CertificateVerifier
+	c, err := createConfig(&newConfig)
+	if err != nil {
+		return fmt.Errorf("cannot update the upstreams: %s", err)
+	}
+	if len(c.Upstreams) == 0 {
+		return errors.New("cannot update the upstreams: no upstreams specified")
+	}
+
+	// the new upstreams take the verifier when they connect, so it's set before Reload and restored if it fails
+	prevVerifier := upstream.VerifyCertificate
+	setCertificateVerifier(newConfig.CertificateVerifier)
+	proxyConfig := d.dnsProxy.Config
+	proxyConfig.Upstreams = c.Upstreams
+	proxyConfig.Fallbacks = c.Fallbacks
+	if d.fallback != nil {
+		proxyConfig.Fallbacks = append(proxyConfig.Fallbacks, d.fallback.upstreams...)
+	}
+	_, err = d.dnsProxy.Reload(proxyConfig)
+	if err != nil {
+		upstream.VerifyCertificate = prevVerifier
+		return fmt.Errorf("cannot update the upstreams: %s", err)
+	}
+
+	d.Config = &newConfig
+	d.setPauseUpstreams(c.Fallbacks)
+	return nil
+}
+
 func (d *DNSProxy) stopProxy() error {
 	errs := []error{}
 
+	d.fallback.close()
+	d.fallback = nil
+	d.idle.close()
+	d.idle = nil
+
 	if d.dnsProxy != nil {
 		err := d.dnsProxy.Stop()
 		d.dnsProxy = nil
@@ -189,20 +279,53 @@ func (d *DNSProxy) stopProxy() error {
 }
 
 func (d *DNSProxy) startProxy() error {
+	setCertificateVerifier(d.Config.CertificateVerifier)
 	c, err := createConfig(d.Config)
 	if err != nil {
 		return fmt.Errorf("cannot start the DNS proxy: %s", err)
 	}
 
+	d.domainRules, err = newDomainRules(d.Config.BlockedDomains, d.Config.AllowedDomains, d.Config.DomainsBlockType)
+	if err != nil {
+		return fmt.Errorf("cannot start the DNS proxy: %s", err)
+	}
+
+	d.fallback, err = newSystemFallback(d.Config)
+	if err != nil {
+		return fmt.Errorf("cannot start the DNS proxy: %s", err)
+	}
+	err = d.initPause(c.Fallbacks)
+	if err != nil {
+		return fmt.Errorf("cannot start the DNS proxy: %s", err)
+	}
+	if d.fallback != nil {
+		// the system resolvers are the last fallbacks
+		c.Fallbacks = append(c.Fallbacks, d.fallback.upstreams...)
+	}
+
+	if d.listener != nil {
+		// serve only the caller's socket
+		c.UDPListenAddr = nil
+		c.TCPListenAddr = nil
+		c.UDPListeners = []*net.UDPConn{d.listener.conn}
+	}
+
 	c.RequestHandler = d.handleDNSRequest
 	d.dnsProxy = &proxy.Proxy{Config: *c}
 
-	// Start the proxy
+	// Start the proxy, if one of the listen addresses fails, the others are closed
 	err = d.dnsProxy.Start()
-	if err == nil && d.Config.DetectDNS64Prefix {
+	if err != nil {
+		_ = d.stopProxy()
+		return err
+	}
+	if d.Config.LowMemoryMode {
+		d.idle = startIdleCloser(d.dnsProxy)
+	}
+	if d.Config.DetectDNS64Prefix {
 		go calculateNAT64Prefix(d.dnsProxy, d.Config.SystemResolvers)
 	}
-	return err
+	return nil
 }
 
 // Addr gets the address proxy is currently listening to
@@ -263,15 +386,15 @@ func (d *DNSProxy) Resolve(packet []byte) ([]byte, error) {
 
 // createProxyConfig creates proxy.Config from mobile.Config values
 func createConfig(config *Config) (*proxy.Config, error) {
-	listenIP := net.ParseIP(config.ListenAddr)
-	if listenIP == nil {
-		return nil, fmt.Errorf("cannot parse %s", config.ListenAddr)
+	if config.BlockIPv6 && config.DetectDNS64Prefix {
+		return nil, errors.New("BlockIPv6 can't be used with DetectDNS64Prefix")
 	}
-	timeout := time.Duration(config.Timeout) * time.Millisecond
 
 	// Init listen addresses and upstreams
-	listenUDPAddr := &net.UDPAddr{Port: config.ListenPort, IP: listenIP}
-	listenTCPAddr := &net.TCPAddr{Port: config.ListenPort, IP: listenIP}
+	listenUDPAddrs, listenTCPAddrs, err := listenAddrs(config)
+	if err != nil {
+		return nil, err
+	}
 	upstreams := make([]upstream.Upstream, 0)
 
 	// Check bootstraps list for empty strings
@@ -292,7 +415,7 @@ func createConfig(config *Config) (*proxy.Config, error) {
 			continue
 		}
 
-		dnsUpstream, err := upstream.AddressToUpstream(line, upstream.Options{Bootstrap: bootstraps, Timeout: timeout})
+		dnsUpstream, err := upstream.AddressToUpstream(line, upstreamOptions(config, bootstraps))
 		if err != nil {
 			return nil, fmt.Errorf("cannot prepare the upstream %s (%s): %s", line, config.BootstrapDNS, err)
 		}
@@ -302,14 +425,17 @@ func createConfig(config *Config) (*proxy.Config, error) {
 
 	// Create the config
 	proxyConfig := proxy.Config{
-		UDPListenAddr:  listenUDPAddr,
-		TCPListenAddr:  listenTCPAddr,
+		UDPListenAddr:  listenUDPAddrs,
+		TCPListenAddr:  listenTCPAddrs,
 		Upstreams:      upstreams,
 		AllServers:     config.AllServers,
 		CacheSizeBytes: config.CacheSizeBytes,
 		CacheEnabled:   config.CacheSizeBytes > 0,
 		MaxGoroutines:  config.MaxGoroutines,
 		Ratelimit:      0,
+
+		EnableExtendedErrors: config.ExtendedErrors,
+		BlockIPv6:            config.BlockIPv6,
 	}
 
 	if config.Fallbacks != "" {
@@ -320,7 +446,7 @@ func createConfig(config *Config) (*proxy.Config, error) {
 				continue
 			}
 
-			fallback, err := upstream.AddressToUpstream(line, upstream.Options{Timeout: timeout})
+			fallback, err := upstream.AddressToUpstream(line, upstreamOptions(config, nil))
 			if err != nil {
 				return nil, fmt.Errorf("cannot parse the fallback %s (%s): %s", line, config.BootstrapDNS, err)
 			}
@@ -331,5 +457,8 @@ func createConfig(config *Config) (*proxy.Config, error) {
 		proxyConfig.Fallbacks = fallbacks
 	}
 
+	if config.LowMemoryMode {
+		applyLowMemoryMode(&proxyConfig)
+	}
 	return &proxyConfig, nil
 }
@@ -364,6 +364,18 @@ func TestDNSProxyDisabledIPv6(t *testing.T) {
 	assert.Nil(t, mobileDNSProxy.Stop())
 }
 
+func TestBlockIPv6WithDNS64(t *testing.T) {
+	config := createDefaultConfig()
+	config.BlockIPv6 = true
+	c, err := createConfig(config)
+	assert.Nil(t, err)
+	assert.True(t, c.BlockIPv6)
+
+	config.DetectDNS64Prefix = true
+	_, err = createConfig(config)
+	assert.NotNil(t, err)
+}
+
 // testDNSProxyRestartAsync restarts DNSProxy in separate goroutine
 // And asserts thar dnsproxy and filtering engine are not nil nor before nor after the restart
 func testDNSProxyRestartAsync(t *testing.T, d *DNSProxy, g *sync.WaitGroup) {
@@ -481,8 +493,8 @@ func assertListenerEventsCount(t *testing.T, listener *testDNSRequestProcessedLi
 // createDNS64Server creates a DNS64 server mock for unit-tests
 func createDNS64Server(t *testing.T) *proxy.Proxy {
 	p := proxy.Proxy{}
-	p.UDPListenAddr = &net.UDPAddr{Port: 0, IP: net.ParseIP("127.0.0.1")}
-	p.TCPListenAddr = &net.TCPAddr{Port: 0, IP: net.ParseIP("127.0.0.1")}
+	p.UDPListenAddr = []*net.UDPAddr{{Port: 0, IP: net.ParseIP("127.0.0.1")}}
+	p.TCPListenAddr = []*net.TCPAddr{{Port: 0, IP: net.ParseIP("127.0.0.1")}}
 	dnsUpstream, err := upstream.AddressToUpstream("8.8.8.8:53", upstream.Options{})
 	assert.Nil(t, err)
 	p.Upstreams = []upstream.Upstream{dnsUpstream}
@@ -525,3 +537,76 @@ func createDefaultConfig() *Config {
 		MaxGoroutines: 1,
 	}
 }
+
+func TestDNSProxyUpdateUpstreams(t *testing.T) {
+	// the new upstream answers all the A requests with 1.2.3.4
+	newUpstream := proxy.Proxy{}
+	newUpstream.UDPListenAddr = []*net.UDPAddr{{Port: 0, IP: net.ParseIP("127.0.0.1")}}
+	newUpstream.Upstreams = []upstream.Upstream{&testUpstream{}}
+	newUpstream.RequestHandler = func(p *proxy.Proxy, d *proxy.DNSContext) error {
+		resp := dns.Msg{}
+		resp.SetReply(d.Req)
+		answer, err := dns.NewRR(d.Req.Question[0].Name + " 60 IN A 1.2.3.4")
+		assert.Nil(t, err)
+		resp.Answer = append(resp.Answer, answer)
+		d.Res = &resp
+		return nil
+	}
+	assert.Nil(t, newUpstream.Start())
+	defer newUpstream.Stop()
+
+	config := createDefaultConfig()
+	mobileDNSProxy := &DNSProxy{Config: config}
+	assert.NotNil(t, mobileDNSProxy.UpdateUpstreams(config))
+	assert.Nil(t, mobileDNSProxy.startWithMock(&testUpstream{ipv4: testIPv4}))
+	defer mobileDNSProxy.Stop()
+	addr := mobileDNSProxy.Addr()
+
+	resolve := func() *dns.Msg {
+		reply, err := dns.Exchange(createHostTestMessage("adguard.com"), addr)
+		assert.Nil(t, err)
+		return reply
+	}
+	assert.Equal(t, "104.20.30.130", resolve().Answer[0].(*dns.A).A.String())
+
+	// invalid upstreams don't change the running proxy
+	assert.NotNil(t, mobileDNSProxy.UpdateUpstreams(&Config{Upstreams: "sdns://invalid", Timeout: 1000}))
+	assert.NotNil(t, mobileDNSProxy.UpdateUpstreams(&Config{Upstreams: "\n", Timeout: 1000}))
+	assert.Equal(t, "104.20.30.130", resolve().Answer[0].(*dns.A).A.String())
+
+	newConfig := &Config{Upstreams: newUpstream.Addr(proxy.ProtoUDP).String(), Timeout: 1000}
+	assert.Nil(t, mobileDNSProxy.UpdateUpstreams(newConfig))
+	assert.Equal(t, addr, mobileDNSProxy.Addr())
+	assert.Equal(t, "1.2.3.4", resolve().Answer[0].(*dns.A).A.String())
+	assert.Equal(t, newConfig.Upstreams, mobileDNSProxy.Config.Upstreams)
+	assert.Equal(t, config.ListenAddr, mobileDNSProxy.Config.ListenAddr)
+}
+
+func TestDNSProxyUpdateUpstreamsReloadFailure(t *testing.T) {
+	running := &testCertificateVerifier{}
+	config := createDefaultConfig()
+	config.CertificateVerifier = running
+	setCertificateVerifier(running)
+	defer setCertificateVerifier(nil)
+
+	d := &DNSProxy{Config: config}
+	if !assert.Nil(t, d.startWithMock(&testUpstream{ipv4: testIPv4})) {
+		return
+	}
+	defer func() { _ = d.Stop() }()
+
+	// Reload fails on the stopped proxy
+	assert.Nil(t, d.dnsProxy.Stop())
+	updated := &testCertificateVerifier{}
+	err := d.UpdateUpstreams(&Config{Upstreams: "tls://1.1.1.1", Timeout: 1000, CertificateVerifier: updated})
+	assert.NotNil(t, err)
+
+	// the running configuration and the verifier are kept
+	assert.Equal(t, config.Upstreams, d.Config.Upstreams)
+	assert.Equal(t, CertificateVerifier(running), d.Config.CertificateVerifier)
+	if assert.NotNil(t, upstream.VerifyCertificate) {
+		assert.Nil(t, upstream.VerifyCertificate("dns.example.org", [][]byte{{1}}))
+	}
+	assert.Equal(t, "dns.example.org", running.host)
+	assert.Empty(t, updated.host)
+}
@@ -0,0 +1,77 @@
+package mobile
+
+import (
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Pause switches off the protection without stopping the proxy: the listeners and the cache are kept,
+// and the queries are sent directly to the system resolvers (or, without them, to the fallbacks)
+// without the filtering and the cache. With Config.PauseRefused or without those resolvers, the queries
+// are answered with REFUSED. The state is kept when the proxy is restarted or its upstreams are updated.
+func (d *DNSProxy) Pause() {
+	d.Lock()
+	defer d.Unlock()
+	if !d.paused {
+		log.Printf("Pausing the DNS proxy")
+		d.paused = true
+	}
+}
+
+// Resume switches the protection back on after Pause
+func (d *DNSProxy) Resume() {
+	d.Lock()
+	defer d.Unlock()
+	if d.paused {
+		log.Printf("Resuming the DNS proxy")
+		d.paused = false
+	}
+}
+
+// IsPaused checks if the proxy is paused (see Pause)
+func (d *DNSProxy) IsPaused() bool {
+	d.RLock()
+	defer d.RUnlock()
+	return d.paused
+}
+
+// initPause sets the resolvers of the paused queries: the system resolvers or the fallbacks of the config
+func (d *DNSProxy) initPause(fallbacks []upstream.Upstream) error {
+	if d.fallback != nil {
+		d.systemResolvers = d.fallback.upstreams
+	} else {
+		var err error
+		d.systemResolvers, err = parseSystemResolvers(d.Config)
+		if err != nil {
+			return err
+		}
+	}
+	d.setPauseUpstreams(fallbacks)
+	return nil
+}
+
+// setPauseUpstreams sets the resolvers of the paused queries when the fallbacks change
+func (d *DNSProxy) setPauseUpstreams(fallbacks []upstream.Upstream) {
+	d.pauseUpstreams = d.systemResolvers
+	if len(d.pauseUpstreams) == 0 {
+		d.pauseUpstreams = fallbacks
+	}
+}
+
+// handlePausedRequest resolves the query received while the proxy is paused (see Pause)
+func (d *DNSProxy) handlePausedRequest(p *proxy.Proxy, ctx *proxy.DNSContext, upstreams []upstream.Upstream) error {
+	var err error
+	if d.Config.PauseRefused || len(upstreams) == 0 {
+		ctx.Res = &dns.Msg{}
+		ctx.Res.SetRcode(ctx.Req, dns.RcodeRefused)
+		ctx.Res.RecursionAvailable = true
+	} else {
+		ctx.Upstreams = upstreams
+		ctx.CacheBypass = true
+		err = p.Resolve(ctx)
+	}
+
+	return err
+}
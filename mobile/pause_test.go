@@ -0,0 +1,78 @@
+package mobile
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPause(t *testing.T) {
+	// the system resolver answers with 2.2.2.2
+	var systemQueries int32
+	system := proxy.Proxy{}
+	system.UDPListenAddr = []*net.UDPAddr{{Port: 0, IP: net.ParseIP("127.0.0.1")}}
+	system.Upstreams = []upstream.Upstream{&testUpstream{}}
+	system.RequestHandler = func(p *proxy.Proxy, d *proxy.DNSContext) error {
+		atomic.AddInt32(&systemQueries, 1)
+		resp := &dns.Msg{}
+		resp.SetReply(d.Req)
+		answer, err := dns.NewRR(d.Req.Question[0].Name + " 60 IN A 2.2.2.2")
+		require.NoError(t, err)
+		resp.Answer = append(resp.Answer, answer)
+		d.Res = resp
+		return nil
+	}
+	require.NoError(t, system.Start())
+	defer system.Stop()
+
+	config := createDefaultConfig()
+	config.Fallbacks = ""
+	config.SystemResolvers = system.Addr(proxy.ProtoUDP).String()
+	config.BlockedDomains = "ads.example.org"
+	d := &DNSProxy{Config: config}
+	require.Nil(t, d.startWithMock(&switchUpstream{available: 1}))
+	defer d.Stop()
+
+	resolve := func(host string) *dns.Msg {
+		reply, err := dns.Exchange(createHostTestMessage(host), d.Addr())
+		require.NoError(t, err)
+		return reply
+	}
+
+	assert.False(t, d.IsPaused())
+	assert.Equal(t, dns.RcodeNameError, resolve("ads.example.org").Rcode)
+
+	// the paused queries aren't filtered or cached
+	d.Pause()
+	assert.True(t, d.IsPaused())
+	for i := 0; i < 2; i++ {
+		reply := resolve("ads.example.org")
+		require.Len(t, reply.Answer, 1)
+		assert.Equal(t, "2.2.2.2", reply.Answer[0].(*dns.A).A.String())
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&systemQueries))
+
+	// the state survives the upstreams update
+	update := createDefaultConfig()
+	update.Upstreams = system.Addr(proxy.ProtoUDP).String()
+	update.Fallbacks = ""
+	require.Nil(t, d.UpdateUpstreams(update))
+	assert.True(t, d.IsPaused())
+	assert.Len(t, resolve("ads.example.org").Answer, 1)
+
+	d.Resume()
+	assert.False(t, d.IsPaused())
+	assert.Equal(t, dns.RcodeNameError, resolve("ads.example.org").Rcode)
+
+	d.Lock()
+	d.Config.PauseRefused = true
+	d.Unlock()
+	d.Pause()
+	assert.Equal(t, dns.RcodeRefused, resolve("example.org").Rcode)
+}
@@ -0,0 +1,145 @@
+package mobile
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// queryLogQueueSize is the max number of events waiting to be passed to the QueryLogListener.
+// If the listener is slower than that, the oldest events are dropped (see DNSProxy.QueryLogDropped).
+const queryLogQueueSize = 256
+
+// QueryLogEvent is a processed query passed to the QueryLogListener
+type QueryLogEvent struct {
+	Domain string // Queried domain name
+	Type   string // Query type
+	Proto  string // Client protocol ("udp", "tcp", "tls", "https")
+
+	StartTime    int64  // Time when dnsproxy started processing request (epoch in milliseconds)
+	Elapsed      int    // Time elapsed on processing (in milliseconds)
+	Answer       string // DNS Answers string representation
+	Status       string // QueryStatusBlocked, QueryStatusError or the rcode of the response (e.g. "NOERROR")
+	UpstreamAddr string // Address of the upstream used to resolve (empty if the response is cached or blocked)
+	Blocked      bool   // True if the query is blocked by the filtering rules
+	IPv6Blocked  bool   // True if the AAAA query is answered with NODATA because of IPv6Disabled or BlockIPv6
+	Cached       bool   // True if the response is served from the cache
+	ProxyStatus  string // The outcome of the processing by the proxy (see proxy.Status), e.g. "timeout"
+	// ExtendedErrors are the Extended DNS Errors of the upstream response separated by "; ", e.g. "6 (DNSSEC Bogus)"
+	ExtendedErrors string
+
+	Error string // If not empty, contains the error text (occurred while processing the DNS query)
+}
+
+// QueryLogListener receives the processed queries (see DNSProxy.SetQueryLogListener)
+type QueryLogListener interface {
+	OnQueryLogEvent(e *QueryLogEvent)
+}
+
+// queryLog contains the QueryLogListener and the queue of its events
+type queryLog struct {
+	listener QueryLogListener
+	events   []*QueryLogEvent // the queued events, the oldest first
+	notify   chan struct{}    // signals the notifyLoop about the new events (nil if there is no listener)
+	dropped  int64            // number of the events dropped because the queue was full
+
+	sync.Mutex
+}
+
+// SetQueryLogListener sets the listener of the query log events (nil to remove it).
+// The listener is called on a separate goroutine, so it doesn't delay the responses.
+func (d *DNSProxy) SetQueryLogListener(l QueryLogListener) {
+	q := &d.queryLog
+	q.Lock()
+	defer q.Unlock()
+
+	q.listener = l
+	if l != nil && q.notify == nil {
+		q.notify = make(chan struct{}, 1)
+		go q.notifyLoop(q.notify)
+	} else if l == nil && q.notify != nil {
+		close(q.notify)
+		q.notify = nil
+		q.events = nil
+	}
+}
+
+// QueryLogDropped returns the number of the query log events that were dropped because the listener was too slow
+func (d *DNSProxy) QueryLogDropped() int64 {
+	q := &d.queryLog
+	q.Lock()
+	defer q.Unlock()
+	return q.dropped
+}
+
+// add queues the processed query to the QueryLogListener, the oldest event is dropped if the queue is full
+func (q *queryLog) add(ctx *proxy.DNSContext, status string, err error) {
+	q.Lock()
+	defer q.Unlock()
+	if q.notify == nil {
+		return
+	}
+
+	e := &QueryLogEvent{
+		Domain:    strings.TrimSuffix(ctx.Req.Question[0].Name, "."),
+		Type:      dns.Type(ctx.Req.Question[0].Qtype).String(),
+		Proto:     ctx.Proto,
+		StartTime: ctx.StartTime.UnixNano() / int64(time.Millisecond),
+		Elapsed:   int(time.Since(ctx.StartTime) / time.Millisecond),
+		Status:    status,
+		Blocked:   status == QueryStatusBlocked,
+		Cached:    ctx.CachedResponse,
+	}
+	e.IPv6Blocked = ctx.IPv6Blocked
+	e.ProxyStatus = ctx.Status.String()
+	for i, ede := range ctx.ExtendedErrors {
+		if i > 0 {
+			e.ExtendedErrors += "; "
+		}
+		e.ExtendedErrors += ede.String()
+	}
+	if ctx.Res != nil {
+		e.Answer = dnsAnswerListToString(ctx.Res.Answer)
+	}
+	if ctx.Upstream != nil {
+		e.UpstreamAddr = ctx.Upstream.Address()
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	if len(q.events) >= queryLogQueueSize {
+		q.events[0] = nil
+		q.events = q.events[1:]
+		q.dropped++
+	}
+	q.events = append(q.events, e)
+	select {
+	case q.notify <- struct{}{}:
+	default:
+		// the notifyLoop hasn't handled the previous signal yet
+	}
+}
+
+// notifyLoop passes the queued events to the current listener until notify is closed
+func (q *queryLog) notifyLoop(notify chan struct{}) {
+	for range notify {
+		for {
+			q.Lock()
+			if q.notify != notify || len(q.events) == 0 {
+				q.Unlock()
+				break
+			}
+			e := q.events[0]
+			q.events[0] = nil
+			q.events = q.events[1:]
+			l := q.listener
+			q.Unlock()
+
+			l.OnQueryLogEvent(e)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package mobile
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testQueryLogListener collects the query log events
+type testQueryLogListener struct {
+	events  []*QueryLogEvent
+	release chan struct{} // if not nil, OnQueryLogEvent waits for it
+	sync.Mutex
+}
+
+func (l *testQueryLogListener) OnQueryLogEvent(e *QueryLogEvent) {
+	if l.release != nil {
+		<-l.release
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.events = append(l.events, e)
+}
+
+// wait waits for n events and returns them
+func (l *testQueryLogListener) wait(t *testing.T, n int) []*QueryLogEvent {
+	var events []*QueryLogEvent
+	assert.Eventually(t, func() bool {
+		l.Lock()
+		defer l.Unlock()
+		events = append([]*QueryLogEvent{}, l.events...)
+		return len(events) >= n
+	}, time.Second, 10*time.Millisecond)
+	return events
+}
+
+func TestQueryLogListener(t *testing.T) {
+	dnsProxy := createTestFilteringProxy(BlockTypeNXDomain)
+	dnsProxy.Config.CacheSizeBytes = 64 * 1024
+	// the answers of switchUpstream are cached
+	err := dnsProxy.startWithMock(&switchUpstream{available: 1})
+	assert.Nil(t, err)
+	defer dnsProxy.Stop()
+
+	resolve := func(host string) {
+		packet, err := createHostTestMessageWithType(host, dns.TypeA).Pack()
+		assert.Nil(t, err)
+		_, err = dnsProxy.Resolve(packet)
+		assert.Nil(t, err)
+	}
+
+	listener := &testQueryLogListener{}
+	dnsProxy.SetQueryLogListener(listener)
+	resolve("example.com")
+	resolve("www.example.net")
+	resolve("www.example.net")
+	events := listener.wait(t, 3)
+	if assert.Len(t, events, 3) {
+		assert.Equal(t, "example.com", events[0].Domain)
+		assert.Equal(t, "A", events[0].Type)
+		assert.True(t, events[0].Blocked)
+		assert.Equal(t, QueryStatusBlocked, events[0].Status)
+
+		assert.Equal(t, "www.example.net", events[1].Domain)
+		assert.False(t, events[1].Blocked)
+		assert.False(t, events[1].Cached)
+		assert.NotEmpty(t, events[1].UpstreamAddr)
+		assert.Equal(t, "NOERROR", events[1].Status)
+		assert.Equal(t, "udp", events[1].Proto)
+		assert.NotEmpty(t, events[1].Answer)
+
+		assert.True(t, events[2].Cached)
+		assert.Empty(t, events[2].UpstreamAddr)
+	}
+
+	// the listener is removed
+	dnsProxy.SetQueryLogListener(nil)
+	resolve("www.example.net")
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, listener.wait(t, 3), 3)
+	assert.Equal(t, int64(0), dnsProxy.QueryLogDropped())
+}
+
+func TestQueryLogIPv6Blocked(t *testing.T) {
+	dnsProxy := createTestFilteringProxy(BlockTypeNXDomain)
+	dnsProxy.Config.IPv6Disabled = true
+	err := dnsProxy.startWithMock(&switchUpstream{available: 1})
+	assert.Nil(t, err)
+	defer dnsProxy.Stop()
+
+	listener := &testQueryLogListener{}
+	dnsProxy.SetQueryLogListener(listener)
+	for _, qtype := range []uint16{dns.TypeAAAA, dns.TypeA} {
+		packet, err := createHostTestMessageWithType("www.example.net", qtype).Pack()
+		assert.Nil(t, err)
+		_, err = dnsProxy.Resolve(packet)
+		assert.Nil(t, err)
+	}
+
+	events := listener.wait(t, 2)
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, "AAAA", events[0].Type)
+		assert.True(t, events[0].IPv6Blocked)
+		assert.False(t, events[0].Blocked)
+		assert.Equal(t, "NOERROR", events[0].Status)
+		assert.Empty(t, events[0].UpstreamAddr)
+
+		assert.Equal(t, "A", events[1].Type)
+		assert.False(t, events[1].IPv6Blocked)
+	}
+}
+
+func TestQueryLogCanaryDomain(t *testing.T) {
+	dnsProxy := createTestFilteringProxy(BlockTypeNXDomain)
+	err := dnsProxy.startWithMock(&switchUpstream{available: 1})
+	assert.Nil(t, err)
+	defer dnsProxy.Stop()
+
+	listener := &testQueryLogListener{}
+	dnsProxy.SetQueryLogListener(listener)
+	packet, err := createHostTestMessageWithType("use-application-dns.net", dns.TypeA).Pack()
+	assert.Nil(t, err)
+	_, err = dnsProxy.Resolve(packet)
+	assert.Nil(t, err)
+
+	events := listener.wait(t, 1)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, "use-application-dns.net", events[0].Domain)
+		assert.Equal(t, "NXDOMAIN", events[0].Status)
+	}
+}
+
+func TestQueryLogDropOldest(t *testing.T) {
+	d := &DNSProxy{}
+	listener := &testQueryLogListener{release: make(chan struct{})}
+	d.SetQueryLogListener(listener)
+	defer d.SetQueryLogListener(nil)
+
+	ctx := &proxy.DNSContext{StartTime: time.Now()}
+	for i := 0; i < queryLogQueueSize+10; i++ {
+		ctx.Req = createHostTestMessage(dns.Fqdn(string(rune('a'+i%26)) + "example.org"))
+		ctx.Req.Id = uint16(i)
+		d.queryLog.add(ctx, "NOERROR", nil)
+	}
+
+	// the first event may be already taken by the listener
+	dropped := d.QueryLogDropped()
+	assert.True(t, dropped == 10 || dropped == 9, "dropped: %d", dropped)
+	close(listener.release)
+	events := listener.wait(t, queryLogQueueSize)
+	assert.True(t, len(events) == queryLogQueueSize || len(events) == queryLogQueueSize+1)
+}
@@ -1,6 +1,27 @@
 package mobile
 
-import "crypto/x509"
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+)
+
+// CertificateVerifier verifies the upstream certificates with the platform trust store
+// (e.g. X509TrustManager on Android or SecTrust on iOS), so that the user-installed CAs are trusted.
+// It's called only for the certificates that aren't trusted by the embedded root CAs.
+type CertificateVerifier interface {
+	// VerifyCertificateChain checks that the certificate chain is trusted.
+	// derChain contains the concatenated DER-encoded certificates sent by the server, the leaf certificate first
+	// (it can be parsed with CertificateFactory.generateCertificates on Android).
+	// host is the upstream host name, it has already been checked against the leaf certificate.
+	// Returns an error if the chain isn't trusted.
+	VerifyCertificateChain(derChain []byte, host string) error
+}
 
 func loadSystemRootCAs() *x509.CertPool {
 	// Use default implementation
@@ -8,3 +29,105 @@ func loadSystemRootCAs() *x509.CertPool {
 	p.AppendCertsFromPEM([]byte(systemRootsPEM))
 	return p
 }
+
+// trustedRoots are the certificates of upstream.RootCAs.
+// certs is nil until the pool is changed, then it contains the embedded roots and the added ones.
+var trustedRoots struct {
+	certs []*x509.Certificate
+	sync.Mutex
+}
+
+// AddTrustedRoots adds the PEM-encoded root certificates to the trusted ones.
+// They are used for the upstream connections created afterwards.
+// If the PEM is invalid, an error is returned and the trusted roots aren't changed.
+func (d *DNSProxy) AddTrustedRoots(rootsPEM string) error {
+	certs, err := parseRootsPEM(rootsPEM)
+	if err != nil {
+		return fmt.Errorf("cannot add the trusted roots: %s", err)
+	}
+
+	trustedRoots.Lock()
+	defer trustedRoots.Unlock()
+	if trustedRoots.certs == nil {
+		trustedRoots.certs, err = parseRootsPEM(systemRootsPEM)
+		if err != nil {
+			return fmt.Errorf("cannot add the trusted roots: %s", err)
+		}
+	}
+	setTrustedRoots(append(trustedRoots.certs, certs...))
+	return nil
+}
+
+// ReplaceTrustedRoots replaces all the trusted root certificates (including the embedded ones)
+// with the PEM-encoded ones. They are used for the upstream connections created afterwards.
+// If the PEM is invalid, an error is returned and the trusted roots aren't changed.
+func (d *DNSProxy) ReplaceTrustedRoots(rootsPEM string) error {
+	certs, err := parseRootsPEM(rootsPEM)
+	if err != nil {
+		return fmt.Errorf("cannot replace the trusted roots: %s", err)
+	}
+
+	trustedRoots.Lock()
+	defer trustedRoots.Unlock()
+	setTrustedRoots(certs)
+	return nil
+}
+
+// setTrustedRoots replaces upstream.RootCAs with a new pool of the certificates.
+// The pool isn't changed in place since it's shared by the existing upstream connections.
+// trustedRoots must be locked.
+func setTrustedRoots(certs []*x509.Certificate) {
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	trustedRoots.certs = certs
+	upstream.RootCAs = pool
+}
+
+// parseRootsPEM parses the PEM-encoded certificates, returns an error if there are none or one of them is invalid
+func parseRootsPEM(rootsPEM string) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	rest := []byte(rootsPEM)
+	for n := 1; ; n++ {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("PEM block %d is %s, not CERTIFICATE", n, block.Type)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate in PEM block %d: %s", n, err)
+		}
+		certs = append(certs, cert)
+	}
+	if strings.TrimSpace(string(rest)) != "" {
+		return nil, errors.New("invalid PEM data after the last certificate")
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found in PEM")
+	}
+	return certs, nil
+}
+
+// setCertificateVerifier makes the upstreams created afterwards use the verifier (nil to use only the embedded roots)
+func setCertificateVerifier(v CertificateVerifier) {
+	if v == nil {
+		upstream.VerifyCertificate = nil
+		return
+	}
+	upstream.VerifyCertificate = func(host string, rawCerts [][]byte) error {
+		derChain := []byte{}
+		for _, raw := range rawCerts {
+			derChain = append(derChain, raw...)
+		}
+		err := v.VerifyCertificateChain(derChain, host)
+		if err != nil {
+			return fmt.Errorf("the platform trust store rejected the certificate of %s: %s", host, err)
+		}
+		return nil
+	}
+}
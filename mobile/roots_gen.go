@@ -1,9 +1,10 @@
 // +build ignore
 
-// Generates roots_gen.go.
+// Generates roots_list.go.
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/sha256"
 	"crypto/x509"
@@ -12,14 +13,19 @@ import (
 	"flag"
 	"fmt"
 	"go/format"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"os/exec"
 	"regexp"
+	"sort"
 	"strings"
 )
 
+// allowedCAs are the root CAs embedded into the library, by the subject or by the SHA-256 fingerprint
+// prefixed with "sha256:" (e.g. "sha256:96bcec06..."), every entry must be found in the source
 var allowedCAs = map[string]bool{
 	"CN=AddTrust Class 1 CA Root,OU=AddTrust TTP Network,O=AddTrust AB,C=SE":           true,
 	"CN=AddTrust External CA Root,OU=AddTrust External TTP Network,O=AddTrust AB,C=SE": true,
@@ -48,14 +54,109 @@ var allowedCAs = map[string]bool{
 	`CN=Go Daddy Root Certificate Authority - G2,O=GoDaddy.com\, Inc.,L=Scottsdale,ST=Arizona,C=US`: true,
 }
 
-var output = flag.String("output", "roots_list.go", "file name to write")
+var (
+	output = flag.String("output", "roots_list.go", "file name to write")
+	source = flag.String("source", "apple", "certificates source: apple (the iOS trust store, macOS only) or mozilla (the Mozilla CA bundle)")
+	input  = flag.String("input", "", "mozilla source: the local PEM bundle to read instead of downloading it")
+	cache  = flag.String("cache", "roots_apple_ids.txt", "apple source: the cached list of the iOS trust store fingerprints, used if apple.com can't be parsed")
+
+	summary  = flag.String("summary", "", "file to write the summary of the included and missing CAs to (default: stdout)")
+	minCerts = flag.Int("min", 100, "minimum number of the certificates in the source")
+)
+
+// mozillaBundleURL is the Mozilla CA bundle in PEM
+const mozillaBundleURL = "https://curl.se/ca/cacert.pem"
 
 func main() {
-	certs, err := selectCerts()
+	flag.Parse()
+
+	var certs []*x509.Certificate
+	var err error
+	switch *source {
+	case "apple":
+		certs, err = appleCerts()
+	case "mozilla":
+		certs, err = mozillaCerts(*input)
+	default:
+		err = fmt.Errorf("unknown source %q", *source)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	certs, missing := filterCerts(certs)
+	err = writeSummary(certs, missing)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if len(missing) > 0 {
+		log.Fatalf("%d allowed CAs are not found in the %s source:\n- %s", len(missing), *source, strings.Join(missing, "\n- "))
+	}
+
+	err = writeCerts(certs)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// filterCerts selects the allowed certificates sorted by the subject, so the output is the same on every run.
+// Returns the sorted allowedCAs entries that aren't found.
+func filterCerts(certs []*x509.Certificate) (selected []*x509.Certificate, missing []string) {
+	found := map[string]bool{}
+	seen := map[string]bool{}
+	for _, cert := range certs {
+		subjectName := cert.Subject.String()
+		fingerprint := certFingerprint(cert)
+		pin := "sha256:" + fingerprint
+		if (!allowedCAs[subjectName] && !allowedCAs[pin]) || seen[fingerprint] {
+			continue
+		}
+		found[subjectName] = true
+		found[pin] = true
+		seen[fingerprint] = true
+		selected = append(selected, cert)
+	}
+
+	for name := range allowedCAs {
+		if !found[name] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+
+	sort.Slice(selected, func(i, j int) bool {
+		si, sj := selected[i].Subject.String(), selected[j].Subject.String()
+		if si != sj {
+			return si < sj
+		}
+		return certFingerprint(selected[i]) < certFingerprint(selected[j])
+	})
+	return selected, missing
+}
+
+// writeSummary writes the sorted lists of the included certificates and the missing CAs,
+// so the changes of the generated list can be reviewed with diff
+func writeSummary(certs []*x509.Certificate, missing []string) error {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "source: %s\n", *source)
+	fmt.Fprintf(buf, "included: %d\n", len(certs))
+	for _, cert := range certs {
+		fmt.Fprintf(buf, "+ %s %s\n", certFingerprint(cert), cert.Subject.String())
+	}
+	fmt.Fprintf(buf, "missing: %d\n", len(missing))
+	for _, name := range missing {
+		fmt.Fprintf(buf, "- %s\n", name)
+	}
+
+	if *summary == "" {
+		_, err := os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	return ioutil.WriteFile(*summary, buf.Bytes(), 0644)
+}
 
+// writeCerts writes the certificates to the output file
+func writeCerts(certs []*x509.Certificate) error {
 	buf := new(bytes.Buffer)
 
 	fmt.Fprintf(buf, "// Code generated by roots_gen --output %s; DO NOT EDIT.\n", *output)
@@ -63,36 +164,39 @@ func main() {
 
 	fmt.Fprintf(buf, "const systemRootsPEM = `\n")
 	for _, cert := range certs {
-
-		subjectName := cert.Subject.String()
-		log.Printf(subjectName)
-
-		if _, ok := allowedCAs[subjectName]; ok {
-			b := &pem.Block{
-				Type:  "CERTIFICATE",
-				Bytes: cert.Raw,
-			}
-			if err := pem.Encode(buf, b); err != nil {
-				log.Fatal(err)
-			}
+		b := &pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: cert.Raw,
+		}
+		if err := pem.Encode(buf, b); err != nil {
+			return err
 		}
-
 	}
 	fmt.Fprintf(buf, "`")
 
 	source, err := format.Source(buf.Bytes())
 	if err != nil {
-		log.Fatal("source format error:", err)
-	}
-	if err := ioutil.WriteFile(*output, source, 0644); err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("source format error: %s", err)
 	}
+	return ioutil.WriteFile(*output, source, 0644)
 }
 
-func selectCerts() ([]*x509.Certificate, error) {
+// appleCerts returns the certificates of the iOS trust store that are also in the macOS system keychain.
+// The trust store fingerprints are taken from apple.com and saved to the cache file,
+// if the page can't be downloaded or parsed, the cached list is used.
+func appleCerts() ([]*x509.Certificate, error) {
 	ids, err := fetchCertIDs()
+	if err == nil && len(ids) < *minCerts {
+		err = fmt.Errorf("only %d certificates found, expected at least %d", len(ids), *minCerts)
+	}
 	if err != nil {
-		return nil, err
+		log.Printf("WARNING: cannot get the iOS trust store from apple.com, using the cached list %s: %s", *cache, err)
+		ids, err = readCertIDs(*cache)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the cached list: %s", err)
+		}
+	} else if err = writeCertIDs(*cache, ids); err != nil {
+		return nil, fmt.Errorf("cannot update the cached list: %s", err)
 	}
 
 	scerts, err := sysCerts()
@@ -111,13 +215,93 @@ func selectCerts() ([]*x509.Certificate, error) {
 	return certs, nil
 }
 
-func sysCerts() (certs map[string]*x509.Certificate, err error) {
-	cmd := exec.Command("/usr/bin/security", "find-certificate", "-a", "-p", "/System/Library/Keychains/SystemRootCertificates.keychain")
-	data, err := cmd.Output()
+// readCertIDs reads the cached list of the certificates written by writeCertIDs
+func readCertIDs(path string) ([]certID, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseCertIDs(f)
+}
+
+// parseCertIDs parses the list of the certificates: a fingerprint and a name per line, the lines starting with # are ignored
+func parseCertIDs(r io.Reader) ([]certID, error) {
+	ids := []certID{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 || len(fields[0]) != 2*sha256.Size {
+			return nil, fmt.Errorf("invalid line %d: %s", n, line)
+		}
+		ids = append(ids, certID{fingerprint: strings.ToLower(fields[0]), name: fields[1]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no certificates found")
+	}
+	return ids, nil
+}
+
+// writeCertIDs writes the list of the certificates sorted by the fingerprint
+func writeCertIDs(path string, ids []certID) error {
+	sorted := append([]certID{}, ids...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].fingerprint < sorted[j].fingerprint })
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "# The iOS trust store fingerprints (SHA-256), updated by roots_gen -source=apple; DO NOT EDIT.\n")
+	for _, id := range sorted {
+		fmt.Fprintf(buf, "%s %s\n", id.fingerprint, id.name)
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// mozillaCerts returns the certificates of the Mozilla CA bundle read from path or downloaded if path is empty
+func mozillaCerts(path string) ([]*x509.Certificate, error) {
+	var data []byte
+	var err error
+	if path != "" {
+		data, err = ioutil.ReadFile(path)
+	} else {
+		data, err = download(mozillaBundleURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	certs := []*x509.Certificate{}
+	for _, cert := range parsePEM(data) {
+		certs = append(certs, cert)
+	}
+	if len(certs) < *minCerts {
+		return nil, fmt.Errorf("only %d certificates found in the Mozilla CA bundle, expected at least %d", len(certs), *minCerts)
+	}
+	return certs, nil
+}
+
+// download returns the body of the url
+func download(url string) ([]byte, error) {
+	resp, err := http.Get(url)
 	if err != nil {
 		return nil, err
 	}
-	certs = make(map[string]*x509.Certificate)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: unexpected status %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// parsePEM parses the certificates of the PEM data, skips the blocks that aren't valid certificates.
+// Returns the certificates by their SHA-256 fingerprints.
+func parsePEM(data []byte) map[string]*x509.Certificate {
+	certs := make(map[string]*x509.Certificate)
 	for len(data) > 0 {
 		var block *pem.Block
 		block, data = pem.Decode(data)
@@ -132,11 +316,24 @@ func sysCerts() (certs map[string]*x509.Certificate, err error) {
 		if err != nil {
 			continue
 		}
+		certs[certFingerprint(cert)] = cert
+	}
+	return certs
+}
 
-		fingerprint := sha256.Sum256(cert.Raw)
-		certs[hex.EncodeToString(fingerprint[:])] = cert
+// certFingerprint returns the hex SHA-256 fingerprint of the certificate
+func certFingerprint(cert *x509.Certificate) string {
+	fingerprint := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(fingerprint[:])
+}
+
+func sysCerts() (certs map[string]*x509.Certificate, err error) {
+	cmd := exec.Command("/usr/bin/security", "find-certificate", "-a", "-p", "/System/Library/Keychains/SystemRootCertificates.keychain")
+	data, err := cmd.Output()
+	if err != nil {
+		return nil, err
 	}
-	return certs, nil
+	return parsePEM(data), nil
 }
 
 type certID struct {
@@ -145,22 +342,29 @@ type certID struct {
 }
 
 // fetchCertIDs fetches IDs of iOS X509 certificates from apple.com.
+// Returns an error if the page doesn't have the expected structure.
 func fetchCertIDs() ([]certID, error) {
 	// Download the iOS 11 support page. The index for all iOS versions is here:
 	// https://support.apple.com/en-us/HT204132
-	resp, err := http.Get("https://support.apple.com/en-us/HT208125")
+	body, err := download("https://support.apple.com/en-us/HT208125")
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	text := string(body)
+	return parseCertIDsPage(string(body))
+}
+
+// parseCertIDsPage parses the table of the trusted certificates of the apple.com support page
+func parseCertIDsPage(text string) ([]certID, error) {
 	idx := strings.Index(text, "<div id=\"trusted\"")
+	if idx < 0 {
+		return nil, fmt.Errorf("the trusted certificates section is not found")
+	}
 	text = text[idx:]
-	text = text[:strings.Index(text, "</div>")]
+	end := strings.Index(text, "</div>")
+	if end < 0 {
+		return nil, fmt.Errorf("the end of the trusted certificates section is not found")
+	}
+	text = text[:end]
 
 	var ids []certID
 	cols := make(map[string]int)
@@ -171,10 +375,18 @@ func fetchCertIDs() ([]certID, error) {
 			for i, match := range regexp.MustCompile("(?s)<th>(.*?)</th>").FindAllStringSubmatch(row, -1) {
 				cols[match[1]] = i
 			}
+			for _, col := range []string{"Certificate name", "Fingerprint (SHA-256)"} {
+				if _, ok := cols[col]; !ok {
+					return nil, fmt.Errorf("the column %q is not found", col)
+				}
+			}
 			continue
 		}
 
 		values := regexp.MustCompile("(?s)<td>(.*?)</td>").FindAllStringSubmatch(row, -1)
+		if len(values) != len(cols) {
+			return nil, fmt.Errorf("row %d has %d columns, expected %d", i, len(values), len(cols))
+		}
 		name := values[cols["Certificate name"]][1]
 		name = strings.ReplaceAll(name, "&nbsp;", "")
 		fingerprint := values[cols["Fingerprint (SHA-256)"]][1]
@@ -183,12 +395,18 @@ func fetchCertIDs() ([]certID, error) {
 		fingerprint = strings.ReplaceAll(fingerprint, " ", "")
 		fingerprint = strings.ReplaceAll(fingerprint, "&nbsp;", "")
 		fingerprint = strings.ToLower(fingerprint)
+		if _, err := hex.DecodeString(fingerprint); err != nil || len(fingerprint) != 2*sha256.Size {
+			return nil, fmt.Errorf("row %d: invalid fingerprint %q", i, fingerprint)
+		}
 
 		ids = append(ids, certID{
 			name:        name,
 			fingerprint: fingerprint,
 		})
 	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no certificates found")
+	}
 	return ids, nil
 }
 
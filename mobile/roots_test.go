@@ -1,9 +1,20 @@
 package mobile
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
 	"testing"
+	"time"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // Tests that our limited set of roots is enough for the most popular upstreams
@@ -62,3 +73,80 @@ func checkUpstream(t *testing.T, u upstream.Upstream, addr string) {
 	}
 	assertResponse(t, reply)
 }
+
+type testCertificateVerifier struct {
+	derChain []byte
+	host     string
+	err      error
+}
+
+func (v *testCertificateVerifier) VerifyCertificateChain(derChain []byte, host string) error {
+	v.derChain = derChain
+	v.host = host
+	return v.err
+}
+
+func TestSetCertificateVerifier(t *testing.T) {
+	v := &testCertificateVerifier{}
+	setCertificateVerifier(v)
+	defer setCertificateVerifier(nil)
+
+	err := upstream.VerifyCertificate("dns.example.org", [][]byte{{1, 2}, {3}})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{1, 2, 3}, v.derChain)
+	assert.Equal(t, "dns.example.org", v.host)
+
+	v.err = errors.New("untrusted")
+	err = upstream.VerifyCertificate("dns.example.org", [][]byte{{1, 2}})
+	assert.NotNil(t, err)
+
+	setCertificateVerifier(nil)
+	assert.Nil(t, upstream.VerifyCertificate)
+}
+
+// createTestRootPEM creates a self-signed CA certificate encoded in PEM
+func createTestRootPEM(t *testing.T, name string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestTrustedRoots(t *testing.T) {
+	defer func() {
+		trustedRoots.certs = nil
+		upstream.RootCAs = loadSystemRootCAs()
+	}()
+
+	embedded, err := parseRootsPEM(systemRootsPEM)
+	require.NoError(t, err)
+	assert.Len(t, upstream.RootCAs.Subjects(), len(embedded))
+
+	d := &DNSProxy{}
+	root := createTestRootPEM(t, "Test Root 1")
+	assert.Nil(t, d.AddTrustedRoots(root))
+	assert.Len(t, upstream.RootCAs.Subjects(), len(embedded)+1)
+
+	// the invalid PEM doesn't change the pool
+	pool := upstream.RootCAs
+	for _, invalid := range []string{"", "not a certificate", root + "garbage", "-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n"} {
+		assert.NotNil(t, d.AddTrustedRoots(invalid))
+		assert.NotNil(t, d.ReplaceTrustedRoots(invalid))
+		assert.True(t, pool == upstream.RootCAs)
+	}
+
+	assert.Nil(t, d.ReplaceTrustedRoots(createTestRootPEM(t, "Test Root 2")+root))
+	assert.Len(t, upstream.RootCAs.Subjects(), 2)
+	assert.Nil(t, d.AddTrustedRoots(createTestRootPEM(t, "Test Root 3")))
+	assert.Len(t, upstream.RootCAs.Subjects(), 3)
+}
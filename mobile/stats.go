@@ -0,0 +1,149 @@
+package mobile
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// statsQueueSize is the max number of queries waiting to be passed to the StatsListener.
+// If the listener is slower than that, the new queries aren't passed to it (they are still counted in QueryStats).
+const statsQueueSize = 256
+
+// The query statuses passed to StatsListener, the other statuses are the rcodes of the responses (e.g. "NOERROR")
+const (
+	QueryStatusBlocked = "BLOCKED" // the query is blocked by the filtering rules
+	QueryStatusError   = "ERROR"   // the query isn't resolved
+)
+
+// StatsListener is notified about every processed query (see DNSProxy.SetStatsListener)
+type StatsListener interface {
+	OnQueryProcessed(domain string, qtype int, elapsedMs int, status string, upstreamAddr string)
+}
+
+// QueryStats contains the totals of the queries processed since the proxy was created
+type QueryStats struct {
+	Total            int64 // number of processed queries
+	Blocked          int64 // number of blocked queries
+	DomainsBlocked   int64 // number of queries blocked by Config.BlockedDomains (included in Blocked)
+	Errors           int64 // number of queries that weren't resolved
+	AverageElapsedMs int64 // average processing time (in milliseconds)
+}
+
+// queryStatsEvent is a processed query waiting to be passed to the StatsListener
+type queryStatsEvent struct {
+	domain       string
+	qtype        int
+	elapsedMs    int
+	status       string
+	upstreamAddr string
+}
+
+// queryStats contains the StatsListener and its queue and the totals of the processed queries
+type queryStats struct {
+	listener StatsListener
+	queue    chan queryStatsEvent // nil if there is no listener
+
+	total          int64
+	blocked        int64
+	domainsBlocked int64
+	errors         int64
+	totalElapsedMs int64
+
+	sync.Mutex
+}
+
+// SetStatsListener sets the listener of the processed queries (nil to remove it).
+// The listener is called on a separate goroutine, so it doesn't delay the responses.
+// It can be replaced while the proxy is running.
+func (d *DNSProxy) SetStatsListener(l StatsListener) {
+	s := &d.stats
+	s.Lock()
+	defer s.Unlock()
+
+	s.listener = l
+	if l != nil && s.queue == nil {
+		s.queue = make(chan queryStatsEvent, statsQueueSize)
+		go s.notifyLoop(s.queue)
+	} else if l == nil && s.queue != nil {
+		close(s.queue)
+		s.queue = nil
+	}
+}
+
+// QueryStats returns the totals of the processed queries
+func (d *DNSProxy) QueryStats() *QueryStats {
+	s := &d.stats
+	s.Lock()
+	defer s.Unlock()
+
+	res := &QueryStats{Total: s.total, Blocked: s.blocked, DomainsBlocked: s.domainsBlocked, Errors: s.errors}
+	if s.total > 0 {
+		res.AverageElapsedMs = s.totalElapsedMs / s.total
+	}
+	return res
+}
+
+// queryProcessed counts the processed query and queues it to the StatsListener and the QueryLogListener
+func (d *DNSProxy) queryProcessed(ctx *proxy.DNSContext, blocked bool, err error) {
+	e := queryStatsEvent{
+		domain:    strings.TrimSuffix(ctx.Req.Question[0].Name, "."),
+		qtype:     int(ctx.Req.Question[0].Qtype),
+		elapsedMs: int(time.Since(ctx.StartTime) / time.Millisecond),
+	}
+	switch {
+	case blocked:
+		e.status = QueryStatusBlocked
+	case err != nil || ctx.Res == nil:
+		e.status = QueryStatusError
+	default:
+		e.status = dns.RcodeToString[ctx.Res.Rcode]
+	}
+	if ctx.Upstream != nil {
+		e.upstreamAddr = ctx.Upstream.Address()
+	}
+
+	s := &d.stats
+	s.Lock()
+	s.total++
+	s.totalElapsedMs += int64(e.elapsedMs)
+	switch e.status {
+	case QueryStatusBlocked:
+		s.blocked++
+	case QueryStatusError:
+		s.errors++
+	}
+
+	if s.queue != nil {
+		select {
+		case s.queue <- e:
+		default:
+			// the listener is too slow, skip the event
+		}
+	}
+	s.Unlock()
+
+	d.queryLog.add(ctx, e.status, err)
+}
+
+// domainBlocked counts the query blocked by Config.BlockedDomains
+func (s *queryStats) domainBlocked() {
+	s.Lock()
+	s.domainsBlocked++
+	s.Unlock()
+}
+
+// notifyLoop passes the queued queries to the current listener until the queue is closed
+func (s *queryStats) notifyLoop(queue chan queryStatsEvent) {
+	for e := range queue {
+		s.Lock()
+		l := s.listener
+		s.Unlock()
+		if l != nil {
+			l.OnQueryProcessed(e.domain, e.qtype, e.elapsedMs, e.status, e.upstreamAddr)
+		}
+	}
+}
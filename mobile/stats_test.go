@@ -0,0 +1,77 @@
+package mobile
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testStatsListener collects the processed queries statuses
+type testStatsListener struct {
+	statuses map[string]string // domain -> status
+	sync.Mutex
+}
+
+func (l *testStatsListener) OnQueryProcessed(domain string, qtype int, elapsedMs int, status string, upstreamAddr string) {
+	l.Lock()
+	defer l.Unlock()
+	l.statuses[domain] = status
+}
+
+// status waits for the status of the domain
+func (l *testStatsListener) status(t *testing.T, domain string) string {
+	var status string
+	assert.Eventually(t, func() bool {
+		l.Lock()
+		defer l.Unlock()
+		status = l.statuses[domain]
+		return status != ""
+	}, time.Second, 10*time.Millisecond)
+	return status
+}
+
+func TestStatsListener(t *testing.T) {
+	dnsProxy := createTestFilteringProxy(BlockTypeNXDomain)
+	err := dnsProxy.startWithMock(&testUpstream{cn: testCNAMEs, ipv4: testIPv4, ipv6: testIPv6})
+	assert.Nil(t, err)
+	defer dnsProxy.Stop()
+
+	resolve := func(host string) {
+		packet, err := createHostTestMessageWithType(host, dns.TypeA).Pack()
+		assert.Nil(t, err)
+		_, err = dnsProxy.Resolve(packet)
+		assert.Nil(t, err)
+	}
+
+	listener := &testStatsListener{statuses: map[string]string{}}
+	dnsProxy.SetStatsListener(listener)
+	resolve("example.com")
+	resolve("mail.google.com")
+	resolve("groups.google.com")
+	resolve("nonexistent.example.net")
+	assert.Equal(t, QueryStatusBlocked, listener.status(t, "example.com"))
+	assert.Equal(t, QueryStatusBlocked, listener.status(t, "mail.google.com"))
+	assert.Equal(t, "NOERROR", listener.status(t, "groups.google.com"))
+	assert.Equal(t, "NXDOMAIN", listener.status(t, "nonexistent.example.net"))
+
+	// the listener is replaced
+	newListener := &testStatsListener{statuses: map[string]string{}}
+	dnsProxy.SetStatsListener(newListener)
+	resolve("adguard.com")
+	assert.Equal(t, QueryStatusBlocked, newListener.status(t, "adguard.com"))
+
+	// and removed, the queries are still counted
+	dnsProxy.SetStatsListener(nil)
+	resolve("dns.adguard.com")
+
+	stats := dnsProxy.QueryStats()
+	assert.Equal(t, int64(6), stats.Total)
+	assert.Equal(t, int64(4), stats.Blocked)
+	assert.Equal(t, int64(0), stats.Errors)
+	listener.Lock()
+	assert.Len(t, listener.statuses, 4)
+	listener.Unlock()
+}
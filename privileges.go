@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// fileAccess is a file the proxy reads or writes after the privileges are dropped
+type fileAccess struct {
+	path  string
+	write bool   // if true, the path must be writable, otherwise readable
+	what  string // description used in the errors, e.g. "the log file"
+}
+
+// filesToAccess returns the files that the proxy opens again after the start:
+// the TLS files and the upstreams file are re-read on SIGHUP, the log file is reopened (and rotated),
+// the PID file is removed and the cache file is saved on exit.
+func filesToAccess(options Options) []fileAccess {
+	var files []fileAccess
+	for _, f := range []fileAccess{
+		{path: options.TLSCertPath, what: "the TLS certificate"},
+		{path: options.TLSKeyPath, what: "the TLS private key"},
+		{path: options.TLSClientCAPath, what: "the TLS client CA"},
+		{path: options.UpstreamFile, what: "the upstreams file"},
+		{path: options.LogOutput, write: true, what: "the log file"},
+	} {
+		if f.path != "" {
+			files = append(files, f)
+		}
+	}
+
+	// the rotated and the reopened log files are created in its directory
+	if options.LogOutput != "" {
+		files = append(files, fileAccess{path: filepath.Dir(options.LogOutput), write: true, what: "the log file directory"})
+	}
+	if options.PIDFile != "" {
+		files = append(files, fileAccess{path: filepath.Dir(options.PIDFile), write: true, what: "the PID file directory"})
+	}
+	// the cache is saved to a temporary file that is renamed then
+	if options.CachePersist != "" {
+		files = append(files, fileAccess{path: filepath.Dir(options.CachePersist), write: true, what: "the cache file directory"})
+	}
+	return files
+}
+
+// checkFilesAccess checks that the current user can access the files from filesToAccess.
+// It's called after the privileges are dropped, so the user is the target one.
+func checkFilesAccess(options Options) error {
+	var errs []string
+	for _, f := range filesToAccess(options) {
+		err := checkAccess(f.path, f.write)
+		if err == nil {
+			continue
+		}
+		mode := "readable"
+		if f.write {
+			mode = "writable"
+		}
+		errs = append(errs, fmt.Sprintf("%s %s must be %s by the user %s (%s): change its owner or permissions",
+			f.what, f.path, mode, options.User, err))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("cannot run as the user %s: %s", options.User, strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// dropPrivileges switches the process to the user and the group (the user's primary group if empty).
+// The files created by the proxy before (e.g. the PID file) are given to the user first.
+func dropPrivileges(userName, groupName string, ownFiles ...string) error {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		return fmt.Errorf("cannot find the user %s: %s", userName, err)
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("invalid uid of the user %s: %s", userName, u.Uid)
+	}
+
+	gidStr := u.Gid
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return fmt.Errorf("cannot find the group %s: %s", groupName, err)
+		}
+		gidStr = g.Gid
+	}
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return fmt.Errorf("invalid gid %s", gidStr)
+	}
+
+	for _, path := range ownFiles {
+		err = os.Chown(path, uid, gid)
+		if err != nil {
+			return fmt.Errorf("cannot change the owner of %s: %s", path, err)
+		}
+	}
+
+	// the group must be changed first, the user can't do it
+	err = syscall.Setgroups([]int{gid})
+	if err != nil {
+		return fmt.Errorf("cannot set the supplementary groups: %s", err)
+	}
+	err = syscall.Setgid(gid)
+	if err != nil {
+		return fmt.Errorf("cannot switch to the group %s: %s", gidStr, err)
+	}
+	err = syscall.Setuid(uid)
+	if err != nil {
+		return fmt.Errorf("cannot switch to the user %s: %s", userName, err)
+	}
+
+	if syscall.Getuid() != uid || syscall.Geteuid() != uid || syscall.Getgid() != gid || syscall.Getegid() != gid {
+		return fmt.Errorf("the user %s and the group %s aren't set", userName, gidStr)
+	}
+	return nil
+}
+
+// checkAccess checks that the current user can read (or write) the path
+func checkAccess(path string, write bool) error {
+	mode := uint32(unix.R_OK)
+	if write {
+		mode = unix.W_OK
+	}
+	return unix.Access(path, mode)
+}
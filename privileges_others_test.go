@@ -0,0 +1,15 @@
+// +build !windows
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDropPrivilegesUnknownUser(t *testing.T) {
+	err := dropPrivileges("dnsproxy-no-such-user", "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot find the user dnsproxy-no-such-user")
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilesToAccess(t *testing.T) {
+	files := filesToAccess(Options{
+		TLSCertPath:  "/etc/dnsproxy/cert.pem",
+		UpstreamFile: "/etc/dnsproxy/upstreams.txt",
+		LogOutput:    "/var/log/dnsproxy/dnsproxy.log",
+		PIDFile:      "/run/dnsproxy/dnsproxy.pid",
+	})
+	assert.Equal(t, []fileAccess{
+		{path: "/etc/dnsproxy/cert.pem", what: "the TLS certificate"},
+		{path: "/etc/dnsproxy/upstreams.txt", what: "the upstreams file"},
+		{path: "/var/log/dnsproxy/dnsproxy.log", write: true, what: "the log file"},
+		{path: "/var/log/dnsproxy", write: true, what: "the log file directory"},
+		{path: "/run/dnsproxy", write: true, what: "the PID file directory"},
+	}, files)
+
+	assert.Empty(t, filesToAccess(Options{}))
+}
+
+func TestCheckFilesAccess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	logPath := filepath.Join(dir, "dnsproxy.log")
+	require.NoError(t, ioutil.WriteFile(logPath, nil, 0644))
+	assert.Nil(t, checkFilesAccess(Options{User: "nobody", LogOutput: logPath}))
+
+	err = checkFilesAccess(Options{User: "nobody", LogOutput: logPath, TLSKeyPath: filepath.Join(dir, "key.pem")})
+	if checkAccess(logPath+".missing", false) == nil {
+		t.Skip("the access isn't checked on this platform")
+	}
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "the TLS private key "+filepath.Join(dir, "key.pem")+" must be readable by the user nobody")
+}
@@ -0,0 +1,13 @@
+package main
+
+import "errors"
+
+// dropPrivileges returns an error, use the service account instead (see --service)
+func dropPrivileges(_, _ string, _ ...string) error {
+	return errors.New("--user and --group are not supported on Windows, run the service as the user instead")
+}
+
+// checkAccess is not used on Windows
+func checkAccess(_ string, _ bool) error {
+	return nil
+}
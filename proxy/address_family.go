@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"github.com/AdguardTeam/dnsproxy/upstream"
+)
+
+// validateAddressFamily checks that the IP addresses of the upstreams belong to OutboundAddressFamily
+func (c *Config) validateAddressFamily() error {
+	for _, list := range c.upstreamLists() {
+		for _, u := range list {
+			if err := upstream.CheckAddressFamily(u.Address(), c.OutboundAddressFamily); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// probeAddressFamilies probes the routable address families in upstream.AddressFamilyAuto
+func (p *Proxy) probeAddressFamilies() {
+	if p.OutboundAddressFamily != upstream.AddressFamilyAuto {
+		return
+	}
+	if f := upstream.ProbeAddressFamilies(); f != upstream.AddressFamilyAuto {
+		p.logger().Infof("Only the %s outbound connections are routable", f)
+	}
+}
+
+// NetworkChanged must be called when the network changes, it probes the routable address families again
+// (see OutboundAddressFamily)
+func (p *Proxy) NetworkChanged() {
+	p.RLock()
+	defer p.RUnlock()
+	p.probeAddressFamilies()
+}
@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateAddressFamily(t *testing.T) {
+	u, err := upstream.AddressToUpstream("[2001:db8::1]:53", upstream.Options{})
+	require.NoError(t, err)
+
+	c := Config{Upstreams: []upstream.Upstream{u}}
+	assert.NoError(t, c.validateAddressFamily())
+
+	c.OutboundAddressFamily = upstream.AddressFamilyIPv6
+	assert.NoError(t, c.validateAddressFamily())
+
+	// the upstreams for domains are checked too
+	c = Config{
+		OutboundAddressFamily:    upstream.AddressFamilyIPv4,
+		DomainsReservedUpstreams: map[string][]upstream.Upstream{"example.org.": {u}},
+	}
+	assert.Error(t, c.validateAddressFamily())
+}
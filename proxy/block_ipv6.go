@@ -0,0 +1,19 @@
+package proxy
+
+import (
+	"github.com/miekg/dns"
+)
+
+// resolveBlockedIPv6 answers the AAAA request with NODATA if BlockIPv6 is set.
+// Returns false if the request isn't blocked.
+func (p *Proxy) resolveBlockedIPv6(d *DNSContext) bool {
+	if !p.requestState(d).BlockIPv6 || d.Req.Question[0].Qtype != dns.TypeAAAA {
+		return false
+	}
+	if l := p.logger(); l.DebugEnabled() {
+		l.Debugf("IPv6 is blocked. Reply with NODATA to %s AAAA request", d.Req.Question[0].Name)
+	}
+	d.Res = genEmptyNoError(d.Req)
+	d.IPv6Blocked = true
+	return true
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockIPv6(t *testing.T) {
+	var reqs []uint16
+	u := &funcUpstream{exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+		reqs = append(reqs, m.Question[0].Qtype)
+		resp := &dns.Msg{}
+		resp.SetReply(m)
+		if m.Question[0].Qtype == dns.TypeAAAA {
+			resp.Answer = []dns.RR{newRR(m.Question[0].Name + " 60 IN AAAA 2001:db8::1")}
+		} else {
+			resp.Answer = []dns.RR{newRR(m.Question[0].Name + " 60 IN A 1.2.3.4")}
+		}
+		return resp, nil
+	}}
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{u}
+	dnsProxy.CacheEnabled = true
+	dnsProxy.BlockIPv6 = true
+	dnsProxy.StaticEntries = map[string][]net.IP{"static.example.": {net.ParseIP("2001:db8::2")}}
+	require.NoError(t, dnsProxy.Start())
+	defer dnsProxy.Stop()
+
+	for _, host := range []string{"example.org", "static.example"} {
+		req := &dns.Msg{}
+		req.SetQuestion(dns.Fqdn(host), dns.TypeAAAA)
+		d := &DNSContext{Proto: ProtoUDP, Req: req, Addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}}}
+		require.NoError(t, dnsProxy.Resolve(d))
+		assert.True(t, d.IPv6Blocked, host)
+		assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+		assert.Empty(t, d.Res.Answer)
+		require.Len(t, d.Res.Ns, 1)
+		assert.Equal(t, dns.TypeSOA, d.Res.Ns[0].Header().Rrtype)
+	}
+	assert.Empty(t, reqs)
+
+	// the other types are resolved as usual
+	d := &DNSContext{Proto: ProtoUDP, Req: createHostTestMessage("example.org"), Addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}}}
+	require.NoError(t, dnsProxy.Resolve(d))
+	assert.False(t, d.IPv6Blocked)
+	require.Len(t, d.Res.Answer, 1)
+	assert.Equal(t, []uint16{dns.TypeA}, reqs)
+
+	// DNS64 is disabled
+	dnsProxy.SetNAT64Prefix(prefix)
+	assert.False(t, dnsProxy.isNAT64PrefixAvailable())
+}
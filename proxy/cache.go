@@ -2,110 +2,159 @@ package proxy
 
 import (
 	"encoding/binary"
+	"fmt"
 	"math"
 	"strings"
 	"sync"
 	"time"
 
-	glcache "github.com/AdguardTeam/golibs/cache"
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/miekg/dns"
 )
 
-const defaultCacheSize = 64 * 1024 // in bytes
+const (
+	defaultCacheSize = 64 * 1024 // in bytes
+
+	// optimisticTTL is the TTL of the expired responses served from the optimistic cache
+	optimisticTTL = 10
+
+	defaultCacheOptimisticMaxStale = 24 * time.Hour
+
+	defaultCachePrefetchWorkers = 4
+
+	// cacheHeaderLen is the length of the header of the cached data, see packResponse
+	cacheHeaderLen = 4 + 4 + 4 + 1
+
+	// cacheFlagSecure is set in the flags of the cached data if the response has come from an encrypted upstream
+	cacheFlagSecure = 1 << 0
+)
 
 type cache struct {
-	items        glcache.Cache // cache
-	cacheSize    int           // cache size (in bytes)
-	sync.RWMutex               // lock
+	items        *cacheStore // cache
+	cacheSize    int         // cache size (in bytes)
+	maxStale     uint32      // how long the expired responses are kept (in seconds, 0 if optimistic cache is disabled)
+	prefetchHits uint32      // number of hits after which the entry is prefetched (0 if prefetch is disabled)
+
+	maxNegativeTTL uint32            // max TTL of the negative responses (in seconds, 0 means no limit)
+	failureTTL     uint32            // TTL of the failure cache entries (in seconds, 0 if failures aren't cached)
+	uncacheable    map[int]bool      // rcodes of the responses that are only stored in the failure cache (if nil, defaultCacheUncacheableRcodes)
+	ttlCaps        map[uint16]uint32 // max TTLs of the cached responses per query type (see Config.CacheTTLCaps)
+	cnameChains    bool              // the RRsets of the CNAME chains are cached separately (see Config.CacheCNAMEChains)
+
+	evictionPolicy CacheEvictionPolicy // which entries are removed when the cache is full
+	logger         proxyutil.Logger    // Config.Logger (nil for the default logger)
+
+	sync.RWMutex // lock
 }
 
 func (c *cache) Get(request *dns.Msg) (*dns.Msg, bool) {
+	res, _, _, _ := c.get(request, nil)
+	return res, res != nil
+}
+
+// get returns the cached response for the request.
+// expired is true if the response is expired and is served by the optimistic cache.
+// prefetch is true if the entry is popular and is about to expire (see hitCacheItem).
+// secure is true if the response has come from an encrypted upstream.
+// ednsKey is the EDNS options of the request (see withEDNSKey).
+func (c *cache) get(request *dns.Msg, ednsKey []byte) (res *dns.Msg, expired, prefetch, secure bool) {
 	if request == nil || len(request.Question) != 1 {
-		return nil, false
+		return nil, false, false, false
 	}
-	// create key for request
-	key := key(request)
-	c.Lock()
-	if c.items == nil {
-		c.Unlock()
-		return nil, false
+	items := c.existingStore()
+	if items == nil {
+		return nil, false, false, false
 	}
-	c.Unlock()
-	data := c.items.Get(key)
+	// create key for request
+	key, data, dnssec := lookupKeys(items, request, func(m *dns.Msg) []byte {
+		return withEDNSKey(key(m), ednsKey)
+	})
 	if data == nil {
-		return nil, false
+		res, secure = c.getCNAMEChain(items, request, ednsKey)
+		return res, false, false, secure
 	}
 
-	res := unpackResponse(data, request)
+	res, expired, err := unpackResponse(data, request, c.maxStale)
+	if err != nil {
+		if l := proxyutil.LoggerOrDefault(c.logger); l.DebugEnabled() {
+			l.Debugf("%s: %s", request.Question[0].Name, err)
+		}
+		items.Invalidate(key)
+		return nil, false, false, false
+	}
 	if res == nil {
-		c.items.Del(key)
-		return nil, false
+		items.Expire(key)
+		return nil, false, false, false
+	}
+	if dnssec {
+		stripDNSSEC(res)
 	}
-	return res, true
+	return res, expired, hitCacheItem(data, c.prefetchHits, items.shardLock(key)), cacheDataSecure(data)
 }
 
 func (c *cache) Set(m *dns.Msg) {
+	c.set(m, false, nil)
+}
+
+// set stores the response, secure is true if it has come from an encrypted upstream.
+// ednsKey is the EDNS options of the request (see withEDNSKey).
+func (c *cache) set(m *dns.Msg, secure bool, ednsKey []byte) {
 	if m == nil {
 		return // no-op
 	}
-	if !isCacheable(m) {
+	ttl, ok := cacheTTL(m, c.maxNegativeTTL, c.failureTTL, c.uncacheable, proxyutil.LoggerOrDefault(c.logger))
+	if !ok {
 		return
 	}
-	key := key(m)
-
-	c.Lock()
-	// lazy initialization for cache
-	if c.items == nil {
-		conf := glcache.Config{
-			MaxSize:   defaultCacheSize,
-			EnableLRU: true,
-		}
-		if c.cacheSize > 0 {
-			conf.MaxSize = uint(c.cacheSize)
-		}
-		c.items = glcache.New(conf)
+	ttl, ok = capTTL(m, ttl, c.ttlCaps)
+	if !ok {
+		return
 	}
-	c.Unlock()
+	key := withEDNSKey(key(m), ednsKey)
+
+	data := packResponse(m, ttl, secure)
+	c.store().Set(key, data)
+	setNXDomain(c.store(), m, withEDNSKey(keyNX(m), ednsKey), data)
+	c.setCNAMEChain(m, secure, ednsKey)
+}
 
-	data := packResponse(m)
-	_ = c.items.Set(key, data)
+// keyNX returns the key of the NXDOMAIN responses for the name (see nxDomainRequest)
+func keyNX(m *dns.Msg) []byte {
+	return key(nxDomainRequest(m))
 }
 
 // check if message is cacheable
-func isCacheable(m *dns.Msg) bool {
+func isCacheable(m *dns.Msg, l proxyutil.Logger) bool {
 	// truncated messages aren't valid
 	if m.Truncated {
-		log.Tracef("Refusing to cache truncated message")
+		l.Debugf("Refusing to cache truncated message")
 		return false
 	}
 
 	// if has wrong number of questions, also don't cache
 	if len(m.Question) != 1 {
-		log.Tracef("Refusing to cache message with wrong number of questions")
+		l.Debugf("Refusing to cache message with wrong number of questions")
 		return false
 	}
 
 	qName := m.Question[0].Name
 	qType := m.Question[0].Qtype
 
-	ttl := findLowestTTL(m)
+	ttl := responseTTL(m, l)
 	if ttl == 0 {
 		return false
 	}
 
 	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
-		log.Tracef("%s: refusing to cache message with response type %s", qName, dns.RcodeToString[m.Rcode])
+		if l.DebugEnabled() {
+			l.Debugf("%s: refusing to cache message with response type %s", qName, dns.RcodeToString[m.Rcode])
+		}
 		return false
 	}
 
-	if m.Rcode == dns.RcodeSuccess && (qType == dns.TypeA || qType == dns.TypeAAAA) {
+	// NODATA responses are cached using the SOA record (see negativeTTL)
+	if m.Rcode == dns.RcodeSuccess && len(m.Answer) > 0 && (qType == dns.TypeA || qType == dns.TypeAAAA) {
 		// Now verify that it contains at least one A or AAAA record
-		if len(m.Answer) == 0 {
-			log.Tracef("%s: refusing to cache a NOERROR response with no answers", qName)
-			return false
-		}
-
 		found := false
 		for _, rr := range m.Answer {
 			if rr.Header().Rrtype == dns.TypeA || rr.Header().Rrtype == dns.TypeAAAA {
@@ -115,7 +164,9 @@ func isCacheable(m *dns.Msg) bool {
 		}
 
 		if !found {
-			log.Tracef("%s: refusing to cache a response with no A and AAAA answers", qName)
+			if l.DebugEnabled() {
+				l.Debugf("%s: refusing to cache a response with no A and AAAA answers", qName)
+			}
 			return false
 		}
 	}
@@ -162,7 +213,7 @@ func getTTLIfLower(h *dns.RR_Header, ttl uint32) uint32 {
 }
 
 // Format:
-// uint8(do)
+// uint8(flags, see keyFlags)
 // uint16(qtype)
 // uint16(qclass)
 // name
@@ -170,17 +221,8 @@ func key(m *dns.Msg) []byte {
 	q := m.Question[0]
 	b := make([]byte, 1+2+2+len(q.Name))
 
-	// put do
-	opt := m.IsEdns0()
-	do := false
-	if opt != nil {
-		do = opt.Do()
-	}
-	if do {
-		b[0] = 1
-	} else {
-		b[0] = 0
-	}
+	// put edns and do flags
+	b[0] = keyFlags(m)
 
 	// put qtype, qclass, name
 	binary.BigEndian.PutUint16(b[1:], q.Qtype)
@@ -192,34 +234,81 @@ func key(m *dns.Msg) []byte {
 
 /*
 expire [4]byte
+ttl [4]byte
+hits [4]byte
+flags [1]byte (see cacheFlagSecure)
 dns_message []byte
 */
-func packResponse(m *dns.Msg) []byte {
+func packResponse(m *dns.Msg, ttl uint32, secure bool) []byte {
 	pm, _ := m.Pack()
-	expire := uint32(time.Now().Unix()) + findLowestTTL(m)
+	expire := uint32(time.Now().Unix()) + ttl
 	var d []byte
-	d = make([]byte, 4+len(pm))
+	d = make([]byte, cacheHeaderLen+len(pm))
 	binary.BigEndian.PutUint32(d, expire)
-	copy(d[4:], pm)
+	binary.BigEndian.PutUint32(d[4:], ttl)
+	if secure {
+		d[12] |= cacheFlagSecure
+	}
+	copy(d[cacheHeaderLen:], pm)
 	return d
 }
 
-// Return nil if response has expired
-func unpackResponse(data []byte, request *dns.Msg) *dns.Msg {
+// cacheDataSecure checks if the cached response has come from an encrypted upstream
+func cacheDataSecure(data []byte) bool {
+	return data[12]&cacheFlagSecure != 0
+}
+
+// hitCacheItem increments the hits counter of the cached data (the lock of its cacheStore shard protects it).
+// Returns true if the entry should be prefetched: it has got at least prefetchHits hits
+// and less than 10% of its TTL is left.
+func hitCacheItem(data []byte, prefetchHits uint32, lock sync.Locker) bool {
+	if prefetchHits == 0 {
+		return false
+	}
+
+	lock.Lock()
+	hits := binary.BigEndian.Uint32(data[8:]) + 1
+	binary.BigEndian.PutUint32(data[8:], hits)
+	lock.Unlock()
+
+	expire := int64(binary.BigEndian.Uint32(data))
+	ttl := int64(binary.BigEndian.Uint32(data[4:]))
+	left := expire - time.Now().Unix()
+	return hits >= prefetchHits && left > 0 && left*10 <= ttl
+}
+
+// Return nil if response has expired more than maxStale seconds ago.
+// The expired responses that are kept are returned with optimisticTTL and expired set to true.
+// Returns an error if the cached response isn't the response to the request (see matchQuestion).
+// The ID and the question of the returned response are always copied from the request.
+func unpackResponse(data []byte, request *dns.Msg, maxStale uint32) (res *dns.Msg, expired bool, err error) {
 	now := time.Now().Unix()
 	expire := binary.BigEndian.Uint32(data[:4])
-	if int64(expire) <= now {
-		return nil
+	var ttl uint32
+	if int64(expire) > now {
+		ttl = expire - uint32(now)
+	} else if int64(expire)+int64(maxStale) > now {
+		ttl = optimisticTTL
+		expired = true
+	} else {
+		return nil, false, nil
 	}
-	ttl := expire - uint32(now)
 
 	m := dns.Msg{}
-	err := m.Unpack(data[4:])
+	err = m.Unpack(data[cacheHeaderLen:])
+	if err != nil {
+		return nil, false, nil
+	}
+	err = matchQuestion(&m, request)
 	if err != nil {
-		return nil
+		return nil, false, err
+	}
+	// the failures are only cached for a few seconds, they must not be served by the optimistic cache
+	if expired && m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return nil, false, nil
 	}
 
-	res := dns.Msg{}
+	res = &dns.Msg{}
 	res.SetReply(request)
 	res.Authoritative = false
 	res.AuthenticatedData = m.AuthenticatedData
@@ -245,5 +334,48 @@ func unpackResponse(data []byte, request *dns.Msg) *dns.Msg {
 		extra.Header().Ttl = ttl
 		res.Extra = append(res.Extra, extra)
 	}
-	return &res
+	// the client that has sent OPT gets OPT with its DO flag (RFC 3225, section 3)
+	if opt := request.IsEdns0(); opt != nil {
+		res.SetEdns0(opt.UDPSize(), opt.Do())
+		if cachedOpt := m.IsEdns0(); cachedOpt != nil {
+			res.IsEdns0().Option = extendedErrorOptions(cachedOpt)
+		}
+	}
+	return res, expired, nil
+}
+
+// matchQuestion checks that the cached response has the question of the request.
+// The NXDOMAIN responses are served for the requests of all types (see nxDomainRequest), so their type isn't checked.
+func matchQuestion(m, request *dns.Msg) error {
+	if len(m.Question) != 1 {
+		return fmt.Errorf("cached response has %d questions", len(m.Question))
+	}
+	q, reqQ := m.Question[0], request.Question[0]
+	if !strings.EqualFold(q.Name, reqQ.Name) || q.Qclass != reqQ.Qclass ||
+		(q.Qtype != reqQ.Qtype && m.Rcode != dns.RcodeNameError) {
+		return fmt.Errorf("cached response question %s %s %s doesn't match the request",
+			q.Name, dns.ClassToString[q.Qclass], dns.TypeToString[q.Qtype])
+	}
+	return nil
+}
+
+// store returns the items storage, it is created on the first use
+func (c *cache) store() *cacheStore {
+	c.Lock()
+	defer c.Unlock()
+	if c.items == nil {
+		size := defaultCacheSize
+		if c.cacheSize > 0 {
+			size = c.cacheSize
+		}
+		c.items = newCacheStore(size, c.evictionPolicy)
+	}
+	return c.items
+}
+
+// existingStore returns the items storage or nil if it isn't created yet
+func (c *cache) existingStore() *cacheStore {
+	c.RLock()
+	defer c.RUnlock()
+	return c.items
 }
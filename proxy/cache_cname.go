@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxCNAMEChain is the max number of the CNAMEs followed when the answer is assembled from the cached RRsets
+const maxCNAMEChain = 8
+
+// cachedRRset is an RRset of the CNAME chain with its RRSIGs
+type cachedRRset struct {
+	name   string
+	rrtype uint16
+	rrs    []dns.RR
+}
+
+// rrsetKey returns the key of the cached RRset of the CNAME chain (see setCNAMEChain).
+// dnssec is true if the RRset is stored with its RRSIGs.
+func rrsetKey(name string, rrtype, class uint16, dnssec bool, ednsKey []byte) []byte {
+	k := key(&dns.Msg{Question: []dns.Question{{Name: name, Qtype: rrtype, Qclass: class}}})
+	k[0] = keyFlagRRset
+	if dnssec {
+		k[0] |= keyFlagDO
+	}
+	return withEDNSKey(k, ednsKey)
+}
+
+// cnameChain returns the RRsets of the CNAME chain of the answer starting from the name of the question:
+// the CNAMEs and the RRset of the question type of the last name (if there is one).
+// The records that aren't a part of the chain are skipped. Returns nil if the answer has no CNAMEs.
+func cnameChain(m *dns.Msg) []cachedRRset {
+	q := m.Question[0]
+	if q.Qtype == dns.TypeCNAME {
+		return nil
+	}
+
+	var chain []cachedRRset
+	name := q.Name
+	for i := 0; i < maxCNAMEChain; i++ {
+		var cname *dns.CNAME
+		for _, rr := range m.Answer {
+			if c, ok := rr.(*dns.CNAME); ok && strings.EqualFold(c.Hdr.Name, name) {
+				cname = c
+				break
+			}
+		}
+		if cname == nil {
+			break
+		}
+		rrs := append([]dns.RR{cname}, rrsetSigs(m.Answer, name, dns.TypeCNAME)...)
+		chain = append(chain, cachedRRset{name: name, rrtype: dns.TypeCNAME, rrs: rrs})
+		name = cname.Target
+	}
+	if len(chain) == 0 {
+		return nil
+	}
+
+	last := cachedRRset{name: name, rrtype: q.Qtype}
+	for _, rr := range m.Answer {
+		if h := rr.Header(); h.Rrtype == q.Qtype && strings.EqualFold(h.Name, name) {
+			last.rrs = append(last.rrs, rr)
+		}
+	}
+	if len(last.rrs) > 0 {
+		last.rrs = append(last.rrs, rrsetSigs(m.Answer, name, q.Qtype)...)
+		chain = append(chain, last)
+	}
+	return chain
+}
+
+// rrsetSigs returns the RRSIGs of the RRset of the name and type
+func rrsetSigs(rrs []dns.RR, name string, rrtype uint16) []dns.RR {
+	var sigs []dns.RR
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == rrtype && strings.EqualFold(sig.Hdr.Name, name) {
+			sigs = append(sigs, sig)
+		}
+	}
+	return sigs
+}
+
+// setCNAMEChain stores every RRset of the CNAME chain of the response under its own name and type with its own TTL
+// (see Config.CacheCNAMEChains). secure and ednsKey are the same as in cache.set.
+func (c *cache) setCNAMEChain(m *dns.Msg, secure bool, ednsKey []byte) {
+	if !c.cnameChains || m.Rcode != dns.RcodeSuccess || m.Truncated || len(m.Question) != 1 {
+		return
+	}
+	chain := cnameChain(m)
+	if chain == nil {
+		return
+	}
+
+	q := m.Question[0]
+	dnssec := keyFlags(m)&keyFlagDO != 0
+	for _, set := range chain {
+		rm := &dns.Msg{}
+		rm.SetQuestion(set.name, set.rrtype)
+		rm.Question[0].Qclass = q.Qclass
+		rm.Response = true
+		rm.RecursionAvailable = m.RecursionAvailable
+		rm.AuthenticatedData = m.AuthenticatedData
+		rm.Answer = set.rrs
+
+		ttl, ok := capTTL(rm, findLowestTTL(rm), c.ttlCaps)
+		if !ok || ttl == 0 {
+			continue
+		}
+		c.store().Set(rrsetKey(set.name, set.rrtype, q.Qclass, dnssec, ednsKey), packResponse(rm, ttl, secure))
+	}
+}
+
+// getCNAMEChain assembles the answer to the request from the cached RRsets of the CNAME chains (see setCNAMEChain).
+// Every RRset has its own TTL. Returns nil if any RRset of the chain isn't cached or is expired.
+func (c *cache) getCNAMEChain(items *cacheStore, request *dns.Msg, ednsKey []byte) (res *dns.Msg, secure bool) {
+	if !c.cnameChains {
+		return nil, false
+	}
+
+	q := request.Question[0]
+	res = &dns.Msg{}
+	res.SetReply(request)
+	res.RecursionAvailable = true
+	res.AuthenticatedData = true
+	secure = true
+
+	name := q.Name
+	for i := 0; i <= maxCNAMEChain; i++ {
+		m, setSecure := c.getRRset(items, request, name, q.Qtype, ednsKey)
+		if m == nil && i > 0 {
+			m, setSecure = getTargetResponse(items, request, name, ednsKey)
+		}
+		if m == nil {
+			m, setSecure = c.getRRset(items, request, name, dns.TypeCNAME, ednsKey)
+		}
+		if m == nil {
+			return nil, false
+		}
+
+		res.Answer = append(res.Answer, m.Answer...)
+		res.AuthenticatedData = res.AuthenticatedData && m.AuthenticatedData
+		secure = secure && setSecure
+		if m.Question[0].Qtype == q.Qtype {
+			if opt := request.IsEdns0(); opt != nil {
+				res.SetEdns0(opt.UDPSize(), opt.Do())
+			}
+			return res, secure
+		}
+		for _, rr := range m.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok {
+				name = cname.Target
+			}
+		}
+	}
+	return nil, false
+}
+
+// getRRset returns the cached RRset of the name and type.
+// The RRsets stored with the RRSIGs are used for the requests without DO too, the RRSIGs are removed in this case.
+func (c *cache) getRRset(items *cacheStore, request *dns.Msg, name string, rrtype uint16, ednsKey []byte) (*dns.Msg, bool) {
+	rrsetReq := &dns.Msg{Question: []dns.Question{{Name: name, Qtype: rrtype, Qclass: request.Question[0].Qclass}}}
+	keys := [][]byte{rrsetKey(name, rrtype, rrsetReq.Question[0].Qclass, true, ednsKey)}
+	if !isDORequested(request) {
+		keys = append([][]byte{rrsetKey(name, rrtype, rrsetReq.Question[0].Qclass, false, ednsKey)}, keys...)
+	}
+
+	for _, k := range keys {
+		data := items.Get(k)
+		if data == nil {
+			continue
+		}
+		m, _, err := unpackResponse(data, rrsetReq, 0)
+		if err != nil {
+			items.Invalidate(k)
+			return nil, false
+		}
+		if m == nil {
+			items.Expire(k)
+			return nil, false
+		}
+		if !isDORequested(request) {
+			stripDNSSEC(m)
+		}
+		return m, cacheDataSecure(data)
+	}
+	return nil, false
+}
+
+// getTargetResponse returns the cached response to the request for the name the CNAME chain leads to,
+// e.g. the A records of the target that has been resolved by another query.
+// Only the successful responses with the answer are used.
+func getTargetResponse(items *cacheStore, request *dns.Msg, name string, ednsKey []byte) (*dns.Msg, bool) {
+	targetReq := request.Copy()
+	targetReq.Question[0].Name = name
+	_, data, dnssec := lookupKeys(items, targetReq, func(m *dns.Msg) []byte {
+		return withEDNSKey(key(m), ednsKey)
+	})
+	if data == nil {
+		return nil, false
+	}
+
+	m, _, err := unpackResponse(data, targetReq, 0)
+	if err != nil || m == nil || m.Rcode != dns.RcodeSuccess || len(m.Answer) == 0 {
+		return nil, false
+	}
+	if dnssec {
+		stripDNSSEC(m)
+	}
+	return m, cacheDataSecure(data)
+}
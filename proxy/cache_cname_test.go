@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cnameTestResponse creates the response to the request for the name and type with the records
+func cnameTestResponse(name string, qtype uint16, rrs ...string) *dns.Msg {
+	req := &dns.Msg{}
+	req.SetQuestion(name, qtype)
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+	for _, rr := range rrs {
+		resp.Answer = append(resp.Answer, newRR(rr))
+	}
+	return resp
+}
+
+func cnameTestRequest(name string, qtype uint16) *dns.Msg {
+	req := &dns.Msg{}
+	req.SetQuestion(name, qtype)
+	return req
+}
+
+func TestCacheCNAMEChains(t *testing.T) {
+	c := &cache{cnameChains: true}
+	c.Set(cnameTestResponse("www.example.com.", dns.TypeA,
+		"www.example.com. 300 IN CNAME edge.example.com.",
+		"edge.example.com. 200 IN CNAME cdn.example.net.",
+		"cdn.example.net. 60 IN A 1.2.3.4",
+		"unrelated.example.org. 3600 IN A 5.6.7.8"))
+
+	// the intermediate name is answered from the chain with its own TTLs
+	res, ok := c.Get(cnameTestRequest("edge.example.com.", dns.TypeA))
+	require.True(t, ok)
+	require.Len(t, res.Answer, 2)
+	assert.Equal(t, "cdn.example.net.", res.Answer[0].(*dns.CNAME).Target)
+	assert.True(t, res.Answer[0].Header().Ttl > 60 && res.Answer[0].Header().Ttl <= 200)
+	assert.True(t, res.Answer[1].Header().Ttl <= 60)
+
+	// the last name of the chain
+	res, ok = c.Get(cnameTestRequest("cdn.example.net.", dns.TypeA))
+	require.True(t, ok)
+	require.Len(t, res.Answer, 1)
+	assert.Equal(t, "1.2.3.4", res.Answer[0].(*dns.A).A.String())
+
+	// the records outside of the chain aren't cached
+	_, ok = c.Get(cnameTestRequest("unrelated.example.org.", dns.TypeA))
+	assert.False(t, ok)
+
+	// the chain leads to the target that isn't resolved for this type yet
+	_, ok = c.Get(cnameTestRequest("www.example.com.", dns.TypeAAAA))
+	assert.False(t, ok)
+
+	// the target is resolved by another query
+	c.Set(cnameTestResponse("cdn.example.net.", dns.TypeAAAA, "cdn.example.net. 30 IN AAAA ::1"))
+	res, ok = c.Get(cnameTestRequest("www.example.com.", dns.TypeAAAA))
+	require.True(t, ok)
+	require.Len(t, res.Answer, 3)
+	assert.Equal(t, "www.example.com.", res.Question[0].Name)
+	assert.True(t, res.Answer[0].Header().Ttl > 200 && res.Answer[0].Header().Ttl <= 300)
+	assert.True(t, res.Answer[2].Header().Ttl <= 30)
+	assert.Equal(t, dns.TypeAAAA, res.Answer[2].Header().Rrtype)
+}
+
+func TestCacheCNAMEChainsDisabled(t *testing.T) {
+	c := &cache{}
+	c.Set(cnameTestResponse("www.example.com.", dns.TypeA,
+		"www.example.com. 300 IN CNAME cdn.example.net.",
+		"cdn.example.net. 60 IN A 1.2.3.4"))
+
+	_, ok := c.Get(cnameTestRequest("www.example.com.", dns.TypeA))
+	assert.True(t, ok)
+	_, ok = c.Get(cnameTestRequest("cdn.example.net.", dns.TypeA))
+	assert.False(t, ok)
+}
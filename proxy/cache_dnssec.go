@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"github.com/miekg/dns"
+)
+
+// The flags of the cache keys
+const (
+	keyFlagDO   = 1 << 0 // the request has the DO flag
+	keyFlagEDNS = 1 << 1 // the request has the OPT record
+
+	keyFlagRRset = 1 << 2 // the entry is an RRset of a CNAME chain (see setCNAMEChain)
+)
+
+// keyFlags returns the flags byte of the cache key, so the responses to the requests
+// with and without EDNS and DO are stored separately
+func keyFlags(m *dns.Msg) byte {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return 0
+	}
+	if opt.Do() {
+		return keyFlagEDNS | keyFlagDO
+	}
+	return keyFlagEDNS
+}
+
+// lookupKeys looks up the response to the request with the keys made by keyFunc: its own key and
+// the key of the NXDOMAIN responses for the name (see nxDomainRequest).
+// If the request doesn't have DO, the responses to the DO requests are used too, dnssec is true in this case
+// and the DNSSEC records must be removed from the response (see stripDNSSEC).
+func lookupKeys(items *cacheStore, request *dns.Msg, keyFunc func(m *dns.Msg) []byte) (key, data []byte, dnssec bool) {
+	keys := [][]byte{keyFunc(request), keyFunc(nxDomainRequest(request))}
+	if keys[0][0]&keyFlagDO == 0 {
+		for _, k := range keys[:2] {
+			doKey := append([]byte{}, k...)
+			doKey[0] = keyFlagEDNS | keyFlagDO
+			keys = append(keys, doKey)
+		}
+	}
+
+	for i, k := range keys {
+		data = items.Get(k)
+		if data != nil {
+			return k, data, i >= 2
+		}
+	}
+	return nil, nil, false
+}
+
+// stripDNSSEC removes the DNSSEC records the client hasn't asked for from the response
+func stripDNSSEC(m *dns.Msg) {
+	qtype := m.Question[0].Qtype
+	m.Answer = filterDNSSEC(m.Answer, qtype)
+	m.Ns = filterDNSSEC(m.Ns, qtype)
+	m.Extra = filterDNSSEC(m.Extra, qtype)
+}
+
+// filterDNSSEC returns the records except RRSIG, NSEC and NSEC3 (unless it's the type of the request)
+func filterDNSSEC(rrs []dns.RR, qtype uint16) []dns.RR {
+	res := rrs[:0]
+	for _, rr := range rrs {
+		switch t := rr.Header().Rrtype; t {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			if t != qtype {
+				continue
+			}
+		}
+		res = append(res, rr)
+	}
+	return res
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signedZone is the fixture of the signed responses of example.org
+var signedZone = map[uint16][]string{
+	dns.TypeA: {
+		"example.org. 3600 IN A 93.184.216.34",
+		"example.org. 3600 IN RRSIG A 13 2 3600 20301231000000 20200101000000 12345 example.org. " +
+			"ZGVhZGJlZWZkZWFkYmVlZmRlYWRiZWVmZGVhZGJlZWZkZWFkYmVlZmRlYWRiZWVmZGVhZGJlZWZkZWFkYmVlZg==",
+	},
+	dns.TypeNSEC: {
+		"example.org. 3600 IN NSEC www.example.org. A NS SOA RRSIG NSEC",
+		"example.org. 3600 IN RRSIG NSEC 13 2 3600 20301231000000 20200101000000 12345 example.org. " +
+			"ZGVhZGJlZWZkZWFkYmVlZmRlYWRiZWVmZGVhZGJlZWZkZWFkYmVlZmRlYWRiZWVmZGVhZGJlZWZkZWFkYmVlZg==",
+	},
+}
+
+// signedRequest creates the request for example.org, edns and do define its OPT record
+func signedRequest(qtype uint16, edns, do bool) *dns.Msg {
+	req := &dns.Msg{}
+	req.SetQuestion("example.org.", qtype)
+	if edns {
+		req.SetEdns0(4096, do)
+	}
+	return req
+}
+
+// signedResponse creates the response to the request from signedZone
+func signedResponse(req *dns.Msg) *dns.Msg {
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	for _, s := range signedZone[req.Question[0].Qtype] {
+		rr := newRR(s)
+		if rr.Header().Rrtype == dns.TypeRRSIG && !req.IsEdns0().Do() {
+			continue
+		}
+		resp.Answer = append(resp.Answer, rr)
+	}
+	if opt := req.IsEdns0(); opt != nil {
+		resp.SetEdns0(4096, opt.Do())
+	}
+	return resp
+}
+
+// countRRSIG returns the number of the RRSIG records in the answer
+func countRRSIG(m *dns.Msg) int {
+	n := 0
+	for _, rr := range m.Answer {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			n++
+		}
+	}
+	return n
+}
+
+func TestKeyFlags(t *testing.T) {
+	plain := key(signedRequest(dns.TypeA, false, false))
+	edns := key(signedRequest(dns.TypeA, true, false))
+	do := key(signedRequest(dns.TypeA, true, true))
+	assert.NotEqual(t, plain, edns)
+	assert.NotEqual(t, edns, do)
+	assert.NotEqual(t, plain, do)
+
+	// the flags are in the subnet cache key too, the qtype doesn't overwrite them
+	ip := net.IP{1, 2, 3, 0}
+	assert.NotEqual(t,
+		keyWithSubnet(signedRequest(dns.TypeA, true, false), ip, 24),
+		keyWithSubnet(signedRequest(dns.TypeA, true, true), ip, 24))
+}
+
+func TestCacheDNSSEC(t *testing.T) {
+	c := &cache{}
+	c.Set(signedResponse(signedRequest(dns.TypeA, true, true)))
+
+	res, ok := c.Get(signedRequest(dns.TypeA, true, true))
+	require.True(t, ok)
+	assert.Len(t, res.Answer, 2)
+	assert.Equal(t, 1, countRRSIG(res))
+
+	// the DO response is served to the other clients without the signatures
+	for _, edns := range []bool{true, false} {
+		res, ok = c.Get(signedRequest(dns.TypeA, edns, false))
+		require.True(t, ok)
+		require.Len(t, res.Answer, 1)
+		assert.Equal(t, dns.TypeA, res.Answer[0].Header().Rrtype)
+	}
+
+	// the cached response isn't changed
+	res, ok = c.Get(signedRequest(dns.TypeA, true, true))
+	require.True(t, ok)
+	assert.Equal(t, 1, countRRSIG(res))
+
+	// the response without the signatures isn't served to the DO clients
+	c = &cache{}
+	c.Set(signedResponse(signedRequest(dns.TypeA, true, false)))
+	_, ok = c.Get(signedRequest(dns.TypeA, true, true))
+	assert.False(t, ok)
+	_, ok = c.Get(signedRequest(dns.TypeA, true, false))
+	assert.True(t, ok)
+	// and it's separate from the responses to the clients without EDNS
+	_, ok = c.Get(signedRequest(dns.TypeA, false, false))
+	assert.False(t, ok)
+
+	// the requested type is kept
+	c.Set(signedResponse(signedRequest(dns.TypeNSEC, true, true)))
+	res, ok = c.Get(signedRequest(dns.TypeNSEC, true, false))
+	require.True(t, ok)
+	require.Len(t, res.Answer, 1)
+	assert.Equal(t, dns.TypeNSEC, res.Answer[0].Header().Rrtype)
+}
+
+func TestCacheSubnetDNSSEC(t *testing.T) {
+	c := &cacheSubnet{}
+	ip := net.IP{1, 2, 3, 0}
+	c.SetWithSubnet(signedResponse(signedRequest(dns.TypeA, true, true)), ip, 24)
+
+	res, ok := c.GetWithSubnet(signedRequest(dns.TypeA, true, true), ip, 24)
+	require.True(t, ok)
+	assert.Equal(t, 1, countRRSIG(res))
+
+	res, ok = c.GetWithSubnet(signedRequest(dns.TypeA, true, false), ip, 24)
+	require.True(t, ok)
+	assert.Equal(t, 0, countRRSIG(res))
+	assert.Len(t, res.Answer, 1)
+}
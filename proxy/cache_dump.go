@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// CacheEntry is the description of a cached response returned by CacheDump
+type CacheEntry struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	TTL     uint32   `json:"ttl"`     // remaining TTL in seconds (0 if the entry is expired and kept by the optimistic cache)
+	Rcode   string   `json:"rcode"`   // response code, e.g. "NOERROR" or "NXDOMAIN"
+	Answer  []string `json:"answer"`  // answer records
+	ECS     bool     `json:"ecs"`     // true if the entry is stored in the subnet cache
+	Client  bool     `json:"client"`  // true if the entry is stored in a client group cache
+	Expired bool     `json:"expired"` // true if the entry is expired and kept by the optimistic cache
+}
+
+// CacheDump returns the cached responses for the names that contain filter (case-insensitive, empty matches all).
+// At most limit entries are returned (0 means no limit).
+// The cache isn't locked while the entries are decoded.
+func (p *Proxy) CacheDump(filter string, limit int) []CacheEntry {
+	st := p.state()
+	filter = strings.ToLower(filter)
+	entries := []CacheEntry{}
+	seen := map[*byte]bool{} // NXDOMAIN responses are stored twice, see setNXDomain
+
+	dump := func(s *cacheStore, ecs, client bool) {
+		if s == nil {
+			return
+		}
+		s.Range(func(_, data []byte) bool {
+			if limit > 0 && len(entries) >= limit {
+				return false
+			}
+			if len(data) < cacheHeaderLen || seen[&data[0]] {
+				return true
+			}
+			seen[&data[0]] = true
+
+			e, ok := cacheEntryFromData(data)
+			if !ok || !strings.Contains(strings.ToLower(e.Name), filter) {
+				return true
+			}
+			e.ECS = ecs
+			e.Client = client
+			entries = append(entries, e)
+			return true
+		})
+	}
+	add := func(c *cache, cSubnet *cacheSubnet, client bool) {
+		if c != nil {
+			dump(c.existingStore(), false, client)
+		}
+		if cSubnet != nil {
+			dump(cSubnet.existingStore(), true, client)
+		}
+	}
+
+	add(st.cache, st.cacheSubnet, false)
+	for _, g := range st.clients {
+		add(g.cache, g.cacheSubnet, true)
+	}
+	return entries
+}
+
+// cacheEntryFromData decodes the cached data (see packResponse)
+func cacheEntryFromData(data []byte) (CacheEntry, bool) {
+	m := &dns.Msg{}
+	if m.Unpack(data[cacheHeaderLen:]) != nil || len(m.Question) != 1 {
+		return CacheEntry{}, false
+	}
+
+	q := m.Question[0]
+	e := CacheEntry{
+		Name:   q.Name,
+		Type:   dns.Type(q.Qtype).String(),
+		Rcode:  dns.RcodeToString[m.Rcode],
+		Answer: []string{},
+	}
+	left := int64(binary.BigEndian.Uint32(data)) - time.Now().Unix()
+	if left > 0 {
+		e.TTL = uint32(left)
+	} else {
+		e.Expired = true
+	}
+	for _, rr := range m.Answer {
+		e.Answer = append(e.Answer, strings.Replace(rr.String(), "\t", " ", -1))
+	}
+	return e, true
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheDump(t *testing.T) {
+	p := &Proxy{Config: Config{CacheEnabled: true, CacheOptimistic: true}}
+	p.initCache()
+	assert.Empty(t, p.CacheDump("", 0))
+
+	for _, host := range []string{"example.org", "www.example.org", "example.net"} {
+		req := createHostTestMessage(host)
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{newRR(host + ". 60 IN A 1.2.3.4")}
+		p.cache.Set(resp)
+	}
+	nx := createHostTestMessage("nx.example.org")
+	p.cache.Set(createNegativeResponse(nx, dns.RcodeNameError, "60", "60"))
+	setCacheEntryExpire(t, p.cache, createHostTestMessage("example.net"), time.Now().Add(-time.Second))
+
+	entries := p.CacheDump("", 0)
+	assert.Len(t, entries, 4)
+
+	entries = p.CacheDump("EXAMPLE.ORG", 0)
+	require.Len(t, entries, 3)
+	e := entries[0]
+	assert.Equal(t, "example.org.", e.Name)
+	assert.Equal(t, "A", e.Type)
+	assert.Equal(t, "NOERROR", e.Rcode)
+	assert.True(t, e.TTL > 50)
+	assert.Equal(t, []string{"example.org. 60 IN A 1.2.3.4"}, e.Answer)
+	assert.False(t, e.ECS)
+	assert.Equal(t, "NXDOMAIN", entries[2].Rcode)
+
+	entries = p.CacheDump("example.net", 0)
+	require.Len(t, entries, 1)
+	assert.True(t, entries[0].Expired)
+	assert.Equal(t, uint32(0), entries[0].TTL)
+
+	assert.Len(t, p.CacheDump("", 2), 2)
+
+	b, err := json.Marshal(p.CacheDump("www", 0))
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `"name":"www.example.org."`)
+}
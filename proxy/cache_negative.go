@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultCacheMaxNegativeTTL is the default limit of the negative responses TTL, as recommended by RFC 2308
+	defaultCacheMaxNegativeTTL = 3 * 60 * 60
+
+	// maxCacheFailureTTL is the limit of CacheFailureTTL
+	maxCacheFailureTTL = 30
+)
+
+// defaultCacheUncacheableRcodes is the default value of CacheUncacheableRcodes
+var defaultCacheUncacheableRcodes = []int{dns.RcodeServerFailure, dns.RcodeRefused, dns.RcodeNotImplemented}
+
+// cacheTTL returns the TTL the response is cached for.
+// The negative responses are cached according to RFC 2308 for not longer than maxNegativeTTL.
+// The responses with the uncacheable rcodes are only stored in the failure cache for failureTTL
+// (0 means they aren't cached), the responses with the other rcodes are cached like the negative ones.
+// Returns false if the response isn't cacheable.
+func cacheTTL(m *dns.Msg, maxNegativeTTL, failureTTL uint32, uncacheable map[int]bool, l proxyutil.Logger) (uint32, bool) {
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		if m.Truncated || len(m.Question) != 1 {
+			return 0, false
+		}
+		if isUncacheableRcode(m.Rcode, uncacheable) {
+			return failureTTL, failureTTL > 0
+		}
+		ttl := findLowestTTL(m)
+		if maxNegativeTTL > 0 && ttl > maxNegativeTTL {
+			ttl = maxNegativeTTL
+		}
+		return ttl, ttl > 0
+	}
+
+	if !isCacheable(m, l) {
+		return 0, false
+	}
+	ttl := responseTTL(m, l)
+	if maxNegativeTTL > 0 && isNegativeResponse(m) && ttl > maxNegativeTTL {
+		ttl = maxNegativeTTL
+	}
+	return ttl, true
+}
+
+// isUncacheableRcode checks if the responses with the rcode are only stored in the failure cache
+func isUncacheableRcode(rcode int, uncacheable map[int]bool) bool {
+	if uncacheable == nil {
+		for _, rc := range defaultCacheUncacheableRcodes {
+			if rc == rcode {
+				return true
+			}
+		}
+		return false
+	}
+	return uncacheable[rcode]
+}
+
+// responseTTL returns the lowest TTL of the records or, for the negative responses, the negative TTL
+func responseTTL(m *dns.Msg, l proxyutil.Logger) uint32 {
+	if isNegativeResponse(m) {
+		return negativeTTL(m, l)
+	}
+	return findLowestTTL(m)
+}
+
+// negativeTTL returns the TTL of the negative response: the minimum of the SOA record TTL and its MINIMUM field.
+// Returns 0 if there is no SOA record in the authority section, such responses must not be cached (RFC 2308, section 5).
+func negativeTTL(m *dns.Msg, l proxyutil.Logger) uint32 {
+	for _, rr := range m.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+		if soa.Minttl < soa.Hdr.Ttl {
+			return soa.Minttl
+		}
+		return soa.Hdr.Ttl
+	}
+	if l.DebugEnabled() {
+		l.Debugf("%s: refusing to cache a negative response without SOA", m.Question[0].Name)
+	}
+	return 0
+}
+
+// nxDomainRequest returns the copy of the request with the qtype set to TypeNone.
+// NXDOMAIN means that the name has no records of any type, so the NXDOMAIN responses
+// are also stored with the key of this request and are served for the requests of all types.
+func nxDomainRequest(m *dns.Msg) *dns.Msg {
+	req := *m
+	q := m.Question[0]
+	req.Question = []dns.Question{{Name: q.Name, Qtype: dns.TypeNone, Qclass: q.Qclass}}
+	return &req
+}
+
+// setNXDomain stores the NXDOMAIN response with nxKey or, if the name exists, removes the stored NXDOMAIN response
+func setNXDomain(s *cacheStore, m *dns.Msg, nxKey, data []byte) {
+	switch m.Rcode {
+	case dns.RcodeNameError:
+		s.Set(nxKey, data)
+	case dns.RcodeSuccess:
+		s.Del(nxKey)
+	}
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createNegativeResponse creates the NXDOMAIN or NODATA response with the SOA record
+func createNegativeResponse(req *dns.Msg, rcode int, soaTTL, minTTL string) *dns.Msg {
+	resp := &dns.Msg{}
+	resp.SetRcode(req, rcode)
+	resp.Ns = []dns.RR{newRR("example.org. " + soaTTL + " IN SOA ns.example.org. hostmaster.example.org. 1 3600 600 86400 " + minTTL)}
+	return resp
+}
+
+func TestCacheTTLNegative(t *testing.T) {
+	req := createHostTestMessage("nx.example.org")
+
+	ttl, ok := cacheTTL(createNegativeResponse(req, dns.RcodeNameError, "3600", "300"), 0, 0, nil, proxyutil.DefaultLogger())
+	assert.True(t, ok)
+	assert.Equal(t, uint32(300), ttl)
+
+	ttl, ok = cacheTTL(createNegativeResponse(req, dns.RcodeSuccess, "100", "300"), 0, 0, nil, proxyutil.DefaultLogger())
+	assert.True(t, ok)
+	assert.Equal(t, uint32(100), ttl)
+
+	ttl, ok = cacheTTL(createNegativeResponse(req, dns.RcodeNameError, "86400", "86400"), 3600, 0, nil, proxyutil.DefaultLogger())
+	assert.True(t, ok)
+	assert.Equal(t, uint32(3600), ttl)
+
+	// no SOA
+	resp := &dns.Msg{}
+	resp.SetRcode(req, dns.RcodeNameError)
+	_, ok = cacheTTL(resp, 0, 0, nil, proxyutil.DefaultLogger())
+	assert.False(t, ok)
+
+	// SERVFAIL is only stored in the failure cache
+	resp.SetRcode(req, dns.RcodeServerFailure)
+	_, ok = cacheTTL(resp, 0, 0, nil, proxyutil.DefaultLogger())
+	assert.False(t, ok)
+	ttl, ok = cacheTTL(resp, 0, 5, nil, proxyutil.DefaultLogger())
+	assert.True(t, ok)
+	assert.Equal(t, uint32(5), ttl)
+
+	// REFUSED is in the default list
+	resp = createNegativeResponse(req, dns.RcodeRefused, "600", "600")
+	ttl, ok = cacheTTL(resp, 300, 5, nil, proxyutil.DefaultLogger())
+	assert.True(t, ok)
+	assert.Equal(t, uint32(5), ttl)
+
+	// it isn't in the custom list, so it's cached like a negative response
+	ttl, ok = cacheTTL(resp, 300, 5, map[int]bool{dns.RcodeServerFailure: true}, proxyutil.DefaultLogger())
+	assert.True(t, ok)
+	assert.Equal(t, uint32(300), ttl)
+}
+
+func TestCacheNXDomain(t *testing.T) {
+	c := &cache{}
+	reqA := createHostTestMessage("nx.example.org")
+	c.Set(createNegativeResponse(reqA, dns.RcodeNameError, "3600", "300"))
+
+	res, ok := c.Get(reqA)
+	require.True(t, ok)
+	assert.Equal(t, dns.RcodeNameError, res.Rcode)
+	require.Len(t, res.Ns, 1)
+	assert.True(t, res.Ns[0].Header().Ttl <= 300)
+
+	// the name doesn't exist, so there are no records of the other types too
+	reqAAAA := createHostTestMessage("nx.example.org")
+	reqAAAA.Question[0].Qtype = dns.TypeAAAA
+	res, ok = c.Get(reqAAAA)
+	require.True(t, ok)
+	assert.Equal(t, dns.RcodeNameError, res.Rcode)
+	assert.Equal(t, dns.TypeAAAA, res.Question[0].Qtype)
+
+	// NODATA is only valid for the requested type
+	reqOther := createHostTestMessage("nodata.example.org")
+	c.Set(createNegativeResponse(reqOther, dns.RcodeSuccess, "3600", "300"))
+	_, ok = c.Get(reqOther)
+	assert.True(t, ok)
+	reqOther.Question[0].Qtype = dns.TypeAAAA
+	_, ok = c.Get(reqOther)
+	assert.False(t, ok)
+
+	// the name is created
+	reqMX := createHostTestMessage("nx.example.org")
+	reqMX.Question[0].Qtype = dns.TypeMX
+	resp := &dns.Msg{}
+	resp.SetReply(reqMX)
+	resp.Answer = []dns.RR{newRR("nx.example.org. 60 IN MX 10 mail.example.org.")}
+	c.Set(resp)
+	_, ok = c.Get(reqAAAA)
+	assert.False(t, ok)
+}
+
+func TestCacheServfail(t *testing.T) {
+	req := createHostTestMessage("example.org")
+	resp := &dns.Msg{}
+	resp.SetRcode(req, dns.RcodeServerFailure)
+
+	c := &cache{}
+	c.Set(resp)
+	_, ok := c.Get(req)
+	assert.False(t, ok)
+
+	c = &cache{failureTTL: 5, maxStale: 3600}
+	c.Set(resp)
+	res, ok := c.Get(req)
+	require.True(t, ok)
+	assert.Equal(t, dns.RcodeServerFailure, res.Rcode)
+
+	// the expired SERVFAIL responses aren't served by the optimistic cache
+	setCacheEntryExpire(t, c, req, time.Now().Add(-time.Second))
+	_, ok = c.Get(req)
+	assert.False(t, ok)
+}
@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// defaultCachePersistMaxSize is the default max size of the cache file (in bytes)
+const defaultCachePersistMaxSize = 32 * 1024 * 1024
+
+// cachePersistMagic and cachePersistVersion start the cache file.
+// The version must be incremented when the format of the file or of the cached data changes.
+var cachePersistMagic = []byte("DNSPXCACHE")
+
+const cachePersistVersion = 4
+
+// The kinds of the cache file records
+const (
+	cacheRecordGeneral = 1 // the record of p.cache
+	cacheRecordSubnet  = 2 // the record of p.cacheSubnet
+)
+
+/*
+The cache file format:
+magic [10]byte
+version uint16
+records:
+	kind uint8
+	key_len uint16
+	key []byte
+	data_len uint32
+	data []byte (the cached data, see packResponse, it contains the absolute expiry time)
+*/
+
+// cacheRecord is a single entry of the cache file
+type cacheRecord struct {
+	kind uint8
+	key  []byte
+	data []byte
+}
+
+// cachePersistMaxSize returns the max size of the cache file
+func (p *Proxy) cachePersistMaxSize() int {
+	if p.CachePersistMaxSize > 0 {
+		return p.CachePersistMaxSize
+	}
+	return defaultCachePersistMaxSize
+}
+
+// saveCache writes the entries of the general cache instances to CachePersistPath.
+// If the entries don't fit into the file size limit, the least recently used ones are skipped.
+func (p *Proxy) saveCache() {
+	if p.CachePersistPath == "" || p.cache == nil {
+		return
+	}
+
+	records := []cacheRecord{}
+	collect := func(kind uint8, s *cacheStore) {
+		if s == nil {
+			return
+		}
+		s.Range(func(key, data []byte) bool {
+			records = append(records, cacheRecord{kind: kind, key: key, data: data})
+			return true
+		})
+	}
+	collect(cacheRecordGeneral, p.cache.existingStore())
+	if p.cacheSubnet != nil {
+		collect(cacheRecordSubnet, p.cacheSubnet.existingStore())
+	}
+
+	// keep the most recently used records that fit into the limit
+	size := len(cachePersistMagic) + 2
+	first := len(records)
+	for first > 0 {
+		r := records[first-1]
+		recSize := 1 + 2 + len(r.key) + 4 + len(r.data)
+		if size+recSize > p.cachePersistMaxSize() {
+			p.logger().Infof("Cache file size limit is reached, %d cache entries aren't saved", first)
+			break
+		}
+		size += recSize
+		first--
+	}
+
+	err := writeCacheFile(p.CachePersistPath, records[first:])
+	if err != nil {
+		p.logger().Errorf("Failed to save the cache to %s: %s", p.CachePersistPath, err)
+		return
+	}
+	p.logger().Infof("Saved %d cache entries to %s", len(records)-first, p.CachePersistPath)
+}
+
+// loadCache reads the cache entries from CachePersistPath.
+// The entries that are expired (including the optimistic cache period) are skipped.
+// If the file is corrupt, the cache is left empty.
+// Returns the number of the loaded entries.
+func (p *Proxy) loadCache() int {
+	if p.CachePersistPath == "" || p.cache == nil {
+		return 0
+	}
+
+	records, err := readCacheFile(p.CachePersistPath, p.cachePersistMaxSize())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			p.logger().Errorf("Failed to load the cache from %s, starting with an empty cache: %s", p.CachePersistPath, err)
+		}
+		return 0
+	}
+
+	now := time.Now().Unix()
+	loaded := 0
+	for _, r := range records {
+		var s *cacheStore
+		var maxStale uint32
+		switch r.kind {
+		case cacheRecordGeneral:
+			s, maxStale = p.cache.store(), p.cache.maxStale
+		case cacheRecordSubnet:
+			if p.cacheSubnet == nil {
+				continue
+			}
+			s, maxStale = p.cacheSubnet.store(), p.cacheSubnet.maxStale
+		}
+
+		expire := int64(binary.BigEndian.Uint32(r.data))
+		if expire+int64(maxStale) <= now {
+			continue
+		}
+		// copy the record, so the entries don't keep the whole file in memory
+		s.Set(append([]byte{}, r.key...), append([]byte{}, r.data...))
+		loaded++
+	}
+	p.logger().Infof("Loaded %d cache entries from %s", loaded, p.CachePersistPath)
+	return loaded
+}
+
+// writeCacheFile writes the records to a temporary file and then renames it to path
+func writeCacheFile(path string, records []cacheRecord) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	_, _ = w.Write(cachePersistMagic)
+	var b [4]byte
+	binary.BigEndian.PutUint16(b[:], cachePersistVersion)
+	_, _ = w.Write(b[:2])
+	for _, r := range records {
+		_ = w.WriteByte(r.kind)
+		binary.BigEndian.PutUint16(b[:], uint16(len(r.key)))
+		_, _ = w.Write(b[:2])
+		_, _ = w.Write(r.key)
+		binary.BigEndian.PutUint32(b[:], uint32(len(r.data)))
+		_, _ = w.Write(b[:])
+		_, _ = w.Write(r.data)
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// readCacheFile reads and validates the records of the cache file.
+// Returns an error if the file is larger than maxSize, has another version or is corrupt.
+func readCacheFile(path string, maxSize int) ([]cacheRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(f, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSize {
+		return nil, fmt.Errorf("the file is larger than %d bytes", maxSize)
+	}
+
+	headerLen := len(cachePersistMagic) + 2
+	if len(data) < headerLen || !bytes.Equal(data[:len(cachePersistMagic)], cachePersistMagic) {
+		return nil, errors.New("not a cache file")
+	}
+	version := binary.BigEndian.Uint16(data[len(cachePersistMagic):])
+	if version != cachePersistVersion {
+		return nil, fmt.Errorf("unsupported cache file version %d", version)
+	}
+
+	errCorrupt := errors.New("the cache file is corrupt")
+	records := []cacheRecord{}
+	data = data[headerLen:]
+	for len(data) > 0 {
+		if len(data) < 1+2 {
+			return nil, errCorrupt
+		}
+		r := cacheRecord{kind: data[0]}
+		if r.kind != cacheRecordGeneral && r.kind != cacheRecordSubnet {
+			return nil, errCorrupt
+		}
+		keyLen := int(binary.BigEndian.Uint16(data[1:]))
+		data = data[3:]
+		if len(data) < keyLen+4 {
+			return nil, errCorrupt
+		}
+		r.key = data[:keyLen]
+		dataLen := int(binary.BigEndian.Uint32(data[keyLen:]))
+		data = data[keyLen+4:]
+		// the cached data contains the header and at least the DNS message header
+		if dataLen < cacheHeaderLen+12 || len(data) < dataLen {
+			return nil, errCorrupt
+		}
+		r.data = data[:dataLen]
+		data = data[dataLen:]
+		records = append(records, r)
+	}
+	return records, nil
+}
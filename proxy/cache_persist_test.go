@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachePersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.bin")
+
+	newProxy := func() *Proxy {
+		p := &Proxy{Config: Config{CacheEnabled: true, CachePersistPath: path}}
+		p.initCache()
+		return p
+	}
+
+	reply := func(host string) *dns.Msg {
+		req := createHostTestMessage(host)
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{newRR(host + ". 60 IN A 1.2.3.4")}
+		return resp
+	}
+
+	// no file yet
+	p := newProxy()
+	p.loadCache()
+
+	p.cache.Set(reply("example.org"))
+	p.cache.Set(reply("expired.example.org"))
+	setCacheEntryExpire(t, p.cache, createHostTestMessage("expired.example.org"), time.Now().Add(-time.Second))
+	p.saveCache()
+
+	p = newProxy()
+	p.loadCache()
+	res, ok := p.cache.Get(createHostTestMessage("example.org"))
+	require.True(t, ok)
+	require.Len(t, res.Answer, 1)
+	assert.True(t, res.Answer[0].Header().Ttl > 50)
+	_, ok = p.cache.Get(createHostTestMessage("expired.example.org"))
+	assert.False(t, ok)
+
+	// the size limit keeps the most recently used entries
+	p.cache.Set(reply("new.example.org"))
+	p.CachePersistMaxSize = 150
+	p.saveCache()
+	p = newProxy()
+	p.loadCache()
+	_, ok = p.cache.Get(createHostTestMessage("example.org"))
+	assert.False(t, ok)
+	_, ok = p.cache.Get(createHostTestMessage("new.example.org"))
+	assert.True(t, ok)
+
+	// corrupt file
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(path, data[:len(data)-1], 0644)
+	require.NoError(t, err)
+	p = newProxy()
+	p.loadCache()
+	_, ok = p.cache.Get(createHostTestMessage("new.example.org"))
+	assert.False(t, ok)
+
+	// another version
+	data[len(cachePersistMagic)+1]++
+	err = ioutil.WriteFile(path, data, 0644)
+	require.NoError(t, err)
+	p = newProxy()
+	p.loadCache()
+	_, ok = p.cache.Get(createHostTestMessage("new.example.org"))
+	assert.False(t, ok)
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ClearCache removes all the entries from the cache, including the caches of the client groups
+func (p *Proxy) ClearCache() {
+	for _, s := range p.cacheStores() {
+		s.Clear()
+	}
+	p.logger().Infof("The DNS cache is cleared")
+}
+
+// RemoveFromCache removes the cached responses for the name and the specified type (0 means all types).
+// The negative responses for the name and the responses with CNAME chains that lead to the name are removed too.
+func (p *Proxy) RemoveFromCache(name string, qtype uint16) {
+	name = strings.ToLower(dns.Fqdn(name))
+	removed := 0
+	for _, s := range p.cacheStores() {
+		s.Range(func(key, data []byte) bool {
+			if cachedResponseMatches(data, name, qtype) {
+				s.Del(key)
+				removed++
+			}
+			return true
+		})
+	}
+	if l := p.logger(); l.DebugEnabled() {
+		l.Debugf("Removed %d cache entries for %s", removed, name)
+	}
+}
+
+// cacheStores returns the storages of all the cache instances that are used
+func (p *Proxy) cacheStores() []*cacheStore {
+	st := p.state()
+	stores := []*cacheStore{}
+	add := func(c *cache, cSubnet *cacheSubnet) {
+		if c != nil {
+			if s := c.existingStore(); s != nil {
+				stores = append(stores, s)
+			}
+		}
+		if cSubnet != nil {
+			if s := cSubnet.existingStore(); s != nil {
+				stores = append(stores, s)
+			}
+		}
+	}
+
+	add(st.cache, st.cacheSubnet)
+	for _, g := range st.clients {
+		add(g.cache, g.cacheSubnet)
+	}
+	return stores
+}
+
+// cachedResponseMatches checks if the cached data is the response for the name (lowercase FQDN) and qtype.
+// NXDOMAIN responses match all types.
+func cachedResponseMatches(data []byte, name string, qtype uint16) bool {
+	m := &dns.Msg{}
+	if len(data) < cacheHeaderLen || m.Unpack(data[cacheHeaderLen:]) != nil || len(m.Question) != 1 {
+		// can't be served anyway
+		return true
+	}
+
+	q := m.Question[0]
+	if qtype != 0 && q.Qtype != qtype && m.Rcode != dns.RcodeNameError {
+		return false
+	}
+	if strings.ToLower(q.Name) == name {
+		return true
+	}
+	for _, rr := range m.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok && strings.ToLower(cname.Target) == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoveFromCache(t *testing.T) {
+	p := &Proxy{Config: Config{CacheEnabled: true}}
+	p.initCache()
+
+	request := func(host string, qtype uint16) *dns.Msg {
+		req := createHostTestMessage(host)
+		req.Question[0].Qtype = qtype
+		return req
+	}
+	set := func(req *dns.Msg, answers ...string) {
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		for _, a := range answers {
+			resp.Answer = append(resp.Answer, newRR(a))
+		}
+		p.cache.Set(resp)
+	}
+	cached := func(req *dns.Msg) bool {
+		_, ok := p.cache.Get(req)
+		return ok
+	}
+
+	reqA := request("example.org", dns.TypeA)
+	reqAAAA := request("example.org", dns.TypeAAAA)
+	reqAlias := request("alias.example.org", dns.TypeA)
+	reqOther := request("example.net", dns.TypeA)
+	reqNX := request("nx.example.org", dns.TypeA)
+	set(reqA, "example.org. 60 IN A 1.2.3.4")
+	set(reqAAAA, "example.org. 60 IN AAAA ::1")
+	set(reqAlias, "alias.example.org. 60 IN CNAME example.org.", "example.org. 60 IN A 1.2.3.4")
+	set(reqOther, "example.net. 60 IN A 1.2.3.4")
+	p.cache.Set(createNegativeResponse(reqNX, dns.RcodeNameError, "60", "60"))
+
+	p.RemoveFromCache("Example.org", dns.TypeA)
+	assert.False(t, cached(reqA))
+	assert.False(t, cached(reqAlias))
+	assert.True(t, cached(reqAAAA))
+	assert.True(t, cached(reqOther))
+
+	// NXDOMAIN is removed for any type
+	assert.True(t, cached(reqNX))
+	p.RemoveFromCache("nx.example.org.", dns.TypeMX)
+	assert.False(t, cached(reqNX))
+	assert.False(t, cached(request("nx.example.org", dns.TypeAAAA)))
+
+	p.RemoveFromCache("example.org", 0)
+	assert.False(t, cached(reqAAAA))
+	assert.True(t, cached(reqOther))
+
+	p.ClearCache()
+	assert.False(t, cached(reqOther))
+}
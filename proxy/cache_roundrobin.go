@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"math"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// rotateCachedAnswer rotates the A and AAAA records of the response served from the cache (see CacheRoundRobin).
+// The response must be a copy of the cached one. The responses to the DO requests aren't changed.
+func (p *Proxy) rotateCachedAnswer(d *DNSContext) {
+	if !p.requestState(d).CacheRoundRobin {
+		return
+	}
+	if isDORequested(d.Req) {
+		return
+	}
+	n := atomic.AddUint64(&p.counters.cacheRotations, 1)
+	rotateAnswer(d.Res.Answer, int(n%math.MaxInt32))
+}
+
+// rotateAnswer rotates every RRset of A or AAAA records by n positions.
+// Only the adjacent records with the same name and type are moved, so the order of the CNAME chain is kept.
+func rotateAnswer(rrs []dns.RR, n int) {
+	for start := 0; start < len(rrs); {
+		h := rrs[start].Header()
+		end := start + 1
+		for end < len(rrs) && rrs[end].Header().Rrtype == h.Rrtype && strings.EqualFold(rrs[end].Header().Name, h.Name) {
+			end++
+		}
+		if (h.Rrtype == dns.TypeA || h.Rrtype == dns.TypeAAAA) && end-start > 1 {
+			rotate(rrs[start:end], n%(end-start))
+		}
+		start = end
+	}
+}
+
+// rotate moves the first n records to the end
+func rotate(rrs []dns.RR, n int) {
+	if n == 0 {
+		return
+	}
+	tmp := append([]dns.RR{}, rrs[:n]...)
+	copy(rrs, rrs[n:])
+	copy(rrs[len(rrs)-n:], tmp)
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotateAnswer(t *testing.T) {
+	rrs := []dns.RR{
+		newRR("www.example.org. 60 IN CNAME example.org."),
+		newRR("example.org. 60 IN A 1.2.3.1"),
+		newRR("example.org. 60 IN A 1.2.3.2"),
+		newRR("example.org. 60 IN A 1.2.3.3"),
+		newRR("example.org. 60 IN AAAA ::1"),
+		newRR("example.org. 60 IN AAAA ::2"),
+	}
+	rotateAnswer(rrs, 1)
+
+	records := []string{}
+	for _, rr := range rrs {
+		records = append(records, rr.String())
+	}
+	assert.Equal(t, []string{
+		"www.example.org.\t60\tIN\tCNAME\texample.org.",
+		"example.org.\t60\tIN\tA\t1.2.3.2",
+		"example.org.\t60\tIN\tA\t1.2.3.3",
+		"example.org.\t60\tIN\tA\t1.2.3.1",
+		"example.org.\t60\tIN\tAAAA\t::2",
+		"example.org.\t60\tIN\tAAAA\t::1",
+	}, records)
+}
+
+func TestCacheRoundRobin(t *testing.T) {
+	p := &Proxy{Config: Config{CacheEnabled: true, CacheRoundRobin: true}}
+	p.initCache()
+
+	req := createHostTestMessage("example.org")
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{
+		newRR("example.org. 60 IN A 1.2.3.1"),
+		newRR("example.org. 60 IN A 1.2.3.2"),
+		newRR("example.org. 60 IN A 1.2.3.3"),
+	}
+	p.setInCache(&DNSContext{Req: req}, resp)
+
+	first := func(req *dns.Msg) string {
+		d := &DNSContext{Req: req}
+		require.True(t, p.replyFromCache(d))
+		require.Len(t, d.Res.Answer, 3)
+		return d.Res.Answer[0].(*dns.A).A.String()
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		seen[first(createHostTestMessage("example.org"))] = true
+	}
+	assert.Len(t, seen, 3)
+
+	// the DO responses aren't rotated
+	doReq := createHostTestMessage("example.org")
+	doReq.SetEdns0(4096, true)
+	doResp := resp.Copy()
+	doResp.SetEdns0(4096, true)
+	p.setInCache(&DNSContext{Req: doReq}, doResp)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "1.2.3.1", first(doReq.Copy()))
+	}
+
+	// the cached entry isn't changed
+	p.CacheRoundRobin = false
+	assert.Equal(t, "1.2.3.1", first(createHostTestMessage("example.org")))
+}
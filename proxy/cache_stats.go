@@ -0,0 +1,33 @@
+package proxy
+
+import "sync/atomic"
+
+// CacheStats contains the cache size and counters.
+// The values are summed over all the cache instances, including the client groups caches.
+// The size and the eviction and expiration counters are reset when the cache is re-created by Reload.
+type CacheStats struct {
+	Entries     int    `json:"entries"`     // number of cached responses
+	Bytes       int    `json:"bytes"`       // approximate memory used by the cached responses, their keys and the entries themselves
+	Hits        uint64 `json:"hits"`        // number of requests answered from the cache
+	Misses      uint64 `json:"misses"`      // number of requests that weren't found in the cache
+	Evictions   uint64 `json:"evictions"`   // number of entries removed because the cache is full
+	Expirations uint64 `json:"expirations"` // number of expired entries removed
+	Mismatches  uint64 `json:"mismatches"`  // number of entries removed because their question doesn't match the request
+}
+
+// CacheStats returns the current cache stats
+func (p *Proxy) CacheStats() CacheStats {
+	stats := CacheStats{
+		Hits:   atomic.LoadUint64(&p.counters.cacheHits),
+		Misses: atomic.LoadUint64(&p.counters.cacheMisses),
+	}
+	for _, s := range p.cacheStores() {
+		entries, size, evictions, expirations := s.Stats()
+		stats.Entries += entries
+		stats.Bytes += size
+		stats.Evictions += evictions
+		stats.Expirations += expirations
+		stats.Mismatches += s.Mismatches()
+	}
+	return stats
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheStats(t *testing.T) {
+	p := &Proxy{Config: Config{CacheEnabled: true, CacheSizeBytes: 400}}
+	p.initCache()
+	assert.Equal(t, CacheStats{}, p.CacheStats())
+
+	set := func(host string) {
+		req := createHostTestMessage(host)
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{newRR(host + ". 60 IN A 1.2.3.4")}
+		p.setInCache(&DNSContext{Req: req}, resp)
+	}
+	lookup := func(host string) bool {
+		return p.replyFromCache(&DNSContext{Req: createHostTestMessage(host)})
+	}
+
+	assert.False(t, lookup("example.org"))
+	set("example.org")
+	assert.True(t, lookup("example.org"))
+	stats := p.CacheStats()
+	assert.Equal(t, 1, stats.Entries)
+	assert.True(t, stats.Bytes > 50)
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+
+	setCacheEntryExpire(t, p.cache, createHostTestMessage("example.org"), time.Now().Add(-time.Second))
+	assert.False(t, lookup("example.org"))
+	stats = p.CacheStats()
+	assert.Equal(t, 0, stats.Entries)
+	assert.Equal(t, 0, stats.Bytes)
+	assert.Equal(t, uint64(1), stats.Expirations)
+	assert.Equal(t, uint64(2), stats.Misses)
+
+	for i := 0; i < 10; i++ {
+		set(fmt.Sprintf("host%d.example.org", i))
+	}
+	stats = p.CacheStats()
+	assert.True(t, stats.Entries < 10)
+	assert.True(t, stats.Bytes <= 400)
+	assert.Equal(t, uint64(10-stats.Entries), stats.Evictions)
+}
@@ -0,0 +1,353 @@
+package proxy
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// maxCacheShards is the max number of the cache shards, must be a power of two
+	maxCacheShards = 16
+
+	// minCacheShardSize is the min fair share of the size limit of a cache shard (in bytes),
+	// the small caches have less shards
+	minCacheShardSize = 16 * 1024
+
+	// cacheEntryOverhead is the approximate memory used by a cache item besides its key and value:
+	// the map entry, the list element and cacheStoreItem itself
+	cacheEntryOverhead = 160
+
+	// protectedCachePercent is the part of the shard size used by the protected items of CacheEvictionLFU
+	protectedCachePercent = 80
+)
+
+// CacheEvictionPolicy defines which cache entries are removed when the cache is full
+type CacheEvictionPolicy int
+
+const (
+	// CacheEvictionLRU -- the least recently used entries are removed.
+	// This is the default policy.
+	CacheEvictionLRU CacheEvictionPolicy = iota
+
+	// CacheEvictionLFU -- the entries that have been requested from the cache are protected
+	// and are only removed after all the entries that have never been requested.
+	// It keeps the frequently used entries when a lot of one-off names are resolved.
+	CacheEvictionLFU
+)
+
+// cacheStore is a size-limited storage of the cache items.
+// When the cache is full, the least recently used items are removed.
+// Unlike golibs/cache, the items can be enumerated (see Range).
+// The items are split into shards by the hash of the key, every shard has its own lock and LRU lists.
+// The size limit is shared: a shard above its fair share removes its own items, otherwise the least recently
+// used item of all the shards is removed, so any item that fits the whole cache is stored.
+// The size of an item is the length of its key and value plus cacheEntryOverhead.
+type cacheStore struct {
+	clock   uint64 // incremented on every access, it must be the first field, see sync/atomic docs
+	size    int64  // current size of all the shards in bytes, accessed atomically
+	maxSize int    // max size in bytes
+	shards  []*cacheShard
+	mask    uint32 // the number of shards minus one
+}
+
+// cacheShard is a part of cacheStore
+type cacheShard struct {
+	items map[string]*list.Element // the values are *cacheStoreItem
+	usage *list.List               // the least recently used items are at the front
+	size  int                      // current size in bytes
+	share int                      // the fair share of cacheStore.maxSize in bytes
+	total *int64                   // cacheStore.size
+
+	// the items that have been requested after they were stored (only used by CacheEvictionLFU)
+	protected     *list.List
+	protectedSize int
+	lfu           bool
+
+	evictions   uint64 // number of items removed because the cache is full
+	expirations uint64 // number of expired items removed (see Expire)
+	mismatches  uint64 // number of items removed because they don't match the request (see Invalidate)
+
+	lock sync.Mutex
+}
+
+// cacheStoreItem is an item of cacheStore
+type cacheStoreItem struct {
+	key       string
+	value     []byte
+	used      uint64 // the value of cacheStore.clock at the last access
+	protected bool   // true if the item is in the protected list
+}
+
+// size returns the size of the item
+func (it *cacheStoreItem) size() int {
+	return len(it.key) + len(it.value) + cacheEntryOverhead
+}
+
+// newCacheStore creates a new cacheStore of the specified size (in bytes)
+func newCacheStore(maxSize int, policy CacheEvictionPolicy) *cacheStore {
+	shards := 1
+	for shards < maxCacheShards && maxSize/(shards*2) >= minCacheShardSize {
+		shards *= 2
+	}
+	return newCacheStoreShards(maxSize, shards, policy)
+}
+
+// newCacheStoreShards creates a new cacheStore with the specified number of shards (a power of two)
+func newCacheStoreShards(maxSize, shards int, policy CacheEvictionPolicy) *cacheStore {
+	s := &cacheStore{maxSize: maxSize, mask: uint32(shards - 1)}
+	for i := 0; i < shards; i++ {
+		s.shards = append(s.shards, &cacheShard{
+			items:     map[string]*list.Element{},
+			usage:     list.New(),
+			share:     maxSize / shards,
+			total:     &s.size,
+			protected: list.New(),
+			lfu:       policy == CacheEvictionLFU,
+		})
+	}
+	return s
+}
+
+// shard returns the shard of the key
+func (s *cacheStore) shard(key []byte) *cacheShard {
+	if s.mask == 0 {
+		return s.shards[0]
+	}
+	// FNV-1a, inlined to avoid allocations
+	h := uint32(2166136261)
+	for _, c := range key {
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	return s.shards[h&s.mask]
+}
+
+// shardLock returns the lock of the shard of the key, it also protects the values of its items
+func (s *cacheStore) shardLock(key []byte) sync.Locker {
+	return &s.shard(key).lock
+}
+
+// Get returns the value of the key (or nil) and marks the item as recently used
+func (s *cacheStore) Get(key []byte) []byte {
+	sh := s.shard(key)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+
+	e, ok := sh.items[string(key)]
+	if !ok {
+		return nil
+	}
+	it := e.Value.(*cacheStoreItem)
+	it.used = atomic.AddUint64(&s.clock, 1)
+	if it.protected {
+		sh.protected.MoveToBack(e)
+	} else if sh.lfu {
+		sh.protect(e)
+	} else {
+		sh.usage.MoveToBack(e)
+	}
+	return it.value
+}
+
+// Set stores the value, the least recently used items are removed if there is not enough space.
+// The items larger than the cache size are not stored.
+func (s *cacheStore) Set(key, value []byte) {
+	sh := s.shard(key)
+	it := &cacheStoreItem{key: string(key), value: value}
+	size := it.size()
+	if size > s.maxSize {
+		return
+	}
+
+	sh.lock.Lock()
+	sh.del(it.key)
+	// a shard above its fair share makes room itself
+	for sh.size+size > sh.share && atomic.LoadInt64(&s.size)+int64(size) > int64(s.maxSize) {
+		if !sh.evict() {
+			break
+		}
+	}
+	it.used = atomic.AddUint64(&s.clock, 1)
+	sh.items[it.key] = sh.usage.PushBack(it)
+	sh.size += size
+	atomic.AddInt64(&s.size, int64(size))
+	sh.lock.Unlock()
+
+	// otherwise the least recently used items of all the shards are removed
+	for atomic.LoadInt64(&s.size) > int64(s.maxSize) {
+		if !s.evictOldest() {
+			break
+		}
+	}
+}
+
+// evictOldest removes the least recently used item of all the shards.
+// Returns false if there are no items.
+func (s *cacheStore) evictOldest() bool {
+	var oldest *cacheShard
+	var used uint64
+	for _, sh := range s.shards {
+		sh.lock.Lock()
+		if e := sh.evictionCandidate(); e != nil && (oldest == nil || e.Value.(*cacheStoreItem).used < used) {
+			oldest, used = sh, e.Value.(*cacheStoreItem).used
+		}
+		sh.lock.Unlock()
+	}
+	if oldest == nil {
+		return false
+	}
+
+	oldest.lock.Lock()
+	defer oldest.lock.Unlock()
+	return oldest.evict()
+}
+
+// Del removes the item
+func (s *cacheStore) Del(key []byte) {
+	sh := s.shard(key)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	sh.del(string(key))
+}
+
+// Expire removes the expired item
+func (s *cacheStore) Expire(key []byte) {
+	sh := s.shard(key)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	if _, ok := sh.items[string(key)]; ok {
+		sh.del(string(key))
+		sh.expirations++
+	}
+}
+
+// Invalidate removes the item that doesn't match the request it is found for
+func (s *cacheStore) Invalidate(key []byte) {
+	sh := s.shard(key)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	if _, ok := sh.items[string(key)]; ok {
+		sh.del(string(key))
+		sh.mismatches++
+	}
+}
+
+// Mismatches returns the number of the items removed by Invalidate
+func (s *cacheStore) Mismatches() (mismatches uint64) {
+	for _, sh := range s.shards {
+		sh.lock.Lock()
+		mismatches += sh.mismatches
+		sh.lock.Unlock()
+	}
+	return mismatches
+}
+
+// Stats returns the number of items, their size and the number of evictions and expirations
+func (s *cacheStore) Stats() (entries, size int, evictions, expirations uint64) {
+	for _, sh := range s.shards {
+		sh.lock.Lock()
+		entries += len(sh.items)
+		size += sh.size
+		evictions += sh.evictions
+		expirations += sh.expirations
+		sh.lock.Unlock()
+	}
+	return entries, size, evictions, expirations
+}
+
+// Clear removes all the items
+func (s *cacheStore) Clear() {
+	for _, sh := range s.shards {
+		sh.lock.Lock()
+		sh.items = map[string]*list.Element{}
+		sh.usage.Init()
+		sh.protected.Init()
+		atomic.AddInt64(&s.size, -int64(sh.size))
+		sh.size = 0
+		sh.protectedSize = 0
+		sh.lock.Unlock()
+	}
+}
+
+// Range calls f for each item from the least to the most recently used until f returns false.
+// f is called for a snapshot of the items, so the locks aren't held while it runs.
+func (s *cacheStore) Range(f func(key, value []byte) bool) {
+	snapshot := []cacheStoreItem{}
+	for _, sh := range s.shards {
+		sh.lock.Lock()
+		for _, l := range []*list.List{sh.usage, sh.protected} {
+			for e := l.Front(); e != nil; e = e.Next() {
+				snapshot = append(snapshot, *e.Value.(*cacheStoreItem))
+			}
+		}
+		sh.lock.Unlock()
+	}
+	sort.Slice(snapshot, func(i, j int) bool {
+		return snapshot[i].used < snapshot[j].used
+	})
+
+	for _, it := range snapshot {
+		if !f([]byte(it.key), it.value) {
+			return
+		}
+	}
+}
+
+// del removes the item (the lock must be held)
+func (sh *cacheShard) del(key string) {
+	if e, ok := sh.items[key]; ok {
+		sh.removeElement(e)
+	}
+}
+
+// evictionCandidate returns the item that is removed first when the cache is full: the protected items
+// are only removed if there are no other items. Returns nil if the shard is empty (the lock must be held).
+func (sh *cacheShard) evictionCandidate() *list.Element {
+	if e := sh.usage.Front(); e != nil {
+		return e
+	}
+	return sh.protected.Front()
+}
+
+// evict removes the evictionCandidate, returns false if the shard is empty (the lock must be held)
+func (sh *cacheShard) evict() bool {
+	e := sh.evictionCandidate()
+	if e == nil {
+		return false
+	}
+	sh.removeElement(e)
+	sh.evictions++
+	return true
+}
+
+// protect moves the item to the protected list, the least recently used protected items are moved back
+// if the protected items take more than protectedCachePercent of the shard's share (the lock must be held)
+func (sh *cacheShard) protect(e *list.Element) {
+	it := sh.usage.Remove(e).(*cacheStoreItem)
+	it.protected = true
+	sh.items[it.key] = sh.protected.PushBack(it)
+	sh.protectedSize += it.size()
+
+	for sh.protectedSize > sh.share*protectedCachePercent/100 {
+		old := sh.protected.Remove(sh.protected.Front()).(*cacheStoreItem)
+		old.protected = false
+		sh.items[old.key] = sh.usage.PushBack(old)
+		sh.protectedSize -= old.size()
+	}
+}
+
+// removeElement removes the item of the list element (the lock must be held)
+func (sh *cacheShard) removeElement(e *list.Element) {
+	var it *cacheStoreItem
+	if e.Value.(*cacheStoreItem).protected {
+		it = sh.protected.Remove(e).(*cacheStoreItem)
+		sh.protectedSize -= it.size()
+	} else {
+		it = sh.usage.Remove(e).(*cacheStoreItem)
+	}
+	delete(sh.items, it.key)
+	sh.size -= it.size()
+	atomic.AddInt64(sh.total, -int64(it.size()))
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheStore(t *testing.T) {
+	// two items of the test size fit
+	s := newCacheStore(2*(1+4+cacheEntryOverhead), CacheEvictionLRU)
+	s.Set([]byte("a"), []byte("1234"))
+	s.Set([]byte("b"), []byte("1234"))
+	assert.Equal(t, []byte("1234"), s.Get([]byte("a")))
+
+	// "b" is the least recently used item
+	s.Set([]byte("c"), []byte("1234"))
+	assert.Nil(t, s.Get([]byte("b")))
+	assert.NotNil(t, s.Get([]byte("a")))
+	assert.NotNil(t, s.Get([]byte("c")))
+
+	// too large
+	s.Set([]byte("d"), make([]byte, 2*cacheEntryOverhead))
+	assert.Nil(t, s.Get([]byte("d")))
+
+	keys := []string{}
+	s.Range(func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+	assert.Equal(t, []string{"a", "c"}, keys)
+
+	s.Del([]byte("a"))
+	assert.Nil(t, s.Get([]byte("a")))
+	s.Clear()
+	assert.Nil(t, s.Get([]byte("c")))
+	entries, size, evictions, _ := s.Stats()
+	assert.Equal(t, 0, entries)
+	assert.Equal(t, 0, size)
+	assert.Equal(t, uint64(1), evictions)
+}
+
+func TestCacheStoreShards(t *testing.T) {
+	assert.Len(t, newCacheStore(defaultCacheSize, CacheEvictionLRU).shards, 4)
+	assert.Len(t, newCacheStore(1024, CacheEvictionLRU).shards, 1)
+	assert.Len(t, newCacheStore(64*1024*1024, CacheEvictionLRU).shards, maxCacheShards)
+
+	s := newCacheStoreShards(64*1024, 4, CacheEvictionLRU)
+	for i := 0; i < 100; i++ {
+		s.Set([]byte(fmt.Sprintf("key%d", i)), make([]byte, 10))
+	}
+	// the least recently used items are at the front even though they are in different shards
+	assert.NotNil(t, s.Get([]byte("key0")))
+	keys := []string{}
+	s.Range(func(key, _ []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+	assert.Len(t, keys, 100)
+	assert.Equal(t, "key1", keys[0])
+	assert.Equal(t, "key0", keys[99])
+
+	// the size limit is shared by the shards
+	s = newCacheStoreShards(4*1024, 4, CacheEvictionLRU)
+	for i := 0; i < 1000; i++ {
+		s.Set([]byte(fmt.Sprintf("key%d", i)), make([]byte, 100))
+	}
+	_, size, _, _ := s.Stats()
+	assert.True(t, size <= 4*1024)
+	assert.Equal(t, int64(size), s.size)
+	assert.NotNil(t, s.Get([]byte("key999")))
+}
+
+func TestCacheStoreLargeItem(t *testing.T) {
+	s := newCacheStore(defaultCacheSize, CacheEvictionLRU)
+	assert.Len(t, s.shards, 4)
+	for i := 0; i < 1000; i++ {
+		s.Set([]byte(fmt.Sprintf("key%d", i)), make([]byte, 100))
+	}
+	_, _, evictions, _ := s.Stats()
+
+	// the item is larger than the fair share of a shard, the items of the other shards are removed
+	s.Set([]byte("large"), make([]byte, 40*1024))
+	assert.Len(t, s.Get([]byte("large")), 40*1024)
+	_, size, largeEvictions, _ := s.Stats()
+	assert.True(t, size <= defaultCacheSize)
+	assert.True(t, largeEvictions > evictions)
+	assert.NotNil(t, s.Get([]byte("key999")))
+
+	// the items larger than the cache are not stored
+	s.Set([]byte("huge"), make([]byte, defaultCacheSize))
+	assert.Nil(t, s.Get([]byte("huge")))
+	assert.NotNil(t, s.Get([]byte("large")))
+}
+
+func TestCacheStoreSize(t *testing.T) {
+	s := newCacheStore(1024, CacheEvictionLRU)
+	s.Set([]byte("key"), make([]byte, 100))
+	_, size, _, _ := s.Stats()
+	assert.Equal(t, 3+100+cacheEntryOverhead, size)
+
+	// replaced
+	s.Set([]byte("key"), make([]byte, 10))
+	_, size, _, _ = s.Stats()
+	assert.Equal(t, 3+10+cacheEntryOverhead, size)
+}
+
+func TestCacheStoreEviction(t *testing.T) {
+	// resolves a lot of one-off names after the popular ones are requested
+	scan := func(policy CacheEvictionPolicy) *cacheStore {
+		s := newCacheStore(10*(6+100+cacheEntryOverhead), policy)
+		for i := 0; i < 5; i++ {
+			key := []byte(fmt.Sprintf("hot%03d", i))
+			s.Set(key, make([]byte, 100))
+			s.Get(key)
+		}
+		for i := 0; i < 100; i++ {
+			s.Set([]byte(fmt.Sprintf("one%03d", i)), make([]byte, 100))
+		}
+		return s
+	}
+
+	s := scan(CacheEvictionLRU)
+	assert.Nil(t, s.Get([]byte("hot000")))
+
+	s = scan(CacheEvictionLFU)
+	for i := 0; i < 5; i++ {
+		assert.NotNil(t, s.Get([]byte(fmt.Sprintf("hot%03d", i))))
+	}
+	assert.NotNil(t, s.Get([]byte("one099")))
+	entries, size, _, _ := s.Stats()
+	assert.Equal(t, 10, entries)
+	assert.True(t, size <= 10*(6+100+cacheEntryOverhead))
+
+	// the protected items are removed too if there are no others
+	s.Set([]byte("big"), make([]byte, 8*(6+100+cacheEntryOverhead)))
+	assert.NotNil(t, s.Get([]byte("big")))
+	assert.NotNil(t, s.Get([]byte("one099")))
+	assert.Nil(t, s.Get([]byte("hot000")))
+
+	keys := 0
+	s.Range(func(_, _ []byte) bool {
+		keys++
+		return true
+	})
+	entries, _, _, _ = s.Stats()
+	assert.Equal(t, entries, keys)
+}
+
+func BenchmarkCacheStoreParallel(b *testing.B) {
+	keys := [][]byte{}
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("\x00\x00\x01\x00\x01host%d.example.org.", i)))
+	}
+	for _, shards := range []int{1, maxCacheShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			s := newCacheStoreShards(64*1024*1024, shards, CacheEvictionLRU)
+			for _, k := range keys {
+				s.Set(k, make([]byte, 100))
+			}
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					s.Get(keys[i%len(keys)])
+					i++
+				}
+			})
+		})
+	}
+}
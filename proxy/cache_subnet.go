@@ -6,23 +6,34 @@ import (
 	"strings"
 	"sync"
 
-	glcache "github.com/AdguardTeam/golibs/cache"
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/miekg/dns"
 )
 
 type cacheSubnet struct {
-	items        glcache.Cache // cache
-	cacheSize    int           // cache size (in bytes)
-	sync.RWMutex               // lock
+	items        *cacheStore // cache
+	cacheSize    int         // cache size (in bytes)
+	maxStale     uint32      // how long the expired responses are kept (in seconds, 0 if optimistic cache is disabled)
+	prefetchHits uint32      // number of hits after which the entry is prefetched (0 if prefetch is disabled)
+
+	maxNegativeTTL uint32            // max TTL of the negative responses (in seconds, 0 means no limit)
+	failureTTL     uint32            // TTL of the failure cache entries (in seconds, 0 if failures aren't cached)
+	uncacheable    map[int]bool      // rcodes of the responses that are only stored in the failure cache (if nil, defaultCacheUncacheableRcodes)
+	ttlCaps        map[uint16]uint32 // max TTLs of the cached responses per query type (see Config.CacheTTLCaps)
+
+	evictionPolicy CacheEvictionPolicy // which entries are removed when the cache is full
+	logger         proxyutil.Logger    // Config.Logger (nil for the default logger)
+
+	sync.RWMutex // lock
 }
 
 // Get key
 // Format:
-// uint8(do)
+// uint8(flags, see keyFlags)
 // uint16(qtype)
 // uint16(qclass)
 // uint8(subnet_mask)
-// client_ip
+// client_ip (masked with subnet_mask)
 // name
 func keyWithSubnet(m *dns.Msg, ip net.IP, mask uint8) []byte {
 	q := m.Question[0]
@@ -35,21 +46,12 @@ func keyWithSubnet(m *dns.Msg, ip net.IP, mask uint8) []byte {
 	b := make([]byte, cap)
 	k := 0
 
-	// put do
-	opt := m.IsEdns0()
-	do := false
-	if opt != nil {
-		do = opt.Do()
-	}
-	if do {
-		b[k] = 1
-	} else {
-		b[k] = 0
-	}
+	// put edns and do flags
+	b[k] = keyFlags(m)
 	k++
 
 	// put qtype
-	binary.BigEndian.PutUint16(b[:], q.Qtype)
+	binary.BigEndian.PutUint16(b[k:], q.Qtype)
 	k += 2
 
 	// put qclass
@@ -60,7 +62,8 @@ func keyWithSubnet(m *dns.Msg, ip net.IP, mask uint8) []byte {
 	b[k] = mask
 	k++
 	if mask != 0 {
-		copy(b[k:], ip)
+		// the address is masked, so all the clients within the scope of the response get the same key
+		copy(b[k:], ip.Mask(net.CIDRMask(int(mask), len(ip)*8)))
 		k += len(ip)
 	}
 
@@ -76,61 +79,98 @@ func keyWithSubnet(m *dns.Msg, ip net.IP, mask uint8) []byte {
 // Note: it's a slow longest-prefix-match algorithm -
 //  we search in cache up to 'mask+1' times, decrementing the value with each iteration.
 func (c *cacheSubnet) GetWithSubnet(request *dns.Msg, ip net.IP, mask uint8) (*dns.Msg, bool) {
+	res, _, _, _ := c.getWithSubnet(request, ip, mask, nil)
+	return res, res != nil
+}
+
+// getWithSubnet is GetWithSubnet that also returns the expired, prefetch and secure flags (see cache.get)
+func (c *cacheSubnet) getWithSubnet(request *dns.Msg, ip net.IP, mask uint8, ednsKey []byte) (res *dns.Msg, expired, prefetch, secure bool) {
 	if request == nil || len(request.Question) != 1 {
-		return nil, false
+		return nil, false, false, false
 	}
 	// create key for request
-	c.Lock()
-	if c.items == nil {
-		c.Unlock()
-		return nil, false
+	items := c.existingStore()
+	if items == nil {
+		return nil, false, false, false
 	}
-	c.Unlock()
 
 	var key, data []byte
+	var dnssec bool
 	for {
-		key = keyWithSubnet(request, ip, mask)
-		data = c.items.Get(key)
+		key, data, dnssec = lookupKeys(items, request, func(m *dns.Msg) []byte {
+			return withEDNSKey(keyWithSubnet(m, ip, mask), ednsKey)
+		})
 		if data != nil {
 			break
 		}
 		if mask == 0 {
-			return nil, false
+			return nil, false, false, false
 		}
 		mask--
 	}
 
-	res := unpackResponse(data, request)
+	res, expired, err := unpackResponse(data, request, c.maxStale)
+	if err != nil {
+		if l := proxyutil.LoggerOrDefault(c.logger); l.DebugEnabled() {
+			l.Debugf("%s: %s", request.Question[0].Name, err)
+		}
+		items.Invalidate(key)
+		return nil, false, false, false
+	}
 	if res == nil {
-		c.items.Del(key)
-		return nil, false
+		items.Expire(key)
+		return nil, false, false, false
 	}
-	return res, true
+	if dnssec {
+		stripDNSSEC(res)
+	}
+	return res, expired, hitCacheItem(data, c.prefetchHits, items.shardLock(key)), cacheDataSecure(data)
 }
 
 // SetWithSubnet - store DNS response
 // ip: IP subnet this response is valid for
 // mask: subnet mask
 func (c *cacheSubnet) SetWithSubnet(m *dns.Msg, ip net.IP, mask uint8) {
-	if m == nil || !isCacheable(m) {
+	c.setWithSubnet(m, ip, mask, false, nil)
+}
+
+// setWithSubnet is SetWithSubnet, secure and ednsKey are the same as in cache.set
+func (c *cacheSubnet) setWithSubnet(m *dns.Msg, ip net.IP, mask uint8, secure bool, ednsKey []byte) {
+	if m == nil {
 		return
 	}
-	key := keyWithSubnet(m, ip, mask)
+	ttl, ok := cacheTTL(m, c.maxNegativeTTL, c.failureTTL, c.uncacheable, proxyutil.LoggerOrDefault(c.logger))
+	if !ok {
+		return
+	}
+	ttl, ok = capTTL(m, ttl, c.ttlCaps)
+	if !ok {
+		return
+	}
+	key := withEDNSKey(keyWithSubnet(m, ip, mask), ednsKey)
+
+	data := packResponse(m, ttl, secure)
+	c.store().Set(key, data)
+	setNXDomain(c.store(), m, withEDNSKey(keyWithSubnet(nxDomainRequest(m), ip, mask), ednsKey), data)
+}
 
+// store returns the items storage, it is created on the first use
+func (c *cacheSubnet) store() *cacheStore {
 	c.Lock()
-	// lazy initialization for cache
+	defer c.Unlock()
 	if c.items == nil {
-		conf := glcache.Config{
-			MaxSize:   defaultCacheSize,
-			EnableLRU: true,
-		}
+		size := defaultCacheSize
 		if c.cacheSize > 0 {
-			conf.MaxSize = uint(c.cacheSize)
+			size = c.cacheSize
 		}
-		c.items = glcache.New(conf)
+		c.items = newCacheStore(size, c.evictionPolicy)
 	}
-	c.Unlock()
+	return c.items
+}
 
-	data := packResponse(m)
-	_ = c.items.Set(key, data)
+// existingStore returns the items storage or nil if it isn't created yet
+func (c *cacheSubnet) existingStore() *cacheStore {
+	c.RLock()
+	defer c.RUnlock()
+	return c.items
 }
@@ -39,6 +39,7 @@ func TestServeCached(t *testing.T) {
 	reply := dns.Msg{}
 	reply.SetQuestion("google.com.", dns.TypeA)
 	reply.Response = true
+	reply.RecursionAvailable = true
 	reply.Answer = []dns.RR{newRR("google.com. 3600 IN A 8.8.8.8")}
 	dnsProxy.cache.Set(&reply)
 
@@ -89,10 +90,10 @@ func TestCacheDO(t *testing.T) {
 	request.RecursionDesired = true
 	request.SetQuestion("google.com.", dns.TypeA)
 
-	// Try requesting without DO
+	// Try requesting without DO, the DO response is used with the DNSSEC records removed
 	r, ok := testCache.Get(&request)
-	assert.Nil(t, r)
-	assert.False(t, ok)
+	assert.NotNil(t, r)
+	assert.True(t, ok)
 
 	// Now add DO and re-test
 	request.SetEdns0(4096, true)
@@ -480,3 +481,58 @@ func TestSubnet(t *testing.T) {
 	a = resp.Answer[0].(*dns.A)
 	assert.True(t, a.A.String() == "3.3.3.3")
 }
+
+func TestCacheQuestionMismatch(t *testing.T) {
+	p := &Proxy{Config: Config{CacheEnabled: true}}
+	p.initCache()
+
+	resp := &dns.Msg{}
+	resp.SetReply(createHostTestMessage("example.org"))
+	resp.Answer = []dns.RR{newRR("example.org. 60 IN A 1.2.3.4")}
+
+	// the response is stored with the key of another name
+	req := createHostTestMessage("example.net")
+	p.cache.store().Set(key(req), packResponse(resp, 60, false))
+	_, ok := p.cache.Get(req)
+	assert.False(t, ok)
+	assert.Equal(t, uint64(1), p.CacheStats().Mismatches)
+	assert.Equal(t, 0, p.CacheStats().Entries)
+
+	// and with the key of another type
+	req = &dns.Msg{}
+	req.SetQuestion("example.org.", dns.TypeAAAA)
+	p.cache.store().Set(key(req), packResponse(resp, 60, false))
+	_, ok = p.cache.Get(req)
+	assert.False(t, ok)
+	assert.Equal(t, uint64(2), p.CacheStats().Mismatches)
+
+	// the ID and the question are copied from the request
+	p.cache.Set(resp)
+	req = createHostTestMessage("ExAmple.ORG")
+	req.Id = 1234
+	res, ok := p.cache.Get(req)
+	assert.True(t, ok)
+	assert.Equal(t, uint16(1234), res.Id)
+	assert.Equal(t, "ExAmple.ORG.", res.Question[0].Name)
+	assert.Equal(t, uint64(2), p.CacheStats().Mismatches)
+}
+
+func TestCacheLargeResponse(t *testing.T) {
+	c := &cache{}
+	req := &dns.Msg{}
+	req.SetQuestion("example.org.", dns.TypeTXT)
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	for i := 0; i < 100; i++ {
+		resp.Answer = append(resp.Answer, newRR(fmt.Sprintf("example.org. 60 IN TXT \"%d %s\"", i, strings.Repeat("a", 250))))
+	}
+	// the response is larger than the fair share of a shard of the default cache
+	assert.True(t, resp.Len() > defaultCacheSize/len(c.store().shards))
+
+	c.Set(resp)
+	res, ok := c.Get(req)
+	assert.True(t, ok)
+	if assert.NotNil(t, res) {
+		assert.Len(t, res.Answer, 100)
+	}
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// clampTTLs applies CacheMinTTL, CacheMaxTTL and CacheMinNegativeTTL to the records of the upstream response,
+// or the CacheTTLOverrides limits if the name matches one of them.
+// The response is modified, so the clamped TTLs are both cached and sent to the clients.
+func (p *Proxy) clampTTLs(m *dns.Msg) {
+	s := p.state()
+	minTTL, maxTTL := s.CacheMinTTL, s.CacheMaxTTL
+	if o, ok := p.cacheTTLOverride(m); ok {
+		minTTL, maxTTL = o.MinTTL, o.MaxTTL
+	}
+	if isNegativeResponse(m) {
+		minTTL = s.CacheMinNegativeTTL
+	}
+	if minTTL == 0 && maxTTL == 0 {
+		return
+	}
+
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range rrs {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if minTTL > 0 && h.Ttl < minTTL {
+				h.Ttl = minTTL
+			}
+			if maxTTL > 0 && h.Ttl > maxTTL {
+				h.Ttl = maxTTL
+			}
+		}
+	}
+
+	// the negative responses TTL also depends on the SOA MINIMUM field (see negativeTTL)
+	if minTTL > 0 && isNegativeResponse(m) {
+		for _, rr := range m.Ns {
+			if soa, ok := rr.(*dns.SOA); ok && soa.Minttl < minTTL {
+				soa.Minttl = minTTL
+			}
+		}
+	}
+}
+
+// isNegativeResponse checks if the response is NXDOMAIN or NODATA
+func isNegativeResponse(m *dns.Msg) bool {
+	return m.Rcode == dns.RcodeNameError || (m.Rcode == dns.RcodeSuccess && len(m.Answer) == 0)
+}
+
+// capTTL applies the TTL cap of the query type to the TTL the response is cached for.
+// Returns false if the cap is 0, i.e. the responses of this type aren't cached.
+func capTTL(m *dns.Msg, ttl uint32, caps map[uint16]uint32) (uint32, bool) {
+	limit, ok := caps[m.Question[0].Qtype]
+	if !ok || ttl <= limit {
+		return ttl, true
+	}
+	return limit, limit > 0
+}
+
+// parseTTLCaps parses the keys of CacheTTLCaps: the type mnemonics (e.g. "HTTPS") or numbers (e.g. "65" or "TYPE65")
+func parseTTLCaps(caps map[string]uint32) (map[uint16]uint32, error) {
+	if len(caps) == 0 {
+		return nil, nil
+	}
+	res := map[uint16]uint32{}
+	for s, ttl := range caps {
+		qtype, ok := parseQtype(s)
+		if !ok {
+			return nil, fmt.Errorf("invalid cache TTL cap type: %s", s)
+		}
+		res[qtype] = ttl
+	}
+	return res, nil
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/utils"
+	"github.com/miekg/dns"
+)
+
+// CacheTTLOverride is the TTL limits of the responses for the domain (see Config.CacheTTLOverrides)
+type CacheTTLOverride struct {
+	// Domain is "example.org" for the domain and its subdomains, "*.example.org" for the subdomains only,
+	// or the empty string for the unqualified names
+	Domain string
+
+	// MinTTL and MaxTTL are used instead of CacheMinTTL and CacheMaxTTL (in seconds, 0 means no limit).
+	// CacheMinNegativeTTL still applies to the negative responses.
+	MinTTL uint32
+	MaxTTL uint32
+}
+
+// initTTLOverrides parses Config.CacheTTLOverrides
+func (p *Proxy) initTTLOverrides() {
+	overrides, err := parseTTLOverrides(p.CacheTTLOverrides)
+	if err != nil {
+		// the config is validated before, so this never happens
+		p.logger().Errorf("invalid cache TTL overrides: %s", err)
+	}
+	p.ttlOverrides = overrides
+}
+
+// parseTTLOverrides returns the overrides by the keys they are matched by:
+// the domain names in the DomainsReservedUpstreams form, with the "*." prefix kept for the wildcards
+func parseTTLOverrides(overrides []CacheTTLOverride) (map[string]CacheTTLOverride, error) {
+	if len(overrides) == 0 {
+		return nil, nil
+	}
+	res := map[string]CacheTTLOverride{}
+	for _, o := range overrides {
+		key := UnqualifiedNames
+		if o.Domain != "" {
+			host := strings.TrimPrefix(o.Domain, "*.")
+			if err := utils.IsValidHostname(host); err != nil {
+				return nil, fmt.Errorf("invalid cache TTL override domain %s: %s", o.Domain, err)
+			}
+			key = strings.ToLower(o.Domain + ".")
+		}
+		if o.MaxTTL > 0 && o.MinTTL > o.MaxTTL {
+			return nil, fmt.Errorf("cache TTL override %s: min TTL %d is larger than max TTL %d", o.Domain, o.MinTTL, o.MaxTTL)
+		}
+		if _, ok := res[key]; ok {
+			return nil, fmt.Errorf("duplicate cache TTL override: %s", o.Domain)
+		}
+		res[key] = o
+	}
+	return res, nil
+}
+
+// cacheTTLOverride returns the override for the question name of m, the most specific match wins.
+// "*.example.org" is more specific than "example.org" for the subdomains of example.org.
+func (p *Proxy) cacheTTLOverride(m *dns.Msg) (CacheTTLOverride, bool) {
+	s := p.state()
+	if len(s.ttlOverrides) == 0 || len(m.Question) == 0 {
+		return CacheTTLOverride{}, false
+	}
+
+	names := domainNames(m.Question[0].Name)
+	for i, name := range names {
+		if i > 0 {
+			if o, ok := s.ttlOverrides["*."+name]; ok {
+				return o, true
+			}
+		}
+		if o, ok := s.ttlOverrides[name]; ok {
+			return o, true
+		}
+	}
+	return CacheTTLOverride{}, false
+}
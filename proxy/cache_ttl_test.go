@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClampTTLs(t *testing.T) {
+	p := &Proxy{Config: Config{CacheMinTTL: 60, CacheMaxTTL: 3600, CacheMinNegativeTTL: 30}}
+
+	m := &dns.Msg{}
+	m.Answer = []dns.RR{
+		newRR("example.org. 5 IN A 1.2.3.4"),
+		newRR("example.org. 604800 IN A 1.2.3.5"),
+		newRR("example.org. 600 IN A 1.2.3.6"),
+	}
+	m.SetEdns0(4096, false)
+	p.clampTTLs(m)
+	assert.Equal(t, uint32(60), m.Answer[0].Header().Ttl)
+	assert.Equal(t, uint32(3600), m.Answer[1].Header().Ttl)
+	assert.Equal(t, uint32(600), m.Answer[2].Header().Ttl)
+	// OPT TTL field contains the flags
+	assert.Equal(t, uint32(0), m.Extra[0].Header().Ttl)
+
+	m = &dns.Msg{}
+	m.Rcode = dns.RcodeNameError
+	m.Ns = []dns.RR{newRR("example.org. 5 IN SOA ns.example.org. hostmaster.example.org. 1 3600 600 86400 5")}
+	p.clampTTLs(m)
+	assert.Equal(t, uint32(30), m.Ns[0].Header().Ttl)
+
+	// no limits
+	p = &Proxy{}
+	m = &dns.Msg{Answer: []dns.RR{newRR("example.org. 5 IN A 1.2.3.4")}}
+	p.clampTTLs(m)
+	assert.Equal(t, uint32(5), m.Answer[0].Header().Ttl)
+
+	assert.Error(t, (&Config{
+		UDPListenAddr: []*net.UDPAddr{{}},
+		Upstreams:     []upstream.Upstream{&funcUpstream{}},
+		CacheMinTTL:   60,
+		CacheMaxTTL:   30,
+	}).validate())
+}
+
+func TestCacheMinTTL(t *testing.T) {
+	var count int32
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.CacheMinTTL = 60
+	dnsProxy.Upstreams = []upstream.Upstream{&funcUpstream{
+		exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+			atomic.AddInt32(&count, 1)
+			resp := &dns.Msg{}
+			resp.SetReply(m)
+			// zero TTL responses aren't cached without the limit
+			resp.Answer = []dns.RR{newRR(m.Question[0].Name + " 0 IN A 1.2.3.4")}
+			return resp, nil
+		},
+	}}
+	require.NoError(t, dnsProxy.Start())
+	defer dnsProxy.Stop()
+
+	for i := 0; i < 2; i++ {
+		d := &DNSContext{Req: createHostTestMessage("example.org")}
+		require.NoError(t, dnsProxy.Resolve(d))
+		require.Len(t, d.Res.Answer, 1)
+		assert.True(t, d.Res.Answer[0].Header().Ttl > 50)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&count))
+}
+
+func TestCacheTTLCaps(t *testing.T) {
+	config := &Config{
+		UDPListenAddr: []*net.UDPAddr{{}},
+		Upstreams:     []upstream.Upstream{&funcUpstream{}},
+		CacheTTLCaps:  map[string]uint32{"txt": 300, "TYPE65": 60, "33": 0},
+	}
+	require.NoError(t, config.validate())
+	config.CacheTTLCaps["INVALID"] = 60
+	assert.Error(t, config.validate())
+
+	caps, err := parseTTLCaps(map[string]uint32{"txt": 300, "TYPE65": 60, "33": 0})
+	require.NoError(t, err)
+	assert.Equal(t, map[uint16]uint32{dns.TypeTXT: 300, 65: 60, dns.TypeSRV: 0}, caps)
+
+	c := &cache{ttlCaps: caps}
+	reply := func(qtype uint16, rr string) *dns.Msg {
+		req := &dns.Msg{}
+		req.SetQuestion("example.org.", qtype)
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{newRR(rr)}
+		return resp
+	}
+
+	c.Set(reply(dns.TypeTXT, `example.org. 3600 IN TXT "v=spf1 -all"`))
+	res, ok := c.Get(reply(dns.TypeTXT, `example.org. 3600 IN TXT "v=spf1 -all"`))
+	require.True(t, ok)
+	assert.True(t, res.Answer[0].Header().Ttl <= 300)
+
+	// the TTLs lower than the cap aren't changed
+	c.Set(reply(dns.TypeTXT, `example.org. 100 IN TXT "v=spf1 -all"`))
+	res, ok = c.Get(reply(dns.TypeTXT, `example.org. 100 IN TXT "v=spf1 -all"`))
+	require.True(t, ok)
+	assert.True(t, res.Answer[0].Header().Ttl <= 100)
+	assert.True(t, res.Answer[0].Header().Ttl > 90)
+
+	// the 0 cap disables caching of the type
+	c.Set(reply(dns.TypeSRV, "example.org. 3600 IN SRV 0 0 443 srv.example.org."))
+	_, ok = c.Get(reply(dns.TypeSRV, "example.org. 3600 IN SRV 0 0 443 srv.example.org."))
+	assert.False(t, ok)
+
+	// the other types aren't capped
+	c.Set(reply(dns.TypeA, "example.org. 3600 IN A 1.2.3.4"))
+	res, ok = c.Get(reply(dns.TypeA, "example.org. 3600 IN A 1.2.3.4"))
+	require.True(t, ok)
+	assert.True(t, res.Answer[0].Header().Ttl > 3000)
+}
+
+func TestCacheTTLOverrides(t *testing.T) {
+	p := &Proxy{Config: Config{
+		CacheMinTTL: 60,
+		CacheMaxTTL: 3600,
+		CacheTTLOverrides: []CacheTTLOverride{
+			{Domain: "example.org", MinTTL: 300},
+			{Domain: "*.example.org", MaxTTL: 30},
+			{Domain: "static.cdn.example.org", MinTTL: 600, MaxTTL: 86400},
+			{Domain: "", MinTTL: 10, MaxTTL: 10},
+		},
+	}}
+	p.initTTLOverrides()
+
+	clamp := func(name string, ttl uint32) uint32 {
+		req := &dns.Msg{}
+		req.SetQuestion(dns.Fqdn(name), dns.TypeA)
+		m := &dns.Msg{}
+		m.SetReply(req)
+		m.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}, A: net.IP{1, 2, 3, 4}}}
+		p.clampTTLs(m)
+		return m.Answer[0].Header().Ttl
+	}
+
+	// the global limits
+	assert.Equal(t, uint32(60), clamp("example.net", 5))
+	assert.Equal(t, uint32(3600), clamp("example.net", 604800))
+
+	// the override has no max TTL
+	assert.Equal(t, uint32(300), clamp("example.org", 5))
+	assert.Equal(t, uint32(604800), clamp("EXAMPLE.ORG", 604800))
+
+	// the wildcard doesn't match the domain itself and is more specific than its parent
+	assert.Equal(t, uint32(30), clamp("www.example.org", 3600))
+	assert.Equal(t, uint32(5), clamp("cdn.example.org", 5))
+
+	// the most specific override wins
+	assert.Equal(t, uint32(600), clamp("static.cdn.example.org", 5))
+	assert.Equal(t, uint32(600), clamp("img.static.cdn.example.org", 5))
+	assert.Equal(t, uint32(86400), clamp("img.static.cdn.example.org", 604800))
+
+	assert.Equal(t, uint32(10), clamp("host", 3600))
+
+	config := &Config{
+		UDPListenAddr:     []*net.UDPAddr{{}},
+		Upstreams:         []upstream.Upstream{&funcUpstream{}},
+		CacheTTLOverrides: p.CacheTTLOverrides,
+	}
+	require.NoError(t, config.validate())
+	for _, o := range []CacheTTLOverride{
+		{Domain: "example..org"},
+		{Domain: "example.net", MinTTL: 60, MaxTTL: 30},
+		{Domain: "Example.org"},
+	} {
+		config.CacheTTLOverrides = append(p.CacheTTLOverrides[:4:4], o)
+		assert.Error(t, config.validate(), o.Domain)
+	}
+}
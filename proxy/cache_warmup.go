@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/miekg/dns"
+)
+
+const (
+	// cacheWarmupWorkers is the number of the names resolved in parallel during the cache warm-up
+	cacheWarmupWorkers = 8
+
+	// defaultCacheWarmupTimeout is the default time limit of the cache warm-up
+	defaultCacheWarmupTimeout = 30 * time.Second
+)
+
+// warmupCache resolves the names from CacheWarmupFile and stores the responses in the global cache.
+// The names that aren't resolved before CacheWarmupTimeout or Stop are skipped.
+func (p *Proxy) warmupCache() {
+	s := p.state()
+	f, err := os.Open(s.CacheWarmupFile)
+	if err != nil {
+		p.logger().Errorf("Failed to read the cache warm-up list: %s", err)
+		return
+	}
+	questions := parseCacheWarmup(f, p.logger())
+	_ = f.Close()
+
+	timeout := s.CacheWarmupTimeout
+	if timeout <= 0 {
+		timeout = defaultCacheWarmupTimeout
+	}
+	start := time.Now()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	queue := make(chan dns.Question)
+	var resolved int
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < cacheWarmupWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for q := range queue {
+				if p.warmupQuestion(q) {
+					lock.Lock()
+					resolved++
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+
+	sent := 0
+send:
+	for _, q := range questions {
+		p.RLock()
+		started := p.started
+		p.RUnlock()
+		if !started {
+			break
+		}
+
+		select {
+		case queue <- q:
+			sent++
+		case <-deadline.C:
+			p.logger().Infof("Cache warm-up time limit is reached, %d names are skipped", len(questions)-sent)
+			break send
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	p.logger().Infof("Cache warm-up: resolved %d of %d names in %s", resolved, len(questions), time.Since(start))
+}
+
+// warmupQuestion resolves the question and stores the response in the global cache.
+// The names answered locally (static entries and mDNS) are skipped.
+// Returns false if the name isn't resolved.
+func (p *Proxy) warmupQuestion(q dns.Question) bool {
+	req := &dns.Msg{}
+	req.SetQuestion(q.Name, q.Qtype)
+	// the DO responses are served to all the clients (see lookupKeys)
+	req.SetEdns0(4096, true)
+	d := &DNSContext{Proto: ProtoUDP, Req: req, StartTime: time.Now()}
+
+	if p.isMDNSName(q.Name) || p.resolveStatic(d) {
+		return false
+	}
+
+	reply, _, err := p.resolveUpstream(d)
+	if err != nil || reply == nil {
+		if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("Cache warm-up: couldn't resolve %s: %v", q.Name, err)
+		}
+		return false
+	}
+	p.setInCache(d, reply)
+	return true
+}
+
+// parseCacheWarmup parses the cache warm-up list: a name per line, optionally followed by the record type
+// (a mnemonic or a number). A and AAAA are resolved for the names without the type.
+// The empty lines and the lines starting with # are ignored, the invalid lines are logged and skipped.
+func parseCacheWarmup(r io.Reader, l proxyutil.Logger) []dns.Question {
+	questions := []dns.Question{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		name := dns.Fqdn(strings.ToLower(fields[0]))
+		if _, ok := dns.IsDomainName(name); !ok || len(fields) > 2 {
+			l.Infof("Cache warm-up list: invalid line %d: %s", n, scanner.Text())
+			continue
+		}
+		if len(fields) == 1 {
+			questions = append(questions,
+				dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET},
+				dns.Question{Name: name, Qtype: dns.TypeAAAA, Qclass: dns.ClassINET})
+			continue
+		}
+
+		qtype, ok := parseQtype(fields[1])
+		if !ok {
+			l.Infof("Cache warm-up list: invalid type at line %d: %s", n, fields[1])
+			continue
+		}
+		questions = append(questions, dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET})
+	}
+	if err := scanner.Err(); err != nil {
+		l.Errorf("Failed to read the cache warm-up list: %s", err)
+	}
+	return questions
+}
+
+// parseQtype parses the record type mnemonic (e.g. "AAAA") or number (e.g. "65" or "TYPE65")
+func parseQtype(s string) (uint16, bool) {
+	s = strings.ToUpper(s)
+	if t, ok := dns.StringToType[s]; ok {
+		return t, true
+	}
+	t, err := strconv.ParseUint(strings.TrimPrefix(s, "TYPE"), 10, 16)
+	if err != nil || t == 0 {
+		return 0, false
+	}
+	return uint16(t), true
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCacheWarmup(t *testing.T) {
+	list := `
+# popular names
+example.org
+Example.NET. aaaa
+example.com srv
+example.com TYPE65
+example.com 65
+invalid..name
+example.com INVALID
+example.com A extra
+`
+	questions := parseCacheWarmup(strings.NewReader(list), proxyutil.DefaultLogger())
+	assert.Equal(t, []dns.Question{
+		{Name: "example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+		{Name: "example.org.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
+		{Name: "example.net.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
+		{Name: "example.com.", Qtype: dns.TypeSRV, Qclass: dns.ClassINET},
+		{Name: "example.com.", Qtype: 65, Qclass: dns.ClassINET},
+		{Name: "example.com.", Qtype: 65, Qclass: dns.ClassINET},
+	}, questions)
+}
+
+func TestCacheWarmup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy-warmup")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "warmup.txt")
+	list := "example.org A\nfail.example.org A\nstatic.example.org A\nprinter.local A\n"
+	require.NoError(t, ioutil.WriteFile(path, []byte(list), 0o644))
+
+	var lock sync.Mutex
+	requested := []string{}
+	u := &funcUpstream{exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+		lock.Lock()
+		requested = append(requested, m.Question[0].Name)
+		lock.Unlock()
+		if m.Question[0].Name == "fail.example.org." {
+			return nil, errors.New("timeout")
+		}
+		resp := &dns.Msg{}
+		resp.SetReply(m)
+		resp.Answer = []dns.RR{newRR(m.Question[0].Name + " 60 IN A 1.2.3.4")}
+		return resp, nil
+	}}
+
+	p := createTestProxy(t, nil)
+	p.Upstreams = []upstream.Upstream{u}
+	p.CacheEnabled = true
+	p.CacheWarmupFile = path
+	p.MDNSEnabled = true
+	p.StaticEntries = map[string][]net.IP{"static.example.org": {net.IP{1, 1, 1, 1}}}
+	require.NoError(t, p.Start())
+	defer p.Stop()
+
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(requested) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	// the warmed up response is served to the clients without EDNS
+	res, ok := p.cache.Get(createHostTestMessage("example.org"))
+	require.True(t, ok)
+	assert.Len(t, res.Answer, 1)
+
+	_, ok = p.cache.Get(createHostTestMessage("fail.example.org"))
+	assert.False(t, ok)
+
+	lock.Lock()
+	assert.ElementsMatch(t, []string{"example.org.", "fail.example.org."}, requested)
+	lock.Unlock()
+}
+
+func TestCacheWarmupTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy-warmup")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "warmup.txt")
+	names := []string{}
+	for i := 0; i < 100; i++ {
+		names = append(names, strings.Repeat("a", i+1)+".example.org A")
+	}
+	require.NoError(t, ioutil.WriteFile(path, []byte(strings.Join(names, "\n")), 0o644))
+
+	var lock sync.Mutex
+	count := 0
+	u := &funcUpstream{exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+		lock.Lock()
+		count++
+		lock.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		resp := &dns.Msg{}
+		resp.SetReply(m)
+		return resp, nil
+	}}
+
+	p := &Proxy{Config: Config{
+		Upstreams:          []upstream.Upstream{u},
+		CacheEnabled:       true,
+		CacheWarmupFile:    path,
+		CacheWarmupTimeout: 100 * time.Millisecond,
+	}}
+	p.Init()
+	p.started = true
+
+	start := time.Now()
+	p.warmupCache()
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	lock.Lock()
+	assert.Less(t, count, len(names))
+	lock.Unlock()
+}
+
+func TestCacheWarmupSkipped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy-warmup")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "warmup.txt")
+	require.NoError(t, ioutil.WriteFile(path, []byte("example.org A\n"), 0o644))
+	cachePath := filepath.Join(dir, "cache.bin")
+
+	// the cache file with a fresh entry
+	p := &Proxy{Config: Config{CacheEnabled: true, CachePersistPath: cachePath}}
+	p.initCache()
+	resp := &dns.Msg{}
+	resp.SetReply(createHostTestMessage("example.net"))
+	resp.Answer = []dns.RR{newRR("example.net. 60 IN A 1.2.3.4")}
+	p.cache.Set(resp)
+	p.saveCache()
+
+	var lock sync.Mutex
+	count := 0
+	u := &funcUpstream{exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+		lock.Lock()
+		count++
+		lock.Unlock()
+		return nil, errors.New("unexpected request")
+	}}
+
+	p = createTestProxy(t, nil)
+	p.Upstreams = []upstream.Upstream{u}
+	p.CacheEnabled = true
+	p.CachePersistPath = cachePath
+	p.CacheWarmupFile = path
+	require.NoError(t, p.Start())
+	defer p.Stop()
+
+	time.Sleep(200 * time.Millisecond)
+	lock.Lock()
+	assert.Equal(t, 0, count)
+	lock.Unlock()
+}
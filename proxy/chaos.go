@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// checkChaosRequest answers the CHAOS class queries that are used to fingerprint the server:
+// version.bind and version.server are answered with ServerVersion,
+// hostname.bind and id.server are answered with ServerHostname.
+// If the corresponding string isn't configured, the query is refused.
+// These queries are never forwarded to the upstreams and never cached.
+// Returns nil if this isn't such query.
+func (p *Proxy) checkChaosRequest(d *DNSContext) *dns.Msg {
+	s := p.requestState(d)
+	if len(d.Req.Question) == 0 {
+		return nil
+	}
+	q := d.Req.Question[0]
+	if !isChaosServerQuery(q) {
+		return nil
+	}
+
+	value := s.ServerHostname
+	switch strings.ToLower(q.Name) {
+	case "version.bind.", "version.server.":
+		value = s.ServerVersion
+	}
+
+	if value == "" || q.Qtype != dns.TypeTXT {
+		if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("Refusing CHAOS %s %s request", dns.TypeToString[q.Qtype], q.Name)
+		}
+		return p.statusResponse(d, StatusBlocked)
+	}
+
+	resp := &dns.Msg{}
+	resp.SetReply(d.Req)
+	resp.Authoritative = true
+	resp.RecursionAvailable = true
+	resp.Answer = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0},
+		Txt: []string{value},
+	}}
+	return resp
+}
+
+// isChaosServerQuery checks if the question is one of the CHAOS queries answered by checkChaosRequest
+func isChaosServerQuery(q dns.Question) bool {
+	if q.Qclass != dns.ClassCHAOS {
+		return false
+	}
+	switch strings.ToLower(q.Name) {
+	case "version.bind.", "version.server.", "hostname.bind.", "id.server.":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func exchangeChaos(t *testing.T, client *dns.Client, addr, name string) *dns.Msg {
+	req := &dns.Msg{}
+	req.SetQuestion(name, dns.TypeTXT)
+	req.Question[0].Qclass = dns.ClassCHAOS
+	r, _, err := client.Exchange(req, addr)
+	require.NoError(t, err)
+	return r
+}
+
+func TestChaosRequests(t *testing.T) {
+	var upstreamCount int32
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.ServerVersion = "dnsproxy test"
+	dnsProxy.Upstreams = []upstream.Upstream{createCountingUpstream(&upstreamCount)}
+	err := dnsProxy.Start()
+	require.NoError(t, err)
+	defer dnsProxy.Stop()
+
+	addr := dnsProxy.Addr(ProtoUDP).String()
+	client := &dns.Client{Net: "udp", Timeout: 500 * time.Millisecond}
+
+	for _, name := range []string{"version.bind.", "VERSION.SERVER."} {
+		r := exchangeChaos(t, client, addr, name)
+		assert.Equal(t, dns.RcodeSuccess, r.Rcode)
+		require.Len(t, r.Answer, 1)
+		txt, ok := r.Answer[0].(*dns.TXT)
+		require.True(t, ok)
+		assert.Equal(t, []string{"dnsproxy test"}, txt.Txt)
+		assert.Equal(t, uint16(dns.ClassCHAOS), txt.Hdr.Class)
+	}
+
+	// hostname isn't configured
+	for _, name := range []string{"hostname.bind.", "id.server."} {
+		r := exchangeChaos(t, client, addr, name)
+		assert.Equal(t, dns.RcodeRefused, r.Rcode)
+	}
+
+	// other CHAOS names aren't handled locally
+	assert.Nil(t, dnsProxy.checkChaosRequest(&DNSContext{Req: &dns.Msg{Question: []dns.Question{
+		{Name: "example.org.", Qtype: dns.TypeTXT, Qclass: dns.ClassCHAOS},
+	}}}))
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&upstreamCount))
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+)
+
+// ClientSettings contains the settings used for the requests from the specified clients
+// instead of the global ones
+type ClientSettings struct {
+	Subnets []string // IP addresses and CIDRs of the clients, e.g. "192.168.1.10" or "10.0.0.0/8"
+
+	// UpstreamConfig is used instead of Upstreams and DomainsReservedUpstreams.
+	// If nil, the global upstreams are used.
+	UpstreamConfig *UpstreamConfig
+
+	CacheEnabled           *bool // overrides Config.CacheEnabled (if nil, the global setting is used)
+	EnableEDNSClientSubnet *bool // overrides Config.EnableEDNSClientSubnet (if nil, the global setting is used)
+}
+
+// clientGroup is the parsed ClientSettings entry.
+// Every group has its own cache instances, so the responses received for the clients of one group
+// (e.g. from a filtering upstream) are never served to the clients of another group.
+type clientGroup struct {
+	settings    *ClientSettings
+	nets        []*net.IPNet
+	ecs         bool         // ECS status for this group
+	cache       *cache       // cache instance (nil if cache is disabled for this group)
+	cacheSubnet *cacheSubnet // subnet cache instance (nil if cache or ECS is disabled for this group)
+}
+
+// initClients parses ClientsSettings and creates the cache instances of the client groups
+func (p *Proxy) initClients() {
+	p.clients = nil
+	for _, s := range p.ClientsSettings {
+		nets, err := parseSubnets(s.Subnets)
+		if err != nil {
+			// the config is validated before, so this never happens
+			p.logger().Errorf("invalid client settings: %s", err)
+			continue
+		}
+
+		g := &clientGroup{
+			settings: s,
+			nets:     nets,
+			ecs:      p.ecsDefault(),
+		}
+		if s.EnableEDNSClientSubnet != nil {
+			g.ecs = *s.EnableEDNSClientSubnet
+		}
+
+		cacheEnabled := p.CacheEnabled
+		if s.CacheEnabled != nil {
+			cacheEnabled = *s.CacheEnabled
+		}
+		if cacheEnabled {
+			g.cache, g.cacheSubnet = p.newCaches(g.ecs)
+		}
+
+		p.clients = append(p.clients, g)
+	}
+
+	if len(p.clients) > 0 {
+		p.logger().Infof("Using the custom settings for %d client groups", len(p.clients))
+	}
+}
+
+// findClient returns the client group with the longest prefix that contains the address,
+// or nil if there is no such group
+func (p *Proxy) findClient(addr net.Addr) *clientGroup {
+	s := p.state()
+	if len(s.clients) == 0 {
+		return nil
+	}
+	ip := getIP(addr)
+	if ip == nil {
+		return nil
+	}
+
+	var res *clientGroup
+	longest := -1
+	for _, g := range s.clients {
+		for _, n := range g.nets {
+			ones, _ := n.Mask.Size()
+			if ones > longest && n.Contains(ip) {
+				res = g
+				longest = ones
+			}
+		}
+	}
+	return res
+}
+
+// clientUpstreams returns the upstreams for the request according to the client's settings
+func (p *Proxy) clientUpstreams(d *DNSContext) []upstream.Upstream {
+	host := d.Req.Question[0].Name
+	if d.client != nil && d.client.settings.UpstreamConfig != nil {
+		conf := d.client.settings.UpstreamConfig
+		return upstreamsForDomain(host, conf.Upstreams, conf.DomainReservedUpstreams)
+	}
+	return p.getUpstreamsForDomain(host)
+}
+
+// ecsEnabled checks if EDNS Client Subnet is enabled for the request
+func (p *Proxy) ecsEnabled(d *DNSContext) bool {
+	if d.client != nil {
+		return d.client.ecs
+	}
+	return p.requestState(d).ecsDefault()
+}
+
+// clientCaches returns the cache instances for the request
+func (p *Proxy) clientCaches(d *DNSContext) (*cache, *cacheSubnet) {
+	s := p.requestState(d)
+	if d.client != nil {
+		return d.client.cache, d.client.cacheSubnet
+	}
+	return s.cache, s.cacheSubnet
+}
+
+// parseSubnets parses the list of IP addresses and CIDRs
+func parseSubnets(subnets []string) ([]*net.IPNet, error) {
+	if len(subnets) == 0 {
+		return nil, errors.New("no client subnets specified")
+	}
+
+	res := []*net.IPNet{}
+	for _, s := range subnets {
+		if strings.Contains(s, "/") {
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid client subnet: %s", s)
+			}
+			res = append(res, n)
+			continue
+		}
+
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid client address: %s", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			res = append(res, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)})
+		} else {
+			res = append(res, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+		}
+	}
+	return res, nil
+}
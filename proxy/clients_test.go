@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createAUpstream creates an upstream that answers every query with the specified IP address
+func createAUpstream(ip string, count *int32) upstream.Upstream {
+	return &funcUpstream{
+		exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+			atomic.AddInt32(count, 1)
+			resp := &dns.Msg{}
+			resp.SetReply(m)
+			resp.Answer = []dns.RR{newRR(m.Question[0].Name + " 60 IN A " + ip)}
+			return resp, nil
+		},
+	}
+}
+
+func TestParseSubnets(t *testing.T) {
+	nets, err := parseSubnets([]string{"192.168.1.10", "10.0.0.0/8", "::1"})
+	require.NoError(t, err)
+	require.Len(t, nets, 3)
+	assert.Equal(t, "192.168.1.10/32", nets[0].String())
+	assert.Equal(t, "10.0.0.0/8", nets[1].String())
+	assert.Equal(t, "::1/128", nets[2].String())
+
+	_, err = parseSubnets([]string{"10.0.0.0/33"})
+	assert.NotNil(t, err)
+	_, err = parseSubnets([]string{"example.org"})
+	assert.NotNil(t, err)
+	_, err = parseSubnets(nil)
+	assert.NotNil(t, err)
+}
+
+func TestFindClient(t *testing.T) {
+	lan := &ClientSettings{Subnets: []string{"192.168.0.0/16"}}
+	kid := &ClientSettings{Subnets: []string{"192.168.1.10", "192.168.2.0/24"}}
+	p := &Proxy{Config: Config{ClientsSettings: []*ClientSettings{kid, lan}}}
+	p.initClients()
+
+	find := func(ip string) *ClientSettings {
+		g := p.findClient(&net.UDPAddr{IP: net.ParseIP(ip), Port: 53})
+		if g == nil {
+			return nil
+		}
+		return g.settings
+	}
+	assert.Equal(t, kid, find("192.168.1.10"))
+	assert.Equal(t, kid, find("192.168.2.1"))
+	assert.Equal(t, lan, find("192.168.1.11"))
+	assert.Nil(t, find("10.0.0.1"))
+	assert.Nil(t, p.findClient(nil))
+}
+
+func TestClientsSettings(t *testing.T) {
+	var globalCount, filteredCount int32
+	disabled := false
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.Upstreams = []upstream.Upstream{createAUpstream("1.2.3.4", &globalCount)}
+	dnsProxy.ClientsSettings = []*ClientSettings{{
+		Subnets: []string{"192.168.1.0/24"},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{createAUpstream("0.0.0.0", &filteredCount)},
+		},
+	}, {
+		Subnets:      []string{"192.168.2.0/24"},
+		CacheEnabled: &disabled,
+	}}
+	err := dnsProxy.Start()
+	require.NoError(t, err)
+	defer dnsProxy.Stop()
+
+	resolve := func(ip string) string {
+		d := &DNSContext{
+			Req:  createHostTestMessage("example.org"),
+			Addr: &net.UDPAddr{IP: net.ParseIP(ip), Port: 53},
+		}
+		err := dnsProxy.Resolve(d)
+		require.NoError(t, err)
+		require.Len(t, d.Res.Answer, 1)
+		return d.Res.Answer[0].(*dns.A).A.String()
+	}
+
+	// the filtered answer is cached for the group only
+	assert.Equal(t, "0.0.0.0", resolve("192.168.1.2"))
+	assert.Equal(t, "0.0.0.0", resolve("192.168.1.3"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&filteredCount))
+
+	assert.Equal(t, "1.2.3.4", resolve("10.0.0.1"))
+	assert.Equal(t, "1.2.3.4", resolve("10.0.0.2"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&globalCount))
+
+	// the cache is disabled for the second group
+	assert.Equal(t, "1.2.3.4", resolve("192.168.2.2"))
+	assert.Equal(t, "1.2.3.4", resolve("192.168.2.2"))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&globalCount))
+}
@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/utils"
+	"github.com/miekg/dns"
+)
+
+// safeSearchCNAMEs are the CNAME overrides that enforce the safe search of the search engines and YouTube
+var safeSearchCNAMEs = map[string]string{
+	"www.google.com":           "forcesafesearch.google.com",
+	"www.google.co.uk":         "forcesafesearch.google.com",
+	"www.google.de":            "forcesafesearch.google.com",
+	"www.google.fr":            "forcesafesearch.google.com",
+	"www.google.es":            "forcesafesearch.google.com",
+	"www.google.it":            "forcesafesearch.google.com",
+	"www.google.nl":            "forcesafesearch.google.com",
+	"www.google.pl":            "forcesafesearch.google.com",
+	"www.google.ru":            "forcesafesearch.google.com",
+	"www.google.ca":            "forcesafesearch.google.com",
+	"www.google.com.au":        "forcesafesearch.google.com",
+	"www.google.com.br":        "forcesafesearch.google.com",
+	"www.google.co.in":         "forcesafesearch.google.com",
+	"www.google.co.jp":         "forcesafesearch.google.com",
+	"www.bing.com":             "strict.bing.com",
+	"duckduckgo.com":           "safe.duckduckgo.com",
+	"www.duckduckgo.com":       "safe.duckduckgo.com",
+	"www.youtube.com":          "restrict.youtube.com",
+	"m.youtube.com":            "restrict.youtube.com",
+	"youtubei.googleapis.com":  "restrict.youtube.com",
+	"youtube.googleapis.com":   "restrict.youtube.com",
+	"www.youtube-nocookie.com": "restrict.youtube.com",
+}
+
+// SafeSearchCNAMEs returns the CNAME overrides of Config.SafeSearch,
+// e.g. www.google.com is replaced with forcesafesearch.google.com
+func SafeSearchCNAMEs() map[string]string {
+	res := make(map[string]string, len(safeSearchCNAMEs))
+	for name, target := range safeSearchCNAMEs {
+		res[name] = target
+	}
+	return res
+}
+
+// initCNAMEOverrides loads the CNAME overrides and, with SafeSearch, the safe search ones from the config
+func (p *Proxy) initCNAMEOverrides() {
+	overrides := map[string]string{}
+	if p.SafeSearch {
+		for name, target := range safeSearchCNAMEs {
+			overrides[normalizeStaticName(name)] = normalizeStaticName(target)
+		}
+	}
+	for name, target := range p.CNAMEOverrides {
+		overrides[normalizeStaticName(name)] = normalizeStaticName(target)
+	}
+
+	p.cnameLock.Lock()
+	p.cnameOverrides = overrides
+	p.cnameLock.Unlock()
+
+	if len(overrides) > 0 {
+		p.logger().Infof("Loaded %d CNAME overrides", len(overrides))
+	}
+}
+
+// SetCNAMEOverride adds or replaces the CNAME override of the name.
+// The changes are lost when the proxy is restarted or the config with the other CNAMEOverrides is reloaded.
+func (p *Proxy) SetCNAMEOverride(name, target string) error {
+	err := validateCNAMEOverride(name, target)
+	if err != nil {
+		return err
+	}
+
+	p.cnameLock.Lock()
+	defer p.cnameLock.Unlock()
+	if p.cnameOverrides == nil {
+		p.cnameOverrides = map[string]string{}
+	}
+	p.cnameOverrides[normalizeStaticName(name)] = normalizeStaticName(target)
+	return nil
+}
+
+// RemoveCNAMEOverride removes the CNAME override of the name
+func (p *Proxy) RemoveCNAMEOverride(name string) {
+	p.cnameLock.Lock()
+	defer p.cnameLock.Unlock()
+	delete(p.cnameOverrides, normalizeStaticName(name))
+}
+
+// cnameOverride returns the target of the CNAME override of the name (or the empty string)
+func (p *Proxy) cnameOverride(name string) string {
+	p.cnameLock.RLock()
+	defer p.cnameLock.RUnlock()
+	return p.cnameOverrides[strings.ToLower(name)]
+}
+
+// resolveCNAMEOverride answers the request for the name with the CNAME override:
+// the target is resolved with the same request and the CNAME to it is added before its records.
+// The CNAME has the lowest TTL of the target's records. Returns false if the name has no override.
+func (p *Proxy) resolveCNAMEOverride(d *DNSContext) (bool, error) {
+	q := d.Req.Question[0]
+	if d.cnameTarget || q.Qclass != dns.ClassINET {
+		return false, nil
+	}
+	target := p.cnameOverride(q.Name)
+	if target == "" {
+		return false, nil
+	}
+
+	req := d.Req.Copy()
+	req.Question[0].Name = target
+	t := &DNSContext{
+		Proto:       d.Proto,
+		Req:         req,
+		Addr:        d.Addr,
+		StartTime:   d.StartTime,
+		ListenAddr:  d.ListenAddr,
+		CacheBypass: d.CacheBypass,
+		cnameTarget: true,
+	}
+	err := p.Resolve(t)
+
+	d.Upstream = t.Upstream
+	d.CachedResponse = t.CachedResponse
+	d.ServedStale = t.ServedStale
+	d.ExtendedErrors = t.ExtendedErrors
+	d.Status = t.Status
+	d.secureUpstream = t.secureUpstream
+	if t.Res == nil {
+		return true, err
+	}
+
+	res := t.Res.Copy()
+	res.Id = d.Req.Id
+	res.Question = []dns.Question{q}
+	cname := &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: cnameOverrideTTL(res)},
+		Target: target,
+	}
+	res.Answer = append([]dns.RR{cname}, res.Answer...)
+	d.Res = res
+	return true, err
+}
+
+// cnameOverrideTTL returns the lowest TTL of the target's answer (or authority) records
+func cnameOverrideTTL(m *dns.Msg) uint32 {
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns} {
+		if len(rrs) == 0 {
+			continue
+		}
+		ttl := rrs[0].Header().Ttl
+		for _, rr := range rrs[1:] {
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+		return ttl
+	}
+	return defaultStaticEntriesTTL
+}
+
+// validateCNAMEOverride checks that the name and the target are valid hostnames and differ
+func validateCNAMEOverride(name, target string) error {
+	if err := utils.IsValidHostname(strings.TrimSuffix(name, ".")); err != nil {
+		return fmt.Errorf("invalid CNAME override name %s: %s", name, err)
+	}
+	if err := utils.IsValidHostname(strings.TrimSuffix(target, ".")); err != nil {
+		return fmt.Errorf("invalid CNAME override target %s: %s", target, err)
+	}
+	if normalizeStaticName(name) == normalizeStaticName(target) {
+		return fmt.Errorf("CNAME override of %s points to itself", name)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCNAMEOverrides(t *testing.T) {
+	var names []string
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.SafeSearch = true
+	dnsProxy.CNAMEOverrides = map[string]string{"www.bing.com": "www.bing.com.edgekey.net", "Example.ORG": "target.example.net"}
+	dnsProxy.Upstreams = []upstream.Upstream{&funcUpstream{exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+		names = append(names, m.Question[0].Name)
+		resp := &dns.Msg{}
+		resp.SetReply(m)
+		resp.Answer = []dns.RR{
+			newRR(m.Question[0].Name + " 300 IN A 1.2.3.4"),
+			newRR(m.Question[0].Name + " 200 IN A 1.2.3.5"),
+		}
+		return resp, nil
+	}}}
+	handled := 0
+	dnsProxy.ResponseHandler = func(d *DNSContext, err error) {
+		handled++
+		assert.Equal(t, "www.google.com.", d.Req.Question[0].Name)
+	}
+	require.NoError(t, dnsProxy.Start())
+	defer dnsProxy.Stop()
+
+	resolve := func(host string) *DNSContext {
+		d := &DNSContext{Proto: ProtoUDP, Req: createHostTestMessage(host), Addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}}}
+		require.NoError(t, dnsProxy.Resolve(d))
+		return d
+	}
+
+	// the target is resolved and follows the CNAME with its lowest TTL
+	d := resolve("www.google.com")
+	assert.Equal(t, []string{"forcesafesearch.google.com."}, names)
+	assert.Equal(t, 1, handled)
+	assert.Equal(t, "www.google.com.", d.Res.Question[0].Name)
+	require.Len(t, d.Res.Answer, 3)
+	cname, ok := d.Res.Answer[0].(*dns.CNAME)
+	require.True(t, ok)
+	assert.Equal(t, "www.google.com.", cname.Hdr.Name)
+	assert.Equal(t, "forcesafesearch.google.com.", cname.Target)
+	assert.Equal(t, uint32(200), cname.Hdr.Ttl)
+	assert.Equal(t, "forcesafesearch.google.com.", d.Res.Answer[1].Header().Name)
+	assert.NotNil(t, d.Upstream)
+	conf := dnsProxy.Config
+	conf.ResponseHandler = nil
+	_, err := dnsProxy.Reload(conf)
+	require.NoError(t, err)
+
+	// the configured overrides replace the preset, the names are case-insensitive
+	resolve("www.bing.com")
+	resolve("EXAMPLE.org")
+	assert.Equal(t, []string{"forcesafesearch.google.com.", "www.bing.com.edgekey.net.", "target.example.net."}, names)
+
+	// the overrides are changed at runtime
+	require.NoError(t, dnsProxy.SetCNAMEOverride("www.example.com", "target.example.net"))
+	d = resolve("www.example.com")
+	assert.Equal(t, "target.example.net.", names[len(names)-1])
+	assert.IsType(t, &dns.CNAME{}, d.Res.Answer[0])
+	dnsProxy.RemoveCNAMEOverride("www.example.com")
+	d = resolve("www.example.com")
+	assert.Equal(t, "www.example.com.", names[len(names)-1])
+	assert.IsType(t, &dns.A{}, d.Res.Answer[0])
+
+	assert.Error(t, dnsProxy.SetCNAMEOverride("www.example.com", "WWW.example.com."))
+	assert.Error(t, dnsProxy.SetCNAMEOverride("www.example.com", "invalid..name"))
+	assert.Error(t, (&Config{
+		UDPListenAddr:  []*net.UDPAddr{{}},
+		Upstreams:      []upstream.Upstream{&funcUpstream{}},
+		CNAMEOverrides: map[string]string{"-invalid-": "example.org"},
+	}).validate())
+}
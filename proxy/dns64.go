@@ -1,17 +1,22 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
 	"net"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/miekg/dns"
 )
 
 // isEmptyAAAAResponse checks AAAA answer to be empty
-// returns true if NAT64 prefix already calculated and there are no answers for AAAA question
+// returns true if NAT64 prefix already calculated and there are no answers for AAAA question.
+// The validating clients (DO and CD are set) get the response as is, since they can't validate
+// the synthesized records (RFC 6147, section 5.5).
 func (p *Proxy) isEmptyAAAAResponse(resp, req *dns.Msg) bool {
+	if req.CheckingDisabled && isDORequested(req) {
+		return false
+	}
 	return p.isNAT64PrefixAvailable() && req.Question[0].Qtype == dns.TypeAAAA && (resp == nil || len(resp.Answer) == 0)
 }
 
@@ -29,26 +34,39 @@ func (p *Proxy) SetNAT64Prefix(prefix []byte) {
 		return
 	}
 
+	if p.state().BlockIPv6 {
+		p.logger().Infof("IPv6 is blocked, NAT64 prefix is ignored")
+		return
+	}
+
 	// Check if proxy is started and has no prefix yet
 	p.nat64Lock.Lock()
 	if len(p.nat64Prefix) == 0 {
 		if p.started {
 			p.nat64Prefix = prefix
-			log.Printf("NAT64 prefix: %v", prefix)
+			p.logger().Infof("NAT64 prefix: %v", prefix)
 		}
 	}
 	p.nat64Lock.Unlock()
 }
 
+// ClearNAT64Prefix removes the NAT64 prefix (e.g. when the network changes), so that a new one can be set
+func (p *Proxy) ClearNAT64Prefix() {
+	p.nat64Lock.Lock()
+	p.nat64Prefix = nil
+	p.nat64Lock.Unlock()
+}
+
 // createModifiedARequest returns modified question to make A DNS request
 func createModifiedARequest(d *dns.Msg) (*dns.Msg, error) {
-	if d.Question[0].Qtype != dns.TypeAAAA {
+	if len(d.Question) == 0 || d.Question[0].Qtype != dns.TypeAAAA {
 		return nil, fmt.Errorf("question is not AAAA, do nothing")
 	}
 
 	req := dns.Msg{}
 	req.Id = dns.Id()
 	req.RecursionDesired = true
+	req.CheckingDisabled = d.CheckingDisabled
 	req.Question = []dns.Question{
 		{Name: d.Question[0].Name, Qtype: dns.TypeA, Qclass: dns.ClassINET},
 	}
@@ -67,8 +85,13 @@ func (p *Proxy) createDNS64MappedResponse(newAResp, oldAAAAResp *dns.Msg) (*dns.
 	if len(newAResp.Answer) == 0 {
 		return nil, fmt.Errorf("no ipv4 answer")
 	}
+	if len(newAResp.Question) == 0 {
+		return nil, fmt.Errorf("no question in the ipv4 response")
+	}
 
 	oldAAAAResp.Answer = []dns.RR{}
+	// the synthesized records aren't signed
+	oldAAAAResp.AuthenticatedData = false
 	// add NAT 64 prefix for each ipv4 answer
 	for _, ans := range newAResp.Answer {
 		i, ok := ans.(*dns.A)
@@ -97,18 +120,22 @@ func (p *Proxy) createDNS64MappedResponse(newAResp, oldAAAAResp *dns.Msg) (*dns.
 // checkDNS64 is called when there is no answer for AAAA request and NAT64 prefix available.
 // this function creates modified A request from oldAAAAReq, exchanges it and returns DNS64 mapped response
 // oldAAAAReq is message with AAAA Question. oldAAAAResp is response for oldAAAAReq with empty answer section
-func (p *Proxy) checkDNS64(oldAAAAReq, oldAAAAResp *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, error) {
+func (p *Proxy) checkDNS64(ctx context.Context, oldAAAAReq, oldAAAAResp *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, error) {
 	// Let's create A request to the same hostname
 	modifiedAReq, err := createModifiedARequest(oldAAAAReq)
 	if err != nil {
-		log.Tracef("Failed to create DNS64 mapped request %s", err)
+		if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("Failed to create DNS64 mapped request %s", err)
+		}
 		return nil, nil, err
 	}
 
 	// Exchange new A request with selected upstreams
-	newAResp, u, err := p.exchange(modifiedAReq, upstreams)
+	newAResp, u, err := p.exchange(ctx, modifiedAReq, upstreams)
 	if err != nil {
-		log.Tracef("Failed to exchange DNS64 request: %s", err)
+		if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("Failed to exchange DNS64 request: %s", err)
+		}
 		return nil, nil, err
 	}
 
@@ -123,7 +150,9 @@ func (p *Proxy) checkDNS64(oldAAAAReq, oldAAAAResp *dns.Msg, upstreams []upstrea
 	// new A response should be mapped with NAT64 prefix
 	mappedAAAAResponse, err := p.createDNS64MappedResponse(newAResp, oldAAAAResp)
 	if err != nil {
-		log.Tracef("Failed to create DNS64 mapped request %s", err)
+		if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("Failed to create DNS64 mapped request %s", err)
+		}
 		return nil, u, err
 	}
 	return mappedAAAAResponse, u, nil
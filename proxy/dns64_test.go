@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"net"
 	"sync"
 	"testing"
@@ -25,7 +26,7 @@ func TestProxyWithDNS64(t *testing.T) {
 
 	// Let's create test A request to ipv4OnlyHost and exchange it with test proxy
 	req := createHostTestMessage(ipv4OnlyHost)
-	resp, _, err := dnsProxy.exchange(req, dnsProxy.Upstreams)
+	resp, _, err := dnsProxy.exchange(context.Background(), req, dnsProxy.Upstreams)
 	if err != nil {
 		t.Fatalf("Can not exchange test message for %s cause: %s", ipv4OnlyHost, err)
 	}
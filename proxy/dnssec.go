@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"github.com/miekg/dns"
+)
+
+// defaultUpstreamUDPSize is the default Config.UpstreamUDPSize
+const defaultUpstreamUDPSize = 4096
+
+// isDORequested checks if the client has set DO, i.e. wants the DNSSEC records in the response (RFC 3225)
+func isDORequested(req *dns.Msg) bool {
+	opt := req.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// upstreamUDPSize returns the UDP payload size advertised to the upstreams in the DO requests
+func (p *Proxy) upstreamUDPSize() uint16 {
+	s := p.state()
+	if s.UpstreamUDPSize > 0 {
+		return s.UpstreamUDPSize
+	}
+	return defaultUpstreamUDPSize
+}
+
+// upstreamRequest returns the request to be sent to the upstreams.
+// The DO requests are sent with the UDP payload size of upstreamUDPSize, so the signed responses
+// aren't truncated because of the client's small buffer. The request of the client isn't changed,
+// its payload size is used for the response (see truncateUDPResponse).
+func (p *Proxy) upstreamRequest(req *dns.Msg) *dns.Msg {
+	if !isDORequested(req) || req.IsEdns0().UDPSize() == p.upstreamUDPSize() {
+		return req
+	}
+
+	req = req.Copy()
+	req.IsEdns0().SetUDPSize(p.upstreamUDPSize())
+	return req
+}
+
+// truncateUDPResponse makes the UDP response fit into the payload size of the client's request
+// (512 bytes for the requests without EDNS). Whole records are removed and TC is set, so the client
+// retries over TCP and gets the complete RRsets with their signatures instead of a fragmented
+// or dropped response (RFC 6891, section 7).
+func truncateUDPResponse(d *DNSContext) {
+	size := dns.MinMsgSize
+	if opt := d.Req.IsEdns0(); opt != nil {
+		size = int(opt.UDPSize())
+	}
+
+	compress := d.Res.Compress
+	d.Res.Truncate(size)
+	// Truncate disables the compression if the response fits without it
+	d.Res.Compress = d.Res.Compress || compress
+}
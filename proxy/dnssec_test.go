@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"crypto"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testZone is the test zone signed with its own key
+type testZone struct {
+	key    *dns.DNSKEY
+	signer crypto.Signer
+}
+
+func newTestZone(t *testing.T) *testZone {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	require.NoError(t, err)
+	return &testZone{key: key, signer: priv.(crypto.Signer)}
+}
+
+// sign returns the records with the RRSIG of the RRset
+func (z *testZone) sign(t *testing.T, rrs ...dns.RR) []dns.RR {
+	h := rrs[0].Header()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: h.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: h.Ttl},
+		Algorithm:  z.key.Algorithm,
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.key.Hdr.Name,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	require.NoError(t, sig.Sign(z.signer, rrs))
+	return append(rrs, sig)
+}
+
+// response returns the signed response of the zone: www.example.org has 30 A records
+// and no AAAA records, the other names don't exist
+func (z *testZone) response(t *testing.T, req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.AuthenticatedData = true
+	soa := newRR("example.org. 300 IN SOA ns.example.org. hostmaster.example.org. 1 3600 600 86400 300")
+
+	switch {
+	case q.Name == "www.example.org." && q.Qtype == dns.TypeA:
+		var rrs []dns.RR
+		for i := 1; i <= 30; i++ {
+			rrs = append(rrs, newRR(fmt.Sprintf("www.example.org. 300 IN A 192.0.2.%d", i)))
+		}
+		resp.Answer = z.sign(t, rrs...)
+	case q.Name == "www.example.org.":
+		nsec := newRR("www.example.org. 300 IN NSEC zzz.example.org. A RRSIG NSEC")
+		resp.Ns = append(z.sign(t, soa), z.sign(t, nsec)...)
+	default:
+		resp.Rcode = dns.RcodeNameError
+		nsec := newRR("example.org. 300 IN NSEC www.example.org. SOA RRSIG NSEC DNSKEY")
+		resp.Ns = append(z.sign(t, soa), z.sign(t, nsec)...)
+	}
+
+	opt := req.IsEdns0()
+	if opt == nil || !opt.Do() {
+		stripDNSSEC(resp)
+	}
+	if opt != nil {
+		resp.SetEdns0(4096, opt.Do())
+	}
+	return resp
+}
+
+// validate verifies every RRset of the section with its RRSIG like a validating stub
+func (z *testZone) validate(t *testing.T, rrs []dns.RR) {
+	sets := map[string][]dns.RR{}
+	sigs := map[string]*dns.RRSIG{}
+	for _, rr := range rrs {
+		h := rr.Header()
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs[strings.ToLower(h.Name)+"/"+dns.TypeToString[sig.TypeCovered]] = sig
+			continue
+		}
+		k := strings.ToLower(h.Name) + "/" + dns.TypeToString[h.Rrtype]
+		sets[k] = append(sets[k], rr)
+	}
+
+	require.NotEmpty(t, sets)
+	for k, set := range sets {
+		sig := sigs[k]
+		require.NotNil(t, sig, "no RRSIG for %s", k)
+		assert.True(t, sig.ValidityPeriod(time.Now()))
+		assert.NoError(t, sig.Verify(z.key, set), "invalid RRSIG of %s", k)
+	}
+}
+
+// createDNSSECTestProxy creates the proxy with all the features that change the responses
+func createDNSSECTestProxy(t *testing.T, z *testZone, upstreamReqs chan *dns.Msg) *Proxy {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.CacheRoundRobin = true
+	dnsProxy.ADPolicy = ADPolicyPassthrough
+	dnsProxy.nat64Prefix = prefix
+	dnsProxy.Upstreams = []upstream.Upstream{&funcUpstream{exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+		upstreamReqs <- m.Copy()
+		return z.response(t, m), nil
+	}}}
+	return dnsProxy
+}
+
+func dnssecRequest(name string, qtype uint16, size uint16, cd bool) *dns.Msg {
+	req := &dns.Msg{}
+	req.SetQuestion(name, qtype)
+	req.CheckingDisabled = cd
+	req.SetEdns0(size, true)
+	return req
+}
+
+func TestDNSSECEndToEnd(t *testing.T) {
+	z := newTestZone(t)
+	upstreamReqs := make(chan *dns.Msg, 10)
+	dnsProxy := createDNSSECTestProxy(t, z, upstreamReqs)
+	require.NoError(t, dnsProxy.Start())
+	defer dnsProxy.Stop()
+
+	udp := &dns.Client{Net: "udp", Timeout: time.Second, UDPSize: 4096}
+	tcp := &dns.Client{Net: "tcp", Timeout: time.Second}
+	var lock sync.Mutex
+	exchange := func(c *dns.Client, req *dns.Msg) *dns.Msg {
+		lock.Lock()
+		defer lock.Unlock()
+		addr := dnsProxy.Addr(ProtoUDP).String()
+		if c.Net == "tcp" {
+			addr = dnsProxy.Addr(ProtoTCP).String()
+		}
+		resp, _, err := c.Exchange(req, addr)
+		require.NoError(t, err)
+		return resp
+	}
+
+	// the response is sent from the upstream and then from the cache with the round robin
+	for i := 0; i < 2; i++ {
+		resp := exchange(udp, dnssecRequest("www.example.org.", dns.TypeA, 1232, false))
+		require.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		require.NotNil(t, resp.IsEdns0())
+		assert.True(t, resp.IsEdns0().Do())
+		assert.True(t, resp.AuthenticatedData)
+		assert.False(t, resp.Truncated)
+		z.validate(t, resp.Answer)
+	}
+
+	// the upstream gets DO and the proxy's payload size, not the client's one
+	up := <-upstreamReqs
+	require.NotNil(t, up.IsEdns0())
+	assert.True(t, up.IsEdns0().Do())
+	assert.Equal(t, uint16(defaultUpstreamUDPSize), up.IsEdns0().UDPSize())
+
+	// the signed response doesn't fit into the client's buffer, it is truncated and then fetched over TCP
+	resp := exchange(udp, dnssecRequest("www.example.org.", dns.TypeA, 512, false))
+	assert.True(t, resp.Truncated)
+	resp = exchange(tcp, dnssecRequest("www.example.org.", dns.TypeA, 512, false))
+	assert.False(t, resp.Truncated)
+	assert.Len(t, resp.Answer, 31)
+	z.validate(t, resp.Answer)
+
+	// the denial of existence with NSEC, from the upstream and from the cache
+	for i := 0; i < 2; i++ {
+		resp = exchange(udp, dnssecRequest("nxdomain.example.org.", dns.TypeA, 1232, false))
+		require.Equal(t, dns.RcodeNameError, resp.Rcode)
+		z.validate(t, resp.Ns)
+	}
+
+	// DNS64 doesn't synthesize the records for the validating stub (DO and CD)
+	resp = exchange(udp, dnssecRequest("www.example.org.", dns.TypeAAAA, 1232, true))
+	require.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Empty(t, resp.Answer)
+	z.validate(t, resp.Ns)
+
+	// the client without DO doesn't get the DNSSEC records and OPT with DO
+	req := createHostTestMessage("www.example.org")
+	req.SetEdns0(4096, false)
+	resp = exchange(udp, req)
+	require.NotNil(t, resp.IsEdns0())
+	assert.False(t, resp.IsEdns0().Do())
+	for _, rr := range resp.Answer {
+		assert.Equal(t, dns.TypeA, rr.Header().Rrtype)
+	}
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// initECSOverride parses Config.ECSOverrideSubnet
+func (p *Proxy) initECSOverride() {
+	p.ecsOverrideV4, p.ecsOverrideV6 = nil, nil
+	if len(p.ECSOverrideSubnet) == 0 {
+		return
+	}
+	v4, v6, err := parseECSOverride(p.ECSOverrideSubnet)
+	if err != nil {
+		// the config is validated before, so this never happens
+		p.logger().Errorf("invalid ECS override subnet: %s", err)
+		return
+	}
+	p.ecsOverrideV4, p.ecsOverrideV6 = v4, v6
+}
+
+// parseECSOverride parses the ECS override subnets: at most one IPv4 and one IPv6 prefix
+func parseECSOverride(subnets []string) (v4, v6 *net.IPNet, err error) {
+	nets, err := parseSubnets(subnets)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, n := range nets {
+		if n.IP.To4() != nil {
+			if v4 != nil {
+				return nil, nil, errors.New("more than one IPv4 ECS override subnet")
+			}
+			v4 = n
+		} else {
+			if v6 != nil {
+				return nil, nil, errors.New("more than one IPv6 ECS override subnet")
+			}
+			v6 = n
+		}
+	}
+	return v4, v6, nil
+}
+
+// validateECSOverride checks Config.ECSOverrideSubnet, it can't be used with the ECS of the clients' addresses
+func (c *Config) validateECSOverride() error {
+	if len(c.ECSOverrideSubnet) == 0 {
+		return nil
+	}
+	if _, _, err := parseECSOverride(c.ECSOverrideSubnet); err != nil {
+		return fmt.Errorf("invalid ECS override subnet: %s", err)
+	}
+	if c.EnableEDNSClientSubnet {
+		return errors.New("ECS override subnet can't be used with EnableEDNSClientSubnet")
+	}
+	for _, s := range c.ClientsSettings {
+		if s.EnableEDNSClientSubnet != nil && *s.EnableEDNSClientSubnet {
+			return fmt.Errorf("ECS override subnet can't be used with EnableEDNSClientSubnet of clients %v", s.Subnets)
+		}
+	}
+	return nil
+}
+
+// ecsDefault checks if ECS is enabled for the clients without their own setting:
+// either the clients' subnets or the override subnet is sent
+func (c *Config) ecsDefault() bool {
+	return c.EnableEDNSClientSubnet || len(c.ECSOverrideSubnet) > 0
+}
+
+// overrideECS replaces the ECS option of the request with the override subnet of the client's address family
+// (or the other one if there is none), so all the clients share the subnet cache entries
+func (p *Proxy) overrideECS(d *DNSContext) bool {
+	s := p.requestState(d)
+	n := s.ecsOverrideV4
+	if ip := getIP(d.Addr); (ip != nil && ip.To4() == nil && s.ecsOverrideV6 != nil) || n == nil {
+		n = s.ecsOverrideV6
+	}
+	if n == nil {
+		return false
+	}
+
+	ones, _ := n.Mask.Size()
+	e := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, SourceNetmask: uint8(ones), Address: n.IP}
+	if n.IP.To4() != nil {
+		e.Family = 1
+	} else {
+		e.Family = 2
+	}
+
+	opt := d.Req.IsEdns0()
+	if opt == nil {
+		d.Req.SetEdns0(4096, false)
+		opt = d.Req.IsEdns0()
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0SUBNET {
+			options = append(options, o)
+		}
+	}
+	opt.Option = append(options, e)
+
+	d.ecsReqIP = e.Address
+	d.ecsReqMask = e.SourceNetmask
+	if l := p.logger(); l.DebugEnabled() {
+		l.Debugf("Set ECS override data: %s/%d", e.Address, e.SourceNetmask)
+	}
+	return true
+}
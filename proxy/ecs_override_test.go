@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestECSOverride(t *testing.T) {
+	var reqs []*dns.Msg
+	u := &funcUpstream{exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+		reqs = append(reqs, m.Copy())
+		resp := &dns.Msg{}
+		resp.SetReply(m)
+		resp.Answer = []dns.RR{newRR(m.Question[0].Name + " 60 IN A 1.2.3.4")}
+		// the upstream supports ECS and answers for the whole source subnet
+		if ip, mask, _ := parseECS(m); ip != nil {
+			resp.SetEdns0(4096, false)
+			opt := resp.IsEdns0()
+			e := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, SourceNetmask: mask, SourceScope: mask, Address: ip, Family: 1}
+			if ip.To4() == nil {
+				e.Family = 2
+			}
+			opt.Option = append(opt.Option, e)
+		}
+		return resp, nil
+	}}
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{u}
+	dnsProxy.CacheEnabled = true
+	dnsProxy.ECSOverrideSubnet = []string{"203.0.113.0/24", "2001:db8::/56"}
+	disabled := false
+	dnsProxy.ClientsSettings = []*ClientSettings{{Subnets: []string{"10.1.0.0/16"}, EnableEDNSClientSubnet: &disabled}}
+	require.NoError(t, dnsProxy.Start())
+	defer dnsProxy.Stop()
+
+	resolve := func(ip net.IP, ecs net.IP) {
+		req := createHostTestMessage("example.org")
+		if ecs != nil {
+			setECS(req, ecs, 0)
+		}
+		d := &DNSContext{Proto: ProtoUDP, Req: req, Addr: &net.UDPAddr{IP: ip}}
+		require.NoError(t, dnsProxy.Resolve(d))
+	}
+
+	// the ECS option of the request is replaced, the private clients get the override too
+	resolve(net.IP{10, 0, 0, 1}, net.IP{1, 2, 3, 4})
+	require.Len(t, reqs, 1)
+	ip, mask, _ := parseECS(reqs[0])
+	assert.Equal(t, "203.0.113.0/24", (&net.IPNet{IP: ip, Mask: net.CIDRMask(int(mask), 32)}).String())
+	assert.Len(t, reqs[0].IsEdns0().Option, 1)
+
+	// the other IPv4 clients share the cache entry
+	resolve(net.IP{198, 51, 100, 7}, nil)
+	assert.Len(t, reqs, 1)
+
+	resolve(net.ParseIP("2001:db8:ffff::1"), nil)
+	require.Len(t, reqs, 2)
+	ip, mask, _ = parseECS(reqs[1])
+	assert.Equal(t, "2001:db8::/56", (&net.IPNet{IP: ip, Mask: net.CIDRMask(int(mask), 128)}).String())
+
+	// the clients can disable ECS
+	resolve(net.IP{10, 1, 2, 3}, nil)
+	require.Len(t, reqs, 3)
+	ip, _, _ = parseECS(reqs[2])
+	assert.Nil(t, ip)
+}
+
+func TestECSOverrideValidation(t *testing.T) {
+	enabled := true
+	testCases := []Config{
+		{ECSOverrideSubnet: []string{"203.0.113.0/24"}, EnableEDNSClientSubnet: true},
+		{ECSOverrideSubnet: []string{"203.0.113.0/24", "198.51.100.0/24"}},
+		{ECSOverrideSubnet: []string{"2001:db8::/56", "2001:db8:1::/56"}},
+		{ECSOverrideSubnet: []string{"invalid"}},
+		{
+			ECSOverrideSubnet: []string{"203.0.113.0/24"},
+			ClientsSettings:   []*ClientSettings{{Subnets: []string{"10.0.0.0/8"}, EnableEDNSClientSubnet: &enabled}},
+		},
+	}
+	for _, c := range testCases {
+		assert.Error(t, c.validateECSOverride(), "%v", c.ECSOverrideSubnet)
+	}
+
+	c := Config{ECSOverrideSubnet: []string{"203.0.113.0/24", "2001:db8::/56"}}
+	assert.NoError(t, c.validateECSOverride())
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// edns0EDE is the code of the Extended DNS Error option (RFC 8914), dns doesn't define it yet
+const edns0EDE = 15
+
+// The info codes of the Extended DNS Errors (RFC 8914, section 4) used by the proxy (see SetExtendedError)
+const (
+	EDEBlocked              uint16 = 15 // blocked by the blocklist of the operator
+	EDECensored             uint16 = 16 // blocked because of an external requirement
+	EDEFiltered             uint16 = 17 // blocked by the filtering rules requested by the client
+	EDEProhibited           uint16 = 18 // refused by the policy, e.g. a zone transfer
+	EDENoReachableAuthority uint16 = 22 // all the upstreams have timed out
+	EDENetworkError         uint16 = 23 // the upstreams have failed or sent invalid responses
+)
+
+// edeNames are the names of the info codes (RFC 8914, section 4)
+var edeNames = []string{
+	"Other", "Unsupported DNSKEY Algorithm", "Unsupported DS Digest Type", "Stale Answer", "Forged Answer",
+	"DNSSEC Indeterminate", "DNSSEC Bogus", "Signature Expired", "Signature Not Yet Valid", "DNSKEY Missing",
+	"RRSIGs Missing", "No Zone Key Bit Set", "NSEC Missing", "Cached Error", "Not Ready", "Blocked", "Censored",
+	"Filtered", "Prohibited", "Stale NXDOMAIN Answer", "Not Authoritative", "Not Supported",
+	"No Reachable Authority", "Network Error", "Invalid Data",
+}
+
+// ExtendedError is the Extended DNS Error (RFC 8914) of the upstream response (see DNSContext.ExtendedErrors)
+type ExtendedError struct {
+	Code uint16 // the info code, e.g. EDEBlocked
+	Text string // the EXTRA-TEXT field (may be empty)
+}
+
+// String returns the code with its name and the text, e.g. "15 (Blocked): example.org is blocked"
+func (e ExtendedError) String() string {
+	name := "Unknown"
+	if int(e.Code) < len(edeNames) {
+		name = edeNames[e.Code]
+	}
+	if e.Text == "" {
+		return fmt.Sprintf("%d (%s)", e.Code, name)
+	}
+	return fmt.Sprintf("%d (%s): %s", e.Code, name, e.Text)
+}
+
+// parseExtendedErrors returns the Extended DNS Errors of the response, the malformed options are skipped
+func parseExtendedErrors(m *dns.Msg) []ExtendedError {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	var res []ExtendedError
+	for _, o := range opt.Option {
+		if l, ok := o.(*dns.EDNS0_LOCAL); ok && l.Code == edns0EDE && len(l.Data) >= 2 {
+			res = append(res, ExtendedError{Code: binary.BigEndian.Uint16(l.Data), Text: string(l.Data[2:])})
+		}
+	}
+	return res
+}
+
+// extendedErrorOptions returns the Extended DNS Error options of opt, they describe the response,
+// so unlike the other options they are kept in the cached responses
+func extendedErrorOptions(opt *dns.OPT) []dns.EDNS0 {
+	var res []dns.EDNS0
+	for _, o := range opt.Option {
+		if o.Option() == edns0EDE {
+			res = append(res, o)
+		}
+	}
+	return res
+}
+
+// isUpstreamBlocking checks if the Extended DNS Errors of the response report that the upstream has blocked it
+func isUpstreamBlocking(m *dns.Msg) bool {
+	for _, e := range parseExtendedErrors(m) {
+		switch e.Code {
+		case EDEBlocked, EDECensored, EDEFiltered:
+			return true
+		}
+	}
+	return false
+}
+
+// retryResponse checks if the response of the upstream is retried on the next one (see RetryServerErrors)
+func (p *Proxy) retryResponse(m *dns.Msg) bool {
+	s := p.state()
+	if !s.RetryServerErrors || (m.Rcode != dns.RcodeServerFailure && m.Rcode != dns.RcodeRefused) {
+		return false
+	}
+	return !s.RespectUpstreamBlocking || !isUpstreamBlocking(m)
+}
+
+// statusEDE returns the info code of the Extended DNS Error for the status of the failed query
+func statusEDE(s Status) (uint16, bool) {
+	switch s {
+	case StatusBlocked:
+		return EDEProhibited, true
+	case StatusTimeout:
+		return EDENoReachableAuthority, true
+	case StatusUpstreamError:
+		return EDENetworkError, true
+	default:
+		return 0, false
+	}
+}
+
+// SetExtendedError adds the Extended DNS Error with the info code to d.Res if EnableExtendedErrors is set
+// and the client has sent OPT. The text is only sent with ExtendedErrorsText. The previous error is replaced.
+// The request handlers use it for their own responses, e.g. the blocked ones.
+func (p *Proxy) SetExtendedError(d *DNSContext, code uint16, text string) {
+	if d.Res != nil {
+		p.setExtendedError(d.Req, d.Res, code, text)
+	}
+}
+
+// setExtendedError adds the Extended DNS Error to the response to req (see SetExtendedError)
+func (p *Proxy) setExtendedError(req, res *dns.Msg, code uint16, text string) {
+	s := p.state()
+	reqOpt := req.IsEdns0()
+	if !s.EnableExtendedErrors || reqOpt == nil {
+		return
+	}
+	if !s.ExtendedErrorsText {
+		text = ""
+	}
+
+	opt := res.IsEdns0()
+	if opt == nil {
+		opt = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT, Class: dns.DefaultMsgSize}}
+		opt.SetUDPSize(reqOpt.UDPSize())
+		res.Extra = append(res.Extra, opt)
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != edns0EDE {
+			options = append(options, o)
+		}
+	}
+
+	data := make([]byte, 2, 2+len(text))
+	binary.BigEndian.PutUint16(data, code)
+	data = append(data, text...)
+	// like edns-tcp-keepalive, the received options are dns.EDNS0_LOCAL
+	opt.Option = append(options, &dns.EDNS0_LOCAL{Code: edns0EDE, Data: data})
+}
+
+// upstreamsErrorText returns the text of the Extended DNS Error of the query whose upstreams have failed
+func upstreamsErrorText(s Status, upstreams []upstream.Upstream) string {
+	names := make([]string, 0, len(upstreams))
+	for _, u := range upstreams {
+		names = append(names, upstream.Name(u))
+	}
+	if s == StatusTimeout {
+		return "upstreams timed out: " + strings.Join(names, ", ")
+	}
+	return "upstreams failed: " + strings.Join(names, ", ")
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// findEDE returns the info code and the text of the Extended DNS Error of the message
+func findEDE(m *dns.Msg) (code uint16, text string, ok bool) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return 0, "", false
+	}
+	for _, o := range opt.Option {
+		if o.Option() == edns0EDE {
+			data := o.(*dns.EDNS0_LOCAL).Data
+			return binary.BigEndian.Uint16(data), string(data[2:]), true
+		}
+	}
+	return 0, "", false
+}
+
+func TestExtendedErrors(t *testing.T) {
+	timeout := failingUpstream("func://timeout", timeoutError{})
+	failed := failingUpstream("func://failed", errors.New("connection refused"))
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.EnableExtendedErrors = true
+	dnsProxy.Upstreams = []upstream.Upstream{timeout}
+	require.NoError(t, dnsProxy.Start())
+	defer dnsProxy.Stop()
+
+	resolve := func(edns bool) *dns.Msg {
+		req := createHostTestMessage("example.org")
+		if edns {
+			req.SetEdns0(4096, false)
+		}
+		d := &DNSContext{Proto: ProtoUDP, Req: req, Addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}}}
+		_ = dnsProxy.Resolve(d)
+		return d.Res
+	}
+
+	res := resolve(true)
+	assert.Equal(t, dns.RcodeServerFailure, res.Rcode)
+	code, text, ok := findEDE(res)
+	require.True(t, ok)
+	assert.Equal(t, EDENoReachableAuthority, code)
+	assert.Empty(t, text)
+
+	// the clients without OPT don't get the errors
+	res = resolve(false)
+	assert.Nil(t, res.IsEdns0())
+
+	// the text names the upstreams and the fallbacks
+	conf := dnsProxy.Config
+	conf.ExtendedErrorsText = true
+	conf.Fallbacks = []upstream.Upstream{failed}
+	_, err := dnsProxy.Reload(conf)
+	require.NoError(t, err)
+	res = resolve(true)
+	code, text, ok = findEDE(res)
+	require.True(t, ok)
+	assert.Equal(t, EDENetworkError, code)
+	assert.Equal(t, "upstreams failed: func://timeout, func://failed", text)
+
+	// the refused queries are prohibited
+	d := &DNSContext{Proto: ProtoUDP, Req: &dns.Msg{}}
+	d.Req.SetQuestion("version.bind.", dns.TypeTXT)
+	d.Req.Question[0].Qclass = dns.ClassCHAOS
+	d.Req.SetEdns0(4096, false)
+	d.Res = dnsProxy.checkChaosRequest(d)
+	require.NotNil(t, d.Res)
+	code, _, ok = findEDE(d.Res)
+	require.True(t, ok)
+	assert.Equal(t, EDEProhibited, code)
+
+	// the request handlers can replace the error
+	dnsProxy.SetExtendedError(d, EDEBlocked, "blocked")
+	code, text, ok = findEDE(d.Res)
+	require.True(t, ok)
+	assert.Equal(t, EDEBlocked, code)
+	assert.Equal(t, "blocked", text)
+	assert.Len(t, d.Res.IsEdns0().Option, 1)
+
+	// the response is packed and unpacked with the option
+	b, err := d.Res.Pack()
+	require.NoError(t, err)
+	m := &dns.Msg{}
+	require.NoError(t, m.Unpack(b))
+	code, text, ok = findEDE(m)
+	require.True(t, ok)
+	assert.Equal(t, EDEBlocked, code)
+	assert.Equal(t, "blocked", text)
+
+	// disabled
+	conf.EnableExtendedErrors = false
+	_, err = dnsProxy.Reload(conf)
+	require.NoError(t, err)
+	d = &DNSContext{Proto: ProtoUDP, Req: d.Req}
+	d.Res = dnsProxy.checkChaosRequest(d)
+	_, _, ok = findEDE(d.Res)
+	assert.False(t, ok)
+}
+
+// edeUpstream returns the upstream that responds with the rcode and the Extended DNS Error
+func edeUpstream(addr string, rcode int, code uint16, text string) upstream.Upstream {
+	return &namedUpstream{addr: addr, funcUpstream: &funcUpstream{exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+		resp := &dns.Msg{}
+		resp.SetRcode(m, rcode)
+		if rcode == dns.RcodeSuccess {
+			resp.Answer = []dns.RR{newRR(m.Question[0].Name + " 60 IN A 1.2.3.4")}
+		}
+		resp.SetEdns0(4096, false)
+		data := append([]byte{byte(code >> 8), byte(code)}, text...)
+		resp.IsEdns0().Option = append(resp.IsEdns0().Option, &dns.EDNS0_LOCAL{Code: edns0EDE, Data: data})
+		return resp, nil
+	}}}
+}
+
+func TestUpstreamExtendedErrors(t *testing.T) {
+	bogus := edeUpstream("func://bogus", dns.RcodeServerFailure, 6, "signature expired")
+	blocked := edeUpstream("func://blocked", dns.RcodeRefused, EDEBlocked, "")
+	stale := edeUpstream("func://stale", dns.RcodeSuccess, 3, "")
+
+	resolve := func(p *Proxy, host string) *DNSContext {
+		req := createHostTestMessage(host)
+		req.SetEdns0(4096, false)
+		d := &DNSContext{Proto: ProtoUDP, Req: req, Addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}}}
+		require.NoError(t, p.Resolve(d))
+		return d
+	}
+
+	// the errors are parsed and kept in the cached responses
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.Upstreams = []upstream.Upstream{stale}
+	dnsProxy.Init()
+	for _, cached := range []bool{false, true} {
+		d := resolve(dnsProxy, "example.org")
+		assert.Equal(t, cached, d.CachedResponse)
+		assert.Equal(t, []ExtendedError{{Code: 3}}, d.ExtendedErrors)
+		assert.Equal(t, "3 (Stale Answer)", d.ExtendedErrors[0].String())
+	}
+
+	// the server errors aren't retried by default
+	dnsProxy = createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{bogus, stale}
+	d := resolve(dnsProxy, "example.org")
+	assert.Equal(t, dns.RcodeServerFailure, d.Res.Rcode)
+	assert.Equal(t, []ExtendedError{{Code: 6, Text: "signature expired"}}, d.ExtendedErrors)
+	assert.Equal(t, "6 (DNSSEC Bogus): signature expired", d.ExtendedErrors[0].String())
+
+	dnsProxy.RetryServerErrors = true
+	d = resolve(dnsProxy, "example.org")
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+	assert.Equal(t, "func://stale", upstream.Name(d.Upstream))
+
+	// the blocking of the upstream is respected
+	dnsProxy.Upstreams = []upstream.Upstream{blocked, stale}
+	d = resolve(dnsProxy, "example.org")
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+	dnsProxy.RespectUpstreamBlocking = true
+	d = resolve(dnsProxy, "example.org")
+	assert.Equal(t, dns.RcodeRefused, d.Res.Rcode)
+	assert.Equal(t, []ExtendedError{{Code: EDEBlocked}}, d.ExtendedErrors)
+
+	// the last response is returned if every upstream sends the server error
+	dnsProxy.Upstreams = []upstream.Upstream{bogus, bogus}
+	d = resolve(dnsProxy, "example.org")
+	assert.Equal(t, dns.RcodeServerFailure, d.Res.Rcode)
+	assert.Equal(t, "func://bogus", upstream.Name(d.Upstream))
+}
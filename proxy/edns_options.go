@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+// ednsOptionAllowed checks if the EDNS option of the client is sent to the upstreams (see Config.EDNSAllowedOptions).
+// ECS is controlled by EnableEDNSClientSubnet, so it's always allowed.
+func (p *Proxy) ednsOptionAllowed(code uint16) bool {
+	s := p.state()
+	if s.EDNSAllowedOptions == nil || code == dns.EDNS0SUBNET {
+		return true
+	}
+	for _, c := range s.EDNSAllowedOptions {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// filterRequestOptions removes the EDNS options that aren't allowed from the request.
+// The allowed options that don't fit into the payload size of the request are removed too.
+// The allowed options are saved to d.ednsKey, so the responses to the requests with the different
+// options aren't served from the cache to each other.
+func (p *Proxy) filterRequestOptions(d *DNSContext) {
+	opt := d.Req.IsEdns0()
+	if p.requestState(d).EDNSAllowedOptions == nil || opt == nil {
+		return
+	}
+
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if p.ednsOptionAllowed(o.Option()) {
+			options = append(options, o)
+		} else if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("Removing EDNS option %d from the request", o.Option())
+		}
+	}
+	opt.Option = options
+
+	// the request mustn't be larger than the payload size it advertises (at least 512 bytes, RFC 6891, section 6.2.5)
+	size := int(opt.UDPSize())
+	if size < dns.MinMsgSize {
+		size = dns.MinMsgSize
+	}
+	for i := len(opt.Option) - 1; i >= 0 && d.Req.Len() > size; i-- {
+		if opt.Option[i].Option() == dns.EDNS0SUBNET {
+			continue
+		}
+		if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("EDNS option %d doesn't fit into the payload size %d", opt.Option[i].Option(), size)
+		}
+		opt.Option = append(opt.Option[:i], opt.Option[i+1:]...)
+	}
+
+	d.ednsKey = ednsOptionsKey(opt)
+}
+
+// filterResponseOptions removes the EDNS options that aren't allowed from the response of the upstream.
+// The Extended DNS Errors are always kept, they are never sent by the clients.
+func (p *Proxy) filterResponseOptions(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if p.state().EDNSAllowedOptions == nil || opt == nil {
+		return
+	}
+
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() == edns0EDE || p.ednsOptionAllowed(o.Option()) {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
+
+// ednsOptionsKey returns the options of the OPT record except ECS (it has its own cache) sorted by the code
+// in the wire format (nil if there are no such options)
+func ednsOptionsKey(opt *dns.OPT) []byte {
+	o := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	for _, e := range opt.Option {
+		if e.Option() != dns.EDNS0SUBNET {
+			o.Option = append(o.Option, e)
+		}
+	}
+	if len(o.Option) == 0 {
+		return nil
+	}
+	sort.SliceStable(o.Option, func(i, j int) bool { return o.Option[i].Option() < o.Option[j].Option() })
+
+	b := make([]byte, dns.Len(o))
+	n, err := dns.PackRR(o, b, 0, nil, false)
+	if err != nil {
+		return nil
+	}
+	return b[:n]
+}
+
+// withEDNSKey appends the EDNS options of the request (see filterRequestOptions) to the cache key.
+// The names don't contain zero bytes, so the key doesn't match the key of another name.
+func withEDNSKey(key, ednsKey []byte) []byte {
+	if len(ednsKey) == 0 {
+		return key
+	}
+	k := make([]byte, 0, len(key)+1+len(ednsKey))
+	k = append(k, key...)
+	k = append(k, 0)
+	return append(k, ednsKey...)
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testDeviceIDOption = 65001 // the allowed option
+	testOtherOption    = 65002 // the option that isn't allowed
+)
+
+// optionsRequest creates the request with the EDNS options with the specified data
+func optionsRequest(udpSize uint16, options map[uint16][]byte) *dns.Msg {
+	req := createHostTestMessage("example.org")
+	req.SetEdns0(udpSize, false)
+	opt := req.IsEdns0()
+	for code, data := range options {
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: code, Data: data})
+	}
+	return req
+}
+
+// optionData returns the data of the EDNS option of the message (nil if there is no such option)
+func optionData(m *dns.Msg, code uint16) []byte {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if local, ok := o.(*dns.EDNS0_LOCAL); ok && local.Code == code {
+			return local.Data
+		}
+	}
+	return nil
+}
+
+// createOptionsTestProxy creates the proxy with the upstream that echoes the EDNS options of the request
+// and adds testOtherOption to the response
+func createOptionsTestProxy(t *testing.T, allowed []uint16, queries *int32, last *dns.Msg) *Proxy {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.EDNSAllowedOptions = allowed
+	dnsProxy.Upstreams = []upstream.Upstream{&funcUpstream{exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+		atomic.AddInt32(queries, 1)
+		*last = *m.Copy()
+		resp := &dns.Msg{}
+		resp.SetReply(m)
+		resp.Answer = []dns.RR{newRR("example.org. 60 IN A 1.2.3.4")}
+		resp.SetEdns0(4096, false)
+		opt := resp.IsEdns0()
+		if reqOpt := m.IsEdns0(); reqOpt != nil {
+			opt.Option = append(opt.Option, reqOpt.Option...)
+		}
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: testOtherOption, Data: []byte{1}})
+		return resp, nil
+	}}}
+	return dnsProxy
+}
+
+func resolveOptions(t *testing.T, p *Proxy, req *dns.Msg) *dns.Msg {
+	d := &DNSContext{Proto: ProtoUDP, Req: req, Addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}}}
+	require.NoError(t, p.Resolve(d))
+	return d.Res
+}
+
+func TestEDNSAllowedOptions(t *testing.T) {
+	var queries int32
+	var last dns.Msg
+	dnsProxy := createOptionsTestProxy(t, []uint16{testDeviceIDOption}, &queries, &last)
+	require.NoError(t, dnsProxy.Start())
+	defer dnsProxy.Stop()
+
+	// the allowed option is sent to the upstream, the other one is removed both ways
+	res := resolveOptions(t, dnsProxy, optionsRequest(4096, map[uint16][]byte{
+		testDeviceIDOption: []byte("device-1"),
+		testOtherOption:    []byte("secret"),
+	}))
+	assert.Equal(t, []byte("device-1"), optionData(&last, testDeviceIDOption))
+	assert.Nil(t, optionData(&last, testOtherOption))
+	assert.Equal(t, []byte("device-1"), optionData(res, testDeviceIDOption))
+	assert.Nil(t, optionData(res, testOtherOption))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&queries))
+
+	// the same allowed option is served from the cache, the removed option doesn't matter
+	resolveOptions(t, dnsProxy, optionsRequest(4096, map[uint16][]byte{testDeviceIDOption: []byte("device-1")}))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&queries))
+
+	// another device doesn't get the response cached for the first one
+	resolveOptions(t, dnsProxy, optionsRequest(4096, map[uint16][]byte{testDeviceIDOption: []byte("device-2")}))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&queries))
+	resolveOptions(t, dnsProxy, optionsRequest(4096, nil))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&queries))
+
+	// the option that doesn't fit into the payload size is removed
+	resolveOptions(t, dnsProxy, optionsRequest(512, map[uint16][]byte{testDeviceIDOption: bytes.Repeat([]byte{1}, 600)}))
+	assert.Nil(t, optionData(&last, testDeviceIDOption))
+	assert.True(t, last.Len() <= dns.MinMsgSize)
+}
+
+func TestEDNSAllowedOptionsDisabled(t *testing.T) {
+	var queries int32
+	var last dns.Msg
+	dnsProxy := createOptionsTestProxy(t, nil, &queries, &last)
+	require.NoError(t, dnsProxy.Start())
+	defer dnsProxy.Stop()
+
+	// all the options are sent as is
+	res := resolveOptions(t, dnsProxy, optionsRequest(4096, map[uint16][]byte{testOtherOption: []byte("data")}))
+	assert.Equal(t, []byte("data"), optionData(&last, testOtherOption))
+	assert.NotNil(t, optionData(res, testOtherOption))
+}
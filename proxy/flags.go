@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"github.com/miekg/dns"
+)
+
+// ADPolicy defines what the proxy does with the AD (Authenticated Data) flag
+// set by the upstream servers before the response is sent to the client
+type ADPolicy int
+
+const (
+	// ADPolicyClear -- always clear the AD flag.
+	// dnsproxy doesn't validate DNSSEC itself so it can't vouch for the data.
+	// This is the default policy.
+	ADPolicyClear ADPolicy = iota
+
+	// ADPolicyPassthrough -- keep the AD flag set by the upstream, but only
+	// if the client has asked for it (i.e. has set AD or DO in the request).
+	// Use it only when the path to the upstream servers is considered secure.
+	ADPolicyPassthrough
+
+	// ADPolicyPassthroughSecure -- like ADPolicyPassthrough, but the AD flag is only kept
+	// if the response has come from an encrypted upstream (DNS-over-TLS, DNS-over-HTTPS or DNSCrypt,
+	// see upstream.IsEncrypted). The cached responses remember the upstream they have come from.
+	ADPolicyPassthroughSecure
+)
+
+// normalizeResponseFlags adjusts the header flags of the response received from
+// the upstream (or from the cache). RA is always set since from the client's
+// point of view we are a recursive resolver. AD is cleared unless it is allowed
+// by the configured ADPolicy. CD is always copied from the request, i.e. the CD
+// flag set by the upstream is deliberately overwritten.
+// It is called by Resolve only, so the responses of a custom RequestHandler
+// are sent to the client as is.
+func (p *Proxy) normalizeResponseFlags(d *DNSContext) {
+	if d.Res == nil || d.Req == nil {
+		return
+	}
+
+	d.Res.RecursionAvailable = true
+	d.Res.CheckingDisabled = d.Req.CheckingDisabled
+	if d.Res.AuthenticatedData {
+		d.Res.AuthenticatedData = p.adAllowed(d) && isADRequested(d.Req)
+	}
+}
+
+// adAllowed checks if ADPolicy allows to pass the AD flag of the response to the client
+func (p *Proxy) adAllowed(d *DNSContext) bool {
+	switch p.requestState(d).ADPolicy {
+	case ADPolicyPassthrough:
+		return true
+	case ADPolicyPassthroughSecure:
+		return d.secureUpstream
+	}
+	return false
+}
+
+// isADRequested checks if the client is interested in the AD flag.
+// According to RFC 6840 (5.7) it is signaled by setting AD or DO in the request.
+func isADRequested(req *dns.Msg) bool {
+	return req.AuthenticatedData || isDORequested(req)
+}
@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// createADTestProxy creates a proxy that uses an upstream which sets AD and doesn't set RA
+func createADTestProxy(t *testing.T, policy ADPolicy) *Proxy {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.ADPolicy = policy
+	dnsProxy.Upstreams = []upstream.Upstream{&funcUpstream{
+		exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+			resp := &dns.Msg{}
+			resp.SetReply(m)
+			resp.AuthenticatedData = true
+			resp.RecursionAvailable = false
+			resp.CheckingDisabled = false
+			resp.Answer = []dns.RR{newRR(m.Question[0].Name + " 60 IN A 1.2.3.4")}
+			return resp, nil
+		},
+	}}
+	return dnsProxy
+}
+
+func resolveWithFlags(t *testing.T, p *Proxy, host string, ad, do, cd bool) *dns.Msg {
+	req := createHostTestMessage(host)
+	req.AuthenticatedData = ad
+	req.CheckingDisabled = cd
+	if do {
+		req.SetEdns0(4096, true)
+	}
+
+	d := &DNSContext{Req: req, Addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}}}
+	err := p.Resolve(d)
+	assert.Nil(t, err)
+	assert.NotNil(t, d.Res)
+	return d.Res
+}
+
+func TestADPolicyClear(t *testing.T) {
+	dnsProxy := createADTestProxy(t, ADPolicyClear)
+	err := dnsProxy.Start()
+	assert.Nil(t, err)
+	defer dnsProxy.Stop()
+
+	// not cached
+	res := resolveWithFlags(t, dnsProxy, "example.org", true, true, false)
+	assert.True(t, res.RecursionAvailable)
+	assert.False(t, res.AuthenticatedData)
+
+	// cached
+	res = resolveWithFlags(t, dnsProxy, "example.org", true, true, false)
+	assert.True(t, res.RecursionAvailable)
+	assert.False(t, res.AuthenticatedData)
+}
+
+func TestADPolicyPassthrough(t *testing.T) {
+	dnsProxy := createADTestProxy(t, ADPolicyPassthrough)
+	err := dnsProxy.Start()
+	assert.Nil(t, err)
+	defer dnsProxy.Stop()
+
+	// AD is requested and not cached
+	res := resolveWithFlags(t, dnsProxy, "example.org", true, false, false)
+	assert.True(t, res.RecursionAvailable)
+	assert.True(t, res.AuthenticatedData)
+
+	// AD is requested, cached
+	res = resolveWithFlags(t, dnsProxy, "example.org", true, false, false)
+	assert.True(t, res.RecursionAvailable)
+	assert.True(t, res.AuthenticatedData)
+
+	// AD is not requested, cached
+	res = resolveWithFlags(t, dnsProxy, "example.org", false, false, false)
+	assert.True(t, res.RecursionAvailable)
+	assert.False(t, res.AuthenticatedData)
+
+	// DO is set, not cached
+	res = resolveWithFlags(t, dnsProxy, "example.net", false, true, false)
+	assert.True(t, res.AuthenticatedData)
+
+	// DO is set, cached
+	res = resolveWithFlags(t, dnsProxy, "example.net", false, true, false)
+	assert.True(t, res.AuthenticatedData)
+
+	// Neither AD nor DO is set
+	res = resolveWithFlags(t, dnsProxy, "example.com", false, false, false)
+	assert.False(t, res.AuthenticatedData)
+}
+
+func TestADPolicyPassthroughSecure(t *testing.T) {
+	dnsProxy := createADTestProxy(t, ADPolicyPassthroughSecure)
+	err := dnsProxy.Start()
+	assert.Nil(t, err)
+	defer dnsProxy.Stop()
+
+	// the upstream isn't encrypted
+	res := resolveWithFlags(t, dnsProxy, "example.org", true, false, false)
+	assert.False(t, res.AuthenticatedData)
+
+	// cached from an insecure upstream
+	res = resolveWithFlags(t, dnsProxy, "example.org", true, false, false)
+	assert.False(t, res.AuthenticatedData)
+
+	// cached from an encrypted upstream
+	resp := &dns.Msg{}
+	resp.SetReply(createHostTestMessage("example.net"))
+	resp.AuthenticatedData = true
+	resp.Answer = []dns.RR{newRR("example.net. 60 IN A 1.2.3.4")}
+	dnsProxy.cache.set(resp, true, nil)
+	res = resolveWithFlags(t, dnsProxy, "example.net", true, false, false)
+	assert.True(t, res.AuthenticatedData)
+
+	// AD is not requested
+	res = resolveWithFlags(t, dnsProxy, "example.net", false, false, false)
+	assert.False(t, res.AuthenticatedData)
+}
+
+func TestCDPassthrough(t *testing.T) {
+	var upstreamCD bool
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.Upstreams = []upstream.Upstream{&funcUpstream{
+		exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+			upstreamCD = m.CheckingDisabled
+			resp := &dns.Msg{}
+			resp.SetReply(m)
+			resp.CheckingDisabled = false
+			resp.Answer = []dns.RR{newRR(m.Question[0].Name + " 60 IN A 1.2.3.4")}
+			return resp, nil
+		},
+	}}
+	err := dnsProxy.Start()
+	assert.Nil(t, err)
+	defer dnsProxy.Stop()
+
+	res := resolveWithFlags(t, dnsProxy, "example.org", false, false, true)
+	assert.True(t, upstreamCD)
+	assert.True(t, res.CheckingDisabled)
+
+	// cached
+	res = resolveWithFlags(t, dnsProxy, "example.org", false, false, true)
+	assert.True(t, res.CheckingDisabled)
+
+	// cached, CD isn't set in the request anymore
+	res = resolveWithFlags(t, dnsProxy, "example.org", false, false, false)
+	assert.False(t, res.CheckingDisabled)
+}
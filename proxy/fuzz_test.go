@@ -0,0 +1,47 @@
+// +build go1.18
+
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// FuzzHandleUDPPacket passes the packets to the UDP entry point, their processing must never panic.
+// The corpus is in testdata/fuzz/FuzzHandleUDPPacket, run "go test -fuzz FuzzHandleUDPPacket ./proxy" to extend it.
+func FuzzHandleUDPPacket(f *testing.F) {
+	dnsProxy := createTestProxy(f, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.RefuseAny = true
+	dnsProxy.nat64Prefix = prefix
+	dnsProxy.Upstreams = []upstream.Upstream{&funcUpstream{exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+		resp := &dns.Msg{}
+		resp.SetReply(m)
+		resp.Answer = []dns.RR{newRR(m.Question[0].Name + " 60 IN A 1.2.3.4")}
+		return resp, nil
+	}}}
+	require.NoError(f, dnsProxy.Start())
+	defer dnsProxy.Stop()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(f, err)
+	defer conn.Close()
+
+	for _, m := range []*dns.Msg{createTestMessage(), createHostTestMessage("ipv4only.arpa")} {
+		packet, err := m.Pack()
+		require.NoError(f, err)
+		f.Add(packet)
+	}
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		dnsProxy.handleUDPPacket(packet, conn.LocalAddr(), conn, nil)
+		if n := atomic.LoadUint64(&dnsProxy.counters.handlerPanics); n != 0 {
+			t.Fatalf("the request processing has panicked %d times", n)
+		}
+	})
+}
@@ -0,0 +1,340 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// defaultHealthWindow is the default Config.HealthWindow
+const defaultHealthWindow = time.Minute
+
+// healthProbeName is the name resolved by the health check to probe the upstreams
+const healthProbeName = "ipv4only.arpa."
+
+// HealthStatus is the overall health status of the proxy (see Proxy.Health)
+type HealthStatus string
+
+const (
+	// HealthOK -- the proxy is listening and all the upstreams with the recent results have answered
+	HealthOK HealthStatus = "ok"
+	// HealthDegraded -- some upstreams have answered recently, some have failed
+	HealthDegraded HealthStatus = "degraded"
+	// HealthDown -- the proxy isn't listening or none of the upstreams has answered recently
+	HealthDown HealthStatus = "down"
+)
+
+// The statuses of the upstreams (see UpstreamHealth)
+const (
+	upstreamUp      = "up"
+	upstreamDown    = "down"
+	upstreamUnknown = "unknown" // no queries within the window
+)
+
+// Health is the health of the proxy and its upstreams
+type Health struct {
+	Status    HealthStatus     `json:"status"`
+	Listening bool             `json:"listening"`
+	Uptime    time.Duration    `json:"-"`
+	Upstreams []UpstreamHealth `json:"upstreams"`
+	Cache     CacheStats       `json:"cache"`
+}
+
+// UpstreamHealth is the health of an upstream: its last results within Config.HealthWindow
+type UpstreamHealth struct {
+	Address     string     `json:"address"`
+	Name        string     `json:"name,omitempty"` // see upstream.WithName
+	Fallback    bool       `json:"fallback,omitempty"`
+	Status      string     `json:"status"` // "up", "down" or "unknown"
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+
+	// RejectedResponses is the number of the responses rejected by the validation (see UpstreamValidation)
+	RejectedResponses uint64 `json:"rejected_responses,omitempty"`
+
+	// State is "up", "down" or "recovering" if Config.UpstreamFailureThreshold is set
+	State               string `json:"state,omitempty"`
+	ConsecutiveFailures int    `json:"consecutive_failures,omitempty"`
+}
+
+// upstreamResult is the last results of the exchanges with an upstream
+type upstreamResult struct {
+	lastSuccess time.Time
+	lastFailure time.Time
+	lastErr     error
+	rejected    uint64 // the number of the rejected responses
+
+	// the state of the upstream (see recordUpstreamState)
+	failures   int       // the number of the consecutive failures
+	successes  int       // the number of the consecutive successes
+	down       bool      // the upstream is down
+	recovering bool      // the upstream is recovering after it was down
+	downSince  time.Time // the start of the cooldown of the down upstream
+}
+
+// healthState contains the upstream results used by the health check
+type healthState struct {
+	results   map[string]*upstreamResult // the last results per upstream name (see upstream.Name)
+	lock      sync.Mutex                 // protects results
+	probeLock sync.Mutex                 // serializes the probes of the upstreams
+}
+
+// recordUpstreamResult saves the result of the exchange with the upstream for the health check
+func (p *Proxy) recordUpstreamResult(u upstream.Upstream, err error) {
+	p.health.lock.Lock()
+	defer p.health.lock.Unlock()
+
+	if p.health.results == nil {
+		p.health.results = map[string]*upstreamResult{}
+	}
+	r := p.health.results[upstream.Name(u)]
+	if r == nil {
+		r = &upstreamResult{}
+		p.health.results[upstream.Name(u)] = r
+	}
+	if err != nil {
+		r.lastFailure = time.Now()
+		r.lastErr = err
+	} else {
+		r.lastSuccess = time.Now()
+	}
+}
+
+// recordRejectedResponse counts the response of the upstream rejected by the validation
+func (p *Proxy) recordRejectedResponse(u upstream.Upstream) {
+	p.health.lock.Lock()
+	defer p.health.lock.Unlock()
+
+	if p.health.results == nil {
+		p.health.results = map[string]*upstreamResult{}
+	}
+	r := p.health.results[upstream.Name(u)]
+	if r == nil {
+		r = &upstreamResult{}
+		p.health.results[upstream.Name(u)] = r
+	}
+	r.rejected++
+}
+
+// recordParallelResult saves the result of upstream.ExchangeParallel:
+// the upstream that has answered is up, if none has answered, all of them are down
+func (p *Proxy) recordParallelResult(upstreams []upstream.Upstream, u upstream.Upstream, err error) {
+	if err == nil && u != nil {
+		p.recordUpstreamResult(u, nil)
+		return
+	}
+	for _, u := range upstreams {
+		p.recordUpstreamResult(u, err)
+	}
+}
+
+// Health returns the current health of the proxy.
+// The proxy is healthy (HealthOK or HealthDegraded) if it's listening and at least one upstream
+// has answered within Config.HealthWindow. If none of the upstreams has been used within the window
+// (e.g. there were no queries), they are probed first.
+func (p *Proxy) Health() Health {
+	p.RLock()
+	listening := p.started && atomic.LoadInt32(&p.draining) == 0
+	uptime := time.Since(p.startTime)
+	upstreams, fallbacks := p.healthUpstreams()
+	window := p.HealthWindow
+	p.RUnlock()
+	if window <= 0 {
+		window = defaultHealthWindow
+	}
+
+	all := append(upstreams, fallbacks...)
+	h := Health{Listening: listening, Cache: p.CacheStats()}
+	if listening {
+		h.Uptime = uptime
+		if !p.hasRecentResults(all, window) {
+			p.probeUpstreams(all, window)
+		}
+	}
+
+	answered := false
+	failed := false
+	for i, u := range all {
+		uh := p.upstreamHealth(u, window)
+		uh.Fallback = i >= len(upstreams)
+		switch uh.Status {
+		case upstreamUp:
+			answered = true
+		case upstreamDown:
+			failed = true
+		}
+		h.Upstreams = append(h.Upstreams, uh)
+	}
+
+	switch {
+	case !listening || !answered:
+		h.Status = HealthDown
+	case failed:
+		h.Status = HealthDegraded
+	default:
+		h.Status = HealthOK
+	}
+	return h
+}
+
+// healthUpstreams returns the configured upstreams (including the domain-specific ones) and the fallbacks
+// without the duplicates, the callers must hold p's lock
+func (p *Proxy) healthUpstreams() (upstreams, fallbacks []upstream.Upstream) {
+	seen := map[string]bool{}
+	add := func(list []upstream.Upstream, u upstream.Upstream) []upstream.Upstream {
+		if u == nil || seen[upstream.Name(u)] {
+			return list
+		}
+		seen[upstream.Name(u)] = true
+		return append(list, u)
+	}
+
+	for _, u := range p.Upstreams {
+		upstreams = add(upstreams, u)
+	}
+	for _, list := range p.DomainsReservedUpstreams {
+		for _, u := range list {
+			upstreams = add(upstreams, u)
+		}
+	}
+	for _, u := range p.Fallbacks {
+		fallbacks = add(fallbacks, u)
+	}
+	return upstreams, fallbacks
+}
+
+// hasRecentResults checks if any of the upstreams has been used within the window
+func (p *Proxy) hasRecentResults(upstreams []upstream.Upstream, window time.Duration) bool {
+	for _, u := range upstreams {
+		if p.upstreamHealth(u, window).Status != upstreamUnknown {
+			return true
+		}
+	}
+	return false
+}
+
+// probeUpstreams sends a query to each of the upstreams in parallel and saves the results.
+// If another probe is in progress, it waits for it and doesn't probe again.
+func (p *Proxy) probeUpstreams(upstreams []upstream.Upstream, window time.Duration) {
+	p.health.probeLock.Lock()
+	defer p.health.probeLock.Unlock()
+
+	if p.hasRecentResults(upstreams, window) {
+		return
+	}
+
+	if l := p.logger(); l.DebugEnabled() {
+		l.Debugf("Probing %d upstreams for the health check", len(upstreams))
+	}
+	wg := sync.WaitGroup{}
+	for _, u := range upstreams {
+		wg.Add(1)
+		go func(u upstream.Upstream) {
+			defer wg.Done()
+			req := &dns.Msg{}
+			req.SetQuestion(healthProbeName, dns.TypeA)
+			_, err := u.Exchange(req)
+			p.recordUpstreamResult(u, err)
+		}(u)
+	}
+	wg.Wait()
+}
+
+// upstreamHealth returns the health of the upstream within the window
+func (p *Proxy) upstreamHealth(u upstream.Upstream, window time.Duration) UpstreamHealth {
+	uh := UpstreamHealth{Address: u.Address(), Status: upstreamUnknown}
+	if name := upstream.Name(u); name != u.Address() {
+		uh.Name = name
+	}
+
+	p.health.lock.Lock()
+	defer p.health.lock.Unlock()
+
+	r := p.health.results[upstream.Name(u)]
+	if r == nil {
+		return uh
+	}
+	uh.RejectedResponses = r.rejected
+	if p.state().UpstreamFailureThreshold > 0 {
+		uh.State = upstreamState(r)
+		uh.ConsecutiveFailures = r.failures
+	}
+	if !r.lastSuccess.IsZero() {
+		t := r.lastSuccess
+		uh.LastSuccess = &t
+	}
+	if !r.lastFailure.IsZero() {
+		t := r.lastFailure
+		uh.LastFailure = &t
+		uh.LastError = r.lastErr.Error()
+	}
+
+	// the latest result within the window defines the status
+	since := time.Now().Add(-window)
+	switch {
+	case r.lastSuccess.After(since) && !r.lastFailure.After(r.lastSuccess):
+		uh.Status = upstreamUp
+	case r.lastFailure.After(since):
+		uh.Status = upstreamDown
+	}
+	return uh
+}
+
+// healthy checks if the health check responds 200 with the status
+func (p *Proxy) healthy(status HealthStatus) bool {
+	if status == HealthDegraded {
+		p.RLock()
+		defer p.RUnlock()
+		return !p.HealthDegradedUnhealthy
+	}
+	return status == HealthOK
+}
+
+// HealthHandler returns the handler of the health check: /health responds 200 if the proxy is healthy
+// and 503 otherwise (whether HealthDegraded is healthy depends on Config.HealthDegradedUnhealthy),
+// /health/detail responds with the same code and the JSON with the upstreams status, the cache stats and the uptime.
+func (p *Proxy) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", p.serveHealth)
+	mux.HandleFunc("/health/detail", p.serveHealthDetail)
+	return mux
+}
+
+// serveHealth handles the /health requests
+func (p *Proxy) serveHealth(w http.ResponseWriter, r *http.Request) {
+	h := p.Health()
+	w.Header().Set("Content-Type", "text/plain")
+	if !p.healthy(h.Status) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = w.Write([]byte(h.Status))
+}
+
+// healthDetail is the JSON of the /health/detail responses
+type healthDetail struct {
+	Health
+	UptimeSec int64 `json:"uptime_sec"`
+}
+
+// serveHealthDetail handles the /health/detail requests
+func (p *Proxy) serveHealthDetail(w http.ResponseWriter, r *http.Request) {
+	h := p.Health()
+	data, err := json.Marshal(healthDetail{Health: h, UptimeSec: int64(h.Uptime / time.Second)})
+	if err != nil {
+		p.logger().Errorf("cannot encode the health check response: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !p.healthy(h.Status) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = w.Write(data)
+}
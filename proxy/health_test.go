@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// healthTestUpstream is the upstream that fails if failing is set and counts the queries
+type healthTestUpstream struct {
+	addr    string
+	failing int32
+	queries int32
+}
+
+func (u *healthTestUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt32(&u.queries, 1)
+	if atomic.LoadInt32(&u.failing) == 1 {
+		return nil, errors.New("connection refused")
+	}
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	return resp, nil
+}
+
+func (u *healthTestUpstream) Address() string {
+	return u.addr
+}
+
+func getHealth(t *testing.T, p *Proxy, path string) (int, string) {
+	w := httptest.NewRecorder()
+	p.HealthHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w.Code, w.Body.String()
+}
+
+func TestHealth(t *testing.T) {
+	u1 := &healthTestUpstream{addr: "1.1.1.1:53"}
+	u2 := &healthTestUpstream{addr: "2.2.2.2:53"}
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{u1, u2}
+
+	// not started
+	code, body := getHealth(t, dnsProxy, "/health")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "down", body)
+
+	require.NoError(t, dnsProxy.Start())
+	defer dnsProxy.Stop()
+
+	// there were no queries, the upstreams are probed
+	code, body = getHealth(t, dnsProxy, "/health")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", body)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u1.queries))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u2.queries))
+
+	// the recent results are used
+	code, _ = getHealth(t, dnsProxy, "/health")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u1.queries))
+
+	// one of the upstreams fails, the proxy is degraded but healthy
+	atomic.StoreInt32(&u1.failing, 1)
+	dnsProxy.recordUpstreamResult(u1, errors.New("connection refused"))
+	code, body = getHealth(t, dnsProxy, "/health/detail")
+	assert.Equal(t, http.StatusOK, code)
+
+	detail := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(body), &detail))
+	assert.Equal(t, "degraded", detail["status"])
+	assert.Equal(t, true, detail["listening"])
+	assert.Contains(t, detail, "uptime_sec")
+	assert.Contains(t, detail["cache"], "hits")
+	upstreams := detail["upstreams"].([]interface{})
+	require.Len(t, upstreams, 2)
+	assert.Equal(t, "1.1.1.1:53", upstreams[0].(map[string]interface{})["address"])
+	assert.Equal(t, "down", upstreams[0].(map[string]interface{})["status"])
+	assert.Equal(t, "connection refused", upstreams[0].(map[string]interface{})["last_error"])
+	assert.Equal(t, "up", upstreams[1].(map[string]interface{})["status"])
+
+	// the degraded proxy is unhealthy with HealthDegradedUnhealthy
+	dnsProxy.HealthDegradedUnhealthy = true
+	code, body = getHealth(t, dnsProxy, "/health")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "degraded", body)
+	dnsProxy.HealthDegradedUnhealthy = false
+
+	// all the upstreams fail
+	dnsProxy.recordUpstreamResult(u2, errors.New("timeout"))
+	code, body = getHealth(t, dnsProxy, "/health")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "down", body)
+}
+
+func TestHealthWindow(t *testing.T) {
+	u := &healthTestUpstream{addr: "1.1.1.1:53"}
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{u}
+	dnsProxy.HealthWindow = 50 * time.Millisecond
+	require.NoError(t, dnsProxy.Start())
+	defer dnsProxy.Stop()
+
+	// the queries are recorded
+	client := &dns.Client{Net: "udp", Timeout: time.Second}
+	_, _, err := client.Exchange(createTestMessage(), dnsProxy.Addr(ProtoUDP).String())
+	require.NoError(t, err)
+	h := dnsProxy.Health()
+	assert.Equal(t, HealthOK, h.Status)
+	assert.NotNil(t, h.Upstreams[0].LastSuccess)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.queries))
+
+	// the old failure is outside of the window, the upstream is probed again
+	dnsProxy.recordUpstreamResult(u, errors.New("timeout"))
+	time.Sleep(100 * time.Millisecond)
+	h = dnsProxy.Health()
+	assert.Equal(t, HealthOK, h.Status)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&u.queries))
+}
@@ -6,7 +6,6 @@ import (
 	"net"
 	"strings"
 
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/miekg/dns"
 )
 
@@ -14,9 +13,12 @@ const retryNoError = 60 // Retry time for NoError SOA
 
 // CheckDisabledAAAARequest checks if AAAA requests should be disabled or not and sets NoError empty response to given DNSContext if needed
 func CheckDisabledAAAARequest(ctx *DNSContext, ipv6Disabled bool) bool {
-	if ipv6Disabled && ctx.Req.Question[0].Qtype == dns.TypeAAAA {
-		log.Debug("IPv6 is disabled. Reply with NoError to %s AAAA request", ctx.Req.Question[0].Name)
+	if ipv6Disabled && len(ctx.Req.Question) > 0 && ctx.Req.Question[0].Qtype == dns.TypeAAAA {
+		if l := ctx.logger(); l.DebugEnabled() {
+			l.Debugf("IPv6 is disabled. Reply with NoError to %s AAAA request", ctx.Req.Question[0].Name)
+		}
 		ctx.Res = genEmptyNoError(ctx.Req)
+		ctx.IPv6Blocked = true
 		return true
 	}
 
@@ -97,6 +99,17 @@ func getIPString(addr net.Addr) string {
 	return ""
 }
 
+// getIP is a helper function that extracts IP address from net.Addr
+func getIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
 // readPrefixed reads DNS message prefixed with its length (2 bytes)
 func readPrefixed(conn *net.Conn) ([]byte, error) {
 	buf := make([]byte, 2+dns.MaxMsgSize)
@@ -249,18 +262,3 @@ func isPublicIP(ip net.IP) bool {
 
 	return true
 }
-
-// split string by a byte and return the first chunk
-// Whitespace is trimmed
-func splitNext(str *string, splitBy byte) string {
-	i := strings.IndexByte(*str, splitBy)
-	s := ""
-	if i != -1 {
-		s = (*str)[0:i]
-		*str = (*str)[i+1:]
-	} else {
-		s = *str
-		*str = ""
-	}
-	return strings.TrimSpace(s)
-}
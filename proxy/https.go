@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/dnsproxy/internal/version"
+)
+
+// defaultHTTPSServerPath is the URL path of the DoH server if Config.HTTPSServerPaths is empty
+const defaultHTTPSServerPath = "/dns-query"
+
+// newHTTPSHandler creates the handler of the built-in HTTPS server for the listener l.
+// DNS queries are served on each of the configured paths (see ServeHTTP) and on the JSON API path,
+// requests to any other path get 404 (or 200 on "/" if the health check is enabled).
+func (p *Proxy) newHTTPSHandler(l *listener) http.Handler {
+	paths := p.HTTPSServerPaths
+	if len(paths) == 0 {
+		paths = []string{defaultHTTPSServerPath}
+	}
+
+	mux := http.NewServeMux()
+	handled := map[string]bool{}
+	for _, path := range append([]string{jsonAPIPath}, paths...) {
+		if handled[path] {
+			continue
+		}
+		mux.Handle(path, p)
+		handled[path] = true
+
+		subtree := strings.TrimSuffix(path, "/") + "/"
+		if len(p.DoHAuthTokens) > 0 && !handled[subtree] {
+			// the token may be passed as the last path component
+			mux.Handle(subtree, p)
+			handled[subtree] = true
+		}
+	}
+	if !handled["/"] {
+		mux.HandleFunc("/", p.serveHTTPSRoot)
+	}
+
+	return withListener(mux, l)
+}
+
+// serveHTTPSRoot handles the requests that don't match any of the DoH paths
+func (p *Proxy) serveHTTPSRoot(w http.ResponseWriter, r *http.Request) {
+	if p.state().HTTPSHealthCheck && r.URL.Path == "/" {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("OK"))
+		return
+	}
+
+	if l := p.logger(); l.DebugEnabled() {
+		l.Debugf("Not found: %s", r.URL.Path)
+	}
+	http.NotFound(w, r)
+}
+
+// serverHeader returns the Server header of the DoH responses
+func (p *Proxy) serverHeader() string {
+	if p.state().HTTPSServerVersion {
+		return "AdGuard DNS dnsproxy/" + version.Version()
+	}
+	return "AdGuard DNS"
+}
+
+// authorizeDoH checks the DoH authentication token if DoHAuthTokens are configured.
+// The token is passed either in the "Authorization: Bearer <token>" header
+// or as the last path component (/dns-query/<token>), it is removed from the request in both cases.
+// If the token is invalid, it responds 403 (or 429 if there were too many failed attempts) and returns false.
+func (p *Proxy) authorizeDoH(w http.ResponseWriter, r *http.Request) bool {
+	if len(p.state().DoHAuthTokens) == 0 {
+		return true
+	}
+
+	token := extractDoHToken(r)
+	ip := ""
+	if addr, err := p.remoteAddr(r); err == nil {
+		ip = getIPString(addr)
+	}
+
+	if p.isAuthFailuresLimitReached(ip) {
+		if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("Too many failed DoH authentication attempts from %s", ip)
+		}
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return false
+	}
+
+	if !p.isValidDoHToken(token) {
+		if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("DoH authentication failed for %s", ip)
+		}
+		atomic.AddUint64(&p.counters.dohAuthFailures, 1)
+		p.registerAuthFailure(ip)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+// extractDoHToken returns the DoH authentication token and strips it from the request
+func extractDoHToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		r.Header.Del("Authorization")
+		return strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	}
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	i := strings.LastIndexByte(path, '/')
+	if i <= 0 {
+		return ""
+	}
+
+	r.URL.Path = path[:i]
+	r.URL.RawPath = ""
+	return path[i+1:]
+}
+
+// isValidDoHToken checks if the token is one of DoHAuthTokens, the comparison is constant-time
+func (p *Proxy) isValidDoHToken(token string) bool {
+	if token == "" {
+		return false
+	}
+
+	valid := 0
+	for _, t := range p.state().DoHAuthTokens {
+		valid |= subtle.ConstantTimeCompare([]byte(t), []byte(token))
+	}
+	return valid == 1
+}
@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// jsonAPIPath is the URL path of the JSON DNS API
+	jsonAPIPath = "/resolve"
+
+	// jsonContentType is the media type of the JSON DNS API requests and responses
+	jsonContentType = "application/dns-json"
+)
+
+// jsonMsg is a DNS message in the JSON format used by Google and Cloudflare DNS APIs
+type jsonMsg struct {
+	Status     int            `json:"Status"`
+	TC         bool           `json:"TC"`
+	RD         bool           `json:"RD"`
+	RA         bool           `json:"RA"`
+	AD         bool           `json:"AD"`
+	CD         bool           `json:"CD"`
+	Question   []jsonQuestion `json:"Question"`
+	Answer     []jsonRR       `json:"Answer,omitempty"`
+	Authority  []jsonRR       `json:"Authority,omitempty"`
+	Additional []jsonRR       `json:"Additional,omitempty"`
+}
+
+// jsonQuestion is a question of jsonMsg
+type jsonQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+// jsonRR is a resource record of jsonMsg
+type jsonRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// jsonError is the body of the JSON DNS API error responses
+type jsonError struct {
+	Error string `json:"error"`
+}
+
+// isJSONRequest checks if the HTTP request is a JSON DNS API request:
+// either a request to /resolve or a request that accepts application/dns-json
+func isJSONRequest(r *http.Request) bool {
+	if r == nil {
+		return false
+	}
+	return r.URL.Path == jsonAPIPath || strings.Contains(r.Header.Get("Accept"), jsonContentType)
+}
+
+// serveJSON handles the JSON DNS API request: the query parameters are converted to a DNS request
+// which is processed as usual, and the response is rendered by respondJSON
+func (p *Proxy) serveJSON(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("Wrong HTTP method: %s", r.Method)
+		}
+		writeJSONError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+
+	msg, err := jsonToDNSRequest(r.URL.Query())
+	if err != nil {
+		if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("Invalid JSON DNS API request %s: %s", r.URL, err)
+		}
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	addr, _ := p.remoteAddr(r)
+
+	d := &DNSContext{
+		Proto:              ProtoHTTPS,
+		Req:                msg,
+		Addr:               addr,
+		HTTPRequest:        r,
+		HTTPResponseWriter: w,
+		ClientCert:         clientCert(r.TLS),
+		ListenAddr:         localAddrFromHTTPRequest(r),
+		listener:           listenerFromHTTPRequest(r),
+		ctx:                r.Context(),
+	}
+
+	err = p.handleDNSRequest(d)
+	if err != nil {
+		if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("error handling DNS (%s) request: %s", d.Proto, err)
+		}
+	}
+}
+
+// jsonToDNSRequest creates a DNS request from the JSON DNS API query parameters:
+// name (required), type (name or number, A by default), do and cd ("1" or "true")
+func jsonToDNSRequest(q url.Values) (*dns.Msg, error) {
+	name := q.Get("name")
+	if name == "" {
+		return nil, errors.New("name is required")
+	}
+	name = dns.Fqdn(name)
+	if _, ok := dns.IsDomainName(name); !ok || len(name) > 254 {
+		return nil, fmt.Errorf("invalid name: %s", q.Get("name"))
+	}
+
+	qType := dns.TypeA
+	if t := q.Get("type"); t != "" {
+		if v, err := strconv.ParseUint(t, 10, 16); err == nil {
+			qType = uint16(v)
+		} else if v, ok := dns.StringToType[strings.ToUpper(t)]; ok {
+			qType = v
+		} else {
+			return nil, fmt.Errorf("invalid type: %s", t)
+		}
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion(name, qType)
+	req.CheckingDisabled = jsonBoolParam(q.Get("cd"))
+	if jsonBoolParam(q.Get("do")) {
+		req.SetEdns0(4096, true)
+	}
+	return req, nil
+}
+
+// jsonBoolParam parses the boolean query parameter
+func jsonBoolParam(v string) bool {
+	return v == "1" || strings.EqualFold(v, "true")
+}
+
+// dnsMsgToJSON converts the DNS message into the JSON DNS API format
+func dnsMsgToJSON(m *dns.Msg) *jsonMsg {
+	res := &jsonMsg{
+		Status:     m.Rcode,
+		TC:         m.Truncated,
+		RD:         m.RecursionDesired,
+		RA:         m.RecursionAvailable,
+		AD:         m.AuthenticatedData,
+		CD:         m.CheckingDisabled,
+		Question:   []jsonQuestion{},
+		Answer:     jsonRRs(m.Answer),
+		Authority:  jsonRRs(m.Ns),
+		Additional: jsonRRs(m.Extra),
+	}
+
+	for _, q := range m.Question {
+		res.Question = append(res.Question, jsonQuestion{Name: q.Name, Type: q.Qtype})
+	}
+	return res
+}
+
+// jsonRRs converts the resource records into the JSON DNS API format (OPT records are skipped)
+func jsonRRs(rrs []dns.RR) []jsonRR {
+	var res []jsonRR
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		res = append(res, jsonRR{
+			Name: h.Name,
+			Type: h.Rrtype,
+			TTL:  h.Ttl,
+			Data: strings.TrimPrefix(rr.String(), h.String()),
+		})
+	}
+	return res
+}
+
+// respondJSON writes the response to the JSON DNS API client
+func (p *Proxy) respondJSON(d *DNSContext) error {
+	w := d.HTTPResponseWriter
+	w.Header().Set("Server", p.serverHeader())
+	w.Header().Set("Content-Type", jsonContentType)
+	return json.NewEncoder(w).Encode(dnsMsgToJSON(d.Res))
+}
+
+// writeJSONError writes the error response to the JSON DNS API client
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(jsonError{Error: msg})
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func doJSONRequest(t *testing.T, h http.Handler, url string, accept bool) (*httptest.ResponseRecorder, *jsonMsg) {
+	r := httptest.NewRequest(http.MethodGet, url, nil)
+	if accept {
+		r.Header.Set("Accept", jsonContentType)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		return w, nil
+	}
+	assert.Equal(t, jsonContentType, w.Header().Get("Content-Type"))
+	m := &jsonMsg{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), m))
+	return w, m
+}
+
+func TestJSONAPI(t *testing.T) {
+	var upstreamReq *dns.Msg
+	p := &Proxy{}
+	p.Upstreams = []upstream.Upstream{&funcUpstream{
+		exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+			upstreamReq = m
+			resp := &dns.Msg{}
+			resp.SetReply(m)
+			resp.Answer = []dns.RR{newRR(m.Question[0].Name + " 60 IN AAAA 2001:db8::1")}
+			return resp, nil
+		},
+	}}
+	p.Init()
+	h := p.newHTTPSHandler(nil)
+
+	_, m := doJSONRequest(t, h, "/resolve?name=example.org&type=AAAA&cd=1&do=true", false)
+	require.NotNil(t, m)
+	assert.Equal(t, dns.RcodeSuccess, m.Status)
+	assert.True(t, m.RD)
+	assert.True(t, m.RA)
+	assert.True(t, m.CD)
+	assert.Equal(t, []jsonQuestion{{Name: "example.org.", Type: dns.TypeAAAA}}, m.Question)
+	require.Len(t, m.Answer, 1)
+	assert.Equal(t, jsonRR{Name: "example.org.", Type: dns.TypeAAAA, TTL: 60, Data: "2001:db8::1"}, m.Answer[0])
+
+	require.NotNil(t, upstreamReq)
+	assert.True(t, upstreamReq.CheckingDisabled)
+	require.NotNil(t, upstreamReq.IsEdns0())
+	assert.True(t, upstreamReq.IsEdns0().Do())
+
+	// numeric type on the DoH path
+	_, m = doJSONRequest(t, h, "/dns-query?name=example.net&type=28", true)
+	require.NotNil(t, m)
+	assert.Equal(t, []jsonQuestion{{Name: "example.net.", Type: dns.TypeAAAA}}, m.Question)
+}
+
+func TestJSONAPIErrors(t *testing.T) {
+	p := createHTTPSTestProxy(t)
+	h := p.newHTTPSHandler(nil)
+
+	for _, url := range []string{
+		"/resolve",
+		"/resolve?name=example..org",
+		"/resolve?name=example.org&type=WRONG",
+		"/resolve?name=example.org&type=100000",
+	} {
+		w, _ := doJSONRequest(t, h, url, true)
+		assert.Equal(t, http.StatusBadRequest, w.Code, url)
+
+		e := &jsonError{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), e))
+		assert.NotEmpty(t, e.Error)
+	}
+}
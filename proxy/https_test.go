@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createHTTPSTestProxy creates a proxy with the test upstream that answers to any request.
+// The proxy isn't started, use its HTTPS handler to send requests.
+func createHTTPSTestProxy(t *testing.T) *Proxy {
+	var upstreamCount int32
+	p := &Proxy{}
+	p.Upstreams = []upstream.Upstream{createCountingUpstream(&upstreamCount)}
+	p.Init()
+	return p
+}
+
+// doHTTPSRequest sends a DoH request (GET or POST) to the handler and returns the recorded response
+func doHTTPSRequest(t *testing.T, h http.Handler, method, path string) *httptest.ResponseRecorder {
+	buf, err := createTestMessage().Pack()
+	require.NoError(t, err)
+
+	var r *http.Request
+	if method == http.MethodGet {
+		r = httptest.NewRequest(method, path+"?dns="+base64.RawURLEncoding.EncodeToString(buf), nil)
+	} else {
+		r = httptest.NewRequest(method, path, bytes.NewReader(buf))
+		r.Header.Set("Content-Type", "application/dns-message")
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestHTTPSServerPaths(t *testing.T) {
+	p := createHTTPSTestProxy(t)
+	p.HTTPSServerPaths = []string{"/dns-query", "/secret-path"}
+	h := p.newHTTPSHandler(nil)
+
+	for _, path := range p.HTTPSServerPaths {
+		for _, method := range []string{http.MethodGet, http.MethodPost} {
+			w := doHTTPSRequest(t, h, method, path)
+			require.Equal(t, http.StatusOK, w.Code, "%s %s", method, path)
+			assert.Equal(t, "application/dns-message", w.Header().Get("Content-Type"))
+
+			reply := &dns.Msg{}
+			require.NoError(t, reply.Unpack(w.Body.Bytes()))
+			assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+		}
+	}
+
+	for _, path := range []string{"/", "/dns-query/", "/other"} {
+		w := doHTTPSRequest(t, h, http.MethodGet, path)
+		assert.Equal(t, http.StatusNotFound, w.Code, path)
+	}
+}
+
+func TestHTTPSDefaultPath(t *testing.T) {
+	p := createHTTPSTestProxy(t)
+	h := p.newHTTPSHandler(nil)
+
+	w := doHTTPSRequest(t, h, http.MethodPost, defaultHTTPSServerPath)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = doHTTPSRequest(t, h, http.MethodPost, "/other")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestHTTPSHealthCheck(t *testing.T) {
+	p := createHTTPSTestProxy(t)
+	p.HTTPSHealthCheck = true
+	h := p.newHTTPSHandler(nil)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/other", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestDoHAuthTokens(t *testing.T) {
+	var reqPath string
+	p := createHTTPSTestProxy(t)
+	p.DoHAuthTokens = []string{"token1", "token2"}
+	p.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		reqPath = d.HTTPRequest.URL.Path
+		return p.Resolve(d)
+	}
+	h := p.newHTTPSHandler(nil)
+
+	// token in the path
+	w := doHTTPSRequest(t, h, http.MethodGet, "/dns-query/token2")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "/dns-query", reqPath)
+
+	// bearer token
+	buf, err := createTestMessage().Pack()
+	require.NoError(t, err)
+	r := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(buf))
+	r.Header.Set("Content-Type", "application/dns-message")
+	r.Header.Set("Authorization", "Bearer token1")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, r.Header.Get("Authorization"))
+
+	// no token or a wrong one
+	reqPath = ""
+	for _, path := range []string{"/dns-query", "/dns-query/token3", "/dns-query/token1x"} {
+		w = doHTTPSRequest(t, h, http.MethodGet, path)
+		assert.Equal(t, http.StatusForbidden, w.Code, path)
+	}
+	assert.Empty(t, reqPath)
+	assert.Equal(t, uint64(3), p.Stats().DoHAuthFailures)
+}
+
+func TestDoHAuthFailuresRatelimit(t *testing.T) {
+	p := createHTTPSTestProxy(t)
+	p.DoHAuthTokens = []string{"token"}
+	p.DoHAuthFailuresRatelimit = 2
+	h := p.newHTTPSHandler(nil)
+
+	assert.Equal(t, http.StatusForbidden, doHTTPSRequest(t, h, http.MethodGet, "/dns-query/wrong").Code)
+	assert.Equal(t, http.StatusForbidden, doHTTPSRequest(t, h, http.MethodGet, "/dns-query/wrong").Code)
+
+	// even the valid token is rejected now
+	assert.Equal(t, http.StatusTooManyRequests, doHTTPSRequest(t, h, http.MethodGet, "/dns-query/token").Code)
+}
+
+func TestHTTPSServerVersion(t *testing.T) {
+	p := createHTTPSTestProxy(t)
+	h := p.newHTTPSHandler(nil)
+
+	w := doHTTPSRequest(t, h, http.MethodPost, defaultHTTPSServerPath)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "AdGuard DNS", w.Header().Get("Server"))
+
+	p.HTTPSServerVersion = true
+	w = doHTTPSRequest(t, h, http.MethodPost, defaultHTTPSServerPath)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "AdGuard DNS dnsproxy/dev", w.Header().Get("Server"))
+}
@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"github.com/AdguardTeam/dnsproxy/upstream"
+)
+
+// CloseIdleConnections closes the idle connections of all the upstreams, including the fallbacks,
+// the domain-specific upstreams and the upstreams of the client groups (see upstream.CloseIdleConnections)
+func (p *Proxy) CloseIdleConnections() {
+	p.RLock()
+	all := [][]upstream.Upstream{p.Upstreams, p.Fallbacks}
+	for _, ups := range p.DomainsReservedUpstreams {
+		all = append(all, ups)
+	}
+	for _, s := range p.ClientsSettings {
+		if s.UpstreamConfig == nil {
+			continue
+		}
+		all = append(all, s.UpstreamConfig.Upstreams)
+		for _, ups := range s.UpstreamConfig.DomainReservedUpstreams {
+			all = append(all, ups)
+		}
+	}
+	p.RUnlock()
+
+	for _, ups := range all {
+		for _, u := range ups {
+			upstream.CloseIdleConnections(u)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// listener contains the context of a listen address that is passed to every request it receives
+type listener struct {
+	proto   string         // "udp", "tcp", "tls" or "https"
+	key     string         // see ListenerKey
+	handler RequestHandler // overrides Config.RequestHandler if not nil
+
+	forwardedClasses []uint16 // the classes other than IN forwarded to the upstreams (see Config.ListenerForwardedClasses)
+
+	udpWriter *udpBatchWriter // sends the UDP responses in batches (nil if not supported)
+}
+
+// listenerContextKey is the key of the listener in the HTTP request context
+type listenerContextKey struct{}
+
+// ListenerKey returns the key of the listen address in Config.ListenerRequestHandlers.
+// addr is the listen address as it is configured, e.g. ListenerKey("udp", &net.UDPAddr{...}) returns "udp://127.0.0.1:53".
+func ListenerKey(proto string, addr net.Addr) string {
+	return proto + "://" + addr.String()
+}
+
+// newListener creates the context of the listen address
+func (p *Proxy) newListener(proto string, addr net.Addr) *listener {
+	key := ListenerKey(proto, addr)
+	return &listener{
+		proto:   proto,
+		key:     key,
+		handler: p.ListenerRequestHandlers[key],
+
+		forwardedClasses: p.ListenerForwardedClasses[key],
+	}
+}
+
+// classForwarded checks if the queries of the class are forwarded by the listener (it may be nil)
+func (l *listener) classForwarded(class uint16) bool {
+	if l == nil {
+		return false
+	}
+	for _, c := range l.forwardedClasses {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// requestHandler returns the custom request handler for the request:
+// the handler of the listener that received it or the global RequestHandler
+func (p *Proxy) requestHandler(d *DNSContext) RequestHandler {
+	if d.listener != nil && d.listener.handler != nil {
+		return d.listener.handler
+	}
+	return p.requestState(d).RequestHandler
+}
+
+// withListener adds the listener context to the HTTP requests passed to h
+func withListener(h http.Handler, l *listener) http.Handler {
+	if l == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), listenerContextKey{}, l)))
+	})
+}
+
+// listenerFromHTTPRequest returns the listener that received the HTTP request (or nil)
+func listenerFromHTTPRequest(r *http.Request) *listener {
+	l, _ := r.Context().Value(listenerContextKey{}).(*listener)
+	return l
+}
+
+// localAddrFromHTTPRequest returns the local address of the connection the HTTP request was received on (or nil)
+func localAddrFromHTTPRequest(r *http.Request) net.Addr {
+	addr, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return addr
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ListenerStats contains the counters of the queries received by a listen address (see Stats.Listeners)
+type ListenerStats struct {
+	Listener string // the listener key, e.g. "udp://127.0.0.1:53" (see ListenerKey)
+	Proto    string // the ingress protocol: "udp", "tcp", "tls" or "https"
+
+	Statuses map[string]uint64 // number of the processed queries by their statuses (see Status.String)
+	Errors   uint64            // number of the processed queries whose status isn't StatusOK
+	Duration time.Duration     // total processing time of the queries
+}
+
+// listenerCounters contains the counters of a listener that are updated atomically.
+// It's allocated separately, so the 64-bit fields are aligned on 32-bit platforms.
+type listenerCounters struct {
+	duration uint64 // in nanoseconds
+	statuses [statusCount]uint64
+	proto    string
+}
+
+// recordListenerQuery counts the processed query by the listener that received it.
+// The queries that haven't come through a listener (see Resolve) aren't counted.
+func (p *Proxy) recordListenerQuery(d *DNSContext) {
+	if d.listener == nil || d.Status < 0 || d.Status >= statusCount {
+		return
+	}
+
+	p.listenerStatsLock.Lock()
+	c, ok := p.listenerStats[d.listener.key]
+	if !ok {
+		if p.listenerStats == nil {
+			p.listenerStats = map[string]*listenerCounters{}
+		}
+		c = &listenerCounters{proto: d.listener.proto}
+		p.listenerStats[d.listener.key] = c
+	}
+	p.listenerStatsLock.Unlock()
+
+	atomic.AddUint64(&c.statuses[d.Status], 1)
+	atomic.AddUint64(&c.duration, uint64(time.Since(d.StartTime)))
+}
+
+// listenersStats returns a snapshot of the listeners counters sorted by the listener keys
+func (p *Proxy) listenersStats() []ListenerStats {
+	p.listenerStatsLock.Lock()
+	defer p.listenerStatsLock.Unlock()
+
+	res := make([]ListenerStats, 0, len(p.listenerStats))
+	for key, c := range p.listenerStats {
+		s := ListenerStats{
+			Listener: key,
+			Proto:    c.proto,
+			Statuses: make(map[string]uint64, statusCount),
+			Duration: time.Duration(atomic.LoadUint64(&c.duration)),
+		}
+		for st := Status(0); st < statusCount; st++ {
+			n := atomic.LoadUint64(&c.statuses[st])
+			s.Statuses[st.String()] = n
+			if st != StatusOK {
+				s.Errors += n
+			}
+		}
+		res = append(res, s)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Listener < res[j].Listener })
+	return res
+}
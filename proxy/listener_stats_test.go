@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenerStats(t *testing.T) {
+	u := &funcUpstream{exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+		if m.Question[0].Name == "fail.example.org." {
+			return nil, errors.New("upstream error")
+		}
+		resp := &dns.Msg{}
+		resp.SetReply(m)
+		resp.Answer = []dns.RR{newRR(m.Question[0].Name + " 60 IN A 1.2.3.4")}
+		return resp, nil
+	}}
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{u}
+	require.NoError(t, dnsProxy.Start())
+	defer dnsProxy.Stop()
+
+	exchange := func(proto, name string) {
+		client := &dns.Client{Net: proto, Timeout: time.Second}
+		_, _, err := client.Exchange(createHostTestMessage(name), dnsProxy.Addr(proto).String())
+		require.NoError(t, err)
+	}
+	exchange(ProtoUDP, "example.org")
+	exchange(ProtoUDP, "fail.example.org")
+	exchange(ProtoTCP, "example.org")
+
+	// the queries resolved directly aren't counted
+	d := &DNSContext{Proto: ProtoUDP, Req: createHostTestMessage("example.org")}
+	require.NoError(t, dnsProxy.Resolve(d))
+
+	// the queries are counted after the responses are sent
+	var stats []ListenerStats
+	require.Eventually(t, func() bool {
+		stats = dnsProxy.Stats().Listeners
+		return len(stats) == 2 && stats[0].Statuses["ok"] == 1 && stats[1].Statuses["ok"]+stats[1].Errors == 2
+	}, time.Second, 10*time.Millisecond)
+	tcp, udp := stats[0], stats[1]
+
+	assert.Equal(t, ListenerKey(ProtoTCP, dnsProxy.TCPListenAddr[0]), tcp.Listener)
+	assert.Equal(t, ProtoTCP, tcp.Proto)
+	assert.Equal(t, uint64(1), tcp.Statuses["ok"])
+	assert.Equal(t, uint64(0), tcp.Errors)
+
+	assert.Equal(t, ListenerKey(ProtoUDP, dnsProxy.UDPListenAddr[0]), udp.Listener)
+	assert.Equal(t, ProtoUDP, udp.Proto)
+	assert.Equal(t, uint64(1), udp.Statuses["ok"])
+	assert.Equal(t, uint64(1), udp.Statuses["upstream_error"])
+	assert.Equal(t, uint64(1), udp.Errors)
+	assert.True(t, udp.Duration > 0)
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createRcodeHandler creates a request handler that answers with the specified rcode
+// and records the listen address of the request
+func createRcodeHandler(rcode int, listenAddrs *sync.Map) RequestHandler {
+	return func(p *Proxy, d *DNSContext) error {
+		listenAddrs.Store(rcode, d.ListenAddr.String())
+		d.Res = GenEmptyMessage(d.Req, rcode, retryNoError)
+		return nil
+	}
+}
+
+func TestListenerRequestHandlers(t *testing.T) {
+	lanAddr := &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 0}
+	hostAddr := &net.UDPAddr{IP: net.IP{127, 0, 0, 2}, Port: 0}
+
+	listenAddrs := &sync.Map{}
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UDPListenAddr = []*net.UDPAddr{lanAddr, hostAddr}
+	dnsProxy.RequestHandler = createRcodeHandler(dns.RcodeNameError, listenAddrs)
+	dnsProxy.ListenerRequestHandlers = map[string]RequestHandler{
+		ListenerKey(ProtoUDP, hostAddr): createRcodeHandler(dns.RcodeSuccess, listenAddrs),
+	}
+	err := dnsProxy.Start()
+	require.NoError(t, err)
+	defer dnsProxy.Stop()
+
+	addrs := dnsProxy.Addrs(ProtoUDP)
+	require.Len(t, addrs, 2)
+	assert.Equal(t, addrs[0], dnsProxy.Addr(ProtoUDP))
+
+	client := &dns.Client{Net: "udp", Timeout: 500 * time.Millisecond}
+
+	// the global handler
+	r, _, err := client.Exchange(createTestMessage(), addrs[0].String())
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeNameError, r.Rcode)
+	addr, _ := listenAddrs.Load(dns.RcodeNameError)
+	assert.Equal(t, addrs[0].String(), addr)
+
+	// the listener's handler
+	r, _, err = client.Exchange(createTestMessage(), addrs[1].String())
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, r.Rcode)
+	addr, _ = listenAddrs.Load(dns.RcodeSuccess)
+	assert.Equal(t, addrs[1].String(), addr)
+
+	// the global handler is used by TCP listener
+	tcpClient := &dns.Client{Net: "tcp", Timeout: 500 * time.Millisecond}
+	r, _, err = tcpClient.Exchange(createTestMessage(), dnsProxy.Addr(ProtoTCP).String())
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeNameError, r.Rcode)
+}
+
+func TestUDPListeners(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	listenAddrs := &sync.Map{}
+	newProxy := func(closeListeners bool) *Proxy {
+		dnsProxy := createTestProxy(t, nil)
+		dnsProxy.UDPListenAddr = nil
+		dnsProxy.TCPListenAddr = nil
+		dnsProxy.UDPListeners = []*net.UDPConn{conn}
+		dnsProxy.CloseUDPListeners = closeListeners
+		dnsProxy.RequestHandler = createRcodeHandler(dns.RcodeSuccess, listenAddrs)
+		return dnsProxy
+	}
+	client := &dns.Client{Net: "udp", Timeout: 500 * time.Millisecond}
+
+	// the caller's socket isn't closed on Stop and can be served again
+	for i := 0; i < 2; i++ {
+		dnsProxy := newProxy(false)
+		require.NoError(t, dnsProxy.Start())
+		assert.Equal(t, conn.LocalAddr(), dnsProxy.Addr(ProtoUDP))
+		r, _, err := client.Exchange(createTestMessage(), conn.LocalAddr().String())
+		require.NoError(t, err)
+		assert.Equal(t, dns.RcodeSuccess, r.Rcode)
+		require.NoError(t, dnsProxy.Stop())
+	}
+	_, err = conn.WriteTo([]byte{0}, conn.LocalAddr())
+	assert.NoError(t, err)
+
+	// unless CloseUDPListeners is set
+	dnsProxy := newProxy(true)
+	require.NoError(t, dnsProxy.Start())
+	require.NoError(t, dnsProxy.Stop())
+	_, err = conn.WriteTo([]byte{0}, conn.LocalAddr())
+	assert.Error(t, err)
+
+	dnsProxy = newProxy(false)
+	dnsProxy.UDPListeners = []*net.UDPConn{nil}
+	assert.Error(t, dnsProxy.Start())
+}
+
+func TestUDPBufferSize(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UDPBufferSize = 512
+	dnsProxy.RequestHandler = createRcodeHandler(dns.RcodeSuccess, &sync.Map{})
+	require.NoError(t, dnsProxy.Start())
+	defer dnsProxy.Stop()
+
+	client := &dns.Client{Net: "udp", Timeout: 200 * time.Millisecond, UDPSize: dns.MaxMsgSize}
+	r, _, err := client.Exchange(createTestMessage(), dnsProxy.Addr(ProtoUDP).String())
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, r.Rcode)
+
+	// the query that doesn't fit into the buffer is dropped
+	req := createTestMessage()
+	req.SetEdns0(4096, false)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 1024)})
+	_, _, err = client.Exchange(req, dnsProxy.Addr(ProtoUDP).String())
+	assert.Error(t, err)
+}
@@ -0,0 +1,14 @@
+package proxy
+
+import "github.com/AdguardTeam/dnsproxy/proxyutil"
+
+// logger returns Config.Logger or the default logger if it isn't set
+func (p *Proxy) logger() proxyutil.Logger {
+	return proxyutil.LoggerOrDefault(p.state().Logger)
+}
+
+// logger returns the logger of the proxy that handles the request
+// (the default logger if the context isn't created by the proxy)
+func (d *DNSContext) logger() proxyutil.Logger {
+	return proxyutil.LoggerOrDefault(d.proxyLogger)
+}
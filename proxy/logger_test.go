@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testLogger records the messages by level
+type testLogger struct {
+	debug    bool
+	messages map[string][]string
+	lock     sync.Mutex
+}
+
+func (l *testLogger) add(level, format string, args ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.messages == nil {
+		l.messages = map[string][]string{}
+	}
+	l.messages[level] = append(l.messages[level], fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) count(level string) int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return len(l.messages[level])
+}
+
+func (l *testLogger) Debugf(format string, args ...interface{}) { l.add("debug", format, args...) }
+func (l *testLogger) Infof(format string, args ...interface{})  { l.add("info", format, args...) }
+func (l *testLogger) Warnf(format string, args ...interface{})  { l.add("warn", format, args...) }
+func (l *testLogger) Errorf(format string, args ...interface{}) { l.add("error", format, args...) }
+func (l *testLogger) DebugEnabled() bool                        { return l.debug }
+
+func TestLogger(t *testing.T) {
+	for _, debug := range []bool{false, true} {
+		l := &testLogger{debug: debug}
+		dnsProxy := createTestProxy(t, nil)
+		dnsProxy.Logger = l
+		dnsProxy.Upstreams = []upstream.Upstream{&funcUpstream{exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+			resp := &dns.Msg{}
+			resp.SetReply(m)
+			return resp, nil
+		}}}
+		require.NoError(t, dnsProxy.Start())
+
+		client := &dns.Client{Net: "udp", Timeout: time.Second}
+		_, _, err := client.Exchange(createTestMessage(), dnsProxy.Addr(ProtoUDP).String())
+		require.NoError(t, err)
+		require.NoError(t, dnsProxy.Stop())
+
+		assert.NotZero(t, l.count("info"))
+		if debug {
+			assert.NotZero(t, l.count("debug"))
+		} else {
+			assert.Zero(t, l.count("debug"))
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	mdnsPort           = 5353
+	mdnsMaxPacketSize  = 9000 // RFC 6762, 17
+	mdnsCacheFlushBit  = 1 << 15
+	defaultMDNSZone    = "local."
+	defaultMDNSTimeout = 500 * time.Millisecond
+)
+
+var (
+	mdnsGroupIPv4 = net.IPv4(224, 0, 0, 251)
+	mdnsGroupIPv6 = net.ParseIP("ff02::fb")
+)
+
+// initMDNS prepares the list of zones resolved via mDNS
+func (p *Proxy) initMDNS() {
+	p.mdnsZones = nil
+	if !p.MDNSEnabled {
+		return
+	}
+
+	zones := p.MDNSZones
+	if len(zones) == 0 {
+		zones = []string{defaultMDNSZone}
+	}
+	for _, z := range zones {
+		p.mdnsZones = append(p.mdnsZones, strings.ToLower(dns.Fqdn(z)))
+	}
+	p.mdnsInFlight = map[string]int{}
+	p.logger().Infof("mDNS bridge is enabled for: %s", strings.Join(p.mdnsZones, ", "))
+}
+
+// isMDNSName checks if the name belongs to one of the mDNS zones
+func (p *Proxy) isMDNSName(name string) bool {
+	name = strings.ToLower(name)
+	for _, z := range p.state().mdnsZones {
+		if name != z && dns.IsSubDomain(z, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveMDNS resolves the request via a one-shot multicast DNS query (RFC 6762, 5.1).
+// The responses collected within MDNSTimeout are merged into d.Res.
+// If nobody replies, the response is NXDOMAIN -- the query never falls through to the upstreams.
+// The result is not cached.
+func (p *Proxy) resolveMDNS(d *DNSContext) error {
+	q := d.Req.Question[0]
+	key := strings.ToLower(q.Name) + "/" + dns.TypeToString[q.Qtype]
+
+	if !p.startMDNSQuery(key, d.Addr) {
+		// The same query from the loopback interface while we're waiting for the mDNS responses
+		// means that the host's resolver sends our own mDNS queries back to us
+		if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("mDNS loop detected for %s from %s", key, d.Addr)
+		}
+		d.Res = GenEmptyMessage(d.Req, dns.RcodeNameError, retryNoError)
+		return nil
+	}
+	defer p.finishMDNSQuery(key)
+
+	timeout := p.requestState(d).MDNSTimeout
+	if timeout <= 0 {
+		timeout = defaultMDNSTimeout
+	}
+
+	answers, err := exchangeMDNS(q, timeout, p.logger())
+	if err != nil {
+		if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("mDNS query for %s failed: %s", key, err)
+		}
+	}
+
+	if len(answers) == 0 {
+		d.Res = GenEmptyMessage(d.Req, dns.RcodeNameError, retryNoError)
+		return nil
+	}
+
+	res := &dns.Msg{}
+	res.SetReply(d.Req)
+	res.RecursionAvailable = true
+	res.Answer = answers
+	d.Res = res
+	return nil
+}
+
+// startMDNSQuery registers the query in the in-flight set.
+// Returns false if the same query is already in flight and this one comes from the loopback interface.
+func (p *Proxy) startMDNSQuery(key string, addr net.Addr) bool {
+	p.mdnsLock.Lock()
+	defer p.mdnsLock.Unlock()
+
+	if p.mdnsInFlight[key] > 0 {
+		ip := getIP(addr)
+		if ip == nil || ip.IsLoopback() {
+			return false
+		}
+	}
+	p.mdnsInFlight[key]++
+	return true
+}
+
+// finishMDNSQuery removes the query from the in-flight set
+func (p *Proxy) finishMDNSQuery(key string) {
+	p.mdnsLock.Lock()
+	defer p.mdnsLock.Unlock()
+
+	p.mdnsInFlight[key]--
+	if p.mdnsInFlight[key] <= 0 {
+		delete(p.mdnsInFlight, key)
+	}
+}
+
+// exchangeMDNS sends the question to the IPv4 and IPv6 mDNS groups on every multicast interface
+// and returns the merged answers received before the timeout.
+// The query is sent from an ephemeral port so the responders reply with unicast "legacy" responses (RFC 6762, 6.7)
+// and we never receive the multicast traffic, including our own queries and the responses to other hosts.
+func exchangeMDNS(q dns.Question, timeout time.Duration, l proxyutil.Logger) ([]dns.RR, error) {
+	req := &dns.Msg{}
+	req.Id = dns.Id()
+	req.Question = []dns.Question{{Name: q.Name, Qtype: q.Qtype, Qclass: dns.ClassINET}}
+	packet, err := req.Pack()
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't pack mDNS query")
+	}
+
+	ifaces := multicastInterfaces(l)
+	conns := []net.PacketConn{}
+	errs := []error{}
+	for _, group := range []net.IP{mdnsGroupIPv4, mdnsGroupIPv6} {
+		conn, err := sendMDNS(packet, group, ifaces)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		conns = append(conns, conn)
+	}
+	if len(conns) == 0 {
+		return nil, errorx.DecorateMany("couldn't send mDNS query", errs...)
+	}
+
+	deadline := time.Now().Add(timeout)
+	ch := make(chan *dns.Msg)
+	wg := sync.WaitGroup{}
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn net.PacketConn) {
+			defer wg.Done()
+			readMDNSResponses(conn, deadline, ch)
+		}(conn)
+	}
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+
+	answers := []dns.RR{}
+	for resp := range ch {
+		answers = mergeMDNSAnswers(answers, mdnsAnswers(req, resp))
+	}
+	return answers, nil
+}
+
+// sendMDNS sends the packet to the multicast group on each of the interfaces
+// and returns the connection to read the responses from
+func sendMDNS(packet []byte, group net.IP, ifaces []net.Interface) (net.PacketConn, error) {
+	network := "udp6"
+	if group.To4() != nil {
+		network = "udp4"
+	}
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't open %s socket", network)
+	}
+
+	// the packet is sent from the same socket, the interface is selected with a socket option
+	var setInterface func(ifi *net.Interface) error
+	if network == "udp4" {
+		pc := ipv4.NewPacketConn(conn)
+		_ = pc.SetMulticastTTL(255)
+		setInterface = pc.SetMulticastInterface
+	} else {
+		pc := ipv6.NewPacketConn(conn)
+		_ = pc.SetMulticastHopLimit(255)
+		setInterface = pc.SetMulticastInterface
+	}
+
+	dst := &net.UDPAddr{IP: group, Port: mdnsPort}
+	sent := 0
+	err = errors.New("no multicast interfaces")
+	for i := range ifaces {
+		if err = setInterface(&ifaces[i]); err != nil {
+			continue
+		}
+		if _, err = conn.WriteTo(packet, dst); err == nil {
+			sent++
+		}
+	}
+
+	if sent == 0 {
+		_ = conn.Close()
+		return nil, errorx.Decorate(err, "couldn't send mDNS query over %s", network)
+	}
+	return conn, nil
+}
+
+// readMDNSResponses reads the DNS responses from conn until the deadline and closes it
+func readMDNSResponses(conn net.PacketConn, deadline time.Time, ch chan *dns.Msg) {
+	defer conn.Close()
+	_ = conn.SetReadDeadline(deadline)
+
+	b := make([]byte, mdnsMaxPacketSize)
+	for {
+		n, _, err := conn.ReadFrom(b)
+		if err != nil {
+			return
+		}
+
+		m := &dns.Msg{}
+		if m.Unpack(b[:n]) == nil {
+			ch <- m
+		}
+	}
+}
+
+// mdnsAnswers returns the records from the mDNS response that answer the question of the request.
+// Class of the records in mDNS responses may have the cache-flush bit set (RFC 6762, 10.2), it is cleared.
+func mdnsAnswers(req, resp *dns.Msg) []dns.RR {
+	if !resp.Response || resp.Opcode != dns.OpcodeQuery || resp.Rcode != dns.RcodeSuccess || resp.Id != req.Id {
+		return nil
+	}
+
+	q := req.Question[0]
+	answers := []dns.RR{}
+	for _, rr := range resp.Answer {
+		h := rr.Header()
+		h.Class &^= mdnsCacheFlushBit
+		if h.Class != dns.ClassINET || !strings.EqualFold(h.Name, q.Name) {
+			continue
+		}
+		if h.Rrtype == q.Qtype || h.Rrtype == dns.TypeCNAME || q.Qtype == dns.TypeANY {
+			answers = append(answers, rr)
+		}
+	}
+	return answers
+}
+
+// mergeMDNSAnswers appends the records to answers skipping the duplicates
+// (the same record is usually received from several interfaces)
+func mergeMDNSAnswers(answers, rrs []dns.RR) []dns.RR {
+	for _, rr := range rrs {
+		duplicate := false
+		for _, a := range answers {
+			if dns.IsDuplicate(a, rr) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			answers = append(answers, rr)
+		}
+	}
+	return answers
+}
+
+// multicastInterfaces returns the list of the interfaces that are up and support multicast
+func multicastInterfaces(l proxyutil.Logger) []net.Interface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		l.Debugf("couldn't list network interfaces: %s", err)
+		return nil
+	}
+
+	res := []net.Interface{}
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagMulticast != 0 {
+			res = append(res, ifi)
+		}
+	}
+	return res
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMDNSZones(t *testing.T) {
+	p := &Proxy{}
+	p.initMDNS()
+	assert.False(t, p.isMDNSName("printer.local."))
+
+	p.MDNSEnabled = true
+	p.initMDNS()
+	assert.True(t, p.isMDNSName("printer.local."))
+	assert.True(t, p.isMDNSName("Printer.LOCAL."))
+	assert.False(t, p.isMDNSName("local."))
+	assert.False(t, p.isMDNSName("printer.notlocal."))
+	assert.False(t, p.isMDNSName("example.org."))
+
+	p.MDNSZones = []string{"home.arpa", "Lan."}
+	p.initMDNS()
+	assert.False(t, p.isMDNSName("printer.local."))
+	assert.True(t, p.isMDNSName("printer.home.arpa."))
+	assert.True(t, p.isMDNSName("nas.lan."))
+}
+
+func TestMDNSAnswers(t *testing.T) {
+	req := &dns.Msg{}
+	req.Id = 1234
+	req.Question = []dns.Question{{Name: "printer.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET}}
+
+	a := newRR("printer.local. 10 IN A 192.168.1.10")
+	a.Header().Class |= mdnsCacheFlushBit
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{
+		a,
+		newRR("Printer.Local. 10 IN A 192.168.1.11"),
+		newRR("printer.local. 10 IN AAAA fe80::1"),
+		newRR("other.local. 10 IN A 192.168.1.12"),
+	}
+
+	answers := mdnsAnswers(req, resp)
+	require.Len(t, answers, 2)
+	assert.Equal(t, uint16(dns.ClassINET), answers[0].Header().Class)
+	assert.Equal(t, "192.168.1.10", answers[0].(*dns.A).A.String())
+	assert.Equal(t, "192.168.1.11", answers[1].(*dns.A).A.String())
+
+	// response to another query
+	resp.Id = 4321
+	assert.Empty(t, mdnsAnswers(req, resp))
+
+	// not a response
+	resp.Id = req.Id
+	resp.Response = false
+	assert.Empty(t, mdnsAnswers(req, resp))
+}
+
+func TestMergeMDNSAnswers(t *testing.T) {
+	answers := mergeMDNSAnswers(nil, []dns.RR{newRR("printer.local. 10 IN A 192.168.1.10")})
+	answers = mergeMDNSAnswers(answers, []dns.RR{
+		newRR("printer.local. 120 IN A 192.168.1.10"),
+		newRR("printer.local. 10 IN A 192.168.1.11"),
+	})
+	assert.Len(t, answers, 2)
+}
+
+func TestMDNSLoopDetection(t *testing.T) {
+	p := &Proxy{Config: Config{MDNSEnabled: true}}
+	p.initMDNS()
+
+	loopback := &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 53}
+	client := &net.UDPAddr{IP: net.IP{192, 168, 1, 2}, Port: 53}
+
+	assert.True(t, p.startMDNSQuery("printer.local./A", client))
+	// the same query from another LAN client is fine
+	assert.True(t, p.startMDNSQuery("printer.local./A", client))
+	// the same query from the host itself is a loop
+	assert.False(t, p.startMDNSQuery("printer.local./A", loopback))
+	assert.True(t, p.startMDNSQuery("printer.local./AAAA", loopback))
+
+	p.finishMDNSQuery("printer.local./A")
+	p.finishMDNSQuery("printer.local./A")
+	assert.True(t, p.startMDNSQuery("printer.local./A", loopback))
+}
+
+func TestMDNSNoResponse(t *testing.T) {
+	var upstreamCount int32
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.MDNSEnabled = true
+	dnsProxy.MDNSTimeout = 100 * time.Millisecond
+	dnsProxy.Upstreams = []upstream.Upstream{createCountingUpstream(&upstreamCount)}
+	err := dnsProxy.Start()
+	require.NoError(t, err)
+	defer dnsProxy.Stop()
+
+	d := &DNSContext{
+		Req:  createHostTestMessage("nonexistent-dnsproxy-test.local"),
+		Addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+	}
+	err = dnsProxy.Resolve(d)
+	require.NoError(t, err)
+	require.NotNil(t, d.Res)
+	assert.Equal(t, dns.RcodeNameError, d.Res.Rcode)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&upstreamCount))
+
+	// regular names are still resolved by the upstreams
+	d = &DNSContext{
+		Req:  createHostTestMessage("example.org"),
+		Addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+	}
+	err = dnsProxy.Resolve(d)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&upstreamCount))
+}
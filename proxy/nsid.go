@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"encoding/hex"
+
+	"github.com/miekg/dns"
+)
+
+// checkNSIDRequest processes the NSID option (RFC 5001) of the request if Config.NSID is set.
+// The option is removed from the request, so the upstreams' identifiers aren't sent instead of NSID
+// and the cached responses are shared with the requests without the option.
+func (p *Proxy) checkNSIDRequest(d *DNSContext) {
+	opt := d.Req.IsEdns0()
+	if p.requestState(d).NSID == "" || opt == nil {
+		return
+	}
+	d.nsid = removeNSID(opt)
+}
+
+// setNSID removes the NSID option from the response and adds the one with Config.NSID
+// if the client has requested it
+func (p *Proxy) setNSID(d *DNSContext) {
+	s := p.requestState(d)
+	if s.NSID == "" {
+		return
+	}
+	opt := d.Res.IsEdns0()
+	if opt != nil {
+		removeNSID(opt)
+	}
+	if !d.nsid {
+		return
+	}
+
+	if opt == nil {
+		opt = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT, Class: dns.DefaultMsgSize}}
+		if reqOpt := d.Req.IsEdns0(); reqOpt != nil {
+			opt.SetUDPSize(reqOpt.UDPSize())
+		}
+		d.Res.Extra = append(d.Res.Extra, opt)
+	}
+	// dns.EDNS0_NSID keeps the identifier hex-encoded
+	opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte(s.NSID))})
+}
+
+// removeNSID removes the NSID options from opt and returns true if there were any
+func removeNSID(opt *dns.OPT) bool {
+	found := false
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0NSID {
+			found = true
+			continue
+		}
+		options = append(options, o)
+	}
+	opt.Option = options
+	return found
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// findNSID returns the decoded NSID option of the message (or nil)
+func findNSID(m *dns.Msg) *dns.EDNS0_NSID {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0NSID {
+			return o.(*dns.EDNS0_NSID)
+		}
+	}
+	return nil
+}
+
+// createNSIDTestMessage creates a request with the empty NSID option
+func createNSIDTestMessage() *dns.Msg {
+	req := createTestMessage()
+	req.SetEdns0(4096, false)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+	return req
+}
+
+func TestNSID(t *testing.T) {
+	// the upstream is called from the proxy's goroutines
+	var reqs []*dns.Msg
+	var reqsLock sync.Mutex
+	sent := func() []*dns.Msg {
+		reqsLock.Lock()
+		defer reqsLock.Unlock()
+		return append([]*dns.Msg{}, reqs...)
+	}
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.NSID = "dnsproxy-1"
+	dnsProxy.Upstreams = []upstream.Upstream{&funcUpstream{
+		exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+			reqsLock.Lock()
+			reqs = append(reqs, m.Copy())
+			reqsLock.Unlock()
+			resp := &dns.Msg{}
+			resp.SetReply(m)
+			resp.Answer = []dns.RR{newRR(m.Question[0].Name + " 60 IN A 1.2.3.4")}
+			// the upstream's own identifier
+			resp.SetEdns0(4096, false)
+			resp.IsEdns0().Option = append(resp.IsEdns0().Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: "7570"})
+			return resp, nil
+		},
+	}}
+	require.NoError(t, dnsProxy.Start())
+	defer dnsProxy.Stop()
+
+	client := &dns.Client{Net: "udp", Timeout: time.Second}
+	addr := dnsProxy.Addr(ProtoUDP).String()
+
+	// the option isn't forwarded, the proxy's identifier is sent both in the upstream and the cached responses
+	for i := 0; i < 2; i++ {
+		resp, _, err := client.Exchange(createNSIDTestMessage(), addr)
+		require.NoError(t, err)
+		nsid := findNSID(resp)
+		require.NotNil(t, nsid)
+		assert.Equal(t, hex.EncodeToString([]byte("dnsproxy-1")), nsid.Nsid)
+	}
+	require.Len(t, sent(), 1)
+	assert.Nil(t, findNSID(sent()[0]))
+
+	// no option if the client hasn't requested it
+	req := createTestMessage()
+	req.SetEdns0(4096, false)
+	resp, _, err := client.Exchange(req, addr)
+	require.NoError(t, err)
+	assert.Nil(t, findNSID(resp))
+	assert.Len(t, sent(), 1)
+}
+
+func TestNSIDDisabled(t *testing.T) {
+	p := &Proxy{}
+	d := &DNSContext{Req: createNSIDTestMessage()}
+	p.checkNSIDRequest(d)
+	assert.False(t, d.nsid)
+	// the option is forwarded to the upstreams
+	assert.NotNil(t, findNSID(d.Req))
+
+	d.Res = &dns.Msg{}
+	d.Res.SetReply(d.Req)
+	p.setNSID(d)
+	assert.Nil(t, d.Res.IsEdns0())
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"sync/atomic"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// The reasons of the local responses to the unsupported requests (see DNSContext.Unsupported)
+const (
+	UnsupportedZoneTransfer = "zone_transfer" // AXFR and IXFR queries
+	UnsupportedOpcode       = "opcode"        // the opcodes other than QUERY (and UPDATE if UpdateUpstream is set)
+	UnsupportedClass        = "class"         // the classes other than IN (see Config.ListenerForwardedClasses)
+)
+
+// checkUnsupportedRequest looks for the requests that must never be forwarded
+// to the upstreams or cached and returns the response to them with the question of the request.
+// AXFR/IXFR queries and the queries of the classes other than IN are answered with REFUSED
+// (except the CHAOS queries answered by checkChaosRequest and the classes forwarded by the listener).
+// The messages with the other opcodes than QUERY (NOTIFY, UPDATE, the obsolete IQUERY, STATUS, etc.)
+// are answered with NOTIMP (unless UpdateUpstream is configured, in this case UPDATE is forwarded to it).
+// Returns nil if the request can be processed as usual.
+func (p *Proxy) checkUnsupportedRequest(d *DNSContext) *dns.Msg {
+	switch d.Req.Opcode {
+	case dns.OpcodeQuery:
+		if len(d.Req.Question) == 0 {
+			return nil
+		}
+		q := d.Req.Question[0]
+		if q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR {
+			if l := p.logger(); l.DebugEnabled() {
+				l.Debugf("Refusing zone transfer request from %s", d.Addr)
+			}
+			atomic.AddUint64(&p.counters.zoneTransfersRefused, 1)
+			d.Unsupported = UnsupportedZoneTransfer
+			return p.statusResponse(d, StatusBlocked)
+		}
+		if q.Qclass != dns.ClassINET && !isChaosServerQuery(q) && !d.listener.classForwarded(q.Qclass) {
+			if l := p.logger(); l.DebugEnabled() {
+				l.Debugf("Refusing %s class request from %s", dns.Class(q.Qclass), d.Addr)
+			}
+			atomic.AddUint64(&p.counters.unsupportedClasses, 1)
+			d.Unsupported = UnsupportedClass
+			return p.statusResponse(d, StatusBlocked)
+		}
+	case dns.OpcodeUpdate:
+		if p.requestState(d).UpdateUpstream != nil {
+			return p.forwardUpdate(d)
+		}
+		fallthrough
+	default:
+		if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("Opcode %d (%s) from %s is not implemented", d.Req.Opcode, dns.OpcodeToString[d.Req.Opcode], d.Addr)
+		}
+		atomic.AddUint64(&p.counters.notImplementedOpcodes, 1)
+		d.Unsupported = UnsupportedOpcode
+		return p.statusResponse(d, StatusNotImplemented)
+	}
+
+	return nil
+}
+
+// forwardUpdate sends the dynamic UPDATE message (RFC 2136) to the UpdateUpstream
+// and returns its response or SERVFAIL if it failed to answer.
+// The response is returned as is, it isn't cached and its flags aren't normalized.
+func (p *Proxy) forwardUpdate(d *DNSContext) *dns.Msg {
+	s := p.requestState(d)
+	if l := p.logger(); l.DebugEnabled() {
+		l.Debugf("Forwarding UPDATE message from %s to %s", d.Addr, upstream.Name(s.UpdateUpstream))
+	}
+	reply, _, err := exchangeWithUpstream(d.Context(), s.UpdateUpstream, d.Req, p.logger())
+	if err != nil || reply == nil {
+		if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("Failed to forward UPDATE message to %s: %v", upstream.Name(s.UpdateUpstream), err)
+		}
+		d.Res = p.statusResponse(d, upstreamStatus(err))
+	} else {
+		d.Upstream = s.UpdateUpstream
+		d.Res = reply
+	}
+
+	if s.ResponseHandler != nil {
+		s.ResponseHandler(d, err)
+	}
+
+	return d.Res
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createCountingUpstream creates an upstream that answers NOERROR to everything
+// and counts the number of the exchanged messages
+func createCountingUpstream(count *int32) upstream.Upstream {
+	return &funcUpstream{
+		exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+			atomic.AddInt32(count, 1)
+			resp := &dns.Msg{}
+			resp.SetReply(m)
+			return resp, nil
+		},
+	}
+}
+
+func TestUnsupportedRequests(t *testing.T) {
+	var upstreamCount int32
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.Upstreams = []upstream.Upstream{createCountingUpstream(&upstreamCount)}
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer dnsProxy.Stop()
+
+	addr := dnsProxy.Addr(ProtoUDP)
+	client := &dns.Client{Net: "udp", Timeout: 500 * time.Millisecond}
+
+	// AXFR and IXFR must be refused
+	for _, qType := range []uint16{dns.TypeAXFR, dns.TypeIXFR} {
+		req := &dns.Msg{}
+		req.SetQuestion("example.org.", qType)
+		r, _, err := client.Exchange(req, addr.String())
+		require.NoError(t, err)
+		assert.Equal(t, dns.RcodeRefused, r.Rcode)
+	}
+
+	// NOTIFY and UPDATE aren't implemented
+	notify := &dns.Msg{}
+	notify.SetNotify("example.org.")
+	r, _, err := client.Exchange(notify, addr.String())
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeNotImplemented, r.Rcode)
+
+	update := &dns.Msg{}
+	update.SetUpdate("example.org.")
+	update.Insert([]dns.RR{newRR("www.example.org. 60 IN A 1.2.3.4")})
+	r, _, err = client.Exchange(update, addr.String())
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeNotImplemented, r.Rcode)
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&upstreamCount))
+	stats := dnsProxy.Stats()
+	assert.Equal(t, uint64(2), stats.ZoneTransfersRefused)
+	assert.Equal(t, uint64(2), stats.NotImplementedOpcodes)
+}
+
+func TestUpdateUpstream(t *testing.T) {
+	var upstreamCount, updateCount, handlerCount int32
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{createCountingUpstream(&upstreamCount)}
+	dnsProxy.UpdateUpstream = createCountingUpstream(&updateCount)
+	dnsProxy.ResponseHandler = func(d *DNSContext, err error) {
+		if d.Req.Opcode == dns.OpcodeUpdate {
+			atomic.AddInt32(&handlerCount, 1)
+		}
+	}
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer dnsProxy.Stop()
+
+	addr := dnsProxy.Addr(ProtoUDP)
+	client := &dns.Client{Net: "udp", Timeout: 500 * time.Millisecond}
+
+	update := &dns.Msg{}
+	update.SetUpdate("example.org.")
+	update.Insert([]dns.RR{newRR("www.example.org. 60 IN A 1.2.3.4")})
+	r, _, err := client.Exchange(update, addr.String())
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, r.Rcode)
+	// the response is returned as is
+	assert.False(t, r.RecursionAvailable)
+
+	// NOTIFY is still not implemented
+	notify := &dns.Msg{}
+	notify.SetNotify("example.org.")
+	r, _, err = client.Exchange(notify, addr.String())
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeNotImplemented, r.Rcode)
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&updateCount))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&handlerCount))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&upstreamCount))
+}
+
+func TestUnsupportedOpcodesAndClasses(t *testing.T) {
+	var upstreamCount int32
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.Upstreams = []upstream.Upstream{createCountingUpstream(&upstreamCount)}
+	// CHAOS is forwarded by the UDP listener only
+	dnsProxy.ListenerForwardedClasses = map[string][]uint16{
+		ListenerKey(ProtoUDP, dnsProxy.UDPListenAddr[0]): {dns.ClassCHAOS},
+	}
+	require.NoError(t, dnsProxy.Start())
+	defer dnsProxy.Stop()
+
+	udp := &dns.Client{Net: "udp", Timeout: 500 * time.Millisecond}
+	tcp := &dns.Client{Net: "tcp", Timeout: 500 * time.Millisecond}
+	exchange := func(c *dns.Client, req *dns.Msg) *dns.Msg {
+		addr := dnsProxy.Addr(ProtoUDP).String()
+		if c.Net == "tcp" {
+			addr = dnsProxy.Addr(ProtoTCP).String()
+		}
+		r, _, err := c.Exchange(req, addr)
+		require.NoError(t, err)
+		require.Len(t, r.Question, 1)
+		assert.Equal(t, req.Question[0], r.Question[0])
+		return r
+	}
+
+	// IQUERY and STATUS aren't implemented
+	for _, opcode := range []int{dns.OpcodeIQuery, dns.OpcodeStatus} {
+		req := createHostTestMessage("example.org")
+		req.Opcode = opcode
+		assert.Equal(t, dns.RcodeNotImplemented, exchange(udp, req).Rcode)
+	}
+
+	// the classes other than IN are refused and the refusals aren't cached
+	chaos := createTestMessage()
+	chaos.Question[0].Qclass = dns.ClassCHAOS
+	hesiod := createTestMessage()
+	hesiod.Question[0].Qclass = dns.ClassHESIOD
+	for _, req := range []*dns.Msg{chaos, hesiod} {
+		assert.Equal(t, dns.RcodeRefused, exchange(tcp, req).Rcode)
+		_, ok := dnsProxy.cache.Get(req)
+		assert.False(t, ok)
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&upstreamCount))
+
+	// the UDP listener forwards CHAOS, but not HESIOD
+	assert.Equal(t, dns.RcodeSuccess, exchange(udp, chaos).Rcode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&upstreamCount))
+	assert.Equal(t, dns.RcodeRefused, exchange(udp, hesiod).Rcode)
+
+	stats := dnsProxy.Stats()
+	assert.Equal(t, uint64(2), stats.NotImplementedOpcodes)
+	assert.Equal(t, uint64(3), stats.RefusedClasses)
+
+	// the reason is saved for the query log
+	d := &DNSContext{Req: hesiod}
+	require.NotNil(t, dnsProxy.checkUnsupportedRequest(d))
+	assert.Equal(t, UnsupportedClass, d.Unsupported)
+	d = &DNSContext{Req: createHostTestMessage("example.org")}
+	assert.Nil(t, dnsProxy.checkUnsupportedRequest(d))
+	assert.Empty(t, d.Unsupported)
+}
@@ -2,7 +2,9 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -13,10 +15,12 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/internal/logutil"
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/AdguardTeam/dnsproxy/upstream"
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/utils"
 	"github.com/joomcode/errorx"
 	"github.com/miekg/dns"
@@ -60,12 +64,18 @@ type ResponseHandler func(d *DNSContext, err error)
 
 // Proxy combines the proxy server state and configuration
 type Proxy struct {
-	started     bool         // Started flag
-	udpListen   *net.UDPConn // UDP listen connection
-	tcpListen   net.Listener // TCP listener
-	tlsListen   net.Listener // TLS listener
-	httpsListen net.Listener // HTTPS listener
-	httpsServer *http.Server // HTTPS server instance
+	counters counters // proxy counters (must be the first field, see counters)
+
+	started      bool            // Started flag
+	startTime    time.Time       // when the proxy was started
+	draining     int32           // 1 if the proxy is shutting down (see Shutdown), accessed atomically
+	inFlight     int32           // number of the queries being processed, accessed atomically
+	udpListen    []*net.UDPConn  // UDP listen connections
+	udpLoopsDone []chan struct{} // closed when the loops serving UDPListeners exit
+	tcpListen    []net.Listener  // TCP listeners
+	tlsListen    []net.Listener  // TLS listeners
+	httpsListen  []net.Listener  // HTTPS listeners
+	httpsServers []*http.Server  // HTTPS server instances (one per HTTPS listener)
 
 	upstreamRttStats map[string]int // Map of upstream addresses and their rtt. Used to sort upstreams "from fast to slow"
 	rttLock          sync.Mutex     // Synchronizes access to the upstreamRttStats map
@@ -74,12 +84,44 @@ type Proxy struct {
 	nat64Lock   sync.Mutex // Prefix lock
 
 	ratelimitBuckets *gocache.Cache // where the ratelimiters are stored, per IP
-	ratelimitLock    sync.Mutex     // Synchronizes access to ratelimitBuckets
+	authFailures     *gocache.Cache // number of failed DoH authentication attempts, per IP
+	ratelimitLock    sync.Mutex     // Synchronizes access to ratelimitBuckets and authFailures
 
 	cache       *cache       // cache instance (nil if cache is disabled)
 	cacheSubnet *cacheSubnet // cache instance (nil if cache is disabled)
 
-	Config // proxy configuration
+	cacheRefreshing  map[string]bool // optimistic cache entries that are being refreshed (or prefetched)
+	prefetchWorkers  chan bool       // limits the number of parallel prefetches
+	cacheRefreshLock sync.Mutex      // Synchronizes access to cacheRefreshing
+
+	mdnsZones    []string       // normalized list of mDNS zones (empty if mDNS bridge is disabled)
+	mdnsInFlight map[string]int // mDNS queries in progress, used for the loop detection
+	mdnsLock     sync.Mutex     // Synchronizes access to mdnsInFlight
+
+	clients []*clientGroup // per-client settings (see ClientsSettings)
+
+	trustedProxies []*net.IPNet // parsed TrustedProxies
+
+	ecsOverrideV4 *net.IPNet // parsed ECSOverrideSubnet
+	ecsOverrideV6 *net.IPNet
+
+	ttlOverrides map[string]CacheTTLOverride // parsed CacheTTLOverrides by domain (see cacheTTLOverride)
+
+	staticHosts map[string][]net.IP // static entries (see StaticEntries)
+	staticPTR   map[string][]string // reverse names of the static entries addresses and the corresponding hostnames
+	staticLock  sync.RWMutex        // Synchronizes access to staticHosts and staticPTR
+
+	cnameOverrides map[string]string // CNAME overrides by the name (see CNAMEOverrides)
+	cnameLock      sync.RWMutex      // Synchronizes access to cnameOverrides
+
+	listenerStats     map[string]*listenerCounters // the query counters by the listener keys (see Stats.Listeners)
+	listenerStatsLock sync.Mutex                   // Synchronizes access to listenerStats
+
+	health healthState // the upstream results for the health check
+
+	Config // proxy configuration, the running proxy only uses the changes applied by Reload
+
+	currentState atomic.Value // *proxyState published by Start and Reload (see state)
 
 	maxGoroutines chan bool // limits the number of parallel queries. if nil, there's no limit
 	sync.RWMutex            // protects parallel access to proxy structures
@@ -87,12 +129,44 @@ type Proxy struct {
 
 // Config contains all the fields necessary for proxy configuration
 type Config struct {
-	UDPListenAddr *net.UDPAddr // if nil, then it does not listen for UDP
-	TCPListenAddr *net.TCPAddr // if nil, then it does not listen for TCP
-
-	HTTPSListenAddr *net.TCPAddr // if nil, then it does not listen for HTTPS (DoH)
-	TLSListenAddr   *net.TCPAddr // if nil, then it does not listen for TLS (DoT)
-	TLSConfig       *tls.Config  // necessary for listening for TLS
+	UDPListenAddr []*net.UDPAddr // if empty, then it does not listen for UDP
+	TCPListenAddr []*net.TCPAddr // if empty, then it does not listen for TCP
+
+	// UDPListeners are the UDP sockets created by the caller (e.g. a socket protected from the VPN on Android)
+	// that the proxy serves in addition to UDPListenAddr.
+	// They are closed on Stop only if CloseUDPListeners is true.
+	UDPListeners      []*net.UDPConn
+	CloseUDPListeners bool
+
+	// UDPBufferSize is the size of the buffers the UDP queries are read into (in bytes).
+	// Default: 65535. The larger queries are dropped.
+	UDPBufferSize int
+
+	HTTPSListenAddr []*net.TCPAddr // if empty, then it does not listen for HTTPS (DoH)
+	TLSListenAddr   []*net.TCPAddr // if empty, then it does not listen for TLS (DoT)
+	TLSConfig       *tls.Config    // necessary for listening for TLS
+	TLSClientAuth   *TLSClientAuth // if set, DoT and DoH clients must present a valid certificate
+
+	HTTPSServerPaths   []string // URL paths where the DoH server accepts DNS queries (default: "/dns-query")
+	HTTPSHealthCheck   bool     // if true, the DoH server responds 200 OK to requests to "/"
+	HTTPSServerVersion bool     // if true, the Server header of the DoH responses includes the dnsproxy version
+
+	// TrustedProxies are the IP addresses and CIDRs of the reverse proxies in front of the DoH server.
+	// The client address is taken from the Forwarded or X-Forwarded-For header only if the request
+	// comes from one of them. If not set, the headers are ignored and the address of the peer is used.
+	TrustedProxies []string
+
+	// HealthWindow is how long the upstream results are considered by the health check (see HealthHandler). Default: 1m.
+	// HealthDegradedUnhealthy makes the health check fail if some of the upstreams have failed within the window
+	// (by default, the proxy is healthy while at least one upstream answers).
+	HealthWindow            time.Duration
+	HealthDegradedUnhealthy bool
+
+	// DoHAuthTokens is the list of tokens accepted by the DoH server.
+	// If set, the clients must pass one of them as a Bearer token or as the last path component
+	// (e.g. /dns-query/<token>), otherwise the server responds 403.
+	DoHAuthTokens            []string
+	DoHAuthFailuresRatelimit int // max number of failed DoH authentication attempts per minute from a given IP (0 to disable)
 
 	Ratelimit          int      // max number of requests per second from a given IP (0 to disable)
 	RatelimitWhitelist []string // a list of whitelisted client IP addresses
@@ -100,6 +174,22 @@ type Config struct {
 	RefuseAny  bool // if true, refuse ANY requests
 	AllServers bool // if true, parallel queries to all configured upstream servers are enabled
 
+	ADPolicy ADPolicy // defines whether the AD flag from the upstream response is passed to the client (cleared by default)
+
+	// UpstreamValidation defines how the upstream responses are checked before they are cached or returned.
+	// The invalid responses are treated as the upstream errors, so the other upstreams and the fallbacks are used.
+	UpstreamValidation UpstreamValidation
+
+	// EDNSAllowedOptions is the codes of the EDNS options of the clients that are sent to the upstreams.
+	// The other options are removed from the requests and from the responses, ECS is controlled
+	// by EnableEDNSClientSubnet. The responses to the requests with the different allowed options
+	// are cached separately. If nil, all the options are sent as is.
+	EDNSAllowedOptions []uint16
+
+	// UpstreamUDPSize is the UDP payload size advertised to the upstreams in the requests with DO (4096 if 0).
+	// The responses are truncated to the payload size of the client's request.
+	UpstreamUDPSize uint16
+
 	// Enable EDNS Client Subnet option
 	// DNS requests to the upstream server will contain an OPT record with Client Subnet option.
 	//  If the original request already has this option set, we pass it through as is.
@@ -121,19 +211,189 @@ type Config struct {
 	//  so they will never be used for clients with public IP addresses.
 	EnableEDNSClientSubnet bool
 
+	// ECSOverrideSubnet is the subnets sent in the ECS option of all the upstream requests instead of the clients'
+	// addresses (at most one IPv4 and one IPv6 CIDR), e.g. the subnet of the office for the VPN users.
+	// The IPv6 subnet is sent for the IPv6 clients and the IPv4 one for the others (if there is one of them, it's
+	// sent for all), so the clients of the same family share the subnet cache entries. The ECS options of
+	// the requests are replaced. It can't be used with EnableEDNSClientSubnet, but the clients can disable it
+	// (see ClientSettings.EnableEDNSClientSubnet).
+	ECSOverrideSubnet []string
+
 	CacheEnabled   bool // cache status
 	CacheSizeBytes int  // Cache size (in bytes). Default: 64k
 
+	// CacheEvictionPolicy defines which entries are removed when the cache is full (LRU by default)
+	CacheEvictionPolicy CacheEvictionPolicy
+
+	// CacheOptimistic enables the optimistic cache: the expired responses are kept for CacheOptimisticMaxStale
+	// and served with a short TTL while the entry is refreshed from the upstreams in the background.
+	// If the refresh fails, the expired response is still served.
+	CacheOptimistic         bool
+	CacheOptimisticMaxStale time.Duration // how long the expired responses are kept (default: 24h)
+
+	// CachePrefetchThreshold enables prefetching of the popular cache entries:
+	// if an entry has got this number of hits, it is refreshed from the upstreams
+	// when it is requested and less than 10% of its TTL is left (0 to disable).
+	CachePrefetchThreshold int
+	CachePrefetchWorkers   int // maximum number of parallel prefetches (default: 4)
+
+	// CachePersistPath is the file where the cache is saved on Stop and loaded from on Start.
+	// Only the global cache is saved, the caches of ClientsSettings aren't.
+	CachePersistPath    string
+	CachePersistMaxSize int // max size of the cache file (in bytes). Default: 32M
+
+	// CacheWarmupFile is the list of names resolved in the background after Start to fill the cache,
+	// one per line, optionally followed by the record type, e.g. "example.org AAAA" (A and AAAA by default).
+	// The warm-up stops after CacheWarmupTimeout (default: 30s) and is skipped if the cache is loaded from CachePersistPath.
+	CacheWarmupFile    string
+	CacheWarmupTimeout time.Duration
+
+	// CacheMinTTL and CacheMaxTTL are the limits of the TTLs of the upstream responses (in seconds, 0 means no limit).
+	// CacheMinNegativeTTL is used instead of CacheMinTTL for NXDOMAIN and NODATA responses.
+	// The TTLs are changed both in the cached and in the sent responses.
+	CacheMinTTL         uint32
+	CacheMaxTTL         uint32
+	CacheMinNegativeTTL uint32
+
+	// CacheRoundRobin enables rotation of the A and AAAA records of the responses served from the cache,
+	// so the clients get the addresses in different order. The responses to the DO requests aren't rotated.
+	CacheRoundRobin bool
+
+	// CacheCNAMEChains enables caching of the CNAME chains by RRset: every CNAME of the answer and the RRset
+	// of its last name are also stored under their own names and types with their own TTLs. The queries for
+	// the intermediate names and the queries that lead to a cached chain are answered from these RRsets.
+	// It increases the number of the cache entries. The subnet cache doesn't store the chains.
+	CacheCNAMEChains bool
+
+	// CacheTTLCaps are the max TTLs of the cached responses per query type (in seconds), e.g. {"HTTPS": 60, "TXT": 300}.
+	// The keys are the type mnemonics or numbers. Unlike CacheMaxTTL, the caps don't change the sent responses,
+	// only how long they are cached. The responses of the types with the 0 cap aren't cached.
+	CacheTTLCaps map[string]uint32
+
+	// CacheTTLOverrides replace CacheMinTTL and CacheMaxTTL for the matching domains (see CacheTTLOverride).
+	// The domains are matched like the ones of DomainsReservedUpstreams, the most specific one wins.
+	CacheTTLOverrides []CacheTTLOverride
+
+	// CacheMaxNegativeTTL is the max TTL of the cached NXDOMAIN and NODATA responses (in seconds). Default: 3 hours.
+	// The negative responses are cached for the SOA MINIMUM value as described in RFC 2308.
+	CacheMaxNegativeTTL uint32
+	// CacheUncacheableRcodes is the list of the response codes that are never cached
+	// (default: SERVFAIL, REFUSED, NOTIMP). Use an empty non-nil list to cache them like the negative responses.
+	CacheUncacheableRcodes []int
+	// CacheFailureTTL enables the failure cache: the upstream errors and the responses with CacheUncacheableRcodes
+	// are cached for this number of seconds (at most 30) to protect the upstreams from retry storms.
+	// If 0, the failures aren't cached.
+	CacheFailureTTL uint32
+
 	Upstreams []upstream.Upstream // list of upstreams
 	Fallbacks []upstream.Upstream // list of fallback resolvers (which will be used if regular upstream failed to answer)
 
+	// OutboundAddressFamily rejects the upstreams with the IP addresses of the other family, it must be the
+	// upstream.Options.AddressFamily of the upstreams. With upstream.AddressFamilyAuto, Start probes the routable
+	// families (see upstream.ProbeAddressFamilies), call NetworkChanged to probe them again.
+	OutboundAddressFamily upstream.AddressFamily
+
 	BeforeRequestHandler BeforeRequestHandler // callback that is called before each request
 	RequestHandler       RequestHandler       // callback that can handle incoming DNS requests
 	ResponseHandler      ResponseHandler      // response callback
 
+	// ListenerRequestHandlers overrides RequestHandler for the specific listen addresses.
+	// The keys are made by ListenerKey from the protocol and the configured listen address,
+	// e.g. "udp://127.0.0.1:53". RequestHandler is used for the listeners that aren't in the map.
+	ListenerRequestHandlers map[string]RequestHandler
+
+	// ListenerForwardedClasses is the query classes other than IN forwarded to the upstreams by the specific
+	// listen addresses (the keys are the same as in ListenerRequestHandlers), e.g. dns.ClassCHAOS.
+	// The queries of the other classes are refused, the CHAOS server queries are answered locally anyway.
+	ListenerForwardedClasses map[string][]uint16
+
 	DomainsReservedUpstreams map[string][]upstream.Upstream // map of domains and lists of corresponding upstreams
 
+	// UpdateUpstream is an upstream that processes dynamic UPDATE messages (RFC 2136).
+	// If nil, UPDATE messages are answered with NOTIMP (as well as NOTIFY messages).
+	UpdateUpstream upstream.Upstream
+
+	// MDNSEnabled enables the mDNS bridge: queries for the names under MDNSZones are
+	// resolved with one-shot multicast DNS queries on the local network instead of the upstreams.
+	// If nobody replies within MDNSTimeout, the response is NXDOMAIN.
+	MDNSEnabled bool
+	MDNSZones   []string      // zones resolved via mDNS (default: "local.")
+	MDNSTimeout time.Duration // how long mDNS responses are collected (default: 500ms)
+
+	// ServerVersion is the answer to TXT CH version.bind and version.server queries.
+	// ServerHostname is the answer to TXT CH hostname.bind and id.server queries.
+	// If empty, these queries are refused.
+	ServerVersion  string
+	ServerHostname string
+
+	// NSID is the server identifier sent in the NSID option (RFC 5001) to the clients that request it,
+	// e.g. to find out which instance has answered. If empty, the option is forwarded to the upstreams.
+	NSID string
+
+	// EnableExtendedErrors adds the Extended DNS Errors (RFC 8914) to the failure responses of the proxy,
+	// e.g. "No Reachable Authority" if all the upstreams have timed out. Only the clients that send OPT get them.
+	// ExtendedErrorsText also sends the error text with the names of the failed upstreams.
+	EnableExtendedErrors bool
+	ExtendedErrorsText   bool
+
+	// RetryServerErrors retries the SERVFAIL and REFUSED responses of the upstreams on the next upstream,
+	// the last one is returned if every upstream fails. Only the sequential mode retries them (not AllServers).
+	// With RespectUpstreamBlocking, the responses with the Blocked, Censored or Filtered Extended DNS Errors
+	// aren't retried, so the blocking of the upstream isn't bypassed.
+	RetryServerErrors       bool
+	RespectUpstreamBlocking bool
+
+	// StaticEntries are the names answered locally with the specified addresses, they are never forwarded.
+	// A and AAAA requests for them get the addresses, the other requests get NODATA,
+	// PTR requests for the addresses get the names. Use Proxy.SetStaticEntry to change them at runtime.
+	StaticEntries    map[string][]net.IP
+	StaticEntriesTTL uint32 // TTL of the static entries records (default: 10)
+
+	// CNAMEOverrides answer the queries for the names with the CNAME to the target, e.g. {"www.google.com":
+	// "forcesafesearch.google.com"}. The target is resolved as usual, its records follow the CNAME, which has their TTL.
+	// SafeSearch adds SafeSearchCNAMEs except the names of CNAMEOverrides.
+	// Use Proxy.SetCNAMEOverride to change them at runtime.
+	CNAMEOverrides map[string]string
+	SafeSearch     bool
+
+	// BlockIPv6 answers all the AAAA requests with NODATA and the SOA for the negative caching, so the network looks
+	// IPv4-only to the clients. The upstreams, the cache, the static entries and the CNAME overrides aren't used
+	// for them, the other types are resolved as usual. DNS64 is disabled: SetNAT64Prefix ignores the prefix.
+	BlockIPv6 bool
+
+	// ClientsSettings overrides the upstreams, cache and ECS settings for the clients from the specified subnets.
+	// If the client address matches several entries, the one with the longest prefix is used.
+	ClientsSettings []*ClientSettings
+
+	// TCPIdleTimeout is the idle timeout of the TCP and DoT connections (default: 10s).
+	// It is advertised in the edns-tcp-keepalive option (RFC 7828) to the clients that send it.
+	TCPIdleTimeout time.Duration
+
+	// SlowQueryThreshold enables the slow query log: the client queries processed longer than that are logged
+	// as warnings with their upstream exchanges and counted in Stats.SlowQueries (0 disables it)
+	SlowQueryThreshold time.Duration
+
+	// UpstreamFailureThreshold is the number of the consecutive failures after which an upstream is marked down
+	// (0 disables it: a failed upstream is only moved to the end of the list).
+	// The down upstreams aren't used for UpstreamCooldown (default: 30s), then a single query tries them first.
+	// If all the upstreams are down, the fallbacks are used at once.
+	UpstreamFailureThreshold int
+	UpstreamCooldown         time.Duration
+	// UpstreamGradualRecovery makes the upstream that has answered the probe "recovering": it's tried after
+	// the ones that are up and probed again after each cooldown until it answers UpstreamFailureThreshold times
+	// in a row (otherwise a single success restores it)
+	UpstreamGradualRecovery bool
+
 	MaxGoroutines int // maximum number of goroutines processing the DNS requests (important for mobile)
+
+	// Logger is used for all the messages of the proxy (github.com/AdguardTeam/golibs/log by default).
+	// Set upstream.Options.Logger (see ParseUpstreamsConfigWithOptions) to get the messages of the upstreams too.
+	Logger proxyutil.Logger
+
+	// Tracer starts the tracing spans of the queries (nothing is traced if nil): the span of each client query
+	// (SpanQuery) and its child spans of the cache lookup, the upstream exchanges and the response.
+	// It can be backed by OpenTelemetry, the spans of the upstreams nest if they implement upstream.ContextExchanger.
+	Tracer proxyutil.Tracer
 }
 
 // DNSContext represents a DNS request message context
@@ -145,8 +405,23 @@ type DNSContext struct {
 	Addr               net.Addr            // client address.
 	HTTPRequest        *http.Request       // HTTP request (for DOH only)
 	HTTPResponseWriter http.ResponseWriter // HTTP response writer (for DOH only)
+	ClientCert         *x509.Certificate   // verified client certificate (DoT and DoH with TLSClientAuth only)
 	StartTime          time.Time           // processing start time
 	Upstream           upstream.Upstream   // upstream that resolved DNS request
+	ListenAddr         net.Addr            // local address of the listener that received the request
+	ServedStale        bool                // true if the response was served from the optimistic cache after its TTL had expired
+	CachedResponse     bool                // true if the response was served from the cache
+	IPv6Blocked        bool                // true if the AAAA request has been answered with NODATA (see Config.BlockIPv6)
+
+	// ExtendedErrors are the Extended DNS Errors (RFC 8914) of the upstream or the cached response,
+	// e.g. the reason of the SERVFAIL, for ResponseHandler and the query logs
+	ExtendedErrors []ExtendedError
+
+	// CacheBypass disables the cache for this request: the response isn't served from the cache and isn't cached.
+	// It can be set by BeforeRequestHandler. The requests with the CD flag always bypass the cache.
+	CacheBypass bool
+
+	listener *listener // context of the listener that received the request (nil if the request was passed to ServeHTTP by the caller)
 
 	// Upstream servers to use for this request
 	// If set, Resolve() uses it instead of default servers
@@ -154,6 +429,37 @@ type DNSContext struct {
 
 	ecsReqIP   net.IP // ECS IP used in request
 	ecsReqMask uint8  // ECS mask used in request
+
+	tcpKeepalive bool // true if the client has sent edns-tcp-keepalive over TCP or TLS
+	nsid         bool // true if the client has requested NSID and Config.NSID is set
+
+	failedUpstreams []upstream.Upstream // the upstreams and the fallbacks that have failed (see ExtendedErrorsText)
+
+	cnameTarget bool // true for the request for the target of a CNAME override (see resolveCNAMEOverride)
+
+	client *clientGroup // settings of the client that sent the request (nil if the global settings are used)
+
+	secureUpstream bool // true if the response has come from an encrypted upstream (see ADPolicyPassthroughSecure)
+
+	ednsKey []byte // the allowed EDNS options of the request, a part of the cache key (see filterRequestOptions)
+
+	responded bool // true if the response has been sent (see recoverHandlerPanic)
+
+	// Unsupported is the reason the request has been answered locally with REFUSED or NOTIMP
+	// without forwarding it, e.g. UnsupportedOpcode (empty if it has been processed as usual)
+	Unsupported string
+
+	// Status is the outcome of the processing, e.g. StatusTimeout if all the upstreams have timed out.
+	// It's set by the failure paths before ResponseHandler is called and the response to the failed query is derived from it.
+	Status Status
+
+	proxyLogger proxyutil.Logger // Config.Logger of the proxy that handles the request (see logger)
+
+	state *proxyState // configuration of the proxy the request is processed with (see requestState)
+
+	ctx context.Context // context of the query with its tracing span (see Context)
+
+	attempts *upstreamAttempts // the upstream exchanges of the query (nil if the slow query log is disabled)
 }
 
 // UpstreamConfig is a wrapper for list of default upstreams and map of reserved domains and corresponding upstreams
@@ -165,6 +471,7 @@ type UpstreamConfig struct {
 // ParseUpstreamsConfig returns UpstreamConfig and error if upstreams configuration is invalid
 // default upstream syntax: <upstreamString>
 // reserved upstream syntax: [/domain1/../domainN/]<upstreamString>
+// The upstreams can be named: [name=]<upstream>, e.g. corp=tls://10.0.0.1 (see upstream.WithName)
 // More specific domains take priority over less specific domains,
 // To exclude more specific domains from reserved upstreams querying you should use the following syntax: [/domain1/../domainN/]#
 // So the following config: ["[/host.com/]1.2.3.4", "[/www.host.com/]2.3.4.5", "[/maps.host.com/]#", "3.4.5.6"]
@@ -181,31 +488,25 @@ type AddressToUpstreamFunction func(address string, opts upstream.Options) (upst
 
 // ParseUpstreamsConfigEx is an extended version of ParseUpstreamsConfig() which has a custom callback function which creates an upstream object
 func ParseUpstreamsConfigEx(upstreamConfig, bootstrapDNS []string, timeout time.Duration, addressToUpstreamFunction AddressToUpstreamFunction) (UpstreamConfig, error) {
+	return parseUpstreamsConfig(upstreamConfig, upstream.Options{Bootstrap: bootstrapDNS, Timeout: timeout}, addressToUpstreamFunction)
+}
+
+// ParseUpstreamsConfigWithOptions is a version of ParseUpstreamsConfig() that creates the upstreams with opts,
+// e.g. to set their Logger. The messages about the upstreams are written with opts.Logger too.
+func ParseUpstreamsConfigWithOptions(upstreamConfig []string, opts upstream.Options) (UpstreamConfig, error) {
+	return parseUpstreamsConfig(upstreamConfig, opts, upstream.AddressToUpstream)
+}
+
+// parseUpstreamsConfig parses the upstreams config, the upstreams are created by addressToUpstreamFunction with opts
+func parseUpstreamsConfig(upstreamConfig []string, opts upstream.Options, addressToUpstreamFunction AddressToUpstreamFunction) (UpstreamConfig, error) {
+	l := proxyutil.LoggerOrDefault(opts.Logger)
 	upstreams := []upstream.Upstream{}
 	domainReservedUpstreams := map[string][]upstream.Upstream{}
 
 	for i, u := range upstreamConfig {
-		hosts := []string{}
-		if strings.HasPrefix(u, "[/") {
-			// split domains and upstream string
-			domainsAndUpstream := strings.Split(strings.TrimPrefix(u, "[/"), "/]")
-			if len(domainsAndUpstream) != 2 {
-				return UpstreamConfig{}, fmt.Errorf("wrong upstream specification: %s", u)
-			}
-
-			// split domains list
-			for _, host := range strings.Split(domainsAndUpstream[0], "/") {
-				if host != "" {
-					if err := utils.IsValidHostname(host); err != nil {
-						return UpstreamConfig{}, err
-					}
-					hosts = append(hosts, strings.ToLower(host+"."))
-				} else {
-					// empty domain specification means `unqualified names only`
-					hosts = append(hosts, UnqualifiedNames)
-				}
-			}
-			u = domainsAndUpstream[1]
+		hosts, u, err := splitUpstreamEntry(u)
+		if err != nil {
+			return UpstreamConfig{}, err
 		}
 
 		// # excludes more specific domain from reserved upstreams querying
@@ -216,10 +517,16 @@ func ParseUpstreamsConfigEx(upstreamConfig, bootstrapDNS []string, timeout time.
 			continue
 		}
 
-		// create an upstream
-		dnsUpstream, err := addressToUpstreamFunction(u, upstream.Options{Bootstrap: bootstrapDNS, Timeout: timeout})
+		// create an upstream, the entries can be named: name=address
+		name, address := upstream.SplitName(u)
+		dnsUpstream, err := addressToUpstreamFunction(address, opts)
 		if err != nil {
-			return UpstreamConfig{}, fmt.Errorf("cannot prepare the upstream %s (%s): %s", u, bootstrapDNS, err)
+			return UpstreamConfig{}, fmt.Errorf("cannot prepare the upstream %s (%s): %s", u, opts.Bootstrap, err)
+		}
+		dnsUpstream = upstream.WithName(dnsUpstream, name)
+		desc := dnsUpstream.Address()
+		if name != "" {
+			desc = fmt.Sprintf("%s (%s)", name, desc)
 		}
 
 		if len(hosts) > 0 {
@@ -230,24 +537,52 @@ func ParseUpstreamsConfigEx(upstreamConfig, bootstrapDNS []string, timeout time.
 				}
 				domainReservedUpstreams[host] = append(domainReservedUpstreams[host], dnsUpstream)
 			}
-			log.Printf("Upstream %d: %s is reserved for next domains: %s", i, dnsUpstream.Address(), strings.Join(hosts, ", "))
+			l.Infof("Upstream %d: %s is reserved for next domains: %s", i, desc, strings.Join(hosts, ", "))
 		} else {
-			log.Printf("Upstream %d: %s", i, dnsUpstream.Address())
+			l.Infof("Upstream %d: %s", i, desc)
 			upstreams = append(upstreams, dnsUpstream)
 		}
 	}
 	return UpstreamConfig{Upstreams: upstreams, DomainReservedUpstreams: domainReservedUpstreams}, nil
 }
 
-// Init - initializes the proxy structures but does not start it
-func (p *Proxy) Init() {
-	if p.CacheEnabled {
-		log.Printf("DNS cache is enabled")
-		p.cache = &cache{cacheSize: p.CacheSizeBytes}
-		if p.Config.EnableEDNSClientSubnet {
-			p.cacheSubnet = &cacheSubnet{cacheSize: p.CacheSizeBytes}
+// splitUpstreamEntry splits the upstreams config entry into the reserved domains and the upstream address
+func splitUpstreamEntry(u string) (hosts []string, address string, err error) {
+	if !strings.HasPrefix(u, "[/") {
+		return nil, u, nil
+	}
+
+	// split domains and upstream string
+	domainsAndUpstream := strings.Split(strings.TrimPrefix(u, "[/"), "/]")
+	if len(domainsAndUpstream) != 2 {
+		return nil, "", fmt.Errorf("wrong upstream specification: %s", u)
+	}
+
+	// split domains list
+	for _, host := range strings.Split(domainsAndUpstream[0], "/") {
+		if host != "" {
+			if err := utils.IsValidHostname(host); err != nil {
+				return nil, "", err
+			}
+			hosts = append(hosts, strings.ToLower(host+"."))
+		} else {
+			// empty domain specification means `unqualified names only`
+			hosts = append(hosts, UnqualifiedNames)
 		}
 	}
+	return hosts, domainsAndUpstream[1], nil
+}
+
+// Init - initializes the proxy structures but does not start it
+func (p *Proxy) Init() {
+	p.initCache()
+	p.initClients()
+	p.initTrustedProxies()
+	p.initECSOverride()
+	p.initTTLOverrides()
+	p.initStaticEntries()
+	p.initCNAMEOverrides()
+	p.initMDNS()
 
 	if p.MaxGoroutines > 0 {
 		p.maxGoroutines = make(chan bool, p.MaxGoroutines)
@@ -257,12 +592,91 @@ func (p *Proxy) Init() {
 	}
 }
 
+// initCache creates the cache instances according to the cache settings
+func (p *Proxy) initCache() {
+	p.cache = nil
+	p.cacheSubnet = nil
+	if p.CacheEnabled {
+		p.logger().Infof("DNS cache is enabled")
+		p.cache, p.cacheSubnet = p.newCaches(p.ecsDefault())
+	}
+
+	workers := defaultCachePrefetchWorkers
+	if p.CachePrefetchWorkers > 0 {
+		workers = p.CachePrefetchWorkers
+	}
+	p.cacheRefreshLock.Lock()
+	p.prefetchWorkers = make(chan bool, workers)
+	p.cacheRefreshLock.Unlock()
+}
+
+// newCaches creates the general cache and, if ecs is true, the subnet cache instances
+func (p *Proxy) newCaches(ecs bool) (*cache, *cacheSubnet) {
+	var maxStale uint32
+	if p.CacheOptimistic {
+		maxStale = uint32(defaultCacheOptimisticMaxStale / time.Second)
+		if p.CacheOptimisticMaxStale > 0 {
+			maxStale = uint32(p.CacheOptimisticMaxStale / time.Second)
+		}
+	}
+
+	var prefetchHits uint32
+	if p.CachePrefetchThreshold > 0 {
+		prefetchHits = uint32(p.CachePrefetchThreshold)
+	}
+
+	maxNegativeTTL := uint32(defaultCacheMaxNegativeTTL)
+	if p.CacheMaxNegativeTTL > 0 {
+		maxNegativeTTL = p.CacheMaxNegativeTTL
+	}
+	failureTTL := p.CacheFailureTTL
+	if failureTTL > maxCacheFailureTTL {
+		failureTTL = maxCacheFailureTTL
+	}
+	var uncacheable map[int]bool
+	if p.CacheUncacheableRcodes != nil {
+		uncacheable = map[int]bool{}
+		for _, rc := range p.CacheUncacheableRcodes {
+			uncacheable[rc] = true
+		}
+	}
+	// the config is validated before, so the error is never returned
+	ttlCaps, _ := parseTTLCaps(p.CacheTTLCaps)
+
+	c := &cache{
+		cacheSize:      p.CacheSizeBytes,
+		maxStale:       maxStale,
+		prefetchHits:   prefetchHits,
+		maxNegativeTTL: maxNegativeTTL,
+		failureTTL:     failureTTL,
+		uncacheable:    uncacheable,
+		ttlCaps:        ttlCaps,
+		cnameChains:    p.CacheCNAMEChains,
+		evictionPolicy: p.CacheEvictionPolicy,
+		logger:         p.Logger,
+	}
+	if !ecs {
+		return c, nil
+	}
+	return c, &cacheSubnet{
+		cacheSize:      p.CacheSizeBytes,
+		maxStale:       maxStale,
+		prefetchHits:   prefetchHits,
+		maxNegativeTTL: maxNegativeTTL,
+		failureTTL:     failureTTL,
+		uncacheable:    uncacheable,
+		ttlCaps:        ttlCaps,
+		evictionPolicy: p.CacheEvictionPolicy,
+		logger:         p.Logger,
+	}
+}
+
 // Start initializes the proxy server and starts listening
 func (p *Proxy) Start() error {
 	p.Lock()
 	defer p.Unlock()
 
-	log.Println("Starting the DNS proxy server")
+	p.logger().Infof("Starting the DNS proxy server")
 	err := p.validateConfig()
 	if err != nil {
 		return err
@@ -270,103 +684,142 @@ func (p *Proxy) Start() error {
 
 	// Init cache
 	p.Init()
+	p.publishState()
+	loaded := p.loadCache()
+	p.probeAddressFamilies()
 
 	err = p.startListeners()
 	if err != nil {
+		p.closeListeners()
 		return err
 	}
 
 	p.started = true
+	p.startTime = time.Now()
+	atomic.StoreInt32(&p.draining, 0)
+
+	// the entries restored from the cache file are fresher than the ones the warm-up would resolve
+	if p.CacheWarmupFile != "" && loaded == 0 {
+		go p.warmupCache()
+	}
 	return nil
 }
 
 // Stop stops the proxy server including all its listeners
 func (p *Proxy) Stop() error {
-	log.Println("Stopping the DNS proxy server")
+	p.logger().Infof("Stopping the DNS proxy server")
+
+	// the loops serving UDPListeners are waited for after unlocking,
+	// so they don't read the packets after Stop returns
+	var udpLoopsDone []chan struct{}
+	defer func() {
+		for _, done := range udpLoopsDone {
+			<-done
+		}
+	}()
 
 	p.Lock()
 	defer p.Unlock()
 	if !p.started {
-		log.Println("The DNS proxy server is not started")
+		p.logger().Infof("The DNS proxy server is not started")
 		return nil
 	}
 
 	errs := []error{}
 
-	if p.tcpListen != nil {
-		err := p.tcpListen.Close()
-		p.tcpListen = nil
+	for _, l := range p.tcpListen {
+		err := l.Close()
 		if err != nil {
 			errs = append(errs, errorx.Decorate(err, "couldn't close TCP listening socket"))
 		}
 	}
+	p.tcpListen = nil
 
-	if p.udpListen != nil {
-		err := p.udpListen.Close()
-		p.udpListen = nil
+	for _, l := range p.udpListen {
+		var err error
+		if p.isCallerUDPListener(l) && !p.CloseUDPListeners {
+			// interrupt the read in udpPacketLoop, it exits since the proxy is stopped
+			err = l.SetReadDeadline(time.Now())
+		} else {
+			err = l.Close()
+		}
 		if err != nil {
 			errs = append(errs, errorx.Decorate(err, "couldn't close UDP listening socket"))
 		}
 	}
+	p.udpListen = nil
+	udpLoopsDone = p.udpLoopsDone
+	p.udpLoopsDone = nil
 
-	if p.tlsListen != nil {
-		err := p.tlsListen.Close()
-		p.tlsListen = nil
+	for _, l := range p.tlsListen {
+		err := l.Close()
 		if err != nil {
 			errs = append(errs, errorx.Decorate(err, "couldn't close TLS listening socket"))
 		}
 	}
+	p.tlsListen = nil
 
-	if p.httpsServer != nil {
-		err := p.httpsServer.Close()
-		p.httpsListen = nil
-		p.httpsServer = nil
+	for _, srv := range p.httpsServers {
+		err := srv.Close()
 		if err != nil {
 			errs = append(errs, errorx.Decorate(err, "couldn't close HTTPS server"))
 		}
 	}
+	p.httpsListen = nil
+	p.httpsServers = nil
 
 	if p.maxGoroutines != nil {
 		close(p.maxGoroutines)
 	}
 
+	p.saveCache()
+
 	p.started = false
-	log.Println("Stopped the DNS proxy server")
+	p.logger().Infof("Stopped the DNS proxy server")
 	if len(errs) != 0 {
 		return errorx.DecorateMany("Failed to stop DNS proxy server", errs...)
 	}
 	return nil
 }
 
-// Addr returns the listen address for the specified proto or null if the proxy does not listen to it
+// Addr returns the first listen address for the specified proto or null if the proxy does not listen to it
 // proto must be "tcp", "tls", "https" or "udp"
 func (p *Proxy) Addr(proto string) net.Addr {
+	addrs := p.Addrs(proto)
+	if len(addrs) == 0 {
+		return nil
+	}
+	return addrs[0]
+}
+
+// Addrs returns all the listen addresses for the specified proto
+// proto must be "tcp", "tls", "https" or "udp"
+func (p *Proxy) Addrs(proto string) []net.Addr {
 	p.RLock()
 	defer p.RUnlock()
+
+	var addrs []net.Addr
 	switch proto {
 	case ProtoTCP:
-		if p.tcpListen == nil {
-			return nil
+		for _, l := range p.tcpListen {
+			addrs = append(addrs, l.Addr())
 		}
-		return p.tcpListen.Addr()
 	case ProtoTLS:
-		if p.tlsListen == nil {
-			return nil
+		for _, l := range p.tlsListen {
+			addrs = append(addrs, l.Addr())
 		}
-		return p.tlsListen.Addr()
 	case ProtoHTTPS:
-		if p.httpsListen == nil {
-			return nil
+		for _, l := range p.httpsListen {
+			addrs = append(addrs, l.Addr())
 		}
-		return p.httpsListen.Addr()
 	case ProtoUDP:
-		if p.udpListen == nil {
-			return nil
+		for _, l := range p.udpListen {
+			addrs = append(addrs, l.LocalAddr())
 		}
-		return p.udpListen.LocalAddr()
 	default:
 		panic("proto must be 'tcp', 'tls', 'https' or 'udp'")
 	}
+	return addrs
 }
 
 // getUpstreamsForDomain looks for a domain in reserved domains map and returns a list of corresponding upstreams.
@@ -376,34 +829,59 @@ func (p *Proxy) Addr(proto string) net.Addr {
 // If we are looking for domain www.host.com, this method will return value of www.host.com key
 // If more specific domain value is nil, it means that domain was excluded and should be exchanged with default upstreams
 func (p *Proxy) getUpstreamsForDomain(host string) []upstream.Upstream {
-	if len(p.DomainsReservedUpstreams) == 0 {
-		return p.Upstreams
+	s := p.state()
+	return upstreamsForDomain(host, s.Upstreams, s.DomainsReservedUpstreams)
+}
+
+// upstreamsForDomain selects the upstreams for the host from the default and the reserved ones
+func upstreamsForDomain(host string, upstreams []upstream.Upstream, reserved map[string][]upstream.Upstream) []upstream.Upstream {
+	if len(reserved) == 0 {
+		return upstreams
 	}
 
-	dotsCount := strings.Count(host, ".")
-	if dotsCount < 2 {
-		return p.DomainsReservedUpstreams[UnqualifiedNames]
+	names := domainNames(host)
+	if names[0] == UnqualifiedNames {
+		return reserved[UnqualifiedNames]
 	}
 
-	for i := 1; i <= dotsCount; i++ {
-		h := strings.SplitAfterN(host, ".", i)
-		name := h[i-1]
-		if u, ok := p.DomainsReservedUpstreams[strings.ToLower(name)]; ok {
+	for _, name := range names {
+		if u, ok := reserved[name]; ok {
 			if u == nil {
 				// domain was excluded from reserved upstreams querying
-				return p.Upstreams
+				return upstreams
 			}
 			return u
 		}
 	}
 
-	return p.Upstreams
+	return upstreams
+}
+
+// domainNames returns the lowercased host and its parent domains (except the root) from the most specific one,
+// these are the keys that DomainsReservedUpstreams are looked up by.
+// The names with less than two dots (e.g. "host.") are only matched by UnqualifiedNames.
+func domainNames(host string) []string {
+	dotsCount := strings.Count(host, ".")
+	if dotsCount < 2 {
+		return []string{UnqualifiedNames}
+	}
+
+	host = strings.ToLower(host)
+	names := make([]string, 0, dotsCount)
+	for i := 0; i < dotsCount; i++ {
+		names = append(names, host)
+		host = host[strings.IndexByte(host, '.')+1:]
+	}
+	return names
 }
 
 // Set EDNS Client-Subnet data in DNS request
 func (p *Proxy) processECS(d *DNSContext) {
 	d.ecsReqIP = nil
 	d.ecsReqMask = uint8(0)
+	if p.overrideECS(d) {
+		return
+	}
 
 	ip, mask, _ := parseECS(d.Req)
 	if mask == 0 {
@@ -418,10 +896,14 @@ func (p *Proxy) processECS(d *DNSContext) {
 
 		if clientIP != nil && isPublicIP(clientIP) {
 			ip, mask = setECS(d.Req, clientIP, 0)
-			log.Debug("Set ECS data: %s/%d", ip, mask)
+			if l := p.logger(); l.DebugEnabled() {
+				l.Debugf("Set ECS data: %s/%d", ip, mask)
+			}
 		}
 	} else {
-		log.Debug("Passing through ECS data: %s/%d", ip, mask)
+		if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("Passing through ECS data: %s/%d", ip, mask)
+		}
 	}
 
 	d.ecsReqIP = ip
@@ -430,35 +912,58 @@ func (p *Proxy) processECS(d *DNSContext) {
 
 // Resolve is the default resolving method used by the DNS proxy to query upstreams
 func (p *Proxy) Resolve(d *DNSContext) error {
-	if p.Config.EnableEDNSClientSubnet {
-		p.processECS(d)
+	s := p.requestState(d)
+	if len(d.Req.Question) != 1 {
+		d.Res = p.statusResponse(d, StatusMalformed)
+		return fmt.Errorf("invalid number of questions: %d", len(d.Req.Question))
 	}
 
-	if p.replyFromCache(d) {
+	if p.resolveBlockedIPv6(d) {
+		p.normalizeResponseFlags(d)
+		if s.ResponseHandler != nil && !d.cnameTarget {
+			s.ResponseHandler(d, nil)
+		}
 		return nil
 	}
 
-	// Get custom upstreams first -- note that they might be empty
-	upstreams := d.Upstreams
-	if len(upstreams) == 0 {
-		// get upstreams for the specified hostname
-		upstreams = p.getUpstreamsForDomain(d.Req.Question[0].Name)
+	// the request for the target of the override doesn't call ResponseHandler, only the original one does
+	if ok, err := p.resolveCNAMEOverride(d); ok {
+		if s.ResponseHandler != nil {
+			s.ResponseHandler(d, err)
+		}
+		return err
 	}
 
-	// execute the DNS request
-	startTime := time.Now()
-	reply, u, err := p.exchange(d.Req, upstreams)
-	if p.isEmptyAAAAResponse(reply, d.Req) {
-		reply, u, err = p.checkDNS64(d.Req, reply, upstreams)
+	if p.resolveStatic(d) {
+		p.normalizeResponseFlags(d)
+		if s.ResponseHandler != nil && !d.cnameTarget {
+			s.ResponseHandler(d, nil)
+		}
+		return nil
 	}
 
-	rtt := int(time.Since(startTime) / time.Millisecond)
-	log.Tracef("RTT: %d ms", rtt)
+	if p.isMDNSName(d.Req.Question[0].Name) {
+		err := p.resolveMDNS(d)
+		p.normalizeResponseFlags(d)
+		if s.ResponseHandler != nil && !d.cnameTarget {
+			s.ResponseHandler(d, err)
+		}
+		return err
+	}
 
-	if err != nil && p.Fallbacks != nil {
-		log.Tracef("Using the fallback upstream due to %s", err)
-		reply, u, err = upstream.ExchangeParallel(p.Fallbacks, d.Req)
+	d.client = p.findClient(d.Addr)
+	if p.ecsEnabled(d) {
+		p.processECS(d)
 	}
+	p.filterRequestOptions(d)
+
+	if p.replyFromCache(d) {
+		d.ExtendedErrors = parseExtendedErrors(d.Res)
+		p.normalizeResponseFlags(d)
+		return nil
+	}
+
+	reply, u, err := p.resolveUpstream(d)
 
 	// set Upstream that resolved DNS request to DNSContext
 	if reply != nil {
@@ -469,43 +974,118 @@ func (p *Proxy) Resolve(d *DNSContext) error {
 	}
 
 	if reply == nil {
-		d.Res = p.genServerFailure(d.Req)
+		d.Res = p.statusResponse(d, upstreamStatus(err))
+		if code, ok := statusEDE(d.Status); ok && s.ExtendedErrorsText {
+			// the text names the upstreams, so the error of statusResponse is replaced
+			p.SetExtendedError(d, code, upstreamsErrorText(d.Status, d.failedUpstreams))
+		}
+		// only stored if the failure cache is enabled
+		p.setInCache(d, d.Res)
 	} else {
 		d.Res = reply
+		d.ExtendedErrors = parseExtendedErrors(reply)
 	}
 	d.Res.Compress = true // some devices require DNS message compression
+	p.normalizeResponseFlags(d)
 
-	if p.ResponseHandler != nil {
-		p.ResponseHandler(d, err)
+	if s.ResponseHandler != nil && !d.cnameTarget {
+		s.ResponseHandler(d, err)
 	}
 
 	return err
 }
 
-func (p *Proxy) exchange(req *dns.Msg, upstreams []upstream.Upstream) (reply *dns.Msg, u upstream.Upstream, err error) {
-	if p.AllServers {
-		reply, u, err = upstream.ExchangeParallel(upstreams, req)
+// resolveUpstream sends the request to the upstreams (or the fallbacks if the upstreams fail)
+func (p *Proxy) resolveUpstream(d *DNSContext) (reply *dns.Msg, u upstream.Upstream, err error) {
+	s := p.requestState(d)
+	// Get custom upstreams first -- note that they might be empty
+	upstreams := d.Upstreams
+	if len(upstreams) == 0 {
+		// get upstreams for the specified hostname
+		upstreams = p.clientUpstreams(d)
+	}
+
+	// execute the DNS request
+	req := p.upstreamRequest(d.Req)
+	startTime := time.Now()
+	reply, u, err = p.exchange(d.Context(), req, upstreams)
+	if p.isEmptyAAAAResponse(reply, req) {
+		reply, u, err = p.checkDNS64(d.Context(), req, reply, upstreams)
+	}
+
+	rtt := int(time.Since(startTime) / time.Millisecond)
+	if l := p.logger(); l.DebugEnabled() {
+		l.Debugf("RTT: %d ms", rtt)
+	}
+
+	if err != nil && s.Fallbacks != nil {
+		if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("Using the fallback upstream due to %s", err)
+		}
+		reply, u, err = p.exchangeParallel(d.Context(), s.Fallbacks, req)
+		p.recordParallelResult(s.Fallbacks, u, err)
+	}
+
+	// clamp the TTLs after DNS64, so the synthesized records are changed too
+	if reply != nil {
+		p.clampTTLs(reply)
+		p.filterResponseOptions(reply)
+	}
+	d.secureUpstream = u != nil && upstream.IsEncrypted(u)
+	if reply == nil {
+		// the fallbacks are always tried after the upstreams have failed
+		d.failedUpstreams = append(upstreams[:len(upstreams):len(upstreams)], s.Fallbacks...)
+	}
+	return reply, u, err
+}
+
+func (p *Proxy) exchange(ctx context.Context, req *dns.Msg, upstreams []upstream.Upstream) (reply *dns.Msg, u upstream.Upstream, err error) {
+	s := p.state()
+	// sort upstreams by rtt from fast to slow and skip the down ones
+	upstreams = p.selectUpstreams(upstreams, len(s.Fallbacks) > 0)
+	if len(upstreams) == 0 {
+		return nil, nil, errAllUpstreamsDown
+	}
+
+	if s.AllServers {
+		reply, u, err = p.exchangeParallel(ctx, upstreams, req)
+		p.recordParallelResult(upstreams, u, err)
 		return
 	}
 
 	if len(upstreams) == 1 {
 		u = upstreams[0]
-		reply, _, err = exchangeWithUpstream(u, req)
+		reply, _, err = p.exchangeValidated(ctx, u, req)
+		p.recordUpstreamResult(u, err)
 		return
 	}
 
-	// sort upstreams by rtt from fast to slow
-	sortedUpstreams := p.getSortedUpstreams(upstreams)
-
 	errs := []error{}
-	for _, dnsUpstream := range sortedUpstreams {
-		reply, elapsed, err := exchangeWithUpstream(dnsUpstream, req)
+	var retried *dns.Msg
+	var retriedUpstream upstream.Upstream
+	for _, dnsUpstream := range upstreams {
+		reply, elapsed, err := p.exchangeValidated(ctx, dnsUpstream, req)
+		p.recordUpstreamResult(dnsUpstream, err)
 		if err == nil {
-			p.updateRtt(dnsUpstream.Address(), elapsed)
-			return reply, dnsUpstream, err
+			p.updateRtt(upstream.Name(dnsUpstream), elapsed)
+			if !p.retryResponse(reply) {
+				return reply, dnsUpstream, err
+			}
+			if l := p.logger(); l.DebugEnabled() {
+				l.Debugf("Retrying the %s response of %s", dns.RcodeToString[reply.Rcode], upstream.Name(dnsUpstream))
+			}
+			retried, retriedUpstream = reply, dnsUpstream
+			continue
 		}
 		errs = append(errs, err)
-		p.updateRtt(dnsUpstream.Address(), int(defaultTimeout/time.Millisecond))
+		if s.UpstreamFailureThreshold <= 0 {
+			// without the state tracking, a single failure deprioritizes the upstream
+			p.updateRtt(upstream.Name(dnsUpstream), int(defaultTimeout/time.Millisecond))
+		}
+	}
+	if retried != nil {
+		// every upstream has failed or sent a server error, the last one is returned
+		return retried, retriedUpstream, nil
 	}
 	return nil, nil, errorx.DecorateMany("all upstreams failed to exchange request", errs...)
 }
@@ -517,7 +1097,7 @@ func (p *Proxy) getSortedUpstreams(u []upstream.Upstream) []upstream.Upstream {
 	copy(clone, u)
 
 	sort.Slice(clone, func(i, j int) bool {
-		if p.upstreamRttStats[clone[i].Address()] < p.upstreamRttStats[clone[j].Address()] {
+		if p.upstreamRttStats[upstream.Name(clone[i])] < p.upstreamRttStats[upstream.Name(clone[j])] {
 			return true
 		}
 		return false
@@ -527,15 +1107,23 @@ func (p *Proxy) getSortedUpstreams(u []upstream.Upstream) []upstream.Upstream {
 	return clone
 }
 
-// exchangeWithUpstream returns result of Exchange with elapsed time
-func exchangeWithUpstream(u upstream.Upstream, req *dns.Msg) (*dns.Msg, int, error) {
+// exchangeWithUpstream returns result of Exchange with elapsed time, ctx is passed to the upstream if it takes it
+// (see upstream.ExchangeContext)
+func exchangeWithUpstream(ctx context.Context, u upstream.Upstream, req *dns.Msg, l proxyutil.Logger) (*dns.Msg, int, error) {
 	startTime := time.Now()
-	reply, err := u.Exchange(req)
+	reply, err := upstream.ExchangeContext(ctx, u, req)
 	elapsed := int(time.Since(startTime) / time.Millisecond)
-	if err != nil {
-		log.Tracef("upstream %s failed to exchange %s in %d milliseconds. Cause: %s", u.Address(), req.Question[0].String(), elapsed, err)
-	} else {
-		log.Tracef("upstream %s successfully finished exchange of %s. Elapsed %d ms.", u.Address(), req.Question[0].String(), elapsed)
+	if l.DebugEnabled() {
+		fields := []logutil.Field{
+			logutil.F("qname", req.Question[0].Name),
+			logutil.F("upstream", upstream.Name(u)),
+			logutil.F("duration_ms", elapsed),
+		}
+		if err != nil {
+			logutil.Debug(l, "Upstream exchange failed", append(fields, logutil.F("err", err))...)
+		} else {
+			logutil.Debug(l, "Upstream exchange finished", fields...)
+		}
 	}
 	return reply, elapsed, err
 }
@@ -556,173 +1144,352 @@ func (p *Proxy) validateConfig() error {
 		return errors.New("server has been already started")
 	}
 
-	if p.UDPListenAddr == nil && p.TCPListenAddr == nil && p.TLSListenAddr == nil && p.HTTPSListenAddr == nil {
+	err := p.Config.validate()
+	if err != nil {
+		return err
+	}
+
+	if p.Ratelimit > 0 {
+		p.logger().Infof("Ratelimit is enabled and set to %d rps", p.Ratelimit)
+	}
+
+	if p.RefuseAny {
+		p.logger().Infof("The server is configured to refuse ANY requests")
+	}
+
+	return nil
+}
+
+// validate checks if the configuration is valid
+func (c *Config) validate() error {
+	if len(c.UDPListenAddr) == 0 && len(c.UDPListeners) == 0 && len(c.TCPListenAddr) == 0 &&
+		len(c.TLSListenAddr) == 0 && len(c.HTTPSListenAddr) == 0 {
 		return errors.New("no listen address specified")
 	}
 
-	if p.TLSListenAddr != nil && p.TLSConfig == nil {
+	for _, conn := range c.UDPListeners {
+		if conn == nil {
+			return errors.New("invalid UDP listener: nil")
+		}
+	}
+
+	if len(c.TLSListenAddr) > 0 && c.TLSConfig == nil {
 		return errors.New("cannot create a TLS listener without TLS config")
 	}
 
-	if p.HTTPSListenAddr != nil && p.TLSConfig == nil {
+	if len(c.HTTPSListenAddr) > 0 && c.TLSConfig == nil {
 		return errors.New("cannot create an HTTPS listener without TLS config")
 	}
 
-	if len(p.Upstreams) == 0 {
-		if len(p.DomainsReservedUpstreams) == 0 {
+	for _, path := range c.HTTPSServerPaths {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("invalid HTTPS server path: %s", path)
+		}
+	}
+
+	if len(c.Upstreams) == 0 {
+		if len(c.DomainsReservedUpstreams) == 0 {
 			return errors.New("no upstreams specified")
 		}
 		return errors.New("no default upstreams specified")
 	}
 
-	if p.Ratelimit > 0 {
-		log.Printf("Ratelimit is enabled and set to %d rps", p.Ratelimit)
+	for _, rc := range c.CacheUncacheableRcodes {
+		if _, ok := dns.RcodeToString[rc]; !ok {
+			return fmt.Errorf("invalid uncacheable rcode: %d", rc)
+		}
 	}
 
-	if p.RefuseAny {
-		log.Print("The server is configured to refuse ANY requests")
+	if c.CacheMaxTTL > 0 && c.CacheMinTTL > c.CacheMaxTTL {
+		return fmt.Errorf("cache min TTL %d is larger than max TTL %d", c.CacheMinTTL, c.CacheMaxTTL)
+	}
+
+	if _, err := parseTTLCaps(c.CacheTTLCaps); err != nil {
+		return err
+	}
+
+	if _, err := parseTTLOverrides(c.CacheTTLOverrides); err != nil {
+		return err
+	}
+
+	for name, ips := range c.StaticEntries {
+		if err := validateStaticEntry(name, ips); err != nil {
+			return err
+		}
+	}
+
+	for name, target := range c.CNAMEOverrides {
+		if err := validateCNAMEOverride(name, target); err != nil {
+			return err
+		}
+	}
+
+	if len(c.TrustedProxies) > 0 {
+		if _, err := parseSubnets(c.TrustedProxies); err != nil {
+			return fmt.Errorf("invalid trusted proxies: %s", err)
+		}
+	}
+
+	if c.UpstreamFailureThreshold < 0 || c.UpstreamCooldown < 0 {
+		return errors.New("upstream failure threshold and cooldown must not be negative")
 	}
 
+	for _, s := range c.ClientsSettings {
+		if _, err := parseSubnets(s.Subnets); err != nil {
+			return err
+		}
+		if s.UpstreamConfig != nil && len(s.UpstreamConfig.Upstreams) == 0 {
+			return fmt.Errorf("no default upstreams specified for clients %v", s.Subnets)
+		}
+	}
+
+	if err := c.validateECSOverride(); err != nil {
+		return err
+	}
+
+	if err := c.validateAddressFamily(); err != nil {
+		return err
+	}
+
+	return c.validateUpstreamNames()
+}
+
+// upstreamLists returns all the upstream lists of the config: the default ones, the fallbacks,
+// the upstreams for domains and the ones of the clients
+func (c *Config) upstreamLists() [][]upstream.Upstream {
+	lists := [][]upstream.Upstream{c.Upstreams, c.Fallbacks}
+	for _, list := range c.DomainsReservedUpstreams {
+		lists = append(lists, list)
+	}
+	for _, s := range c.ClientsSettings {
+		if s.UpstreamConfig != nil {
+			lists = append(lists, s.UpstreamConfig.Upstreams)
+			for _, list := range s.UpstreamConfig.DomainReservedUpstreams {
+				lists = append(lists, list)
+			}
+		}
+	}
+	return lists
+}
+
+// validateUpstreamNames checks that the names of the upstreams are unique (see upstream.WithName)
+func (c *Config) validateUpstreamNames() error {
+	named := map[string]upstream.Upstream{}
+	for _, list := range c.upstreamLists() {
+		for _, u := range list {
+			name := upstream.Name(u)
+			if name == u.Address() {
+				continue
+			}
+			if other, ok := named[name]; ok && other != u {
+				return fmt.Errorf("duplicate upstream name %s", name)
+			}
+			named[name] = u
+		}
+	}
 	return nil
 }
 
 // startListeners configures and starts listener loops
 func (p *Proxy) startListeners() error {
-	if p.UDPListenAddr != nil {
-		log.Printf("Creating the UDP server socket")
-		udpAddr := p.UDPListenAddr
+	// the loops are started when all the listeners are created
+	loops := []func(){}
+
+	for _, udpAddr := range p.UDPListenAddr {
+		p.logger().Infof("Creating the UDP server socket")
 		udpListen, err := net.ListenUDP("udp", udpAddr)
 		if err != nil {
 			return errorx.Decorate(err, "couldn't listen to UDP socket")
 		}
-		p.udpListen = udpListen
-		log.Printf("Listening to udp://%s", p.udpListen.LocalAddr())
+		p.udpListen = append(p.udpListen, udpListen)
+		p.logger().Infof("Listening to udp://%s", udpListen.LocalAddr())
+		l := p.newListener(ProtoUDP, udpAddr)
+		loops = append(loops, func() { p.udpPacketLoop(udpListen, l) })
 	}
 
-	if p.TCPListenAddr != nil {
-		log.Printf("Creating the TCP server socket")
-		tcpAddr := p.TCPListenAddr
+	for _, udpListen := range p.UDPListeners {
+		udpListen := udpListen
+		// reset the deadline set by the previous Stop
+		err := udpListen.SetReadDeadline(time.Time{})
+		if err != nil {
+			return errorx.Decorate(err, "invalid UDP listener")
+		}
+		p.udpListen = append(p.udpListen, udpListen)
+		p.logger().Infof("Listening to udp://%s", udpListen.LocalAddr())
+		l := p.newListener(ProtoUDP, udpListen.LocalAddr())
+		done := make(chan struct{})
+		p.udpLoopsDone = append(p.udpLoopsDone, done)
+		loops = append(loops, func() {
+			defer close(done)
+			p.udpPacketLoop(udpListen, l)
+		})
+	}
+
+	for _, tcpAddr := range p.TCPListenAddr {
+		p.logger().Infof("Creating the TCP server socket")
 		tcpListen, err := net.ListenTCP("tcp", tcpAddr)
 		if err != nil {
 			return errorx.Decorate(err, "couldn't listen to TCP socket")
 		}
-		p.tcpListen = tcpListen
-		log.Printf("Listening to tcp://%s", p.tcpListen.Addr())
+		p.tcpListen = append(p.tcpListen, tcpListen)
+		p.logger().Infof("Listening to tcp://%s", tcpListen.Addr())
+		l := p.newListener(ProtoTCP, tcpAddr)
+		loops = append(loops, func() { p.tcpPacketLoop(tcpListen, l) })
 	}
 
-	if p.TLSListenAddr != nil {
-		log.Printf("Creating the TLS server socket")
-		tlsAddr := p.TLSListenAddr
+	for _, tlsAddr := range p.TLSListenAddr {
+		p.logger().Infof("Creating the TLS server socket")
 		tcpListen, err := net.ListenTCP("tcp", tlsAddr)
 		if err != nil {
 			return errorx.Decorate(err, "could not start TLS listener")
 		}
-		p.tlsListen = tls.NewListener(tcpListen, p.TLSConfig)
-		log.Printf("Listening to tls://%s", p.tlsListen.Addr())
+		tlsListen := tls.NewListener(tcpListen, p.serverTLSConfig())
+		p.tlsListen = append(p.tlsListen, tlsListen)
+		p.logger().Infof("Listening to tls://%s", tlsListen.Addr())
+		l := p.newListener(ProtoTLS, tlsAddr)
+		loops = append(loops, func() { p.tcpPacketLoop(tlsListen, l) })
 	}
 
-	if p.HTTPSListenAddr != nil {
-		log.Printf("Creating the HTTPS server")
-		tcpListen, err := net.ListenTCP("tcp", p.HTTPSListenAddr)
+	for _, httpsAddr := range p.HTTPSListenAddr {
+		p.logger().Infof("Creating the HTTPS server")
+		tcpListen, err := net.ListenTCP("tcp", httpsAddr)
 		if err != nil {
 			return errorx.Decorate(err, "could not start HTTPS listener")
 		}
-		p.httpsListen = tls.NewListener(tcpListen, p.TLSConfig)
-		log.Printf("Listening to https://%s", p.httpsListen.Addr())
-		p.httpsServer = &http.Server{
-			Handler:           p,
+		httpsListen := tls.NewListener(tcpListen, p.serverTLSConfig())
+		p.logger().Infof("Listening to https://%s", httpsListen.Addr())
+		srv := &http.Server{
+			Handler:           p.newHTTPSHandler(p.newListener(ProtoHTTPS, httpsAddr)),
 			ReadHeaderTimeout: defaultTimeout,
 			WriteTimeout:      defaultTimeout,
+			ErrorLog:          p.newHTTPSErrorLog(),
 		}
+		p.httpsListen = append(p.httpsListen, httpsListen)
+		p.httpsServers = append(p.httpsServers, srv)
+		loops = append(loops, func() { p.listenHTTPS(srv, httpsListen) })
 	}
 
-	if p.udpListen != nil {
-		go p.udpPacketLoop(p.udpListen)
+	for _, loop := range loops {
+		go loop()
 	}
 
-	if p.tcpListen != nil {
-		go p.tcpPacketLoop(p.tcpListen, ProtoTCP)
-	}
+	return nil
+}
 
-	if p.tlsListen != nil {
-		go p.tcpPacketLoop(p.tlsListen, ProtoTLS)
+// closeListeners closes the listeners created by startListeners when one of them has failed,
+// so the proxy isn't left listening on a part of the addresses (the loops aren't started yet)
+func (p *Proxy) closeListeners() {
+	for _, l := range p.udpListen {
+		if !p.isCallerUDPListener(l) || p.CloseUDPListeners {
+			_ = l.Close()
+		}
 	}
+	for _, l := range p.tcpListen {
+		_ = l.Close()
+	}
+	for _, l := range p.tlsListen {
+		_ = l.Close()
+	}
+	for _, l := range p.httpsListen {
+		_ = l.Close()
+	}
+	p.udpListen, p.udpLoopsDone, p.tcpListen, p.tlsListen, p.httpsListen, p.httpsServers = nil, nil, nil, nil, nil, nil
+}
 
-	if p.httpsListen != nil {
-		go p.listenHTTPS()
+// isCallerUDPListener checks if conn is one of UDPListeners
+func (p *Proxy) isCallerUDPListener(conn *net.UDPConn) bool {
+	for _, c := range p.UDPListeners {
+		if c == conn {
+			return true
+		}
 	}
+	return false
+}
 
-	return nil
+// udpBufferSize returns the size of the UDP read buffers
+func (p *Proxy) udpBufferSize() int {
+	s := p.state()
+	if s.UDPBufferSize > 0 {
+		return s.UDPBufferSize
+	}
+	return dns.MaxMsgSize
 }
 
 // udpPacketLoop listens for incoming UDP packets
-func (p *Proxy) udpPacketLoop(conn *net.UDPConn) {
-	log.Printf("Entering the UDP listener loop on %s", conn.LocalAddr())
-	b := make([]byte, dns.MaxMsgSize)
+// On Linux, the packets are read and the responses are written in batches (see udpBatchLoop)
+func (p *Proxy) udpPacketLoop(conn *net.UDPConn, l *listener) {
+	p.logger().Infof("Entering the UDP listener loop on %s", conn.LocalAddr())
+	if bc := newUDPBatchConn(conn); bc != nil && p.udpBatchLoop(conn, bc, l) {
+		return
+	}
+
+	b := make([]byte, p.udpBufferSize())
 	for {
 		p.RLock()
-		if !p.started {
+		started := p.started
+		p.RUnlock()
+		if !started {
 			return
 		}
-		p.RUnlock()
 
 		n, addr, err := conn.ReadFrom(b)
 		// documentation says to handle the packet even if err occurs, so do that first
 		if n > 0 {
-			// make a copy of all bytes because ReadFrom() will overwrite contents of b on next call
-			// we need the contents to survive the call because we're handling them in goroutine
-			packet := make([]byte, n)
-			copy(packet, b)
-			p.guardMaxGoroutines()
-			go func() {
-				p.handleUDPPacket(packet, addr, conn) // ignore errors
-				p.freeMaxGoroutines()
-			}()
+			p.dispatchUDPPacket(b[:n], addr, conn, l)
 		}
 		if err != nil {
 			if isConnClosed(err) {
-				log.Printf("udpListen.ReadFrom() returned because we're reading from a closed connection, exiting loop")
+				p.logger().Infof("udpListen.ReadFrom() returned because we're reading from a closed connection, exiting loop")
 				break
 			}
-			log.Printf("got error when reading from UDP listen: %s", err)
+			p.logger().Infof("got error when reading from UDP listen: %s", err)
 		}
 	}
 }
 
 // handleUDPPacket processes the incoming UDP packet and sends a DNS response
-func (p *Proxy) handleUDPPacket(packet []byte, addr net.Addr, conn *net.UDPConn) {
-	log.Tracef("Start handling new UDP packet from %s", addr)
+func (p *Proxy) handleUDPPacket(packet []byte, addr net.Addr, conn *net.UDPConn, l *listener) {
+	if l := p.logger(); l.DebugEnabled() {
+		l.Debugf("Start handling new UDP packet from %s", addr)
+	}
 
-	msg := &dns.Msg{}
-	err := msg.Unpack(packet)
+	msg, err := unpackRequest(packet)
 	if err != nil {
-		log.Printf("error handling UDP packet: %s", err)
+		p.logger().Infof("error handling UDP packet: %s", err)
 		return
 	}
 
 	d := &DNSContext{
-		Proto: "udp",
-		Req:   msg,
-		Addr:  addr,
-		Conn:  conn,
+		Proto:      "udp",
+		Req:        msg,
+		Addr:       addr,
+		Conn:       conn,
+		ListenAddr: conn.LocalAddr(),
+		listener:   l,
 	}
 
 	err = p.handleDNSRequest(d)
 	if err != nil {
-		log.Tracef("error handling DNS (%s) request: %s", d.Proto, err)
+		if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("error handling DNS (%s) request: %s", d.Proto, err)
+		}
 	}
 }
 
 // Writes a response to the UDP client
 func (p *Proxy) respondUDP(d *DNSContext) error {
-	resp := d.Res
 	conn := d.Conn.(*net.UDPConn)
 
-	bytes, err := resp.Pack()
+	bytes, err := p.packClientResponse(d)
 	if err != nil {
-		return errorx.Decorate(err, "couldn't convert message into wire format: %s", resp.String())
+		return err
+	}
+	var n int
+	if d.listener != nil && d.listener.udpWriter != nil {
+		n, err = d.listener.udpWriter.write(bytes, d.Addr)
+	} else {
+		n, err = conn.WriteTo(bytes, d.Addr)
 	}
-	n, err := conn.WriteTo(bytes, d.Addr)
 	if n == 0 && isConnClosed(err) {
 		return err
 	}
@@ -736,22 +1503,22 @@ func (p *Proxy) respondUDP(d *DNSContext) error {
 }
 
 // tcpPacketLoop listens for incoming TCP packets
-// proto is either "tcp" or "tls"
-func (p *Proxy) tcpPacketLoop(l net.Listener, proto string) {
-	log.Printf("Entering the %s listener loop on %s", proto, l.Addr())
+// the listener protocol is either "tcp" or "tls"
+func (p *Proxy) tcpPacketLoop(tcpListen net.Listener, l *listener) {
+	p.logger().Infof("Entering the %s listener loop on %s", l.proto, tcpListen.Addr())
 	for {
-		clientConn, err := l.Accept()
+		clientConn, err := tcpListen.Accept()
 
 		if err != nil {
 			if isConnClosed(err) {
-				log.Printf("tcpListen.Accept() returned because we're reading from a closed connection, exiting loop")
+				p.logger().Infof("tcpListen.Accept() returned because we're reading from a closed connection, exiting loop")
 				break
 			}
-			log.Printf("got error when reading from TCP listen: %s", err)
+			p.logger().Infof("got error when reading from TCP listen: %s", err)
 		} else {
 			p.guardMaxGoroutines()
 			go func() {
-				p.handleTCPConnection(clientConn, proto)
+				p.handleTCPConnection(clientConn, l)
 				p.freeMaxGoroutines()
 			}()
 		}
@@ -759,11 +1526,23 @@ func (p *Proxy) tcpPacketLoop(l net.Listener, proto string) {
 }
 
 // handleTCPConnection starts a loop that handles an incoming TCP connection
-// proto is either "tcp" or "tls"
-func (p *Proxy) handleTCPConnection(conn net.Conn, proto string) {
-	log.Tracef("Start handling the new %s connection %s", proto, conn.RemoteAddr())
+// the listener protocol is either "tcp" or "tls"
+func (p *Proxy) handleTCPConnection(conn net.Conn, l *listener) {
+	if log := p.logger(); log.DebugEnabled() {
+		log.Debugf("Start handling the new %s connection %s", l.proto, conn.RemoteAddr())
+	}
 	defer conn.Close()
 
+	var cert *x509.Certificate
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn.SetDeadline(time.Now().Add(defaultTimeout)) //nolint
+		var err error
+		cert, err = p.handshakeTLS(tlsConn)
+		if err != nil {
+			return
+		}
+	}
+
 	for {
 		p.RLock()
 		if !p.started {
@@ -771,41 +1550,45 @@ func (p *Proxy) handleTCPConnection(conn net.Conn, proto string) {
 		}
 		p.RUnlock()
 
-		conn.SetDeadline(time.Now().Add(defaultTimeout)) //nolint
+		// the idle timeout is advertised to the clients that use edns-tcp-keepalive
+		conn.SetDeadline(time.Now().Add(p.tcpIdleTimeout())) //nolint
 		packet, err := readPrefixed(&conn)
 		if err != nil {
 			return
 		}
 
-		msg := &dns.Msg{}
-		err = msg.Unpack(packet)
+		msg, err := unpackRequest(packet)
 		if err != nil {
-			log.Printf("error handling TCP packet: %s", err)
+			p.logger().Infof("error handling TCP packet: %s", err)
 			return
 		}
 
 		d := &DNSContext{
-			Proto: proto,
-			Req:   msg,
-			Addr:  conn.RemoteAddr(),
-			Conn:  conn,
+			Proto:      l.proto,
+			Req:        msg,
+			Addr:       conn.RemoteAddr(),
+			Conn:       conn,
+			ClientCert: cert,
+			ListenAddr: conn.LocalAddr(),
+			listener:   l,
 		}
 
 		err = p.handleDNSRequest(d)
 		if err != nil {
-			log.Tracef("error handling DNS (%s) request: %s", d.Proto, err)
+			if l := p.logger(); l.DebugEnabled() {
+				l.Debugf("error handling DNS (%s) request: %s", d.Proto, err)
+			}
 		}
 	}
 }
 
 // Writes a response to the TCP (or TLS) client
 func (p *Proxy) respondTCP(d *DNSContext) error {
-	resp := d.Res
 	conn := d.Conn
 
-	bytes, err := resp.Pack()
+	bytes, err := p.packClientResponse(d)
 	if err != nil {
-		return errorx.Decorate(err, "couldn't convert message into wire format: %s", resp.String())
+		return err
 	}
 
 	bytes, err = prefixWithSize(bytes)
@@ -827,14 +1610,14 @@ func (p *Proxy) respondTCP(d *DNSContext) error {
 }
 
 // serveHttps starts the HTTPS server
-func (p *Proxy) listenHTTPS() {
-	log.Printf("Listening to DNS-over-HTTPS on %s", p.httpsListen.Addr())
-	err := p.httpsServer.Serve(p.httpsListen)
+func (p *Proxy) listenHTTPS(srv *http.Server, l net.Listener) {
+	p.logger().Infof("Listening to DNS-over-HTTPS on %s", l.Addr())
+	err := srv.Serve(l)
 
 	if err != http.ErrServerClosed {
-		log.Printf("HTTPS server was closed unexpectedly: %s", err)
+		p.logger().Infof("HTTPS server was closed unexpectedly: %s", err)
 	} else {
-		log.Printf("HTTPS server was closed")
+		p.logger().Infof("HTTPS server was closed")
 	}
 }
 
@@ -843,8 +1626,21 @@ func (p *Proxy) listenHTTPS() {
 // http.StatusBadRequest - if there is no DNS request data
 // http.StatusUnsupportedMediaType - if request content type is not application/dns-message
 // http.StatusMethodNotAllowed - if request method is not GET or POST
+// http.StatusForbidden - if DoHAuthTokens are configured and the request has no valid token
+// JSON DNS API requests (see isJSONRequest) are handled by serveJSON.
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Tracef("Incoming HTTPS request on %s", r.URL)
+	if !p.authorizeDoH(w, r) {
+		return
+	}
+
+	if l := p.logger(); l.DebugEnabled() {
+		l.Debugf("Incoming HTTPS request on %s", r.URL)
+	}
+
+	if isJSONRequest(r) {
+		p.serveJSON(w, r)
+		return
+	}
 
 	var buf []byte
 	var err error
@@ -854,33 +1650,41 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		dnsParam := r.URL.Query().Get("dns")
 		buf, err = base64.RawURLEncoding.DecodeString(dnsParam)
 		if len(buf) == 0 || err != nil {
-			log.Tracef("Cannot parse DNS request from %s", dnsParam)
+			if l := p.logger(); l.DebugEnabled() {
+				l.Debugf("Cannot parse DNS request from %s", dnsParam)
+			}
 			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
 		}
 	case http.MethodPost:
 		contentType := r.Header.Get("Content-Type")
 		if contentType != "application/dns-message" {
-			log.Tracef("Unsupported media type: %s", contentType)
+			if l := p.logger(); l.DebugEnabled() {
+				l.Debugf("Unsupported media type: %s", contentType)
+			}
 			http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
 			return
 		}
 
 		buf, err = ioutil.ReadAll(r.Body)
 		if err != nil {
-			log.Tracef("Cannot read the request body: %s", err)
+			if l := p.logger(); l.DebugEnabled() {
+				l.Debugf("Cannot read the request body: %s", err)
+			}
 			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
 		}
 		defer r.Body.Close()
 	default:
-		log.Tracef("Wrong HTTP method: %s", r.Method)
+		if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("Wrong HTTP method: %s", r.Method)
+		}
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
 
-	msg := new(dns.Msg)
-	if err = msg.Unpack(buf); err != nil {
+	msg, err := unpackRequest(buf)
+	if err != nil {
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
@@ -893,50 +1697,35 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		Addr:               addr,
 		HTTPRequest:        r,
 		HTTPResponseWriter: w,
+		ClientCert:         clientCert(r.TLS),
+		ListenAddr:         localAddrFromHTTPRequest(r),
+		listener:           listenerFromHTTPRequest(r),
+		ctx:                r.Context(),
 	}
 
 	err = p.handleDNSRequest(d)
 	if err != nil {
-		log.Tracef("error handling DNS (%s) request: %s", d.Proto, err)
-	}
-}
-
-// Get a client IP address from HTTP headers that proxy servers may set
-func getIPFromHTTPRequest(r *http.Request) net.IP {
-	names := []string{
-		"CF-Connecting-IP", "True-Client-IP", // set by CloudFlare servers
-		"X-Real-IP",
-	}
-	for _, name := range names {
-		s := r.Header.Get(name)
-		ip := net.ParseIP(s)
-		if ip != nil {
-			return ip
+		if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("error handling DNS (%s) request: %s", d.Proto, err)
 		}
 	}
-
-	s := r.Header.Get("X-Forwarded-For")
-	s = splitNext(&s, ',') // get left-most IP address
-	ip := net.ParseIP(s)
-	if ip != nil {
-		return ip
-	}
-
-	return nil
 }
 
 // Writes a response to the DOH client
 func (p *Proxy) respondHTTPS(d *DNSContext) error {
-	resp := d.Res
+	if isJSONRequest(d.HTTPRequest) {
+		return p.respondJSON(d)
+	}
+
 	w := d.HTTPResponseWriter
 
-	bytes, err := resp.Pack()
+	bytes, err := p.packClientResponse(d)
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return errorx.Decorate(err, "couldn't convert message into wire format: %s", resp.String())
+		return err
 	}
 
-	w.Header().Set("Server", "AdGuard DNS")
+	w.Header().Set("Server", p.serverHeader())
 	w.Header().Set("Content-Type", "application/dns-message")
 	_, err = w.Write(bytes)
 	return err
@@ -953,11 +1742,14 @@ func (p *Proxy) remoteAddr(r *http.Request) (net.Addr, error) {
 		return nil, err
 	}
 
-	ip := getIPFromHTTPRequest(r)
+	peer := net.ParseIP(host)
+	ip := p.forwardedClientIP(r, peer)
 	if ip != nil {
-		log.Debug("Using IP address from HTTP request: %s", ip)
+		if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("Using IP address from HTTP request: %s", ip)
+		}
 	} else {
-		ip = net.ParseIP(host)
+		ip = peer
 		if ip == nil {
 			return nil, fmt.Errorf("invalid IP: %s", host)
 		}
@@ -981,15 +1773,35 @@ func (p *Proxy) freeMaxGoroutines() {
 }
 
 // handleDNSRequest processes the incoming packet bytes and returns with an optional response packet.
-func (p *Proxy) handleDNSRequest(d *DNSContext) error {
+func (p *Proxy) handleDNSRequest(d *DNSContext) (err error) {
+	// counted before the check, so Shutdown waits for the queries accepted before it's called
+	atomic.AddInt32(&p.inFlight, 1)
+	defer atomic.AddInt32(&p.inFlight, -1)
+	defer p.recoverHandlerPanic(d)
+	if atomic.LoadInt32(&p.draining) == 1 {
+		return nil // the proxy is shutting down, don't reply
+	}
+
 	d.StartTime = time.Now()
+	// the configuration is loaded once, so a concurrent Reload doesn't change it in the middle of the request
+	d.state = p.state()
+	s := d.state
+	d.proxyLogger = s.Logger
+	endSpan := p.startQuerySpan(d)
+	p.startSlowQueryLog(d)
+	defer func() {
+		p.recordStatus(d.Status)
+		p.recordListenerQuery(d)
+		p.logSlowQuery(d)
+		endSpan(err)
+	}()
 	p.logDNSMessage(d.Req)
 
-	if p.BeforeRequestHandler != nil {
-		ok, err := p.BeforeRequestHandler(p, d)
+	if s.BeforeRequestHandler != nil {
+		ok, err := s.BeforeRequestHandler(p, d)
 		if err != nil {
-			log.Error("Error in the BeforeRequestHandler: %s", err)
-			d.Res = p.genServerFailure(d.Req)
+			p.logger().Errorf("Error in the BeforeRequestHandler: %s", err)
+			d.Res = p.statusResponse(d, StatusInternalError)
 			p.respond(d)
 			return nil
 		}
@@ -1000,43 +1812,65 @@ func (p *Proxy) handleDNSRequest(d *DNSContext) error {
 
 	// ratelimit based on IP only, protects CPU cycles and outbound connections
 	if d.Proto == ProtoUDP && p.isRatelimited(d.Addr) {
-		log.Tracef("Ratelimiting %v based on IP only", d.Addr)
+		if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("Ratelimiting %v based on IP only", d.Addr)
+		}
+		d.Status = StatusRatelimited
+		p.logProcessed(d, nil)
 		return nil // do nothing, don't reply, we got ratelimited
 	}
 
 	if len(d.Req.Question) != 1 {
-		log.Printf("got invalid number of questions: %v", len(d.Req.Question))
-		d.Res = p.genServerFailure(d.Req)
+		p.logger().Infof("got invalid number of questions: %v", len(d.Req.Question))
+		d.Res = p.statusResponse(d, StatusMalformed)
 	}
 
 	// refuse ANY requests (anti-DDOS measure)
-	if p.RefuseAny && len(d.Req.Question) > 0 && d.Req.Question[0].Qtype == dns.TypeANY {
-		log.Tracef("Refusing type=ANY request")
-		d.Res = p.genNotImpl(d.Req)
+	if d.Res == nil && s.RefuseAny && len(d.Req.Question) > 0 && d.Req.Question[0].Qtype == dns.TypeANY {
+		p.logger().Debugf("Refusing type=ANY request")
+		d.Res = p.statusResponse(d, StatusNotImplemented)
 	}
 
-	var err error
+	// AXFR/IXFR, NOTIFY and UPDATE are never forwarded to the regular upstreams
+	if d.Res == nil {
+		d.Res = p.checkUnsupportedRequest(d)
+	}
 
+	// edns-tcp-keepalive is processed here and removed from the request
+	if d.Res == nil && len(d.Req.Question) > 0 {
+		d.Res = p.checkTCPKeepaliveRequest(d)
+	}
+	p.checkNSIDRequest(d)
+
+	// version.bind and similar CHAOS queries are answered locally
 	if d.Res == nil {
-		if len(p.Upstreams) == 0 {
+		d.Res = p.checkChaosRequest(d)
+	}
+
+	if d.Res == nil {
+		if len(s.Upstreams) == 0 {
 			panic("SHOULD NOT HAPPEN: no default upstreams specified")
 		}
 
 		// execute the DNS request
 		// if there is a custom middleware configured, use it
-		if p.RequestHandler != nil {
-			err = p.RequestHandler(p, d)
+		if handler := p.requestHandler(d); handler != nil {
+			err = handler(p, d)
 		} else {
 			err = p.Resolve(d)
 		}
 
 		if err != nil {
 			err = errorx.Decorate(err, "talking to dnsUpstream failed")
+			if d.Status == StatusOK {
+				d.Status = StatusInternalError
+			}
 		}
 	}
 
 	p.logDNSMessage(d.Res)
 	p.respond(d)
+	p.logProcessed(d, err)
 	return err
 }
 
@@ -1045,6 +1879,10 @@ func (p *Proxy) respond(d *DNSContext) {
 	if d.Res == nil {
 		return
 	}
+	d.responded = true
+
+	p.setTCPKeepalive(d)
+	p.setNSID(d)
 
 	// d.Conn can be nil in the case of a DOH request
 	if d.Conn != nil {
@@ -1052,6 +1890,8 @@ func (p *Proxy) respond(d *DNSContext) {
 	}
 
 	var err error
+	endSpan := p.startRespondSpan(d)
+	defer func() { endSpan(err) }()
 
 	switch d.Proto {
 	case ProtoUDP:
@@ -1069,9 +1909,11 @@ func (p *Proxy) respond(d *DNSContext) {
 	if err != nil {
 		if strings.HasSuffix(err.Error(), "use of closed network connection") {
 			// This case may happen while we're restarting DNS server
-			log.Debug("error while responding to a DNS request: %s", err)
+			if l := p.logger(); l.DebugEnabled() {
+				l.Debugf("error while responding to a DNS request: %s", err)
+			}
 		} else {
-			log.Printf("error while responding to a DNS request: %s", err)
+			p.logger().Infof("error while responding to a DNS request: %s", err)
 		}
 	}
 }
@@ -1083,6 +1925,23 @@ func (p *Proxy) genServerFailure(request *dns.Msg) *dns.Msg {
 	return &resp
 }
 
+func (p *Proxy) genRefused(request *dns.Msg) *dns.Msg {
+	resp := dns.Msg{}
+	resp.SetRcode(request, dns.RcodeRefused)
+	resp.RecursionAvailable = true
+	return &resp
+}
+
+func (p *Proxy) genFormErr(request *dns.Msg) *dns.Msg {
+	resp := dns.Msg{}
+	resp.SetRcode(request, dns.RcodeFormatError)
+	resp.RecursionAvailable = true
+	if request.IsEdns0() != nil {
+		resp.SetEdns0(1452, false) // the request has EDNS, so the response has it too
+	}
+	return &resp
+}
+
 func (p *Proxy) genNotImpl(request *dns.Msg) *dns.Msg {
 	resp := dns.Msg{}
 	resp.SetRcode(request, dns.RcodeNotImplemented)
@@ -1093,8 +1952,48 @@ func (p *Proxy) genNotImpl(request *dns.Msg) *dns.Msg {
 
 func (p *Proxy) logDNSMessage(m *dns.Msg) {
 	if m.Response {
-		log.Tracef("OUT: %s", m)
+		if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("OUT: %s", m)
+		}
 	} else {
-		log.Tracef("IN: %s", m)
+		if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("IN: %s", m)
+		}
+	}
+}
+
+// logProcessed writes the debug message with the summary of the processed query
+func (p *Proxy) logProcessed(d *DNSContext, err error) {
+	l := p.logger()
+	if !l.DebugEnabled() || len(d.Req.Question) == 0 {
+		return
+	}
+
+	q := d.Req.Question[0]
+	fields := []logutil.Field{
+		logutil.F("qname", q.Name),
+		logutil.F("qtype", dns.TypeToString[q.Qtype]),
+		logutil.F("proto", d.Proto),
+	}
+	if d.Addr != nil {
+		fields = append(fields, logutil.F("client", d.Addr.String()))
+	}
+	if d.Upstream != nil {
+		fields = append(fields, logutil.F("upstream", upstream.Name(d.Upstream)))
+	}
+	if d.Res != nil {
+		fields = append(fields, logutil.F("rcode", dns.RcodeToString[d.Res.Rcode]))
+	}
+	if d.Unsupported != "" {
+		fields = append(fields, logutil.F("unsupported", d.Unsupported))
+	}
+	for _, e := range d.ExtendedErrors {
+		fields = append(fields, logutil.F("ede", e.String()))
+	}
+	fields = append(fields, logutil.F("status", d.Status.String()))
+	fields = append(fields, logutil.F("duration_ms", time.Since(d.StartTime)))
+	if err != nil {
+		fields = append(fields, logutil.F("err", err))
 	}
+	logutil.Debug(l, "Processed the query", fields...)
 }
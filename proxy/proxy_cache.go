@@ -1,76 +1,180 @@
 package proxy
 
 import (
-	"github.com/AdguardTeam/golibs/log"
+	"fmt"
+	"sync/atomic"
+
 	"github.com/miekg/dns"
 )
 
 // Get response from general or subnet cache
 // Return TRUE if response is found in cache
 func (p *Proxy) replyFromCache(d *DNSContext) bool {
-	if p.cache == nil || len(d.Upstreams) > 0 {
+	c, cSubnet := p.clientCaches(d)
+	if c == nil || len(d.Upstreams) > 0 || cacheBypassed(d) {
 		// Do not use cache if:
 		// it is disabled
 		// the query is with custom upstreams
+		// the cache is bypassed for the query
 		return false
 	}
 
-	if !p.Config.EnableEDNSClientSubnet {
-		val, ok := p.cache.Get(d.Req)
-		if ok && val != nil {
-			d.Res = val
-			log.Tracef("Serving cached response")
-			return true
+	var val *dns.Msg
+	endSpan := p.startCacheSpan(d)
+	defer func() { endSpan(val != nil) }()
+	var expired, prefetch, secure bool
+	var refreshKey string
+	if !p.ecsEnabled(d) {
+		val, expired, prefetch, secure = c.get(d.Req, d.ednsKey)
+		if val != nil {
+			p.logger().Debugf("Serving cached response")
+		}
+		refreshKey = fmt.Sprintf("%p/%x", c, withEDNSKey(key(d.Req), d.ednsKey))
+	} else if d.ecsReqMask != 0 && cSubnet != nil {
+		val, expired, prefetch, secure = cSubnet.getWithSubnet(d.Req, d.ecsReqIP, d.ecsReqMask, d.ednsKey)
+		if val != nil {
+			p.logger().Debugf("Serving response from subnet cache")
+		}
+		refreshKey = fmt.Sprintf("%p/%x", cSubnet, withEDNSKey(keyWithSubnet(d.Req, d.ecsReqIP, d.ecsReqMask), d.ednsKey))
+	} else if d.ecsReqMask == 0 {
+		val, expired, prefetch, secure = c.get(d.Req, d.ednsKey)
+		if val != nil {
+			p.logger().Debugf("Serving response from general cache")
 		}
+		refreshKey = fmt.Sprintf("%p/%x", c, withEDNSKey(key(d.Req), d.ednsKey))
+	}
+
+	if val == nil {
+		atomic.AddUint64(&p.counters.cacheMisses, 1)
 		return false
 	}
+	atomic.AddUint64(&p.counters.cacheHits, 1)
 
-	if d.ecsReqMask != 0 && p.cacheSubnet != nil {
-		val, ok := p.cacheSubnet.GetWithSubnet(d.Req, d.ecsReqIP, d.ecsReqMask)
-		if ok && val != nil {
-			d.Res = val
-			log.Debug("Serving response from subnet cache")
-			return true
+	d.Res = val
+	d.CachedResponse = true
+	d.ServedStale = expired
+	d.secureUpstream = secure
+	p.rotateCachedAnswer(d)
+	if expired {
+		if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("Serving expired response for %s", d.Req.Question[0].Name)
 		}
-	} else if d.ecsReqMask == 0 && p.cache != nil {
-		val, ok := p.cache.Get(d.Req)
-		if ok && val != nil {
-			d.Res = val
-			log.Debug("Serving response from general cache")
-			return true
+		p.refreshCache(d, refreshKey, false)
+	} else if prefetch {
+		p.refreshCache(d, refreshKey, true)
+	}
+	return true
+}
+
+// refreshCache starts the background refresh of the expired (or, if prefetch is true, the popular) cache entry.
+// Only one refresh per entry is in flight, if the refresh fails, the entry isn't changed.
+// The number of parallel prefetches is limited by CachePrefetchWorkers, if the limit is reached, the prefetch is skipped.
+func (p *Proxy) refreshCache(d *DNSContext, refreshKey string, prefetch bool) {
+	p.cacheRefreshLock.Lock()
+	if p.cacheRefreshing[refreshKey] {
+		p.cacheRefreshLock.Unlock()
+		return
+	}
+	// the channel may be re-created by Reload while the prefetch is in progress
+	workers := p.prefetchWorkers
+	if prefetch {
+		select {
+		case workers <- true:
+		default:
+			p.cacheRefreshLock.Unlock()
+			if l := p.logger(); l.DebugEnabled() {
+				l.Debugf("Too many prefetches in progress, skipping %s", d.Req.Question[0].Name)
+			}
+			return
 		}
+		atomic.AddUint64(&p.counters.prefetchAttempts, 1)
+	}
+	if p.cacheRefreshing == nil {
+		p.cacheRefreshing = map[string]bool{}
 	}
+	p.cacheRefreshing[refreshKey] = true
+	p.cacheRefreshLock.Unlock()
+
+	// the copy of the context is used since the request may be modified after the response is sent
+	refresh := &DNSContext{
+		Proto:      d.Proto,
+		Req:        d.Req.Copy(),
+		Addr:       d.Addr,
+		StartTime:  d.StartTime,
+		ecsReqIP:   d.ecsReqIP,
+		ecsReqMask: d.ecsReqMask,
+		client:     d.client,
+		ednsKey:    d.ednsKey,
+	}
+
+	go func() {
+		defer func() {
+			p.cacheRefreshLock.Lock()
+			delete(p.cacheRefreshing, refreshKey)
+			if prefetch {
+				<-workers
+			}
+			p.cacheRefreshLock.Unlock()
+		}()
 
-	return false
+		// the failures don't replace the cached response, so it is served until it is refreshed
+		reply, _, err := p.resolveUpstream(refresh)
+		if err != nil || reply == nil || (reply.Rcode != dns.RcodeSuccess && reply.Rcode != dns.RcodeNameError) {
+			if l := p.logger(); l.DebugEnabled() {
+				l.Debugf("couldn't refresh the cached response for %s: %v", refresh.Req.Question[0].Name, err)
+			}
+			return
+		}
+		if prefetch && isCacheable(reply, p.logger()) {
+			atomic.AddUint64(&p.counters.prefetchSuccesses, 1)
+		}
+		p.setInCache(refresh, reply)
+	}()
 }
 
 // Store response in general or subnet cache
 func (p *Proxy) setInCache(d *DNSContext, resp *dns.Msg) {
-	if p.cache == nil || len(d.Upstreams) > 0 {
+	c, cSubnet := p.clientCaches(d)
+	if c == nil || len(d.Upstreams) > 0 || cacheBypassed(d) {
 		// Do not use cache if:
 		// it is disabled
 		// the query is with custom upstreams
+		// the cache is bypassed for the query
 		return
 	}
 
-	if !p.Config.EnableEDNSClientSubnet {
-		p.cache.Set(resp)
+	if !p.ecsEnabled(d) {
+		c.set(resp, d.secureUpstream, d.ednsKey)
 		return
 	}
 
 	ip, mask, scope := parseECS(resp)
 	if ip != nil {
 		if ip.Equal(d.ecsReqIP) && mask == d.ecsReqMask {
-			log.Debug("ECS option in response: %s/%d", ip, scope)
-			p.cacheSubnet.SetWithSubnet(resp, ip, scope)
+			if l := p.logger(); l.DebugEnabled() {
+				l.Debugf("ECS option in response: %s/%d", ip, scope)
+			}
+			// the response can't be used for the clients outside of the source subnet (RFC 7871, section 7.3.1)
+			if scope > mask {
+				scope = mask
+			}
+			cSubnet.setWithSubnet(resp, ip, scope, d.secureUpstream, d.ednsKey)
 		} else {
-			log.Debug("Invalid response from server: ECS data mismatch: %s/%d -- %s/%d",
-				d.ecsReqIP, d.ecsReqMask, ip, mask)
+			if l := p.logger(); l.DebugEnabled() {
+				l.Debugf("Invalid response from server: ECS data mismatch: %s/%d -- %s/%d",
+					d.ecsReqIP, d.ecsReqMask, ip, mask)
+			}
 		}
 	} else if d.ecsReqIP != nil {
 		// server doesn't support ECS - cache response for all subnets
-		p.cacheSubnet.SetWithSubnet(resp, ip, scope)
+		cSubnet.setWithSubnet(resp, ip, scope, d.secureUpstream, d.ednsKey)
 	} else {
-		p.cache.Set(resp) // use general cache
+		c.set(resp, d.secureUpstream, d.ednsKey) // use general cache
 	}
 }
+
+// cacheBypassed checks if the cache must not be used for the request.
+// The clients that set CD validate DNSSEC themselves, so they get the responses directly from the upstreams.
+func cacheBypassed(d *DNSContext) bool {
+	return d.CacheBypass || d.Req.CheckingDisabled
+}
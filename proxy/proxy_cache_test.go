@@ -0,0 +1,330 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setCacheEntryExpire changes the expiration time of the cached response
+func setCacheEntryExpire(t *testing.T, c *cache, req *dns.Msg, expire time.Time) {
+	data := c.items.Get(key(req))
+	require.NotNil(t, data)
+	binary.BigEndian.PutUint32(data, uint32(expire.Unix()))
+}
+
+func TestCacheOptimistic(t *testing.T) {
+	var count, failing int32
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.CacheOptimistic = true
+	dnsProxy.CacheOptimisticMaxStale = time.Hour
+	dnsProxy.Upstreams = []upstream.Upstream{&funcUpstream{
+		exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+			atomic.AddInt32(&count, 1)
+			if atomic.LoadInt32(&failing) != 0 {
+				return nil, errors.New("upstream is down")
+			}
+			resp := &dns.Msg{}
+			resp.SetReply(m)
+			resp.Answer = []dns.RR{newRR(m.Question[0].Name + " 60 IN A 1.2.3.4")}
+			return resp, nil
+		},
+	}}
+	err := dnsProxy.Start()
+	require.NoError(t, err)
+	defer dnsProxy.Stop()
+
+	resolve := func() *DNSContext {
+		d := &DNSContext{
+			Req:  createHostTestMessage("example.org"),
+			Addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+		}
+		err := dnsProxy.Resolve(d)
+		require.NoError(t, err)
+		require.Len(t, d.Res.Answer, 1)
+		return d
+	}
+	waitCount := func(n int32) {
+		assert.Eventually(t, func() bool { return atomic.LoadInt32(&count) == n }, time.Second, 10*time.Millisecond)
+		// wait for the refresh to finish
+		assert.Eventually(t, func() bool {
+			dnsProxy.cacheRefreshLock.Lock()
+			defer dnsProxy.cacheRefreshLock.Unlock()
+			return len(dnsProxy.cacheRefreshing) == 0
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	d := resolve()
+	assert.False(t, d.ServedStale)
+	assert.False(t, d.CachedResponse)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&count))
+
+	// the expired response is served and refreshed in the background
+	setCacheEntryExpire(t, dnsProxy.cache, d.Req, time.Now().Add(-time.Minute))
+	d = resolve()
+	assert.True(t, d.ServedStale)
+	assert.True(t, d.CachedResponse)
+	assert.Equal(t, uint32(optimisticTTL), d.Res.Answer[0].Header().Ttl)
+	waitCount(2)
+
+	d = resolve()
+	assert.False(t, d.ServedStale)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&count))
+
+	// the refresh fails, the expired response stays in the cache
+	atomic.StoreInt32(&failing, 1)
+	setCacheEntryExpire(t, dnsProxy.cache, d.Req, time.Now().Add(-time.Minute))
+	d = resolve()
+	assert.True(t, d.ServedStale)
+	waitCount(3)
+	d = resolve()
+	assert.True(t, d.ServedStale)
+	waitCount(4)
+
+	// the response is dropped after CacheOptimisticMaxStale
+	setCacheEntryExpire(t, dnsProxy.cache, d.Req, time.Now().Add(-2*time.Hour))
+	d = &DNSContext{
+		Req:  createHostTestMessage("example.org"),
+		Addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+	}
+	err = dnsProxy.Resolve(d)
+	assert.NotNil(t, err)
+	assert.False(t, d.ServedStale)
+	assert.Equal(t, dns.RcodeServerFailure, d.Res.Rcode)
+}
+
+func TestCachePrefetch(t *testing.T) {
+	var count int32
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.CachePrefetchThreshold = 2
+	dnsProxy.Upstreams = []upstream.Upstream{createAUpstream("1.2.3.4", &count)}
+	err := dnsProxy.Start()
+	require.NoError(t, err)
+	defer dnsProxy.Stop()
+
+	resolve := func() *DNSContext {
+		d := &DNSContext{
+			Req:  createHostTestMessage("example.org"),
+			Addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+		}
+		err := dnsProxy.Resolve(d)
+		require.NoError(t, err)
+		require.Len(t, d.Res.Answer, 1)
+		return d
+	}
+
+	d := resolve()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&count))
+
+	// less than 10% of TTL is left, but the entry isn't popular yet
+	setCacheEntryExpire(t, dnsProxy.cache, d.Req, time.Now().Add(5*time.Second))
+	resolve()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&count))
+
+	// the second hit triggers the prefetch
+	resolve()
+	assert.Eventually(t, func() bool {
+		return dnsProxy.Stats().PrefetchSuccesses == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&count))
+	assert.Equal(t, uint64(1), dnsProxy.Stats().PrefetchAttempts)
+
+	// the prefetched entry is fresh
+	d = resolve()
+	assert.True(t, d.Res.Answer[0].Header().Ttl > 50)
+	resolve()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&count))
+}
+
+func TestCacheECSScopes(t *testing.T) {
+	var count int32
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.EnableEDNSClientSubnet = true
+	dnsProxy.Upstreams = []upstream.Upstream{&funcUpstream{
+		exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+			atomic.AddInt32(&count, 1)
+			ip, mask, _ := parseECS(m)
+			require.NotNil(t, ip)
+
+			// a CDN-like answer that depends on the client subnet:
+			// the scope of cdn.example.org is /24 and the scope of region.example.org is /16
+			scope := uint8(24)
+			if m.Question[0].Name == "region.example.org." {
+				scope = 16
+			}
+			resp := &dns.Msg{}
+			resp.SetReply(m)
+			resp.Answer = []dns.RR{newRR(fmt.Sprintf("%s 60 IN A 10.0.%d.%d", m.Question[0].Name, ip[1], ip[2]))}
+			o := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+			o.Option = []dns.EDNS0{&dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        1,
+				SourceNetmask: mask,
+				SourceScope:   scope,
+				Address:       ip,
+			}}
+			resp.Extra = []dns.RR{o}
+			return resp, nil
+		},
+	}}
+	require.NoError(t, dnsProxy.Start())
+	defer dnsProxy.Stop()
+
+	resolve := func(host string, clientIP net.IP) string {
+		d := &DNSContext{
+			Req:  createHostTestMessage(host),
+			Addr: &net.UDPAddr{IP: clientIP, Port: 53},
+		}
+		require.NoError(t, dnsProxy.Resolve(d))
+		require.Len(t, d.Res.Answer, 1)
+		return d.Res.Answer[0].(*dns.A).A.String()
+	}
+
+	client1 := net.IP{1, 2, 3, 4}
+	client2 := net.IP{1, 2, 4, 5}
+	assert.Equal(t, "10.0.2.3", resolve("cdn.example.org", client1))
+	assert.Equal(t, "10.0.2.4", resolve("cdn.example.org", client2))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&count))
+
+	// both answers are cached, each for its own subnet
+	assert.Equal(t, "10.0.2.3", resolve("cdn.example.org", net.IP{1, 2, 3, 100}))
+	assert.Equal(t, "10.0.2.4", resolve("cdn.example.org", client2))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&count))
+
+	// the answer with /16 scope is used for both subnets
+	assert.Equal(t, "10.0.2.3", resolve("region.example.org", client1))
+	assert.Equal(t, "10.0.2.3", resolve("region.example.org", client2))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&count))
+}
+
+func TestCacheFailure(t *testing.T) {
+	var count, failing int32
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.CacheOptimistic = true
+	dnsProxy.CacheFailureTTL = 5
+	dnsProxy.Upstreams = []upstream.Upstream{&funcUpstream{
+		exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+			atomic.AddInt32(&count, 1)
+			resp := &dns.Msg{}
+			switch atomic.LoadInt32(&failing) {
+			case 1:
+				return nil, errors.New("upstream failure")
+			case 2:
+				resp.SetRcode(m, dns.RcodeRefused)
+			default:
+				resp.SetReply(m)
+				resp.Answer = []dns.RR{newRR(m.Question[0].Name + " 60 IN A 1.2.3.4")}
+			}
+			return resp, nil
+		},
+	}}
+	require.NoError(t, dnsProxy.Start())
+	defer dnsProxy.Stop()
+
+	resolve := func(host string) *DNSContext {
+		d := &DNSContext{Req: createHostTestMessage(host)}
+		_ = dnsProxy.Resolve(d)
+		require.NotNil(t, d.Res)
+		return d
+	}
+
+	// the upstream error is remembered for a few seconds
+	atomic.StoreInt32(&failing, 1)
+	assert.Equal(t, dns.RcodeServerFailure, resolve("fail.example.org").Res.Rcode)
+	assert.Equal(t, dns.RcodeServerFailure, resolve("fail.example.org").Res.Rcode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&count))
+
+	// the expired failure isn't served by the optimistic cache
+	setCacheEntryExpire(t, dnsProxy.cache, createHostTestMessage("fail.example.org"), time.Now().Add(-time.Second))
+	atomic.StoreInt32(&failing, 0)
+	d := resolve("fail.example.org")
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+	assert.False(t, d.ServedStale)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&count))
+
+	// REFUSED is stored in the failure cache only
+	atomic.StoreInt32(&failing, 2)
+	assert.Equal(t, dns.RcodeRefused, resolve("refused.example.org").Res.Rcode)
+	assert.Equal(t, dns.RcodeRefused, resolve("refused.example.org").Res.Rcode)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&count))
+	data := dnsProxy.cache.items.Get(key(createHostTestMessage("refused.example.org")))
+	require.NotNil(t, data)
+	assert.Equal(t, uint32(5), binary.BigEndian.Uint32(data[4:]))
+
+	// the failed refresh doesn't replace the expired response
+	atomic.StoreInt32(&failing, 1)
+	setCacheEntryExpire(t, dnsProxy.cache, createHostTestMessage("fail.example.org"), time.Now().Add(-time.Second))
+	d = resolve("fail.example.org")
+	assert.True(t, d.ServedStale)
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+	assert.Eventually(t, func() bool {
+		dnsProxy.cacheRefreshLock.Lock()
+		defer dnsProxy.cacheRefreshLock.Unlock()
+		return atomic.LoadInt32(&count) == 4 && len(dnsProxy.cacheRefreshing) == 0
+	}, time.Second, 10*time.Millisecond)
+	d = resolve("fail.example.org")
+	assert.True(t, d.ServedStale)
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+}
+
+func TestCacheBypass(t *testing.T) {
+	var count, cdCount int32
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.Upstreams = []upstream.Upstream{&funcUpstream{
+		exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+			atomic.AddInt32(&count, 1)
+			if m.CheckingDisabled {
+				atomic.AddInt32(&cdCount, 1)
+			}
+			resp := &dns.Msg{}
+			resp.SetReply(m)
+			resp.Answer = []dns.RR{newRR(m.Question[0].Name + " 60 IN A 1.2.3.4")}
+			return resp, nil
+		},
+	}}
+	require.NoError(t, dnsProxy.Start())
+	defer dnsProxy.Stop()
+
+	resolve := func(host string, cd, bypass bool) *DNSContext {
+		d := &DNSContext{Req: createHostTestMessage(host), CacheBypass: bypass}
+		d.Req.CheckingDisabled = cd
+		require.NoError(t, dnsProxy.Resolve(d))
+		return d
+	}
+
+	resolve("example.org", false, false)
+	resolve("example.org", false, false)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&count))
+
+	// the cached response isn't served to the CD query, CD is passed to the upstream
+	d := resolve("example.org", true, false)
+	assert.True(t, d.Res.CheckingDisabled)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&count))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&cdCount))
+
+	// the response to the CD query isn't cached
+	resolve("cd.example.org", true, false)
+	resolve("cd.example.org", false, false)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&count))
+
+	// the cache is bypassed by the flag
+	resolve("example.org", false, true)
+	assert.Equal(t, int32(5), atomic.LoadInt32(&count))
+	resolve("bypass.example.org", false, true)
+	resolve("bypass.example.org", false, false)
+	assert.Equal(t, int32(7), atomic.LoadInt32(&count))
+}
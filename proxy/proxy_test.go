@@ -69,7 +69,7 @@ func TestHttpsProxy(t *testing.T) {
 	}
 
 	bb := bytes.NewBuffer(buf)
-	req, err := http.NewRequest("POST", "https://test.com", bb)
+	req, err := http.NewRequest("POST", "https://test.com/dns-query", bb)
 	if err != nil {
 		t.Fatalf("couldn't create a new HTTP request: %s", err)
 	}
@@ -77,7 +77,7 @@ func TestHttpsProxy(t *testing.T) {
 	req.Header.Set("Content-Type", "application/dns-message")
 	req.Header.Set("Accept", "application/dns-message")
 
-	// IP "1.2.3.4" will be used as a client address in DNSContext
+	// the header is ignored, there are no trusted proxies
 	req.Header.Set("X-Forwarded-For", "1.2.3.4, 127.0.0.1")
 
 	client := http.Client{
@@ -168,6 +168,29 @@ func TestUdpProxy(t *testing.T) {
 	}
 }
 
+func TestStartListenersFailure(t *testing.T) {
+	// a free port for the first listener
+	free, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(listenIP)})
+	assert.Nil(t, err)
+	freeAddr := free.LocalAddr().(*net.UDPAddr)
+	assert.Nil(t, free.Close())
+
+	busy, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(listenIP)})
+	assert.Nil(t, err)
+	defer busy.Close()
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UDPListenAddr = []*net.UDPAddr{freeAddr, busy.LocalAddr().(*net.UDPAddr)}
+	assert.NotNil(t, dnsProxy.Start())
+	assert.Nil(t, dnsProxy.Addr(ProtoUDP))
+
+	// the first listener has been closed
+	conn, err := net.ListenUDP("udp", freeAddr)
+	if assert.Nil(t, err) {
+		assert.Nil(t, conn.Close())
+	}
+}
+
 // TestProxyRace sends multiple parallel DNS requests to the
 // fully configured dnsproxy to check for race conditions
 func TestProxyRace(t *testing.T) {
@@ -613,8 +636,8 @@ func TestInvalidDNSRequest(t *testing.T) {
 		t.Fatalf("error in the first request: %s", err)
 	}
 
-	if r.Rcode != dns.RcodeServerFailure {
-		t.Fatalf("wrong response code (must've been ServerFailure)")
+	if r.Rcode != dns.RcodeFormatError {
+		t.Fatalf("wrong response code (must've been FormatError)")
 	}
 
 	// Stop the proxy
@@ -624,16 +647,16 @@ func TestInvalidDNSRequest(t *testing.T) {
 	}
 }
 
-func createTestProxy(t *testing.T, tlsConfig *tls.Config) *Proxy {
+func createTestProxy(t testing.TB, tlsConfig *tls.Config) *Proxy {
 	p := Proxy{}
 
 	if tlsConfig != nil {
-		p.TLSListenAddr = &net.TCPAddr{Port: 0, IP: net.ParseIP(listenIP)}
-		p.HTTPSListenAddr = &net.TCPAddr{Port: 0, IP: net.ParseIP(listenIP)}
+		p.TLSListenAddr = []*net.TCPAddr{{Port: 0, IP: net.ParseIP(listenIP)}}
+		p.HTTPSListenAddr = []*net.TCPAddr{{Port: 0, IP: net.ParseIP(listenIP)}}
 		p.TLSConfig = tlsConfig
 	} else {
-		p.UDPListenAddr = &net.UDPAddr{Port: 0, IP: net.ParseIP(listenIP)}
-		p.TCPListenAddr = &net.TCPAddr{Port: 0, IP: net.ParseIP(listenIP)}
+		p.UDPListenAddr = []*net.UDPAddr{{Port: 0, IP: net.ParseIP(listenIP)}}
+		p.TCPListenAddr = []*net.TCPAddr{{Port: 0, IP: net.ParseIP(listenIP)}}
 	}
 	upstreams := make([]upstream.Upstream, 0)
 	dnsUpstream, err := upstream.AddressToUpstream(upstreamAddr, upstream.Options{Timeout: defaultTimeout})
@@ -858,6 +881,19 @@ func (u *testUpstream) Address() string {
 	return ""
 }
 
+// funcUpstream is a test upstream that uses the specified function to answer the queries
+type funcUpstream struct {
+	exchangeFunc func(m *dns.Msg) (*dns.Msg, error)
+}
+
+func (u *funcUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	return u.exchangeFunc(m)
+}
+
+func (u *funcUpstream) Address() string {
+	return "func://test"
+}
+
 // Resolve the same host with the different client subnet values
 func TestECSProxy(t *testing.T) {
 	dnsProxy := createTestProxy(t, nil)
@@ -946,3 +982,37 @@ func TestECSProxy(t *testing.T) {
 
 	_ = dnsProxy.Stop()
 }
+
+func TestNamedUpstreams(t *testing.T) {
+	config, err := ParseUpstreamsConfig([]string{"corp=1.2.3.4:53", "[/example.org/example.net/]corp-tls=tls://10.0.0.1", "8.8.8.8:53"}, nil, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, "corp", upstream.Name(config.Upstreams[0]))
+	assert.Equal(t, "1.2.3.4:53", config.Upstreams[0].Address())
+	assert.Equal(t, "8.8.8.8:53", upstream.Name(config.Upstreams[1]))
+	assert.Equal(t, "corp-tls", upstream.Name(config.DomainReservedUpstreams["example.org."][0]))
+
+	// the same upstream reserved for several domains isn't a duplicate
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = config.Upstreams
+	dnsProxy.DomainsReservedUpstreams = config.DomainReservedUpstreams
+	assert.Nil(t, dnsProxy.validateConfig())
+
+	duplicate, err := upstream.AddressToNamedUpstream("corp=tls://10.0.0.2", upstream.Options{})
+	assert.Nil(t, err)
+	dnsProxy.Fallbacks = []upstream.Upstream{duplicate}
+	assert.NotNil(t, dnsProxy.validateConfig())
+
+	// the name is used in the errors and the health check
+	broken, _ := validationTestUpstreams()
+	named := upstream.WithName(broken, "corp-broken")
+	dnsProxy = createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{named}
+	d := &DNSContext{Proto: ProtoUDP, Req: createHostTestMessage("example.org"), Addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}}}
+	err = dnsProxy.Resolve(d)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "corp-broken")
+	uh := dnsProxy.upstreamHealth(named, time.Minute)
+	assert.Equal(t, "corp-broken", uh.Name)
+	assert.Equal(t, "func://broken", uh.Address)
+	assert.Equal(t, upstreamDown, uh.Status)
+}
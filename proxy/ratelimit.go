@@ -5,11 +5,13 @@ import (
 	"sort"
 	"time"
 
-	"github.com/AdguardTeam/golibs/log"
 	rate "github.com/beefsack/go-rate"
 	gocache "github.com/patrickmn/go-cache"
 )
 
+// authFailuresPeriod is the period the failed authentication attempts are counted for
+const authFailuresPeriod = time.Minute
+
 func (p *Proxy) limiterForIP(ip string) interface{} {
 	p.ratelimitLock.Lock()
 	defer p.ratelimitLock.Unlock()
@@ -20,7 +22,7 @@ func (p *Proxy) limiterForIP(ip string) interface{} {
 	// check if ratelimiter for that IP already exists, if not, create
 	value, found := p.ratelimitBuckets.Get(ip)
 	if !found {
-		value = rate.New(p.Ratelimit, time.Second)
+		value = rate.New(p.state().Ratelimit, time.Second)
 		p.ratelimitBuckets.Set(ip, value, time.Hour)
 	}
 
@@ -29,20 +31,21 @@ func (p *Proxy) limiterForIP(ip string) interface{} {
 
 // isRatelimited checks if the specified IP is ratelimited
 func (p *Proxy) isRatelimited(addr net.Addr) bool {
-	if p.Ratelimit <= 0 { // 0 -- disabled
+	s := p.state()
+	if s.Ratelimit <= 0 { // 0 -- disabled
 		return false
 	}
 
 	ip := getIPString(addr)
 	if ip == "" {
-		log.Printf("failed to split %v into host/port", addr)
+		p.logger().Infof("failed to split %v into host/port", addr)
 		return false
 	}
 
-	if len(p.RatelimitWhitelist) > 0 {
-		i := sort.SearchStrings(p.RatelimitWhitelist, ip)
+	if len(s.RatelimitWhitelist) > 0 {
+		i := sort.SearchStrings(s.RatelimitWhitelist, ip)
 
-		if i < len(p.RatelimitWhitelist) && p.RatelimitWhitelist[i] == ip {
+		if i < len(s.RatelimitWhitelist) && s.RatelimitWhitelist[i] == ip {
 			// found, don't ratelimit
 			return false
 		}
@@ -51,10 +54,49 @@ func (p *Proxy) isRatelimited(addr net.Addr) bool {
 	value := p.limiterForIP(ip)
 	rl, ok := value.(*rate.RateLimiter)
 	if !ok {
-		log.Println("SHOULD NOT HAPPEN: non-bool entry found in safebrowsing lookup cache")
+		p.logger().Warnf("SHOULD NOT HAPPEN: non-bool entry found in safebrowsing lookup cache")
 		return false
 	}
 
 	allow, _ := rl.Try()
 	return !allow
 }
+
+// isAuthFailuresLimitReached checks if there were too many failed DoH authentication
+// attempts from the specified IP. These attempts are counted separately from the regular ratelimit.
+func (p *Proxy) isAuthFailuresLimitReached(ip string) bool {
+	s := p.state()
+	if s.DoHAuthFailuresRatelimit <= 0 || ip == "" {
+		return false
+	}
+
+	p.ratelimitLock.Lock()
+	defer p.ratelimitLock.Unlock()
+	if p.authFailures == nil {
+		return false
+	}
+
+	value, found := p.authFailures.Get(ip)
+	if !found {
+		return false
+	}
+	count, ok := value.(int)
+	return ok && count >= s.DoHAuthFailuresRatelimit
+}
+
+// registerAuthFailure counts the failed DoH authentication attempt from the specified IP
+func (p *Proxy) registerAuthFailure(ip string) {
+	if p.state().DoHAuthFailuresRatelimit <= 0 || ip == "" {
+		return
+	}
+
+	p.ratelimitLock.Lock()
+	defer p.ratelimitLock.Unlock()
+	if p.authFailures == nil {
+		p.authFailures = gocache.New(authFailuresPeriod, authFailuresPeriod)
+	}
+
+	if err := p.authFailures.Increment(ip, 1); err != nil {
+		p.authFailures.Set(ip, 1, authFailuresPeriod)
+	}
+}
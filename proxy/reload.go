@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"reflect"
+)
+
+// proxyState is the configuration of the running proxy and the structures built from it.
+// It's never changed after Start or Reload has published it, so the queries use it without locking
+// (see Proxy.state). The Proxy fields it's copied from are only changed under the lock.
+type proxyState struct {
+	Config
+
+	cache          *cache
+	cacheSubnet    *cacheSubnet
+	clients        []*clientGroup
+	trustedProxies []*net.IPNet
+	ecsOverrideV4  *net.IPNet
+	ecsOverrideV6  *net.IPNet
+	ttlOverrides   map[string]CacheTTLOverride
+	mdnsZones      []string
+}
+
+// Reload applies the new configuration to the running proxy without restarting the listeners.
+// The new config is validated first, if it is invalid, nothing is changed.
+// Upstreams, cache and ratelimit parameters, ECS, mDNS, static entries and the request handlers are applied at once.
+// The caches are re-created (and so dropped) only if their parameters (or ClientsSettings) are changed.
+// The fields that can only be applied by Stop/Start (listen addresses, TLS settings, DoH server settings,
+// MaxGoroutines and UDPBufferSize) are not changed, Reload returns their names.
+// The queries that are being processed during Reload may still use the old settings.
+func (p *Proxy) Reload(newConfig Config) (restartRequired []string, err error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if !p.started {
+		return nil, errors.New("server is not started")
+	}
+
+	err = newConfig.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	restartRequired = p.Config.restartRequired(&newConfig)
+	if len(restartRequired) > 0 {
+		p.logger().Warnf("These settings require restart and will not be applied: %v", restartRequired)
+	}
+
+	// keep the settings that can't be changed on the fly
+	newConfig.UDPListenAddr = p.UDPListenAddr
+	newConfig.UDPListeners = p.UDPListeners
+	newConfig.CloseUDPListeners = p.CloseUDPListeners
+	newConfig.UDPBufferSize = p.UDPBufferSize
+	newConfig.TCPListenAddr = p.TCPListenAddr
+	newConfig.TLSListenAddr = p.TLSListenAddr
+	newConfig.HTTPSListenAddr = p.HTTPSListenAddr
+	newConfig.TLSConfig = p.TLSConfig
+	newConfig.TLSClientAuth = p.TLSClientAuth
+	newConfig.HTTPSServerPaths = p.HTTPSServerPaths
+	newConfig.HTTPSHealthCheck = p.HTTPSHealthCheck
+	newConfig.HTTPSServerVersion = p.HTTPSServerVersion
+	newConfig.ListenerRequestHandlers = p.ListenerRequestHandlers
+	newConfig.MaxGoroutines = p.MaxGoroutines
+
+	cacheChanged := newConfig.CacheEnabled != p.CacheEnabled ||
+		newConfig.CacheSizeBytes != p.CacheSizeBytes ||
+		newConfig.CacheEvictionPolicy != p.CacheEvictionPolicy ||
+		newConfig.CacheOptimistic != p.CacheOptimistic ||
+		newConfig.CacheOptimisticMaxStale != p.CacheOptimisticMaxStale ||
+		newConfig.CachePrefetchThreshold != p.CachePrefetchThreshold ||
+		newConfig.CachePrefetchWorkers != p.CachePrefetchWorkers ||
+		newConfig.CacheMaxNegativeTTL != p.CacheMaxNegativeTTL ||
+		newConfig.CacheFailureTTL != p.CacheFailureTTL ||
+		!reflect.DeepEqual(newConfig.CacheUncacheableRcodes, p.CacheUncacheableRcodes) ||
+		!reflect.DeepEqual(newConfig.CacheTTLCaps, p.CacheTTLCaps) ||
+		newConfig.CacheCNAMEChains != p.CacheCNAMEChains ||
+		newConfig.EnableEDNSClientSubnet != p.EnableEDNSClientSubnet ||
+		!reflect.DeepEqual(newConfig.ECSOverrideSubnet, p.ECSOverrideSubnet) ||
+		!reflect.DeepEqual(newConfig.EDNSAllowedOptions, p.EDNSAllowedOptions)
+	clientsChanged := cacheChanged || !reflect.DeepEqual(newConfig.ClientsSettings, p.ClientsSettings)
+	ratelimitChanged := newConfig.Ratelimit != p.Ratelimit
+	staticChanged := !reflect.DeepEqual(newConfig.StaticEntries, p.StaticEntries)
+	cnameChanged := !reflect.DeepEqual(newConfig.CNAMEOverrides, p.CNAMEOverrides) || newConfig.SafeSearch != p.SafeSearch
+
+	p.Config = newConfig
+
+	if cacheChanged {
+		p.initCache()
+	}
+	if clientsChanged {
+		p.initClients()
+	}
+	p.initTrustedProxies()
+	p.initECSOverride()
+	p.initTTLOverrides()
+
+	if ratelimitChanged {
+		p.ratelimitLock.Lock()
+		p.ratelimitBuckets = nil
+		p.ratelimitLock.Unlock()
+	}
+
+	if staticChanged {
+		p.initStaticEntries()
+	}
+	if cnameChanged {
+		p.initCNAMEOverrides()
+	}
+	p.initMDNS()
+	if p.BlockIPv6 {
+		p.ClearNAT64Prefix()
+	}
+
+	p.publishState()
+
+	p.logger().Infof("The DNS proxy configuration has been reloaded")
+	return restartRequired, nil
+}
+
+// publishState makes the current configuration visible to the queries (the lock must be held)
+func (p *Proxy) publishState() {
+	p.currentState.Store(p.newState())
+}
+
+// newState copies the current configuration
+func (p *Proxy) newState() *proxyState {
+	return &proxyState{
+		Config:         p.Config,
+		cache:          p.cache,
+		cacheSubnet:    p.cacheSubnet,
+		clients:        p.clients,
+		trustedProxies: p.trustedProxies,
+		ecsOverrideV4:  p.ecsOverrideV4,
+		ecsOverrideV6:  p.ecsOverrideV6,
+		ttlOverrides:   p.ttlOverrides,
+		mdnsZones:      p.mdnsZones,
+	}
+}
+
+// state returns the configuration published by Start or Reload,
+// the proxy that has never been started uses its current configuration
+func (p *Proxy) state() *proxyState {
+	if s, ok := p.currentState.Load().(*proxyState); ok {
+		return s
+	}
+	return p.newState()
+}
+
+// requestState returns the configuration the request is processed with, it's loaded once per request
+func (p *Proxy) requestState(d *DNSContext) *proxyState {
+	if d.state == nil {
+		d.state = p.state()
+	}
+	return d.state
+}
+
+// restartRequired returns the names of the fields of the new config
+// that differ from c and can't be applied without restarting the proxy
+func (c *Config) restartRequired(newConfig *Config) []string {
+	var fields []string
+	if !reflect.DeepEqual(c.UDPListenAddr, newConfig.UDPListenAddr) {
+		fields = append(fields, "UDPListenAddr")
+	}
+	if !reflect.DeepEqual(c.UDPListeners, newConfig.UDPListeners) {
+		fields = append(fields, "UDPListeners")
+	}
+	if !reflect.DeepEqual(c.TCPListenAddr, newConfig.TCPListenAddr) {
+		fields = append(fields, "TCPListenAddr")
+	}
+	if !reflect.DeepEqual(c.TLSListenAddr, newConfig.TLSListenAddr) {
+		fields = append(fields, "TLSListenAddr")
+	}
+	if !reflect.DeepEqual(c.HTTPSListenAddr, newConfig.HTTPSListenAddr) {
+		fields = append(fields, "HTTPSListenAddr")
+	}
+	if c.TLSConfig != newConfig.TLSConfig {
+		fields = append(fields, "TLSConfig")
+	}
+	if c.TLSClientAuth != newConfig.TLSClientAuth {
+		fields = append(fields, "TLSClientAuth")
+	}
+	if !reflect.DeepEqual(c.HTTPSServerPaths, newConfig.HTTPSServerPaths) {
+		fields = append(fields, "HTTPSServerPaths")
+	}
+	if c.HTTPSHealthCheck != newConfig.HTTPSHealthCheck {
+		fields = append(fields, "HTTPSHealthCheck")
+	}
+	if c.HTTPSServerVersion != newConfig.HTTPSServerVersion {
+		fields = append(fields, "HTTPSServerVersion")
+	}
+	if !sameKeys(c.ListenerRequestHandlers, newConfig.ListenerRequestHandlers) {
+		fields = append(fields, "ListenerRequestHandlers")
+	}
+	if c.MaxGoroutines != newConfig.MaxGoroutines {
+		fields = append(fields, "MaxGoroutines")
+	}
+	if c.UDPBufferSize != newConfig.UDPBufferSize {
+		fields = append(fields, "UDPBufferSize")
+	}
+	return fields
+}
+
+// sameKeys checks if the maps have the same set of keys (the functions can't be compared)
+func sameKeys(a, b map[string]RequestHandler) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if _, ok := b[k]; !ok {
+			return false
+		}
+	}
+	return true
+}
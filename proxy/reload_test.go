@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReload(t *testing.T) {
+	var oldCount, newCount int32
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{createCountingUpstream(&oldCount)}
+
+	_, err := dnsProxy.Reload(dnsProxy.Config)
+	assert.NotNil(t, err)
+
+	err = dnsProxy.Start()
+	require.NoError(t, err)
+	defer dnsProxy.Stop()
+
+	addr := dnsProxy.Addr(ProtoUDP).String()
+	client := &dns.Client{Net: "udp", Timeout: 500 * time.Millisecond}
+	_, _, err = client.Exchange(createTestMessage(), addr)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&oldCount))
+
+	// invalid config isn't applied
+	newConfig := dnsProxy.Config
+	newConfig.Upstreams = nil
+	_, err = dnsProxy.Reload(newConfig)
+	assert.NotNil(t, err)
+
+	newConfig.Upstreams = []upstream.Upstream{&funcUpstream{
+		exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+			atomic.AddInt32(&newCount, 1)
+			resp := &dns.Msg{}
+			resp.SetReply(m)
+			resp.Answer = []dns.RR{newRR(m.Question[0].Name + " 60 IN A 1.2.3.4")}
+			return resp, nil
+		},
+	}}
+	newConfig.CacheEnabled = true
+	newConfig.UDPListenAddr = []*net.UDPAddr{{IP: net.IP{127, 0, 0, 1}, Port: 0}, {IP: net.IP{127, 0, 0, 2}, Port: 0}}
+	restartRequired, err := dnsProxy.Reload(newConfig)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"UDPListenAddr"}, restartRequired)
+
+	// the listener is the same
+	assert.Equal(t, addr, dnsProxy.Addr(ProtoUDP).String())
+	assert.Len(t, dnsProxy.Addrs(ProtoUDP), 1)
+
+	// new upstream and cache are used
+	for i := 0; i < 2; i++ {
+		_, _, err = client.Exchange(createTestMessage(), addr)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&oldCount))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&newCount))
+}
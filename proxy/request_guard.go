@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// headerLen is the length of the DNS message header
+const headerLen = 12
+
+// unpackRequest parses the message received from the client.
+// The packets shorter than the header or longer than the max message size are rejected before
+// they're parsed, and a panic of the parser is returned as an error.
+func unpackRequest(packet []byte) (msg *dns.Msg, err error) {
+	if len(packet) < headerLen {
+		return nil, fmt.Errorf("packet is too short: %d bytes", len(packet))
+	}
+	if len(packet) > dns.MaxMsgSize {
+		return nil, fmt.Errorf("packet is too long: %d bytes", len(packet))
+	}
+
+	defer func() {
+		if v := recover(); v != nil {
+			msg, err = nil, fmt.Errorf("malformed packet: %v", v)
+		}
+	}()
+
+	msg = &dns.Msg{}
+	err = msg.Unpack(packet)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// recoverHandlerPanic is deferred by handleDNSRequest: it recovers a panic of the request processing,
+// counts it (see Stats.HandlerPanics) and responds with SERVFAIL unless the response has already been sent,
+// so a broken request doesn't crash the listener.
+func (p *Proxy) recoverHandlerPanic(d *DNSContext) {
+	v := recover()
+	if v == nil {
+		return
+	}
+
+	atomic.AddUint64(&p.counters.handlerPanics, 1)
+	p.logger().Errorf("Panic while handling the %s request from %s: %v\n%s", d.Proto, d.Addr, v, debug.Stack())
+	if d.responded || d.Req == nil {
+		return
+	}
+
+	defer func() {
+		if v := recover(); v != nil {
+			p.logger().Errorf("Panic while sending SERVFAIL to %s: %v", d.Addr, v)
+		}
+	}()
+	d.Res = p.statusResponse(d, StatusInternalError)
+	p.respond(d)
+}
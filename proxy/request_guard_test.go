@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnpackRequest(t *testing.T) {
+	packet, err := createTestMessage().Pack()
+	require.NoError(t, err)
+	msg, err := unpackRequest(packet)
+	require.NoError(t, err)
+	assert.Len(t, msg.Question, 1)
+
+	for _, p := range [][]byte{nil, packet[:5], packet[:headerLen+3], make([]byte, dns.MaxMsgSize+1)} {
+		_, err = unpackRequest(p)
+		assert.Error(t, err)
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.BeforeRequestHandler = func(p *Proxy, d *DNSContext) (bool, error) {
+		if d.Req.Question[0].Name == "panic.example.org." {
+			var m map[string]int
+			m["panic"]++
+		}
+		d.Res = p.genServerFailure(d.Req)
+		d.Res.Rcode = dns.RcodeRefused
+		p.respond(d)
+		return false, nil
+	}
+	require.NoError(t, dnsProxy.Start())
+	defer dnsProxy.Stop()
+
+	client := &dns.Client{Net: "udp", Timeout: time.Second}
+	addr := dnsProxy.Addr(ProtoUDP).String()
+
+	// the panic is answered with SERVFAIL and the listener keeps working
+	resp, _, err := client.Exchange(createHostTestMessage("panic.example.org"), addr)
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+	assert.Equal(t, uint64(1), dnsProxy.Stats().HandlerPanics)
+
+	resp, _, err = client.Exchange(createHostTestMessage("example.org"), addr)
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+	assert.Equal(t, uint64(1), dnsProxy.Stats().HandlerPanics)
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"sync/atomic"
+
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+// responseSizeBuckets are the upper bounds of the buckets of the response size histogram (see Stats.ResponseSizes):
+// the classic UDP limit, the recommended EDNS buffer size (DNS Flag Day 2020), the usual EDNS buffer size
+// and the max message size
+var responseSizeBuckets = [...]int{dns.MinMsgSize, 1232, 4096, dns.MaxMsgSize}
+
+// ResponseSizeBucket is a bucket of the histogram of the sizes of the responses sent to the clients
+type ResponseSizeBucket struct {
+	MaxSize int    // the upper bound of the bucket (in bytes)
+	Count   uint64 // number of the responses larger than the previous bucket and not larger than MaxSize
+}
+
+// packClientResponse packs the response to be sent to the client, all the protocols use it.
+// The response is always compressed, whichever path it has come from (the upstreams, the cache or the local answers),
+// and the UDP responses are truncated to the payload size of the client (see truncateUDPResponse).
+// The size of the packed response is recorded in the histogram.
+func (p *Proxy) packClientResponse(d *DNSContext) ([]byte, error) {
+	d.Res.Compress = true
+	if d.Proto == ProtoUDP {
+		truncateUDPResponse(d)
+	}
+
+	b, err := d.Res.Pack()
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't convert message into wire format: %s", d.Res.String())
+	}
+	p.recordResponseSize(len(b))
+	return b, nil
+}
+
+// recordResponseSize adds the size of the response to the histogram
+func (p *Proxy) recordResponseSize(size int) {
+	for i, max := range responseSizeBuckets {
+		if size <= max {
+			atomic.AddUint64(&p.counters.responseSizes[i], 1)
+			return
+		}
+	}
+}
+
+// responseSizes returns a snapshot of the response size histogram
+func (p *Proxy) responseSizes() []ResponseSizeBucket {
+	buckets := make([]ResponseSizeBucket, len(responseSizeBuckets))
+	for i, max := range responseSizeBuckets {
+		buckets[i] = ResponseSizeBucket{MaxSize: max, Count: atomic.LoadUint64(&p.counters.responseSizes[i])}
+	}
+	return buckets
+}
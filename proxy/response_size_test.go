@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// compressionTestName is long, so the compression makes a big difference
+const compressionTestName = "a-fairly-long-name-for-the-compression-test.example.org."
+
+// manyRecordsResponse returns the response to the request with n A records
+func manyRecordsResponse(req *dns.Msg, n int) *dns.Msg {
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	for i := 0; i < n; i++ {
+		resp.Answer = append(resp.Answer, newRR(fmt.Sprintf("%s 60 IN A 10.0.%d.%d", req.Question[0].Name, i/256, i%256)))
+	}
+	return resp
+}
+
+func TestPackClientResponse(t *testing.T) {
+	req := &dns.Msg{}
+	req.SetQuestion(compressionTestName, dns.TypeA)
+
+	testCases := []struct {
+		name      string
+		proto     string
+		records   int
+		truncated bool
+		bucket    int
+	}{
+		// 25 records only fit into 512 bytes compressed
+		{name: "udp_fits_compressed", proto: ProtoUDP, records: 25, bucket: dns.MinMsgSize},
+		{name: "udp_truncated", proto: ProtoUDP, records: 60, truncated: true, bucket: dns.MinMsgSize},
+		{name: "tcp", proto: ProtoTCP, records: 60, bucket: 1232},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Proxy{}
+			d := &DNSContext{Proto: tc.proto, Req: req, Res: manyRecordsResponse(req, tc.records)}
+			assert.True(t, d.Res.Len() > dns.MinMsgSize, "the uncompressed response must not fit")
+
+			b, err := p.packClientResponse(d)
+			require.NoError(t, err)
+			res := &dns.Msg{}
+			require.NoError(t, res.Unpack(b))
+			assert.Equal(t, tc.truncated, res.Truncated)
+			if !tc.truncated {
+				assert.Len(t, res.Answer, tc.records)
+			}
+			if tc.proto == ProtoUDP {
+				assert.True(t, len(b) <= dns.MinMsgSize)
+			}
+
+			for _, bucket := range p.Stats().ResponseSizes {
+				if bucket.MaxSize == tc.bucket {
+					assert.Equal(t, uint64(1), bucket.Count)
+				} else {
+					assert.Zero(t, bucket.Count)
+				}
+			}
+		})
+	}
+}
+
+func TestCachedResponseCompression(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.Upstreams = []upstream.Upstream{&funcUpstream{exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+		return manyRecordsResponse(m, 25), nil
+	}}}
+	require.NoError(t, dnsProxy.Start())
+	defer dnsProxy.Stop()
+
+	// the response from the upstream and then from the cache fits into 512 bytes
+	client := &dns.Client{Net: "udp", Timeout: time.Second}
+	req := &dns.Msg{}
+	req.SetQuestion(compressionTestName, dns.TypeA)
+	for i := 0; i < 2; i++ {
+		resp, _, err := client.Exchange(req, dnsProxy.Addr(ProtoUDP).String())
+		require.NoError(t, err)
+		assert.False(t, resp.Truncated)
+		assert.Len(t, resp.Answer, 25)
+	}
+	assert.Equal(t, uint64(2), dnsProxy.Stats().ResponseSizes[0].Count)
+}
@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// shutdownPollInterval is how often Shutdown checks if the queries in progress are processed
+const shutdownPollInterval = 10 * time.Millisecond
+
+// Shutdown gracefully stops the proxy: the new queries aren't answered any more,
+// the queries in progress are processed (Shutdown waits for them at most timeout) and then the proxy is stopped (see Stop).
+func (p *Proxy) Shutdown(timeout time.Duration) error {
+	atomic.StoreInt32(&p.draining, 1)
+
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt32(&p.inFlight) > 0 {
+		if time.Now().After(deadline) {
+			p.logger().Infof("Stopping the DNS proxy with %d queries in progress", atomic.LoadInt32(&p.inFlight))
+			break
+		}
+		time.Sleep(shutdownPollInterval)
+	}
+
+	return p.Stop()
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdown(t *testing.T) {
+	release := make(chan struct{})
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{&funcUpstream{exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+		<-release
+		resp := &dns.Msg{}
+		resp.SetReply(m)
+		return resp, nil
+	}}}
+	require.NoError(t, dnsProxy.Start())
+
+	// the query in progress is answered
+	client := &dns.Client{Net: "udp", Timeout: 2 * time.Second}
+	addr := dnsProxy.Addr(ProtoUDP).String()
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := client.Exchange(createTestMessage(), addr)
+		errs <- err
+	}()
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&dnsProxy.inFlight) == 1 }, time.Second, 10*time.Millisecond)
+
+	shutdownDone := make(chan error, 1)
+	go func() { shutdownDone <- dnsProxy.Shutdown(time.Second) }()
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&dnsProxy.draining) == 1 }, time.Second, 10*time.Millisecond)
+
+	// the new queries aren't answered
+	err := dnsProxy.handleDNSRequest(&DNSContext{Proto: ProtoUDP, Req: createTestMessage()})
+	assert.Nil(t, err)
+
+	close(release)
+	assert.Nil(t, <-errs)
+	assert.Nil(t, <-shutdownDone)
+	assert.Nil(t, dnsProxy.Addr(ProtoUDP))
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{&funcUpstream{exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+		<-release
+		return nil, errors.New("timeout")
+	}}}
+	require.NoError(t, dnsProxy.Start())
+
+	client := &dns.Client{Net: "udp", Timeout: time.Second}
+	go func() { _, _, _ = client.Exchange(createTestMessage(), dnsProxy.Addr(ProtoUDP).String()) }()
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&dnsProxy.inFlight) == 1 }, time.Second, 10*time.Millisecond)
+
+	start := time.Now()
+	assert.Nil(t, dnsProxy.Shutdown(100*time.Millisecond))
+	assert.True(t, time.Since(start) < time.Second)
+}
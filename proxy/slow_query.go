@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/logutil"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// upstreamAttempt is an exchange with an upstream made to resolve the query
+type upstreamAttempt struct {
+	upstream string
+	elapsed  int // in milliseconds, as measured by exchangeWithUpstream for the RTT stats
+	err      error
+}
+
+// upstreamAttempts are the exchanges of the query for the slow query log (see Config.SlowQueryThreshold).
+// The parallel exchanges add to it concurrently.
+type upstreamAttempts struct {
+	list []upstreamAttempt
+	sync.Mutex
+}
+
+// attemptsKey is the key of the upstreamAttempts in the context of the query
+type attemptsKey struct{}
+
+// add adds the attempt
+func (a *upstreamAttempts) add(u string, elapsed int, err error) {
+	a.Lock()
+	a.list = append(a.list, upstreamAttempt{upstream: u, elapsed: elapsed, err: err})
+	a.Unlock()
+}
+
+// String returns the attempts in the order they have finished, e.g. "tls://1.1.1.1=2000ms:timeout,8.8.8.8:53=20ms:ok"
+func (a *upstreamAttempts) String() string {
+	a.Lock()
+	defer a.Unlock()
+
+	parts := make([]string, len(a.list))
+	for i, at := range a.list {
+		outcome := "ok"
+		if at.err != nil {
+			outcome = upstreamStatus(at.err).String()
+		}
+		parts[i] = fmt.Sprintf("%s=%dms:%s", at.upstream, at.elapsed, outcome)
+	}
+	return strings.Join(parts, ",")
+}
+
+// count returns the number of the attempts
+func (a *upstreamAttempts) count() int {
+	a.Lock()
+	defer a.Unlock()
+	return len(a.list)
+}
+
+// startSlowQueryLog adds the upstreamAttempts to the context of the query if the slow query log is enabled
+func (p *Proxy) startSlowQueryLog(d *DNSContext) {
+	if p.requestState(d).SlowQueryThreshold <= 0 {
+		return
+	}
+	d.attempts = &upstreamAttempts{}
+	d.ctx = context.WithValue(d.Context(), attemptsKey{}, d.attempts)
+}
+
+// recordAttempt adds the exchange with the upstream to the attempts of the query in ctx (if any)
+func (p *Proxy) recordAttempt(ctx context.Context, u string, elapsed int, err error) {
+	if p.state().SlowQueryThreshold <= 0 {
+		return
+	}
+	if a, ok := ctx.Value(attemptsKey{}).(*upstreamAttempts); ok {
+		a.add(u, elapsed, err)
+	}
+}
+
+// logSlowQuery writes the warning about the query processed longer than Config.SlowQueryThreshold
+// and counts it (see Stats.SlowQueries)
+func (p *Proxy) logSlowQuery(d *DNSContext) {
+	elapsed := time.Since(d.StartTime)
+	if d.attempts == nil || elapsed <= p.requestState(d).SlowQueryThreshold || d.Req == nil {
+		return
+	}
+	atomic.AddUint64(&p.counters.slowQueries, 1)
+
+	fields := []logutil.Field{}
+	if len(d.Req.Question) > 0 {
+		q := d.Req.Question[0]
+		fields = append(fields, logutil.F("qname", q.Name), logutil.F("qtype", dns.TypeToString[q.Qtype]))
+	}
+	fields = append(fields, logutil.F("proto", d.Proto))
+	if d.Addr != nil {
+		fields = append(fields, logutil.F("client", d.Addr.String()))
+	}
+	if d.Upstream != nil {
+		fields = append(fields, logutil.F("upstream", upstream.Name(d.Upstream)))
+	}
+	if n := d.attempts.count(); n > 0 {
+		fields = append(fields, logutil.F("attempts", d.attempts), logutil.F("retries", n-1))
+	}
+	fields = append(fields, logutil.F("cached", d.CachedResponse), logutil.F("status", d.Status.String()))
+	if d.Res != nil {
+		fields = append(fields, logutil.F("rcode", dns.RcodeToString[d.Res.Rcode]))
+	}
+	fields = append(fields, logutil.F("duration_ms", elapsed))
+	logutil.Warn(p.logger(), "Slow query", fields...)
+}
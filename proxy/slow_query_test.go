@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlowQueryLog(t *testing.T) {
+	_, good := validationTestUpstreams()
+	slow := &namedUpstream{addr: "func://slow", funcUpstream: &funcUpstream{exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+		time.Sleep(30 * time.Millisecond)
+		return good.Exchange(m)
+	}}}
+	timeout := failingUpstream("func://timeout", timeoutError{})
+
+	l := &testLogger{}
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Logger = l
+	dnsProxy.SlowQueryThreshold = 20 * time.Millisecond
+	dnsProxy.Upstreams = []upstream.Upstream{slow, timeout}
+	require.NoError(t, dnsProxy.Start())
+	defer dnsProxy.Stop()
+	// the upstream that times out is tried first
+	dnsProxy.upstreamRttStats = map[string]int{slow.Address(): 100}
+
+	resp := serveDoH(t, dnsProxy, createHostTestMessage("example.org"))
+	require.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, uint64(1), dnsProxy.Stats().SlowQueries)
+	require.Equal(t, 1, l.count("warn"))
+	msg := l.messages["warn"][0]
+	assert.True(t, strings.HasPrefix(msg, "Slow query qname=example.org. qtype=A"), msg)
+	assert.Contains(t, msg, "upstream=func://slow")
+	assert.Contains(t, msg, "func://timeout=0ms:timeout,func://slow=")
+	assert.Contains(t, msg, "retries=1")
+	assert.Contains(t, msg, "status=ok rcode=NOERROR")
+
+	// the fast queries aren't logged
+	conf := dnsProxy.Config
+	conf.Upstreams = []upstream.Upstream{good}
+	_, err := dnsProxy.Reload(conf)
+	require.NoError(t, err)
+	serveDoH(t, dnsProxy, createHostTestMessage("example.net"))
+	assert.Equal(t, uint64(1), dnsProxy.Stats().SlowQueries)
+	assert.Equal(t, 1, l.count("warn"))
+}
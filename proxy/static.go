@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/utils"
+	"github.com/miekg/dns"
+)
+
+const defaultStaticEntriesTTL = 10 // in seconds
+
+// initStaticEntries loads the static entries from the config
+func (p *Proxy) initStaticEntries() {
+	hosts := map[string][]net.IP{}
+	for name, ips := range p.StaticEntries {
+		hosts[normalizeStaticName(name)] = copyIPs(ips)
+	}
+
+	p.staticLock.Lock()
+	p.staticHosts = hosts
+	p.staticPTR = buildStaticPTR(hosts)
+	p.staticLock.Unlock()
+
+	if len(hosts) > 0 {
+		p.logger().Infof("Loaded %d static DNS entries", len(hosts))
+	}
+}
+
+// SetStaticEntry adds or replaces the static entry of the name.
+// If ips is empty, the entry is removed.
+// The changes are lost when the proxy is restarted or the config with the other StaticEntries is reloaded.
+func (p *Proxy) SetStaticEntry(name string, ips []net.IP) error {
+	if len(ips) == 0 {
+		p.RemoveStaticEntry(name)
+		return nil
+	}
+	err := validateStaticEntry(name, ips)
+	if err != nil {
+		return err
+	}
+
+	p.staticLock.Lock()
+	defer p.staticLock.Unlock()
+	if p.staticHosts == nil {
+		p.staticHosts = map[string][]net.IP{}
+	}
+	p.staticHosts[normalizeStaticName(name)] = copyIPs(ips)
+	p.staticPTR = buildStaticPTR(p.staticHosts)
+	return nil
+}
+
+// RemoveStaticEntry removes the static entry of the name
+func (p *Proxy) RemoveStaticEntry(name string) {
+	p.staticLock.Lock()
+	defer p.staticLock.Unlock()
+	delete(p.staticHosts, normalizeStaticName(name))
+	p.staticPTR = buildStaticPTR(p.staticHosts)
+}
+
+// LookupStaticEntry returns the addresses of the static entry of the name (or nil)
+func (p *Proxy) LookupStaticEntry(name string) []net.IP {
+	p.staticLock.RLock()
+	defer p.staticLock.RUnlock()
+	return copyIPs(p.staticHosts[normalizeStaticName(name)])
+}
+
+// resolveStatic answers the request from the static entries.
+// A and AAAA requests get the addresses of the entry, the other requests for the name get NODATA.
+// PTR requests for the addresses of the entries get the names.
+// Returns false if the request doesn't match any entry.
+func (p *Proxy) resolveStatic(d *DNSContext) bool {
+	q := d.Req.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return false
+	}
+	name := strings.ToLower(q.Name)
+
+	p.staticLock.RLock()
+	defer p.staticLock.RUnlock()
+
+	ttl := p.requestState(d).StaticEntriesTTL
+	if ttl == 0 {
+		ttl = defaultStaticEntriesTTL
+	}
+
+	var answers []dns.RR
+	if ips, ok := p.staticHosts[name]; ok {
+		for _, ip := range ips {
+			ip4 := ip.To4()
+			hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: ttl}
+			if q.Qtype == dns.TypeA && ip4 != nil {
+				hdr.Rrtype = dns.TypeA
+				answers = append(answers, &dns.A{Hdr: hdr, A: ip4})
+			} else if q.Qtype == dns.TypeAAAA && ip4 == nil {
+				hdr.Rrtype = dns.TypeAAAA
+				answers = append(answers, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+	} else if names, ok := p.staticPTR[name]; ok && q.Qtype == dns.TypePTR {
+		for _, host := range names {
+			hdr := dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl}
+			answers = append(answers, &dns.PTR{Hdr: hdr, Ptr: host})
+		}
+	} else {
+		return false
+	}
+
+	if len(answers) == 0 {
+		d.Res = genEmptyNoError(d.Req)
+		return true
+	}
+
+	resp := &dns.Msg{}
+	resp.SetReply(d.Req)
+	resp.RecursionAvailable = true
+	resp.Answer = answers
+	d.Res = resp
+	return true
+}
+
+// validateStaticEntry checks that the name is a valid hostname and the addresses are set
+func validateStaticEntry(name string, ips []net.IP) error {
+	if err := utils.IsValidHostname(strings.TrimSuffix(name, ".")); err != nil {
+		return fmt.Errorf("invalid static entry name %s: %s", name, err)
+	}
+	for _, ip := range ips {
+		if ip == nil {
+			return fmt.Errorf("invalid static entry address for %s", name)
+		}
+	}
+	return nil
+}
+
+// buildStaticPTR builds the map of the reverse names of the addresses and the corresponding hostnames
+func buildStaticPTR(hosts map[string][]net.IP) map[string][]string {
+	ptr := map[string][]string{}
+	for name, ips := range hosts {
+		for _, ip := range ips {
+			arpa, err := dns.ReverseAddr(ip.String())
+			if err != nil {
+				continue
+			}
+			ptr[arpa] = append(ptr[arpa], name)
+		}
+	}
+	for _, names := range ptr {
+		sort.Strings(names)
+	}
+	return ptr
+}
+
+// normalizeStaticName returns the lowercase FQDN
+func normalizeStaticName(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
+}
+
+// copyIPs returns a copy of the list of addresses (nil if it is empty)
+func copyIPs(ips []net.IP) []net.IP {
+	if len(ips) == 0 {
+		return nil
+	}
+	res := make([]net.IP, len(ips))
+	copy(res, ips)
+	return res
+}
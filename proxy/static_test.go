@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticEntries(t *testing.T) {
+	var count int32
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{createAUpstream("1.2.3.4", &count)}
+	dnsProxy.StaticEntries = map[string][]net.IP{
+		"MyPrinter.lan": {net.ParseIP("192.168.1.50"), net.ParseIP("fd00::50")},
+		"nas.lan.":      {net.ParseIP("192.168.1.50")},
+	}
+	dnsProxy.StaticEntriesTTL = 30
+	err := dnsProxy.Start()
+	require.NoError(t, err)
+	defer dnsProxy.Stop()
+
+	resolve := func(name string, qtype uint16) *dns.Msg {
+		req := &dns.Msg{}
+		req.SetQuestion(name, qtype)
+		d := &DNSContext{Req: req, Addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}}}
+		err := dnsProxy.Resolve(d)
+		require.NoError(t, err)
+		return d.Res
+	}
+
+	resp := resolve("myprinter.lan.", dns.TypeA)
+	require.Len(t, resp.Answer, 1)
+	assert.Equal(t, "192.168.1.50", resp.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, uint32(30), resp.Answer[0].Header().Ttl)
+
+	resp = resolve("MYPRINTER.lan.", dns.TypeAAAA)
+	require.Len(t, resp.Answer, 1)
+	assert.Equal(t, "fd00::50", resp.Answer[0].(*dns.AAAA).AAAA.String())
+
+	// NODATA for the other types
+	resp = resolve("nas.lan.", dns.TypeAAAA)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Empty(t, resp.Answer)
+	resp = resolve("nas.lan.", dns.TypeMX)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Empty(t, resp.Answer)
+
+	// PTR
+	resp = resolve("50.1.168.192.in-addr.arpa.", dns.TypePTR)
+	require.Len(t, resp.Answer, 2)
+	assert.Equal(t, "myprinter.lan.", resp.Answer[0].(*dns.PTR).Ptr)
+	assert.Equal(t, "nas.lan.", resp.Answer[1].(*dns.PTR).Ptr)
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&count))
+
+	// runtime changes
+	require.NoError(t, dnsProxy.SetStaticEntry("nas.lan", []net.IP{net.ParseIP("192.168.1.51")}))
+	assert.Equal(t, []net.IP{net.ParseIP("192.168.1.51")}, dnsProxy.LookupStaticEntry("NAS.lan."))
+	resp = resolve("nas.lan.", dns.TypeA)
+	require.Len(t, resp.Answer, 1)
+	assert.Equal(t, "192.168.1.51", resp.Answer[0].(*dns.A).A.String())
+	resp = resolve("50.1.168.192.in-addr.arpa.", dns.TypePTR)
+	assert.Len(t, resp.Answer, 1)
+
+	dnsProxy.RemoveStaticEntry("nas.lan")
+	assert.Nil(t, dnsProxy.LookupStaticEntry("nas.lan"))
+	resp = resolve("nas.lan.", dns.TypeA)
+	require.Len(t, resp.Answer, 1)
+	assert.Equal(t, "1.2.3.4", resp.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&count))
+
+	assert.NotNil(t, dnsProxy.SetStaticEntry("invalid_name!", []net.IP{net.ParseIP("192.168.1.51")}))
+}
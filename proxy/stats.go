@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"sync/atomic"
+)
+
+// Stats contains the proxy counters.
+// Use Proxy.Stats() to get the current values.
+type Stats struct {
+	ZoneTransfersRefused  uint64 // number of AXFR/IXFR queries that were refused
+	NotImplementedOpcodes uint64 // number of the messages with the opcodes other than QUERY answered with NOTIMP
+	RefusedClasses        uint64 // number of the queries of the classes other than IN that were refused
+	DoHAuthFailures       uint64 // number of DoH requests rejected due to a missing or invalid token
+	TLSHandshakeFailures  uint64 // number of failed TLS handshakes on the DoT and DoH listeners
+	PrefetchAttempts      uint64 // number of popular cache entries that were prefetched
+	PrefetchSuccesses     uint64 // number of prefetches that updated the cache entry
+	RejectedResponses     uint64 // number of upstream responses rejected by the validation (see UpstreamValidation)
+	HandlerPanics         uint64 // number of requests answered with SERVFAIL because their processing panicked
+	SlowQueries           uint64 // number of the queries processed longer than SlowQueryThreshold
+	UpstreamsMarkedDown   uint64 // number of the times the upstreams were marked down (see UpstreamFailureThreshold)
+	UpstreamsRecovered    uint64 // number of the times the down upstreams were restored
+
+	Statuses map[string]uint64 // number of the processed client queries by their statuses (see Status.String)
+
+	ResponseSizes []ResponseSizeBucket // histogram of the sizes of the DNS messages sent to the clients
+
+	Listeners []ListenerStats // the query counters by the listen addresses and protocols
+}
+
+// counters contains the proxy counters that are updated atomically.
+// It must be the first field of the Proxy struct so that the 64-bit
+// fields are properly aligned on 32-bit platforms (see sync/atomic docs).
+type counters struct {
+	zoneTransfersRefused  uint64
+	notImplementedOpcodes uint64
+	unsupportedClasses    uint64
+	dohAuthFailures       uint64
+	tlsHandshakeFailures  uint64
+	prefetchAttempts      uint64
+	prefetchSuccesses     uint64
+	cacheHits             uint64
+	cacheMisses           uint64
+	cacheRotations        uint64 // the number of the rotated cached responses (see CacheRoundRobin)
+	rejectedResponses     uint64
+	handlerPanics         uint64
+	slowQueries           uint64
+	upstreamsMarkedDown   uint64
+	upstreamsRecovered    uint64
+
+	responseSizes [len(responseSizeBuckets)]uint64 // see recordResponseSize
+	statuses      [statusCount]uint64              // see recordStatus
+}
+
+// Stats returns a snapshot of the proxy counters
+func (p *Proxy) Stats() Stats {
+	return Stats{
+		ZoneTransfersRefused:  atomic.LoadUint64(&p.counters.zoneTransfersRefused),
+		NotImplementedOpcodes: atomic.LoadUint64(&p.counters.notImplementedOpcodes),
+		RefusedClasses:        atomic.LoadUint64(&p.counters.unsupportedClasses),
+		DoHAuthFailures:       atomic.LoadUint64(&p.counters.dohAuthFailures),
+		TLSHandshakeFailures:  atomic.LoadUint64(&p.counters.tlsHandshakeFailures),
+		PrefetchAttempts:      atomic.LoadUint64(&p.counters.prefetchAttempts),
+		PrefetchSuccesses:     atomic.LoadUint64(&p.counters.prefetchSuccesses),
+		RejectedResponses:     atomic.LoadUint64(&p.counters.rejectedResponses),
+		HandlerPanics:         atomic.LoadUint64(&p.counters.handlerPanics),
+		SlowQueries:           atomic.LoadUint64(&p.counters.slowQueries),
+		UpstreamsMarkedDown:   atomic.LoadUint64(&p.counters.upstreamsMarkedDown),
+		UpstreamsRecovered:    atomic.LoadUint64(&p.counters.upstreamsRecovered),
+		Statuses:              p.statuses(),
+		ResponseSizes:         p.responseSizes(),
+		Listeners:             p.listenersStats(),
+	}
+}
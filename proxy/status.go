@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+// Status is the outcome of the processing of the query (see DNSContext.Status).
+// The responses to the failed queries are derived from it by statusResponse.
+type Status int
+
+// The statuses of the queries
+const (
+	StatusOK             Status = iota // the query has been answered by the upstreams, the cache or locally
+	StatusMalformed                    // the query is malformed, e.g. it hasn't got exactly one question (FORMERR)
+	StatusRatelimited                  // the query has been dropped by the ratelimit (no response)
+	StatusBlocked                      // the query has been refused by the policy, e.g. a zone transfer (REFUSED)
+	StatusNotImplemented               // the opcode or, with RefuseAny, the ANY query isn't supported (NOTIMP)
+	StatusTimeout                      // all the upstreams have timed out (SERVFAIL)
+	StatusUpstreamError                // the upstreams have failed or sent invalid responses (SERVFAIL)
+	StatusInternalError                // the request handler has failed or panicked (SERVFAIL)
+
+	statusCount // the number of the statuses
+)
+
+var statusNames = [statusCount]string{
+	StatusOK:             "ok",
+	StatusMalformed:      "malformed",
+	StatusRatelimited:    "ratelimited",
+	StatusBlocked:        "blocked",
+	StatusNotImplemented: "not_implemented",
+	StatusTimeout:        "timeout",
+	StatusUpstreamError:  "upstream_error",
+	StatusInternalError:  "internal_error",
+}
+
+// String returns the name of the status used in the logs and Stats.Statuses, e.g. "timeout"
+func (s Status) String() string {
+	if s < 0 || s >= statusCount {
+		return "unknown"
+	}
+	return statusNames[s]
+}
+
+// Rcode returns the rcode of the response to the query with the status
+// (RcodeSuccess for StatusOK and StatusRatelimited, the latter isn't answered)
+func (s Status) Rcode() int {
+	switch s {
+	case StatusMalformed:
+		return dns.RcodeFormatError
+	case StatusBlocked:
+		return dns.RcodeRefused
+	case StatusNotImplemented:
+		return dns.RcodeNotImplemented
+	case StatusTimeout, StatusUpstreamError, StatusInternalError:
+		return dns.RcodeServerFailure
+	default:
+		return dns.RcodeSuccess
+	}
+}
+
+// statusResponse records the status of the failed query and returns the response to it, all the failure paths use it.
+// The response has the Extended DNS Error of the status if they are enabled (see statusEDE).
+func (p *Proxy) statusResponse(d *DNSContext, status Status) *dns.Msg {
+	d.Status = status
+	var res *dns.Msg
+	switch status.Rcode() {
+	case dns.RcodeFormatError:
+		res = p.genFormErr(d.Req)
+	case dns.RcodeRefused:
+		res = p.genRefused(d.Req)
+	case dns.RcodeNotImplemented:
+		res = p.genNotImpl(d.Req)
+	default:
+		res = p.genServerFailure(d.Req)
+	}
+	if code, ok := statusEDE(status); ok {
+		p.setExtendedError(d.Req, res, code, "")
+	}
+	return res
+}
+
+// upstreamStatus returns the status of the query whose upstreams have failed with err
+func upstreamStatus(err error) Status {
+	if errorx.IsTimeout(err) {
+		return StatusTimeout
+	}
+	return StatusUpstreamError
+}
+
+// markTimeout wraps the timeout error of the upstream into errorx.TimeoutElapsed.
+// The errors of several upstreams combined by errorx.DecorateMany are only a timeout if all of them are,
+// so upstreamStatus tells the queries whose upstreams have all timed out.
+func markTimeout(u string, err error) error {
+	if isTimeoutError(err) {
+		return errorx.TimeoutElapsed.Wrap(err, "upstream %s timed out", u)
+	}
+	return err
+}
+
+// isTimeoutError returns true if err or its cause is a network timeout
+func isTimeoutError(err error) bool {
+	for err != nil {
+		if ne, ok := err.(net.Error); ok {
+			return ne.Timeout()
+		}
+		e := errorx.Cast(err)
+		if e == nil {
+			return false
+		}
+		err = e.Cause()
+	}
+	return false
+}
+
+// recordStatus counts the processed query by its status (see Stats.Statuses)
+func (p *Proxy) recordStatus(s Status) {
+	if s >= 0 && s < statusCount {
+		atomic.AddUint64(&p.counters.statuses[s], 1)
+	}
+}
+
+// statuses returns a snapshot of the numbers of the processed queries by their statuses
+func (p *Proxy) statuses() map[string]uint64 {
+	m := make(map[string]uint64, statusCount)
+	for s := Status(0); s < statusCount; s++ {
+		m[s.String()] = atomic.LoadUint64(&p.counters.statuses[s])
+	}
+	return m
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// timeoutError is the network timeout
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// failingUpstream returns the upstream that fails with err
+func failingUpstream(addr string, err error) upstream.Upstream {
+	return &namedUpstream{addr: addr, funcUpstream: &funcUpstream{exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+		return nil, err
+	}}}
+}
+
+func TestResolveStatus(t *testing.T) {
+	broken, good := validationTestUpstreams()
+	timeout1 := failingUpstream("func://timeout1", &net.OpError{Op: "read", Net: "udp", Err: timeoutError{}})
+	timeout2 := failingUpstream("func://timeout2", timeoutError{})
+	failed := failingUpstream("func://failed", errors.New("connection refused"))
+
+	testCases := []struct {
+		name      string
+		upstreams []upstream.Upstream
+		status    Status
+	}{
+		{name: "ok", upstreams: []upstream.Upstream{good}, status: StatusOK},
+		{name: "timeout", upstreams: []upstream.Upstream{timeout1}, status: StatusTimeout},
+		{name: "all_timeouts", upstreams: []upstream.Upstream{timeout1, timeout2}, status: StatusTimeout},
+		{name: "timeout_and_error", upstreams: []upstream.Upstream{timeout1, failed}, status: StatusUpstreamError},
+		{name: "invalid_response", upstreams: []upstream.Upstream{broken}, status: StatusUpstreamError},
+	}
+	for _, tc := range testCases {
+		for _, allServers := range []bool{false, true} {
+			dnsProxy := createTestProxy(t, nil)
+			dnsProxy.AllServers = allServers
+			dnsProxy.Upstreams = tc.upstreams
+			var handlerStatus Status
+			dnsProxy.ResponseHandler = func(d *DNSContext, err error) {
+				handlerStatus = d.Status
+			}
+
+			d := &DNSContext{Proto: ProtoUDP, Req: createHostTestMessage("example.org"), Addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}}}
+			err := dnsProxy.Resolve(d)
+			assert.Equal(t, tc.status == StatusOK, err == nil, tc.name)
+			assert.Equal(t, tc.status, d.Status, tc.name)
+			assert.Equal(t, tc.status, handlerStatus, tc.name)
+			require.NotNil(t, d.Res)
+			assert.Equal(t, tc.status.Rcode(), d.Res.Rcode, tc.name)
+		}
+	}
+}
+
+// serveDoH passes the request to ServeHTTP, so it's processed synchronously, and returns the response
+func serveDoH(t *testing.T, p *Proxy, req *dns.Msg) *dns.Msg {
+	packet, err := req.Pack()
+	require.NoError(t, err)
+	r := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(packet))
+	r.Header.Set("Content-Type", "application/dns-message")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	resp := &dns.Msg{}
+	require.NoError(t, resp.Unpack(w.Body.Bytes()))
+	return resp
+}
+
+func TestRequestStatus(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.RefuseAny = true
+	require.NoError(t, dnsProxy.Start())
+	defer dnsProxy.Stop()
+
+	noQuestion := &dns.Msg{}
+	noQuestion.Id = dns.Id()
+	assert.Equal(t, dns.RcodeFormatError, serveDoH(t, dnsProxy, noQuestion).Rcode)
+
+	any := &dns.Msg{}
+	any.SetQuestion("example.org.", dns.TypeANY)
+	assert.Equal(t, dns.RcodeNotImplemented, serveDoH(t, dnsProxy, any).Rcode)
+
+	axfr := &dns.Msg{}
+	axfr.SetQuestion("example.org.", dns.TypeAXFR)
+	assert.Equal(t, dns.RcodeRefused, serveDoH(t, dnsProxy, axfr).Rcode)
+
+	statuses := dnsProxy.Stats().Statuses
+	assert.Equal(t, uint64(1), statuses["malformed"])
+	assert.Equal(t, uint64(1), statuses["not_implemented"])
+	assert.Equal(t, uint64(1), statuses["blocked"])
+	assert.Zero(t, statuses["ok"])
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// tcpIdleTimeout returns the idle timeout of the TCP and TLS connections
+func (p *Proxy) tcpIdleTimeout() time.Duration {
+	s := p.state()
+	if s.TCPIdleTimeout > 0 {
+		return s.TCPIdleTimeout
+	}
+	return defaultTimeout
+}
+
+// checkTCPKeepaliveRequest processes the edns-tcp-keepalive option (RFC 7828) of the request.
+// The option is hop-by-hop, so it is removed from the request and never forwarded to the upstreams.
+// Returns FORMERR if the option is received over UDP (RFC 7828, 3.2.1), otherwise returns nil.
+func (p *Proxy) checkTCPKeepaliveRequest(d *DNSContext) *dns.Msg {
+	opt := d.Req.IsEdns0()
+	if opt == nil || !removeTCPKeepalive(opt) {
+		return nil
+	}
+
+	if d.Proto == ProtoUDP {
+		p.logger().Debugf("edns-tcp-keepalive received over UDP")
+		return p.statusResponse(d, StatusMalformed)
+	}
+	d.tcpKeepalive = d.Proto == ProtoTCP || d.Proto == ProtoTLS
+	return nil
+}
+
+// setTCPKeepalive removes the edns-tcp-keepalive option from the response
+// and adds the one with the idle timeout if the client has requested it
+func (p *Proxy) setTCPKeepalive(d *DNSContext) {
+	opt := d.Res.IsEdns0()
+	if opt != nil {
+		removeTCPKeepalive(opt)
+	}
+	if !d.tcpKeepalive {
+		return
+	}
+
+	if opt == nil {
+		opt = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT, Class: dns.DefaultMsgSize}}
+		if reqOpt := d.Req.IsEdns0(); reqOpt != nil {
+			opt.SetUDPSize(reqOpt.UDPSize())
+		}
+		d.Res.Extra = append(d.Res.Extra, opt)
+	}
+
+	// the timeout is specified in units of 100 milliseconds
+	timeout := p.tcpIdleTimeout() / (100 * time.Millisecond)
+	if timeout > 0xffff {
+		timeout = 0xffff
+	}
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, uint16(timeout))
+	// dns.EDNS0_TCP_KEEPALIVE isn't used since it is packed incorrectly (the option code and length are duplicated)
+	// and it isn't unpacked at all, the received options are dns.EDNS0_LOCAL
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE, Data: data})
+}
+
+// removeTCPKeepalive removes the edns-tcp-keepalive options from opt and returns true if there were any
+func removeTCPKeepalive(opt *dns.OPT) bool {
+	found := false
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0TCPKEEPALIVE {
+			found = true
+			continue
+		}
+		options = append(options, o)
+	}
+	opt.Option = options
+	return found
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// findTCPKeepalive returns the data of the edns-tcp-keepalive option of the message (or nil)
+func findTCPKeepalive(m *dns.Msg) []byte {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0TCPKEEPALIVE {
+			return o.(*dns.EDNS0_LOCAL).Data
+		}
+	}
+	return nil
+}
+
+// createKeepaliveTestMessage creates a request with the edns-tcp-keepalive option
+func createKeepaliveTestMessage() *dns.Msg {
+	req := createTestMessage()
+	req.SetEdns0(4096, false)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE, Data: []byte{}})
+	return req
+}
+
+func TestTCPKeepalive(t *testing.T) {
+	forwarded := make(chan bool, 10)
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.TCPIdleTimeout = 30 * time.Second
+	dnsProxy.Upstreams = []upstream.Upstream{&funcUpstream{
+		exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+			forwarded <- m.IsEdns0() != nil && len(m.IsEdns0().Option) > 0
+			resp := &dns.Msg{}
+			resp.SetReply(m)
+			resp.Answer = []dns.RR{newRR(m.Question[0].Name + " 60 IN A 1.2.3.4")}
+			return resp, nil
+		},
+	}}
+	err := dnsProxy.Start()
+	require.NoError(t, err)
+	defer dnsProxy.Stop()
+
+	// the timeout is advertised over TCP, the option isn't forwarded
+	tcpClient := &dns.Client{Net: "tcp", Timeout: time.Second}
+	resp, _, err := tcpClient.Exchange(createKeepaliveTestMessage(), dnsProxy.Addr(ProtoTCP).String())
+	require.NoError(t, err)
+	assert.False(t, <-forwarded)
+	// 300 units of 100 milliseconds
+	assert.Equal(t, []byte{0x01, 0x2c}, findTCPKeepalive(resp))
+
+	// no option if the client hasn't requested it
+	resp, _, err = tcpClient.Exchange(createTestMessage(), dnsProxy.Addr(ProtoTCP).String())
+	require.NoError(t, err)
+	<-forwarded
+	assert.Nil(t, findTCPKeepalive(resp))
+
+	// FORMERR over UDP
+	udpClient := &dns.Client{Net: "udp", Timeout: time.Second}
+	resp, _, err = udpClient.Exchange(createKeepaliveTestMessage(), dnsProxy.Addr(ProtoUDP).String())
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeFormatError, resp.Rcode)
+	assert.Nil(t, findTCPKeepalive(resp))
+	assert.Len(t, forwarded, 0)
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	stdlog "log"
+	"strings"
+	"sync/atomic"
+)
+
+// TLSClientAuth configures the client certificate authentication
+// on the DoT and DoH listeners (mutual TLS)
+type TLSClientAuth struct {
+	// ClientCAs is the pool of the CA certificates that are used to verify the client certificates
+	ClientCAs *x509.CertPool
+
+	// Mode is the client authentication policy.
+	// tls.RequireAndVerifyClientCert is used if it isn't set.
+	Mode tls.ClientAuthType
+}
+
+// serverTLSConfig returns the TLS config of the DoT and DoH listeners
+// with the client authentication settings applied
+func (p *Proxy) serverTLSConfig() *tls.Config {
+	if p.TLSClientAuth == nil {
+		return p.TLSConfig
+	}
+
+	c := p.TLSConfig.Clone()
+	c.ClientCAs = p.TLSClientAuth.ClientCAs
+	c.ClientAuth = p.TLSClientAuth.Mode
+	if c.ClientAuth == tls.NoClientCert {
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return c
+}
+
+// clientCert returns the verified client certificate from the TLS connection state (or nil)
+func clientCert(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// handshakeTLS performs the TLS handshake on the DoT connection and returns the verified client certificate.
+// Handshake failures are expected (e.g. the client has no valid certificate),
+// so they're only counted and logged at the debug level.
+func (p *Proxy) handshakeTLS(conn *tls.Conn) (*x509.Certificate, error) {
+	err := conn.Handshake()
+	if err != nil {
+		atomic.AddUint64(&p.counters.tlsHandshakeFailures, 1)
+		if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("TLS handshake with %s failed: %s", conn.RemoteAddr(), err)
+		}
+		return nil, err
+	}
+
+	state := conn.ConnectionState()
+	return clientCert(&state), nil
+}
+
+// httpsErrorLog is the error log of the HTTPS server.
+// TLS handshake errors are counted and logged at the debug level, other errors are logged as usual.
+type httpsErrorLog struct {
+	p *Proxy
+}
+
+// Write implements the io.Writer interface for httpsErrorLog
+func (l *httpsErrorLog) Write(b []byte) (int, error) {
+	msg := strings.TrimSpace(string(b))
+	if strings.Contains(msg, "TLS handshake error") {
+		atomic.AddUint64(&l.p.counters.tlsHandshakeFailures, 1)
+		if log := l.p.logger(); log.DebugEnabled() {
+			log.Debugf("%s", msg)
+		}
+	} else {
+		l.p.logger().Infof("%s", msg)
+	}
+	return len(b), nil
+}
+
+// newHTTPSErrorLog creates the error logger for the HTTPS server
+func (p *Proxy) newHTTPSErrorLog() *stdlog.Logger {
+	return stdlog.New(&httpsErrorLog{p: p}, "", 0)
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createClientCert creates a self-signed client certificate with the specified CN
+func createClientCert(t *testing.T, cn string) (tls.Certificate, *x509.Certificate) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(derBytes)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{derBytes}, PrivateKey: privateKey}, cert
+}
+
+func TestTLSClientAuth(t *testing.T) {
+	serverConfig, caPem := createServerTLSConfig(t)
+	clientCert, clientCA := createClientCert(t, "client1")
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCA)
+
+	var clientCN atomic.Value
+	dnsProxy := createTestProxy(t, serverConfig)
+	dnsProxy.TLSClientAuth = &TLSClientAuth{ClientCAs: clientCAs}
+	dnsProxy.Upstreams = []upstream.Upstream{&funcUpstream{
+		exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+			resp := &dns.Msg{}
+			resp.SetReply(m)
+			return resp, nil
+		},
+	}}
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		if d.ClientCert != nil {
+			clientCN.Store(d.ClientCert.Subject.CommonName)
+		}
+		return p.Resolve(d)
+	}
+	err := dnsProxy.Start()
+	require.NoError(t, err)
+	defer dnsProxy.Stop()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPem)
+	addr := dnsProxy.Addr(ProtoTLS).String()
+
+	// valid client certificate
+	client := &dns.Client{Net: "tcp-tls", Timeout: 2 * time.Second, TLSConfig: &tls.Config{
+		ServerName:   tlsServerName,
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{clientCert},
+	}}
+	r, _, err := client.Exchange(createTestMessage(), addr)
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, r.Rcode)
+	assert.Equal(t, "client1", clientCN.Load())
+	assert.Equal(t, uint64(0), dnsProxy.Stats().TLSHandshakeFailures)
+
+	// no client certificate
+	client.TLSConfig = &tls.Config{ServerName: tlsServerName, RootCAs: roots}
+	_, _, err = client.Exchange(createTestMessage(), addr)
+	assert.NotNil(t, err)
+
+	// the handshake is finished by the server asynchronously
+	for i := 0; i < 100 && dnsProxy.Stats().TLSHandshakeFailures == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, uint64(1), dnsProxy.Stats().TLSHandshakeFailures)
+}
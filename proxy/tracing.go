@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"context"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// The names of the tracing spans (see Config.Tracer)
+const (
+	SpanQuery    = "dnsproxy.query"    // the processing of the client query, the parent of the other spans
+	SpanCache    = "dnsproxy.cache"    // the cache lookup
+	SpanUpstream = "dnsproxy.upstream" // an exchange with an upstream (or a fallback)
+	SpanRespond  = "dnsproxy.respond"  // the writing of the response to the client
+)
+
+// The keys of the span attributes
+const (
+	AttrQName    = "dns.qname"
+	AttrQType    = "dns.qtype"
+	AttrProto    = "dns.proto"
+	AttrClient   = "dns.client"
+	AttrUpstream = "dns.upstream"
+	AttrRcode    = "dns.rcode"
+	AttrCacheHit = "dns.cache_hit"
+)
+
+// tracer returns the tracer of the proxy (the no-op one if Config.Tracer isn't set)
+func (p *Proxy) tracer() proxyutil.Tracer {
+	return proxyutil.TracerOrNoop(p.state().Tracer)
+}
+
+// Context returns the context of the query that contains its tracing span
+// (context.Background() if the query is processed without a context)
+func (d *DNSContext) Context() context.Context {
+	if d.ctx == nil {
+		return context.Background()
+	}
+	return d.ctx
+}
+
+// ResolveContext is Resolve that nests the spans of the query in the span from ctx
+func (p *Proxy) ResolveContext(ctx context.Context, d *DNSContext) error {
+	d.ctx = ctx
+	return p.Resolve(d)
+}
+
+// questionAttrs returns the attributes of the question of the request
+func questionAttrs(req *dns.Msg) []proxyutil.Attribute {
+	if req == nil || len(req.Question) == 0 {
+		return nil
+	}
+	q := req.Question[0]
+	return []proxyutil.Attribute{{Key: AttrQName, Value: q.Name}, {Key: AttrQType, Value: dns.TypeToString[q.Qtype]}}
+}
+
+// startQuerySpan starts the parent span of the client query, the returned function ends it
+func (p *Proxy) startQuerySpan(d *DNSContext) func(err error) {
+	s := p.requestState(d)
+	if s.Tracer == nil {
+		return func(error) {}
+	}
+
+	attrs := append(questionAttrs(d.Req), proxyutil.Attribute{Key: AttrProto, Value: d.Proto})
+	if d.Addr != nil {
+		attrs = append(attrs, proxyutil.Attribute{Key: AttrClient, Value: d.Addr.String()})
+	}
+	ctx, span := s.Tracer.Start(d.Context(), SpanQuery, attrs...)
+	d.ctx = ctx
+	return func(err error) {
+		endSpan(span, d.Res, err)
+	}
+}
+
+// startCacheSpan starts the span of the cache lookup, the returned function ends it
+func (p *Proxy) startCacheSpan(d *DNSContext) func(hit bool) {
+	s := p.requestState(d)
+	if s.Tracer == nil {
+		return func(bool) {}
+	}
+
+	_, span := s.Tracer.Start(d.Context(), SpanCache, questionAttrs(d.Req)...)
+	return func(hit bool) {
+		span.SetAttributes(proxyutil.Attribute{Key: AttrCacheHit, Value: hit})
+		span.End()
+	}
+}
+
+// startRespondSpan starts the span of writing the response, the returned function ends it
+func (p *Proxy) startRespondSpan(d *DNSContext) func(err error) {
+	s := p.requestState(d)
+	if s.Tracer == nil {
+		return func(error) {}
+	}
+
+	_, span := s.Tracer.Start(d.Context(), SpanRespond, proxyutil.Attribute{Key: AttrProto, Value: d.Proto})
+	return func(err error) {
+		endSpan(span, d.Res, err)
+	}
+}
+
+// startUpstreamSpan starts the span of the exchange with the upstream, the returned context contains it
+// and is passed to the upstream (see upstream.ExchangeContext), so the spans of the upstream nest in it.
+// The returned function ends the span.
+func (p *Proxy) startUpstreamSpan(ctx context.Context, u upstream.Upstream, req *dns.Msg) (context.Context, func(reply *dns.Msg, err error)) {
+	s := p.state()
+	if s.Tracer == nil {
+		return ctx, func(*dns.Msg, error) {}
+	}
+
+	attrs := append(questionAttrs(req), proxyutil.Attribute{Key: AttrUpstream, Value: upstream.Name(u)})
+	ctx, span := s.Tracer.Start(ctx, SpanUpstream, attrs...)
+	return ctx, func(reply *dns.Msg, err error) {
+		endSpan(span, reply, err)
+	}
+}
+
+// endSpan records the rcode of the response and the error (if any) and ends the span
+func endSpan(span proxyutil.Span, res *dns.Msg, err error) {
+	if res != nil {
+		span.SetAttributes(proxyutil.Attribute{Key: AttrRcode, Value: dns.RcodeToString[res.Rcode]})
+	}
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// spanKey is the key of the testSpan in the context
+type spanKey struct{}
+
+// testSpan is the span recorded by testTracer
+type testSpan struct {
+	name   string
+	parent *testSpan
+	attrs  map[string]interface{}
+	err    error
+	ended  bool
+}
+
+func (s *testSpan) SetAttributes(attrs ...proxyutil.Attribute) {
+	for _, a := range attrs {
+		s.attrs[a.Key] = a.Value
+	}
+}
+
+func (s *testSpan) RecordError(err error) { s.err = err }
+func (s *testSpan) End()                  { s.ended = true }
+
+// testTracer records the started spans
+type testTracer struct {
+	sync.Mutex
+	spans []*testSpan
+}
+
+func (t *testTracer) Start(ctx context.Context, name string, attrs ...proxyutil.Attribute) (context.Context, proxyutil.Span) {
+	parent, _ := ctx.Value(spanKey{}).(*testSpan)
+	s := &testSpan{name: name, parent: parent, attrs: map[string]interface{}{}}
+	s.SetAttributes(attrs...)
+	t.Lock()
+	t.spans = append(t.spans, s)
+	t.Unlock()
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// ctxUpstream is the upstream that takes the context of the query
+type ctxUpstream struct {
+	*funcUpstream
+	parent *testSpan // the span in the context of the last exchange
+}
+
+func (u *ctxUpstream) ExchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	u.parent, _ = ctx.Value(spanKey{}).(*testSpan)
+	return u.Exchange(m)
+}
+
+func TestTracing(t *testing.T) {
+	tracer := &testTracer{}
+	u := &ctxUpstream{funcUpstream: &funcUpstream{exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+		resp := &dns.Msg{}
+		resp.SetReply(m)
+		resp.Answer = []dns.RR{newRR("google-public-dns-a.google.com. 60 IN A 8.8.8.8")}
+		return resp, nil
+	}}}
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.Tracer = tracer
+	dnsProxy.Upstreams = []upstream.Upstream{u}
+	require.NoError(t, dnsProxy.Start())
+	defer dnsProxy.Stop()
+
+	packet, err := createTestMessage().Pack()
+	require.NoError(t, err)
+
+	// the query span is the child of the span of the HTTP request
+	serve := func() []*testSpan {
+		tracer.spans = nil
+		ctx, root := tracer.Start(context.Background(), "http")
+		r := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(packet)).WithContext(ctx)
+		r.Header.Set("Content-Type", "application/dns-message")
+		w := httptest.NewRecorder()
+		dnsProxy.ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		spans := tracer.spans[1:]
+		for _, s := range spans {
+			assert.True(t, s.ended, s.name)
+			assert.NoError(t, s.err, s.name)
+		}
+		require.NotEmpty(t, spans)
+		assert.Equal(t, SpanQuery, spans[0].name)
+		assert.Equal(t, root, spans[0].parent)
+		assert.Equal(t, "google-public-dns-a.google.com.", spans[0].attrs[AttrQName])
+		assert.Equal(t, "A", spans[0].attrs[AttrQType])
+		assert.Equal(t, "NOERROR", spans[0].attrs[AttrRcode])
+		for _, s := range spans[1:] {
+			assert.Equal(t, spans[0], s.parent, s.name)
+		}
+		return spans
+	}
+
+	spans := serve()
+	require.Len(t, spans, 4)
+	assert.Equal(t, SpanCache, spans[1].name)
+	assert.Equal(t, false, spans[1].attrs[AttrCacheHit])
+	assert.Equal(t, SpanUpstream, spans[2].name)
+	assert.Equal(t, "func://test", spans[2].attrs[AttrUpstream])
+	assert.Equal(t, "NOERROR", spans[2].attrs[AttrRcode])
+	assert.Equal(t, spans[2], u.parent, "the upstream must get the context with its span")
+	assert.Equal(t, SpanRespond, spans[3].name)
+
+	// the cached response isn't exchanged with the upstream
+	spans = serve()
+	require.Len(t, spans, 3)
+	assert.Equal(t, SpanCache, spans[1].name)
+	assert.Equal(t, true, spans[1].attrs[AttrCacheHit])
+	assert.Equal(t, SpanRespond, spans[2].name)
+}
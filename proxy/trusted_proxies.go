@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// initTrustedProxies parses Config.TrustedProxies
+func (p *Proxy) initTrustedProxies() {
+	p.trustedProxies = nil
+	if len(p.TrustedProxies) == 0 {
+		return
+	}
+	nets, err := parseSubnets(p.TrustedProxies)
+	if err != nil {
+		// the config is validated before, so this never happens
+		p.logger().Errorf("invalid trusted proxies: %s", err)
+		return
+	}
+	p.trustedProxies = nets
+}
+
+// isTrustedProxy returns true if ip is in Config.TrustedProxies
+func (p *Proxy) isTrustedProxy(ip net.IP) bool {
+	for _, n := range p.state().trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedClientIP returns the address of the client that has sent the DoH request through the reverse proxies
+// or nil if the address of the peer must be used.
+// Only the headers of the peer in Config.TrustedProxies are used: the RFC 7239 Forwarded header or, if there is none,
+// X-Forwarded-For. The client is the rightmost untrusted hop, the malformed headers are ignored.
+func (p *Proxy) forwardedClientIP(r *http.Request, peer net.IP) net.IP {
+	if !p.isTrustedProxy(peer) {
+		return nil
+	}
+
+	var hops []net.IP
+	var ok bool
+	if v := r.Header["Forwarded"]; len(v) > 0 {
+		hops, ok = parseForwarded(strings.Join(v, ","))
+	} else if v := r.Header["X-Forwarded-For"]; len(v) > 0 {
+		hops, ok = parseXForwardedFor(strings.Join(v, ","))
+	}
+	if !ok {
+		return nil
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !p.isTrustedProxy(hops[i]) {
+			return hops[i]
+		}
+	}
+	// all the hops are trusted, the leftmost one is the client
+	return hops[0]
+}
+
+// parseXForwardedFor parses the comma-separated addresses of the X-Forwarded-For header,
+// returns false if the header is empty or any of them is invalid
+func parseXForwardedFor(s string) ([]net.IP, bool) {
+	var hops []net.IP
+	for _, f := range strings.Split(s, ",") {
+		ip := parseHopIP(strings.TrimSpace(f))
+		if ip == nil {
+			return nil, false
+		}
+		hops = append(hops, ip)
+	}
+	return hops, len(hops) > 0
+}
+
+// parseForwarded parses the "for" parameters of the elements of the RFC 7239 Forwarded header,
+// returns false if the header has no elements or any of them has no valid "for" address
+// (including the "unknown" and the obfuscated identifiers)
+func parseForwarded(s string) ([]net.IP, bool) {
+	var hops []net.IP
+	for _, element := range strings.Split(s, ",") {
+		var ip net.IP
+		for _, pair := range strings.Split(element, ";") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+				ip = parseHopIP(strings.Trim(kv[1], `"`))
+				break
+			}
+		}
+		if ip == nil {
+			return nil, false
+		}
+		hops = append(hops, ip)
+	}
+	return hops, len(hops) > 0
+}
+
+// parseHopIP parses the address of the hop: an IP address, optionally with the port,
+// the IPv6 address with the port is enclosed in square brackets
+func parseHopIP(s string) net.IP {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	p := &Proxy{}
+	p.TrustedProxies = []string{"127.0.0.1", "10.0.0.0/8", "fd00::/8"}
+	p.initTrustedProxies()
+
+	testCases := []struct {
+		name    string
+		peer    string
+		headers map[string]string
+		want    string
+	}{
+		{name: "no_headers", peer: "127.0.0.1:1234", want: "127.0.0.1"},
+		{name: "xff", peer: "127.0.0.1:1234", headers: map[string]string{"X-Forwarded-For": "1.2.3.4"}, want: "1.2.3.4"},
+		{name: "xff_rightmost_untrusted", peer: "127.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "6.6.6.6, 1.2.3.4, 10.1.1.1"}, want: "1.2.3.4"},
+		{name: "xff_all_trusted", peer: "127.0.0.1:1234", headers: map[string]string{"X-Forwarded-For": "10.2.2.2, 10.1.1.1"}, want: "10.2.2.2"},
+		{name: "xff_untrusted_peer", peer: "192.168.1.1:1234", headers: map[string]string{"X-Forwarded-For": "1.2.3.4"}, want: "192.168.1.1"},
+		{name: "xff_malformed", peer: "127.0.0.1:1234", headers: map[string]string{"X-Forwarded-For": "1.2.3.4, garbage"}, want: "127.0.0.1"},
+		{name: "forwarded", peer: "127.0.0.1:1234",
+			headers: map[string]string{"Forwarded": `for=192.0.2.60;proto=https;by=10.0.0.1, For="[2001:db8:cafe::17]:4711"`}, want: "2001:db8:cafe::17"},
+		{name: "forwarded_trusted_hop", peer: "[fd00::1]:443",
+			headers: map[string]string{"Forwarded": "for=192.0.2.60, for=10.3.3.3"}, want: "192.0.2.60"},
+		{name: "forwarded_first", peer: "127.0.0.1:1234",
+			headers: map[string]string{"Forwarded": "for=192.0.2.60", "X-Forwarded-For": "1.2.3.4"}, want: "192.0.2.60"},
+		{name: "forwarded_unknown", peer: "127.0.0.1:1234", headers: map[string]string{"Forwarded": "for=unknown"}, want: "127.0.0.1"},
+		{name: "forwarded_no_for", peer: "127.0.0.1:1234", headers: map[string]string{"Forwarded": "proto=https"}, want: "127.0.0.1"},
+		{name: "real_ip_ignored", peer: "127.0.0.1:1234", headers: map[string]string{"X-Real-IP": "1.2.3.4"}, want: "127.0.0.1"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/dns-query", nil)
+			r.RemoteAddr = tc.peer
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+			addr, err := p.remoteAddr(r)
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, addr.(*net.TCPAddr).IP.String())
+		})
+	}
+}
+
+func TestNoTrustedProxies(t *testing.T) {
+	p := &Proxy{}
+	p.initTrustedProxies()
+
+	// the headers of any peer are ignored
+	r := httptest.NewRequest(http.MethodGet, "/dns-query", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	for _, h := range []string{"X-Forwarded-For", "X-Real-IP", "CF-Connecting-IP", "True-Client-IP"} {
+		r.Header.Set(h, "1.2.3.4")
+	}
+	r.Header.Set("Forwarded", "for=1.2.3.4")
+	addr, err := p.remoteAddr(r)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", addr.(*net.TCPAddr).IP.String())
+}
+
+func TestTrustedProxiesValidation(t *testing.T) {
+	p := createTestProxy(t, nil)
+	p.TrustedProxies = []string{"not-an-ip"}
+	assert.Error(t, p.Start())
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+)
+
+// udpBatchSize is the max number of datagrams read or written with a single syscall
+const udpBatchSize = 16
+
+// udpBatchConn reads and writes several datagrams at once
+// (implemented by ipv4.PacketConn and ipv6.PacketConn, both use recvmmsg and sendmmsg on Linux)
+type udpBatchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// udpBatchLoop reads the incoming UDP packets with ReadBatch, the responses are sent with WriteBatch.
+// Returns false if the batched read doesn't work, so the caller should fall back to the single-packet loop.
+func (p *Proxy) udpBatchLoop(conn *net.UDPConn, bc udpBatchConn, l *listener) bool {
+	w := newUDPBatchWriter(conn, bc)
+	defer w.stop()
+	l.udpWriter = w
+
+	ms := make([]ipv4.Message, udpBatchSize)
+	for i := range ms {
+		ms[i].Buffers = [][]byte{make([]byte, p.udpBufferSize())}
+	}
+
+	received := false
+	for {
+		p.RLock()
+		started := p.started
+		p.RUnlock()
+		if !started {
+			return true
+		}
+
+		n, err := bc.ReadBatch(ms, 0)
+		for i := 0; i < n; i++ {
+			if ms[i].N > 0 {
+				received = true
+				p.dispatchUDPPacket(ms[i].Buffers[0][:ms[i].N], ms[i].Addr, conn, l)
+			}
+		}
+		if err != nil {
+			if isConnClosed(err) {
+				p.logger().Infof("ReadBatch() returned because we're reading from a closed connection, exiting loop")
+				return true
+			}
+			if !received {
+				p.logger().Infof("batched UDP read isn't supported: %s", err)
+				return false
+			}
+			p.logger().Infof("got error when reading from UDP listen: %s", err)
+		}
+	}
+}
+
+// dispatchUDPPacket starts processing of the packet received from addr in a new goroutine
+func (p *Proxy) dispatchUDPPacket(b []byte, addr net.Addr, conn *net.UDPConn, l *listener) {
+	// make a copy of all bytes because the next read will overwrite contents of b
+	// we need the contents to survive the call because we're handling them in goroutine
+	packet := make([]byte, len(b))
+	copy(packet, b)
+	p.guardMaxGoroutines()
+	go func() {
+		p.handleUDPPacket(packet, addr, conn, l) // ignore errors
+		p.freeMaxGoroutines()
+	}()
+}
+
+// udpBatchWriter collects the responses that are written to the UDP connection at the same time
+// and sends them with a single WriteBatch call
+type udpBatchWriter struct {
+	conn    *net.UDPConn
+	bc      udpBatchConn
+	writes  chan *udpWrite
+	stopped chan struct{} // closed when the listener loop exits
+}
+
+// udpWrite is a response queued to udpBatchWriter
+type udpWrite struct {
+	b    []byte
+	addr net.Addr
+	n    int
+	err  error
+	done chan struct{} // closed when the response is written
+}
+
+// newUDPBatchWriter creates a new udpBatchWriter and starts its loop
+func newUDPBatchWriter(conn *net.UDPConn, bc udpBatchConn) *udpBatchWriter {
+	w := &udpBatchWriter{
+		conn:    conn,
+		bc:      bc,
+		writes:  make(chan *udpWrite),
+		stopped: make(chan struct{}),
+	}
+	go w.loop()
+	return w
+}
+
+// write sends b to addr and returns the number of bytes written, just like conn.WriteTo
+func (w *udpBatchWriter) write(b []byte, addr net.Addr) (int, error) {
+	wr := &udpWrite{b: b, addr: addr, done: make(chan struct{})}
+	select {
+	case w.writes <- wr:
+	case <-w.stopped:
+		return w.conn.WriteTo(b, addr)
+	}
+	<-wr.done
+	return wr.n, wr.err
+}
+
+// stop stops the writer loop, the responses that are written after that are sent with conn.WriteTo
+func (w *udpBatchWriter) stop() {
+	close(w.stopped)
+}
+
+// loop waits for a response and then sends it with all the other responses that are already queued
+func (w *udpBatchWriter) loop() {
+	writes := make([]*udpWrite, 0, udpBatchSize)
+	ms := make([]ipv4.Message, udpBatchSize)
+	for i := range ms {
+		ms[i].Buffers = make([][]byte, 1)
+	}
+
+	for {
+		select {
+		case wr := <-w.writes:
+			writes = append(writes[:0], wr)
+		case <-w.stopped:
+			return
+		}
+
+	collect:
+		for len(writes) < udpBatchSize {
+			select {
+			case wr := <-w.writes:
+				writes = append(writes, wr)
+			default:
+				break collect
+			}
+		}
+
+		w.flush(writes, ms[:len(writes)])
+	}
+}
+
+// flush writes the responses and notifies the waiting writers
+func (w *udpBatchWriter) flush(writes []*udpWrite, ms []ipv4.Message) {
+	for i, wr := range writes {
+		ms[i].Buffers[0] = wr.b
+		ms[i].Addr = wr.addr
+		ms[i].N = 0
+	}
+
+	sent := 0
+	for sent < len(ms) {
+		n, err := w.bc.WriteBatch(ms[sent:], 0)
+		if err != nil || n == 0 {
+			// write the rest one by one, so every response gets its own result
+			for _, wr := range writes[sent:] {
+				wr.n, wr.err = w.conn.WriteTo(wr.b, wr.addr)
+			}
+			break
+		}
+		for i := sent; i < sent+n; i++ {
+			writes[i].n = ms[i].N
+		}
+		sent += n
+	}
+
+	for i, wr := range writes {
+		close(wr.done)
+		ms[i].Buffers[0] = nil
+		writes[i] = nil
+	}
+}
@@ -0,0 +1,19 @@
+// +build linux
+
+package proxy
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// newUDPBatchConn returns the connection that reads and writes the datagrams
+// with recvmmsg and sendmmsg
+func newUDPBatchConn(conn *net.UDPConn) udpBatchConn {
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		return ipv6.NewPacketConn(conn)
+	}
+	return ipv4.NewPacketConn(conn)
+}
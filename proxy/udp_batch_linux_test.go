@@ -0,0 +1,149 @@
+// +build linux
+
+package proxy
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/ipv4"
+)
+
+func TestUDPBatch(t *testing.T) {
+	var count int32
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{createAUpstream("1.2.3.4", &count)}
+	err := dnsProxy.Start()
+	require.NoError(t, err)
+	defer dnsProxy.Stop()
+
+	addr := dnsProxy.Addr(ProtoUDP)
+	conn, err := net.Dial("udp", addr.String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// send a burst of queries over a single socket
+	ids := map[uint16]bool{}
+	for i := 0; i < 100; i++ {
+		req := createTestMessage()
+		req.Id = uint16(i + 1)
+		ids[req.Id] = true
+		packet, err := req.Pack()
+		require.NoError(t, err)
+		_, err = conn.Write(packet)
+		require.NoError(t, err)
+	}
+
+	b := make([]byte, dns.MaxMsgSize)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(ids) > 0 {
+		n, err := conn.Read(b)
+		require.NoError(t, err)
+		resp := &dns.Msg{}
+		require.NoError(t, resp.Unpack(b[:n]))
+		require.True(t, ids[resp.Id])
+		delete(ids, resp.Id)
+		require.Len(t, resp.Answer, 1)
+		assert.Equal(t, "1.2.3.4", resp.Answer[0].(*dns.A).A.String())
+	}
+}
+
+func TestUDPBatchWriter(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+	defer conn.Close()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+	defer client.Close()
+
+	w := newUDPBatchWriter(conn, newUDPBatchConn(conn))
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := w.write([]byte("test"), client.LocalAddr())
+			assert.NoError(t, err)
+			assert.Equal(t, 4, n)
+		}()
+	}
+	wg.Wait()
+
+	// the writes after stop are sent directly
+	w.stop()
+	n, err := w.write([]byte("test"), client.LocalAddr())
+	require.NoError(t, err)
+	assert.Equal(t, 4, n)
+
+	b := make([]byte, 16)
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 51; i++ {
+		n, _, err := client.ReadFrom(b)
+		require.NoError(t, err)
+		assert.Equal(t, "test", string(b[:n]))
+	}
+}
+
+// benchmarkUDPRead sends udpBatchSize packets and reads them with the read function
+// which returns the number of packets it has read, the number of calls per packet is reported
+func benchmarkUDPRead(b *testing.B, read func(conn *net.UDPConn) int) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+
+	packet, _ := createTestMessage().Pack()
+	calls := 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < udpBatchSize; j++ {
+			_, _ = client.Write(packet)
+		}
+		for received := 0; received < udpBatchSize; calls++ {
+			received += read(conn)
+		}
+	}
+	b.ReportMetric(float64(calls)/float64(b.N*udpBatchSize), "syscalls/packet")
+}
+
+func BenchmarkUDPRead(b *testing.B) {
+	b.Run("single", func(b *testing.B) {
+		buf := make([]byte, dns.MaxMsgSize)
+		benchmarkUDPRead(b, func(conn *net.UDPConn) int {
+			if _, _, err := conn.ReadFrom(buf); err != nil {
+				b.Fatal(err)
+			}
+			return 1
+		})
+	})
+
+	b.Run("batch", func(b *testing.B) {
+		var bc udpBatchConn
+		ms := make([]ipv4.Message, udpBatchSize)
+		for i := range ms {
+			ms[i].Buffers = [][]byte{make([]byte, dns.MaxMsgSize)}
+		}
+		benchmarkUDPRead(b, func(conn *net.UDPConn) int {
+			if bc == nil {
+				bc = newUDPBatchConn(conn)
+			}
+			n, err := bc.ReadBatch(ms, 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			return n
+		})
+	})
+}
@@ -0,0 +1,11 @@
+// +build !linux
+
+package proxy
+
+import "net"
+
+// newUDPBatchConn returns nil: the batched I/O is only supported on Linux,
+// on the other platforms the datagrams are processed one by one
+func newUDPBatchConn(conn *net.UDPConn) udpBatchConn {
+	return nil
+}
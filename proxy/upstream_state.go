@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+)
+
+// defaultUpstreamCooldown is the default Config.UpstreamCooldown
+const defaultUpstreamCooldown = 30 * time.Second
+
+// upstreamRecovering is the status of the upstream that has answered after it was down
+// and isn't fully restored yet (see Config.UpstreamGradualRecovery)
+const upstreamRecovering = "recovering"
+
+// errAllUpstreamsDown is returned by exchange if all the upstreams are down, so the fallbacks are used at once
+var errAllUpstreamsDown = errors.New("all upstreams are down")
+
+// resultLocked returns the results of the upstream, the callers must hold p.health.lock
+func (p *Proxy) resultLocked(address string) *upstreamResult {
+	if p.health.results == nil {
+		p.health.results = map[string]*upstreamResult{}
+	}
+	r := p.health.results[address]
+	if r == nil {
+		r = &upstreamResult{}
+		p.health.results[address] = r
+	}
+	return r
+}
+
+// recordUpstreamState counts the consecutive failures and successes of the upstream
+// and marks it down or restores it (see Config.UpstreamFailureThreshold)
+func (p *Proxy) recordUpstreamState(u upstream.Upstream, err error) {
+	s := p.state()
+	threshold := s.UpstreamFailureThreshold
+	if threshold <= 0 {
+		return
+	}
+
+	p.health.lock.Lock()
+	defer p.health.lock.Unlock()
+
+	r := p.resultLocked(upstream.Name(u))
+	if err != nil {
+		r.failures++
+		r.successes = 0
+		switch {
+		case r.down || r.recovering:
+			// the probe has failed, the cooldown starts again
+			r.down, r.recovering = true, false
+			r.downSince = time.Now()
+		case r.failures >= threshold:
+			r.down = true
+			r.downSince = time.Now()
+			atomic.AddUint64(&p.counters.upstreamsMarkedDown, 1)
+			p.logger().Infof("Upstream %s is down after %d failures in a row: %s", upstream.Name(u), r.failures, err)
+		}
+		return
+	}
+
+	r.failures = 0
+	r.successes++
+	switch {
+	case r.down && s.UpstreamGradualRecovery:
+		r.down, r.recovering = false, true
+		r.successes = 1
+	case r.down || (r.recovering && r.successes >= threshold):
+		r.down, r.recovering = false, false
+		atomic.AddUint64(&p.counters.upstreamsRecovered, 1)
+		p.logger().Infof("Upstream %s is up again", upstream.Name(u))
+	}
+}
+
+// selectUpstreams returns the upstreams to try in the order of the preference, each group sorted by RTT:
+// the down and recovering ones whose cooldown has passed (a single query per cooldown probes them),
+// the ones that are up and the recovering ones.
+// The down upstreams within the cooldown are skipped unless all the upstreams are down and there are no fallbacks.
+func (p *Proxy) selectUpstreams(upstreams []upstream.Upstream, hasFallbacks bool) []upstream.Upstream {
+	s := p.state()
+	if s.UpstreamFailureThreshold <= 0 {
+		return p.getSortedUpstreams(upstreams)
+	}
+	cooldown := s.UpstreamCooldown
+	if cooldown <= 0 {
+		cooldown = defaultUpstreamCooldown
+	}
+
+	const (
+		rankProbe = iota
+		rankUp
+		rankRecovering
+		rankDown
+	)
+	ranks := make(map[string]int, len(upstreams))
+	now := time.Now()
+	p.health.lock.Lock()
+	for _, u := range upstreams {
+		r := p.health.results[upstream.Name(u)]
+		switch {
+		case r == nil || (!r.down && !r.recovering):
+			ranks[upstream.Name(u)] = rankUp
+		case now.Sub(r.downSince) >= cooldown:
+			ranks[upstream.Name(u)] = rankProbe
+			r.downSince = now
+		case r.recovering:
+			ranks[upstream.Name(u)] = rankRecovering
+		default:
+			ranks[upstream.Name(u)] = rankDown
+		}
+	}
+	p.health.lock.Unlock()
+
+	sorted := p.getSortedUpstreams(upstreams)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return ranks[upstream.Name(sorted[i])] < ranks[upstream.Name(sorted[j])]
+	})
+
+	n := len(sorted)
+	for n > 0 && ranks[upstream.Name(sorted[n-1])] == rankDown {
+		n--
+	}
+	if n == 0 && !hasFallbacks {
+		return sorted
+	}
+	return sorted[:n]
+}
+
+// upstreamState returns the state of the upstream with the results r:
+// upstreamUp, upstreamDown or upstreamRecovering (see Config.UpstreamFailureThreshold)
+func upstreamState(r *upstreamResult) string {
+	switch {
+	case r.down:
+		return upstreamDown
+	case r.recovering:
+		return upstreamRecovering
+	default:
+		return upstreamUp
+	}
+}
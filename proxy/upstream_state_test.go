@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// switchUpstream fails while failing is set and counts the exchanges
+type switchUpstream struct {
+	addr    string
+	failing int32
+	calls   int32
+}
+
+func (u *switchUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt32(&u.calls, 1)
+	if atomic.LoadInt32(&u.failing) != 0 {
+		return nil, errors.New("connection refused")
+	}
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	resp.Answer = append(resp.Answer, newRR("example.org. 60 IN A 1.2.3.4"))
+	return resp, nil
+}
+
+func (u *switchUpstream) Address() string { return u.addr }
+
+// endCooldown makes the cooldown of the upstream pass
+func endCooldown(p *Proxy, u upstream.Upstream) {
+	p.health.lock.Lock()
+	p.health.results[u.Address()].downSince = time.Now().Add(-time.Hour)
+	p.health.lock.Unlock()
+}
+
+func resolveTestQuery(t *testing.T, p *Proxy) {
+	d := &DNSContext{Proto: ProtoUDP, Req: createHostTestMessage("example.org"), Addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}}}
+	require.NoError(t, p.Resolve(d))
+}
+
+func TestUpstreamFailureThreshold(t *testing.T) {
+	primary := &switchUpstream{addr: "func://primary", failing: 1}
+	fallback := &switchUpstream{addr: "func://fallback"}
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{primary}
+	dnsProxy.Fallbacks = []upstream.Upstream{fallback}
+	dnsProxy.UpstreamFailureThreshold = 2
+
+	resolveTestQuery(t, dnsProxy)
+	assert.Zero(t, dnsProxy.Stats().UpstreamsMarkedDown)
+	resolveTestQuery(t, dnsProxy)
+	assert.Equal(t, uint64(1), dnsProxy.Stats().UpstreamsMarkedDown)
+	uh := dnsProxy.upstreamHealth(primary, time.Minute)
+	assert.Equal(t, "down", uh.State)
+	assert.Equal(t, 2, uh.ConsecutiveFailures)
+
+	// the down upstream isn't used within the cooldown
+	resolveTestQuery(t, dnsProxy)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&primary.calls))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&fallback.calls))
+
+	// the failed probe starts the cooldown again
+	endCooldown(dnsProxy, primary)
+	resolveTestQuery(t, dnsProxy)
+	resolveTestQuery(t, dnsProxy)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&primary.calls))
+
+	endCooldown(dnsProxy, primary)
+	atomic.StoreInt32(&primary.failing, 0)
+	resolveTestQuery(t, dnsProxy)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&primary.calls))
+	assert.Equal(t, int32(5), atomic.LoadInt32(&fallback.calls))
+	assert.Equal(t, uint64(1), dnsProxy.Stats().UpstreamsRecovered)
+	assert.Equal(t, "up", dnsProxy.upstreamHealth(primary, time.Minute).State)
+}
+
+func TestUpstreamGradualRecovery(t *testing.T) {
+	primary := &switchUpstream{addr: "func://primary", failing: 1}
+	secondary := &switchUpstream{addr: "func://secondary"}
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{primary, secondary}
+	dnsProxy.UpstreamFailureThreshold = 2
+	dnsProxy.UpstreamGradualRecovery = true
+
+	// without the fallbacks, the down upstreams are still tried if all of them are down
+	atomic.StoreInt32(&secondary.failing, 1)
+	for i := 0; i < 2; i++ {
+		d := &DNSContext{Proto: ProtoUDP, Req: createHostTestMessage("example.org"), Addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}}}
+		require.Error(t, dnsProxy.Resolve(d))
+	}
+	assert.Equal(t, uint64(2), dnsProxy.Stats().UpstreamsMarkedDown)
+	atomic.StoreInt32(&secondary.failing, 0)
+	resolveTestQuery(t, dnsProxy)
+	assert.Equal(t, "recovering", dnsProxy.upstreamHealth(secondary, time.Minute).State)
+
+	endCooldown(dnsProxy, primary)
+	atomic.StoreInt32(&primary.failing, 0)
+	resolveTestQuery(t, dnsProxy)
+	assert.Equal(t, "recovering", dnsProxy.upstreamHealth(primary, time.Minute).State)
+
+	// the recovering upstream is probed again after the cooldown
+	endCooldown(dnsProxy, secondary)
+	resolveTestQuery(t, dnsProxy)
+	assert.Equal(t, "up", dnsProxy.upstreamHealth(secondary, time.Minute).State)
+	assert.Equal(t, uint64(1), dnsProxy.Stats().UpstreamsRecovered)
+
+	// within the cooldown, the recovering upstream is tried after the ones that are up
+	sorted := dnsProxy.selectUpstreams(dnsProxy.Upstreams, false)
+	require.Len(t, sorted, 2)
+	assert.Equal(t, secondary.Address(), sorted[0].Address())
+	assert.Equal(t, primary.Address(), sorted[1].Address())
+}
+
+func TestUpstreamStateValidation(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamFailureThreshold = -1
+	assert.Error(t, dnsProxy.Start())
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+// UpstreamValidation defines how the upstream responses are checked before they are cached or returned
+type UpstreamValidation int
+
+const (
+	// UpstreamValidationDefault -- the response must have QR set, the ID, the opcode and the question
+	// of the request (the names are compared case-insensitively) and at most one OPT record.
+	UpstreamValidationDefault UpstreamValidation = iota
+
+	// UpstreamValidationStrict -- like UpstreamValidationDefault, but the case of the question name must match too.
+	UpstreamValidationStrict
+
+	// UpstreamValidationDisabled -- the responses aren't checked.
+	UpstreamValidationDisabled
+)
+
+// validateResponse checks that the response of the upstream is the response to the request.
+// strictCase is true if the case of the question name must match.
+func validateResponse(req, reply *dns.Msg, strictCase bool) error {
+	switch {
+	case reply == nil:
+		return errors.New("no response")
+	case !reply.Response:
+		return errors.New("QR bit isn't set")
+	case reply.Id != req.Id:
+		return fmt.Errorf("ID %d doesn't match the request ID %d", reply.Id, req.Id)
+	case reply.Opcode != req.Opcode:
+		return fmt.Errorf("opcode %s doesn't match the request", dns.OpcodeToString[reply.Opcode])
+	case len(reply.Question) != len(req.Question):
+		return fmt.Errorf("response has %d questions", len(reply.Question))
+	}
+
+	for i, q := range reply.Question {
+		reqQ := req.Question[i]
+		nameMatch := q.Name == reqQ.Name || (!strictCase && strings.EqualFold(q.Name, reqQ.Name))
+		if !nameMatch || q.Qtype != reqQ.Qtype || q.Qclass != reqQ.Qclass {
+			return fmt.Errorf("question %s %s %s doesn't match the request",
+				q.Name, dns.ClassToString[q.Qclass], dns.TypeToString[q.Qtype])
+		}
+	}
+
+	// the responses with several OPT records are malformed (RFC 6891, section 6.1.1)
+	opts := 0
+	for _, rr := range reply.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			opts++
+		}
+	}
+	if opts > 1 {
+		return fmt.Errorf("response has %d OPT records", opts)
+	}
+	return nil
+}
+
+// validateUpstreamResponse checks the response of the upstream according to Config.UpstreamValidation.
+// The rejected responses are counted per upstream (see UpstreamHealth.RejectedResponses).
+func (p *Proxy) validateUpstreamResponse(u upstream.Upstream, req, reply *dns.Msg) error {
+	s := p.state()
+	if s.UpstreamValidation == UpstreamValidationDisabled {
+		return nil
+	}
+
+	err := validateResponse(req, reply, s.UpstreamValidation == UpstreamValidationStrict)
+	if err == nil {
+		return nil
+	}
+
+	atomic.AddUint64(&p.counters.rejectedResponses, 1)
+	p.recordRejectedResponse(u)
+	if l := p.logger(); l.DebugEnabled() {
+		l.Debugf("Rejecting the response of %s: %s", upstream.Name(u), err)
+	}
+	return errorx.Decorate(err, "invalid response from %s", upstream.Name(u))
+}
+
+// exchangeValidated is exchangeWithUpstream that rejects the invalid responses (see validateUpstreamResponse).
+// The exchange is traced in its own span (see startUpstreamSpan) and counted in the state of the upstream
+// (see recordUpstreamState).
+func (p *Proxy) exchangeValidated(ctx context.Context, u upstream.Upstream, req *dns.Msg) (*dns.Msg, int, error) {
+	ctx, end := p.startUpstreamSpan(ctx, u, req)
+	reply, elapsed, err := exchangeWithUpstream(ctx, u, req, p.logger())
+	err = markTimeout(upstream.Name(u), err)
+	p.recordAttempt(ctx, upstream.Name(u), elapsed, err)
+	if err == nil {
+		err = p.validateUpstreamResponse(u, req, reply)
+		if err != nil {
+			reply = nil
+		}
+	}
+	p.recordUpstreamState(u, err)
+	end(reply, err)
+	return reply, elapsed, err
+}
+
+// exchangeParallel is upstream.ExchangeParallel that rejects the invalid responses and traces the exchanges
+// (see exchangeValidated)
+func (p *Proxy) exchangeParallel(ctx context.Context, upstreams []upstream.Upstream, req *dns.Msg) (*dns.Msg, upstream.Upstream, error) {
+	return upstream.ExchangeParallelFunc(upstreams, req, func(u upstream.Upstream, req *dns.Msg) (*dns.Msg, error) {
+		reply, _, err := p.exchangeValidated(ctx, u, req)
+		return reply, err
+	})
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateResponse(t *testing.T) {
+	req := createHostTestMessage("example.org")
+	valid := func() *dns.Msg {
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		return resp
+	}
+
+	testCases := []struct {
+		name       string
+		modify     func(resp *dns.Msg)
+		strictCase bool
+		valid      bool
+	}{
+		{name: "valid", modify: func(resp *dns.Msg) {}, valid: true},
+		{name: "no_qr", modify: func(resp *dns.Msg) { resp.Response = false }},
+		{name: "id", modify: func(resp *dns.Msg) { resp.Id++ }},
+		{name: "opcode", modify: func(resp *dns.Msg) { resp.Opcode = dns.OpcodeStatus }},
+		{name: "no_question", modify: func(resp *dns.Msg) { resp.Question = nil }},
+		{name: "other_name", modify: func(resp *dns.Msg) { resp.Question[0].Name = "example.net." }},
+		{name: "other_type", modify: func(resp *dns.Msg) { resp.Question[0].Qtype = dns.TypeAAAA }},
+		{name: "two_opts", modify: func(resp *dns.Msg) {
+			resp.SetEdns0(4096, false)
+			resp.Extra = append(resp.Extra, dns.Copy(resp.Extra[0]))
+		}},
+		{name: "case", modify: func(resp *dns.Msg) { resp.Question[0].Name = "EXAMPLE.org." }, valid: true},
+		{name: "case_strict", modify: func(resp *dns.Msg) { resp.Question[0].Name = "EXAMPLE.org." }, strictCase: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := valid()
+			tc.modify(resp)
+			err := validateResponse(req, resp, tc.strictCase)
+			if tc.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+	assert.Error(t, validateResponse(req, nil, false))
+}
+
+// namedUpstream is funcUpstream with its own address
+type namedUpstream struct {
+	*funcUpstream
+	addr string
+}
+
+func (u *namedUpstream) Address() string {
+	return u.addr
+}
+
+// validationTestUpstreams returns the upstream that sends the responses without QR and the upstream that answers
+func validationTestUpstreams() (broken, good upstream.Upstream) {
+	broken = &namedUpstream{addr: "func://broken", funcUpstream: &funcUpstream{exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+		resp := &dns.Msg{}
+		resp.SetReply(m)
+		resp.Response = false
+		return resp, nil
+	}}}
+	good = &namedUpstream{addr: "func://good", funcUpstream: &funcUpstream{exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+		resp := &dns.Msg{}
+		resp.SetReply(m)
+		resp.Answer = []dns.RR{newRR(m.Question[0].Name + " 60 IN A 1.2.3.4")}
+		return resp, nil
+	}}}
+	return broken, good
+}
+
+func TestUpstreamValidation(t *testing.T) {
+	for _, allServers := range []bool{false, true} {
+		broken, good := validationTestUpstreams()
+		dnsProxy := createTestProxy(t, nil)
+		dnsProxy.AllServers = allServers
+		dnsProxy.Upstreams = []upstream.Upstream{broken}
+		dnsProxy.Fallbacks = []upstream.Upstream{good}
+		require.NoError(t, dnsProxy.Start())
+
+		// the invalid response is rejected and the fallback answers
+		d := &DNSContext{Proto: ProtoUDP, Req: createHostTestMessage("example.org"), Addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}}}
+		require.NoError(t, dnsProxy.Resolve(d))
+		require.NotNil(t, d.Res)
+		assert.Len(t, d.Res.Answer, 1)
+		assert.Equal(t, uint64(1), dnsProxy.Stats().RejectedResponses)
+		assert.Equal(t, uint64(1), dnsProxy.upstreamHealth(broken, time.Minute).RejectedResponses)
+		assert.Zero(t, dnsProxy.upstreamHealth(good, time.Minute).RejectedResponses)
+		require.NoError(t, dnsProxy.Stop())
+	}
+}
+
+func TestUpstreamValidationCase(t *testing.T) {
+	// the upstream rewrites the case of the name
+	u := &funcUpstream{exchangeFunc: func(m *dns.Msg) (*dns.Msg, error) {
+		resp := &dns.Msg{}
+		resp.SetReply(m)
+		resp.Question[0].Name = strings.ToUpper(resp.Question[0].Name)
+		return resp, nil
+	}}
+
+	for _, v := range []UpstreamValidation{UpstreamValidationDefault, UpstreamValidationStrict, UpstreamValidationDisabled} {
+		dnsProxy := createTestProxy(t, nil)
+		dnsProxy.UpstreamValidation = v
+		dnsProxy.Upstreams = []upstream.Upstream{u}
+		require.NoError(t, dnsProxy.Start())
+
+		d := &DNSContext{Proto: ProtoUDP, Req: createHostTestMessage("example.org"), Addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}}}
+		err := dnsProxy.Resolve(d)
+		if v == UpstreamValidationStrict {
+			assert.Error(t, err)
+			assert.Equal(t, uint64(1), dnsProxy.Stats().RejectedResponses)
+		} else {
+			assert.NoError(t, err)
+			assert.Zero(t, dnsProxy.Stats().RejectedResponses)
+		}
+		require.NoError(t, dnsProxy.Stop())
+	}
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/joomcode/errorx"
+)
+
+// ReadUpstreamsFile reads the upstreams file: an upstream per line in the ParseUpstreamsConfig syntax
+// (including the [/domain/] prefixes). The empty lines and the lines starting with # are ignored.
+// It returns the entries to be passed to ParseUpstreamsConfig, or the error listing all the invalid lines.
+func ReadUpstreamsFile(path string, bootstrapDNS []string, timeout time.Duration) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't open the upstreams file")
+	}
+	defer f.Close()
+
+	opts := upstream.Options{Bootstrap: bootstrapDNS, Timeout: timeout}
+	var entries []string
+	var errs []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := validateUpstreamEntry(line, opts); err != nil {
+			errs = append(errs, fmt.Sprintf("line %d: %s", n, err))
+			continue
+		}
+		entries = append(entries, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errorx.Decorate(err, "couldn't read the upstreams file %s", path)
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid upstreams file %s: %s", path, strings.Join(errs, "; "))
+	}
+	return entries, nil
+}
+
+// validateUpstreamEntry checks that the upstreams config entry can be parsed
+func validateUpstreamEntry(entry string, opts upstream.Options) error {
+	hosts, address, err := splitUpstreamEntry(entry)
+	if err != nil {
+		return err
+	}
+	if address == "#" && len(hosts) > 0 {
+		return nil
+	}
+	_, err = upstream.AddressToNamedUpstream(address, opts)
+	return err
+}
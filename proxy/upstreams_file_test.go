@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeUpstreamsFile writes the upstreams file to the directory
+func writeUpstreamsFile(t *testing.T, dir, content string) string {
+	path := filepath.Join(dir, "upstreams.txt")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestReadUpstreamsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy-upstreams")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := writeUpstreamsFile(t, dir, `# the default upstreams
+8.8.8.8:53
+
+tls://1.1.1.1
+  [/example.org/]1.2.3.4:53
+[/internal.example.org/]#
+`)
+	entries, err := ReadUpstreamsFile(path, nil, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"8.8.8.8:53", "tls://1.1.1.1", "[/example.org/]1.2.3.4:53", "[/internal.example.org/]#"}, entries)
+
+	config, err := ParseUpstreamsConfig(entries, nil, time.Second)
+	assert.Nil(t, err)
+	assert.Len(t, config.Upstreams, 2)
+	assert.Len(t, config.DomainReservedUpstreams["example.org."], 1)
+	assert.Nil(t, config.DomainReservedUpstreams["internal.example.org."])
+}
+
+func TestReadUpstreamsFileErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy-upstreams")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := writeUpstreamsFile(t, dir, `8.8.8.8:53
+# comment
+[/example.org/1.2.3.4
+sdns://invalid
+`)
+	_, err = ReadUpstreamsFile(path, nil, time.Second)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "line 3:")
+	assert.Contains(t, err.Error(), "line 4:")
+	assert.NotContains(t, err.Error(), "line 1:")
+
+	_, err = ReadUpstreamsFile(filepath.Join(dir, "missing.txt"), nil, time.Second)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,39 @@
+package proxyutil
+
+import "github.com/AdguardTeam/golibs/log"
+
+// Logger is the logger of the proxy and the upstreams (see proxy.Config.Logger and upstream.Options.Logger).
+// The messages are formatted like fmt.Sprintf. On the hot paths, DebugEnabled is checked
+// before the arguments of Debugf are built, so the debug messages cost nothing when they are disabled.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+
+	// DebugEnabled returns true if the debug messages are written
+	DebugEnabled() bool
+}
+
+// defaultLogger writes the messages with github.com/AdguardTeam/golibs/log.
+// It has no warning level, so the warnings are written as the info messages.
+type defaultLogger struct{}
+
+func (defaultLogger) Debugf(format string, args ...interface{}) { log.Debug(format, args...) }
+func (defaultLogger) Infof(format string, args ...interface{})  { log.Info(format, args...) }
+func (defaultLogger) Warnf(format string, args ...interface{})  { log.Info(format, args...) }
+func (defaultLogger) Errorf(format string, args ...interface{}) { log.Error(format, args...) }
+func (defaultLogger) DebugEnabled() bool                        { return log.GetLevel() >= log.DEBUG }
+
+// DefaultLogger returns the logger that writes the messages with github.com/AdguardTeam/golibs/log
+func DefaultLogger() Logger {
+	return defaultLogger{}
+}
+
+// LoggerOrDefault returns l or DefaultLogger() if l is nil
+func LoggerOrDefault(l Logger) Logger {
+	if l == nil {
+		return defaultLogger{}
+	}
+	return l
+}
@@ -0,0 +1,55 @@
+package proxyutil
+
+import "context"
+
+// Attribute is a key-value attribute of a tracing span, e.g. the name of the query
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Span is a tracing span started by Tracer
+type Span interface {
+	// SetAttributes adds the attributes to the span
+	SetAttributes(attrs ...Attribute)
+
+	// RecordError marks the span as failed with err
+	RecordError(err error)
+
+	// End finishes the span, it's called once
+	End()
+}
+
+// Tracer starts the tracing spans of the proxy (see proxy.Config.Tracer).
+// The proxy doesn't depend on a tracing library, Tracer is a thin wrapper of e.g. the OpenTelemetry tracer:
+// the new span is the child of the span in ctx (if any) and the returned context contains the new span.
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// noopTracer starts the spans that record nothing
+type noopTracer struct{}
+
+// noopSpan records nothing
+type noopSpan struct{}
+
+func (noopTracer) Start(ctx context.Context, _ string, _ ...Attribute) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+func (noopSpan) SetAttributes(...Attribute) {}
+func (noopSpan) RecordError(error)          {}
+func (noopSpan) End()                       {}
+
+// NoopTracer returns the tracer that records nothing
+func NoopTracer() Tracer {
+	return noopTracer{}
+}
+
+// TracerOrNoop returns t or NoopTracer() if t is nil
+func TracerOrNoop(t Tracer) Tracer {
+	if t == nil {
+		return noopTracer{}
+	}
+	return t
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// resolveCommand is the command that resolves a name and exits, e.g. dnsproxy resolve example.org AAAA
+const resolveCommand = "resolve"
+
+// parseResolveArgs parses the arguments of the resolve command: the name and the optional record type (A by default)
+func parseResolveArgs(args []string) (name string, qtype uint16, err error) {
+	if len(args) == 0 || len(args) > 2 {
+		return "", 0, fmt.Errorf("usage: dnsproxy %s <name> [type] [options]", resolveCommand)
+	}
+
+	qtype = dns.TypeA
+	if len(args) == 2 {
+		t, ok := dns.StringToType[strings.ToUpper(args[1])]
+		if !ok {
+			return "", 0, fmt.Errorf("unknown record type %s", args[1])
+		}
+		qtype = t
+	}
+	return dns.Fqdn(args[0]), qtype, nil
+}
+
+// newResolveRequest creates the request of the resolve command
+func newResolveRequest(name string, qtype uint16) *dns.Msg {
+	req := &dns.Msg{}
+	req.Id = dns.Id()
+	req.RecursionDesired = true
+	req.Question = []dns.Question{{Name: name, Qtype: qtype, Qclass: dns.ClassINET}}
+	return req
+}
+
+// resolve resolves the name through the proxy with the config (the cache, the static entries, the per-domain upstreams,
+// the fallbacks and ECS) as if the query came from the client IP (may be nil) and writes the response,
+// the upstream that has answered and the time to w. Returns false if the name couldn't be resolved.
+func resolve(config proxy.Config, name string, qtype uint16, client net.IP, w io.Writer) bool {
+	p := &proxy.Proxy{Config: config}
+	p.Init()
+
+	d := &proxy.DNSContext{
+		Proto:     proxy.ProtoUDP,
+		Req:       newResolveRequest(name, qtype),
+		StartTime: time.Now(),
+	}
+	if client != nil {
+		d.Addr = &net.UDPAddr{IP: client}
+	}
+	err := p.Resolve(d)
+	elapsed := time.Since(d.StartTime)
+
+	if d.Res != nil {
+		_, _ = fmt.Fprintln(w, d.Res)
+	}
+	if d.Upstream != nil {
+		_, _ = fmt.Fprintf(w, ";; Upstream: %s\n", upstream.Name(d.Upstream))
+	} else if err == nil {
+		_, _ = fmt.Fprintln(w, ";; Answered locally (cache, static entries or mDNS)")
+	}
+	_, _ = fmt.Fprintf(w, ";; Query time: %d msec\n", elapsed/time.Millisecond)
+	if err != nil {
+		_, _ = fmt.Fprintf(w, ";; Error: %s\n", err)
+		return false
+	}
+	return true
+}
+
+// upstreamAnswer is the response of an upstream to the resolve --all query
+type upstreamAnswer struct {
+	resp    *dns.Msg
+	latency time.Duration
+	err     error
+}
+
+// resolveAll sends the query to every upstream of the config and writes the table to compare the responses to w.
+// Returns false if none of the upstreams has answered.
+func resolveAll(config proxy.Config, name string, qtype uint16, w io.Writer) bool {
+	groups := upstreamGroups(config)
+	answers := make([][]upstreamAnswer, len(groups))
+	var wg sync.WaitGroup
+	for i, g := range groups {
+		answers[i] = make([]upstreamAnswer, len(g.upstreams))
+		for j, u := range g.upstreams {
+			wg.Add(1)
+			go func(a *upstreamAnswer, u upstream.Upstream) {
+				defer wg.Done()
+				start := time.Now()
+				a.resp, a.err = u.Exchange(newResolveRequest(name, qtype))
+				a.latency = time.Since(start)
+			}(&answers[i][j], u)
+		}
+	}
+	wg.Wait()
+
+	ok := false
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "GROUP\tUPSTREAM\tRCODE\tANSWER\tLATENCY")
+	for i, g := range groups {
+		for j, u := range g.upstreams {
+			a := answers[i][j]
+			if a.err != nil {
+				_, _ = fmt.Fprintf(tw, "%s\t%s\tFAIL: %s\t-\t-\n", g.name, upstream.Name(u), a.err)
+				continue
+			}
+			ok = true
+			_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", g.name, upstream.Name(u), dns.RcodeToString[a.resp.Rcode],
+				answerData(a.resp), a.latency.Round(time.Millisecond))
+		}
+	}
+	_ = tw.Flush()
+	return ok
+}
+
+// answerData returns the data of the answer records of the response separated with spaces ("-" if there are none)
+func answerData(resp *dns.Msg) string {
+	if len(resp.Answer) == 0 {
+		return "-"
+	}
+	data := make([]string, 0, len(resp.Answer))
+	for _, rr := range resp.Answer {
+		rdata := strings.TrimPrefix(rr.String(), rr.Header().String())
+		data = append(data, strings.TrimSpace(strings.Replace(rdata, "\t", " ", -1)))
+	}
+	return strings.Join(data, " ")
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// resolveTestUpstream answers the A queries with the IP address
+type resolveTestUpstream struct {
+	address string
+	ip      net.IP
+}
+
+func (u *resolveTestUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	if m.Question[0].Qtype == dns.TypeA {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   u.ip,
+		})
+	}
+	return resp, nil
+}
+
+func (u *resolveTestUpstream) Address() string {
+	return u.address
+}
+
+func TestParseResolveArgs(t *testing.T) {
+	name, qtype, err := parseResolveArgs([]string{"example.org"})
+	assert.Nil(t, err)
+	assert.Equal(t, "example.org.", name)
+	assert.Equal(t, dns.TypeA, qtype)
+
+	_, qtype, err = parseResolveArgs([]string{"example.org", "aaaa"})
+	assert.Nil(t, err)
+	assert.Equal(t, dns.TypeAAAA, qtype)
+
+	_, _, err = parseResolveArgs([]string{"example.org", "BAD"})
+	assert.EqualError(t, err, "unknown record type BAD")
+	_, _, err = parseResolveArgs(nil)
+	assert.Error(t, err)
+	_, _, err = parseResolveArgs([]string{"example.org", "A", "extra"})
+	assert.Error(t, err)
+}
+
+func TestResolve(t *testing.T) {
+	config := proxy.Config{
+		Upstreams: []upstream.Upstream{&resolveTestUpstream{address: "default.example", ip: net.IP{1, 2, 3, 4}}},
+		DomainsReservedUpstreams: map[string][]upstream.Upstream{
+			"example.org.": {&resolveTestUpstream{address: "domain.example", ip: net.IP{5, 6, 7, 8}}},
+		},
+		StaticEntries: map[string][]net.IP{"printer.lan": {{192, 168, 1, 50}}},
+	}
+
+	// the per-domain upstream is used
+	out := &bytes.Buffer{}
+	assert.True(t, resolve(config, "www.example.org.", dns.TypeA, nil, out))
+	assert.Contains(t, out.String(), "5.6.7.8")
+	assert.Contains(t, out.String(), ";; Upstream: domain.example\n")
+	assert.Regexp(t, `;; Query time: \d+ msec`, out.String())
+
+	// the static entries are answered locally
+	out.Reset()
+	assert.True(t, resolve(config, "printer.lan.", dns.TypeA, nil, out))
+	assert.Contains(t, out.String(), "192.168.1.50")
+	assert.Contains(t, out.String(), ";; Answered locally")
+
+	// the upstream fails
+	config.Upstreams = []upstream.Upstream{&testModeUpstream{address: "failed.example", err: errors.New("timeout")}}
+	out.Reset()
+	assert.False(t, resolve(config, "example.com.", dns.TypeA, nil, out))
+	assert.Contains(t, out.String(), "SERVFAIL")
+	assert.Contains(t, out.String(), ";; Error: ")
+}
+
+func TestResolveAll(t *testing.T) {
+	config := proxy.Config{
+		Upstreams: []upstream.Upstream{
+			&resolveTestUpstream{address: "good.example", ip: net.IP{1, 2, 3, 4}},
+			&resolveTestUpstream{address: "poisoned.example", ip: net.IP{6, 6, 6, 6}},
+			&testModeUpstream{address: "failed.example", err: errors.New("timeout")},
+		},
+		Fallbacks: []upstream.Upstream{&testModeUpstream{address: "nxdomain.example", rcode: dns.RcodeNameError}},
+	}
+
+	out := &bytes.Buffer{}
+	assert.True(t, resolveAll(config, "example.org.", dns.TypeA, out))
+	assert.Regexp(t, `default\s+good\.example\s+NOERROR\s+1\.2\.3\.4\s+`, out.String())
+	assert.Regexp(t, `default\s+poisoned\.example\s+NOERROR\s+6\.6\.6\.6\s+`, out.String())
+	assert.Regexp(t, `default\s+failed\.example\s+FAIL: timeout\s+-\s+-`, out.String())
+	assert.Regexp(t, `fallback\s+nxdomain\.example\s+NXDOMAIN\s+-\s+`, out.String())
+
+	config.Upstreams = config.Upstreams[2:]
+	config.Fallbacks = nil
+	assert.False(t, resolveAll(config, "example.org.", dns.TypeA, &bytes.Buffer{}))
+}
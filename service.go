@@ -0,0 +1,38 @@
+package main
+
+import "strings"
+
+// The --service actions
+const (
+	serviceInstall   = "install"
+	serviceUninstall = "uninstall"
+	serviceStart     = "start"
+	serviceStop      = "stop"
+	serviceRun       = "run"
+)
+
+// The Windows service settings
+const (
+	serviceName        = "dnsproxy"
+	serviceDisplayName = "dnsproxy"
+	serviceDescription = "Simple DNS proxy with DoH, DoT and DNSCrypt support"
+)
+
+// serviceArgs returns the arguments the service is started with: the command-line arguments
+// with the --service action replaced by --service=run
+func serviceArgs(args []string) []string {
+	res := make([]string, 0, len(args)+1)
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--service" {
+			// skip the action too
+			i++
+			continue
+		}
+		if strings.HasPrefix(a, "--service=") {
+			continue
+		}
+		res = append(res, a)
+	}
+	return append(res, "--service="+serviceRun)
+}
@@ -0,0 +1,13 @@
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// handleServiceCommand returns an error, the services are only supported on Windows
+func handleServiceCommand(options Options, _ []string) error {
+	return fmt.Errorf("--service %s: the services are not supported on %s, use the init system", options.Service, runtime.GOOS)
+}
@@ -0,0 +1,15 @@
+// +build !windows
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleServiceCommand(t *testing.T) {
+	err := handleServiceCommand(Options{Service: serviceInstall}, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not supported")
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceArgs(t *testing.T) {
+	args := serviceArgs([]string{"-u", "8.8.8.8", "--service", "install", "--config-path=C:\\dnsproxy.yaml"})
+	assert.Equal(t, []string{"-u", "8.8.8.8", "--config-path=C:\\dnsproxy.yaml", "--service=run"}, args)
+
+	args = serviceArgs([]string{"--service=install", "-u", "8.8.8.8"})
+	assert.Equal(t, []string{"-u", "8.8.8.8", "--service=run"}, args)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/version"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceStopTimeout is how long --service stop waits for the service to stop
+const serviceStopTimeout = 10 * time.Second
+
+// handleServiceCommand performs the --service action using the service control manager.
+// The service is installed with the other command-line arguments (see serviceArgs).
+func handleServiceCommand(options Options, args []string) error {
+	switch options.Service {
+	case serviceInstall:
+		err := checkUpstreams(options)
+		if err != nil {
+			return err
+		}
+		_, err = createProxyConfig(options)
+		if err != nil {
+			return fmt.Errorf("invalid configuration: %s", err)
+		}
+		return installService(serviceArgs(args))
+	case serviceUninstall:
+		return uninstallService()
+	case serviceStart:
+		return controlService(func(s *mgr.Service) error { return s.Start() })
+	case serviceStop:
+		return controlService(stopService)
+	case serviceRun:
+		err := checkUpstreams(options)
+		if err != nil {
+			return err
+		}
+		return runService(options)
+	}
+	return fmt.Errorf("unknown --service action %q: use install, uninstall, start, stop or run", options.Service)
+}
+
+// installService creates the automatically started service and the event log source
+func installService(args []string) error {
+	exePath, err := os.Executable()
+	if err != nil {
+		return errorx.Decorate(err, "couldn't find the executable")
+	}
+	exePath, err = filepath.Abs(exePath)
+	if err != nil {
+		return errorx.Decorate(err, "couldn't find the executable")
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return errorx.Decorate(err, "couldn't connect to the service control manager")
+	}
+	defer m.Disconnect() //nolint
+
+	config := mgr.Config{
+		DisplayName: serviceDisplayName,
+		Description: serviceDescription,
+		StartType:   mgr.StartAutomatic,
+	}
+	s, err := m.CreateService(serviceName, exePath, config, args...)
+	if err != nil {
+		return errorx.Decorate(err, "couldn't install the service")
+	}
+	defer s.Close() //nolint
+
+	err = eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Info)
+	if err != nil {
+		_ = s.Delete()
+		return errorx.Decorate(err, "couldn't install the event log source")
+	}
+	fmt.Printf("The %s service is installed\n", serviceName)
+	return nil
+}
+
+// uninstallService removes the service and the event log source
+func uninstallService() error {
+	err := controlService(func(s *mgr.Service) error { return s.Delete() })
+	if err != nil {
+		return err
+	}
+	err = eventlog.Remove(serviceName)
+	if err != nil {
+		return errorx.Decorate(err, "couldn't remove the event log source")
+	}
+	fmt.Printf("The %s service is uninstalled\n", serviceName)
+	return nil
+}
+
+// controlService opens the service and calls f for it
+func controlService(f func(s *mgr.Service) error) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return errorx.Decorate(err, "couldn't connect to the service control manager")
+	}
+	defer m.Disconnect() //nolint
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return errorx.Decorate(err, "couldn't open the %s service", serviceName)
+	}
+	defer s.Close() //nolint
+	return f(s)
+}
+
+// stopService sends the stop request to the service and waits for it to stop
+func stopService(s *mgr.Service) error {
+	status, err := s.Control(svc.Stop)
+	if err != nil {
+		return errorx.Decorate(err, "couldn't stop the service")
+	}
+
+	deadline := time.Now().Add(serviceStopTimeout)
+	for status.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("the service didn't stop in %s", serviceStopTimeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+		status, err = s.Query()
+		if err != nil {
+			return errorx.Decorate(err, "couldn't query the service status")
+		}
+	}
+	return nil
+}
+
+// runService runs the proxy as the service, the logs are written to the event log unless --output is set
+func runService(options Options) error {
+	if options.LogOutput == "" {
+		elog, err := eventlog.Open(serviceName)
+		if err != nil {
+			return errorx.Decorate(err, "couldn't open the event log")
+		}
+		defer elog.Close() //nolint
+		log.SetOutput(&backendWriter{backend: &eventLogBackend{elog: elog}})
+	}
+
+	log.Printf("Starting the DNS proxy service, %s", version.Full())
+	return svc.Run(serviceName, &service{options: options})
+}
+
+// service handles the requests of the service control manager
+type service struct {
+	options Options
+}
+
+// Execute implements the svc.Handler interface for service.
+// The stop and shutdown requests stop the proxy after the queries in progress are processed.
+func (s *service) Execute(_ []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		run(s.options, stop)
+		close(done)
+	}()
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				changes <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				close(stop)
+				<-done
+				return false, 0
+			}
+		case <-done:
+			return false, 0
+		}
+	}
+}
+
+// eventLogBackend writes the log messages to the Windows event log
+type eventLogBackend struct {
+	elog *eventlog.Log
+}
+
+// writeMessage implements the logBackend interface for eventLogBackend.
+// The errors are written as the error events, the other messages as the information events.
+func (b *eventLogBackend) writeMessage(level, msg string) error {
+	if level == levelError || level == levelFatal {
+		return b.elog.Error(1, msg)
+	}
+	return b.elog.Info(1, msg)
+}
@@ -0,0 +1,17 @@
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// reopenSignals are the signals that make the proxy reopen the log file (for logrotate)
+var reopenSignals = []os.Signal{syscall.SIGUSR1} // nolint:gochecknoglobals
+
+// processExists returns true if the process with the PID is running
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
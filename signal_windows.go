@@ -0,0 +1,16 @@
+package main
+
+import "os"
+
+// reopenSignals are the signals that make the proxy reopen the log file, there is no such signal on Windows
+var reopenSignals []os.Signal // nolint:gochecknoglobals
+
+// processExists returns true if the process with the PID is running
+func processExists(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	_ = p.Release()
+	return true
+}
@@ -0,0 +1,69 @@
+// +build !windows,!plan9
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+)
+
+// syslogFacilities are the names of the syslog facilities
+var syslogFacilities = map[string]syslog.Priority{ // nolint:gochecknoglobals
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// newSyslogOutput connects to the local syslog (journald reads it too)
+func newSyslogOutput(facility, tag string) (io.Writer, error) {
+	return dialSyslog("", "", facility, tag)
+}
+
+// dialSyslog connects to the syslog server at raddr (the local syslog if network is empty)
+func dialSyslog(network, raddr, facility, tag string) (io.Writer, error) {
+	p, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+	w, err := syslog.Dial(network, raddr, p|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &backendWriter{backend: &syslogBackend{w: w}}, nil
+}
+
+// syslogBackend writes the log messages to syslog with the severity of their level
+type syslogBackend struct {
+	w *syslog.Writer
+}
+
+// writeMessage implements the logBackend interface for syslogBackend
+func (b *syslogBackend) writeMessage(level, msg string) error {
+	switch level {
+	case levelDebug:
+		return b.w.Debug(msg)
+	case levelError:
+		return b.w.Err(msg)
+	case levelFatal:
+		return b.w.Crit(msg)
+	}
+	return b.w.Info(msg)
+}
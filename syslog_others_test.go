@@ -0,0 +1,58 @@
+// +build !windows,!plan9
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyslogOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy-syslog")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "log.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	w, err := dialSyslog("unixgram", path, "local0", "dnsproxy")
+	require.NoError(t, err)
+
+	// <PRI> is facility*8+severity, local0 is 16
+	testCases := []struct {
+		line string
+		pri  string
+		msg  string
+	}{
+		{"2019/10/14 05:12:25 [info] Starting the DNS proxy\n", "<134>", "Starting the DNS proxy"},
+		{"2019/10/14 05:12:25 [debug] query\n", "<135>", "query"},
+		{"2019/10/14 05:12:25 [error] cannot resolve\n", "<131>", "cannot resolve"},
+		{"2019/10/14 05:12:25 [fatal] cannot start\n", "<130>", "cannot start"},
+	}
+	buf := make([]byte, 1024)
+	for _, tc := range testCases {
+		_, err = w.Write([]byte(tc.line))
+		require.NoError(t, err)
+
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+		msg := string(buf[:n])
+		assert.True(t, strings.HasPrefix(msg, tc.pri), msg)
+		assert.Contains(t, msg, "dnsproxy[")
+		assert.True(t, strings.HasSuffix(strings.TrimSpace(msg), tc.msg), msg)
+	}
+
+	_, err = dialSyslog("unixgram", path, "unknown", "dnsproxy")
+	assert.Error(t, err)
+}
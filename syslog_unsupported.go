@@ -0,0 +1,14 @@
+// +build windows plan9
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+)
+
+// newSyslogOutput returns an error, there is no syslog on this platform
+func newSyslogOutput(_, _ string) (io.Writer, error) {
+	return nil, fmt.Errorf("syslog is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// upstreamGroup is a set of upstreams used for the same queries, at least one of them must work
+type upstreamGroup struct {
+	name      string // "default", "fallback" or "[/domain/]"
+	upstreams []upstream.Upstream
+}
+
+// upstreamTestResult is the result of resolving the test domain through an upstream
+type upstreamTestResult struct {
+	latency time.Duration
+	err     error
+}
+
+// upstreamGroups returns the groups of the upstreams of the config: the default upstreams,
+// the upstreams of each reserved domain and the fallbacks
+func upstreamGroups(config proxy.Config) []upstreamGroup {
+	groups := []upstreamGroup{{name: "default", upstreams: config.Upstreams}}
+
+	hosts := make([]string, 0, len(config.DomainsReservedUpstreams))
+	for host, ups := range config.DomainsReservedUpstreams {
+		// the domains excluded with # use the default upstreams
+		if len(ups) > 0 {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		name := strings.TrimSuffix(host, ".")
+		if host == proxy.UnqualifiedNames {
+			name = ""
+		}
+		groups = append(groups, upstreamGroup{name: "[/" + name + "/]", upstreams: config.DomainsReservedUpstreams[host]})
+	}
+
+	if len(config.Fallbacks) > 0 {
+		groups = append(groups, upstreamGroup{name: "fallback", upstreams: config.Fallbacks})
+	}
+	return groups
+}
+
+// testUpstreams resolves the domain through every upstream of the config and writes the results table to w.
+// Returns true if at least one upstream of every group works (all the upstreams if strict is true).
+func testUpstreams(config proxy.Config, domain string, strict bool, w io.Writer) bool {
+	groups := upstreamGroups(config)
+	results := make([][]upstreamTestResult, len(groups))
+	var wg sync.WaitGroup
+	for i, g := range groups {
+		results[i] = make([]upstreamTestResult, len(g.upstreams))
+		for j, u := range g.upstreams {
+			wg.Add(1)
+			go func(r *upstreamTestResult, u upstream.Upstream) {
+				defer wg.Done()
+				r.latency, r.err = testUpstream(u, domain)
+			}(&results[i][j], u)
+		}
+	}
+	wg.Wait()
+
+	ok := true
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "GROUP\tUPSTREAM\tRESULT\tLATENCY")
+	for i, g := range groups {
+		passed := 0
+		for j, u := range g.upstreams {
+			r := results[i][j]
+			if r.err != nil {
+				_, _ = fmt.Fprintf(tw, "%s\t%s\tFAIL: %s\t-\n", g.name, upstream.Name(u), r.err)
+				continue
+			}
+			passed++
+			_, _ = fmt.Fprintf(tw, "%s\t%s\tOK\t%s\n", g.name, upstream.Name(u), r.latency.Round(time.Millisecond))
+		}
+		if passed == 0 || (strict && passed < len(g.upstreams)) {
+			ok = false
+		}
+	}
+	_ = tw.Flush()
+	return ok
+}
+
+// testUpstream resolves the A records of the domain through the upstream and returns the time it took.
+// NXDOMAIN is a valid response, the other response codes (e.g. SERVFAIL) are errors.
+func testUpstream(u upstream.Upstream, domain string) (time.Duration, error) {
+	req := &dns.Msg{}
+	req.Id = dns.Id()
+	req.RecursionDesired = true
+	req.Question = []dns.Question{{Name: dns.Fqdn(domain), Qtype: dns.TypeA, Qclass: dns.ClassINET}}
+
+	start := time.Now()
+	resp, err := u.Exchange(req)
+	elapsed := time.Since(start)
+	if err != nil {
+		return 0, err
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return 0, fmt.Errorf("response code %s", dns.RcodeToString[resp.Rcode])
+	}
+	return elapsed, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testModeUpstream responds with rcode or fails if err is set
+type testModeUpstream struct {
+	address string
+	rcode   int
+	err     error
+}
+
+func (u *testModeUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	if u.err != nil {
+		return nil, u.err
+	}
+	resp := &dns.Msg{}
+	resp.SetRcode(m, u.rcode)
+	return resp, nil
+}
+
+func (u *testModeUpstream) Address() string {
+	return u.address
+}
+
+func TestTestUpstreams(t *testing.T) {
+	ok := &testModeUpstream{address: "ok.example"}
+	nxdomain := &testModeUpstream{address: "nxdomain.example", rcode: dns.RcodeNameError}
+	servfail := &testModeUpstream{address: "servfail.example", rcode: dns.RcodeServerFailure}
+	failed := &testModeUpstream{address: "failed.example", err: errors.New("timeout")}
+
+	config := proxy.Config{
+		Upstreams: []upstream.Upstream{ok, failed},
+		DomainsReservedUpstreams: map[string][]upstream.Upstream{
+			"example.org.":          {nxdomain},
+			"internal.example.org.": nil,
+		},
+		Fallbacks: []upstream.Upstream{servfail, ok},
+	}
+	out := &bytes.Buffer{}
+	assert.True(t, testUpstreams(config, "example.org", false, out))
+	assert.Regexp(t, `default\s+failed\.example\s+FAIL: timeout\s+-`, out.String())
+	assert.Regexp(t, `\[/example\.org/\]\s+nxdomain\.example\s+OK\s+0s`, out.String())
+	assert.Regexp(t, `fallback\s+servfail\.example\s+FAIL: response code SERVFAIL`, out.String())
+	assert.NotContains(t, out.String(), "internal.example.org")
+
+	// all the upstreams must work in the strict mode
+	assert.False(t, testUpstreams(config, "example.org", true, &bytes.Buffer{}))
+
+	// a group without working upstreams
+	config.DomainsReservedUpstreams["example.org."] = []upstream.Upstream{failed}
+	assert.False(t, testUpstreams(config, "example.org", false, &bytes.Buffer{}))
+}
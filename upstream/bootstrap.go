@@ -12,8 +12,6 @@ import (
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/proxyutil"
-
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/joomcode/errorx"
 	"github.com/miekg/dns"
 )
@@ -24,10 +22,14 @@ import (
 var RootCAs *x509.CertPool
 
 type bootstrapper struct {
-	address        string        // in form of "tls://one.one.one.one:853"
-	resolvers      []*Resolver   // list of Resolvers to use to resolve hostname, if necessary
-	timeout        time.Duration // resolution duration (shared with the upstream) (0 == infinite timeout)
-	dialContext    dialHandler   // specifies the dial function for creating unencrypted TCP connections.
+	address        string           // in form of "tls://one.one.one.one:853"
+	resolvers      []*Resolver      // list of Resolvers to use to resolve hostname, if necessary
+	timeout        time.Duration    // resolution duration (shared with the upstream) (0 == infinite timeout)
+	keepAlive      time.Duration    // TCP keep-alive period of the connections (see Options.KeepAlive)
+	log            proxyutil.Logger // see Options.Logger
+	dialContext    dialHandler      // specifies the dial function for creating unencrypted TCP connections.
+	hashes         [][]byte         // see Options.CertificateHashes
+	family         AddressFamily    // see Options.AddressFamily
 	resolvedConfig *tls.Config
 	sync.RWMutex
 }
@@ -37,12 +39,14 @@ type Resolver struct {
 	resolver        *net.Resolver // net.Resolver
 	resolverAddress string        // Resolver's address
 	upstream        Upstream
+	log             proxyutil.Logger
+	err             error // the reason the resolver can't be used, returned by LookupIPAddr
 }
 
 // toBootResolved creates a new bootstrapper that already contains resolved config.
 // This can be done only in the case when we already know the resolver IP address.
 // timeout is also used for establishing TCP connections
-func toBootResolved(address string, serverIP net.IP, timeout time.Duration) (*bootstrapper, error) {
+func toBootResolved(address string, serverIP net.IP, timeout, keepAlive time.Duration, l proxyutil.Logger) (*bootstrapper, error) {
 	// get a host without port
 	host, port, err := getAddressHostPort(address)
 	if err != nil {
@@ -54,9 +58,11 @@ func toBootResolved(address string, serverIP net.IP, timeout time.Duration) (*bo
 
 	return &bootstrapper{
 		address:        address,
-		dialContext:    createDialContext([]string{resolverAddress}, timeout),
+		dialContext:    createDialContext([]string{resolverAddress}, timeout, keepAlive, AddressFamilyAuto, l),
 		resolvedConfig: createTLSConfig(host),
 		timeout:        timeout,
+		keepAlive:      keepAlive,
+		log:            l,
 	}, nil
 }
 
@@ -64,23 +70,28 @@ func toBootResolved(address string, serverIP net.IP, timeout time.Duration) (*bo
 // address -- original resolver address string (i.e. tls://one.one.one.one:853)
 // bootstrapAddr -- a list of bootstrap DNS resolvers' addresses
 // timeout -- DNS query timeout
-func toBoot(address string, bootstrapAddr []string, timeout time.Duration) *bootstrapper {
+// family -- the address family of the bootstrap resolvers and the resolved addresses
+// l -- the logger of the bootstrapper and the resolvers (nil for the default one)
+// chain -- the bootstraps this one is resolved with if it's a bootstrap itself (see otherBootstraps)
+func toBoot(address string, bootstrapAddr []string, timeout time.Duration, family AddressFamily, l proxyutil.Logger, chain []string) *bootstrapper {
 	resolvers := []*Resolver{}
 	if bootstrapAddr != nil && len(bootstrapAddr) != 0 {
 		// Create a list of resolvers for parallel lookup
 		for _, boot := range bootstrapAddr {
-			r := NewResolver(boot, timeout)
+			r := newResolver(boot, bootstrapAddr, chain, timeout, family, l)
 			resolvers = append(resolvers, r)
 		}
 	} else {
 		// nil resolver if the default one
-		resolvers = append(resolvers, NewResolver("", timeout))
+		resolvers = append(resolvers, newResolver("", nil, nil, timeout, family, l))
 	}
 
 	return &bootstrapper{
 		address:   address,
 		resolvers: resolvers,
 		timeout:   timeout,
+		family:    family,
+		log:       l,
 	}
 }
 
@@ -88,7 +99,14 @@ func toBoot(address string, bootstrapAddr []string, timeout time.Duration) *boot
 // resolverAddress is address of net.Resolver
 // The host in the address parameter of Dial func will always be a literal IP address (from documentation)
 func NewResolver(resolverAddress string, timeout time.Duration) *Resolver {
-	r := &Resolver{}
+	return newResolver(resolverAddress, nil, nil, timeout, AddressFamilyAuto, nil)
+}
+
+// newResolver creates the Resolver for the bootstrap entry of the address family that writes the messages to l
+// (nil for the default logger). If its address has a hostname, it's resolved with the other bootstraps
+// that aren't in the chain yet (see otherBootstraps).
+func newResolver(resolverAddress string, bootstraps, chain []string, timeout time.Duration, family AddressFamily, l proxyutil.Logger) *Resolver {
+	r := &Resolver{log: l}
 
 	// set default net.Resolver as a resolver if resolverAddress is empty
 	if resolverAddress == "" {
@@ -97,59 +115,36 @@ func NewResolver(resolverAddress string, timeout time.Duration) *Resolver {
 	}
 
 	r.resolverAddress = resolverAddress
+	chain = append(chain[:len(chain):len(chain)], resolverAddress)
 	opts := Options{
-		Timeout: timeout,
+		Bootstrap:      otherBootstraps(bootstraps, chain),
+		Timeout:        timeout,
+		Logger:         l,
+		AddressFamily:  family,
+		bootstrapChain: chain,
 	}
-	var err error
-	r.upstream, err = AddressToUpstream(resolverAddress, opts)
+	u, err := AddressToNamedUpstream(resolverAddress, opts)
 	if err != nil {
-		log.Error("AddressToUpstream: %s", err)
+		r.err = fmt.Errorf("invalid bootstrap %s: %s", resolverAddress, err)
+		r.logger().Errorf("AddressToUpstream: %s", err)
 		return r
 	}
 
-	// Validate the bootstrap resolver. It must be either a plain DNS resolver.
-	// Or a DOT/DOH resolver with an IP address (not a hostname).
-	if !isResolverValidBootstrap(r.upstream) {
-		r.upstream = nil
-		log.Error("Resolver %s is not eligible to be a bootstrap DNS server", resolverAddress)
-	}
-
-	return r
-}
-
-// isResolverValidBootstrap checks if the upstream is eligible to be a bootstrap DNS server
-// DNSCrypt and plain DNS resolvers are okay
-// DOH and DOT are okay only in the case if an IP address is used in the IP address
-func isResolverValidBootstrap(upstream Upstream) bool {
-	if u, ok := upstream.(*dnsOverTLS); ok {
-		host, _, err := net.SplitHostPort(u.Address())
-		if err != nil {
-			return false
-		}
-
-		if ip := net.ParseIP(host); ip != nil {
-			return true
-		}
-		return false
-	}
-
-	if u, ok := upstream.(*dnsOverHTTPS); ok {
-		urlAddr, err := url.Parse(u.Address())
-		if err != nil {
-			return false
-		}
-		host, _, err := net.SplitHostPort(urlAddr.Host)
-		if err != nil {
-			host = urlAddr.Host
+	// Validate the bootstrap resolver. A DOT/DOH resolver with a hostname must be resolved
+	// with the other bootstraps, it's never resolved with the system resolver.
+	if b := hostBootstrapper(u); b != nil {
+		if len(opts.Bootstrap) == 0 {
+			r.err = bootstrapChainError(chain)
+			r.logger().Errorf("Resolver %s is not eligible to be a bootstrap DNS server", resolverAddress)
+			return r
 		}
-
-		if ip := net.ParseIP(host); ip != nil {
-			return true
+		if r.err = b.resolversError(); r.err != nil {
+			return r
 		}
-		return false
 	}
 
-	return true
+	r.upstream = u
+	return r
 }
 
 type resultError struct {
@@ -179,6 +174,9 @@ func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr,
 		return r.resolver.LookupIPAddr(ctx, host)
 	}
 
+	if r.err != nil {
+		return []net.IPAddr{}, r.err
+	}
 	if r.upstream == nil || len(host) == 0 {
 		return []net.IPAddr{}, nil
 	}
@@ -252,9 +250,9 @@ func (n *bootstrapper) get() (*tls.Config, dialHandler, error) {
 		n.Lock()
 		defer n.Unlock()
 
-		dialContext := createDialContext([]string{resolverAddress}, n.timeout)
+		dialContext := createDialContext([]string{resolverAddress}, n.timeout, n.keepAlive, AddressFamilyAuto, n.logger())
 		n.dialContext = dialContext
-		config := createTLSConfig(host)
+		config := n.tlsConfig(host)
 		n.resolvedConfig = config
 		return config, n.dialContext, nil
 	}
@@ -287,6 +285,10 @@ func (n *bootstrapper) get() (*tls.Config, dialHandler, error) {
 		if addr.IP.To4() == nil && addr.IP.To16() == nil {
 			continue
 		}
+		if !n.family.allows(addr.IP) {
+			// the other family is never dialed (in AddressFamilyAuto, the unroutable one is skipped by the dialer)
+			continue
+		}
 
 		resolved = append(resolved, net.JoinHostPort(addr.String(), port))
 	}
@@ -299,16 +301,27 @@ func (n *bootstrapper) get() (*tls.Config, dialHandler, error) {
 	n.Lock()
 	defer n.Unlock()
 
-	dialContext := createDialContext(resolved, n.timeout)
+	dialContext := createDialContext(resolved, n.timeout, n.keepAlive, n.family, n.logger())
 	n.dialContext = dialContext
-	n.resolvedConfig = createTLSConfig(host)
+	n.resolvedConfig = n.tlsConfig(host)
 	return n.resolvedConfig, n.dialContext, nil
 }
 
-// createDialContext returns dialContext function that tries to establish connection with all given addresses one by one
-func createDialContext(addresses []string, timeout time.Duration) (dialContext dialHandler) {
+// tlsConfig creates the client TLS config for host that also checks the certificate hashes
+func (n *bootstrapper) tlsConfig(host string) *tls.Config {
+	tlsConfig := createTLSConfig(host)
+	setCertificateHashes(tlsConfig, n.hashes)
+	return tlsConfig
+}
+
+// createDialContext returns dialContext function that tries to establish connection with all given addresses one by one,
+// the addresses that don't belong to family.bootstrapFamily() are skipped, unless all of them would be.
+// The messages are written to l (nil for the default logger).
+func createDialContext(addresses []string, timeout, keepAlive time.Duration, family AddressFamily, l proxyutil.Logger) (dialContext dialHandler) {
+	l = proxyutil.LoggerOrDefault(l)
 	dialer := &net.Dialer{
 		Timeout:   timeout,
+		KeepAlive: keepAlive,
 		DualStack: true,
 	}
 
@@ -317,31 +330,64 @@ func createDialContext(addresses []string, timeout time.Duration) (dialContext d
 
 		// Return first connection without error
 		// Note that we're using bootstrapped resolverAddress instead of what's passed to the function
-		for _, resolverAddress := range addresses {
-			log.Tracef("Dialing to %s", resolverAddress)
+		for _, resolverAddress := range familyAddresses(addresses, family.bootstrapFamily()) {
+			if l.DebugEnabled() {
+				l.Debugf("Dialing to %s", resolverAddress)
+			}
 			start := time.Now()
 			con, err := dialer.DialContext(ctx, network, resolverAddress)
 			elapsed := time.Since(start) / time.Millisecond
 
 			if err == nil {
-				log.Tracef("dialer has successfully initialized connection to %s in %d milliseconds", resolverAddress, elapsed)
+				if l.DebugEnabled() {
+					l.Debugf("dialer has successfully initialized connection to %s in %d milliseconds", resolverAddress, elapsed)
+				}
 				return con, err
 			}
 			errs = append(errs, err)
-			log.Tracef("dialer failed to initialize connection to %s, in %d milliseconds, cause: %s", resolverAddress, elapsed, err)
+			if l.DebugEnabled() {
+				l.Debugf("dialer failed to initialize connection to %s, in %d milliseconds, cause: %s", resolverAddress, elapsed, err)
+			}
 		}
 		return nil, errorx.DecorateMany("all dialers failed to initialize connection: ", errs...)
 	}
 	return
 }
 
+// familyAddresses returns the addresses that belong to the family (or all of them if none does)
+func familyAddresses(addresses []string, family AddressFamily) []string {
+	if family == AddressFamilyAuto {
+		return addresses
+	}
+	var res []string
+	for _, addr := range addresses {
+		host, _, err := net.SplitHostPort(addr)
+		if ip := net.ParseIP(host); err == nil && ip != nil && family.allows(ip) {
+			res = append(res, addr)
+		}
+	}
+	if len(res) == 0 {
+		return addresses
+	}
+	return res
+}
+
+// NewTLSConfig creates the client TLS config that the upstreams use to connect to host
+func NewTLSConfig(host string) *tls.Config {
+	return createTLSConfig(host)
+}
+
 // createTLSConfig creates a client TLS config
 func createTLSConfig(host string) *tls.Config {
-	return &tls.Config{
+	tlsConfig := &tls.Config{
 		ServerName: host,
 		RootCAs:    RootCAs,
 		MinVersion: tls.VersionTLS12,
 	}
+	if VerifyCertificate != nil {
+		setCertificateVerifier(tlsConfig, host, RootCAs, VerifyCertificate)
+	}
+	return tlsConfig
 }
 
 // getAddressHostPort splits resolver address into host and port
@@ -0,0 +1,96 @@
+package upstream
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// maxBootstrapDepth is the max length of the chain of the bootstraps with the hostnames
+// that resolve each other, e.g. 3 for a DoH bootstrap resolved by a DoT one resolved by a plain one
+const maxBootstrapDepth = 3
+
+// otherBootstraps returns the bootstraps that can resolve the hostname of the last one of the chain:
+// the ones that aren't in the chain yet, so the cycles are never followed.
+// Returns nil if the chain is at maxBootstrapDepth.
+func otherBootstraps(bootstraps, chain []string) []string {
+	if len(chain) >= maxBootstrapDepth {
+		return nil
+	}
+	var res []string
+	for _, b := range bootstraps {
+		inChain := false
+		for _, c := range chain {
+			if b == c {
+				inChain = true
+				break
+			}
+		}
+		if !inChain {
+			res = append(res, b)
+		}
+	}
+	return res
+}
+
+// hostBootstrapper returns the bootstrapper of the DoT or DoH upstream if its hostname must be resolved
+// before connecting, otherwise nil
+func hostBootstrapper(u Upstream) *bootstrapper {
+	var b *bootstrapper
+	switch u := unwrapName(u).(type) {
+	case *dnsOverTLS:
+		b = u.boot
+	case *dnsOverHTTPS:
+		b = u.boot
+	default:
+		return nil
+	}
+	if b.dialContext != nil {
+		// the server IP is known (see Options.ServerIP)
+		return nil
+	}
+	host, _, err := getAddressHostPort(b.address)
+	if err != nil || net.ParseIP(host) != nil {
+		return nil
+	}
+	return b
+}
+
+// resolversError returns the error of the first resolver of the bootstrapper if none of them can be used
+func (n *bootstrapper) resolversError() error {
+	for _, r := range n.resolvers {
+		if r.err == nil {
+			return nil
+		}
+	}
+	return n.resolvers[0].err
+}
+
+// bootstrapChainError returns the error of the last bootstrap of the chain whose hostname can't be resolved
+// with the other bootstraps
+func bootstrapChainError(chain []string) error {
+	address := chain[len(chain)-1]
+	switch {
+	case len(chain) == 1:
+		return fmt.Errorf("bootstrap %s needs another bootstrap to resolve its hostname", address)
+	case len(chain) >= maxBootstrapDepth:
+		return fmt.Errorf("bootstrap %s needs another bootstrap to resolve its hostname, but the chain %s reached the limit of %d bootstraps",
+			address, strings.Join(chain, " -> "), maxBootstrapDepth)
+	default:
+		return fmt.Errorf("bootstrap %s needs another bootstrap to resolve its hostname, but the other ones are already in the chain %s",
+			address, strings.Join(chain, " -> "))
+	}
+}
+
+// ValidateBootstrap checks that the bootstrap entries are valid upstream addresses (optionally named, see SplitName)
+// and that the ones with hostnames can be resolved by the others without cycles.
+// Only Timeout, AddressFamily and Logger of opts are used.
+func ValidateBootstrap(bootstrap []string, opts Options) error {
+	for _, b := range bootstrap {
+		r := newResolver(b, bootstrap, nil, opts.Timeout, opts.AddressFamily, opts.Logger)
+		if r.err != nil {
+			return r.err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package upstream
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBootstrapChain(t *testing.T) {
+	// the DoH bootstrap with the hostname is resolved by the plain one
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dohAnswer(t, w, r)
+	}))
+	defer srv.Close()
+
+	// the certificate of the test server is issued for example.com
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	oldRoots := RootCAs
+	RootCAs = roots
+	defer func() { RootCAs = oldRoots }()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	plainSrv := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := &dns.Msg{}
+		resp.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeA && r.Question[0].Name == "example.com." {
+			resp.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IP{127, 0, 0, 1},
+			}}
+		}
+		_ = w.WriteMsg(resp)
+	})}
+	go func() { _ = plainSrv.ActivateAndServe() }()
+	defer func() { _ = plainSrv.Shutdown() }()
+
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	require.NoError(t, err)
+	doh := "https://example.com:" + port + "/dns-query"
+	bootstrap := []string{doh, "local=" + conn.LocalAddr().String()}
+	require.NoError(t, ValidateBootstrap(bootstrap, Options{Timeout: time.Second}))
+
+	r := newResolver(doh, bootstrap, nil, time.Second, AddressFamilyAuto, nil)
+	require.NoError(t, r.err)
+	addrs, err := r.LookupIPAddr(context.Background(), "dns.example.org")
+	require.NoError(t, err)
+	require.NotEmpty(t, addrs)
+	assert.Equal(t, "1.2.3.4", addrs[0].IP.String())
+}
+
+func TestBootstrapChainErrors(t *testing.T) {
+	l := &errorsLogger{}
+	opts := Options{Timeout: time.Second, Logger: l}
+
+	err := ValidateBootstrap([]string{"tls://dns.example.org"}, opts)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "needs another bootstrap")
+
+	// the bootstraps that need each other
+	err = ValidateBootstrap([]string{"tls://dns.example.org", "https://doh.example.org/dns-query"}, opts)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "already in the chain tls://dns.example.org -> https://doh.example.org/dns-query")
+
+	// the chain is too long
+	err = ValidateBootstrap([]string{"tls://a.example.org", "tls://b.example.org", "tls://c.example.org", "tls://d.example.org"}, opts)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "reached the limit of 3 bootstraps")
+
+	err = ValidateBootstrap([]string{"tls://dns.example.org", "1.1.1.1:53", "tls://1.1.1.1"}, opts)
+	assert.NoError(t, err)
+	err = ValidateBootstrap([]string{"tls://[::1"}, opts)
+	assert.Error(t, err)
+
+	// the upstream with the invalid bootstraps fails instead of using the system resolver
+	u, err := AddressToUpstream("tls://dns.example.org", Options{Timeout: time.Second, Bootstrap: []string{"tls://dns.adguard.com"}, Logger: l})
+	require.NoError(t, err)
+	req := &dns.Msg{}
+	req.SetQuestion("example.org.", dns.TypeA)
+	_, err = u.Exchange(req)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "needs another bootstrap")
+}
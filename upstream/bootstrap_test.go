@@ -2,6 +2,7 @@ package upstream
 
 import (
 	"context"
+	"fmt"
 	"testing"
 	"time"
 
@@ -57,15 +58,37 @@ func TestNewResolverIsValid(t *testing.T) {
 	assert.Nil(t, err)
 	assert.True(t, len(addrs) > 0)
 
+	// the hostnames can't be resolved without the other bootstraps
 	r = NewResolver("tls://dns.adguard.com", 3*time.Second)
 	assert.Nil(t, r.upstream)
 	addrs, err = r.LookupIPAddr(context.TODO(), "cloudflare-dns.com")
-	assert.Nil(t, err)
+	assert.NotNil(t, err)
 	assert.True(t, len(addrs) == 0)
 
 	r = NewResolver("https://dns.adguard.com/dns-query", 3*time.Second)
 	assert.Nil(t, r.upstream)
 	addrs, err = r.LookupIPAddr(context.TODO(), "cloudflare-dns.com")
-	assert.Nil(t, err)
+	assert.NotNil(t, err)
 	assert.True(t, len(addrs) == 0)
 }
+
+// errorsLogger counts the error messages
+type errorsLogger struct {
+	errors []string
+}
+
+func (l *errorsLogger) Debugf(format string, args ...interface{}) {}
+func (l *errorsLogger) Infof(format string, args ...interface{})  {}
+func (l *errorsLogger) Warnf(format string, args ...interface{})  {}
+func (l *errorsLogger) Errorf(format string, args ...interface{}) {
+	l.errors = append(l.errors, fmt.Sprintf(format, args...))
+}
+func (l *errorsLogger) DebugEnabled() bool { return false }
+
+func TestBootstrapLogger(t *testing.T) {
+	l := &errorsLogger{}
+	u, err := AddressToUpstream("tls://dns.example.org", Options{Bootstrap: []string{"tls://dns.adguard.com"}, Logger: l})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Resolver tls://dns.adguard.com is not eligible to be a bootstrap DNS server"}, l.errors)
+	assert.Equal(t, l, u.(*dnsOverTLS).logger())
+}
@@ -0,0 +1,22 @@
+package upstream
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+)
+
+// ContextExchanger is implemented by the upstreams that take the context of the query,
+// e.g. to nest their own tracing spans in the span of the proxy or to stop the exchange when ctx is done
+type ContextExchanger interface {
+	ExchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+}
+
+// ExchangeContext exchanges m with the upstream passing ctx to it if it implements ContextExchanger.
+// The other upstreams don't get ctx and are exchanged with as usual.
+func ExchangeContext(ctx context.Context, u Upstream, m *dns.Msg) (*dns.Msg, error) {
+	if c, ok := u.(ContextExchanger); ok {
+		return c.ExchangeContext(ctx, m)
+	}
+	return u.Exchange(m)
+}
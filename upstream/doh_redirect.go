@@ -0,0 +1,151 @@
+package upstream
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/joomcode/errorx"
+)
+
+// dohMaxRedirects is the max number of the redirects followed by a DoH request
+const dohMaxRedirects = 3
+
+// checkRedirect is the http.Client's CheckRedirect of the DoH upstream: the redirects are only followed to HTTPS URLs
+// on the same host or, when the certificate hashes are configured (they're checked on every connection), on any host
+func (p *dnsOverHTTPS) checkRedirect(req *http.Request, via []*http.Request) error {
+	chain := make([]string, 0, len(via)+1)
+	for _, r := range via {
+		chain = append(chain, redirectURLString(r.URL))
+	}
+	chain = append(chain, redirectURLString(req.URL))
+
+	for _, r := range via {
+		if r.URL.String() == req.URL.String() {
+			return fmt.Errorf("redirect loop: %s", strings.Join(chain, " -> "))
+		}
+	}
+	if len(via) > dohMaxRedirects {
+		return fmt.Errorf("too many redirects: %s", strings.Join(chain, " -> "))
+	}
+	if req.URL.Scheme != "https" {
+		return fmt.Errorf("refusing the redirect to a non-HTTPS URL: %s", strings.Join(chain, " -> "))
+	}
+
+	origin, err := url.Parse(p.boot.address)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(req.URL.Hostname(), origin.Hostname()) && len(p.boot.hashes) == 0 {
+		return fmt.Errorf("refusing the cross-origin redirect: %s", strings.Join(chain, " -> "))
+	}
+	return nil
+}
+
+// redirectURLString returns the URL without the query, so the DNS messages aren't written to the errors
+func redirectURLString(u *url.URL) string {
+	c := *u
+	c.RawQuery = ""
+	return c.String()
+}
+
+// requestBase returns the URL the queries are sent to: the address of the upstream
+// or the final URL of the previous redirected query
+func (p *dnsOverHTTPS) requestBase() string {
+	p.redirectLock.Lock()
+	defer p.redirectLock.Unlock()
+	if p.redirectURL != "" {
+		return p.redirectURL
+	}
+	return p.boot.address
+}
+
+// setRedirectURL caches the final URL of the redirected query without its "dns" parameter,
+// the next queries are sent to it directly until it fails (see Exchange)
+func (p *dnsOverHTTPS) setRedirectURL(u *url.URL) {
+	c := *u
+	q := c.Query()
+	q.Del("dns")
+	c.RawQuery = q.Encode()
+	final := c.String()
+
+	p.redirectLock.Lock()
+	defer p.redirectLock.Unlock()
+	if p.redirectURL != final && final != p.boot.address {
+		p.logger().Debugf("Queries to %s are redirected to %s", p.boot.address, final)
+		p.redirectURL = final
+	}
+}
+
+// dohTransport sends the requests to the host of the upstream with its bootstrapped transport,
+// and the requests redirected to the other hosts with their own transports
+type dohTransport struct {
+	p    *dnsOverHTTPS
+	host string          // the host and port of the upstream URL
+	main *http.Transport // the transport of the upstream host
+
+	siblings map[string]*http.Transport // the transports of the other hosts by host and port
+	sync.Mutex
+}
+
+// RoundTrip implements the http.RoundTripper interface for dohTransport
+func (t *dohTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := hostWithDefaultPort(req.URL)
+	if host == t.host {
+		return t.main.RoundTrip(req)
+	}
+	sibling, err := t.sibling(host)
+	if err != nil {
+		return nil, err
+	}
+	return sibling.RoundTrip(req)
+}
+
+// sibling returns the transport of the host the requests are redirected to, it's resolved with the bootstrap
+// resolvers of the upstream and its certificate is checked against the certificate hashes
+func (t *dohTransport) sibling(host string) (*http.Transport, error) {
+	t.Lock()
+	defer t.Unlock()
+	if s, ok := t.siblings[host]; ok {
+		return s, nil
+	}
+
+	b := &bootstrapper{
+		address:   "https://" + host + "/",
+		resolvers: t.p.boot.resolvers,
+		timeout:   t.p.boot.timeout,
+		keepAlive: t.p.boot.keepAlive,
+		log:       t.p.boot.log,
+		hashes:    t.p.boot.hashes,
+	}
+	s, err := t.p.createTransport(b)
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't initialize HTTP transport for %s", host)
+	}
+	if t.siblings == nil {
+		t.siblings = map[string]*http.Transport{}
+	}
+	t.siblings[host] = s
+	return s, nil
+}
+
+// CloseIdleConnections closes the idle connections of all the transports (see http.Client.CloseIdleConnections)
+func (t *dohTransport) CloseIdleConnections() {
+	t.main.CloseIdleConnections()
+	t.Lock()
+	defer t.Unlock()
+	for _, s := range t.siblings {
+		s.CloseIdleConnections()
+	}
+}
+
+// hostWithDefaultPort returns the host and port of the HTTPS URL, the port is 443 if it isn't specified
+func hostWithDefaultPort(u *url.URL) string {
+	if u.Port() == "" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return u.Host
+}
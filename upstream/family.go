@@ -0,0 +1,148 @@
+package upstream
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ameshkov/dnsstamps"
+)
+
+// AddressFamily is the address family of the outbound connections (see Options.AddressFamily)
+type AddressFamily int32
+
+// The outbound address families
+const (
+	AddressFamilyAuto AddressFamily = iota // both families, the bootstrapped addresses of the unroutable one are skipped (see ProbeAddressFamilies)
+	AddressFamilyIPv4                      // only IPv4, the IPv6 addresses are skipped and the IPv6 upstreams are rejected
+	AddressFamilyIPv6                      // only IPv6, the IPv4 addresses are skipped and the IPv4 upstreams are rejected
+)
+
+// ParseAddressFamily parses "auto" (or the empty string), "ipv4" or "ipv6"
+func ParseAddressFamily(s string) (AddressFamily, error) {
+	switch strings.ToLower(s) {
+	case "", "auto":
+		return AddressFamilyAuto, nil
+	case "ipv4":
+		return AddressFamilyIPv4, nil
+	case "ipv6":
+		return AddressFamilyIPv6, nil
+	default:
+		return AddressFamilyAuto, fmt.Errorf("unknown address family %q: use auto, ipv4 or ipv6", s)
+	}
+}
+
+// String returns the name of the family: "auto", "ipv4" or "ipv6"
+func (f AddressFamily) String() string {
+	switch f {
+	case AddressFamilyIPv4:
+		return "ipv4"
+	case AddressFamilyIPv6:
+		return "ipv6"
+	default:
+		return "auto"
+	}
+}
+
+// probedFamily is the result of the last ProbeAddressFamilies, accessed atomically
+var probedFamily int32
+
+// familyRoutable checks if the network has a route to addr, connecting a UDP socket doesn't send packets
+var familyRoutable = func(network, addr string) bool {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+// ProbeAddressFamilies checks which address families have a route on the network. It must be called at startup
+// and when the network changes, in AddressFamilyAuto the bootstrapped addresses of the family without a route
+// aren't dialed. Returns AddressFamilyIPv4 or AddressFamilyIPv6 if only that family is routable,
+// otherwise AddressFamilyAuto.
+func ProbeAddressFamilies() AddressFamily {
+	v4 := familyRoutable("udp4", "1.1.1.1:53")
+	v6 := familyRoutable("udp6", "[2606:4700:4700::1111]:53")
+
+	f := AddressFamilyAuto
+	if v4 && !v6 {
+		f = AddressFamilyIPv4
+	} else if v6 && !v4 {
+		f = AddressFamilyIPv6
+	}
+	atomic.StoreInt32(&probedFamily, int32(f))
+	return f
+}
+
+// bootstrapFamily returns the family the bootstrapped addresses are filtered by:
+// f itself or, in AddressFamilyAuto, the result of ProbeAddressFamilies
+func (f AddressFamily) bootstrapFamily() AddressFamily {
+	if f != AddressFamilyAuto {
+		return f
+	}
+	return AddressFamily(atomic.LoadInt32(&probedFamily))
+}
+
+// allows checks if the IP address belongs to the family (any address does in AddressFamilyAuto)
+func (f AddressFamily) allows(ip net.IP) bool {
+	switch f {
+	case AddressFamilyIPv4:
+		return ip.To4() != nil
+	case AddressFamilyIPv6:
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
+
+// network returns the network of the family for "udp" or "tcp", e.g. "udp4"
+func (f AddressFamily) network(network string) string {
+	switch f {
+	case AddressFamilyIPv4:
+		return network + "4"
+	case AddressFamilyIPv6:
+		return network + "6"
+	default:
+		return network
+	}
+}
+
+// checkIP returns an error if the IP address of the upstream address doesn't belong to the family
+func (f AddressFamily) checkIP(address string, ip net.IP) error {
+	if ip == nil || f.allows(ip) {
+		return nil
+	}
+	if f == AddressFamilyIPv4 {
+		return fmt.Errorf("%s is an IPv6 address, but only IPv4 is used for the outbound connections", address)
+	}
+	return fmt.Errorf("%s is an IPv4 address, but only IPv6 is used for the outbound connections", address)
+}
+
+// CheckAddressFamily returns an error if the host of the upstream address is an IP address that doesn't belong
+// to the family, e.g. tls://[2606:4700::1111]:853 in AddressFamilyIPv4 (the addresses are in the form of Upstream.Address).
+// The host names and the DNS stamps are accepted.
+func CheckAddressFamily(address string, f AddressFamily) error {
+	if f == AddressFamilyAuto || strings.HasPrefix(address, "sdns://") {
+		return nil
+	}
+	host, _, err := getAddressHostPort(address)
+	if err != nil {
+		return nil
+	}
+	return f.checkIP(address, net.ParseIP(host))
+}
+
+// checkStampAddressFamily checks the server address of the DNSCrypt stamp like CheckAddressFamily
+func checkStampAddressFamily(stamp string, f AddressFamily) error {
+	s, err := dnsstamps.NewServerStampFromString(stamp)
+	if err != nil || f == AddressFamilyAuto {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(s.ServerAddrStr)
+	if err != nil {
+		host = s.ServerAddrStr
+	}
+	return f.checkIP(s.ServerAddrStr, net.ParseIP(strings.Trim(host, "[]")))
+}
@@ -0,0 +1,65 @@
+package upstream
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAddressFamily(t *testing.T) {
+	for s, f := range map[string]AddressFamily{"": AddressFamilyAuto, "auto": AddressFamilyAuto, "IPv4": AddressFamilyIPv4, "ipv6": AddressFamilyIPv6} {
+		v, err := ParseAddressFamily(s)
+		require.NoError(t, err)
+		assert.Equal(t, f, v, s)
+	}
+	_, err := ParseAddressFamily("ipv5")
+	assert.Error(t, err)
+}
+
+func TestCheckAddressFamily(t *testing.T) {
+	assert.Error(t, CheckAddressFamily("tls://[2606:4700::1111]:853", AddressFamilyIPv4))
+	assert.Error(t, CheckAddressFamily("8.8.8.8:53", AddressFamilyIPv6))
+	assert.NoError(t, CheckAddressFamily("tls://[2606:4700::1111]:853", AddressFamilyAuto))
+	assert.NoError(t, CheckAddressFamily("tls://dns.adguard.com", AddressFamilyIPv6))
+	assert.NoError(t, CheckAddressFamily("https://1.1.1.1/dns-query", AddressFamilyIPv4))
+
+	_, err := AddressToUpstream("[::1]:53", Options{AddressFamily: AddressFamilyIPv4})
+	assert.Error(t, err)
+	_, err = AddressToUpstream("tcp://127.0.0.1:53", Options{AddressFamily: AddressFamilyIPv6})
+	assert.Error(t, err)
+	u, err := AddressToUpstream("127.0.0.1:53", Options{AddressFamily: AddressFamilyIPv4})
+	require.NoError(t, err)
+	assert.Equal(t, "udp4", u.(*plainDNS).family.network("udp"))
+}
+
+func TestFamilyAddresses(t *testing.T) {
+	addrs := []string{"1.2.3.4:853", "[2001:db8::1]:853", "5.6.7.8:853"}
+	assert.Equal(t, []string{"1.2.3.4:853", "5.6.7.8:853"}, familyAddresses(addrs, AddressFamilyIPv4))
+	assert.Equal(t, []string{"[2001:db8::1]:853"}, familyAddresses(addrs, AddressFamilyIPv6))
+	assert.Equal(t, addrs, familyAddresses(addrs, AddressFamilyAuto))
+
+	// all the addresses are dialed if none of them belongs to the family
+	assert.Equal(t, addrs[:1], familyAddresses(addrs[:1], AddressFamilyIPv6))
+}
+
+func TestProbeAddressFamilies(t *testing.T) {
+	routable := familyRoutable
+	defer func() {
+		familyRoutable = routable
+		ProbeAddressFamilies()
+	}()
+
+	v6 := false
+	familyRoutable = func(network, _ string) bool { return network == "udp4" || v6 }
+
+	assert.Equal(t, AddressFamilyIPv4, ProbeAddressFamilies())
+	assert.Equal(t, AddressFamilyIPv4, AddressFamilyAuto.bootstrapFamily())
+	assert.False(t, AddressFamilyAuto.bootstrapFamily().allows(net.ParseIP("2001:db8::1")))
+	assert.Equal(t, AddressFamilyIPv6, AddressFamilyIPv6.bootstrapFamily())
+
+	v6 = true
+	assert.Equal(t, AddressFamilyAuto, ProbeAddressFamilies())
+	assert.True(t, AddressFamilyAuto.bootstrapFamily().allows(net.ParseIP("2001:db8::1")))
+}
@@ -0,0 +1,51 @@
+package upstream
+
+// idleCloser is implemented by the upstreams that keep the connections open between the queries
+type idleCloser interface {
+	closeIdleConnections()
+}
+
+// CloseIdleConnections closes the connections of the upstream that aren't used by the queries in progress
+// (the pooled DoT connections and the idle DoH connections). The new queries open new connections.
+// It does nothing for the upstreams that don't keep the connections (e.g. plain DNS).
+func CloseIdleConnections(u Upstream) {
+	if c, ok := u.(idleCloser); ok {
+		c.closeIdleConnections()
+	}
+}
+
+// closeIdleConnections closes the pooled connections
+func (p *dnsOverTLS) closeIdleConnections() {
+	p.RLock()
+	pool := p.pool
+	p.RUnlock()
+	if pool != nil {
+		pool.closeAll()
+	}
+}
+
+// closeIdleConnections closes the idle connections of the HTTP transport
+func (p *dnsOverHTTPS) closeIdleConnections() {
+	p.RLock()
+	client := p.client
+	p.RUnlock()
+	if client != nil {
+		client.CloseIdleConnections()
+	}
+}
+
+// closeAll closes and removes all the connections from the pool
+func (n *TLSPool) closeAll() {
+	n.connsMutex.Lock()
+	conns := n.conns
+	n.conns = nil
+	for _, t := range n.timers {
+		t.Stop()
+	}
+	n.timers = nil
+	n.connsMutex.Unlock()
+
+	for _, c := range conns {
+		_ = c.Close()
+	}
+}
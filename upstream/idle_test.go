@@ -0,0 +1,56 @@
+package upstream
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloseIdleConnections(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	u := &dnsOverTLS{pool: &TLSPool{}}
+	u.pool.Put(client)
+	CloseIdleConnections(u)
+
+	assert.Empty(t, u.pool.conns)
+	_, err := client.Write([]byte{0})
+	assert.Error(t, err)
+
+	// the upstreams without connections are ignored
+	CloseIdleConnections(&plainDNS{address: "127.0.0.1:53"})
+	CloseIdleConnections(&dnsOverTLS{})
+	CloseIdleConnections(&dnsOverHTTPS{})
+}
+
+func TestTLSPoolIdleTimeout(t *testing.T) {
+	pool := &TLSPool{idleTimeout: 50 * time.Millisecond}
+
+	// the idle connection is closed
+	client, server := net.Pipe()
+	defer server.Close()
+	pool.Put(client)
+	assert.Eventually(t, func() bool {
+		pool.connsMutex.Lock()
+		defer pool.connsMutex.Unlock()
+		return len(pool.conns) == 0 && len(pool.timers) == 0
+	}, time.Second, 10*time.Millisecond)
+	_, err := client.Write([]byte{0})
+	assert.Error(t, err)
+
+	// the connection taken from the pool isn't closed
+	client, server = net.Pipe()
+	defer server.Close()
+	pool.Put(client)
+	c, err := pool.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, client, c)
+	assert.Empty(t, pool.timers)
+	time.Sleep(100 * time.Millisecond)
+	go func() { _, _ = server.Read(make([]byte, 1)) }()
+	_, err = client.Write([]byte{0})
+	assert.Nil(t, err)
+}
@@ -0,0 +1,31 @@
+package upstream
+
+import "github.com/AdguardTeam/dnsproxy/proxyutil"
+
+// logger returns the logger of the bootstrapper (see Options.Logger)
+func (n *bootstrapper) logger() proxyutil.Logger {
+	if n == nil {
+		return proxyutil.DefaultLogger()
+	}
+	return proxyutil.LoggerOrDefault(n.log)
+}
+
+// logger returns the logger of the resolver
+func (r *Resolver) logger() proxyutil.Logger {
+	return proxyutil.LoggerOrDefault(r.log)
+}
+
+func (p *plainDNS) logger() proxyutil.Logger     { return proxyutil.LoggerOrDefault(p.log) }
+func (p *dnsOverTLS) logger() proxyutil.Logger   { return p.boot.logger() }
+func (p *dnsOverHTTPS) logger() proxyutil.Logger { return p.boot.logger() }
+func (p *dnsCrypt) logger() proxyutil.Logger     { return p.boot.logger() }
+func (n *TLSPool) logger() proxyutil.Logger      { return n.boot.logger() }
+
+// upstreamLogger returns the logger of the upstream created by AddressToUpstream
+// or the default logger for the other implementations of Upstream
+func upstreamLogger(u Upstream) proxyutil.Logger {
+	if lu, ok := u.(interface{ logger() proxyutil.Logger }); ok {
+		return lu.logger()
+	}
+	return proxyutil.DefaultLogger()
+}
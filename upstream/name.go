@@ -0,0 +1,85 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/miekg/dns"
+)
+
+// namedUpstream is the upstream with the name (see WithName)
+type namedUpstream struct {
+	Upstream
+	name string
+}
+
+// WithName returns u with the name, it's used instead of the address in the logs, the stats and the errors
+// of the proxy (see Name). The empty name returns u as is.
+func WithName(u Upstream, name string) Upstream {
+	if name == "" {
+		return u
+	}
+	return &namedUpstream{Upstream: unwrapName(u), name: name}
+}
+
+// Name returns the name of the upstream set by WithName or its address if it has no name
+func Name(u Upstream) string {
+	if n, ok := u.(*namedUpstream); ok {
+		return n.name
+	}
+	return u.Address()
+}
+
+// unwrapName returns the upstream without the name
+func unwrapName(u Upstream) Upstream {
+	if n, ok := u.(*namedUpstream); ok {
+		return n.Upstream
+	}
+	return u
+}
+
+// ExchangeContext implements ContextExchanger, ctx is passed to the upstream if it takes it
+func (n *namedUpstream) ExchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	return ExchangeContext(ctx, n.Upstream, m)
+}
+
+func (n *namedUpstream) closeIdleConnections()    { CloseIdleConnections(n.Upstream) }
+func (n *namedUpstream) logger() proxyutil.Logger { return upstreamLogger(n.Upstream) }
+
+// SplitName splits the upstream entry in the name=address form (e.g. corp=tls://10.0.0.1)
+// into the name and the address. The name is empty if the entry has none.
+// The names consist of the letters, the digits, '-', '_' and '.'.
+func SplitName(entry string) (name, address string) {
+	i := strings.IndexByte(entry, '=')
+	if i <= 0 || !isValidName(entry[:i]) {
+		return "", entry
+	}
+	return entry[:i], entry[i+1:]
+}
+
+// isValidName checks that the upstream name has only the allowed characters (see SplitName)
+func isValidName(name string) bool {
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return name != ""
+}
+
+// AddressToNamedUpstream is AddressToUpstream for the entries in the name=address form (see SplitName)
+func AddressToNamedUpstream(entry string, opts Options) (Upstream, error) {
+	name, address := SplitName(entry)
+	if name != "" && address == "" {
+		return nil, fmt.Errorf("no address of the upstream %s", name)
+	}
+	u, err := AddressToUpstream(address, opts)
+	if err != nil {
+		return nil, err
+	}
+	return WithName(u, name), nil
+}
@@ -0,0 +1,49 @@
+package upstream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitName(t *testing.T) {
+	testCases := []struct {
+		entry   string
+		name    string
+		address string
+	}{
+		{entry: "corp=tls://10.0.0.1", name: "corp", address: "tls://10.0.0.1"},
+		{entry: "corp-dns.1_a=8.8.8.8:53", name: "corp-dns.1_a", address: "8.8.8.8:53"},
+		{entry: "tls://10.0.0.1", address: "tls://10.0.0.1"},
+		{entry: "https://dns.example.org/dns-query?a=b", address: "https://dns.example.org/dns-query?a=b"},
+		{entry: "https://dns.example.org/dns-query#header=X-Api-Key:abc", address: "https://dns.example.org/dns-query#header=X-Api-Key:abc"},
+		{entry: "=tls://10.0.0.1", address: "=tls://10.0.0.1"},
+		{entry: "my corp=tls://10.0.0.1", address: "my corp=tls://10.0.0.1"},
+	}
+	for _, tc := range testCases {
+		name, address := SplitName(tc.entry)
+		assert.Equal(t, tc.name, name, tc.entry)
+		assert.Equal(t, tc.address, address, tc.entry)
+	}
+}
+
+func TestAddressToNamedUpstream(t *testing.T) {
+	u, err := AddressToNamedUpstream("corp=tls://10.0.0.1", Options{})
+	require.NoError(t, err)
+	assert.Equal(t, "corp", Name(u))
+	assert.Equal(t, "10.0.0.1:853", u.Address())
+	assert.True(t, IsEncrypted(u))
+
+	// renaming replaces the name
+	assert.Equal(t, "other", Name(WithName(u, "other")))
+	assert.Equal(t, u, WithName(u, ""))
+
+	u, err = AddressToNamedUpstream("8.8.8.8", Options{})
+	require.NoError(t, err)
+	assert.Equal(t, "8.8.8.8:53", Name(u))
+	assert.False(t, IsEncrypted(u))
+
+	_, err = AddressToNamedUpstream("corp=", Options{})
+	assert.Error(t, err)
+}
@@ -6,7 +6,6 @@ import (
 	"net"
 	"time"
 
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/joomcode/errorx"
 	"github.com/miekg/dns"
 )
@@ -18,18 +17,31 @@ type exchangeResult struct {
 	err      error    // Error
 }
 
+// ExchangeFunc exchanges the request with the upstream, e.g. u.Exchange with the validation of the response
+type ExchangeFunc func(u Upstream, req *dns.Msg) (*dns.Msg, error)
+
 // ExchangeParallel function is called to parallel exchange dns request by many upstreams
 // First answer without error will be returned
 // We will return nil and error if count of errors equals count of upstreams
 func ExchangeParallel(u []Upstream, req *dns.Msg) (*dns.Msg, Upstream, error) {
+	return ExchangeParallelFunc(u, req, nil)
+}
+
+// ExchangeParallelFunc is ExchangeParallel that exchanges with each upstream using exchangeFunc
+// (Upstream.Exchange if nil), so the responses it rejects with an error make it wait for the other upstreams
+func ExchangeParallelFunc(u []Upstream, req *dns.Msg, exchangeFunc ExchangeFunc) (*dns.Msg, Upstream, error) {
 	size := len(u)
 
 	if size == 0 {
 		return nil, nil, errors.New("no upstream specified")
 	}
 
+	if exchangeFunc == nil {
+		exchangeFunc = func(u Upstream, req *dns.Msg) (*dns.Msg, error) { return u.Exchange(req) }
+	}
+
 	if size == 1 {
-		reply, err := exchange(u[0], req)
+		reply, err := exchange(u[0], req, exchangeFunc)
 		return reply, u[0], err
 	}
 
@@ -38,7 +50,7 @@ func ExchangeParallel(u []Upstream, req *dns.Msg) (*dns.Msg, Upstream, error) {
 	ch := make(chan *exchangeResult, size)
 
 	for _, f := range u {
-		go exchangeAsync(f, req, ch)
+		go exchangeAsync(f, req, exchangeFunc, ch)
 	}
 
 	errs := []error{}
@@ -63,8 +75,8 @@ func ExchangeParallel(u []Upstream, req *dns.Msg) (*dns.Msg, Upstream, error) {
 }
 
 // exchangeAsync tries to resolve DNS request with one upstream and send result to resp channel
-func exchangeAsync(u Upstream, req *dns.Msg, resp chan *exchangeResult) {
-	reply, err := u.Exchange(req)
+func exchangeAsync(u Upstream, req *dns.Msg, exchangeFunc ExchangeFunc, resp chan *exchangeResult) {
+	reply, err := exchangeFunc(u, req)
 	resp <- &exchangeResult{
 		reply:    reply,
 		upstream: u,
@@ -72,14 +84,18 @@ func exchangeAsync(u Upstream, req *dns.Msg, resp chan *exchangeResult) {
 	}
 }
 
-func exchange(u Upstream, req *dns.Msg) (*dns.Msg, error) {
+func exchange(u Upstream, req *dns.Msg, exchangeFunc ExchangeFunc) (*dns.Msg, error) {
 	start := time.Now()
-	reply, err := u.Exchange(req)
+	reply, err := exchangeFunc(u, req)
 	elapsed := time.Since(start) / time.Millisecond
 	if err == nil {
-		log.Tracef("upstream %s successfully finished exchange of %s. Elapsed %d ms.", u.Address(), req.Question[0].String(), elapsed)
+		if l := upstreamLogger(u); l.DebugEnabled() {
+			l.Debugf("upstream %s successfully finished exchange of %s. Elapsed %d ms.", u.Address(), req.Question[0].String(), elapsed)
+		}
 	} else {
-		log.Tracef("upstream %s failed to exchange %s in %d milliseconds. Cause: %s", u.Address(), req.Question[0].String(), elapsed, err)
+		if l := upstreamLogger(u); l.DebugEnabled() {
+			l.Debugf("upstream %s failed to exchange %s in %d milliseconds. Cause: %s", u.Address(), req.Question[0].String(), elapsed, err)
+		}
 	}
 	return reply, err
 }
@@ -147,9 +163,13 @@ func lookup(ctx context.Context, r *Resolver, host string) ([]net.IPAddr, error)
 	address, err := r.LookupIPAddr(ctx, host)
 	elapsed := time.Since(start) / time.Millisecond
 	if err != nil {
-		log.Tracef("failed to lookup for %s in %d milliseconds using %s: %s", host, elapsed, r.resolverAddress, err)
+		if l := r.logger(); l.DebugEnabled() {
+			l.Debugf("failed to lookup for %s in %d milliseconds using %s: %s", host, elapsed, r.resolverAddress, err)
+		}
 	} else {
-		log.Tracef("successfully finished lookup for %s in %d milliseconds using %s. Result : %s", host, elapsed, r.resolverAddress, address)
+		if l := r.logger(); l.DebugEnabled() {
+			l.Debugf("successfully finished lookup for %s in %d milliseconds using %s. Result : %s", host, elapsed, r.resolverAddress, address)
+		}
 	}
 	return address, err
 }
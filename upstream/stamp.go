@@ -0,0 +1,165 @@
+package upstream
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/ameshkov/dnsstamps"
+	"github.com/joomcode/errorx"
+)
+
+// stampPrefix is the scheme of the DNS stamps
+const stampPrefix = "sdns://"
+
+// StampFromOptions returns the DNS stamp of the upstream with the address (see AddressToUpstream) and the options.
+// Options.ServerIP is the address hint of the DoH and DoT stamps and Options.CertificateHashes are their hashes,
+// the other options (the bootstrap, the timeouts, the logger) are the settings of the client and aren't exported.
+// The DNSCrypt upstreams are configured with the stamps, so their addresses are returned as is.
+// The upstreams that can't be expressed with the stamps are rejected: DNS-over-TCP, plain DNS by the host name,
+// DoH with the HTTP headers, the query or the credentials.
+// The stamp is parsed back to the same address and options (see OptionsFromStamp).
+func StampFromOptions(addr string, opts *Options) (string, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	for _, h := range opts.CertificateHashes {
+		if len(h) != sha256.Size {
+			return "", fmt.Errorf("invalid certificate hash length %d, must be %d", len(h), sha256.Size)
+		}
+	}
+
+	if strings.HasPrefix(addr, stampPrefix) {
+		if _, err := dnsstamps.NewServerStampFromString(addr); err != nil {
+			return "", errorx.Decorate(err, "failed to parse %s", addr)
+		}
+		if opts.ServerIP != nil || len(opts.CertificateHashes) > 0 || len(opts.HTTPHeaders) > 0 {
+			return "", errors.New("the options of the sdns:// upstreams are defined by their stamps")
+		}
+		return addr, nil
+	}
+
+	if !strings.Contains(addr, "://") {
+		return plainStamp(addr, opts)
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", errorx.Decorate(err, "failed to parse %s", addr)
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("DNS stamps can't express the credentials, the query or the fragment of %s://%s", u.Scheme, u.Host)
+	}
+
+	switch u.Scheme {
+	case "dns":
+		if u.Path != "" && u.Path != "/" {
+			return "", fmt.Errorf("unexpected path in %s", addr)
+		}
+		return plainStamp(u.Host, opts)
+	case "tls":
+		if u.Path != "" && u.Path != "/" {
+			return "", fmt.Errorf("unexpected path in %s", addr)
+		}
+		return encryptedStamp(dnsstamps.StampProtoTypeTLS, u, "853", opts)
+	case "https":
+		if len(opts.HTTPHeaders) > 0 {
+			return "", errors.New("DNS stamps can't express the HTTP headers")
+		}
+		return encryptedStamp(dnsstamps.StampProtoTypeDoH, u, "443", opts)
+	case "tcp":
+		return "", errors.New("DNS stamps can't express the DNS-over-TCP upstreams")
+	case "udp":
+		return "", errors.New("DNS stamps can't express the UDP-only upstreams")
+	}
+	return "", fmt.Errorf("unsupported scheme %s", u.Scheme)
+}
+
+// plainStamp returns the plain DNS stamp of the server with the address in the host[:port] form
+func plainStamp(hostPort string, opts *Options) (string, error) {
+	if opts.ServerIP != nil || len(opts.CertificateHashes) > 0 {
+		return "", errors.New("the server IP and the certificate hashes are only supported by the DoH and DoT stamps")
+	}
+
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host, port = strings.TrimSuffix(strings.TrimPrefix(hostPort, "["), "]"), "53"
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", fmt.Errorf("plain DNS stamps require an IP address, got %s", host)
+	}
+
+	stamp := dnsstamps.ServerStamp{Proto: dnsstamps.StampProtoTypePlain, ServerAddrStr: net.JoinHostPort(ip.String(), port)}
+	return stamp.String(), nil
+}
+
+// encryptedStamp returns the DoH or DoT stamp of the server with the URL u
+func encryptedStamp(proto dnsstamps.StampProtoType, u *url.URL, defaultPort string, opts *Options) (string, error) {
+	host := u.Hostname()
+	if host == "" {
+		return "", fmt.Errorf("no host in %s", u)
+	}
+	providerName := host
+	if port := u.Port(); port != "" && port != defaultPort {
+		providerName = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		providerName = "[" + host + "]"
+	}
+
+	stamp := dnsstamps.ServerStamp{Proto: proto, ProviderName: providerName, Hashes: opts.CertificateHashes}
+	if proto == dnsstamps.StampProtoTypeDoH {
+		stamp.Path = u.EscapedPath()
+	}
+	if len(stamp.ProviderName) > 255 || len(stamp.Path) > 255 {
+		return "", fmt.Errorf("the host or the path of %s is too long", u)
+	}
+	if opts.ServerIP != nil {
+		stamp.ServerAddrStr = opts.ServerIP.String()
+		if opts.ServerIP.To4() == nil {
+			stamp.ServerAddrStr = "[" + stamp.ServerAddrStr + "]"
+		}
+	}
+	return stamp.String(), nil
+}
+
+// OptionsFromStamp parses the DNS stamp into the upstream address and the options, it's the inverse of StampFromOptions.
+// The address of the DNSCrypt upstreams is the stamp itself.
+func OptionsFromStamp(stamp string) (addr string, opts *Options, err error) {
+	s, err := dnsstamps.NewServerStampFromString(stamp)
+	if err != nil {
+		return "", nil, errorx.Decorate(err, "failed to parse %s", stamp)
+	}
+
+	opts = &Options{}
+	if s.ServerAddrStr != "" {
+		host, _, err := net.SplitHostPort(s.ServerAddrStr)
+		if err != nil {
+			host = s.ServerAddrStr
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return "", nil, fmt.Errorf("invalid server address in the stamp: %s", s.ServerAddrStr)
+		}
+		if s.Proto == dnsstamps.StampProtoTypeDoH || s.Proto == dnsstamps.StampProtoTypeTLS {
+			opts.ServerIP = ip
+		}
+	}
+	if len(s.Hashes) > 0 {
+		opts.CertificateHashes = s.Hashes
+	}
+
+	switch s.Proto {
+	case dnsstamps.StampProtoTypePlain:
+		return s.ServerAddrStr, opts, nil
+	case dnsstamps.StampProtoTypeDNSCrypt:
+		return stamp, opts, nil
+	case dnsstamps.StampProtoTypeDoH:
+		return fmt.Sprintf("https://%s%s", s.ProviderName, s.Path), opts, nil
+	case dnsstamps.StampProtoTypeTLS:
+		return fmt.Sprintf("tls://%s", s.ProviderName), opts, nil
+	}
+	return "", nil, fmt.Errorf("unsupported protocol %v in %s", s.Proto, stamp)
+}
@@ -2,13 +2,12 @@
 package upstream
 
 import (
-	"fmt"
 	"net"
 	"net/url"
 	"strings"
 	"time"
 
-	"github.com/ameshkov/dnsstamps"
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/joomcode/errorx"
 	"github.com/miekg/dns"
 )
@@ -22,7 +21,8 @@ type Upstream interface {
 // Options for AddressToUpstream func
 type Options struct {
 	// Bootstrap is a list of DNS servers to be used to resolve DOH/DOT hostnames (if any)
-	// You can use plain DNS, DNSCrypt, or DOT/DOH with IP addresses (not hostnames)
+	// in the AddressToNamedUpstream syntax. The DOT/DOH bootstraps with hostnames are resolved
+	// by the other ones, the chains are limited to 3 bootstraps (see ValidateBootstrap).
 	Bootstrap []string
 
 	// Timeout is the default upstream timeout. Also, it is used as a timeout for bootstrap DNS requests.
@@ -32,14 +32,44 @@ type Options struct {
 	// ServerIP allows specifying the resolver's IP address. In the case if it's specified,
 	// bootstrap DNS servers won't be used at all.
 	ServerIP net.IP
+
+	// IdleTimeout is how long the idle DoT and DoH connections are kept open.
+	// IdleTimeout=0 means they are kept until the server closes them.
+	IdleTimeout time.Duration
+
+	// KeepAlive is the TCP keep-alive period of the DoT and DoH connections.
+	// KeepAlive=0 means the Go default (15s), a negative value disables the keep-alive probes.
+	KeepAlive time.Duration
+
+	// Logger is the logger of the upstream and its bootstrap resolvers.
+	// Logger=nil means the default one (see proxyutil.DefaultLogger).
+	Logger proxyutil.Logger
+
+	// HTTPHeaders are added to the requests of the DoH upstreams, e.g. an API key.
+	// They can also be set in the URL fragment: https://dns.example/dns-query#header=X-Api-Key:abc.
+	// The Host header only changes the header, the TLS server name and the certificate are checked for the URL host.
+	HTTPHeaders map[string]string
+
+	// CertificateHashes are the SHA256 digests of the TBS certificates (the hashes of the DNS stamps).
+	// If set, one of the certificates of the DoH or DoT server chain must match one of them.
+	CertificateHashes [][]byte
+
+	// AddressFamily restricts the outbound connections to IPv4 or IPv6: the upstreams with the IP addresses
+	// of the other family are rejected, and its bootstrapped addresses are never dialed.
+	// AddressFamilyAuto only skips the bootstrapped addresses of the family without a route (see ProbeAddressFamilies).
+	AddressFamily AddressFamily
+
+	bootstrapChain []string // the bootstraps this upstream is resolved with if it's a bootstrap itself
 }
 
 // AddressToUpstream converts the specified address to an Upstream instance
 // * 8.8.8.8:53 -- plain DNS
 // * tcp://8.8.8.8:53 -- plain DNS over TCP
+// * udp://8.8.8.8:53 -- plain DNS over UDP only, the truncated responses aren't retried over TCP
 // * tls://1.1.1.1 -- DNS-over-TLS
 // * https://dns.adguard.com/dns-query -- DNS-over-HTTPS
 // * sdns://... -- DNS stamp (see https://dnscrypt.info/stamps-specifications)
+// Use AddressToNamedUpstream for the named upstreams (e.g. corp=tls://10.0.0.1).
 func AddressToUpstream(address string, opts Options) (Upstream, error) {
 	if strings.Contains(address, "://") {
 		upstreamURL, err := url.Parse(address)
@@ -55,16 +85,50 @@ func AddressToUpstream(address string, opts Options) (Upstream, error) {
 		// doesn't have port, default to 53
 		address = net.JoinHostPort(address, "53")
 	}
-	return &plainDNS{address: address, timeout: opts.Timeout}, nil
+	return newPlainDNS(address, opts)
+}
+
+// newPlainDNS creates the plain DNS upstream, its IP address must belong to opts.AddressFamily
+func newPlainDNS(address string, opts Options) (*plainDNS, error) {
+	if err := CheckAddressFamily(address, opts.AddressFamily); err != nil {
+		return nil, err
+	}
+	return &plainDNS{address: address, timeout: opts.Timeout, family: opts.AddressFamily, log: opts.Logger}, nil
+}
+
+// IsEncrypted checks if the upstream is DNS-over-TLS, DNS-over-HTTPS or DNSCrypt,
+// i.e. its responses can't be modified on the way from the server
+func IsEncrypted(u Upstream) bool {
+	switch unwrapName(u).(type) {
+	case *dnsOverTLS, *dnsOverHTTPS, *dnsCrypt:
+		return true
+	}
+	return false
 }
 
 // urlToBoot creates an instance of the bootstrapper with the specified options
 func urlToBoot(resolverURL string, opts Options) (*bootstrapper, error) {
+	if err := CheckAddressFamily(resolverURL, opts.AddressFamily); err != nil {
+		return nil, err
+	}
 	if opts.ServerIP == nil {
-		return toBoot(resolverURL, opts.Bootstrap, opts.Timeout), nil
+		b := toBoot(resolverURL, opts.Bootstrap, opts.Timeout, opts.AddressFamily, opts.Logger, opts.bootstrapChain)
+		b.keepAlive = opts.KeepAlive
+		b.hashes = opts.CertificateHashes
+		return b, nil
 	}
 
-	return toBootResolved(resolverURL, opts.ServerIP, opts.Timeout)
+	if err := opts.AddressFamily.checkIP(opts.ServerIP.String(), opts.ServerIP); err != nil {
+		return nil, err
+	}
+	b, err := toBootResolved(resolverURL, opts.ServerIP, opts.Timeout, opts.KeepAlive, opts.Logger)
+	if err != nil {
+		return nil, err
+	}
+	b.family = opts.AddressFamily
+	b.hashes = opts.CertificateHashes
+	setCertificateHashes(b.resolvedConfig, b.hashes)
+	return b, nil
 }
 
 // urlToUpstream converts a URL to an Upstream
@@ -73,9 +137,21 @@ func urlToUpstream(upstreamURL *url.URL, opts Options) (Upstream, error) {
 	case "sdns":
 		return stampToUpstream(upstreamURL.String(), opts)
 	case "dns":
-		return &plainDNS{address: getHostWithPort(upstreamURL, "53"), timeout: opts.Timeout}, nil
+		return newPlainDNS(getHostWithPort(upstreamURL, "53"), opts)
 	case "tcp":
-		return &plainDNS{address: getHostWithPort(upstreamURL, "53"), timeout: opts.Timeout, preferTCP: true}, nil
+		u, err := newPlainDNS(getHostWithPort(upstreamURL, "53"), opts)
+		if err != nil {
+			return nil, err
+		}
+		u.preferTCP = true
+		return u, nil
+	case "udp":
+		u, err := newPlainDNS(getHostWithPort(upstreamURL, "53"), opts)
+		if err != nil {
+			return nil, err
+		}
+		u.udpOnly = true
+		return u, nil
 	case "tls":
 		resolverURL := getHostWithPort(upstreamURL, "853")
 		b, err := urlToBoot(resolverURL, opts)
@@ -83,57 +159,51 @@ func urlToUpstream(upstreamURL *url.URL, opts Options) (Upstream, error) {
 			return nil, errorx.Decorate(err, "couldn't create tls bootstrapper")
 		}
 
-		return &dnsOverTLS{boot: b}, nil
+		return &dnsOverTLS{boot: b, idleTimeout: opts.IdleTimeout}, nil
 	case "https":
 		if upstreamURL.Port() == "" {
 			upstreamURL.Host += ":443"
 		}
 
+		headers, host, err := dohHeaders(upstreamURL, opts.HTTPHeaders)
+		if err != nil {
+			return nil, errorx.Decorate(err, "invalid headers of https://%s%s", upstreamURL.Host, upstreamURL.Path)
+		}
+
 		resolverURL := upstreamURL.String()
 		b, err := urlToBoot(resolverURL, opts)
 		if err != nil {
 			return nil, errorx.Decorate(err, "couldn't create tls bootstrapper")
 		}
 
-		return &dnsOverHTTPS{boot: b}, nil
+		return &dnsOverHTTPS{boot: b, idleTimeout: opts.IdleTimeout, headers: headers, host: host}, nil
 	default:
 		// assume it's plain DNS
-		return &plainDNS{address: getHostWithPort(upstreamURL, "53"), timeout: opts.Timeout}, nil
+		return newPlainDNS(getHostWithPort(upstreamURL, "53"), opts)
 	}
 }
 
-// stampToUpstream converts a DNS stamp to an Upstream
+// stampToUpstream converts a DNS stamp to an Upstream (see OptionsFromStamp)
 func stampToUpstream(address string, opts Options) (Upstream, error) {
-	stamp, err := dnsstamps.NewServerStampFromString(address)
+	addr, stampOpts, err := OptionsFromStamp(address)
 	if err != nil {
-		return nil, errorx.Decorate(err, "failed to parse %s", address)
+		return nil, err
 	}
 
-	if stamp.ServerAddrStr != "" {
-		host, _, err := net.SplitHostPort(stamp.ServerAddrStr)
-		if err != nil {
-			host = stamp.ServerAddrStr
-		}
-
-		// Parse and add to options
-		opts.ServerIP = net.ParseIP(host)
-		if opts.ServerIP == nil {
-			return nil, fmt.Errorf("invalid server address in the stamp: %s", stamp.ServerAddrStr)
+	if addr == address {
+		// DNSCrypt
+		if err := checkStampAddressFamily(address, opts.AddressFamily); err != nil {
+			return nil, err
 		}
+		return &dnsCrypt{boot: toBoot(address, opts.Bootstrap, opts.Timeout, opts.AddressFamily, opts.Logger, opts.bootstrapChain)}, nil
 	}
-
-	switch stamp.Proto {
-	case dnsstamps.StampProtoTypePlain:
-		return &plainDNS{address: stamp.ServerAddrStr, timeout: opts.Timeout}, nil
-	case dnsstamps.StampProtoTypeDNSCrypt:
-		return &dnsCrypt{boot: toBoot(address, opts.Bootstrap, opts.Timeout)}, nil
-	case dnsstamps.StampProtoTypeDoH:
-		return AddressToUpstream(fmt.Sprintf("https://%s%s", stamp.ProviderName, stamp.Path), opts)
-	case dnsstamps.StampProtoTypeTLS:
-		return AddressToUpstream(fmt.Sprintf("tls://%s", stamp.ProviderName), opts)
+	if stampOpts.ServerIP != nil {
+		opts.ServerIP = stampOpts.ServerIP
 	}
-
-	return nil, fmt.Errorf("unsupported protocol %v in %s", stamp.Proto, address)
+	if stampOpts.CertificateHashes != nil {
+		opts.CertificateHashes = stampOpts.CertificateHashes
+	}
+	return AddressToUpstream(addr, opts)
 }
 
 // getHostWithPort is a helper function that appends port if needed
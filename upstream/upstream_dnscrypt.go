@@ -6,7 +6,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/ameshkov/dnscrypt"
 	"github.com/joomcode/errorx"
 	"github.com/miekg/dns"
@@ -76,7 +75,9 @@ func (p *dnsCrypt) exchangeDNSCrypt(m *dns.Msg) (*dns.Msg, error) {
 	reply, _, err := client.Exchange(m, serverInfo)
 
 	if reply != nil && reply.Truncated {
-		log.Tracef("Truncated message was received, retrying over TCP, question: %s", m.Question[0].String())
+		if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("Truncated message was received, retrying over TCP, question: %s", m.Question[0].String())
+		}
 		tcpClient := dnscrypt.Client{Timeout: p.boot.timeout, Proto: "tcp"}
 		reply, _, err = tcpClient.Exchange(m, serverInfo)
 	}
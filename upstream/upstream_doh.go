@@ -2,9 +2,12 @@ package upstream
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 
@@ -28,6 +31,14 @@ type dnsOverHTTPS struct {
 	// needed. Clients are safe for concurrent use by multiple goroutines.
 	client *http.Client
 
+	idleTimeout time.Duration // see Options.IdleTimeout
+
+	headers http.Header // the headers added to the requests (see Options.HTTPHeaders)
+	host    string      // the Host header of the requests (the host of the URL if empty)
+
+	redirectURL  string     // the final URL of the redirected queries (see setRedirectURL)
+	redirectLock sync.Mutex // protects redirectURL (getClient sends the warm-up query with the lock below held)
+
 	sync.RWMutex // protects transport
 }
 
@@ -46,6 +57,9 @@ func (p *dnsOverHTTPS) Exchange(m *dns.Msg) (*dns.Msg, error) {
 			p.client = nil // this connection is no longer usable
 		}
 		p.Unlock()
+		p.redirectLock.Lock()
+		p.redirectURL = ""
+		p.redirectLock.Unlock()
 	}
 	return r, err
 }
@@ -58,12 +72,24 @@ func (p *dnsOverHTTPS) exchangeHTTPSClient(m *dns.Msg, client *http.Client) (*dn
 	}
 
 	// It appears, that GET requests are more memory-efficient with Golang implementation of HTTP/2.
-	requestURL := p.boot.address + "?dns=" + base64.RawURLEncoding.EncodeToString(buf)
+	base := p.requestBase()
+	sep := "?"
+	if strings.Contains(base, "?") {
+		sep = "&"
+	}
+	requestURL := base + sep + "dns=" + base64.RawURLEncoding.EncodeToString(buf)
 	req, err := http.NewRequest("GET", requestURL, nil)
 	if err != nil {
 		return nil, errorx.Decorate(err, "couldn't create a HTTP request to %s", p.boot.address)
 	}
+	for name, values := range p.headers {
+		req.Header[name] = values
+	}
 	req.Header.Set("Accept", "application/dns-message")
+	if p.host != "" {
+		// only the Host header is changed, the connection and TLS still use the host of the URL
+		req.Host = p.host
+	}
 
 	resp, err := client.Do(req)
 	if resp != nil && resp.Body != nil {
@@ -88,6 +114,10 @@ func (p *dnsOverHTTPS) exchangeHTTPSClient(m *dns.Msg, client *http.Client) (*dn
 	if err == nil && response.Id != m.Id {
 		err = dns.ErrId
 	}
+	if err == nil && resp.Request != nil && resp.Request.Response != nil {
+		// the request has been redirected
+		p.setRedirectURL(resp.Request.URL)
+	}
 	return &response, err
 }
 
@@ -108,15 +138,20 @@ func (p *dnsOverHTTPS) getClient() (*http.Client, error) {
 		return nil, fmt.Errorf("timeout exceeded: %d ms", int(elapsed/time.Millisecond))
 	}
 
-	transport, err := p.createTransport()
+	transport, err := p.createTransport(p.boot)
 	if err != nil {
 		return nil, errorx.Decorate(err, "couldn't initialize HTTP transport")
 	}
 
+	upstreamURL, err := url.Parse(p.boot.address)
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't parse %s", p.boot.address)
+	}
 	client := &http.Client{
-		Transport: transport,
-		Timeout:   p.boot.timeout,
-		Jar:       nil,
+		Transport:     &dohTransport{p: p, host: hostWithDefaultPort(upstreamURL), main: transport},
+		CheckRedirect: p.checkRedirect,
+		Timeout:       p.boot.timeout,
+		Jar:           nil,
 	}
 
 	// Warming up the HTTP client.
@@ -137,11 +172,11 @@ func (p *dnsOverHTTPS) getClient() (*http.Client, error) {
 }
 
 // createTransport initializes an HTTP transport that will be used specifically for this DOH resolver
-// This HTTP transport ensures that the HTTP requests will be sent exactly to the IP address got from the bootstrap resolver
-func (p *dnsOverHTTPS) createTransport() (*http.Transport, error) {
-	tlsConfig, dialContext, err := p.boot.get()
+// This HTTP transport ensures that the HTTP requests will be sent exactly to the IP address got from the bootstrap resolver b
+func (p *dnsOverHTTPS) createTransport(b *bootstrapper) (*http.Transport, error) {
+	tlsConfig, dialContext, err := b.get()
 	if err != nil {
-		return nil, errorx.Decorate(err, "couldn't bootstrap %s", p.boot.address)
+		return nil, errorx.Decorate(err, "couldn't bootstrap %s", b.address)
 	}
 
 	transport := &http.Transport{
@@ -150,6 +185,7 @@ func (p *dnsOverHTTPS) createTransport() (*http.Transport, error) {
 		DialContext:        dialContext,
 		MaxConnsPerHost:    DohMaxConnsPerHost,
 		MaxIdleConns:       1,
+		IdleConnTimeout:    p.idleTimeout,
 	}
 	// It appears that this is important to explicitly configure transport to use HTTP2
 	// Relevant issue: https://github.com/AdguardTeam/dnsproxy/issues/11
@@ -157,3 +193,39 @@ func (p *dnsOverHTTPS) createTransport() (*http.Transport, error) {
 
 	return transport, nil
 }
+
+// dohHeaders returns the headers of the DoH requests: Options.HTTPHeaders and the "header=Name:Value" parameters
+// of the URL fragment (e.g. https://dns.example/dns-query#header=X-Api-Key:abc), the latter take precedence.
+// The Host header is returned separately. The fragment is removed from the URL, so the headers aren't written
+// to the logs with the address of the upstream.
+func dohHeaders(upstreamURL *url.URL, opts map[string]string) (headers http.Header, host string, err error) {
+	headers = http.Header{}
+	for name, value := range opts {
+		headers.Set(name, value)
+	}
+
+	if upstreamURL.Fragment != "" {
+		params, err := url.ParseQuery(upstreamURL.Fragment)
+		if err != nil {
+			return nil, "", errorx.Decorate(err, "invalid URL fragment")
+		}
+		for _, h := range params["header"] {
+			kv := strings.SplitN(h, ":", 2)
+			if len(kv) != 2 {
+				// the value isn't in the error, it may be a secret
+				return nil, "", errors.New("invalid header in the URL fragment, must be Name:Value")
+			}
+			headers.Set(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+		}
+		upstreamURL.Fragment = ""
+	}
+
+	for name := range headers {
+		if name == "" || strings.ContainsAny(name, " \t:") {
+			return nil, "", fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	host = headers.Get("Host")
+	headers.Del("Host")
+	return headers, host, nil
+}
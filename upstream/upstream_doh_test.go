@@ -0,0 +1,203 @@
+package upstream
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoHHeaders(t *testing.T) {
+	u, err := url.Parse("https://dns.example.org/dns-query#header=X-Api-Key:secret&header=Host:cdn.example.org")
+	require.NoError(t, err)
+	headers, host, err := dohHeaders(u, map[string]string{"x-api-key": "default", "X-Client": "dnsproxy"})
+	require.NoError(t, err)
+	assert.Equal(t, "secret", headers.Get("X-Api-Key"))
+	assert.Equal(t, "dnsproxy", headers.Get("X-Client"))
+	assert.Empty(t, headers.Get("Host"))
+	assert.Equal(t, "cdn.example.org", host)
+	assert.Equal(t, "https://dns.example.org/dns-query", u.String())
+
+	for _, fragment := range []string{"header=secret", "header=X%20Api:abc", "header=:abc"} {
+		u, err = url.Parse("https://dns.example.org/dns-query#" + fragment)
+		require.NoError(t, err)
+		_, _, err = dohHeaders(u, nil)
+		require.Error(t, err, fragment)
+		assert.NotContains(t, err.Error(), "secret")
+	}
+}
+
+func TestDoHHeadersExchange(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "cdn.example.org", r.Host)
+		assert.Equal(t, "example.com", r.TLS.ServerName)
+		if r.Header.Get("X-Api-Key") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		buf, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		require.NoError(t, err)
+		req := &dns.Msg{}
+		require.NoError(t, req.Unpack(buf))
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IP{1, 2, 3, 4},
+		}}
+		packed, err := resp.Pack()
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(packed)
+	}))
+	defer srv.Close()
+
+	// the certificate of the test server is issued for example.com
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	oldRoots := RootCAs
+	RootCAs = roots
+	defer func() { RootCAs = oldRoots }()
+
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	require.NoError(t, err)
+	address := "https://example.com:" + port + "/dns-query#header=Host:cdn.example.org"
+	u, err := AddressToUpstream(address, Options{
+		Timeout:     time.Second,
+		ServerIP:    net.IP{127, 0, 0, 1},
+		HTTPHeaders: map[string]string{"X-Api-Key": "secret"},
+	})
+	require.NoError(t, err)
+	assert.False(t, strings.Contains(u.Address(), "#"), u.Address())
+
+	req := &dns.Msg{}
+	req.SetQuestion("example.org.", dns.TypeA)
+	resp, err := u.Exchange(req)
+	require.NoError(t, err)
+	require.Len(t, resp.Answer, 1)
+
+	// the certificate hashes of the stamp are checked
+	digest := sha256.Sum256(srv.Certificate().RawTBSCertificate)
+	for _, hash := range [][]byte{digest[:], make([]byte, sha256.Size)} {
+		stamp, err := StampFromOptions("https://example.com:"+port+"/dns-query", &Options{
+			ServerIP:          net.IP{127, 0, 0, 1},
+			CertificateHashes: [][]byte{hash},
+		})
+		require.NoError(t, err)
+		headers := map[string]string{"X-Api-Key": "secret", "Host": "cdn.example.org"}
+		u, err = AddressToUpstream(stamp, Options{Timeout: time.Second, HTTPHeaders: headers})
+		require.NoError(t, err)
+		_, err = u.Exchange(req)
+		assert.Equal(t, bytes.Equal(hash, digest[:]), err == nil, err)
+	}
+}
+
+// dohAnswer writes the response with 1.2.3.4 to the DoH query of r
+func dohAnswer(t *testing.T, w http.ResponseWriter, r *http.Request) {
+	buf, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	require.NoError(t, err)
+	req := &dns.Msg{}
+	require.NoError(t, req.Unpack(buf))
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IP{1, 2, 3, 4},
+	}}
+	packed, err := resp.Pack()
+	require.NoError(t, err)
+	w.Header().Set("Content-Type", "application/dns-message")
+	_, _ = w.Write(packed)
+}
+
+func TestDoHRedirect(t *testing.T) {
+	var siblingQueries int32
+	sibling := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&siblingQueries, 1)
+		dohAnswer(t, w, r)
+	}))
+	defer sibling.Close()
+
+	var paths []string
+	var mu sync.Mutex
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		location := map[string]string{
+			"/moved":    "/dns-query",
+			"/loop":     "/loop2",
+			"/loop2":    "/loop",
+			"/insecure": "http://example.com/dns-query",
+			"/sibling":  sibling.URL + "/dns-query",
+		}[r.URL.Path]
+		if location == "" {
+			dohAnswer(t, w, r)
+			return
+		}
+		http.Redirect(w, r, location+"?"+r.URL.RawQuery, http.StatusTemporaryRedirect)
+	}))
+	defer srv.Close()
+
+	// the certificate of the test servers is issued for example.com and 127.0.0.1
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	oldRoots := RootCAs
+	RootCAs = roots
+	defer func() { RootCAs = oldRoots }()
+
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	require.NoError(t, err)
+	exchange := func(path string, hashes [][]byte) error {
+		opts := Options{Timeout: time.Second, ServerIP: net.IP{127, 0, 0, 1}, CertificateHashes: hashes}
+		u, err := AddressToUpstream("https://example.com:"+port+path, opts)
+		require.NoError(t, err)
+		for i := 0; i < 2; i++ {
+			req := &dns.Msg{}
+			req.SetQuestion("example.org.", dns.TypeA)
+			resp, err := u.Exchange(req)
+			if err != nil {
+				return err
+			}
+			require.Len(t, resp.Answer, 1)
+		}
+		return nil
+	}
+
+	// the final URL is used by the next queries
+	require.NoError(t, exchange("/moved", nil))
+	assert.Equal(t, []string{"/moved", "/dns-query", "/dns-query", "/dns-query"}, paths)
+
+	err = exchange("/loop", nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "redirect loop")
+
+	err = exchange("/insecure", nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "non-HTTPS")
+
+	// the other hosts are only allowed when the certificate hashes are checked
+	err = exchange("/sibling", nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cross-origin")
+
+	digest := sha256.Sum256(srv.Certificate().RawTBSCertificate)
+	paths = nil
+	require.NoError(t, exchange("/sibling", [][]byte{digest[:]}))
+	assert.Equal(t, []string{"/sibling"}, paths)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&siblingQueries))
+}
@@ -3,8 +3,8 @@ package upstream
 import (
 	"net"
 	"sync"
+	"time"
 
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/joomcode/errorx"
 	"github.com/miekg/dns"
 )
@@ -13,8 +13,9 @@ import (
 // DNS-over-TLS
 //
 type dnsOverTLS struct {
-	boot *bootstrapper
-	pool *TLSPool
+	boot        *bootstrapper
+	pool        *TLSPool
+	idleTimeout time.Duration // see Options.IdleTimeout
 
 	sync.RWMutex // protects pool
 }
@@ -29,7 +30,7 @@ func (p *dnsOverTLS) Exchange(m *dns.Msg) (*dns.Msg, error) {
 	if pool == nil {
 		p.Lock()
 		// lazy initialize it
-		p.pool = &TLSPool{boot: p.boot}
+		p.pool = &TLSPool{boot: p.boot, idleTimeout: p.idleTimeout}
 		p.Unlock()
 	}
 
@@ -42,7 +43,9 @@ func (p *dnsOverTLS) Exchange(m *dns.Msg) (*dns.Msg, error) {
 
 	reply, err := p.exchangeConn(poolConn, m)
 	if err != nil {
-		log.Tracef("The TLS connection is expired due to %s", err)
+		if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("The TLS connection is expired due to %s", err)
+		}
 
 		// The pooled connection might have been closed already (see https://github.com/AdguardTeam/dnsproxy/issues/3)
 		// So we're trying to re-connect right away here.
@@ -3,7 +3,7 @@ package upstream
 import (
 	"time"
 
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/miekg/dns"
 )
 
@@ -14,6 +14,9 @@ type plainDNS struct {
 	address   string
 	timeout   time.Duration
 	preferTCP bool
+	udpOnly   bool          // never retry over TCP, the truncated responses are returned as is (udp:// upstreams)
+	family    AddressFamily // the host names are only resolved and dialed in this family (see Options.AddressFamily)
+	log       proxyutil.Logger
 }
 
 // Address returns the original address that we've put in initially, not resolved one
@@ -21,16 +24,18 @@ func (p *plainDNS) Address() string { return p.address }
 
 func (p *plainDNS) Exchange(m *dns.Msg) (*dns.Msg, error) {
 	if p.preferTCP {
-		tcpClient := dns.Client{Net: "tcp", Timeout: p.timeout}
+		tcpClient := dns.Client{Net: p.family.network("tcp"), Timeout: p.timeout}
 		reply, _, tcpErr := tcpClient.Exchange(m, p.address)
 		return reply, tcpErr
 	}
 
-	client := dns.Client{Timeout: p.timeout, UDPSize: dns.MaxMsgSize}
+	client := dns.Client{Net: p.family.network("udp"), Timeout: p.timeout, UDPSize: dns.MaxMsgSize}
 	reply, _, err := client.Exchange(m, p.address)
-	if reply != nil && reply.Truncated {
-		log.Tracef("Truncated message was received, retrying over TCP, question: %s", m.Question[0].String())
-		tcpClient := dns.Client{Net: "tcp", Timeout: p.timeout}
+	if reply != nil && reply.Truncated && !p.udpOnly {
+		if l := p.logger(); l.DebugEnabled() {
+			l.Debugf("Truncated message was received, retrying over TCP, question: %s", m.Question[0].String())
+		}
+		tcpClient := dns.Client{Net: p.family.network("tcp"), Timeout: p.timeout}
 		reply, _, err = tcpClient.Exchange(m, p.address)
 	}
 
@@ -0,0 +1,66 @@
+package upstream
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveTruncating starts the UDP server that always responds with TC set
+// and the TCP server on the same port that responds with the answer
+func serveTruncating(t *testing.T) (addr string, stop func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", conn.LocalAddr().String())
+	require.NoError(t, err)
+
+	handler := func(truncated bool) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, r *dns.Msg) {
+			resp := &dns.Msg{}
+			resp.SetReply(r)
+			resp.Truncated = truncated
+			if !truncated {
+				resp.Answer = []dns.RR{&dns.A{
+					Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.IP{1, 2, 3, 4},
+				}}
+			}
+			_ = w.WriteMsg(resp)
+		}
+	}
+	udpServer := &dns.Server{PacketConn: conn, Handler: handler(true)}
+	tcpServer := &dns.Server{Listener: l, Handler: handler(false)}
+	go func() { _ = udpServer.ActivateAndServe() }()
+	go func() { _ = tcpServer.ActivateAndServe() }()
+	return conn.LocalAddr().String(), func() {
+		_ = udpServer.Shutdown()
+		_ = tcpServer.Shutdown()
+	}
+}
+
+func TestUDPOnly(t *testing.T) {
+	addr, stop := serveTruncating(t)
+	defer stop()
+
+	req := &dns.Msg{}
+	req.SetQuestion("example.org.", dns.TypeA)
+
+	// the plain DNS upstream retries the truncated responses over TCP
+	u, err := AddressToUpstream(addr, Options{Timeout: timeout})
+	require.NoError(t, err)
+	res, err := u.Exchange(req)
+	require.NoError(t, err)
+	assert.False(t, res.Truncated)
+	assert.Len(t, res.Answer, 1)
+
+	u, err = AddressToUpstream("udp://"+addr, Options{Timeout: timeout})
+	require.NoError(t, err)
+	assert.Equal(t, addr, u.Address())
+	res, err = u.Exchange(req)
+	require.NoError(t, err)
+	assert.True(t, res.Truncated)
+	assert.Empty(t, res.Answer)
+}
@@ -7,7 +7,7 @@ import (
 	"sync"
 	"time"
 
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/joomcode/errorx"
 )
 
@@ -30,11 +30,13 @@ const dialTimeout = 10 * time.Second
 //  log.Println(r)
 //  pool.Put(c.Conn)
 type TLSPool struct {
-	boot *bootstrapper
+	boot        *bootstrapper
+	idleTimeout time.Duration // the pooled connections are closed after this period (0: never)
 
 	// connections
 	conns      []net.Conn
-	connsMutex sync.Mutex // protects conns
+	timers     map[net.Conn]*time.Timer // the idle timers of the pooled connections (if idleTimeout is set)
+	connsMutex sync.Mutex               // protects conns and timers
 }
 
 // Get gets or creates a new TLS connection
@@ -47,6 +49,10 @@ func (n *TLSPool) Get() (net.Conn, error) {
 		last := num - 1
 		c = n.conns[last]
 		n.conns = n.conns[:last]
+		if t, ok := n.timers[c]; ok {
+			t.Stop()
+			delete(n.timers, c)
+		}
 	}
 	n.connsMutex.Unlock()
 
@@ -56,7 +62,9 @@ func (n *TLSPool) Get() (net.Conn, error) {
 
 		// If deadLine can't be updated it means that connection was already closed
 		if err == nil {
-			log.Tracef("Returning existing connection to %s with updated deadLine", c.RemoteAddr())
+			if l := n.logger(); l.DebugEnabled() {
+				l.Debugf("Returning existing connection to %s with updated deadLine", c.RemoteAddr())
+			}
 			return c, nil
 		}
 	}
@@ -72,7 +80,7 @@ func (n *TLSPool) Create() (net.Conn, error) {
 	}
 
 	// we'll need a new connection, dial now
-	conn, err := tlsDial(dialContext, "tcp", tlsConfig)
+	conn, err := tlsDial(dialContext, "tcp", tlsConfig, n.logger())
 	if err != nil {
 		return nil, errorx.Decorate(err, "Failed to connect to %s", tlsConfig.ServerName)
 	}
@@ -86,11 +94,39 @@ func (n *TLSPool) Put(c net.Conn) {
 	}
 	n.connsMutex.Lock()
 	n.conns = append(n.conns, c)
+	if n.idleTimeout > 0 {
+		if n.timers == nil {
+			n.timers = map[net.Conn]*time.Timer{}
+		}
+		n.timers[c] = time.AfterFunc(n.idleTimeout, func() { n.expire(c) })
+	}
+	n.connsMutex.Unlock()
+}
+
+// expire closes the connection if it is still in the pool
+func (n *TLSPool) expire(c net.Conn) {
+	n.connsMutex.Lock()
+	found := false
+	for i, conn := range n.conns {
+		if conn == c {
+			n.conns = append(n.conns[:i], n.conns[i+1:]...)
+			delete(n.timers, c)
+			found = true
+			break
+		}
+	}
 	n.connsMutex.Unlock()
+
+	if found {
+		if l := n.logger(); l.DebugEnabled() {
+			l.Debugf("Closing the idle connection to %s", c.RemoteAddr())
+		}
+		_ = c.Close()
+	}
 }
 
 // tlsDial is basically the same as tls.DialWithDialer, but we will call our own dialContext function to get connection
-func tlsDial(dialContext dialHandler, network string, config *tls.Config) (*tls.Conn, error) {
+func tlsDial(dialContext dialHandler, network string, config *tls.Config, l proxyutil.Logger) (*tls.Conn, error) {
 	// we're using bootstrapped address instead of what's passed to the function
 	rawConn, err := dialContext(context.TODO(), network, "")
 	if err != nil {
@@ -102,7 +138,7 @@ func tlsDial(dialContext dialHandler, network string, config *tls.Config) (*tls.
 	conn := tls.Client(rawConn, config)
 	err = conn.SetDeadline(time.Now().Add(dialTimeout))
 	if err != nil {
-		log.Printf("DeadLine is not supported cause: %s", err)
+		l.Infof("DeadLine is not supported cause: %s", err)
 		conn.Close()
 		return nil, err
 	}
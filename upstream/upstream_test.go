@@ -260,7 +260,7 @@ func TestDialContext(t *testing.T) {
 		},
 	}
 	for _, test := range resolved {
-		dialContext := createDialContext(test.addresses, 2*time.Second)
+		dialContext := createDialContext(test.addresses, 2*time.Second, 0, AddressFamilyAuto, nil)
 		_, err := dialContext(context.TODO(), "tcp", "")
 		if err != nil {
 			t.Fatalf("Couldn't dial to %s: %s", test.host, err)
@@ -543,3 +543,22 @@ func assertResponse(t *testing.T, reply *dns.Msg) {
 		t.Fatalf("DNS upstream returned wrong answer type instead of A: %v", reply.Answer[0])
 	}
 }
+
+func TestIsEncrypted(t *testing.T) {
+	for address, encrypted := range map[string]bool{
+		"8.8.8.8:53":                     false,
+		"tcp://8.8.8.8:53":               false,
+		"tls://1.1.1.1":                  true,
+		"https://1.1.1.1/dns-query":      true,
+		"sdns://AAcAAAAAAAAABzguOC44Ljg": false,
+		"sdns://AQIAAAAAAAAAFDE3Ni4xMDMuMTMwLjEzMDo1NDQzINErR_JS3PLCu_iZEIbq95zkSV2LFsigxDIuUso_OQhzIjIuZG5zY3J5cHQuZGVmYXVsdC5uczEuYWRndWFyZC5jb20": true,
+	} {
+		u, err := AddressToUpstream(address, Options{Timeout: time.Second})
+		if err != nil {
+			t.Fatalf("cannot create the upstream %s: %s", address, err)
+		}
+		if IsEncrypted(u) != encrypted {
+			t.Fatalf("IsEncrypted(%s) must be %v", address, encrypted)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package upstream
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+
+	"github.com/joomcode/errorx"
+)
+
+// VerifyCertificate is called for the upstream certificates that can't be verified with RootCAs,
+// e.g. to delegate the verification to the platform trust store on mobile.
+// rawCerts is the DER-encoded certificate chain sent by the server, the leaf certificate first.
+// The host name is verified before calling it, so it only needs to check that the chain is trusted.
+// It's used for the connections created after it's set.
+// nolint
+var VerifyCertificate func(host string, rawCerts [][]byte) error
+
+// setCertificateVerifier makes tlsConfig verify the certificates with roots first and then with verify
+func setCertificateVerifier(tlsConfig *tls.Config, host string, roots *x509.CertPool, verify func(host string, rawCerts [][]byte) error) {
+	// the standard verification is replaced with verifyPeerCertificate
+	tlsConfig.InsecureSkipVerify = true
+	tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		return verifyPeerCertificate(host, rawCerts, roots, verify)
+	}
+}
+
+// verifyPeerCertificate checks that the certificate chain is issued for host and is trusted
+// either by roots or by verify
+func verifyPeerCertificate(host string, rawCerts [][]byte, roots *x509.CertPool, verify func(host string, rawCerts [][]byte) error) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no certificates sent by the server")
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return errorx.Decorate(err, "failed to parse the server certificate")
+		}
+		certs[i] = cert
+	}
+
+	err := certs[0].VerifyHostname(host)
+	if err != nil {
+		return err
+	}
+
+	opts := x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err = certs[0].Verify(opts)
+	if err == nil {
+		return nil
+	}
+
+	verifyErr := verify(host, rawCerts)
+	if verifyErr != nil {
+		return errorx.Decorate(verifyErr, "certificate verification failed: %s", err)
+	}
+	return nil
+}
+
+// setCertificateHashes makes tlsConfig also check that the chain has one of the certificates with the hashes
+// (see Options.CertificateHashes)
+func setCertificateHashes(tlsConfig *tls.Config, hashes [][]byte) {
+	if len(hashes) == 0 {
+		return
+	}
+	verify := tlsConfig.VerifyPeerCertificate
+	tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+		if verify != nil {
+			if err := verify(rawCerts, chains); err != nil {
+				return err
+			}
+		}
+		return verifyCertificateHashes(rawCerts, hashes)
+	}
+}
+
+// verifyCertificateHashes checks that the SHA256 digest of the TBS part of one of the certificates is in hashes
+func verifyCertificateHashes(rawCerts [][]byte, hashes [][]byte) error {
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return errorx.Decorate(err, "failed to parse the server certificate")
+		}
+		digest := sha256.Sum256(cert.RawTBSCertificate)
+		for _, h := range hashes {
+			if bytes.Equal(digest[:], h) {
+				return nil
+			}
+		}
+	}
+	return errors.New("none of the server certificates matches the certificate hashes")
+}
@@ -0,0 +1,110 @@
+package upstream
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createTestChain creates a CA and a leaf certificate for host signed by it
+func createTestChain(t *testing.T, host string) (*x509.Certificate, [][]byte) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+	return ca, [][]byte{leafDER, caDER}
+}
+
+func TestVerifyPeerCertificate(t *testing.T) {
+	ca, chain := createTestChain(t, "dns.example.org")
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	calls := 0
+	var verifyErr error
+	verify := func(host string, rawCerts [][]byte) error {
+		calls++
+		assert.Equal(t, "dns.example.org", host)
+		assert.Equal(t, chain, rawCerts)
+		return verifyErr
+	}
+
+	// trusted by the roots, the callback isn't called
+	assert.NoError(t, verifyPeerCertificate("dns.example.org", chain, roots, verify))
+	assert.Equal(t, 0, calls)
+
+	// not trusted by the roots, the callback decides
+	assert.NoError(t, verifyPeerCertificate("dns.example.org", chain, x509.NewCertPool(), verify))
+	assert.Equal(t, 1, calls)
+	verifyErr = errors.New("untrusted")
+	assert.Error(t, verifyPeerCertificate("dns.example.org", chain, x509.NewCertPool(), verify))
+	assert.Equal(t, 2, calls)
+
+	// the host name is always checked
+	assert.Error(t, verifyPeerCertificate("dns.example.net", chain, roots, verify))
+	assert.Error(t, verifyPeerCertificate("dns.example.org", nil, roots, verify))
+	assert.Equal(t, 2, calls)
+}
+
+func TestCreateTLSConfigVerifier(t *testing.T) {
+	tlsConfig := createTLSConfig("dns.example.org")
+	assert.False(t, tlsConfig.InsecureSkipVerify)
+	assert.Nil(t, tlsConfig.VerifyPeerCertificate)
+
+	VerifyCertificate = func(host string, rawCerts [][]byte) error {
+		return nil
+	}
+	defer func() { VerifyCertificate = nil }()
+	tlsConfig = createTLSConfig("dns.example.org")
+	assert.True(t, tlsConfig.InsecureSkipVerify)
+	assert.NotNil(t, tlsConfig.VerifyPeerCertificate)
+}
+
+func TestVerifyCertificateHashes(t *testing.T) {
+	ca, chain := createTestChain(t, "dns.example.org")
+	digest := sha256.Sum256(ca.RawTBSCertificate)
+	assert.NoError(t, verifyCertificateHashes(chain, [][]byte{{1, 2, 3}, digest[:]}))
+	assert.Error(t, verifyCertificateHashes(chain, [][]byte{{1, 2, 3}}))
+
+	// the hashes are checked by the TLS config
+	tlsConfig := createTLSConfig("dns.example.org")
+	setCertificateHashes(tlsConfig, [][]byte{digest[:]})
+	require.NotNil(t, tlsConfig.VerifyPeerCertificate)
+	assert.NoError(t, tlsConfig.VerifyPeerCertificate(chain, nil))
+	assert.Error(t, tlsConfig.VerifyPeerCertificate(chain[:1], nil))
+}
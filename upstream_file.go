@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// upstreamFileCheckInterval is how often the modification time of the upstreams file is checked
+const upstreamFileCheckInterval = 5 * time.Second
+
+// watchUpstreamFile sends to changed when the modification time or the size of the file changes
+// until stop is closed. The errors (e.g. the file is being replaced) are ignored until the file is back.
+func watchUpstreamFile(path string, interval time.Duration, changed chan<- struct{}, stop <-chan struct{}) {
+	var modTime time.Time
+	var size int64
+	if fi, err := os.Stat(path); err == nil {
+		modTime, size = fi.ModTime(), fi.Size()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil || (fi.ModTime().Equal(modTime) && fi.Size() == size) {
+			continue
+		}
+		modTime, size = fi.ModTime(), fi.Size()
+
+		// don't block if the previous change is yet to be applied
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchUpstreamFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy-upstreams")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "upstreams.txt")
+	require.NoError(t, ioutil.WriteFile(path, []byte("8.8.8.8\n"), 0644))
+
+	changed := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go watchUpstreamFile(path, 10*time.Millisecond, changed, stop)
+
+	select {
+	case <-changed:
+		t.Fatal("unchanged file is reported")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("8.8.8.8\n1.1.1.1\n"), 0644))
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		assert.Fail(t, "changed file isn't reported")
+	}
+}